@@ -2,10 +2,11 @@ package mongodb
 
 import (
 	"context"
-	"errors"
 	"fmt"
 	"time"
 
+	"github.com/efimovalex/replaceme/internal/apperr"
+	"github.com/efimovalex/replaceme/internal/requestid"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
@@ -31,13 +32,14 @@ func (db *Client) FindOneUserByEmail(ctx context.Context, email string) (*User,
 	u := User{}
 
 	filter := bson.M{"email": email}
+	requestid.Logger(ctx, db.logger).Debug().Msgf("%s.findOne %v", userCollection, filter)
 	err := db.Users.FindOne(ctx, filter).Decode(&u)
 	if err != nil {
 		if err == mongo.ErrNoDocuments {
 			return nil, nil
 		}
 
-		return nil, err
+		return nil, apperr.Internal(err)
 	}
 
 	return &u, nil
@@ -46,17 +48,17 @@ func (db *Client) FindOneUserByEmail(ctx context.Context, email string) (*User,
 // Insert sanitizes and inserts a User in database
 func (db *Client) InsertUser(ctx context.Context, u *User) error {
 	if u == nil {
-		return errors.New("user is nil")
+		return apperr.Validation(apperr.CodeUserRequired, "user is nil")
 	}
 
 	if u.Password == "" {
-		return errors.New("password is required")
+		return apperr.Validation(apperr.CodePasswordRequired, "password is required")
 	}
 
 	// hash password
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(u.Password), bcrypt.DefaultCost)
 	if err != nil {
-		return err
+		return apperr.Internal(err)
 	}
 	u.Password = string(hashedPassword)
 	u.ID = primitive.NewObjectID()
@@ -68,15 +70,24 @@ func (db *Client) InsertUser(ctx context.Context, u *User) error {
 	}
 
 	if user != nil {
-		return fmt.Errorf("user with email %v does already exist", u.Email)
+		return errUserEmailTaken(u.Email)
 	}
 
+	requestid.Logger(ctx, db.logger).Debug().Msgf("%s.insertOne {_id: %s, email: %s}", userCollection, u.ID.Hex(), u.Email)
 	ins, err := db.Users.InsertOne(ctx, *u)
 	if err != nil {
-		return err
+		if mongo.IsDuplicateKeyError(err) {
+			return errUserEmailTaken(u.Email).Wrap(err)
+		}
+
+		return apperr.Internal(err)
 	}
 
 	u.ID = ins.InsertedID.(primitive.ObjectID)
 
 	return nil
 }
+
+func errUserEmailTaken(email string) *apperr.Error {
+	return apperr.Conflict(apperr.CodeUserEmailTaken, fmt.Sprintf("user with email %v does already exist", email))
+}
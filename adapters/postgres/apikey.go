@@ -0,0 +1,153 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/efimovalex/replaceme/internal/apperr"
+
+	sq "github.com/Masterminds/squirrel"
+)
+
+// APIKey is a key authenticating a service or a partner
+type APIKey struct {
+	ID int `db:"id"`
+	// Prefix is the visible start of the key
+	Prefix string `db:"prefix"`
+	// SecretHash is the hex encoded SHA-256 hash of the secret part of the key
+	SecretHash string `db:"secret_hash"`
+	Name       string `db:"name"`
+	// Scopes are the space separated scopes granted to the key
+	Scopes     string     `db:"scopes"`
+	CreatedBy  string     `db:"created_by"`
+	ExpiresAt  *time.Time `db:"expires_at"`
+	CreatedAt  time.Time  `db:"created_at"`
+	LastUsedAt *time.Time `db:"last_used_at"`
+}
+
+// InsertAPIKey stores a new key
+func (db *Client) InsertAPIKey(ctx context.Context, k *APIKey) error {
+	stmt, args, err := sq.StatementBuilder.PlaceholderFormat(sq.Dollar).Insert("api_keys").
+		Columns("prefix", "secret_hash", "name", "scopes", "created_by", "expires_at").
+		Values(k.Prefix, k.SecretHash, k.Name, k.Scopes, k.CreatedBy, k.ExpiresAt).
+		Suffix("RETURNING id, created_at").ToSql()
+	if err != nil {
+		return apperr.Internal(err)
+	}
+	db.logQuery(ctx, stmt, args...)
+
+	if err := db.QueryRowxContext(ctx, stmt, args...).Scan(&k.ID, &k.CreatedAt); err != nil {
+		return apperr.Internal(err)
+	}
+
+	return nil
+}
+
+// FindAPIKeys loads all the keys, oldest first
+func (db *Client) FindAPIKeys(ctx context.Context) ([]APIKey, error) {
+	keys := []APIKey{}
+
+	stmt, args, err := sq.StatementBuilder.PlaceholderFormat(sq.Dollar).Select("*").
+		From("api_keys").OrderBy("id").ToSql()
+	if err != nil {
+		return nil, apperr.Internal(err)
+	}
+	db.logQuery(ctx, stmt, args...)
+
+	if err := db.SelectContext(ctx, &keys, stmt, args...); err != nil {
+		return nil, apperr.Internal(err)
+	}
+
+	return keys, nil
+}
+
+// FindAPIKey loads the key with given id, returns nil if not found
+func (db *Client) FindAPIKey(ctx context.Context, id int) (*APIKey, error) {
+	return db.findAPIKey(ctx, sq.Eq{"id": id})
+}
+
+// FindAPIKeyByPrefix loads the key with given prefix, returns nil if not found
+func (db *Client) FindAPIKeyByPrefix(ctx context.Context, prefix string) (*APIKey, error) {
+	return db.findAPIKey(ctx, sq.Eq{"prefix": prefix})
+}
+
+func (db *Client) findAPIKey(ctx context.Context, where sq.Eq) (*APIKey, error) {
+	k := APIKey{}
+
+	stmt, args, err := sq.StatementBuilder.PlaceholderFormat(sq.Dollar).Select("*").
+		From("api_keys").Where(where).Limit(1).ToSql()
+	if err != nil {
+		return nil, apperr.Internal(err)
+	}
+	db.logQuery(ctx, stmt, args...)
+
+	err = db.GetContext(ctx, &k, stmt, args...)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, apperr.Internal(err)
+	}
+	return &k, nil
+}
+
+// UpdateAPIKey saves the name, the scopes and the expiry of a key. It fails with a not found error if there is no
+// such key.
+func (db *Client) UpdateAPIKey(ctx context.Context, k *APIKey) error {
+	stmt, args, err := sq.StatementBuilder.PlaceholderFormat(sq.Dollar).Update("api_keys").
+		Set("name", k.Name).
+		Set("scopes", k.Scopes).
+		Set("expires_at", k.ExpiresAt).
+		Where(sq.Eq{"id": k.ID}).ToSql()
+	if err != nil {
+		return apperr.Internal(err)
+	}
+
+	ok, err := db.execUpdated(ctx, stmt, args...)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return apperr.NotFound(apperr.CodeAPIKeyNotFound, "api key not found")
+	}
+
+	return nil
+}
+
+// UpdateAPIKeyUse records a use of the key. It is only written once per minute, a key used by every request of a
+// batch job would otherwise cause a write per request.
+func (db *Client) UpdateAPIKeyUse(ctx context.Context, id int) error {
+	stmt, args, err := sq.StatementBuilder.PlaceholderFormat(sq.Dollar).Update("api_keys").
+		Set("last_used_at", sq.Expr("CURRENT_TIMESTAMP")).
+		Where(sq.And{
+			sq.Eq{"id": id},
+			sq.Or{sq.Eq{"last_used_at": nil}, sq.Expr("last_used_at < CURRENT_TIMESTAMP - INTERVAL '1 minute'")},
+		}).ToSql()
+	if err != nil {
+		return apperr.Internal(err)
+	}
+
+	_, err = db.execUpdated(ctx, stmt, args...)
+
+	return err
+}
+
+// DeleteAPIKey removes a key. It fails with a not found error if there is no such key.
+func (db *Client) DeleteAPIKey(ctx context.Context, id int) error {
+	stmt, args, err := sq.StatementBuilder.PlaceholderFormat(sq.Dollar).Delete("api_keys").
+		Where(sq.Eq{"id": id}).ToSql()
+	if err != nil {
+		return apperr.Internal(err)
+	}
+
+	ok, err := db.execUpdated(ctx, stmt, args...)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return apperr.NotFound(apperr.CodeAPIKeyNotFound, "api key not found")
+	}
+
+	return nil
+}
@@ -0,0 +1,62 @@
+package postgres
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClient_APIKeys(t *testing.T) {
+	db := NewTestDB(t)
+	defer func() {
+		db.ResetTable(t, "api_keys")
+	}()
+
+	ctx := context.Background()
+	expiresAt := time.Now().Add(24 * time.Hour).UTC().Truncate(time.Second)
+	k := APIKey{Prefix: "rk_a1b2c3d4", SecretHash: "hash", Name: "Nightly export", Scopes: "users:read", CreatedBy: "1", ExpiresAt: &expiresAt}
+	assert.NoError(t, db.InsertAPIKey(ctx, &k))
+	assert.NotZero(t, k.ID)
+	assert.False(t, k.CreatedAt.IsZero())
+	assert.Error(t, db.InsertAPIKey(ctx, &APIKey{Prefix: "rk_a1b2c3d4", SecretHash: "other", Name: "Duplicate"}))
+
+	got, err := db.FindAPIKeyByPrefix(ctx, "rk_a1b2c3d4")
+	assert.NoError(t, err)
+	if assert.NotNil(t, got) {
+		assert.Equal(t, k.ID, got.ID)
+		assert.Equal(t, "hash", got.SecretHash)
+		assert.Equal(t, "users:read", got.Scopes)
+		assert.Nil(t, got.LastUsedAt)
+	}
+	got, err = db.FindAPIKeyByPrefix(ctx, "rk_00000000")
+	assert.NoError(t, err)
+	assert.Nil(t, got)
+
+	k.Name = "Hourly export"
+	k.Scopes = "users:read users:write"
+	k.ExpiresAt = nil
+	assert.NoError(t, db.UpdateAPIKey(ctx, &k))
+	assert.EqualError(t, db.UpdateAPIKey(ctx, &APIKey{ID: k.ID + 1}), "api key not found")
+
+	assert.NoError(t, db.UpdateAPIKeyUse(ctx, k.ID))
+	got, err = db.FindAPIKey(ctx, k.ID)
+	assert.NoError(t, err)
+	if assert.NotNil(t, got) {
+		assert.Equal(t, "Hourly export", got.Name)
+		assert.Equal(t, "users:read users:write", got.Scopes)
+		assert.Nil(t, got.ExpiresAt)
+		assert.NotNil(t, got.LastUsedAt)
+	}
+
+	keys, err := db.FindAPIKeys(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, keys, 1)
+
+	assert.EqualError(t, db.DeleteAPIKey(ctx, k.ID+1), "api key not found")
+	assert.NoError(t, db.DeleteAPIKey(ctx, k.ID))
+	keys, err = db.FindAPIKeys(ctx)
+	assert.NoError(t, err)
+	assert.Empty(t, keys)
+}
@@ -2,6 +2,7 @@
 package postgres
 
 import (
+	"context"
 
 	// sql driver
 	"fmt"
@@ -12,6 +13,7 @@ import (
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 
+	"github.com/efimovalex/replaceme/internal/requestid"
 	"github.com/jmoiron/sqlx"
 )
 
@@ -55,8 +57,8 @@ func (c *Client) Ping() error {
 	return c.DB.Ping()
 }
 
-// logQuery logs the query and its parameter values
-func (db *Client) logQuery(query string,
+// logQuery logs the query and its parameter values with the request id found in ctx
+func (db *Client) logQuery(ctx context.Context, query string,
 	args ...interface{}) {
 	query = regexp.MustCompile(`\s+`).ReplaceAllString(query, " ")
 	q := regexp.MustCompile(`\$\d`).ReplaceAllString(query, "%v")
@@ -90,5 +92,5 @@ func (db *Client) logQuery(query string,
 
 	}
 
-	db.logger.Debug().Msgf(q, a...)
+	requestid.Logger(ctx, db.logger).Debug().Msgf(q, a...)
 }
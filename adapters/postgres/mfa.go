@@ -0,0 +1,222 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/efimovalex/replaceme/internal/apperr"
+	"github.com/jmoiron/sqlx"
+
+	sq "github.com/Masterminds/squirrel"
+)
+
+// UserTOTP is the TOTP second factor of a user
+type UserTOTP struct {
+	UserID int `db:"user_id"`
+	// Secret is the encrypted TOTP secret
+	Secret string `db:"secret"`
+	// ConfirmedAt is set once the user proved the enrollment with a code, the factor is not enforced until then
+	ConfirmedAt  *time.Time `db:"confirmed_at"`
+	LastUsedStep int64      `db:"last_used_step"`
+	CreatedAt    time.Time  `db:"created_at"`
+}
+
+// Confirmed reports whether the factor is enabled
+func (t *UserTOTP) Confirmed() bool {
+	return t != nil && t.ConfirmedAt != nil
+}
+
+// FindUserTOTP loads the TOTP factor of the user with given id, returns nil if not enrolled
+func (db *Client) FindUserTOTP(ctx context.Context, userID int) (*UserTOTP, error) {
+	t := UserTOTP{}
+
+	stmt, args, err := sq.StatementBuilder.PlaceholderFormat(sq.Dollar).Select("*").
+		From("user_totp").Where(sq.Eq{"user_id": userID}).Limit(1).ToSql()
+	if err != nil {
+		return nil, apperr.Internal(err)
+	}
+
+	db.logQuery(ctx, stmt, args...)
+
+	err = db.GetContext(ctx, &t, stmt, args...)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, apperr.Internal(err)
+	}
+	return &t, nil
+}
+
+// SaveUserTOTP stores a new unconfirmed TOTP secret of the user, replacing an unconfirmed one.
+// It fails with a conflict error if the user has a confirmed factor.
+func (db *Client) SaveUserTOTP(ctx context.Context, userID int, secret string) error {
+	stmt, args, err := sq.StatementBuilder.PlaceholderFormat(sq.Dollar).Insert("user_totp").
+		Columns("user_id", "secret").Values(userID, secret).
+		Suffix(`ON CONFLICT (user_id) DO UPDATE SET secret = EXCLUDED.secret, last_used_step = 0,
+			created_at = CURRENT_TIMESTAMP WHERE user_totp.confirmed_at IS NULL`).ToSql()
+	if err != nil {
+		return apperr.Internal(err)
+	}
+	db.logQuery(ctx, stmt, args...)
+
+	res, err := db.ExecContext(ctx, stmt, args...)
+	if err != nil {
+		return apperr.Internal(err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return apperr.Internal(err)
+	}
+	if n == 0 {
+		return apperr.Conflict(apperr.CodeTOTPAlreadyEnabled, "TOTP is already enabled")
+	}
+
+	return nil
+}
+
+// ConfirmUserTOTP enables the TOTP factor of the user after a code of step was verified, and stores the hashes
+// of its recovery codes. It fails with a not found error if the user has no unconfirmed factor.
+func (db *Client) ConfirmUserTOTP(ctx context.Context, userID int, step int64, recoveryHashes []string) error {
+	stmt, args, err := sq.StatementBuilder.PlaceholderFormat(sq.Dollar).Update("user_totp").
+		Set("confirmed_at", sq.Expr("CURRENT_TIMESTAMP")).
+		Set("last_used_step", step).
+		Where(sq.Eq{"user_id": userID, "confirmed_at": nil}).ToSql()
+	if err != nil {
+		return apperr.Internal(err)
+	}
+
+	return db.inTx(ctx, func(tx *sqlx.Tx) error {
+		db.logQuery(ctx, stmt, args...)
+		res, err := tx.ExecContext(ctx, stmt, args...)
+		if err != nil {
+			return apperr.Internal(err)
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return apperr.Internal(err)
+		}
+		if n == 0 {
+			return apperr.NotFound(apperr.CodeTOTPNotEnrolled, "TOTP enrollment not found")
+		}
+
+		return db.replaceRecoveryCodes(ctx, tx, userID, recoveryHashes)
+	})
+}
+
+// UseTOTPStep records the use of the code of step by the user. It returns false if a code of the same
+// or a later step was already used, the code is replayed.
+func (db *Client) UseTOTPStep(ctx context.Context, userID int, step int64) (bool, error) {
+	stmt, args, err := sq.StatementBuilder.PlaceholderFormat(sq.Dollar).Update("user_totp").
+		Set("last_used_step", step).
+		Where(sq.Eq{"user_id": userID}).Where(sq.Lt{"last_used_step": step}).ToSql()
+	if err != nil {
+		return false, apperr.Internal(err)
+	}
+
+	return db.execUpdated(ctx, stmt, args...)
+}
+
+// DeleteUserTOTP removes the TOTP factor and the recovery codes of the user
+func (db *Client) DeleteUserTOTP(ctx context.Context, userID int) error {
+	return db.inTx(ctx, func(tx *sqlx.Tx) error {
+		for _, table := range []string{"user_recovery_codes", "user_totp"} {
+			stmt, args, err := sq.StatementBuilder.PlaceholderFormat(sq.Dollar).Delete(table).
+				Where(sq.Eq{"user_id": userID}).ToSql()
+			if err != nil {
+				return apperr.Internal(err)
+			}
+			db.logQuery(ctx, stmt, args...)
+			if _, err := tx.ExecContext(ctx, stmt, args...); err != nil {
+				return apperr.Internal(err)
+			}
+		}
+
+		return nil
+	})
+}
+
+// ReplaceRecoveryCodes replaces the recovery codes of the user, only their hashes are stored
+func (db *Client) ReplaceRecoveryCodes(ctx context.Context, userID int, hashes []string) error {
+	return db.inTx(ctx, func(tx *sqlx.Tx) error {
+		return db.replaceRecoveryCodes(ctx, tx, userID, hashes)
+	})
+}
+
+// UseRecoveryCode marks the unused recovery code of the user with given hash as used.
+// It returns false if there is no such code.
+func (db *Client) UseRecoveryCode(ctx context.Context, userID int, hash string) (bool, error) {
+	stmt, args, err := sq.StatementBuilder.PlaceholderFormat(sq.Dollar).Update("user_recovery_codes").
+		Set("used_at", sq.Expr("CURRENT_TIMESTAMP")).
+		Where(sq.Eq{"user_id": userID, "code_hash": hash, "used_at": nil}).ToSql()
+	if err != nil {
+		return false, apperr.Internal(err)
+	}
+
+	return db.execUpdated(ctx, stmt, args...)
+}
+
+func (db *Client) replaceRecoveryCodes(ctx context.Context, tx *sqlx.Tx, userID int, hashes []string) error {
+	stmt, args, err := sq.StatementBuilder.PlaceholderFormat(sq.Dollar).Delete("user_recovery_codes").
+		Where(sq.Eq{"user_id": userID}).ToSql()
+	if err != nil {
+		return apperr.Internal(err)
+	}
+	db.logQuery(ctx, stmt, args...)
+	if _, err := tx.ExecContext(ctx, stmt, args...); err != nil {
+		return apperr.Internal(err)
+	}
+	if len(hashes) == 0 {
+		return nil
+	}
+
+	b := sq.StatementBuilder.PlaceholderFormat(sq.Dollar).Insert("user_recovery_codes").Columns("user_id", "code_hash")
+	for _, h := range hashes {
+		b = b.Values(userID, h)
+	}
+	stmt, args, err = b.ToSql()
+	if err != nil {
+		return apperr.Internal(err)
+	}
+	db.logQuery(ctx, stmt, args...)
+	if _, err := tx.ExecContext(ctx, stmt, args...); err != nil {
+		return apperr.Internal(err)
+	}
+
+	return nil
+}
+
+// execUpdated executes an update and reports whether it matched rows
+func (db *Client) execUpdated(ctx context.Context, stmt string, args ...interface{}) (bool, error) {
+	db.logQuery(ctx, stmt, args...)
+
+	res, err := db.ExecContext(ctx, stmt, args...)
+	if err != nil {
+		return false, apperr.Internal(err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, apperr.Internal(err)
+	}
+
+	return n > 0, nil
+}
+
+// inTx runs fn in a transaction, committed if fn succeeds
+func (db *Client) inTx(ctx context.Context, fn func(tx *sqlx.Tx) error) error {
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return apperr.Internal(err)
+	}
+	if err := fn(tx); err != nil {
+		_ = tx.Rollback()
+
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return apperr.Internal(err)
+	}
+
+	return nil
+}
@@ -0,0 +1,104 @@
+package postgres
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClient_UserTOTP(t *testing.T) {
+	db := NewTestDB(t)
+	defer func() {
+		db.ResetTable(t, "users")
+	}()
+	u := User{
+		Email:       "test@test.com",
+		Password:    "test",
+		Description: "description",
+		LastName:    "lastname",
+		FirstName:   "firstname",
+		Active:      true,
+	}
+
+	ctx := context.Background()
+	assert.NoError(t, db.InsertUser(ctx, &u))
+
+	got, err := db.FindUserTOTP(ctx, u.ID)
+	assert.NoError(t, err)
+	assert.Nil(t, got)
+	assert.False(t, got.Confirmed())
+	assert.EqualError(t, db.ConfirmUserTOTP(ctx, u.ID, 1, nil), "TOTP enrollment not found")
+
+	// an unconfirmed enrollment can be restarted
+	assert.NoError(t, db.SaveUserTOTP(ctx, u.ID, "first"))
+	assert.NoError(t, db.SaveUserTOTP(ctx, u.ID, "second"))
+	got, err = db.FindUserTOTP(ctx, u.ID)
+	assert.NoError(t, err)
+	if assert.NotNil(t, got) {
+		assert.Equal(t, "second", got.Secret)
+		assert.False(t, got.Confirmed())
+	}
+
+	assert.NoError(t, db.ConfirmUserTOTP(ctx, u.ID, 100, []string{"hash-1", "hash-2"}))
+	got, err = db.FindUserTOTP(ctx, u.ID)
+	assert.NoError(t, err)
+	if assert.NotNil(t, got) {
+		assert.True(t, got.Confirmed())
+		assert.Equal(t, int64(100), got.LastUsedStep)
+	}
+	assert.EqualError(t, db.SaveUserTOTP(ctx, u.ID, "third"), "TOTP is already enabled")
+
+	// codes are only accepted once
+	ok, err := db.UseTOTPStep(ctx, u.ID, 100)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	ok, err = db.UseTOTPStep(ctx, u.ID, 101)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	assert.NoError(t, db.DeleteUserTOTP(ctx, u.ID))
+	got, err = db.FindUserTOTP(ctx, u.ID)
+	assert.NoError(t, err)
+	assert.Nil(t, got)
+	ok, err = db.UseRecoveryCode(ctx, u.ID, "hash-1")
+	assert.NoError(t, err)
+	assert.False(t, ok, "recovery codes are deleted with the factor")
+}
+
+func TestClient_UseRecoveryCode(t *testing.T) {
+	db := NewTestDB(t)
+	defer func() {
+		db.ResetTable(t, "users")
+	}()
+	u := User{
+		Email:       "test@test.com",
+		Password:    "test",
+		Description: "description",
+		LastName:    "lastname",
+		FirstName:   "firstname",
+		Active:      true,
+	}
+
+	ctx := context.Background()
+	assert.NoError(t, db.InsertUser(ctx, &u))
+	assert.NoError(t, db.ReplaceRecoveryCodes(ctx, u.ID, []string{"hash-1", "hash-2"}))
+
+	ok, err := db.UseRecoveryCode(ctx, u.ID, "hash-1")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	ok, err = db.UseRecoveryCode(ctx, u.ID, "hash-1")
+	assert.NoError(t, err)
+	assert.False(t, ok, "recovery codes are only used once")
+	ok, err = db.UseRecoveryCode(ctx, u.ID+1, "hash-2")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	assert.NoError(t, db.ReplaceRecoveryCodes(ctx, u.ID, []string{"hash-3"}))
+	ok, err = db.UseRecoveryCode(ctx, u.ID, "hash-2")
+	assert.NoError(t, err)
+	assert.False(t, ok, "replaced codes are deleted")
+	ok, err = db.UseRecoveryCode(ctx, u.ID, "hash-3")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+}
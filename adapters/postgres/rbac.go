@@ -0,0 +1,267 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/efimovalex/replaceme/internal/apperr"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+
+	sq "github.com/Masterminds/squirrel"
+)
+
+// pgForeignKeyViolation is the postgres error code for foreign key constraint violations
+const pgForeignKeyViolation = "23503"
+
+// roleColumns are the columns of the roles table, the permissions are stored in their own table
+var roleColumns = []string{"id", "name", "description", "created_at"}
+
+// Role is a named set of permissions granted to the users it is assigned to
+type Role struct {
+	ID          int       `db:"id"`
+	Name        string    `db:"name"`
+	Description string    `db:"description"`
+	CreatedAt   time.Time `db:"created_at"`
+	// Permissions are the permissions granted by the role, sorted
+	Permissions []string `db:"-"`
+}
+
+// InsertRole stores a new role with its permissions. It fails with a conflict error if a role has the same name.
+func (db *Client) InsertRole(ctx context.Context, r *Role) error {
+	r.Permissions = uniqueSorted(r.Permissions)
+	stmt, args, err := sq.StatementBuilder.PlaceholderFormat(sq.Dollar).Insert("roles").
+		Columns("name", "description").
+		Values(r.Name, r.Description).
+		Suffix("RETURNING id, created_at").ToSql()
+	if err != nil {
+		return apperr.Internal(err)
+	}
+
+	return db.inTx(ctx, func(tx *sqlx.Tx) error {
+		db.logQuery(ctx, stmt, args...)
+		if err := tx.QueryRowxContext(ctx, stmt, args...).Scan(&r.ID, &r.CreatedAt); err != nil {
+			return roleError(r.Name, err)
+		}
+
+		return db.replacePermissions(ctx, tx, r.ID, r.Permissions)
+	})
+}
+
+// FindRoles loads all the roles with their permissions, oldest first
+func (db *Client) FindRoles(ctx context.Context) ([]Role, error) {
+	return db.findRoles(ctx, sq.Select(roleColumns...).From("roles"))
+}
+
+// FindRole loads the role with given id and its permissions, returns nil if not found
+func (db *Client) FindRole(ctx context.Context, id int) (*Role, error) {
+	roles, err := db.findRoles(ctx, sq.Select(roleColumns...).From("roles").Where(sq.Eq{"id": id}))
+	if err != nil || len(roles) == 0 {
+		return nil, err
+	}
+
+	return &roles[0], nil
+}
+
+// FindUserRoles loads the roles assigned to the user of the issuer with their permissions, oldest first
+func (db *Client) FindUserRoles(ctx context.Context, issuer, userID string) ([]Role, error) {
+	return db.findRoles(ctx, sq.Select("roles.id", "roles.name", "roles.description", "roles.created_at").From("roles").
+		Join("user_roles ON user_roles.role_id = roles.id").
+		Where(sq.Eq{"user_roles.issuer": issuer, "user_roles.user_id": userID}))
+}
+
+// UpdateRole saves the name, the description and the permissions of a role. It fails with a not found error if
+// there is no such role, and with a conflict error if another role has the same name.
+func (db *Client) UpdateRole(ctx context.Context, r *Role) error {
+	r.Permissions = uniqueSorted(r.Permissions)
+	stmt, args, err := sq.StatementBuilder.PlaceholderFormat(sq.Dollar).Update("roles").
+		Set("name", r.Name).
+		Set("description", r.Description).
+		Where(sq.Eq{"id": r.ID}).
+		Suffix("RETURNING created_at").ToSql()
+	if err != nil {
+		return apperr.Internal(err)
+	}
+
+	return db.inTx(ctx, func(tx *sqlx.Tx) error {
+		db.logQuery(ctx, stmt, args...)
+		if err := tx.QueryRowxContext(ctx, stmt, args...).Scan(&r.CreatedAt); err != nil {
+			if err == sql.ErrNoRows {
+				return apperr.NotFound(apperr.CodeRoleNotFound, "role not found")
+			}
+			return roleError(r.Name, err)
+		}
+
+		return db.replacePermissions(ctx, tx, r.ID, r.Permissions)
+	})
+}
+
+// DeleteRole removes a role, its permissions and its assignments. It fails with a not found error if there is no
+// such role.
+func (db *Client) DeleteRole(ctx context.Context, id int) error {
+	stmt, args, err := sq.StatementBuilder.PlaceholderFormat(sq.Dollar).Delete("roles").
+		Where(sq.Eq{"id": id}).ToSql()
+	if err != nil {
+		return apperr.Internal(err)
+	}
+
+	ok, err := db.execUpdated(ctx, stmt, args...)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return apperr.NotFound(apperr.CodeRoleNotFound, "role not found")
+	}
+
+	return nil
+}
+
+// AssignRole assigns the role to the user of the issuer, assigning it again does nothing. It fails with a not found
+// error if there is no such role.
+func (db *Client) AssignRole(ctx context.Context, issuer, userID string, roleID int) error {
+	stmt, args, err := sq.StatementBuilder.PlaceholderFormat(sq.Dollar).Insert("user_roles").
+		Columns("issuer", "user_id", "role_id").
+		Values(issuer, userID, roleID).
+		Suffix("ON CONFLICT DO NOTHING").ToSql()
+	if err != nil {
+		return apperr.Internal(err)
+	}
+	db.logQuery(ctx, stmt, args...)
+
+	if _, err := db.ExecContext(ctx, stmt, args...); err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == pgForeignKeyViolation {
+			return apperr.NotFound(apperr.CodeRoleNotFound, "role not found").Wrap(err)
+		}
+
+		return apperr.Internal(err)
+	}
+
+	return nil
+}
+
+// UnassignRole removes the role from the user of the issuer. It fails with a not found error if the role is not
+// assigned to the user.
+func (db *Client) UnassignRole(ctx context.Context, issuer, userID string, roleID int) error {
+	stmt, args, err := sq.StatementBuilder.PlaceholderFormat(sq.Dollar).Delete("user_roles").
+		Where(sq.Eq{"issuer": issuer, "user_id": userID, "role_id": roleID}).ToSql()
+	if err != nil {
+		return apperr.Internal(err)
+	}
+
+	ok, err := db.execUpdated(ctx, stmt, args...)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return apperr.NotFound(apperr.CodeRoleNotFound, "role not assigned to the user")
+	}
+
+	return nil
+}
+
+// findRoles loads the roles selected by b, oldest first, and their permissions
+func (db *Client) findRoles(ctx context.Context, b sq.SelectBuilder) ([]Role, error) {
+	roles := []Role{}
+
+	stmt, args, err := b.PlaceholderFormat(sq.Dollar).OrderBy("id").ToSql()
+	if err != nil {
+		return nil, apperr.Internal(err)
+	}
+	db.logQuery(ctx, stmt, args...)
+
+	if err := db.SelectContext(ctx, &roles, stmt, args...); err != nil {
+		return nil, apperr.Internal(err)
+	}
+	if len(roles) == 0 {
+		return roles, nil
+	}
+
+	ids := make([]int, len(roles))
+	for i, r := range roles {
+		ids[i] = r.ID
+	}
+	stmt, args, err = sq.StatementBuilder.PlaceholderFormat(sq.Dollar).Select("role_id", "permission").
+		From("permissions").Where(sq.Eq{"role_id": ids}).OrderBy("permission").ToSql()
+	if err != nil {
+		return nil, apperr.Internal(err)
+	}
+	db.logQuery(ctx, stmt, args...)
+
+	var permissions []struct {
+		RoleID     int    `db:"role_id"`
+		Permission string `db:"permission"`
+	}
+	if err := db.SelectContext(ctx, &permissions, stmt, args...); err != nil {
+		return nil, apperr.Internal(err)
+	}
+	byRole := make(map[int][]string, len(roles))
+	for _, p := range permissions {
+		byRole[p.RoleID] = append(byRole[p.RoleID], p.Permission)
+	}
+	for i := range roles {
+		roles[i].Permissions = append([]string{}, byRole[roles[i].ID]...)
+	}
+
+	return roles, nil
+}
+
+// replacePermissions replaces the permissions of the role, they must not have duplicates
+func (db *Client) replacePermissions(ctx context.Context, tx *sqlx.Tx, roleID int, permissions []string) error {
+	stmt, args, err := sq.StatementBuilder.PlaceholderFormat(sq.Dollar).Delete("permissions").
+		Where(sq.Eq{"role_id": roleID}).ToSql()
+	if err != nil {
+		return apperr.Internal(err)
+	}
+	db.logQuery(ctx, stmt, args...)
+	if _, err := tx.ExecContext(ctx, stmt, args...); err != nil {
+		return apperr.Internal(err)
+	}
+
+	if len(permissions) == 0 {
+		return nil
+	}
+	b := sq.StatementBuilder.PlaceholderFormat(sq.Dollar).Insert("permissions").Columns("role_id", "permission")
+	for _, p := range permissions {
+		b = b.Values(roleID, p)
+	}
+	stmt, args, err = b.ToSql()
+	if err != nil {
+		return apperr.Internal(err)
+	}
+	db.logQuery(ctx, stmt, args...)
+	if _, err := tx.ExecContext(ctx, stmt, args...); err != nil {
+		return apperr.Internal(err)
+	}
+
+	return nil
+}
+
+// roleError turns the unique violation of the role name into a conflict error
+func roleError(name string, err error) error {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == pgUniqueViolation {
+		return apperr.Conflict(apperr.CodeRoleExists, fmt.Sprintf("role %v does already exist", name)).Wrap(err)
+	}
+
+	return apperr.Internal(err)
+}
+
+// uniqueSorted returns the sorted values without duplicates
+func uniqueSorted(values []string) []string {
+	res := make([]string, 0, len(values))
+	seen := make(map[string]bool, len(values))
+	for _, v := range values {
+		if !seen[v] {
+			seen[v] = true
+			res = append(res, v)
+		}
+	}
+	sort.Strings(res)
+
+	return res
+}
@@ -0,0 +1,75 @@
+package postgres
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClient_Roles(t *testing.T) {
+	db := NewTestDB(t)
+	defer func() {
+		db.ResetTable(t, "roles")
+	}()
+
+	ctx := context.Background()
+	issuer := "https://replaceme.com/"
+	r := Role{Name: "editor", Description: "Edits the users", Permissions: []string{"users:write", "users:read", "users:write"}}
+	assert.NoError(t, db.InsertRole(ctx, &r))
+	assert.NotZero(t, r.ID)
+	assert.False(t, r.CreatedAt.IsZero())
+	assert.ErrorContains(t, db.InsertRole(ctx, &Role{Name: "editor"}), "role editor does already exist")
+	viewer := Role{Name: "viewer"}
+	assert.NoError(t, db.InsertRole(ctx, &viewer))
+
+	got, err := db.FindRole(ctx, r.ID)
+	assert.NoError(t, err)
+	if assert.NotNil(t, got) {
+		assert.Equal(t, "Edits the users", got.Description)
+		assert.Equal(t, []string{"users:read", "users:write"}, got.Permissions)
+	}
+	got, err = db.FindRole(ctx, viewer.ID+1)
+	assert.NoError(t, err)
+	assert.Nil(t, got)
+
+	r.Name = "admin"
+	r.Permissions = []string{"users:delete"}
+	assert.NoError(t, db.UpdateRole(ctx, &r))
+	assert.EqualError(t, db.UpdateRole(ctx, &Role{ID: viewer.ID + 1, Name: "other"}), "role not found")
+	assert.ErrorContains(t, db.UpdateRole(ctx, &Role{ID: viewer.ID, Name: "admin"}), "role admin does already exist")
+
+	roles, err := db.FindRoles(ctx)
+	assert.NoError(t, err)
+	if assert.Len(t, roles, 2) {
+		assert.Equal(t, "admin", roles[0].Name)
+		assert.Equal(t, []string{"users:delete"}, roles[0].Permissions)
+		assert.Equal(t, []string{}, roles[1].Permissions)
+	}
+
+	assert.NoError(t, db.AssignRole(ctx, issuer, "1", r.ID))
+	assert.NoError(t, db.AssignRole(ctx, issuer, "1", r.ID), "assigning a role again does nothing")
+	assert.NoError(t, db.AssignRole(ctx, issuer, "1", viewer.ID))
+	assert.NoError(t, db.AssignRole(ctx, issuer, "2", viewer.ID))
+	assert.ErrorContains(t, db.AssignRole(ctx, issuer, "1", viewer.ID+1), "role not found")
+
+	roles, err = db.FindUserRoles(ctx, issuer, "1")
+	assert.NoError(t, err)
+	assert.Len(t, roles, 2)
+	roles, err = db.FindUserRoles(ctx, issuer, "3")
+	assert.NoError(t, err)
+	assert.Empty(t, roles)
+	roles, err = db.FindUserRoles(ctx, "https://idp.replaceme.com/", "1")
+	assert.NoError(t, err)
+	assert.Empty(t, roles, "the user 1 of another issuer is another user")
+
+	assert.NoError(t, db.UnassignRole(ctx, issuer, "1", viewer.ID))
+	assert.EqualError(t, db.UnassignRole(ctx, issuer, "1", viewer.ID), "role not assigned to the user")
+
+	// deleting a role removes its assignments
+	assert.EqualError(t, db.DeleteRole(ctx, viewer.ID+1), "role not found")
+	assert.NoError(t, db.DeleteRole(ctx, r.ID))
+	roles, err = db.FindUserRoles(ctx, issuer, "1")
+	assert.NoError(t, err)
+	assert.Empty(t, roles)
+}
@@ -7,11 +7,20 @@ import (
 	"fmt"
 	"time"
 
+	"github.com/efimovalex/replaceme/internal/apperr"
+	"github.com/lib/pq"
 	"golang.org/x/crypto/bcrypt"
 
 	sq "github.com/Masterminds/squirrel"
 )
 
+const (
+	// pgUniqueViolation is the postgres error code for unique constraint violations
+	pgUniqueViolation = "23505"
+	// dummyPasswordHash is compared against when no user matches, it has the cost of the stored hashes
+	dummyPasswordHash = "$2a$10$WwiaNG55CBomvue1uG10A.MLqUbo9LUmr9oSMK/N2FXdUKk0oMGR2"
+)
+
 // User contains the database entry
 type User struct {
 	ID          int       `db:"id"`
@@ -23,6 +32,8 @@ type User struct {
 	Active      bool      `db:"active"`
 	CreatedAt   time.Time `db:"created_at"`
 	UpdatedAt   time.Time `db:"updated_at"`
+	// EmailVerifiedAt is set once the user proved owning the email, nil until then
+	EmailVerifiedAt *time.Time `db:"email_verified_at"`
 }
 
 // UserByEmail loads User with given email, returns nil if not found
@@ -38,17 +49,39 @@ func (db *Client) FindOneUserByEmail(ctx context.Context, email string, active *
 
 	stmt, args, err := b.ToSql()
 	if err != nil {
-		return nil, err
+		return nil, apperr.Internal(err)
+	}
+
+	db.logQuery(ctx, stmt, args...)
+
+	err = db.GetContext(ctx, &u, stmt, args...)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, apperr.Internal(err)
+	}
+	return &u, nil
+}
+
+// FindOneUserByID loads User with given id, returns nil if not found
+func (db *Client) FindOneUserByID(ctx context.Context, id int) (*User, error) {
+	u := User{}
+
+	stmt, args, err := sq.StatementBuilder.PlaceholderFormat(sq.Dollar).Select("*").
+		From("users").Where(sq.Eq{"id": id}).Limit(1).ToSql()
+	if err != nil {
+		return nil, apperr.Internal(err)
 	}
 
-	db.logQuery(stmt, args...)
+	db.logQuery(ctx, stmt, args...)
 
 	err = db.GetContext(ctx, &u, stmt, args...)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, nil
 		}
-		return nil, err
+		return nil, apperr.Internal(err)
 	}
 	return &u, nil
 }
@@ -56,13 +89,13 @@ func (db *Client) FindOneUserByEmail(ctx context.Context, email string, active *
 // InsertUser - inserts a User in database
 func (db *Client) InsertUser(ctx context.Context, u *User) error {
 	if u.Password == "" {
-		return errors.New("password is required")
+		return apperr.Validation(apperr.CodePasswordRequired, "password is required")
 	}
 
 	// hash password
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(u.Password), bcrypt.DefaultCost)
 	if err != nil {
-		return err
+		return apperr.Internal(err)
 	}
 	u.Password = string(hashedPassword)
 
@@ -73,7 +106,7 @@ func (db *Client) InsertUser(ctx context.Context, u *User) error {
 	}
 
 	if user != nil {
-		return fmt.Errorf("user with email %v does already exist", u.Email)
+		return errUserEmailTaken(u.Email)
 	}
 
 	// insert to database
@@ -81,14 +114,91 @@ func (db *Client) InsertUser(ctx context.Context, u *User) error {
 		Columns("email", "password", "description", "first_name", "last_name", "active").
 		Values(u.Email, u.Password, u.Description, u.FirstName, u.LastName, u.Active).Suffix(" RETURNING * ").ToSql()
 	if err != nil {
-		return err
+		return apperr.Internal(err)
 	}
-	db.logQuery(stmt, args...)
+	db.logQuery(ctx, stmt, args...)
 
 	err = db.GetContext(ctx, u, stmt, args...)
 	if err != nil {
-		return err
+		// a concurrent insert can still win the race after the check above
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == pgUniqueViolation {
+			return errUserEmailTaken(u.Email).Wrap(err)
+		}
+
+		return apperr.Internal(err)
+	}
+
+	return nil
+}
+
+// UpdateUserPassword hashes and stores a new password of the user with given id.
+// Setting a password through an emailed link proves owning the email, it is marked as verified too.
+func (db *Client) UpdateUserPassword(ctx context.Context, id int, password string) error {
+	if password == "" {
+		return apperr.Validation(apperr.CodePasswordRequired, "password is required")
+	}
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return apperr.Internal(err)
+	}
+
+	stmt, args, err := sq.StatementBuilder.PlaceholderFormat(sq.Dollar).Update("users").
+		Set("password", string(hashedPassword)).
+		Set("email_verified_at", sq.Expr("COALESCE(email_verified_at, CURRENT_TIMESTAMP)")).
+		Set("updated_at", sq.Expr("CURRENT_TIMESTAMP")).
+		Where(sq.Eq{"id": id}).ToSql()
+	if err != nil {
+		return apperr.Internal(err)
+	}
+
+	return db.updateUser(ctx, stmt, args...)
+}
+
+// MarkUserEmailVerified sets the email of the user with given id as verified, it is a no-op if it already is
+func (db *Client) MarkUserEmailVerified(ctx context.Context, id int) error {
+	stmt, args, err := sq.StatementBuilder.PlaceholderFormat(sq.Dollar).Update("users").
+		Set("email_verified_at", sq.Expr("COALESCE(email_verified_at, CURRENT_TIMESTAMP)")).
+		Set("updated_at", sq.Expr("CURRENT_TIMESTAMP")).
+		Where(sq.Eq{"id": id}).ToSql()
+	if err != nil {
+		return apperr.Internal(err)
+	}
+
+	return db.updateUser(ctx, stmt, args...)
+}
+
+// updateUser executes an update of a single user, it fails with a not found error if no user matched
+func (db *Client) updateUser(ctx context.Context, stmt string, args ...interface{}) error {
+	db.logQuery(ctx, stmt, args...)
+
+	res, err := db.ExecContext(ctx, stmt, args...)
+	if err != nil {
+		return apperr.Internal(err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return apperr.Internal(err)
+	}
+	if n == 0 {
+		return apperr.NotFound(apperr.CodeUserNotFound, "user not found")
 	}
 
 	return nil
 }
+
+// CheckPassword reports whether password matches the password hash of u. A nil user never matches,
+// but a hash is still compared so that the time taken does not tell whether the user exists.
+func CheckPassword(u *User, password string) bool {
+	hash := dummyPasswordHash
+	if u != nil {
+		hash = u.Password
+	}
+	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+
+	return u != nil && err == nil
+}
+
+func errUserEmailTaken(email string) *apperr.Error {
+	return apperr.Conflict(apperr.CodeUserEmailTaken, fmt.Sprintf("user with email %v does already exist", email))
+}
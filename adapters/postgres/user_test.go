@@ -7,6 +7,7 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
 )
 
 func (db *Client) ResetTable(t *testing.T, table string) {
@@ -74,6 +75,33 @@ func TestClient_FindOneUserByEmail(t *testing.T) {
 	}
 }
 
+func TestClient_FindOneUserByID(t *testing.T) {
+	db := NewTestDB(t)
+	defer func() {
+		db.ResetTable(t, "users")
+	}()
+	u := User{
+		Email:       "test@test.com",
+		Password:    "test",
+		Description: "description",
+		LastName:    "lastname",
+		FirstName:   "firstname",
+		Active:      true,
+	}
+
+	ctx := context.Background()
+	err := db.InsertUser(ctx, &u)
+	assert.NoError(t, err)
+
+	got, err := db.FindOneUserByID(ctx, u.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, &u, got)
+
+	got, err = db.FindOneUserByID(ctx, u.ID+1)
+	assert.NoError(t, err)
+	assert.Nil(t, got)
+}
+
 func TestClient_InsertUser(t *testing.T) {
 	db := NewTestDB(t)
 	defer func() {
@@ -129,3 +157,75 @@ func TestClient_InsertUser(t *testing.T) {
 		})
 	}
 }
+
+func TestClient_UpdateUserPassword(t *testing.T) {
+	db := NewTestDB(t)
+	defer func() {
+		db.ResetTable(t, "users")
+	}()
+	u := User{
+		Email:       "test@test.com",
+		Password:    "test",
+		Description: "description",
+		LastName:    "lastname",
+		FirstName:   "firstname",
+		Active:      true,
+	}
+
+	ctx := context.Background()
+	assert.NoError(t, db.InsertUser(ctx, &u))
+	assert.Nil(t, u.EmailVerifiedAt)
+
+	assert.NoError(t, db.UpdateUserPassword(ctx, u.ID, "n3w-p4ssword"))
+	got, err := db.FindOneUserByID(ctx, u.ID)
+	assert.NoError(t, err)
+	assert.True(t, CheckPassword(got, "n3w-p4ssword"))
+	assert.NotNil(t, got.EmailVerifiedAt)
+
+	assert.EqualError(t, db.UpdateUserPassword(ctx, u.ID, ""), "password is required")
+	assert.EqualError(t, db.UpdateUserPassword(ctx, u.ID+1, "n3w-p4ssword"), "user not found")
+}
+
+func TestClient_MarkUserEmailVerified(t *testing.T) {
+	db := NewTestDB(t)
+	defer func() {
+		db.ResetTable(t, "users")
+	}()
+	u := User{
+		Email:       "test@test.com",
+		Password:    "test",
+		Description: "description",
+		LastName:    "lastname",
+		FirstName:   "firstname",
+		Active:      true,
+	}
+
+	ctx := context.Background()
+	assert.NoError(t, db.InsertUser(ctx, &u))
+
+	assert.NoError(t, db.MarkUserEmailVerified(ctx, u.ID))
+	got, err := db.FindOneUserByID(ctx, u.ID)
+	assert.NoError(t, err)
+	if assert.NotNil(t, got.EmailVerifiedAt) {
+		verifiedAt := *got.EmailVerifiedAt
+
+		// verifying again keeps the first time
+		assert.NoError(t, db.MarkUserEmailVerified(ctx, u.ID))
+		got, err = db.FindOneUserByID(ctx, u.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, verifiedAt, *got.EmailVerifiedAt)
+	}
+
+	assert.EqualError(t, db.MarkUserEmailVerified(ctx, u.ID+1), "user not found")
+}
+
+func TestCheckPassword(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("s3cr3t-p4ss"), bcrypt.MinCost)
+	assert.NoError(t, err)
+	u := &User{Email: "test@test.com", Password: string(hash)}
+
+	assert.True(t, CheckPassword(u, "s3cr3t-p4ss"))
+	assert.False(t, CheckPassword(u, "wrong-pass"))
+	assert.False(t, CheckPassword(nil, "s3cr3t-p4ss"))
+	assert.False(t, CheckPassword(nil, "this is not a password"), "the dummy hash never matches")
+}
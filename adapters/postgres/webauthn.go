@@ -0,0 +1,122 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/efimovalex/replaceme/internal/apperr"
+
+	sq "github.com/Masterminds/squirrel"
+)
+
+// WebAuthnCredential is a passkey registered by a user
+type WebAuthnCredential struct {
+	// ID is the base64url encoded credential id
+	ID     string `db:"id"`
+	UserID int    `db:"user_id"`
+	// PublicKey is the COSE encoded public key of the credential
+	PublicKey []byte `db:"public_key"`
+	SignCount int64  `db:"sign_count"`
+	// Transports are the space separated transports of the authenticator, e.g. "usb nfc"
+	Transports string     `db:"transports"`
+	AAGUID     []byte     `db:"aaguid"`
+	Name       string     `db:"name"`
+	CreatedAt  time.Time  `db:"created_at"`
+	LastUsedAt *time.Time `db:"last_used_at"`
+}
+
+// InsertWebAuthnCredential stores a new credential of a user
+func (db *Client) InsertWebAuthnCredential(ctx context.Context, c *WebAuthnCredential) error {
+	stmt, args, err := sq.StatementBuilder.PlaceholderFormat(sq.Dollar).Insert("webauthn_credentials").
+		Columns("id", "user_id", "public_key", "sign_count", "transports", "aaguid", "name").
+		Values(c.ID, c.UserID, c.PublicKey, c.SignCount, c.Transports, c.AAGUID, c.Name).
+		Suffix("ON CONFLICT (id) DO NOTHING RETURNING created_at").ToSql()
+	if err != nil {
+		return apperr.Internal(err)
+	}
+	db.logQuery(ctx, stmt, args...)
+
+	err = db.QueryRowxContext(ctx, stmt, args...).Scan(&c.CreatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return apperr.Conflict(apperr.CodeConflict, "credential is already registered")
+		}
+		return apperr.Internal(err)
+	}
+
+	return nil
+}
+
+// FindWebAuthnCredentials loads the credentials of the user with given id, oldest first
+func (db *Client) FindWebAuthnCredentials(ctx context.Context, userID int) ([]WebAuthnCredential, error) {
+	creds := []WebAuthnCredential{}
+
+	stmt, args, err := sq.StatementBuilder.PlaceholderFormat(sq.Dollar).Select("*").
+		From("webauthn_credentials").Where(sq.Eq{"user_id": userID}).OrderBy("created_at", "id").ToSql()
+	if err != nil {
+		return nil, apperr.Internal(err)
+	}
+	db.logQuery(ctx, stmt, args...)
+
+	if err := db.SelectContext(ctx, &creds, stmt, args...); err != nil {
+		return nil, apperr.Internal(err)
+	}
+
+	return creds, nil
+}
+
+// FindWebAuthnCredential loads the credential with given id, returns nil if not found
+func (db *Client) FindWebAuthnCredential(ctx context.Context, id string) (*WebAuthnCredential, error) {
+	c := WebAuthnCredential{}
+
+	stmt, args, err := sq.StatementBuilder.PlaceholderFormat(sq.Dollar).Select("*").
+		From("webauthn_credentials").Where(sq.Eq{"id": id}).Limit(1).ToSql()
+	if err != nil {
+		return nil, apperr.Internal(err)
+	}
+	db.logQuery(ctx, stmt, args...)
+
+	err = db.GetContext(ctx, &c, stmt, args...)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, apperr.Internal(err)
+	}
+	return &c, nil
+}
+
+// UpdateWebAuthnCredentialUse records a login with the credential and its new signature counter. The counter is
+// only updated if it is still prevCount, it returns false if a concurrent login changed it.
+func (db *Client) UpdateWebAuthnCredentialUse(ctx context.Context, id string, prevCount, signCount int64) (bool, error) {
+	stmt, args, err := sq.StatementBuilder.PlaceholderFormat(sq.Dollar).Update("webauthn_credentials").
+		Set("sign_count", signCount).
+		Set("last_used_at", sq.Expr("CURRENT_TIMESTAMP")).
+		Where(sq.Eq{"id": id, "sign_count": prevCount}).ToSql()
+	if err != nil {
+		return false, apperr.Internal(err)
+	}
+
+	return db.execUpdated(ctx, stmt, args...)
+}
+
+// DeleteWebAuthnCredential removes a credential of the user. It fails with a not found error if the user has no
+// such credential.
+func (db *Client) DeleteWebAuthnCredential(ctx context.Context, userID int, id string) error {
+	stmt, args, err := sq.StatementBuilder.PlaceholderFormat(sq.Dollar).Delete("webauthn_credentials").
+		Where(sq.Eq{"id": id, "user_id": userID}).ToSql()
+	if err != nil {
+		return apperr.Internal(err)
+	}
+
+	ok, err := db.execUpdated(ctx, stmt, args...)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return apperr.NotFound(apperr.CodeCredentialNotFound, "credential not found")
+	}
+
+	return nil
+}
@@ -0,0 +1,64 @@
+package postgres
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClient_WebAuthnCredentials(t *testing.T) {
+	db := NewTestDB(t)
+	defer func() {
+		db.ResetTable(t, "users")
+	}()
+	u := User{
+		Email:       "test@test.com",
+		Password:    "test",
+		Description: "description",
+		LastName:    "lastname",
+		FirstName:   "firstname",
+		Active:      true,
+	}
+
+	ctx := context.Background()
+	assert.NoError(t, db.InsertUser(ctx, &u))
+
+	c := WebAuthnCredential{ID: "cred-1", UserID: u.ID, PublicKey: []byte("key"), Transports: "usb nfc", Name: "YubiKey"}
+	assert.NoError(t, db.InsertWebAuthnCredential(ctx, &c))
+	assert.False(t, c.CreatedAt.IsZero())
+	assert.EqualError(t, db.InsertWebAuthnCredential(ctx, &c), "credential is already registered")
+
+	got, err := db.FindWebAuthnCredential(ctx, "cred-1")
+	assert.NoError(t, err)
+	if assert.NotNil(t, got) {
+		assert.Equal(t, u.ID, got.UserID)
+		assert.Equal(t, []byte("key"), got.PublicKey)
+		assert.Equal(t, "usb nfc", got.Transports)
+		assert.Nil(t, got.LastUsedAt)
+	}
+	got, err = db.FindWebAuthnCredential(ctx, "cred-2")
+	assert.NoError(t, err)
+	assert.Nil(t, got)
+
+	// the counter is only updated from the value the login verified
+	ok, err := db.UpdateWebAuthnCredentialUse(ctx, "cred-1", 0, 5)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	ok, err = db.UpdateWebAuthnCredentialUse(ctx, "cred-1", 0, 6)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	creds, err := db.FindWebAuthnCredentials(ctx, u.ID)
+	assert.NoError(t, err)
+	if assert.Len(t, creds, 1) {
+		assert.Equal(t, int64(5), creds[0].SignCount)
+		assert.NotNil(t, creds[0].LastUsedAt)
+	}
+
+	assert.EqualError(t, db.DeleteWebAuthnCredential(ctx, u.ID+1, "cred-1"), "credential not found")
+	assert.NoError(t, db.DeleteWebAuthnCredential(ctx, u.ID, "cred-1"))
+	creds, err = db.FindWebAuthnCredentials(ctx, u.ID)
+	assert.NoError(t, err)
+	assert.Empty(t, creds)
+}
@@ -0,0 +1,133 @@
+package redisdb
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	cacheKeyPrefix    = "cache:"
+	cacheTagKeyPrefix = "cache-tag:"
+)
+
+// popTagScript returns the keys tagged with a tag and deletes the tag. The tagged keys are deleted by the caller,
+// with Redis Cluster they are in other hash slots than the tag.
+// KEYS[1] tag key
+var popTagScript = redis.NewScript(`
+local keys = redis.call('SMEMBERS', KEYS[1])
+redis.call('DEL', KEYS[1])
+return keys
+`)
+
+// tagScript adds a key to a tag, the tag is kept at least as long as the key.
+// KEYS[1] tag key, ARGV[1] tagged key, ARGV[2] ttl in milliseconds
+var tagScript = redis.NewScript(`
+local ttl = tonumber(ARGV[2])
+redis.call('SADD', KEYS[1], ARGV[1])
+if redis.call('PTTL', KEYS[1]) < ttl then
+	redis.call('PEXPIRE', KEYS[1], ttl)
+end
+return 1
+`)
+
+// CachedResponse is a response body shared between replicas
+type CachedResponse struct {
+	Status int    `json:"status"`
+	Body   []byte `json:"body"`
+}
+
+// GetCachedResponse loads the cached response stored under key, returns nil if not found
+func (c *Client) GetCachedResponse(ctx context.Context, key string) (*CachedResponse, error) {
+	b, err := c.DB.Get(ctx, cacheKeyPrefix+key).Bytes()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	var res CachedResponse
+	if err := json.Unmarshal(b, &res); err != nil {
+		return nil, err
+	}
+
+	return &res, nil
+}
+
+// SetCachedResponse caches the response under key for ttl and tags it for invalidation
+func (c *Client) SetCachedResponse(ctx context.Context, key string, res *CachedResponse, ttl time.Duration, tags ...string) error {
+	b, err := json.Marshal(res)
+	if err != nil {
+		return err
+	}
+
+	tagKeys := make([]string, len(tags))
+	for i, tag := range tags {
+		tagKeys[i] = cacheTagKeyPrefix + tag
+	}
+
+	return c.setTagged(ctx, cacheKeyPrefix+key, b, ttl, tagKeys)
+}
+
+// InvalidateCacheTags deletes every cached response tagged with one of the tags
+func (c *Client) InvalidateCacheTags(ctx context.Context, tags ...string) error {
+	if len(tags) == 0 {
+		return nil
+	}
+
+	keys := make([]string, len(tags))
+	for i, tag := range tags {
+		keys[i] = cacheTagKeyPrefix + tag
+	}
+
+	return c.invalidateTags(ctx, keys)
+}
+
+// setTagged stores the value under key for ttl and adds it to the tags. The key and the tags are in different hash
+// slots with Redis Cluster, so each one is written on its own: the tags first, an invalidation racing with the write
+// cannot miss the value.
+func (c *Client) setTagged(ctx context.Context, key string, value []byte, ttl time.Duration, tagKeys []string) error {
+	for _, tagKey := range tagKeys {
+		if err := tagScript.Run(ctx, c.DB, []string{tagKey}, key, ttl.Milliseconds()).Err(); err != nil {
+			return err
+		}
+	}
+
+	return c.DB.Set(ctx, key, value, ttl).Err()
+}
+
+// invalidateTags deletes the tags and every key tagged with one of them. Each tag is read and deleted at once, the
+// keys written after it are in a new tag.
+func (c *Client) invalidateTags(ctx context.Context, tagKeys []string) error {
+	var keys []string
+	for _, tagKey := range tagKeys {
+		tagged, err := popTagScript.Run(ctx, c.DB, []string{tagKey}).StringSlice()
+		if err != nil {
+			return err
+		}
+		keys = append(keys, tagged...)
+	}
+
+	return c.deleteKeys(ctx, keys...)
+}
+
+// deleteKeys deletes the keys in one round trip, with a DEL for each key as they can be in different hash slots
+func (c *Client) deleteKeys(ctx context.Context, keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+
+	_, err := c.DB.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, key := range keys {
+			pipe.Del(ctx, key)
+		}
+
+		return nil
+	})
+
+	return err
+}
@@ -0,0 +1,56 @@
+package redisdb
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClient_CachedResponse(t *testing.T) {
+	db := NewTestDB(t)
+	defer db.Reset(t)
+	ctx := context.Background()
+
+	got, err := db.GetCachedResponse(ctx, "/users/1")
+	require.NoError(t, err)
+	assert.Nil(t, got)
+
+	user1 := &CachedResponse{Status: http.StatusOK, Body: []byte(`{"id":1}`)}
+	user2 := &CachedResponse{Status: http.StatusOK, Body: []byte(`{"id":2}`)}
+	require.NoError(t, db.SetCachedResponse(ctx, "/users/1", user1, time.Minute, "users", "user:1"))
+	require.NoError(t, db.SetCachedResponse(ctx, "/users/2", user2, time.Minute, "users", "user:2"))
+	require.NoError(t, db.SetCachedResponse(ctx, "/", &CachedResponse{Status: http.StatusOK}, time.Minute))
+
+	got, err = db.GetCachedResponse(ctx, "/users/1")
+	require.NoError(t, err)
+	assert.Equal(t, user1, got)
+
+	// a shorter ttl does not shorten the tag lifetime
+	require.NoError(t, db.SetCachedResponse(ctx, "/users/2?fields=id", user2, time.Second, "user:2"))
+	assert.Greater(t, db.DB.PTTL(ctx, cacheTagKeyPrefix+"user:2").Val(), time.Second)
+
+	require.NoError(t, db.InvalidateCacheTags(ctx, "user:1"))
+	got, err = db.GetCachedResponse(ctx, "/users/1")
+	require.NoError(t, err)
+	assert.Nil(t, got)
+	got, err = db.GetCachedResponse(ctx, "/users/2")
+	require.NoError(t, err)
+	assert.NotNil(t, got)
+
+	require.NoError(t, db.InvalidateCacheTags(ctx, "users"))
+	got, err = db.GetCachedResponse(ctx, "/users/2")
+	require.NoError(t, err)
+	assert.Nil(t, got)
+	got, err = db.GetCachedResponse(ctx, "/users/2?fields=id")
+	require.NoError(t, err)
+	assert.NotNil(t, got, "only tagged responses are invalidated")
+	got, err = db.GetCachedResponse(ctx, "/")
+	require.NoError(t, err)
+	assert.NotNil(t, got)
+
+	assert.NoError(t, db.InvalidateCacheTags(ctx))
+}
@@ -5,6 +5,7 @@ import (
 	"context"
 	"fmt"
 
+	"github.com/efimovalex/replaceme/internal/requestid"
 	"github.com/go-redis/redis/v8"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
@@ -28,6 +29,7 @@ func New(host, port, password string, database int) (*Client, error) {
 		Password: password,
 		DB:       database, // use default DB
 	})
+	c.DB.AddHook(logHook{logger: c.logger})
 
 	err = c.Ping()
 	if err != nil {
@@ -44,3 +46,44 @@ func (c *Client) Ping() error {
 	_, err := c.DB.Ping(context.Background()).Result()
 	return err
 }
+
+// logHook logs every redis command with the request id found in the command context
+type logHook struct {
+	logger zerolog.Logger
+}
+
+// BeforeProcess implements redis.Hook
+func (h logHook) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+	return ctx, nil
+}
+
+// AfterProcess implements redis.Hook
+func (h logHook) AfterProcess(ctx context.Context, cmd redis.Cmder) error {
+	h.log(ctx, cmd)
+
+	return nil
+}
+
+// BeforeProcessPipeline implements redis.Hook
+func (h logHook) BeforeProcessPipeline(ctx context.Context, cmds []redis.Cmder) (context.Context, error) {
+	return ctx, nil
+}
+
+// AfterProcessPipeline implements redis.Hook
+func (h logHook) AfterProcessPipeline(ctx context.Context, cmds []redis.Cmder) error {
+	for _, cmd := range cmds {
+		h.log(ctx, cmd)
+	}
+
+	return nil
+}
+
+func (h logHook) log(ctx context.Context, cmd redis.Cmder) {
+	l := requestid.Logger(ctx, h.logger)
+	if err := cmd.Err(); err != nil && err != redis.Nil {
+		l.Error().Err(err).Msg(cmd.Name())
+
+		return
+	}
+	l.Debug().Msg(cmd.Name())
+}
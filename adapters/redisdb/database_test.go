@@ -0,0 +1,31 @@
+package redisdb
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// NewTestDB connects to the redis service started by docker-compose
+func NewTestDB(t *testing.T) *Client {
+	if t == nil {
+		return nil
+	}
+	db, err := New("localhost", "6379", "eYVX7EwVmmxKPCDmwMtyKVge8oLd2t81", 1)
+	assert.NoError(t, err)
+	return db
+}
+
+// Reset removes all keys of the test database
+func (c *Client) Reset(t *testing.T) {
+	assert.NoError(t, c.DB.FlushDB(context.Background()).Err())
+}
+
+func TestNew(t *testing.T) {
+	db := NewTestDB(t)
+	assert.NotNil(t, db)
+
+	_, err := New("localhost", "6379", "wrong-password", 1)
+	assert.Error(t, err)
+}
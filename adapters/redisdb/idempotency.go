@@ -0,0 +1,79 @@
+package redisdb
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	idempotencyKeyPrefix     = "idempotency:"
+	idempotencyLockKeyPrefix = "idempotency-lock:"
+)
+
+// releaseLockScript deletes the lock only if it is still held by the given token.
+// KEYS[1] lock key, ARGV[1] token
+var releaseLockScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+// IdempotentResponse is the first response of an idempotent request, replayed on retries
+type IdempotentResponse struct {
+	// Fingerprint identifies the request the response was produced for
+	Fingerprint string      `json:"fingerprint"`
+	Status      int         `json:"status"`
+	Header      http.Header `json:"header"`
+	Body        []byte      `json:"body"`
+}
+
+// AcquireIdempotencyLock takes the lock of the idempotency key for ttl.
+// It returns the lock token, empty if the lock is held by another request.
+func (c *Client) AcquireIdempotencyLock(ctx context.Context, key string, ttl time.Duration) (string, error) {
+	token := randomID()
+	ok, err := c.DB.SetNX(ctx, idempotencyLockKeyPrefix+key, token, ttl).Result()
+	if err != nil || !ok {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// ReleaseIdempotencyLock releases the lock of the idempotency key if it is still held by token.
+func (c *Client) ReleaseIdempotencyLock(ctx context.Context, key, token string) error {
+	return releaseLockScript.Run(ctx, c.DB, []string{idempotencyLockKeyPrefix + key}, token).Err()
+}
+
+// GetIdempotentResponse loads the stored response of the idempotency key, returns nil if not found
+func (c *Client) GetIdempotentResponse(ctx context.Context, key string) (*IdempotentResponse, error) {
+	b, err := c.DB.Get(ctx, idempotencyKeyPrefix+key).Bytes()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	var res IdempotentResponse
+	if err := json.Unmarshal(b, &res); err != nil {
+		return nil, err
+	}
+
+	return &res, nil
+}
+
+// SetIdempotentResponse stores the response of the idempotency key for ttl
+func (c *Client) SetIdempotentResponse(ctx context.Context, key string, res *IdempotentResponse, ttl time.Duration) error {
+	b, err := json.Marshal(res)
+	if err != nil {
+		return err
+	}
+
+	return c.DB.Set(ctx, idempotencyKeyPrefix+key, b, ttl).Err()
+}
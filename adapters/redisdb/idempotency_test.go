@@ -0,0 +1,59 @@
+package redisdb
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClient_IdempotencyLock(t *testing.T) {
+	db := NewTestDB(t)
+	defer db.Reset(t)
+	ctx := context.Background()
+
+	token, err := db.AcquireIdempotencyLock(ctx, "user:1:POST /users:key", time.Minute)
+	require.NoError(t, err)
+	assert.NotEmpty(t, token)
+
+	// the lock is held
+	other, err := db.AcquireIdempotencyLock(ctx, "user:1:POST /users:key", time.Minute)
+	require.NoError(t, err)
+	assert.Empty(t, other)
+
+	// only the holder can release it
+	require.NoError(t, db.ReleaseIdempotencyLock(ctx, "user:1:POST /users:key", "not-the-token"))
+	other, err = db.AcquireIdempotencyLock(ctx, "user:1:POST /users:key", time.Minute)
+	require.NoError(t, err)
+	assert.Empty(t, other)
+
+	require.NoError(t, db.ReleaseIdempotencyLock(ctx, "user:1:POST /users:key", token))
+	other, err = db.AcquireIdempotencyLock(ctx, "user:1:POST /users:key", time.Minute)
+	require.NoError(t, err)
+	assert.NotEmpty(t, other)
+}
+
+func TestClient_IdempotentResponse(t *testing.T) {
+	db := NewTestDB(t)
+	defer db.Reset(t)
+	ctx := context.Background()
+
+	got, err := db.GetIdempotentResponse(ctx, "user:1:POST /users:key")
+	require.NoError(t, err)
+	assert.Nil(t, got)
+
+	res := &IdempotentResponse{
+		Fingerprint: "fingerprint",
+		Status:      http.StatusCreated,
+		Header:      http.Header{"Content-Type": []string{"application/json"}},
+		Body:        []byte(`{"id":1}`),
+	}
+	require.NoError(t, db.SetIdempotentResponse(ctx, "user:1:POST /users:key", res, time.Minute))
+
+	got, err = db.GetIdempotentResponse(ctx, "user:1:POST /users:key")
+	require.NoError(t, err)
+	assert.Equal(t, res, got)
+}
@@ -0,0 +1,29 @@
+package redisdb
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const introspectionKeyPrefix = "introspection:"
+
+// GetIntrospection loads the introspection result cached under key, returns nil if not found
+func (c *Client) GetIntrospection(ctx context.Context, key string) ([]byte, error) {
+	b, err := c.DB.Get(ctx, introspectionKeyPrefix+key).Bytes()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// SetIntrospection caches the introspection result under key for ttl
+func (c *Client) SetIntrospection(ctx context.Context, key string, result []byte, ttl time.Duration) error {
+	return c.DB.Set(ctx, introspectionKeyPrefix+key, result, ttl).Err()
+}
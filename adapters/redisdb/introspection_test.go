@@ -0,0 +1,29 @@
+package redisdb
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClient_Introspection(t *testing.T) {
+	db := NewTestDB(t)
+	defer db.Reset(t)
+	ctx := context.Background()
+
+	result, err := db.GetIntrospection(ctx, "hash-1")
+	require.NoError(t, err)
+	assert.Nil(t, result)
+
+	require.NoError(t, db.SetIntrospection(ctx, "hash-1", []byte(`{"active":true}`), time.Minute))
+	result, err = db.GetIntrospection(ctx, "hash-1")
+	require.NoError(t, err)
+	assert.Equal(t, `{"active":true}`, string(result))
+
+	ttl, err := db.DB.PTTL(ctx, introspectionKeyPrefix+"hash-1").Result()
+	require.NoError(t, err)
+	assert.InDelta(t, time.Minute, ttl, float64(time.Second))
+}
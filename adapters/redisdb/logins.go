@@ -0,0 +1,256 @@
+package redisdb
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	loginFailuresKeyPrefix = "login-failures:"
+	// loginLockoutsKey indexes the locked out subjects by the end of their lockout
+	loginLockoutsKey = "login-lockouts"
+)
+
+// LoginThrottle is the policy of the failed logins of a subject, e.g. an account or an IP
+type LoginThrottle struct {
+	// Threshold is the number of failures locking the subject out
+	Threshold int
+	// Window is how long the failures are remembered after the last one
+	Window time.Duration
+	// LockoutDuration is how long the subject stays locked out
+	LockoutDuration time.Duration
+	// DelayAfter is the number of failures after which each attempt has to wait for a delay
+	DelayAfter int
+	// BaseDelay is the first delay, it doubles with every failure up to MaxDelay
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+}
+
+// LoginAttempts is the state of the failed logins of a subject
+type LoginAttempts struct {
+	Subject  string
+	Failures int
+	// RetryAt is when the next attempt is allowed after a failure, zero if not delayed
+	RetryAt time.Time
+	// LockedUntil is the end of the lockout of the subject, zero if not locked out
+	LockedUntil time.Time
+	// Locked is set when the attempt just reserved locked the subject out
+	Locked bool
+	// Refused is set when the attempt was not reserved, the subject being delayed or locked out
+	Refused bool
+}
+
+// Blocked reports whether attempts of the subject are refused at now, and until when
+func (a *LoginAttempts) Blocked(now time.Time) (bool, time.Time) {
+	until := a.RetryAt
+	if a.LockedUntil.After(until) {
+		until = a.LockedUntil
+	}
+
+	return now.Before(until), until
+}
+
+// reserveLoginAttemptScript refuses the attempt of a delayed or locked out subject, or counts it as a failed login
+// before the credentials are checked: it delays the next attempt and locks the subject out when the failures reach
+// the threshold. The failures are reset by a lockout.
+// KEYS[1] failures key, KEYS[2] lockouts index, ARGV[1] now in milliseconds, ARGV[2] threshold,
+// ARGV[3] window in milliseconds, ARGV[4] lockout in milliseconds, ARGV[5] failures before delays,
+// ARGV[6] base delay in milliseconds, ARGV[7] max delay in milliseconds, ARGV[8] subject
+var reserveLoginAttemptScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local state = redis.call('HMGET', KEYS[1], 'failures', 'retry_at', 'locked_until')
+local failures = tonumber(state[1] or '0')
+local retry_at = tonumber(state[2] or '0')
+local locked_until = tonumber(state[3] or '0')
+if retry_at > now or locked_until > now then
+	return {failures, retry_at, locked_until, 0, 1}
+end
+
+failures = failures + 1
+retry_at = 0
+local locked = 0
+local ttl = tonumber(ARGV[3])
+
+if failures >= tonumber(ARGV[2]) then
+	locked_until = now + tonumber(ARGV[4])
+	locked = 1
+	failures = 0
+	redis.call('ZADD', KEYS[2], locked_until, ARGV[8])
+elseif failures >= tonumber(ARGV[5]) and tonumber(ARGV[6]) > 0 then
+	local delay = tonumber(ARGV[6]) * 2 ^ (failures - tonumber(ARGV[5]))
+	retry_at = now + math.min(delay, tonumber(ARGV[7]))
+end
+
+redis.call('HSET', KEYS[1], 'failures', failures, 'retry_at', retry_at, 'locked_until', locked_until)
+if locked_until - now > ttl then
+	ttl = locked_until - now
+end
+redis.call('PEXPIRE', KEYS[1], ttl)
+return {failures, retry_at, locked_until, locked, 0}
+`)
+
+// refundLoginAttemptScript gives back an attempt reserved by reserveLoginAttemptScript which did not fail: its
+// failure is forgotten, and its delay and lockout are lifted unless another attempt replaced them.
+// KEYS[1] failures key, KEYS[2] lockouts index, ARGV[1] 1 if the attempt locked the subject out, ARGV[2] threshold,
+// ARGV[3] subject, ARGV[4] retry at of the attempt in milliseconds, ARGV[5] locked until of the attempt in milliseconds
+var refundLoginAttemptScript = redis.NewScript(`
+local state = redis.call('HMGET', KEYS[1], 'failures', 'retry_at', 'locked_until')
+if not state[1] then
+	return 0
+end
+if ARGV[1] == '1' then
+	-- the lockout reset the failures, the ones before the attempt are restored
+	if state[3] == ARGV[5] then
+		redis.call('HSET', KEYS[1], 'failures', tonumber(ARGV[2]) - 1, 'retry_at', 0, 'locked_until', 0)
+		redis.call('ZREM', KEYS[2], ARGV[3])
+	end
+	return 1
+end
+
+local failures = tonumber(state[1])
+if failures > 0 then
+	redis.call('HSET', KEYS[1], 'failures', failures - 1)
+end
+if ARGV[4] ~= '0' and state[2] == ARGV[4] then
+	redis.call('HSET', KEYS[1], 'retry_at', 0)
+end
+return 1
+`)
+
+// resetLoginFailuresScript forgets the failures of a subject but keeps its lockout.
+// KEYS[1] failures key
+var resetLoginFailuresScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 1 then
+	redis.call('HSET', KEYS[1], 'failures', 0, 'retry_at', 0)
+end
+return 1
+`)
+
+// ReserveLoginAttempt counts a login attempt of the subject at now as a failure before its credentials are checked,
+// see LoginThrottle, so that concurrent attempts cannot get past the threshold. The attempt is refused, with
+// Refused set and nothing counted, while the subject is delayed or locked out. An attempt which succeeds is given
+// back with RefundLoginAttempt.
+func (c *Client) ReserveLoginAttempt(ctx context.Context, subject string, t LoginThrottle, now time.Time) (*LoginAttempts, error) {
+	res, err := reserveLoginAttemptScript.Run(ctx, c.DB, []string{loginFailuresKeyPrefix + subject, loginLockoutsKey},
+		now.UnixMilli(), t.Threshold, t.Window.Milliseconds(), t.LockoutDuration.Milliseconds(), t.DelayAfter,
+		t.BaseDelay.Milliseconds(), t.MaxDelay.Milliseconds(), subject).Int64Slice()
+	if err != nil {
+		return nil, err
+	}
+
+	return &LoginAttempts{
+		Subject:     subject,
+		Failures:    int(res[0]),
+		RetryAt:     fromMillis(res[1]),
+		LockedUntil: fromMillis(res[2]),
+		Locked:      res[3] == 1,
+		Refused:     res[4] == 1,
+	}, nil
+}
+
+// RefundLoginAttempt gives back an attempt reserved by ReserveLoginAttempt which did not fail, e.g. the credentials
+// were right: its failure is forgotten, and the delay or the lockout it caused is lifted
+func (c *Client) RefundLoginAttempt(ctx context.Context, a *LoginAttempts, t LoginThrottle) error {
+	locked := 0
+	if a.Locked {
+		locked = 1
+	}
+
+	return refundLoginAttemptScript.Run(ctx, c.DB, []string{loginFailuresKeyPrefix + a.Subject, loginLockoutsKey},
+		locked, t.Threshold, a.Subject, toMillis(a.RetryAt), toMillis(a.LockedUntil)).Err()
+}
+
+// GetLoginAttempts returns the failed logins of the subject, nil if none is remembered
+func (c *Client) GetLoginAttempts(ctx context.Context, subject string) (*LoginAttempts, error) {
+	values, err := c.DB.HMGet(ctx, loginFailuresKeyPrefix+subject, "failures", "retry_at", "locked_until").Result()
+	if err != nil {
+		return nil, err
+	}
+	if values[0] == nil {
+		return nil, nil
+	}
+
+	ints := make([]int64, len(values))
+	for i, v := range values {
+		s, _ := v.(string)
+		ints[i], _ = strconv.ParseInt(s, 10, 64)
+	}
+
+	return &LoginAttempts{
+		Subject:     subject,
+		Failures:    int(ints[0]),
+		RetryAt:     fromMillis(ints[1]),
+		LockedUntil: fromMillis(ints[2]),
+	}, nil
+}
+
+// ResetLoginFailures forgets the failed logins of the subject, e.g. after a successful login.
+// A lockout is not lifted, see ClearLockout.
+func (c *Client) ResetLoginFailures(ctx context.Context, subject string) error {
+	return resetLoginFailuresScript.Run(ctx, c.DB, []string{loginFailuresKeyPrefix + subject}).Err()
+}
+
+// ListLockouts returns the subjects locked out at now, the lockouts ending first come first
+func (c *Client) ListLockouts(ctx context.Context, now time.Time) ([]*LoginAttempts, error) {
+	ms := strconv.FormatInt(now.UnixMilli(), 10)
+	if err := c.DB.ZRemRangeByScore(ctx, loginLockoutsKey, "-inf", ms).Err(); err != nil {
+		return nil, err
+	}
+	subjects, err := c.DB.ZRangeByScore(ctx, loginLockoutsKey, &redis.ZRangeBy{Min: "(" + ms, Max: "+inf"}).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	lockouts := make([]*LoginAttempts, 0, len(subjects))
+	for _, subject := range subjects {
+		a, err := c.GetLoginAttempts(ctx, subject)
+		if err != nil {
+			return nil, err
+		}
+		// the failures expire with the lockout, the index is cleaned up on the next listing
+		if a == nil {
+			continue
+		}
+		lockouts = append(lockouts, a)
+	}
+
+	return lockouts, nil
+}
+
+// ClearLockout lifts the lockout of the subject and forgets its failed logins, it reports whether the subject
+// was listed as locked out
+func (c *Client) ClearLockout(ctx context.Context, subject string) (bool, error) {
+	var removed *redis.IntCmd
+	_, err := c.DB.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		removed = pipe.ZRem(ctx, loginLockoutsKey, subject)
+		pipe.Del(ctx, loginFailuresKeyPrefix+subject)
+
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return removed.Val() > 0, nil
+}
+
+// toMillis converts a time to a unix time in milliseconds, the zero time is 0
+func toMillis(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+
+	return t.UnixMilli()
+}
+
+// fromMillis converts a unix time in milliseconds, 0 is the zero time
+func fromMillis(ms int64) time.Time {
+	if ms == 0 {
+		return time.Time{}
+	}
+
+	return time.UnixMilli(ms)
+}
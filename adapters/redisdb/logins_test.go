@@ -0,0 +1,150 @@
+package redisdb
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClient_LoginFailures(t *testing.T) {
+	db := NewTestDB(t)
+	defer db.Reset(t)
+	ctx := context.Background()
+	now := time.UnixMilli(time.Now().UnixMilli())
+	throttle := LoginThrottle{
+		Threshold:       4,
+		Window:          15 * time.Minute,
+		LockoutDuration: time.Hour,
+		DelayAfter:      2,
+		BaseDelay:       time.Second,
+		MaxDelay:        time.Second * 3 / 2,
+	}
+
+	a, err := db.GetLoginAttempts(ctx, "account:jane.doe@replaceme.com")
+	require.NoError(t, err)
+	assert.Nil(t, a)
+
+	// no delay before DelayAfter failures
+	a, err = db.ReserveLoginAttempt(ctx, "account:jane.doe@replaceme.com", throttle, now)
+	require.NoError(t, err)
+	assert.Equal(t, &LoginAttempts{Subject: "account:jane.doe@replaceme.com", Failures: 1}, a)
+	blocked, _ := a.Blocked(now)
+	assert.False(t, blocked)
+	ttl, err := db.DB.PTTL(ctx, loginFailuresKeyPrefix+"account:jane.doe@replaceme.com").Result()
+	require.NoError(t, err)
+	assert.InDelta(t, (15 * time.Minute).Seconds(), ttl.Seconds(), 1)
+
+	// then the delay doubles up to the max
+	a, err = db.ReserveLoginAttempt(ctx, "account:jane.doe@replaceme.com", throttle, now)
+	require.NoError(t, err)
+	assert.Equal(t, now.Add(time.Second), a.RetryAt)
+	retried := a.RetryAt
+	a, err = db.ReserveLoginAttempt(ctx, "account:jane.doe@replaceme.com", throttle, now)
+	require.NoError(t, err)
+	assert.Equal(t, &LoginAttempts{Subject: "account:jane.doe@replaceme.com", Failures: 2, RetryAt: retried, Refused: true}, a, "the attempts are refused until the delay ends")
+	now = retried
+	a, err = db.ReserveLoginAttempt(ctx, "account:jane.doe@replaceme.com", throttle, now)
+	require.NoError(t, err)
+	assert.Equal(t, now.Add(time.Second*3/2), a.RetryAt)
+	blocked, until := a.Blocked(now)
+	assert.True(t, blocked)
+	assert.Equal(t, a.RetryAt, until)
+
+	got, err := db.GetLoginAttempts(ctx, "account:jane.doe@replaceme.com")
+	require.NoError(t, err)
+	assert.Equal(t, &LoginAttempts{Subject: "account:jane.doe@replaceme.com", Failures: 3, RetryAt: a.RetryAt}, got)
+
+	// the threshold locks the subject out
+	now = a.RetryAt
+	a, err = db.ReserveLoginAttempt(ctx, "account:jane.doe@replaceme.com", throttle, now)
+	require.NoError(t, err)
+	assert.True(t, a.Locked)
+	assert.Equal(t, now.Add(time.Hour), a.LockedUntil)
+	assert.Zero(t, a.Failures)
+	ttl, err = db.DB.PTTL(ctx, loginFailuresKeyPrefix+"account:jane.doe@replaceme.com").Result()
+	require.NoError(t, err)
+	assert.InDelta(t, time.Hour.Seconds(), ttl.Seconds(), 1, "the lockout outlives the window")
+
+	// a success resets the failures, not the lockout
+	require.NoError(t, db.ResetLoginFailures(ctx, "account:jane.doe@replaceme.com"))
+	got, err = db.GetLoginAttempts(ctx, "account:jane.doe@replaceme.com")
+	require.NoError(t, err)
+	assert.Equal(t, now.Add(time.Hour), got.LockedUntil)
+	require.NoError(t, db.ResetLoginFailures(ctx, "ip:192.0.2.1"))
+	exists, err := db.DB.Exists(ctx, loginFailuresKeyPrefix+"ip:192.0.2.1").Result()
+	require.NoError(t, err)
+	assert.Zero(t, exists, "nothing is stored for subjects without failures")
+
+	_, err = db.ReserveLoginAttempt(ctx, "ip:192.0.2.1", LoginThrottle{Threshold: 1, Window: time.Minute, LockoutDuration: time.Minute}, now)
+	require.NoError(t, err)
+	lockouts, err := db.ListLockouts(ctx, now)
+	require.NoError(t, err)
+	require.Len(t, lockouts, 2)
+	assert.Equal(t, "ip:192.0.2.1", lockouts[0].Subject)
+	assert.Equal(t, "account:jane.doe@replaceme.com", lockouts[1].Subject)
+
+	lockouts, err = db.ListLockouts(ctx, now.Add(30*time.Minute))
+	require.NoError(t, err)
+	require.Len(t, lockouts, 1, "ended lockouts are not listed")
+
+	cleared, err := db.ClearLockout(ctx, "account:jane.doe@replaceme.com")
+	require.NoError(t, err)
+	assert.True(t, cleared)
+	cleared, err = db.ClearLockout(ctx, "account:jane.doe@replaceme.com")
+	require.NoError(t, err)
+	assert.False(t, cleared)
+	got, err = db.GetLoginAttempts(ctx, "account:jane.doe@replaceme.com")
+	require.NoError(t, err)
+	assert.Nil(t, got)
+}
+
+func TestClient_RefundLoginAttempt(t *testing.T) {
+	db := NewTestDB(t)
+	defer db.Reset(t)
+	ctx := context.Background()
+	now := time.UnixMilli(time.Now().UnixMilli())
+	throttle := LoginThrottle{
+		Threshold:       3,
+		Window:          15 * time.Minute,
+		LockoutDuration: time.Hour,
+		DelayAfter:      1,
+		BaseDelay:       time.Second,
+		MaxDelay:        time.Second,
+	}
+	const subject = "account:jane.doe@replaceme.com"
+
+	// the refunded attempt leaves neither a failure nor a delay
+	a, err := db.ReserveLoginAttempt(ctx, subject, throttle, now)
+	require.NoError(t, err)
+	require.False(t, a.RetryAt.IsZero())
+	require.NoError(t, db.RefundLoginAttempt(ctx, a, throttle))
+	got, err := db.GetLoginAttempts(ctx, subject)
+	require.NoError(t, err)
+	assert.Equal(t, &LoginAttempts{Subject: subject}, got)
+
+	// nor the lockout it caused
+	for i := 0; i < 2; i++ {
+		a, err = db.ReserveLoginAttempt(ctx, subject, throttle, now)
+		require.NoError(t, err)
+		now = a.RetryAt
+	}
+	a, err = db.ReserveLoginAttempt(ctx, subject, throttle, now)
+	require.NoError(t, err)
+	require.True(t, a.Locked)
+	require.NoError(t, db.RefundLoginAttempt(ctx, a, throttle))
+	got, err = db.GetLoginAttempts(ctx, subject)
+	require.NoError(t, err)
+	assert.Equal(t, &LoginAttempts{Subject: subject, Failures: 2}, got)
+	lockouts, err := db.ListLockouts(ctx, now)
+	require.NoError(t, err)
+	assert.Empty(t, lockouts)
+
+	// nothing is stored for subjects without failures
+	require.NoError(t, db.RefundLoginAttempt(ctx, &LoginAttempts{Subject: "ip:192.0.2.1"}, throttle))
+	exists, err := db.DB.Exists(ctx, loginFailuresKeyPrefix+"ip:192.0.2.1").Result()
+	require.NoError(t, err)
+	assert.Zero(t, exists)
+}
@@ -0,0 +1,66 @@
+package redisdb
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const mfaChallengeKeyPrefix = "mfa-challenge:"
+
+// attemptMFAChallengeScript counts an attempt at the second factor of a challenge and returns its user id and the
+// methods of its first factor. The challenge is deleted by its last attempt.
+// KEYS[1] challenge key, ARGV[1] max attempts
+var attemptMFAChallengeScript = redis.NewScript(`
+local challenge = redis.call('HMGET', KEYS[1], 'user_id', 'auth_methods')
+if not challenge[1] then
+	return false
+end
+if redis.call('HINCRBY', KEYS[1], 'attempts', 1) >= tonumber(ARGV[1]) then
+	redis.call('DEL', KEYS[1])
+end
+return {challenge[1], challenge[2] or ''}
+`)
+
+// MFAChallenge is a login of a user waiting for its second factor
+type MFAChallenge struct {
+	UserID string
+	// AuthMethods are the methods of the first factor, e.g. pwd, see RFC 8176
+	AuthMethods []string
+}
+
+// CreateMFAChallenge stores the hash of the token of a login of the user waiting for its second factor, with the
+// methods of its first factor, valid for ttl
+func (c *Client) CreateMFAChallenge(ctx context.Context, tokenHash, userID string, authMethods []string, ttl time.Duration) error {
+	key := mfaChallengeKeyPrefix + tokenHash
+	_, err := c.DB.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, key, "user_id", userID, "auth_methods", strings.Join(authMethods, " "), "attempts", 0)
+		pipe.PExpire(ctx, key, ttl)
+
+		return nil
+	})
+
+	return err
+}
+
+// AttemptMFAChallenge counts an attempt at the second factor of the challenge and returns it, nil if the challenge
+// is unknown or expired. The challenge stops working after maxAttempts attempts.
+func (c *Client) AttemptMFAChallenge(ctx context.Context, tokenHash string, maxAttempts int) (*MFAChallenge, error) {
+	res, err := attemptMFAChallengeScript.Run(ctx, c.DB, []string{mfaChallengeKeyPrefix + tokenHash}, maxAttempts).StringSlice()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	return &MFAChallenge{UserID: res[0], AuthMethods: strings.Fields(res[1])}, nil
+}
+
+// DeleteMFAChallenge deletes a challenge, e.g. once its second factor is verified
+func (c *Client) DeleteMFAChallenge(ctx context.Context, tokenHash string) error {
+	return c.DB.Del(ctx, mfaChallengeKeyPrefix+tokenHash).Err()
+}
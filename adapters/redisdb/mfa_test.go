@@ -0,0 +1,41 @@
+package redisdb
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClient_MFAChallenge(t *testing.T) {
+	db := NewTestDB(t)
+	defer db.Reset(t)
+	ctx := context.Background()
+
+	require.NoError(t, db.CreateMFAChallenge(ctx, "hash-1", "42", []string{"email"}, 5*time.Minute))
+	ttl, err := db.DB.PTTL(ctx, mfaChallengeKeyPrefix+"hash-1").Result()
+	require.NoError(t, err)
+	assert.InDelta(t, 5*time.Minute, ttl, float64(time.Second))
+
+	challenge, err := db.AttemptMFAChallenge(ctx, "unknown", 3)
+	require.NoError(t, err)
+	assert.Nil(t, challenge)
+
+	// the challenge stops working after its last attempt
+	for i := 0; i < 3; i++ {
+		challenge, err = db.AttemptMFAChallenge(ctx, "hash-1", 3)
+		require.NoError(t, err)
+		assert.Equal(t, &MFAChallenge{UserID: "42", AuthMethods: []string{"email"}}, challenge)
+	}
+	challenge, err = db.AttemptMFAChallenge(ctx, "hash-1", 3)
+	require.NoError(t, err)
+	assert.Nil(t, challenge)
+
+	require.NoError(t, db.CreateMFAChallenge(ctx, "hash-2", "42", []string{"pwd"}, 5*time.Minute))
+	require.NoError(t, db.DeleteMFAChallenge(ctx, "hash-2"))
+	challenge, err = db.AttemptMFAChallenge(ctx, "hash-2", 3)
+	require.NoError(t, err)
+	assert.Nil(t, challenge)
+}
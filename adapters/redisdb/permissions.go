@@ -0,0 +1,171 @@
+package redisdb
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	permissionsKeyPrefix     = "permissions:"
+	permissionsRoleKeyPrefix = "permissions-role:"
+	// permissionsGenerationKey counts the invalidations of the roles, see PermissionsLease
+	permissionsGenerationKey = "permissions-generation"
+	// permissionsLeasePrefix starts the placeholder of the permissions being loaded
+	permissionsLeasePrefix = "lease:"
+	// permissionsLeaseTTL bounds the time to load the permissions of a lease
+	permissionsLeaseTTL = 10 * time.Second
+)
+
+// setPermissionsScript replaces the lease of the permissions of a user, unless the lease was deleted by an
+// invalidation or expired.
+// KEYS[1] permissions key, ARGV[1] lease, ARGV[2] permissions, ARGV[3] ttl in milliseconds
+var setPermissionsScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) ~= ARGV[1] then
+	return 0
+end
+redis.call('SET', KEYS[1], ARGV[2], 'PX', ARGV[3])
+return 1
+`)
+
+// releasePermissionsScript deletes the lease of the permissions of a user, unless it was replaced.
+// KEYS[1] permissions key, ARGV[1] lease
+var releasePermissionsScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) ~= ARGV[1] then
+	return 0
+end
+return redis.call('DEL', KEYS[1])
+`)
+
+// PermissionsLease is taken before the permissions of a user are loaded from the database, they are only cached
+// if nothing invalidated them in the meantime. It is a placeholder in the cache, deleted by the invalidations of
+// the user, along with the generation of the roles, changed by the invalidations of the roles.
+type PermissionsLease struct {
+	token      string
+	generation int64
+}
+
+// GetPermissions loads the cached effective permissions of the user of the issuer, returns nil if not found.
+// A user without permissions gets an empty list.
+func (c *Client) GetPermissions(ctx context.Context, issuer, userID string) ([]string, error) {
+	b, err := c.DB.Get(ctx, permissionsKey(issuer, userID)).Bytes()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+	// the permissions are being loaded
+	if strings.HasPrefix(string(b), permissionsLeasePrefix) {
+		return nil, nil
+	}
+
+	permissions := []string{}
+	if err := json.Unmarshal(b, &permissions); err != nil {
+		return nil, err
+	}
+
+	return permissions, nil
+}
+
+// LeasePermissions takes the lease of the permissions of the user of the issuer before they are loaded, see
+// PermissionsLease. It returns nil when they are already being loaded, they are then not cached.
+func (c *Client) LeasePermissions(ctx context.Context, issuer, userID string) (*PermissionsLease, error) {
+	generation, err := c.permissionsGeneration(ctx)
+	if err != nil {
+		return nil, err
+	}
+	lease := &PermissionsLease{token: permissionsLeasePrefix + randomID(), generation: generation}
+	ok, err := c.DB.SetNX(ctx, permissionsKey(issuer, userID), lease.token, permissionsLeaseTTL).Result()
+	if err != nil || !ok {
+		return nil, err
+	}
+
+	return lease, nil
+}
+
+// SetPermissions caches the effective permissions of the user of the issuer for ttl, loaded under the lease. They
+// are invalidated with any of the roles they come from, see InvalidateRolePermissions, and are not cached when
+// the user or a role was invalidated since the lease was taken.
+func (c *Client) SetPermissions(ctx context.Context, issuer, userID string, permissions []string, roleIDs []int, lease *PermissionsLease, ttl time.Duration) error {
+	if permissions == nil {
+		permissions = []string{}
+	}
+	b, err := json.Marshal(permissions)
+	if err != nil {
+		return err
+	}
+
+	// the lease is tagged before the generation is checked: an invalidation of a role either changed the
+	// generation already, or deletes the lease afterwards
+	key := permissionsKey(issuer, userID)
+	for _, id := range roleIDs {
+		if err := tagScript.Run(ctx, c.DB, []string{permissionsRoleKeyPrefix + strconv.Itoa(id)}, key, ttl.Milliseconds()).Err(); err != nil {
+			return err
+		}
+	}
+	generation, err := c.permissionsGeneration(ctx)
+	if err != nil {
+		return err
+	}
+	if generation != lease.generation {
+		return releasePermissionsScript.Run(ctx, c.DB, []string{key}, lease.token).Err()
+	}
+
+	return setPermissionsScript.Run(ctx, c.DB, []string{key}, lease.token, b, ttl.Milliseconds()).Err()
+}
+
+// InvalidateUserPermissions deletes the cached permissions of the users of the issuer, e.g. when a role is assigned
+// to them
+func (c *Client) InvalidateUserPermissions(ctx context.Context, issuer string, userIDs ...string) error {
+	if len(userIDs) == 0 {
+		return nil
+	}
+
+	keys := make([]string, len(userIDs))
+	for i, id := range userIDs {
+		keys[i] = permissionsKey(issuer, id)
+	}
+
+	return c.deleteKeys(ctx, keys...)
+}
+
+// InvalidateRolePermissions deletes the cached permissions of every user holding one of the roles, e.g. when
+// their permissions change
+func (c *Client) InvalidateRolePermissions(ctx context.Context, roleIDs ...int) error {
+	if len(roleIDs) == 0 {
+		return nil
+	}
+
+	keys := make([]string, len(roleIDs))
+	for i, id := range roleIDs {
+		keys[i] = permissionsRoleKeyPrefix + strconv.Itoa(id)
+	}
+	// the permissions being loaded are not tagged yet, see SetPermissions
+	if err := c.DB.Incr(ctx, permissionsGenerationKey).Err(); err != nil {
+		return err
+	}
+
+	return c.invalidateTags(ctx, keys)
+}
+
+// permissionsGeneration returns the number of invalidations of the roles
+func (c *Client) permissionsGeneration(ctx context.Context) (int64, error) {
+	generation, err := c.DB.Get(ctx, permissionsGenerationKey).Int64()
+	if err == redis.Nil {
+		return 0, nil
+	}
+
+	return generation, err
+}
+
+// permissionsKey is the key of the cached permissions of the user of the issuer, the issuers are URLs and have no
+// spaces
+func permissionsKey(issuer, userID string) string {
+	return permissionsKeyPrefix + issuer + " " + userID
+}
@@ -0,0 +1,97 @@
+package redisdb
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClient_Permissions(t *testing.T) {
+	db := NewTestDB(t)
+	defer db.Reset(t)
+	ctx := context.Background()
+	issuer := "https://replaceme.com/"
+
+	got, err := db.GetPermissions(ctx, issuer, "1")
+	require.NoError(t, err)
+	assert.Nil(t, got)
+
+	set := func(userID string, permissions []string, roleIDs []int) {
+		lease, err := db.LeasePermissions(ctx, issuer, userID)
+		require.NoError(t, err)
+		require.NotNil(t, lease)
+		require.NoError(t, db.SetPermissions(ctx, issuer, userID, permissions, roleIDs, lease, time.Minute))
+	}
+	set("1", []string{"users:read", "users:write"}, []int{1, 2})
+	set("2", []string{"users:read"}, []int{1})
+	set("3", nil, nil)
+
+	got, err = db.GetPermissions(ctx, issuer, "1")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"users:read", "users:write"}, got)
+	got, err = db.GetPermissions(ctx, issuer, "3")
+	require.NoError(t, err)
+	assert.Equal(t, []string{}, got, "a user without permissions is cached too")
+	got, err = db.GetPermissions(ctx, "https://idp.replaceme.com/", "1")
+	require.NoError(t, err)
+	assert.Nil(t, got, "the user 1 of another issuer is another user")
+
+	require.NoError(t, db.InvalidateRolePermissions(ctx, 2))
+	got, err = db.GetPermissions(ctx, issuer, "1")
+	require.NoError(t, err)
+	assert.Nil(t, got)
+	got, err = db.GetPermissions(ctx, issuer, "2")
+	require.NoError(t, err)
+	assert.NotNil(t, got, "only the users holding the role are invalidated")
+
+	require.NoError(t, db.InvalidateUserPermissions(ctx, issuer, "2", "3"))
+	got, err = db.GetPermissions(ctx, issuer, "2")
+	require.NoError(t, err)
+	assert.Nil(t, got)
+	got, err = db.GetPermissions(ctx, issuer, "3")
+	require.NoError(t, err)
+	assert.Nil(t, got)
+
+	assert.NoError(t, db.InvalidateRolePermissions(ctx))
+	assert.NoError(t, db.InvalidateUserPermissions(ctx, issuer))
+}
+
+func TestClient_PermissionsLease(t *testing.T) {
+	db := NewTestDB(t)
+	defer db.Reset(t)
+	ctx := context.Background()
+	issuer := "https://replaceme.com/"
+
+	lease, err := db.LeasePermissions(ctx, issuer, "1")
+	require.NoError(t, err)
+	require.NotNil(t, lease)
+	got, err := db.GetPermissions(ctx, issuer, "1")
+	require.NoError(t, err)
+	assert.Nil(t, got, "the permissions are being loaded")
+	other, err := db.LeasePermissions(ctx, issuer, "1")
+	require.NoError(t, err)
+	assert.Nil(t, other, "one load at a time is cached")
+
+	// a role assigned while the permissions are loaded
+	require.NoError(t, db.InvalidateUserPermissions(ctx, issuer, "1"))
+	require.NoError(t, db.SetPermissions(ctx, issuer, "1", []string{"users:read"}, []int{1}, lease, time.Minute))
+	got, err = db.GetPermissions(ctx, issuer, "1")
+	require.NoError(t, err)
+	assert.Nil(t, got, "the stale permissions are not cached")
+
+	// a role changed while the permissions are loaded, before they are tagged with it
+	lease, err = db.LeasePermissions(ctx, issuer, "1")
+	require.NoError(t, err)
+	require.NotNil(t, lease)
+	require.NoError(t, db.InvalidateRolePermissions(ctx, 1))
+	require.NoError(t, db.SetPermissions(ctx, issuer, "1", []string{"users:read"}, []int{1}, lease, time.Minute))
+	got, err = db.GetPermissions(ctx, issuer, "1")
+	require.NoError(t, err)
+	assert.Nil(t, got, "the stale permissions are not cached")
+	lease, err = db.LeasePermissions(ctx, issuer, "1")
+	require.NoError(t, err)
+	assert.NotNil(t, lease, "the lease of the stale permissions is released")
+}
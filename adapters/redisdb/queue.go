@@ -0,0 +1,171 @@
+package redisdb
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	queueKeyPrefix           = "queue:"
+	queueDelayedKeyPrefix    = "queue-delayed:"
+	queueProcessingKeyPrefix = "queue-processing:"
+	queueDeadKeyPrefix       = "queue-dead:"
+	queueConsumersKeyPrefix  = "queue-consumers:"
+)
+
+// promoteJobsScript moves the delayed jobs which are due to the queue.
+// KEYS[1] delayed jobs key, KEYS[2] queue key, ARGV[1] now in milliseconds
+var promoteJobsScript = redis.NewScript(`
+local jobs = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1])
+for _, job in ipairs(jobs) do
+	redis.call('ZREM', KEYS[1], job)
+	redis.call('LPUSH', KEYS[2], job)
+end
+return #jobs
+`)
+
+// retryJobScript moves a job being processed to the delayed jobs.
+// KEYS[1] processing key, KEYS[2] delayed jobs key, ARGV[1] job, ARGV[2] job with its new attempts, ARGV[3] due time in milliseconds
+var retryJobScript = redis.NewScript(`
+redis.call('LREM', KEYS[1], 1, ARGV[1])
+redis.call('ZADD', KEYS[2], ARGV[3], ARGV[2])
+return 1
+`)
+
+// buryJobScript moves a job being processed to the dead jobs, scored by burial time, and drops the expired ones.
+// KEYS[1] processing key, KEYS[2] dead jobs key, ARGV[1] job, ARGV[2] now in milliseconds, ARGV[3] ttl in milliseconds
+var buryJobScript = redis.NewScript(`
+redis.call('LREM', KEYS[1], 1, ARGV[1])
+redis.call('ZADD', KEYS[2], ARGV[2], ARGV[1])
+redis.call('ZREMRANGEBYSCORE', KEYS[2], '-inf', ARGV[2] - ARGV[3])
+redis.call('PEXPIRE', KEYS[2], ARGV[3])
+return 1
+`)
+
+// requeueJobsScript moves the jobs left in a processing list back to the queue.
+// KEYS[1] processing key, KEYS[2] queue key
+var requeueJobsScript = redis.NewScript(`
+local n = 0
+while redis.call('RPOPLPUSH', KEYS[1], KEYS[2]) do
+	n = n + 1
+end
+return n
+`)
+
+// Job is a message of a queue
+type Job struct {
+	ID       string          `json:"id"`
+	Payload  json.RawMessage `json:"payload"`
+	Attempts int             `json:"attempts"`
+
+	// raw is the job as stored in the processing list
+	raw string
+}
+
+// EnqueueJob adds a job with the payload to the queue
+func (c *Client) EnqueueJob(ctx context.Context, queue string, payload []byte) error {
+	b, err := json.Marshal(Job{ID: randomID(), Payload: payload})
+	if err != nil {
+		return err
+	}
+
+	return c.DB.LPush(ctx, queueKeyPrefix+queue, b).Err()
+}
+
+// DequeueJob waits up to timeout for a job of the queue, returns nil if none came.
+// The job is held in the processing list of the consumer until it is acknowledged, retried or buried.
+func (c *Client) DequeueJob(ctx context.Context, queue, consumer string, timeout time.Duration) (*Job, error) {
+	now := strconv.FormatInt(time.Now().UnixMilli(), 10)
+	if err := promoteJobsScript.Run(ctx, c.DB, []string{queueDelayedKeyPrefix + queue, queueKeyPrefix + queue}, now).Err(); err != nil {
+		return nil, err
+	}
+
+	raw, err := c.DB.BRPopLPush(ctx, queueKeyPrefix+queue, processingKey(queue, consumer), timeout).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	job := Job{raw: raw}
+	if err := json.Unmarshal([]byte(raw), &job); err != nil {
+		return &job, err
+	}
+
+	return &job, nil
+}
+
+// AckJob removes a processed job
+func (c *Client) AckJob(ctx context.Context, queue, consumer string, job *Job) error {
+	return c.DB.LRem(ctx, processingKey(queue, consumer), 1, job.raw).Err()
+}
+
+// RetryJob counts a failed attempt of the job and enqueues it again after delay
+func (c *Client) RetryJob(ctx context.Context, queue, consumer string, job *Job, delay time.Duration) error {
+	retried := *job
+	retried.Attempts++
+	b, err := json.Marshal(retried)
+	if err != nil {
+		return err
+	}
+	due := time.Now().Add(delay).UnixMilli()
+
+	return retryJobScript.Run(ctx, c.DB, []string{processingKey(queue, consumer), queueDelayedKeyPrefix + queue}, job.raw, b, due).Err()
+}
+
+// BuryJob moves a job which cannot be processed to the dead jobs of the queue, where it is kept for inspection for
+// ttl. The dead jobs are a sorted set scored by burial time in milliseconds.
+func (c *Client) BuryJob(ctx context.Context, queue, consumer string, job *Job, ttl time.Duration) error {
+	now := time.Now().UnixMilli()
+
+	return buryJobScript.Run(ctx, c.DB, []string{processingKey(queue, consumer), queueDeadKeyPrefix + queue}, job.raw, now, ttl.Milliseconds()).Err()
+}
+
+// RequeueJobs enqueues again the jobs a consumer left in processing, e.g. when it crashed.
+// It returns the number of requeued jobs.
+func (c *Client) RequeueJobs(ctx context.Context, queue, consumer string) (int, error) {
+	return requeueJobsScript.Run(ctx, c.DB, []string{processingKey(queue, consumer), queueKeyPrefix + queue}).Int()
+}
+
+// TouchJobConsumer records that the consumer is alive for ttl. Once ttl passed without a touch, the jobs it left in
+// processing are reclaimed by ReclaimJobs.
+func (c *Client) TouchJobConsumer(ctx context.Context, queue, consumer string, ttl time.Duration) error {
+	expiresAt := float64(time.Now().Add(ttl).UnixMilli())
+
+	return c.DB.ZAdd(ctx, queueConsumersKeyPrefix+queue, &redis.Z{Score: expiresAt, Member: consumer}).Err()
+}
+
+// ReclaimJobs enqueues again the jobs left in processing by the consumers which are not alive anymore, e.g. the ones
+// of a crashed instance that did not come back under the same consumer name. It returns the number of requeued jobs.
+func (c *Client) ReclaimJobs(ctx context.Context, queue string) (int, error) {
+	now := strconv.FormatInt(time.Now().UnixMilli(), 10)
+	consumers, err := c.DB.ZRangeByScore(ctx, queueConsumersKeyPrefix+queue, &redis.ZRangeBy{Min: "-inf", Max: now}).Result()
+	if err != nil {
+		return 0, err
+	}
+
+	total := 0
+	for _, consumer := range consumers {
+		n, err := c.RequeueJobs(ctx, queue, consumer)
+		if err != nil {
+			return total, err
+		}
+		total += n
+		if err := c.DB.ZRem(ctx, queueConsumersKeyPrefix+queue, consumer).Err(); err != nil {
+			return total, err
+		}
+	}
+
+	return total, nil
+}
+
+// processingKey is the list of the jobs of the queue a consumer is processing
+func processingKey(queue, consumer string) string {
+	return queueProcessingKeyPrefix + queue + ":" + consumer
+}
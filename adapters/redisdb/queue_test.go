@@ -0,0 +1,102 @@
+package redisdb
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClient_Queue(t *testing.T) {
+	db := NewTestDB(t)
+	defer db.Reset(t)
+	ctx := context.Background()
+
+	job, err := db.DequeueJob(ctx, "mail", "worker-1", 10*time.Millisecond)
+	require.NoError(t, err)
+	assert.Nil(t, job, "the queue is empty")
+
+	require.NoError(t, db.EnqueueJob(ctx, "mail", []byte(`{"to":"jane.doe@replaceme.com"}`)))
+	require.NoError(t, db.EnqueueJob(ctx, "mail", []byte(`{"to":"john.doe@replaceme.com"}`)))
+
+	// jobs are dequeued in order
+	first, err := db.DequeueJob(ctx, "mail", "worker-1", time.Second)
+	require.NoError(t, err)
+	require.NotNil(t, first)
+	assert.NotEmpty(t, first.ID)
+	assert.JSONEq(t, `{"to":"jane.doe@replaceme.com"}`, string(first.Payload))
+	assert.Zero(t, first.Attempts)
+	second, err := db.DequeueJob(ctx, "mail", "worker-1", time.Second)
+	require.NoError(t, err)
+	require.NotNil(t, second)
+	assert.JSONEq(t, `{"to":"john.doe@replaceme.com"}`, string(second.Payload))
+
+	// a failed job is retried once due
+	require.NoError(t, db.RetryJob(ctx, "mail", "worker-1", first, 0))
+	retried, err := db.DequeueJob(ctx, "mail", "worker-1", time.Second)
+	require.NoError(t, err)
+	require.NotNil(t, retried)
+	assert.Equal(t, first.ID, retried.ID)
+	assert.Equal(t, 1, retried.Attempts)
+
+	require.NoError(t, db.RetryJob(ctx, "mail", "worker-1", retried, time.Hour))
+	job, err = db.DequeueJob(ctx, "mail", "worker-1", 10*time.Millisecond)
+	require.NoError(t, err)
+	assert.Nil(t, job, "the retry is not due yet")
+
+	// jobs left in processing are requeued
+	n, err := db.RequeueJobs(ctx, "mail", "worker-1")
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	requeued, err := db.DequeueJob(ctx, "mail", "worker-2", time.Second)
+	require.NoError(t, err)
+	require.NotNil(t, requeued)
+	assert.Equal(t, second.ID, requeued.ID)
+
+	require.NoError(t, db.BuryJob(ctx, "mail", "worker-2", requeued, time.Hour))
+	dead, err := db.DB.ZRange(ctx, queueDeadKeyPrefix+"mail", 0, -1).Result()
+	require.NoError(t, err)
+	assert.Len(t, dead, 1)
+	ttl, err := db.DB.PTTL(ctx, queueDeadKeyPrefix+"mail").Result()
+	require.NoError(t, err)
+	assert.InDelta(t, time.Hour, ttl, float64(time.Minute), "the dead jobs expire")
+
+	require.NoError(t, db.EnqueueJob(ctx, "mail", []byte(`{}`)))
+	job, err = db.DequeueJob(ctx, "mail", "worker-2", time.Second)
+	require.NoError(t, err)
+	require.NoError(t, db.AckJob(ctx, "mail", "worker-2", job))
+	processing, err := db.DB.LLen(ctx, processingKey("mail", "worker-2")).Result()
+	require.NoError(t, err)
+	assert.Zero(t, processing)
+}
+
+func TestClient_ReclaimJobs(t *testing.T) {
+	db := NewTestDB(t)
+	defer db.Reset(t)
+	ctx := context.Background()
+
+	require.NoError(t, db.EnqueueJob(ctx, "mail", []byte(`{"to":"jane.doe@replaceme.com"}`)))
+	require.NoError(t, db.EnqueueJob(ctx, "mail", []byte(`{"to":"john.doe@replaceme.com"}`)))
+	require.NoError(t, db.TouchJobConsumer(ctx, "mail", "gone-0", -time.Second))
+	gone, err := db.DequeueJob(ctx, "mail", "gone-0", time.Second)
+	require.NoError(t, err)
+	require.NotNil(t, gone)
+	require.NoError(t, db.TouchJobConsumer(ctx, "mail", "alive-0", time.Minute))
+	alive, err := db.DequeueJob(ctx, "mail", "alive-0", time.Second)
+	require.NoError(t, err)
+	require.NotNil(t, alive)
+
+	n, err := db.ReclaimJobs(ctx, "mail")
+	require.NoError(t, err)
+	assert.Equal(t, 1, n, "only the jobs of the consumer which is not alive are reclaimed")
+	reclaimed, err := db.DequeueJob(ctx, "mail", "alive-0", time.Second)
+	require.NoError(t, err)
+	require.NotNil(t, reclaimed)
+	assert.Equal(t, gone.ID, reclaimed.ID)
+
+	consumers, err := db.DB.ZRange(ctx, queueConsumersKeyPrefix+"mail", 0, -1).Result()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"alive-0"}, consumers)
+}
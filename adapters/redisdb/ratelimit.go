@@ -0,0 +1,169 @@
+package redisdb
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const rateLimitKeyPrefix = "ratelimit:"
+
+// Rate limit algorithms
+const (
+	SlidingWindow = "sliding_window"
+	TokenBucket   = "token_bucket"
+)
+
+// slidingWindowScript keeps one sorted set member per accepted request in the last window.
+// Redis TIME is used so replicas with skewed clocks share the same window.
+// KEYS[1] key, ARGV[1] window in microseconds, ARGV[2] limit, ARGV[3] unique member suffix
+// returns {allowed, remaining, retry after ms, reset after ms}
+var slidingWindowScript = redis.NewScript(`
+local key = KEYS[1]
+local window = tonumber(ARGV[1])
+local limit = tonumber(ARGV[2])
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000000 + tonumber(t[2])
+
+redis.call('ZREMRANGEBYSCORE', key, '-inf', now - window)
+local count = redis.call('ZCARD', key)
+local allowed = 0
+if count < limit then
+	redis.call('ZADD', key, now, now .. '-' .. ARGV[3])
+	count = count + 1
+	allowed = 1
+end
+redis.call('PEXPIRE', key, math.ceil(window / 1000))
+
+local reset = 0
+local oldest = redis.call('ZRANGE', key, 0, 0, 'WITHSCORES')
+if oldest[2] then
+	reset = math.ceil((tonumber(oldest[2]) + window - now) / 1000)
+end
+
+local retry = 0
+if allowed == 0 then
+	retry = reset
+end
+
+return {allowed, limit - count, retry, reset}
+`)
+
+// tokenBucketScript refills the bucket lazily based on the time elapsed since the last request.
+// KEYS[1] key, ARGV[1] capacity, ARGV[2] refill rate in tokens per microsecond
+// returns {allowed, remaining, retry after ms, reset after ms}
+var tokenBucketScript = redis.NewScript(`
+local key = KEYS[1]
+local capacity = tonumber(ARGV[1])
+local rate = tonumber(ARGV[2])
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000000 + tonumber(t[2])
+
+local state = redis.call('HMGET', key, 'tokens', 'ts')
+local tokens = tonumber(state[1]) or capacity
+local ts = tonumber(state[2]) or now
+tokens = math.min(capacity, tokens + math.max(0, now - ts) * rate)
+
+local allowed = 0
+local retry = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+else
+	retry = math.ceil((1 - tokens) / rate / 1000)
+end
+
+local reset = math.ceil((capacity - tokens) / rate / 1000)
+redis.call('HSET', key, 'tokens', tostring(tokens), 'ts', tostring(now))
+redis.call('PEXPIRE', key, reset + 1000)
+
+return {allowed, math.floor(tokens), retry, reset}
+`)
+
+// RateLimit is a rate limit policy
+type RateLimit struct {
+	// Algorithm is SlidingWindow or TokenBucket
+	Algorithm string
+	// Limit is the number of requests allowed per Period
+	Limit  int
+	Period time.Duration
+	// Burst is the token bucket capacity, defaults to Limit
+	Burst int
+}
+
+// RateLimitResult is the outcome of a rate limit check
+type RateLimitResult struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	// RetryAfter is the time to wait until a request can be allowed again, zero if Allowed
+	RetryAfter time.Duration
+	// ResetAfter is the time until the limit is fully restored
+	ResetAfter time.Duration
+}
+
+// Allow checks and consumes one request of the rate limit identified by key.
+// The check is a single atomic Lua script so it is safe across replicas.
+func (c *Client) Allow(ctx context.Context, key string, l RateLimit) (*RateLimitResult, error) {
+	if l.Limit <= 0 || l.Period <= 0 {
+		return nil, fmt.Errorf("invalid rate limit %d per %s", l.Limit, l.Period)
+	}
+
+	var (
+		res   []interface{}
+		err   error
+		limit = l.Limit
+	)
+	key = rateLimitKeyPrefix + l.Algorithm + ":" + key
+
+	switch l.Algorithm {
+	case SlidingWindow:
+		res, err = slidingWindowScript.Run(ctx, c.DB, []string{key}, l.Period.Microseconds(), l.Limit, randomID()).Slice()
+	case TokenBucket:
+		if l.Burst > 0 {
+			limit = l.Burst
+		}
+		rate := float64(l.Limit) / float64(l.Period.Microseconds())
+		res, err = tokenBucketScript.Run(ctx, c.DB, []string{key}, limit, rate).Slice()
+	default:
+		return nil, fmt.Errorf("unknown rate limit algorithm %q", l.Algorithm)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(res) != 4 {
+		return nil, fmt.Errorf("unexpected rate limit script result %v", res)
+	}
+	values := make([]int64, len(res))
+	for i, v := range res {
+		n, ok := v.(int64)
+		if !ok {
+			return nil, fmt.Errorf("unexpected rate limit script result %v", res)
+		}
+		values[i] = n
+	}
+
+	return &RateLimitResult{
+		Allowed:    values[0] == 1,
+		Limit:      limit,
+		Remaining:  int(values[1]),
+		RetryAfter: time.Duration(values[2]) * time.Millisecond,
+		ResetAfter: time.Duration(values[3]) * time.Millisecond,
+	}, nil
+}
+
+// randomID returns a random id, used to tell apart requests accepted in the same microsecond
+func randomID() string {
+	b := make([]byte, 8)
+	// crypto/rand only fails if the OS random source is unavailable
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,79 @@
+package redisdb
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClient_Allow(t *testing.T) {
+	db := NewTestDB(t)
+	defer db.Reset(t)
+
+	tests := []struct {
+		name  string
+		limit RateLimit
+	}{
+		{
+			name:  "sliding window",
+			limit: RateLimit{Algorithm: SlidingWindow, Limit: 3, Period: time.Minute},
+		},
+		{
+			name:  "token bucket",
+			limit: RateLimit{Algorithm: TokenBucket, Limit: 3, Period: time.Minute},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			key := "test:" + tt.name
+
+			for i := 0; i < tt.limit.Limit; i++ {
+				res, err := db.Allow(ctx, key, tt.limit)
+				require.NoError(t, err)
+				assert.True(t, res.Allowed)
+				assert.Equal(t, tt.limit.Limit, res.Limit)
+				assert.Equal(t, tt.limit.Limit-i-1, res.Remaining)
+				assert.Zero(t, res.RetryAfter)
+			}
+
+			res, err := db.Allow(ctx, key, tt.limit)
+			require.NoError(t, err)
+			assert.False(t, res.Allowed)
+			assert.Zero(t, res.Remaining)
+			assert.Greater(t, res.RetryAfter, time.Duration(0))
+			assert.LessOrEqual(t, res.RetryAfter, tt.limit.Period)
+
+			// other keys are not affected
+			res, err = db.Allow(ctx, key+":other", tt.limit)
+			require.NoError(t, err)
+			assert.True(t, res.Allowed)
+		})
+	}
+
+	t.Run("token bucket burst", func(t *testing.T) {
+		ctx := context.Background()
+		limit := RateLimit{Algorithm: TokenBucket, Limit: 1, Period: time.Hour, Burst: 2}
+
+		for i := 0; i < 2; i++ {
+			res, err := db.Allow(ctx, "test:burst", limit)
+			require.NoError(t, err)
+			assert.True(t, res.Allowed)
+			assert.Equal(t, 2, res.Limit)
+		}
+		res, err := db.Allow(ctx, "test:burst", limit)
+		require.NoError(t, err)
+		assert.False(t, res.Allowed)
+	})
+
+	t.Run("invalid limits", func(t *testing.T) {
+		_, err := db.Allow(context.Background(), "test:invalid", RateLimit{Algorithm: "fixed_window", Limit: 1, Period: time.Second})
+		assert.EqualError(t, err, `unknown rate limit algorithm "fixed_window"`)
+
+		_, err = db.Allow(context.Background(), "test:invalid", RateLimit{Algorithm: SlidingWindow})
+		assert.EqualError(t, err, "invalid rate limit 0 per 0s")
+	})
+}
@@ -0,0 +1,366 @@
+package redisdb
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// The keys of the sessions of a user share the hash tag {<user id>}, so that the scripts revoking and rotating them
+// run on a single node of a Redis Cluster. The refresh tokens are looked up by hash only, they are kept out of the
+// scripts and expire with the sessions, a refresh token of a revoked session finds no session.
+const (
+	sessionKeyPrefix       = "session:"
+	sessionAccessKeyPrefix = "session-access:"
+	refreshTokenKeyPrefix  = "refresh-token:"
+	userSessionsKeyPrefix  = "user-sessions:"
+	revokedTokenKeyPrefix  = "revoked-jti:"
+)
+
+// ErrRefreshTokenReused is returned when a rotated refresh token is presented again,
+// the session it belonged to has been revoked.
+var ErrRefreshTokenReused = errors.New("refresh token reused")
+
+// revokeSessionLua deletes a session of a user and revokes its access tokens, until they expire.
+// It is prepended to the scripts revoking sessions, which declare the keys it is given.
+const revokeSessionLua = `
+local function revoke(key, access_key, sessions_key, revoked_key, sid, now, ttl)
+	redis.call('SREM', sessions_key, sid)
+	if redis.call('EXISTS', key) == 0 then
+		return 0
+	end
+	for _, jti in ipairs(redis.call('SMEMBERS', access_key)) do
+		redis.call('ZADD', revoked_key, now + ttl, jti)
+	end
+	redis.call('ZREMRANGEBYSCORE', revoked_key, '-inf', now)
+	if redis.call('PTTL', revoked_key) < ttl then
+		redis.call('PEXPIRE', revoked_key, ttl)
+	end
+	redis.call('DEL', key, access_key)
+	return 1
+end
+`
+
+// rotateRefreshTokenScript replaces the current refresh token of a session. A refresh token of the
+// session which is not the current one has been rotated already, the whole session is revoked.
+// KEYS[1] session key, KEYS[2] session access tokens key, KEYS[3] user sessions key, KEYS[4] revoked tokens key,
+// ARGV[1] session id, ARGV[2] refresh token hash, ARGV[3] new refresh token hash, ARGV[4] time of use,
+// ARGV[5] session ttl in milliseconds, ARGV[6] now in milliseconds, ARGV[7] access token ttl in milliseconds
+var rotateRefreshTokenScript = redis.NewScript(revokeSessionLua + `
+local current = redis.call('HGET', KEYS[1], 'refresh_hash')
+if not current then
+	return false
+end
+if current ~= ARGV[2] then
+	revoke(KEYS[1], KEYS[2], KEYS[3], KEYS[4], ARGV[1], tonumber(ARGV[6]), tonumber(ARGV[7]))
+	return 'reused'
+end
+local ttl = tonumber(ARGV[5])
+redis.call('HSET', KEYS[1], 'refresh_hash', ARGV[3], 'last_used_at', ARGV[4])
+for i = 1, 3 do
+	if redis.call('PTTL', KEYS[i]) < ttl then
+		redis.call('PEXPIRE', KEYS[i], ttl)
+	end
+end
+return 'rotated'
+`)
+
+// revokeSessionScript revokes a session of the user, the session key tells which user it belongs to.
+// KEYS[1] session key, KEYS[2] session access tokens key, KEYS[3] user sessions key, KEYS[4] revoked tokens key,
+// ARGV[1] session id, ARGV[2] now in milliseconds, ARGV[3] access token ttl in milliseconds
+var revokeSessionScript = redis.NewScript(revokeSessionLua + `
+return revoke(KEYS[1], KEYS[2], KEYS[3], KEYS[4], ARGV[1], tonumber(ARGV[2]), tonumber(ARGV[3]))
+`)
+
+// revokeUserSessionsScript revokes the listed sessions of a user. It returns the number of sessions of the user left,
+// the ones created since they were listed.
+// KEYS[1] user sessions key, KEYS[2] revoked tokens key, KEYS[3..] session and session access tokens keys of each
+// session, ARGV[1] now in milliseconds, ARGV[2] access token ttl in milliseconds, ARGV[3..] session ids
+var revokeUserSessionsScript = redis.NewScript(revokeSessionLua + `
+for i = 3, #ARGV do
+	local k = 2 * (i - 2) + 1
+	revoke(KEYS[k], KEYS[k + 1], KEYS[1], KEYS[2], ARGV[i], tonumber(ARGV[1]), tonumber(ARGV[2]))
+end
+return redis.call('SCARD', KEYS[1])
+`)
+
+// addSessionAccessTokenScript adds an access token to a session, the set of access tokens lives
+// as long as the session or as long as its last access token.
+// KEYS[1] session access tokens key, ARGV[1] jti, ARGV[2] access token ttl in milliseconds
+var addSessionAccessTokenScript = redis.NewScript(`
+redis.call('SADD', KEYS[1], ARGV[1])
+local ttl = tonumber(ARGV[2])
+if redis.call('PTTL', KEYS[1]) < ttl then
+	redis.call('PEXPIRE', KEYS[1], ttl)
+end
+return 1
+`)
+
+// Session is a login of a user, kept alive by its refresh tokens
+type Session struct {
+	ID         string
+	UserID     string
+	CreatedAt  time.Time
+	LastUsedAt time.Time
+	UserAgent  string
+	IP         string
+	// AuthMethods are the methods the user authenticated with, e.g. pwd and otp, see RFC 8176
+	AuthMethods []string
+	// AuthTime is when the user authenticated, it is kept by the refreshes of the session
+	AuthTime time.Time
+}
+
+// CreateSession stores a session with its first refresh token, the session expires if unused for ttl
+func (c *Client) CreateSession(ctx context.Context, s *Session, refreshHash string, ttl time.Duration) error {
+	if s.ID == "" {
+		s.ID = randomID()
+	}
+	key := sessionKey(s.UserID, s.ID)
+	_, err := c.DB.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, key,
+			"user_id", s.UserID,
+			"refresh_hash", refreshHash,
+			"created_at", s.CreatedAt.UTC().Format(time.RFC3339Nano),
+			"last_used_at", s.LastUsedAt.UTC().Format(time.RFC3339Nano),
+			"user_agent", s.UserAgent,
+			"ip", s.IP,
+			"auth_methods", strings.Join(s.AuthMethods, " "),
+			"auth_time", formatTime(s.AuthTime),
+		)
+		pipe.PExpire(ctx, key, ttl)
+		pipe.SAdd(ctx, userSessionsKey(s.UserID), s.ID)
+		pipe.PExpire(ctx, userSessionsKey(s.UserID), ttl)
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return c.DB.Set(ctx, refreshTokenKeyPrefix+refreshHash, refreshTokenValue(s.UserID, s.ID), ttl).Err()
+}
+
+// AddSessionAccessToken records an access token issued for the session of the user, it is revoked with the session.
+// ttl is the lifetime of the access token.
+func (c *Client) AddSessionAccessToken(ctx context.Context, userID, sessionID, tokenID string, ttl time.Duration) error {
+	return addSessionAccessTokenScript.Run(ctx, c.DB, []string{sessionAccessKey(userID, sessionID)}, tokenID, ttl.Milliseconds()).Err()
+}
+
+// RotateRefreshToken replaces the refresh token of a session and extends the session for ttl.
+// It returns the session, nil if the refresh token is unknown or expired. A refresh token which has
+// already been rotated revokes its session, whose access tokens are revoked for accessTTL,
+// and ErrRefreshTokenReused is returned.
+func (c *Client) RotateRefreshToken(ctx context.Context, refreshHash, newRefreshHash string, usedAt time.Time, ttl, accessTTL time.Duration) (*Session, error) {
+	v, err := c.DB.Get(ctx, refreshTokenKeyPrefix+refreshHash).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+	userID, sessionID, ok := strings.Cut(v, " ")
+	if !ok {
+		return nil, nil
+	}
+	// the new refresh token is stored first, it is not handed out if the rotation fails
+	if err := c.DB.Set(ctx, refreshTokenKeyPrefix+newRefreshHash, v, ttl).Err(); err != nil {
+		return nil, err
+	}
+
+	res, err := rotateRefreshTokenScript.Run(ctx, c.DB, sessionKeys(userID, sessionID), sessionID, refreshHash, newRefreshHash,
+		usedAt.UTC().Format(time.RFC3339Nano), ttl.Milliseconds(), time.Now().UnixMilli(), accessTTL.Milliseconds()).Text()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+	if res == "reused" {
+		return nil, ErrRefreshTokenReused
+	}
+
+	return c.GetSession(ctx, userID, sessionID)
+}
+
+// GetSession loads a session of the user, returns nil if not found
+func (c *Client) GetSession(ctx context.Context, userID, id string) (*Session, error) {
+	h, err := c.DB.HGetAll(ctx, sessionKey(userID, id)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	return sessionFromHash(id, h)
+}
+
+// ListSessions returns the sessions of a user, most recently used first
+func (c *Client) ListSessions(ctx context.Context, userID string) ([]*Session, error) {
+	ids, err := c.DB.SMembers(ctx, userSessionsKey(userID)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	cmds := make([]*redis.StringStringMapCmd, len(ids))
+	if _, err := c.DB.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, id := range ids {
+			cmds[i] = pipe.HGetAll(ctx, sessionKey(userID, id))
+		}
+
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	sessions := make([]*Session, 0, len(ids))
+	var expired []interface{}
+	for i, cmd := range cmds {
+		s, err := sessionFromHash(ids[i], cmd.Val())
+		if err != nil {
+			return nil, err
+		}
+		if s == nil {
+			expired = append(expired, ids[i])
+			continue
+		}
+		sessions = append(sessions, s)
+	}
+	if len(expired) > 0 {
+		if err := c.DB.SRem(ctx, userSessionsKey(userID), expired...).Err(); err != nil {
+			return nil, err
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].LastUsedAt.After(sessions[j].LastUsedAt)
+	})
+
+	return sessions, nil
+}
+
+// RevokeSession revokes a session of the user, its access tokens are revoked for accessTTL.
+// It returns false if the user has no such session.
+func (c *Client) RevokeSession(ctx context.Context, userID, sessionID string, accessTTL time.Duration) (bool, error) {
+	n, err := revokeSessionScript.Run(ctx, c.DB, sessionKeys(userID, sessionID), sessionID, time.Now().UnixMilli(),
+		accessTTL.Milliseconds()).Int()
+
+	return n == 1, err
+}
+
+// RevokeUserSessions revokes all the sessions of the user, their access tokens are revoked for accessTTL. The
+// sessions are listed first, the keys of a script are declared, and listed again if some were created meanwhile.
+func (c *Client) RevokeUserSessions(ctx context.Context, userID string, accessTTL time.Duration) error {
+	for {
+		ids, err := c.DB.SMembers(ctx, userSessionsKey(userID)).Result()
+		if err != nil || len(ids) == 0 {
+			return err
+		}
+
+		keys := []string{userSessionsKey(userID), revokedTokensKey(userID)}
+		args := []interface{}{time.Now().UnixMilli(), accessTTL.Milliseconds()}
+		for _, id := range ids {
+			keys = append(keys, sessionKey(userID, id), sessionAccessKey(userID, id))
+			args = append(args, id)
+		}
+		left, err := revokeUserSessionsScript.Run(ctx, c.DB, keys, args...).Int()
+		if err != nil || left == 0 {
+			return err
+		}
+	}
+}
+
+// IsTokenRevoked tells if the access token of the jti issued to the user has been revoked
+func (c *Client) IsTokenRevoked(ctx context.Context, userID, tokenID string) (bool, error) {
+	expiresAt, err := c.DB.ZScore(ctx, revokedTokensKey(userID), tokenID).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	return int64(expiresAt) > time.Now().UnixMilli(), nil
+}
+
+// userTag is the hash tag of the keys of the sessions of a user
+func userTag(userID string) string {
+	return "{" + userID + "}"
+}
+
+// sessionKey is the hash of a session of the user
+func sessionKey(userID, sessionID string) string {
+	return sessionKeyPrefix + userTag(userID) + ":" + sessionID
+}
+
+// sessionAccessKey is the set of the access tokens issued for a session of the user
+func sessionAccessKey(userID, sessionID string) string {
+	return sessionAccessKeyPrefix + userTag(userID) + ":" + sessionID
+}
+
+// sessionKeys are the keys of the scripts of a session of the user
+func sessionKeys(userID, sessionID string) []string {
+	return []string{sessionKey(userID, sessionID), sessionAccessKey(userID, sessionID), userSessionsKey(userID),
+		revokedTokensKey(userID)}
+}
+
+// revokedTokensKey is the sorted set of the revoked access tokens of the user, scored by their expiry in milliseconds
+func revokedTokensKey(userID string) string {
+	return revokedTokenKeyPrefix + userTag(userID)
+}
+
+// userSessionsKey is the set of the session ids of the user
+func userSessionsKey(userID string) string {
+	return userSessionsKeyPrefix + userTag(userID)
+}
+
+// refreshTokenValue is the value of a refresh token key, the user and the session it refreshes
+func refreshTokenValue(userID, sessionID string) string {
+	return userID + " " + sessionID
+}
+
+// sessionFromHash parses a session stored as a hash, returns nil for an empty hash
+func sessionFromHash(id string, h map[string]string) (*Session, error) {
+	if len(h) == 0 {
+		return nil, nil
+	}
+	createdAt, err := time.Parse(time.RFC3339Nano, h["created_at"])
+	if err != nil {
+		return nil, err
+	}
+	lastUsedAt, err := time.Parse(time.RFC3339Nano, h["last_used_at"])
+	if err != nil {
+		return nil, err
+	}
+
+	// sessions created before the authentication methods were recorded have none
+	var authTime time.Time
+	if h["auth_time"] != "" {
+		if authTime, err = time.Parse(time.RFC3339Nano, h["auth_time"]); err != nil {
+			return nil, err
+		}
+	}
+
+	return &Session{
+		ID:          id,
+		UserID:      h["user_id"],
+		CreatedAt:   createdAt,
+		LastUsedAt:  lastUsedAt,
+		UserAgent:   h["user_agent"],
+		IP:          h["ip"],
+		AuthMethods: strings.Fields(h["auth_methods"]),
+		AuthTime:    authTime,
+	}, nil
+}
+
+// formatTime formats a time stored in a hash, the zero time is empty
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+
+	return t.UTC().Format(time.RFC3339Nano)
+}
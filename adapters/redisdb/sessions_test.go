@@ -0,0 +1,169 @@
+package redisdb
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestSession(t *testing.T, db *Client, userID, refreshHash string, lastUsedAt time.Time) *Session {
+	s := &Session{UserID: userID, CreatedAt: lastUsedAt, LastUsedAt: lastUsedAt, UserAgent: "curl/7.79.1", IP: "192.0.2.1",
+		AuthMethods: []string{"pwd", "otp"}, AuthTime: lastUsedAt}
+	require.NoError(t, db.CreateSession(context.Background(), s, refreshHash, time.Hour))
+	require.NotEmpty(t, s.ID)
+
+	return s
+}
+
+func TestClient_RotateRefreshToken(t *testing.T) {
+	db := NewTestDB(t)
+	defer db.Reset(t)
+	ctx := context.Background()
+	createdAt := time.Date(2022, 7, 1, 10, 0, 0, 0, time.UTC)
+
+	s := newTestSession(t, db, "42", "hash-1", createdAt)
+	require.NoError(t, db.AddSessionAccessToken(ctx, "42", s.ID, "jti-1", time.Minute))
+
+	// unknown refresh token
+	got, err := db.RotateRefreshToken(ctx, "unknown", "hash-2", createdAt, time.Hour, time.Minute)
+	require.NoError(t, err)
+	assert.Nil(t, got)
+
+	usedAt := createdAt.Add(time.Minute)
+	got, err = db.RotateRefreshToken(ctx, "hash-1", "hash-2", usedAt, time.Hour, time.Minute)
+	require.NoError(t, err)
+	require.NotNil(t, got)
+	assert.Equal(t, s.ID, got.ID)
+	assert.Equal(t, "42", got.UserID)
+	assert.Equal(t, createdAt, got.CreatedAt)
+	assert.Equal(t, usedAt, got.LastUsedAt)
+	assert.Equal(t, []string{"pwd", "otp"}, got.AuthMethods)
+	assert.Equal(t, createdAt, got.AuthTime, "refreshes keep the authentication time")
+	require.NoError(t, db.AddSessionAccessToken(ctx, "42", s.ID, "jti-2", time.Minute))
+
+	revoked, err := db.IsTokenRevoked(ctx, "42", "jti-1")
+	require.NoError(t, err)
+	assert.False(t, revoked, "rotation keeps the access tokens")
+
+	// the rotated token is reused, the whole family is revoked
+	_, err = db.RotateRefreshToken(ctx, "hash-1", "hash-3", usedAt, time.Hour, time.Minute)
+	assert.ErrorIs(t, err, ErrRefreshTokenReused)
+
+	for _, jti := range []string{"jti-1", "jti-2"} {
+		revoked, err := db.IsTokenRevoked(ctx, "42", jti)
+		require.NoError(t, err)
+		assert.True(t, revoked, jti)
+	}
+	got, err = db.RotateRefreshToken(ctx, "hash-2", "hash-3", usedAt, time.Hour, time.Minute)
+	require.NoError(t, err)
+	assert.Nil(t, got, "the current token of the family is revoked too")
+
+	sessions, err := db.ListSessions(ctx, "42")
+	require.NoError(t, err)
+	assert.Empty(t, sessions)
+}
+
+func TestClient_ListSessions(t *testing.T) {
+	db := NewTestDB(t)
+	defer db.Reset(t)
+	ctx := context.Background()
+	createdAt := time.Date(2022, 7, 1, 10, 0, 0, 0, time.UTC)
+
+	older := newTestSession(t, db, "42", "hash-1", createdAt)
+	newer := newTestSession(t, db, "42", "hash-2", createdAt.Add(time.Hour))
+	newTestSession(t, db, "43", "hash-3", createdAt)
+
+	sessions, err := db.ListSessions(ctx, "42")
+	require.NoError(t, err)
+	assert.Equal(t, []*Session{newer, older}, sessions)
+
+	// an expired session is pruned
+	require.NoError(t, db.DB.Del(ctx, sessionKey("42", older.ID)).Err())
+	sessions, err = db.ListSessions(ctx, "42")
+	require.NoError(t, err)
+	assert.Equal(t, []*Session{newer}, sessions)
+	ids, err := db.DB.SMembers(ctx, userSessionsKey("42")).Result()
+	require.NoError(t, err)
+	assert.Equal(t, []string{newer.ID}, ids)
+}
+
+func TestClient_RevokeSession(t *testing.T) {
+	db := NewTestDB(t)
+	defer db.Reset(t)
+	ctx := context.Background()
+	createdAt := time.Date(2022, 7, 1, 10, 0, 0, 0, time.UTC)
+
+	s := newTestSession(t, db, "42", "hash-1", createdAt)
+	require.NoError(t, db.AddSessionAccessToken(ctx, "42", s.ID, "jti-1", time.Minute))
+
+	ok, err := db.RevokeSession(ctx, "43", s.ID, time.Minute)
+	require.NoError(t, err)
+	assert.False(t, ok, "sessions of other users are not revoked")
+
+	ok, err = db.RevokeSession(ctx, "42", s.ID, time.Minute)
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	revoked, err := db.IsTokenRevoked(ctx, "42", "jti-1")
+	require.NoError(t, err)
+	assert.True(t, revoked)
+	got, err := db.RotateRefreshToken(ctx, "hash-1", "hash-2", createdAt, time.Hour, time.Minute)
+	require.NoError(t, err)
+	assert.Nil(t, got)
+
+	ok, err = db.RevokeSession(ctx, "42", s.ID, time.Minute)
+	require.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestClient_RevokeUserSessions(t *testing.T) {
+	db := NewTestDB(t)
+	defer db.Reset(t)
+	ctx := context.Background()
+	createdAt := time.Date(2022, 7, 1, 10, 0, 0, 0, time.UTC)
+
+	first := newTestSession(t, db, "42", "hash-1", createdAt)
+	second := newTestSession(t, db, "42", "hash-2", createdAt)
+	other := newTestSession(t, db, "43", "hash-3", createdAt)
+	require.NoError(t, db.AddSessionAccessToken(ctx, "42", first.ID, "jti-1", time.Minute))
+	require.NoError(t, db.AddSessionAccessToken(ctx, "42", second.ID, "jti-2", time.Minute))
+	require.NoError(t, db.AddSessionAccessToken(ctx, "43", other.ID, "jti-3", time.Minute))
+
+	require.NoError(t, db.RevokeUserSessions(ctx, "42", time.Minute))
+
+	for _, tt := range []struct {
+		userID, jti string
+		expected    bool
+	}{{"42", "jti-1", true}, {"42", "jti-2", true}, {"43", "jti-3", false}} {
+		revoked, err := db.IsTokenRevoked(ctx, tt.userID, tt.jti)
+		require.NoError(t, err)
+		assert.Equal(t, tt.expected, revoked, tt.jti)
+	}
+	sessions, err := db.ListSessions(ctx, "42")
+	require.NoError(t, err)
+	assert.Empty(t, sessions)
+	sessions, err = db.ListSessions(ctx, "43")
+	require.NoError(t, err)
+	assert.Equal(t, []*Session{other}, sessions)
+}
+
+func TestSessionKeys_HashTag(t *testing.T) {
+	// a Redis Cluster hashes only the part of a key between its first braces, the keys the session scripts touch must
+	// share it to be on the same slot
+	hashTag := func(key string) string {
+		start := strings.Index(key, "{")
+		end := strings.Index(key[start+1:], "}")
+		require.True(t, start >= 0 && end > 0, key)
+
+		return key[start+1 : start+1+end]
+	}
+
+	for _, key := range []string{sessionKey("42", "s1"), sessionAccessKey("42", "s1"), userSessionsKey("42"),
+		revokedTokensKey("42")} {
+		assert.Equal(t, "42", hashTag(key), key)
+	}
+}
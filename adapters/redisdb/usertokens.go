@@ -0,0 +1,86 @@
+package redisdb
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	userTokenKeyPrefix       = "user-token:"
+	userTokenLatestKeyPrefix = "user-token-latest:"
+)
+
+// createUserTokenScript stores a token of a user for a purpose, replacing the previous one:
+// only the last emailed link of a kind works.
+// KEYS[1] token key, KEYS[2] latest token key of the user, ARGV[1] user id, ARGV[2] ttl in milliseconds,
+// ARGV[3] token key prefix
+var createUserTokenScript = redis.NewScript(`
+local previous = redis.call('GET', KEYS[2])
+if previous then
+	redis.call('DEL', ARGV[3] .. previous)
+end
+local ttl = tonumber(ARGV[2])
+redis.call('SET', KEYS[1], ARGV[1], 'PX', ttl)
+redis.call('SET', KEYS[2], string.sub(KEYS[1], string.len(ARGV[3]) + 1), 'PX', ttl)
+return 1
+`)
+
+// consumeUserTokenScript deletes a token and returns its user id, a token is used only once.
+// KEYS[1] token key
+var consumeUserTokenScript = redis.NewScript(`
+local uid = redis.call('GET', KEYS[1])
+if not uid then
+	return false
+end
+redis.call('DEL', KEYS[1])
+return uid
+`)
+
+// restoreUserTokenScript stores back a consumed token for the rest of its ttl, unless the user got a newer token for
+// the same purpose meanwhile.
+// KEYS[1] token key, KEYS[2] latest token key of the user, ARGV[1] user id, ARGV[2] token hash
+var restoreUserTokenScript = redis.NewScript(`
+if redis.call('GET', KEYS[2]) ~= ARGV[2] then
+	return 0
+end
+local ttl = redis.call('PTTL', KEYS[2])
+if ttl <= 0 then
+	return 0
+end
+redis.call('SET', KEYS[1], ARGV[1], 'PX', ttl)
+return 1
+`)
+
+// CreateUserToken stores the hash of a single-use token of the user for purpose, e.g. a password reset,
+// valid for ttl. The previous token of the user for the same purpose stops working.
+func (c *Client) CreateUserToken(ctx context.Context, purpose, userID, tokenHash string, ttl time.Duration) error {
+	prefix := userTokenKeyPrefix + purpose + ":"
+	keys := []string{prefix + tokenHash, userTokenLatestKeyPrefix + purpose + ":" + userID}
+
+	return createUserTokenScript.Run(ctx, c.DB, keys, userID, ttl.Milliseconds(), prefix).Err()
+}
+
+// ConsumeUserToken deletes the token for purpose and returns its user id, empty if the token is unknown,
+// expired or already used
+func (c *Client) ConsumeUserToken(ctx context.Context, purpose, tokenHash string) (string, error) {
+	userID, err := consumeUserTokenScript.Run(ctx, c.DB, []string{userTokenKeyPrefix + purpose + ":" + tokenHash}).Text()
+	if err != nil {
+		if err == redis.Nil {
+			return "", nil
+		}
+
+		return "", err
+	}
+
+	return userID, nil
+}
+
+// RestoreUserToken stores back a token consumed by ConsumeUserToken, e.g. when the action it allows failed, so that
+// it can be used again until it expires. A token replaced by a newer one is not restored.
+func (c *Client) RestoreUserToken(ctx context.Context, purpose, userID, tokenHash string) error {
+	keys := []string{userTokenKeyPrefix + purpose + ":" + tokenHash, userTokenLatestKeyPrefix + purpose + ":" + userID}
+
+	return restoreUserTokenScript.Run(ctx, c.DB, keys, userID, tokenHash).Err()
+}
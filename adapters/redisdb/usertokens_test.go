@@ -0,0 +1,58 @@
+package redisdb
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClient_UserToken(t *testing.T) {
+	db := NewTestDB(t)
+	defer db.Reset(t)
+	ctx := context.Background()
+
+	require.NoError(t, db.CreateUserToken(ctx, "password-reset", "42", "hash-1", time.Hour))
+	require.NoError(t, db.CreateUserToken(ctx, "email-verification", "42", "hash-2", time.Hour))
+
+	// tokens are scoped by purpose
+	userID, err := db.ConsumeUserToken(ctx, "email-verification", "hash-1")
+	require.NoError(t, err)
+	assert.Empty(t, userID)
+
+	userID, err = db.ConsumeUserToken(ctx, "password-reset", "hash-1")
+	require.NoError(t, err)
+	assert.Equal(t, "42", userID)
+
+	// tokens are single-use
+	userID, err = db.ConsumeUserToken(ctx, "password-reset", "hash-1")
+	require.NoError(t, err)
+	assert.Empty(t, userID)
+
+	// a new token replaces the previous one
+	require.NoError(t, db.CreateUserToken(ctx, "email-verification", "42", "hash-3", time.Hour))
+	userID, err = db.ConsumeUserToken(ctx, "email-verification", "hash-2")
+	require.NoError(t, err)
+	assert.Empty(t, userID)
+	userID, err = db.ConsumeUserToken(ctx, "email-verification", "hash-3")
+	require.NoError(t, err)
+	assert.Equal(t, "42", userID)
+
+	// consumed tokens are restored for the rest of their ttl, unless they were replaced
+	require.NoError(t, db.RestoreUserToken(ctx, "email-verification", "42", "hash-3"))
+	userID, err = db.ConsumeUserToken(ctx, "email-verification", "hash-3")
+	require.NoError(t, err)
+	assert.Equal(t, "42", userID)
+	require.NoError(t, db.RestoreUserToken(ctx, "email-verification", "42", "hash-2"))
+	userID, err = db.ConsumeUserToken(ctx, "email-verification", "hash-2")
+	require.NoError(t, err)
+	assert.Empty(t, userID)
+
+	// tokens expire
+	require.NoError(t, db.CreateUserToken(ctx, "password-reset", "42", "hash-4", time.Minute))
+	ttl, err := db.DB.PTTL(ctx, userTokenKeyPrefix+"password-reset:hash-4").Result()
+	require.NoError(t, err)
+	assert.InDelta(t, time.Minute, ttl, float64(time.Second))
+}
@@ -0,0 +1,61 @@
+package redisdb
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const webAuthnChallengeKeyPrefix = "webauthn-challenge:"
+
+// WebAuthnChallenge is a pending WebAuthn ceremony
+type WebAuthnChallenge struct {
+	// Ceremony is the kind of the ceremony, e.g. registration or login
+	Ceremony string
+	// UserID is the user registering a credential, empty for the logins where the user is not known yet
+	UserID string
+}
+
+// consumeWebAuthnChallengeScript deletes a challenge and returns its ceremony and user id.
+// KEYS[1] challenge key
+var consumeWebAuthnChallengeScript = redis.NewScript(`
+local fields = redis.call('HMGET', KEYS[1], 'ceremony', 'user_id')
+if not fields[1] then
+	return false
+end
+redis.call('DEL', KEYS[1])
+return fields
+`)
+
+// CreateWebAuthnChallenge stores the challenge of a ceremony, valid for ttl
+func (c *Client) CreateWebAuthnChallenge(ctx context.Context, challenge string, ch WebAuthnChallenge, ttl time.Duration) error {
+	key := webAuthnChallengeKeyPrefix + challenge
+	_, err := c.DB.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, key, "ceremony", ch.Ceremony, "user_id", ch.UserID)
+		pipe.PExpire(ctx, key, ttl)
+
+		return nil
+	})
+
+	return err
+}
+
+// ConsumeWebAuthnChallenge deletes the challenge and returns its ceremony, nil if the challenge is unknown or
+// expired. A challenge is only returned once, so a response to a ceremony cannot be replayed.
+func (c *Client) ConsumeWebAuthnChallenge(ctx context.Context, challenge string) (*WebAuthnChallenge, error) {
+	fields, err := consumeWebAuthnChallengeScript.Run(ctx, c.DB, []string{webAuthnChallengeKeyPrefix + challenge}).Slice()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	ch := &WebAuthnChallenge{}
+	ch.Ceremony, _ = fields[0].(string)
+	ch.UserID, _ = fields[1].(string)
+
+	return ch, nil
+}
@@ -0,0 +1,39 @@
+package redisdb
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClient_WebAuthnChallenge(t *testing.T) {
+	db := NewTestDB(t)
+	defer db.Reset(t)
+	ctx := context.Background()
+
+	require.NoError(t, db.CreateWebAuthnChallenge(ctx, "challenge-1", WebAuthnChallenge{Ceremony: "registration", UserID: "42"}, 5*time.Minute))
+	ttl, err := db.DB.PTTL(ctx, webAuthnChallengeKeyPrefix+"challenge-1").Result()
+	require.NoError(t, err)
+	assert.InDelta(t, 5*time.Minute, ttl, float64(time.Second))
+
+	ch, err := db.ConsumeWebAuthnChallenge(ctx, "unknown")
+	require.NoError(t, err)
+	assert.Nil(t, ch)
+
+	ch, err = db.ConsumeWebAuthnChallenge(ctx, "challenge-1")
+	require.NoError(t, err)
+	assert.Equal(t, &WebAuthnChallenge{Ceremony: "registration", UserID: "42"}, ch)
+
+	// a challenge is only used once
+	ch, err = db.ConsumeWebAuthnChallenge(ctx, "challenge-1")
+	require.NoError(t, err)
+	assert.Nil(t, ch)
+
+	require.NoError(t, db.CreateWebAuthnChallenge(ctx, "challenge-2", WebAuthnChallenge{Ceremony: "login"}, 5*time.Minute))
+	ch, err = db.ConsumeWebAuthnChallenge(ctx, "challenge-2")
+	require.NoError(t, err)
+	assert.Equal(t, &WebAuthnChallenge{Ceremony: "login"}, ch)
+}
@@ -4,6 +4,8 @@ import (
 	// to embed default config
 	"context"
 	_ "embed"
+	"encoding/json"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/sethvargo/go-envconfig"
@@ -21,6 +23,8 @@ type Config struct {
 
 	Auth Auth `env:",prefix=AUTH_"`
 
+	Mailer Mailer `env:",prefix=MAILER_"`
+
 	Swagger Swagger `env:",prefix=SWAGGER_"`
 }
 
@@ -28,6 +32,8 @@ type Config struct {
 type Swagger struct {
 	Enable bool   `env:"ENABLE,default=true"`
 	Port   string `env:"PORT,default=8085"`
+
+	TLS TLS `env:",prefix=TLS_"`
 }
 
 // Logger represents the logger configuration
@@ -40,11 +46,237 @@ type Logger struct {
 type REST struct {
 	Port   string `env:"PORT,default=8080"`
 	Pretty bool   `env:"PRETTY,default=false"`
+
+	TLS TLS `env:",prefix=TLS_"`
+
+	Server      Server      `env:",prefix=SERVER_"`
+	Compression Compression `env:",prefix=COMPRESSION_"`
+	Security    Security    `env:",prefix=SECURITY_"`
+	CORS        CORS        `env:",prefix=CORS_"`
+
+	RateLimit      RateLimit `env:",prefix=RATELIMIT_"`
+	UsersRateLimit RateLimit `env:",prefix=RATELIMIT_USERS_"`
+	AuthRateLimit  RateLimit `env:",prefix=RATELIMIT_AUTH_"`
+
+	Accounts  Accounts  `env:",prefix=ACCOUNTS_"`
+	MagicLink MagicLink `env:",prefix=MAGIC_LINK_"`
+	Lockout   Lockout   `env:",prefix=LOCKOUT_"`
+	MFA       MFA       `env:",prefix=MFA_"`
+	WebAuthn  WebAuthn  `env:",prefix=WEBAUTHN_"`
+	RBAC      RBAC      `env:",prefix=RBAC_"`
+
+	Idempotency Idempotency `env:",prefix=IDEMPOTENCY_"`
+
+	Cache Cache `env:",prefix=CACHE_"`
+
+	Versioning Versioning `env:",prefix=VERSION_"`
+}
+
+// Accounts represents the password reset and email verification configuration
+type Accounts struct {
+	// RequireVerifiedEmail rejects the logins of users who did not verify their email
+	RequireVerifiedEmail bool `env:"REQUIRE_VERIFIED_EMAIL,default=true"`
+	// PasswordResetURL is the page of the emailed password reset links, the token is added to its query
+	PasswordResetURL string        `env:"PASSWORD_RESET_URL,default=http://localhost:3000/reset-password"`
+	PasswordResetTTL time.Duration `env:"PASSWORD_RESET_TTL,default=1h"`
+	// EmailVerificationURL is the page of the emailed verification links, the token is added to its query
+	EmailVerificationURL string        `env:"EMAIL_VERIFICATION_URL,default=http://localhost:3000/verify-email"`
+	EmailVerificationTTL time.Duration `env:"EMAIL_VERIFICATION_TTL,default=48h"`
+}
+
+// MagicLink represents the email-only login, it needs redis for the emailed tokens
+type MagicLink struct {
+	Enable bool `env:"ENABLE,default=true"`
+	// URL is the page of the emailed login links, the token is added to its query
+	URL string        `env:"URL,default=http://localhost:3000/magic-link"`
+	TTL time.Duration `env:"TTL,default=15m"`
+	// CookieName is the cookie binding a link to the browser which asked for it
+	CookieName string `env:"COOKIE_NAME,default=magic_link_nonce"`
+	// CookieSecure only sends the cookie over HTTPS
+	CookieSecure bool `env:"COOKIE_SECURE,default=true"`
+}
+
+// Lockout represents the brute-force protection of the password login, failures are counted per account and per IP
+type Lockout struct {
+	Enable bool `env:"ENABLE,default=true"`
+	// AccountThreshold is the number of failures locking an account out, wherever they come from
+	AccountThreshold int `env:"ACCOUNT_THRESHOLD,default=5"`
+	// IPThreshold is the number of failures locking an IP out, whatever the accounts, high enough for shared IPs
+	IPThreshold int `env:"IP_THRESHOLD,default=50"`
+	// Window is how long failures are remembered after the last one
+	Window   time.Duration `env:"WINDOW,default=15m"`
+	Duration time.Duration `env:"DURATION,default=15m"`
+	// DelayAfter is the number of failures of an account after which its attempts are delayed, from BaseDelay
+	// doubling up to MaxDelay
+	DelayAfter int           `env:"DELAY_AFTER,default=3"`
+	BaseDelay  time.Duration `env:"BASE_DELAY,default=1s"`
+	MaxDelay   time.Duration `env:"MAX_DELAY,default=30s"`
+	// FailOpen lets logins through when redis is unavailable instead of rejecting them
+	FailOpen bool `env:"FAIL_OPEN,default=false"`
+}
+
+// MFA represents the TOTP second factor of the local accounts, it needs redis for the login challenges
+type MFA struct {
+	Enable bool `env:"ENABLE,default=true"`
+	// Issuer names the service in authenticator apps
+	Issuer string `env:"ISSUER,default=Replaceme"`
+	// EncryptionKey is the base64 encoded 32 bytes key encrypting the TOTP secrets in the database, it is required
+	// when MFA is enabled
+	EncryptionKey string `env:"ENCRYPTION_KEY"`
+	// ChallengeTTL is how long a login waits for its second factor
+	ChallengeTTL time.Duration `env:"CHALLENGE_TTL,default=5m"`
+	// ChallengeAttempts is how many codes can be tried for a login
+	ChallengeAttempts int `env:"CHALLENGE_ATTEMPTS,default=5"`
+	// StepUpMaxAge is how long after the second factor the routes requiring it are allowed
+	StepUpMaxAge time.Duration `env:"STEP_UP_MAX_AGE,default=15m"`
+	// RequireForAdmin requires a recent second factor on the admin routes
+	RequireForAdmin bool `env:"REQUIRE_FOR_ADMIN,default=true"`
+	RecoveryCodes   int  `env:"RECOVERY_CODES,default=10"`
+}
+
+// WebAuthn represents the passkey login, it needs redis for the challenges of the ceremonies
+type WebAuthn struct {
+	Enable bool `env:"ENABLE,default=true"`
+	// RPID is the domain the passkeys are registered for, it must be the domain of the origins or a parent of it
+	RPID   string `env:"RP_ID,default=localhost"`
+	RPName string `env:"RP_NAME,default=Replaceme"`
+	// Origins are the origins of the pages running the ceremonies, e.g. https://app.replaceme.com
+	Origins []string `env:"ORIGINS,default=http://localhost:8080"`
+	// ChallengeTTL is how long a ceremony waits for the authenticator
+	ChallengeTTL time.Duration `env:"CHALLENGE_TTL,default=5m"`
+	// UserVerification is required, preferred or discouraged
+	UserVerification string `env:"USER_VERIFICATION,default=preferred"`
+}
+
+// Server represents the HTTP server limits
+type Server struct {
+	ReadHeaderTimeout time.Duration `env:"READ_HEADER_TIMEOUT,default=5s"`
+	ReadTimeout       time.Duration `env:"READ_TIMEOUT,default=30s"`
+	WriteTimeout      time.Duration `env:"WRITE_TIMEOUT,default=30s"`
+	IdleTimeout       time.Duration `env:"IDLE_TIMEOUT,default=2m"`
+	// MaxHeaderBytes bounds the size of the request line and headers
+	MaxHeaderBytes int `env:"MAX_HEADER_BYTES,default=1048576"`
+	// MaxBodySize bounds the size of request bodies, e.g. 512K or 4M, larger requests get a 413
+	MaxBodySize string `env:"MAX_BODY_SIZE,default=1M"`
+	// TrustedProxies are the CIDRs of the reverse proxies in front of the service, e.g. 10.0.0.0/8. The client IP of
+	// their requests is read from X-Forwarded-For, the client IP of the other requests is the peer address.
+	TrustedProxies []string `env:"TRUSTED_PROXIES"`
+}
+
+// Compression represents the response compression configuration, brotli is preferred over gzip
+type Compression struct {
+	Enable bool `env:"ENABLE,default=true"`
+	// MinLength is the size in bytes under which responses are not worth compressing
+	MinLength int `env:"MIN_LENGTH,default=1024"`
+	// GzipLevel is 1 (best speed) to 9 (best compression), -1 is the gzip default
+	GzipLevel int `env:"GZIP_LEVEL,default=-1"`
+	// BrotliLevel is 0 (best speed) to 11 (best compression)
+	BrotliLevel int `env:"BROTLI_LEVEL,default=4"`
+}
+
+// Security represents the security headers of the REST responses
+type Security struct {
+	// HSTSMaxAge is the Strict-Transport-Security max-age in seconds, sent over TLS only, 0 disables HSTS
+	HSTSMaxAge            int  `env:"HSTS_MAX_AGE,default=31536000"`
+	HSTSIncludeSubdomains bool `env:"HSTS_INCLUDE_SUBDOMAINS,default=true"`
+	HSTSPreload           bool `env:"HSTS_PRELOAD,default=false"`
+	// ContentSecurityPolicy defaults to a policy fit for a JSON API, nothing is allowed to load
+	ContentSecurityPolicy string `env:"CONTENT_SECURITY_POLICY,default=default-src 'none'; frame-ancestors 'none'"`
+	// FrameOptions is the X-Frame-Options header, DENY or SAMEORIGIN
+	FrameOptions   string `env:"FRAME_OPTIONS,default=DENY"`
+	ReferrerPolicy string `env:"REFERRER_POLICY,default=no-referrer"`
+}
+
+// CORS represents the cross-origin resource sharing configuration
+type CORS struct {
+	// AllowOrigins lists the allowed origins, e.g. https://app.replaceme.com or https://*.replaceme.com,
+	// cross-origin requests are refused when empty
+	AllowOrigins []string `env:"ALLOW_ORIGINS"`
+	AllowMethods []string `env:"ALLOW_METHODS,default=GET,HEAD,PUT,PATCH,POST,DELETE"`
+	AllowHeaders []string `env:"ALLOW_HEADERS,default=Accept,Authorization,Content-Type,API-Version,Idempotency-Key,If-None-Match,X-Request-ID"`
+	// ExposeHeaders lists the response headers readable by the browser
+	ExposeHeaders []string `env:"EXPOSE_HEADERS,default=API-Version,Deprecation,Sunset,Link,ETag,Idempotent-Replayed,RateLimit-Limit,RateLimit-Remaining,RateLimit-Reset,Retry-After,X-Request-ID"`
+	// AllowCredentials lets browsers send cookies and authorization headers, it cannot be used with the * origin
+	AllowCredentials bool          `env:"ALLOW_CREDENTIALS,default=false"`
+	MaxAge           time.Duration `env:"MAX_AGE,default=10m"`
+}
+
+// Versioning represents the REST API versions configuration
+type Versioning struct {
+	// Default is the version of requests to unversioned paths without an API-Version header
+	Default string `env:"DEFAULT,default=v1"`
+
+	V1 APIVersion `env:",prefix=V1_"`
+	V2 APIVersion `env:",prefix=V2_"`
+}
+
+// APIVersion represents the lifecycle of a REST API version, dates are RFC 3339
+type APIVersion struct {
+	// DeprecatedAt is announced in the Deprecation header, it can be in the future
+	DeprecatedAt time.Time `env:"DEPRECATED_AT"`
+	// SunsetAt is announced in the Sunset header, the version answers 410 Gone after it
+	SunsetAt time.Time `env:"SUNSET_AT"`
+	// Link documents the deprecation and the migration to the next version
+	Link string `env:"LINK"`
+}
+
+// Cache represents the shared response cache configuration
+type Cache struct {
+	Enable bool `env:"ENABLE,default=true"`
+	// TTL bounds how long a response is served after it was cached, mutations invalidate it earlier
+	TTL time.Duration `env:"TTL,default=5m"`
+}
+
+// RBAC represents the role-based access control configuration
+type RBAC struct {
+	// CacheTTL bounds how long the effective permissions of a user are cached, role changes invalidate them earlier
+	CacheTTL time.Duration `env:"CACHE_TTL,default=5m"`
+}
+
+// Idempotency represents the Idempotency-Key support configuration
+type Idempotency struct {
+	Enable bool `env:"ENABLE,default=true"`
+	// TTL is how long responses are replayed for retries
+	TTL time.Duration `env:"TTL,default=24h"`
+	// LockTTL bounds how long a crashed request can block its retries
+	LockTTL time.Duration `env:"LOCK_TTL,default=1m"`
+	// LockWait is how long concurrent retries wait for the in-flight request
+	LockWait time.Duration `env:"LOCK_WAIT,default=10s"`
+}
+
+// RateLimit represents the rate limit policy of a REST route group
+type RateLimit struct {
+	Enable bool `env:"ENABLE,default=true"`
+	// Algorithm is sliding_window or token_bucket
+	Algorithm string        `env:"ALGORITHM,default=sliding_window"`
+	Limit     int           `env:"LIMIT,default=100"`
+	Period    time.Duration `env:"PERIOD,default=1m"`
+	// Burst is the token bucket capacity, defaults to LIMIT
+	Burst int `env:"BURST,default=0"`
+	// FailOpen lets requests through when redis is unavailable instead of rejecting them
+	FailOpen bool `env:"FAIL_OPEN,default=true"`
 }
 
 // HealthCheck represents the healthcheck service configuration
 type HealthCheck struct {
 	Port string `env:"PORT,default=8081"`
+
+	TLS TLS `env:",prefix=TLS_"`
+}
+
+// TLS represents the TLS configuration of a listener, TLS is enabled when the certificate and key files are set.
+// The files are reloaded when they change on disk, so certificates can be rotated without a restart.
+type TLS struct {
+	CertFile string `env:"CERT_FILE"`
+	KeyFile  string `env:"KEY_FILE"`
+	// ClientCAFile is the PEM bundle of the CAs client certificates are verified against, it enables mutual TLS
+	ClientCAFile string `env:"CLIENT_CA_FILE"`
+	// ClientCertOptional lets clients connect without a certificate, the certificates sent are still verified
+	ClientCertOptional bool `env:"CLIENT_CERT_OPTIONAL,default=false"`
+	// MinVersion is the minimum TLS version, 1.2 or 1.3
+	MinVersion string `env:"MIN_VERSION,default=1.2"`
+	// ReloadInterval is how often the files are checked for changes
+	ReloadInterval time.Duration `env:"RELOAD_INTERVAL,default=10s"`
 }
 
 // Postgres represents the postgres service configuration
@@ -80,6 +312,149 @@ type Redis struct {
 type Auth struct {
 	Domain   string `env:"DOMAIN,default=replaceme.eu.auth0.com"`
 	Audience string `env:"AUDIENCE,default=https://replaceme.com"`
+	// Issuer is the URL of an OpenID Connect issuer, e.g. Keycloak, Dex or Okta, https://<Domain>/ when empty
+	Issuer string `env:"ISSUER"`
+	// JWKSURL overrides the jwks_uri of the discovery document of the issuer
+	JWKSURL string `env:"JWKS_URL"`
+	// Algorithms the tokens of the issuer can be signed with, the ones of the discovery document when empty
+	Algorithms []string      `env:"ALGORITHMS"`
+	KeysTTL    time.Duration `env:"KEYS_TTL,default=5m"`
+	// Introspection validates the tokens of the issuer at its introspection endpoint instead of with its keys
+	Introspection Introspection `env:",prefix=INTROSPECTION_"`
+
+	Claims ClaimMapping `env:",prefix=CLAIM_"`
+
+	// Issuers lists the trusted issuers as a JSON array, e.g. two Auth0 tenants during a migration. When set,
+	// it replaces the issuer of Domain or Issuer. Algorithms and Claims are the defaults of the listed issuers.
+	Issuers Issuers `env:"ISSUERS"`
+
+	Local LocalAuth `env:",prefix=LOCAL_"`
+}
+
+// ClaimMapping names the claims of the user attributes in the tokens of the issuer, see auth.ClaimMapping
+type ClaimMapping struct {
+	Subject string `env:"SUBJECT,default=sub" json:"subject"`
+	Email   string `env:"EMAIL,default=email" json:"email"`
+	Name    string `env:"NAME,default=name" json:"name"`
+	Roles   string `env:"ROLES" json:"roles"`
+	Tenant  string `env:"TENANT" json:"tenant"`
+}
+
+// Issuer is a trusted OpenID Connect issuer, with its own audiences and keys
+type Issuer struct {
+	Issuer     string        `json:"issuer"`
+	Audiences  []string      `json:"audiences"`
+	JWKSURL    string        `json:"jwks_url"`
+	Algorithms []string      `json:"algorithms"`
+	Claims     *ClaimMapping `json:"claims"`
+	// Introspection validates the tokens of the issuer at its introspection endpoint, e.g. its opaque tokens
+	Introspection *Introspection `json:"introspection"`
+}
+
+// Introspection configures the RFC 7662 introspection of the tokens of an issuer, see auth.Introspection
+type Introspection struct {
+	URL          string `env:"URL" json:"url"`
+	ClientID     string `env:"CLIENT_ID" json:"client_id"`
+	ClientSecret string `env:"CLIENT_SECRET" json:"client_secret"`
+	// Opaque marks the issuer of the opaque tokens, which are sent to its endpoint only. It is implied for the only
+	// issuer with an introspection endpoint, and only one issuer can set it.
+	Opaque bool `json:"opaque"`
+	// the cache and the circuit breaker settings apply to every issuer
+	CacheTTL         time.Duration `env:"CACHE_TTL,default=1m" json:"-"`
+	NegativeCacheTTL time.Duration `env:"NEGATIVE_CACHE_TTL,default=30s" json:"-"`
+	BreakerThreshold int           `env:"BREAKER_THRESHOLD,default=5" json:"-"`
+	BreakerCooldown  time.Duration `env:"BREAKER_COOLDOWN,default=30s" json:"-"`
+}
+
+// Issuers is a JSON array of issuers, e.g.
+// [{"issuer":"https://old.eu.auth0.com/","audiences":["https://replaceme.com"]},{"issuer":"https://new.eu.auth0.com/","audiences":["https://replaceme.com"]}]
+type Issuers []Issuer
+
+// EnvDecode implements envconfig.Decoder
+func (is *Issuers) EnvDecode(val string) error {
+	if val == "" {
+		return nil
+	}
+
+	var issuers []Issuer
+	if err := json.Unmarshal([]byte(val), &issuers); err != nil {
+		return errors.Wrap(err, "invalid issuers")
+	}
+	opaque := 0
+	for i, iss := range issuers {
+		if iss.Issuer == "" {
+			return errors.Errorf("issuer %d has no issuer URL", i)
+		}
+		if len(iss.Audiences) == 0 {
+			return errors.Errorf("issuer %q has no audiences", iss.Issuer)
+		}
+		if iss.Introspection != nil && iss.Introspection.Opaque {
+			opaque++
+		}
+	}
+	if opaque > 1 {
+		return errors.New("only one issuer can introspect the opaque tokens")
+	}
+	*is = issuers
+
+	return nil
+}
+
+// LocalAuth represents the configuration of the tokens issued by the login endpoint
+type LocalAuth struct {
+	// Issuer is the iss claim of the tokens, the public URL of the service
+	Issuer   string `env:"ISSUER,default=http://localhost:8080/"`
+	Audience string `env:"AUDIENCE,default=https://replaceme.com"`
+	// Algorithm signs the tokens, RS256 or EdDSA
+	Algorithm string `env:"ALGORITHM,default=EdDSA"`
+	// KeyFiles are PEM encoded private keys, the first one signs the tokens and the others are only published
+	// in the JWKS, e.g. a key being rotated out. They are required unless EphemeralKey is set.
+	KeyFiles []string `env:"KEY_FILES"`
+	// EphemeralKey generates a key at startup when KeyFiles is empty, for development only: the tokens do not
+	// survive restarts and are not accepted by the other instances
+	EphemeralKey   bool          `env:"EPHEMERAL_KEY,default=false"`
+	AccessTokenTTL time.Duration `env:"ACCESS_TOKEN_TTL,default=15m"`
+	// RefreshTokenTTL is the idle lifetime of a session, every refresh extends it
+	RefreshTokenTTL time.Duration `env:"REFRESH_TOKEN_TTL,default=720h"`
+}
+
+// Mailer represents the outbound email configuration
+type Mailer struct {
+	// Driver sends the emails: smtp, dir writing .eml files for development, or log
+	Driver string `env:"DRIVER,default=dir"`
+	// From is the sender address, e.g. "Replaceme <no-reply@replaceme.com>"
+	From string `env:"FROM,default=Replaceme <no-reply@replaceme.com>"`
+	// Dir is where the dir driver writes the emails
+	Dir string `env:"DIR,default=./tmp/mail"`
+
+	SMTP  SMTP      `env:",prefix=SMTP_"`
+	Queue MailQueue `env:",prefix=QUEUE_"`
+}
+
+// SMTP represents the SMTP server the emails are sent through
+type SMTP struct {
+	Host     string `env:"HOST,default=localhost"`
+	Port     string `env:"PORT,default=587"`
+	Username string `env:"USERNAME"`
+	Password string `env:"PASSWORD"`
+	// TLS is starttls, tls for implicit TLS (usually port 465) or none for local relays
+	TLS     string        `env:"TLS,default=starttls"`
+	Timeout time.Duration `env:"TIMEOUT,default=30s"`
+}
+
+// MailQueue represents the background sending of the emails, it needs redis
+type MailQueue struct {
+	Enable  bool `env:"ENABLE,default=true"`
+	Workers int  `env:"WORKERS,default=2"`
+	// MaxAttempts is how many times an email is tried before it is moved to the dead emails
+	MaxAttempts int `env:"MAX_ATTEMPTS,default=5"`
+	// Backoff is the delay before the first retry, it doubles on every retry
+	Backoff time.Duration `env:"BACKOFF,default=30s"`
+	// DeadTTL is how long the dead emails are kept for inspection, they hold links with tokens
+	DeadTTL time.Duration `env:"DEAD_TTL,default=72h"`
+	// Consumer names the processing lists of the instance, defaults to the hostname. It should be stable across
+	// restarts, e.g. the name of a stateful pod, the emails of an instance gone for good are reclaimed by the others.
+	Consumer string `env:"CONSUMER"`
 }
 
 // Load reads info from ENV and returns a Config struct
@@ -0,0 +1,237 @@
+// Package apperr provides typed application errors that carry a kind and a stable machine readable code.
+package apperr
+
+import (
+	"errors"
+	"net/http"
+)
+
+// Kind classifies an application error and drives the HTTP status returned to clients.
+type Kind uint8
+
+// Application error kinds
+const (
+	KindInternal Kind = iota
+	KindNotFound
+	KindConflict
+	KindValidation
+	KindUnauthorized
+	KindForbidden
+	KindRateLimited
+	KindUnavailable
+)
+
+// Stable error codes that clients can branch on.
+const (
+	CodeInternal     = "internal_error"
+	CodeNotFound     = "not_found"
+	CodeConflict     = "conflict"
+	CodeValidation   = "validation_failed"
+	CodeUnauthorized = "unauthorized"
+	CodeForbidden    = "forbidden"
+	CodeRateLimited  = "rate_limited"
+	CodeUnavailable  = "service_unavailable"
+
+	CodeIdempotencyKeyReused  = "idempotency_key_reused"
+	CodeIdempotencyInProgress = "idempotency_request_in_progress"
+	CodeUserEmailTaken        = "user_email_taken"
+	CodeUserNotFound          = "user_not_found"
+	CodeUserRequired          = "user_required"
+	CodePasswordRequired      = "password_required"
+	CodeInvalidCredentials    = "invalid_credentials"
+	CodeInvalidRefreshToken   = "invalid_refresh_token"
+	CodeRefreshTokenReused    = "refresh_token_reused"
+	CodeTokenRevoked          = "token_revoked"
+	CodeSessionNotFound       = "session_not_found"
+	CodeInvalidToken          = "invalid_token"
+	CodeEmailNotVerified      = "email_not_verified"
+	CodeLoginLocked           = "login_locked"
+	CodeLoginThrottled        = "login_throttled"
+	CodeLockoutNotFound       = "lockout_not_found"
+	CodeInsufficientScope     = "insufficient_scope"
+	CodeMFARequired           = "mfa_required"
+	CodeInvalidMFAToken       = "invalid_mfa_token"
+	CodeInvalidMFACode        = "invalid_mfa_code"
+	CodeTOTPAlreadyEnabled    = "totp_already_enabled"
+	CodeTOTPNotEnrolled       = "totp_not_enrolled"
+	CodeInvalidWebAuthn       = "invalid_webauthn_response"
+	CodeInvalidChallenge      = "invalid_webauthn_challenge"
+	CodeCredentialNotFound    = "credential_not_found"
+	CodeCredentialCloned      = "credential_cloned"
+	CodeAPIKeyNotFound        = "api_key_not_found"
+	CodeRoleNotFound          = "role_not_found"
+	CodeRoleExists            = "role_exists"
+	CodeMissingPermission     = "missing_permission"
+)
+
+// String returns the human readable name of the kind.
+func (k Kind) String() string {
+	switch k {
+	case KindNotFound:
+		return "not found"
+	case KindConflict:
+		return "conflict"
+	case KindValidation:
+		return "validation"
+	case KindUnauthorized:
+		return "unauthorized"
+	case KindForbidden:
+		return "forbidden"
+	case KindRateLimited:
+		return "rate limited"
+	case KindUnavailable:
+		return "unavailable"
+	default:
+		return "internal"
+	}
+}
+
+// HTTPStatus returns the HTTP status code matching the kind.
+func (k Kind) HTTPStatus() int {
+	switch k {
+	case KindNotFound:
+		return http.StatusNotFound
+	case KindConflict:
+		return http.StatusConflict
+	case KindValidation:
+		return http.StatusUnprocessableEntity
+	case KindUnauthorized:
+		return http.StatusUnauthorized
+	case KindForbidden:
+		return http.StatusForbidden
+	case KindRateLimited:
+		return http.StatusTooManyRequests
+	case KindUnavailable:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// FieldError describes a single invalid field of a request.
+type FieldError struct {
+	// Pointer is the JSON pointer (RFC 6901) of the invalid field, e.g. /address/street
+	Pointer string `json:"pointer"`
+	// Rule is the validation rule that failed, e.g. required
+	Rule   string `json:"rule"`
+	Detail string `json:"detail"`
+}
+
+// Error is an application error.
+// Message and Fields are safe to be shown to clients, Err is the underlying cause and is never exposed.
+type Error struct {
+	Kind    Kind
+	Code    string
+	Message string
+	Fields  []FieldError
+	Err     error
+}
+
+// Error returns the message, followed by the cause when present.
+func (e *Error) Error() string {
+	if e.Err != nil {
+		if e.Message == "" {
+			return e.Err.Error()
+		}
+
+		return e.Message + ": " + e.Err.Error()
+	}
+
+	return e.Message
+}
+
+// Unwrap returns the underlying cause.
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// New creates a new application error.
+func New(kind Kind, code, message string) *Error {
+	return &Error{Kind: kind, Code: code, Message: message}
+}
+
+// NotFound creates a new KindNotFound error.
+func NotFound(code, message string) *Error {
+	return New(KindNotFound, code, message)
+}
+
+// Conflict creates a new KindConflict error.
+func Conflict(code, message string) *Error {
+	return New(KindConflict, code, message)
+}
+
+// Validation creates a new KindValidation error.
+func Validation(code, message string) *Error {
+	return New(KindValidation, code, message)
+}
+
+// Unauthorized creates a new KindUnauthorized error.
+func Unauthorized(code, message string) *Error {
+	return New(KindUnauthorized, code, message)
+}
+
+// Forbidden creates a new KindForbidden error.
+func Forbidden(code, message string) *Error {
+	return New(KindForbidden, code, message)
+}
+
+// RateLimited creates a new KindRateLimited error.
+func RateLimited(code, message string) *Error {
+	return New(KindRateLimited, code, message)
+}
+
+// Unavailable creates a new KindUnavailable error.
+func Unavailable(code, message string) *Error {
+	return New(KindUnavailable, code, message)
+}
+
+// Internal wraps err into a KindInternal error.
+func Internal(err error) *Error {
+	return &Error{Kind: KindInternal, Code: CodeInternal, Err: err}
+}
+
+// Wrap attaches err as the cause of the given application error and returns it.
+func (e *Error) Wrap(err error) *Error {
+	e.Err = err
+
+	return e
+}
+
+// WithFields attaches the invalid fields to the given application error and returns it.
+func (e *Error) WithFields(fields ...FieldError) *Error {
+	e.Fields = append(e.Fields, fields...)
+
+	return e
+}
+
+// As returns the first *Error found in the err chain.
+// Errors that are not application errors are wrapped as KindInternal.
+func As(err error) *Error {
+	if err == nil {
+		return nil
+	}
+
+	var e *Error
+	if errors.As(err, &e) {
+		return e
+	}
+
+	return Internal(err)
+}
+
+// KindOf returns the kind of err, KindInternal for errors that are not application errors.
+func KindOf(err error) Kind {
+	return As(err).Kind
+}
+
+// CodeOf returns the code of err, CodeInternal for errors that are not application errors.
+func CodeOf(err error) string {
+	return As(err).Code
+}
+
+// Is reports whether err is an application error of the given kind.
+func Is(err error, kind Kind) bool {
+	var e *Error
+
+	return errors.As(err, &e) && e.Kind == kind
+}
@@ -0,0 +1,97 @@
+package apperr
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestError(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		wantMsg    string
+		wantKind   Kind
+		wantCode   string
+		wantStatus int
+	}{
+		{
+			name:       "not found",
+			err:        NotFound(CodeUserNotFound, "user not found"),
+			wantMsg:    "user not found",
+			wantKind:   KindNotFound,
+			wantCode:   CodeUserNotFound,
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "conflict wrapped with cause",
+			err:        Conflict(CodeUserEmailTaken, "email taken").Wrap(errors.New("pq: duplicate key")),
+			wantMsg:    "email taken: pq: duplicate key",
+			wantKind:   KindConflict,
+			wantCode:   CodeUserEmailTaken,
+			wantStatus: http.StatusConflict,
+		},
+		{
+			name:       "validation",
+			err:        Validation(CodePasswordRequired, "password is required"),
+			wantMsg:    "password is required",
+			wantKind:   KindValidation,
+			wantCode:   CodePasswordRequired,
+			wantStatus: http.StatusUnprocessableEntity,
+		},
+		{
+			name:       "unauthorized",
+			err:        Unauthorized(CodeUnauthorized, "jwt missing"),
+			wantMsg:    "jwt missing",
+			wantKind:   KindUnauthorized,
+			wantCode:   CodeUnauthorized,
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "forbidden",
+			err:        Forbidden(CodeForbidden, "not allowed"),
+			wantMsg:    "not allowed",
+			wantKind:   KindForbidden,
+			wantCode:   CodeForbidden,
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "wrapped app error",
+			err:        fmt.Errorf("insert: %w", Conflict(CodeUserEmailTaken, "email taken")),
+			wantMsg:    "insert: email taken",
+			wantKind:   KindConflict,
+			wantCode:   CodeUserEmailTaken,
+			wantStatus: http.StatusConflict,
+		},
+		{
+			name:       "plain error is internal",
+			err:        errors.New("pq: connection refused"),
+			wantMsg:    "pq: connection refused",
+			wantKind:   KindInternal,
+			wantCode:   CodeInternal,
+			wantStatus: http.StatusInternalServerError,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.EqualError(t, tt.err, tt.wantMsg)
+			assert.Equal(t, tt.wantKind, KindOf(tt.err))
+			assert.Equal(t, tt.wantCode, CodeOf(tt.err))
+			assert.Equal(t, tt.wantStatus, KindOf(tt.err).HTTPStatus())
+		})
+	}
+}
+
+func TestIs(t *testing.T) {
+	cause := errors.New("cause")
+	err := fmt.Errorf("wrapped: %w", Internal(cause))
+
+	assert.True(t, Is(err, KindInternal))
+	assert.False(t, Is(err, KindNotFound))
+	assert.False(t, Is(cause, KindInternal))
+	assert.True(t, errors.Is(err, cause))
+	assert.Nil(t, As(nil))
+}
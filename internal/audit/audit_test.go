@@ -0,0 +1,27 @@
+package audit
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/efimovalex/replaceme/internal/requestid"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLog_Record(t *testing.T) {
+	var buf bytes.Buffer
+	l := &Log{logger: zerolog.New(&buf).With().Bool("audit", true).Logger()}
+	ctx := requestid.WithID(context.Background(), "a1b2c3")
+
+	l.Record(ctx, Event{
+		Type:    EventLoginLocked,
+		Subject: "account:jane.doe@replaceme.com",
+		IP:      "192.0.2.1",
+		Details: map[string]interface{}{"locked_until": "2022-08-01T10:15:00Z"},
+	})
+	assert.JSONEq(t, `{"level":"info","audit":true,"request_id":"a1b2c3","event":"login.locked",
+		"subject":"account:jane.doe@replaceme.com","ip":"192.0.2.1","locked_until":"2022-08-01T10:15:00Z",
+		"message":"audit event"}`, buf.String())
+}
@@ -0,0 +1,222 @@
+// Package authtest provides an OpenID Connect issuer for tests: it generates signing keys, serves the discovery
+// document and the JWKS with httptest, and mints tokens with any claims
+package authtest
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+const (
+	// DiscoveryPath is the path of the discovery document, relative to the issuer
+	DiscoveryPath = "/.well-known/openid-configuration"
+	// JWKSPath is the path of the JWKS of the issuer
+	JWKSPath = "/keys"
+
+	// Audience is the default audience of the tokens
+	Audience = "https://replaceme.com"
+	// Subject is the default subject of the tokens
+	Subject = "user-1"
+)
+
+// Claims are the claims of a minted token, they override the registered claims of the issuer
+type Claims map[string]interface{}
+
+// Key is a signing key of the issuer
+type Key struct {
+	ID        string
+	Algorithm jose.SignatureAlgorithm
+	Signer    crypto.Signer
+}
+
+// NewRSAKey generates an RS256 key
+func NewRSAKey(t testing.TB, id string) Key {
+	t.Helper()
+	k, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate the rsa key: %v", err)
+	}
+
+	return Key{ID: id, Algorithm: jose.RS256, Signer: k}
+}
+
+// NewECKey generates an ES256 key
+func NewECKey(t testing.TB, id string) Key {
+	t.Helper()
+	k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate the ec key: %v", err)
+	}
+
+	return Key{ID: id, Algorithm: jose.ES256, Signer: k}
+}
+
+// Issuer is an OpenID Connect issuer served by httptest. Its URL with a trailing slash is the issuer URL, see Issuer.
+type Issuer struct {
+	*httptest.Server
+
+	// Algorithms are the id_token_signing_alg_values_supported of the discovery document,
+	// the algorithms of the keys by default
+	Algorithms []string
+
+	mu        sync.Mutex
+	keys      map[string]Key
+	published []string
+	fetches   int
+}
+
+// NewIssuer starts an issuer publishing the keys, or a generated RSA key with the id "rsa" when none is given.
+// The first key signs the tokens of Token. The server is closed at the end of the test.
+func NewIssuer(t testing.TB, keys ...Key) *Issuer {
+	t.Helper()
+	if len(keys) == 0 {
+		keys = []Key{NewRSAKey(t, "rsa")}
+	}
+
+	i := &Issuer{keys: map[string]Key{}}
+	for _, k := range keys {
+		i.AddKey(k)
+		i.Algorithms = appendMissing(i.Algorithms, string(k.Algorithm))
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(JWKSPath, i.serveJWKS)
+	// the document is served for any path of the issuer, as a misconfigured proxy would,
+	// so that tests can check the issuer it names
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, DiscoveryPath) {
+			http.NotFound(w, r)
+			return
+		}
+		writeJSON(w, map[string]interface{}{
+			"issuer":                                i.Issuer(),
+			"jwks_uri":                              i.JWKSURL(),
+			"id_token_signing_alg_values_supported": i.Algorithms,
+		})
+	})
+	i.Server = httptest.NewServer(mux)
+	t.Cleanup(i.Close)
+
+	return i
+}
+
+// Issuer returns the issuer URL, the iss claim of the tokens
+func (i *Issuer) Issuer() string {
+	return i.URL + "/"
+}
+
+// JWKSURL returns the URL of the JWKS
+func (i *Issuer) JWKSURL() string {
+	return i.URL + JWKSPath
+}
+
+// AddKey adds a key to the issuer and publishes it in the JWKS, e.g. to rotate the keys
+func (i *Issuer) AddKey(k Key) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.keys[k.ID] = k
+	i.published = appendMissing(i.published, k.ID)
+}
+
+// Publish replaces the keys of the JWKS by the keys with the ids. Unpublished keys can still sign tokens.
+func (i *Issuer) Publish(ids ...string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.published = ids
+}
+
+// JWKSFetches returns how many times the JWKS was fetched
+func (i *Issuer) JWKSFetches() int {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	return i.fetches
+}
+
+// Token mints a token signed by the first published key, see Sign
+func (i *Issuer) Token(t testing.TB, claims Claims) string {
+	t.Helper()
+	i.mu.Lock()
+	id := ""
+	if len(i.published) > 0 {
+		id = i.published[0]
+	}
+	i.mu.Unlock()
+
+	return i.Sign(t, id, claims)
+}
+
+// Sign mints a token signed by the key with the id. The token is valid for an hour and is issued to Subject for
+// Audience, the claims override them, e.g. Claims{"exp": time.Now().Add(-time.Minute).Unix(), "aud": "other"}.
+func (i *Issuer) Sign(t testing.TB, keyID string, claims Claims) string {
+	t.Helper()
+	i.mu.Lock()
+	k, ok := i.keys[keyID]
+	i.mu.Unlock()
+	if !ok {
+		t.Fatalf("unknown key %q", keyID)
+	}
+
+	signer, err := jose.NewSigner(
+		jose.SigningKey{Algorithm: k.Algorithm, Key: jose.JSONWebKey{Key: k.Signer, KeyID: k.ID}},
+		(&jose.SignerOptions{}).WithType("JWT"),
+	)
+	if err != nil {
+		t.Fatalf("failed to create the signer: %v", err)
+	}
+	now := time.Now()
+	registered := jwt.Claims{
+		Issuer:   i.Issuer(),
+		Subject:  Subject,
+		Audience: jwt.Audience{Audience},
+		IssuedAt: jwt.NewNumericDate(now),
+		Expiry:   jwt.NewNumericDate(now.Add(time.Hour)),
+	}
+	raw, err := jwt.Signed(signer).Claims(registered).Claims(map[string]interface{}(claims)).CompactSerialize()
+	if err != nil {
+		t.Fatalf("failed to sign the token: %v", err)
+	}
+
+	return raw
+}
+
+func (i *Issuer) serveJWKS(w http.ResponseWriter, _ *http.Request) {
+	i.mu.Lock()
+	i.fetches++
+	var keys jose.JSONWebKeySet
+	for _, id := range i.published {
+		k := i.keys[id]
+		keys.Keys = append(keys.Keys, jose.JSONWebKey{Key: k.Signer.Public(), KeyID: k.ID, Algorithm: string(k.Algorithm), Use: "sig"})
+	}
+	i.mu.Unlock()
+
+	writeJSON(w, keys)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func appendMissing(list []string, s string) []string {
+	for _, v := range list {
+		if v == s {
+			return list
+		}
+	}
+
+	return append(list, s)
+}
@@ -0,0 +1,67 @@
+package authtest
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+func getJSON(t *testing.T, url string, dst interface{}) {
+	res, err := http.Get(url)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.NoError(t, json.NewDecoder(res.Body).Decode(dst))
+}
+
+func TestIssuer(t *testing.T) {
+	i := NewIssuer(t, NewRSAKey(t, "rsa"), NewECKey(t, "ec"))
+
+	var doc struct {
+		Issuer     string   `json:"issuer"`
+		JWKSURI    string   `json:"jwks_uri"`
+		Algorithms []string `json:"id_token_signing_alg_values_supported"`
+	}
+	getJSON(t, i.URL+DiscoveryPath, &doc)
+	assert.Equal(t, i.Issuer(), doc.Issuer)
+	assert.Equal(t, i.JWKSURL(), doc.JWKSURI)
+	assert.Equal(t, []string{"RS256", "ES256"}, doc.Algorithms)
+
+	var keys jose.JSONWebKeySet
+	getJSON(t, doc.JWKSURI, &keys)
+	require.Len(t, keys.Keys, 2)
+	assert.Equal(t, 1, i.JWKSFetches())
+
+	t.Run("Token", func(t *testing.T) {
+		raw := i.Sign(t, "ec", Claims{"aud": "https://other.com", "email": "jane.doe@replaceme.com"})
+		parsed, err := jwt.ParseSigned(raw)
+		require.NoError(t, err)
+		assert.Equal(t, "ec", parsed.Headers[0].KeyID)
+
+		var registered jwt.Claims
+		claims := map[string]interface{}{}
+		require.NoError(t, parsed.Claims(keys.Key("ec")[0].Key, &registered, &claims))
+		assert.NoError(t, registered.Validate(jwt.Expected{Issuer: i.Issuer(), Subject: Subject, Audience: jwt.Audience{"https://other.com"}, Time: time.Now()}))
+		assert.Equal(t, "jane.doe@replaceme.com", claims["email"])
+	})
+
+	t.Run("Key rotation", func(t *testing.T) {
+		i.AddKey(NewRSAKey(t, "rotated"))
+		i.Publish("rotated")
+
+		var keys jose.JSONWebKeySet
+		getJSON(t, i.JWKSURL(), &keys)
+		require.Len(t, keys.Keys, 1)
+		assert.Equal(t, "rotated", keys.Keys[0].KeyID)
+
+		parsed, err := jwt.ParseSigned(i.Token(t, nil))
+		require.NoError(t, err)
+		assert.Equal(t, "rotated", parsed.Headers[0].KeyID)
+	})
+}
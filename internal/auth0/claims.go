@@ -2,69 +2,306 @@ package auth
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"strings"
+	"time"
 )
 
 const (
-	claimsKeyEmail = "parsed_email"
+	claimsKeyUserID = "parsed_user_id"
+	claimsKeyEmail  = "parsed_email"
+	claimsKeyName   = "parsed_name"
+	claimsKeyRoles  = "parsed_roles"
+	claimsKeyTenant = "parsed_tenant"
+
+	// ClaimTokenID is the jti claim identifying a token, see RFC 7519
+	ClaimTokenID = "jti"
+	// ClaimSessionID is the claim of the session a first-party token was issued for
+	ClaimSessionID = "sid"
+	// ClaimScope is the space separated list of the scopes granted to a token, see RFC 8693
+	ClaimScope = "scope"
+	// ClaimPermissions lists the permissions of a token, as set by Auth0 RBAC
+	ClaimPermissions = "permissions"
+	// ClaimAuthMethods lists the methods the user authenticated with, see RFC 8176
+	ClaimAuthMethods = "amr"
+	// ClaimAuthTime is the unix time the user authenticated at, see OpenID Connect Core section 2
+	ClaimAuthTime = "auth_time"
+)
+
+// Authentication method references of RFC 8176
+const (
+	AuthMethodPassword    = "pwd"
+	AuthMethodOTP         = "otp"
+	AuthMethodMFA         = "mfa"
+	AuthMethodHardwareKey = "hwk"
+	// AuthMethodEmail is a link emailed to the user, it has no RFC 8176 value
+	AuthMethodEmail = "email"
 )
 
 // CustomClaims contains custom data from a JWT token.
 type CustomClaims map[string]interface{}
 
-// Validate is needed to satisfy Auth0 validator.CustomClaims interface.
+// ErrClaimNotFound is returned by the accessors of the user attributes the token does not have
+var ErrClaimNotFound = errors.New("claim not found")
+
+// Validate is needed to satisfy Auth0 validator.CustomClaims interface, it maps the claims with the default
+// ClaimMapping.
 func (cc CustomClaims) Validate(ctx context.Context) error {
-	var errs []string
+	return cc.Map(ClaimMapping{})
+}
+
+// GetUserID returns the user ID mapped from the claims, see ClaimMapping.
+func (cc CustomClaims) GetUserID() (string, error) {
+	return cc.mapped(claimsKeyUserID, "user ID")
+}
+
+// GetUserEmail returns the user email mapped from the claims, ErrClaimNotFound if the token has none.
+func (cc CustomClaims) GetUserEmail() (string, error) {
+	return cc.mapped(claimsKeyEmail, "email")
+}
+
+// GetUserName returns the user name mapped from the claims, ErrClaimNotFound if the token has none.
+func (cc CustomClaims) GetUserName() (string, error) {
+	return cc.mapped(claimsKeyName, "name")
+}
+
+// GetTenant returns the tenant of the user mapped from the claims, ErrClaimNotFound if the token has none.
+func (cc CustomClaims) GetTenant() (string, error) {
+	return cc.mapped(claimsKeyTenant, "tenant")
+}
 
-	userID, ok := cc["sub"]
+// GetRoles returns the roles of the user mapped from the claims, see ClaimMapping, nil if the token has none.
+func (cc CustomClaims) GetRoles() []string {
+	roles, _ := cc[claimsKeyRoles].([]string)
+	return roles
+}
+
+func (cc CustomClaims) mapped(key, name string) (string, error) {
+	v, ok := cc[key]
+	if !ok {
+		return "", fmt.Errorf("%w: %s", ErrClaimNotFound, name)
+	}
+	s, ok := v.(string)
+	if !ok {
+		return "", fmt.Errorf("%s '%v' from claims has unexpected type: expected 'string', got '%T'", name, v, v)
+	}
+
+	return s, nil
+}
+
+// GetTokenID returns the token ID from the claims, empty if the token has none.
+func (cc CustomClaims) GetTokenID() string {
+	id, _ := cc[ClaimTokenID].(string)
+	return id
+}
+
+// GetSessionID returns the session ID from the claims, empty if the token has none.
+func (cc CustomClaims) GetSessionID() string {
+	id, _ := cc[ClaimSessionID].(string)
+	return id
+}
+
+// HasScope reports whether the token grants scope, in its scope or permissions claim.
+func (cc CustomClaims) HasScope(scope string) bool {
+	if s, ok := cc[ClaimScope].(string); ok {
+		for _, granted := range strings.Fields(s) {
+			if granted == scope {
+				return true
+			}
+		}
+	}
+	if permissions, ok := cc[ClaimPermissions].([]interface{}); ok {
+		for _, p := range permissions {
+			if p == scope {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// GetAuthMethods returns the methods the user authenticated with, nil if the token does not tell.
+func (cc CustomClaims) GetAuthMethods() []string {
+	var methods []string
+	switch amr := cc[ClaimAuthMethods].(type) {
+	case []string:
+		methods = amr
+	case []interface{}:
+		for _, m := range amr {
+			if s, ok := m.(string); ok {
+				methods = append(methods, s)
+			}
+		}
+	}
+
+	return methods
+}
+
+// HasAuthMethod reports whether the user authenticated with method.
+func (cc CustomClaims) HasAuthMethod(method string) bool {
+	for _, m := range cc.GetAuthMethods() {
+		if m == method {
+			return true
+		}
+	}
+
+	return false
+}
+
+// GetAuthTime returns the time the user authenticated at, the zero time if the token does not tell.
+func (cc CustomClaims) GetAuthTime() time.Time {
+	var sec int64
+	switch t := cc[ClaimAuthTime].(type) {
+	case float64:
+		sec = int64(t)
+	case int64:
+		sec = t
+	case int:
+		sec = int64(t)
+	case json.Number:
+		sec, _ = t.Int64()
+	}
+	if sec <= 0 {
+		return time.Time{}
+	}
+
+	return time.Unix(sec, 0)
+}
+
+// ClaimMapping names the claims holding the user attributes in the tokens of a provider, e.g. preferred_username,
+// or groups for the roles. A name is looked up as a claim first, so namespaced claims like
+// https://replaceme.com/roles work, then as a dot separated path of nested claims, like realm_access.roles or
+// https://replaceme.com/app_metadata.tenant.
+type ClaimMapping struct {
+	// Subject is the claim of the user ID, sub when empty
+	Subject string
+	// Email is the claim of the email, email when empty
+	Email string
+	// Name is the claim of the user name, name when empty
+	Name string
+	// Roles is the claim of the roles, a list or a space separated string, the token has no roles when empty
+	Roles string
+	// Tenant is the claim of the tenant of the user, the token has no tenant when empty
+	Tenant string
+}
+
+// DefaultClaimMapping is the mapping of the claims registered by OpenID Connect Core, the one of Validate
+var DefaultClaimMapping = ClaimMapping{Subject: "sub", Email: "email", Name: "name"}
+
+// Map sets the user ID, the email, the name, the roles and the tenant from the claims named by the mapping, see
+// the Get accessors. The user ID is required, the other attributes are optional but must have the expected type.
+func (cc CustomClaims) Map(m ClaimMapping) error {
+	if m.Subject == "" {
+		m.Subject = DefaultClaimMapping.Subject
+	}
+	if m.Email == "" {
+		m.Email = DefaultClaimMapping.Email
+	}
+	if m.Name == "" {
+		m.Name = DefaultClaimMapping.Name
+	}
+
+	var errs []string
+	userID, ok := cc.lookup(m.Subject)
 	if !ok {
 		errs = append(errs, "no user ID found in claims")
 	}
-	if ok {
-		_, ok = userID.(string)
+	for _, attr := range []struct {
+		key, name, claim string
+		value            interface{}
+		found            bool
+	}{
+		{key: claimsKeyUserID, name: "user ID", value: userID, found: ok},
+		{key: claimsKeyEmail, name: "email", claim: m.Email},
+		{key: claimsKeyName, name: "name", claim: m.Name},
+		{key: claimsKeyTenant, name: "tenant", claim: m.Tenant},
+	} {
+		delete(cc, attr.key)
+		if attr.claim != "" {
+			attr.value, attr.found = cc.lookup(attr.claim)
+		}
+		if !attr.found {
+			continue
+		}
+		s, ok := attr.value.(string)
 		if !ok {
 			errs = append(errs, fmt.Sprintf(
-				"user ID '%v' from claims has unexpected type: expected 'string', got '%T'",
-				userID, userID))
+				"%s '%v' from claims has unexpected type: expected 'string', got '%T'",
+				attr.name, attr.value, attr.value))
+			continue
 		}
+		cc[attr.key] = s
 	}
 
-	email, err := cc.parseEmail()
-	if err != nil {
-		errs = append(errs, err.Error())
+	delete(cc, claimsKeyRoles)
+	if m.Roles != "" {
+		roles, err := cc.roles(m.Roles)
+		if err != nil {
+			errs = append(errs, err.Error())
+		} else if roles != nil {
+			cc[claimsKeyRoles] = roles
+		}
 	}
 
 	if len(errs) > 0 {
 		return fmt.Errorf("failed to validate token claims: %s", strings.Join(errs, ", "))
 	}
 
-	cc[claimsKeyEmail] = email
-
 	return nil
 }
 
-// GetUserID returns the user ID from the claims.
-func (cc CustomClaims) GetUserID() string {
-	return cc["sub"].(string)
+func (cc CustomClaims) roles(claim string) ([]string, error) {
+	value, ok := cc.lookup(claim)
+	if !ok {
+		return nil, nil
+	}
+
+	switch r := value.(type) {
+	case string:
+		return strings.Fields(r), nil
+	case []string:
+		return r, nil
+	case []interface{}:
+		roles := make([]string, 0, len(r))
+		for _, role := range r {
+			s, ok := role.(string)
+			if !ok {
+				return nil, fmt.Errorf("role '%v' from claims has unexpected type: expected 'string', got '%T'", role, role)
+			}
+			roles = append(roles, s)
+		}
+		return roles, nil
+	}
+
+	return nil, fmt.Errorf("roles '%v' from claims have unexpected type: expected a list or a 'string', got '%T'", value, value)
 }
 
-// GetUserEmail returns the user email from the claims.
-func (cc CustomClaims) GetUserEmail() string {
-	return cc[claimsKeyEmail].(string)
+// lookup returns the claim with the name, or the nested claim at the dot separated path
+func (cc CustomClaims) lookup(name string) (interface{}, bool) {
+	return lookupPath(map[string]interface{}(cc), name)
 }
 
-func (cc CustomClaims) parseEmail() (string, error) {
-	for k, v := range cc {
-		if strings.HasSuffix(k, "email") {
-			email, ok := v.(string)
-			if !ok {
-				return "", fmt.Errorf(
-					"email '%v' from claims has unexpected type: expected 'string', got '%T'",
-					v, v)
+// lookupPath returns the value at the path of nested objects. The keys can have dots themselves, like namespaced
+// claims, so the longest key the path starts with is tried first.
+func lookupPath(v interface{}, path string) (interface{}, bool) {
+	obj, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, false
+	}
+	if v, ok := obj[path]; ok {
+		return v, true
+	}
+
+	for i := strings.LastIndex(path, "."); i > 0; i = strings.LastIndex(path[:i], ".") {
+		if child, ok := obj[path[:i]]; ok {
+			if v, ok := lookupPath(child, path[i+1:]); ok {
+				return v, true
 			}
-			return email, nil
 		}
 	}
-	return "", nil
+
+	return nil, false
 }
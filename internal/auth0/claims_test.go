@@ -4,8 +4,10 @@ import (
 	"context"
 	"encoding/json"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestClaims(t *testing.T) {
@@ -26,11 +28,34 @@ func TestClaims(t *testing.T) {
 	var claims CustomClaims
 	assert.NoError(t, json.Unmarshal([]byte(claimsJSON), &claims))
 	assert.NoError(t, claims.Validate(context.Background()))
-	assert.Equal(t, "auth0|1a2b3c4d5e6f7g8h9i0a1b2c", claims.GetUserID())
-	assert.Equal(t, "some.user@some-non-existent-domain.com", claims.GetUserEmail())
+	userID, err := claims.GetUserID()
+	assert.NoError(t, err)
+	assert.Equal(t, "auth0|1a2b3c4d5e6f7g8h9i0a1b2c", userID)
+	_, err = claims.GetUserEmail()
+	assert.ErrorIs(t, err, ErrClaimNotFound, "namespaced claims are not mapped by default")
+	assert.NoError(t, claims.Map(ClaimMapping{Email: "https://icondevhvo.com/email"}))
+	email, err := claims.GetUserEmail()
+	assert.NoError(t, err)
+	assert.Equal(t, "some.user@some-non-existent-domain.com", email)
+	assert.Empty(t, claims.GetTokenID())
+	assert.Empty(t, claims.GetSessionID())
+	assert.Equal(t, "a1b2", CustomClaims{"jti": "a1b2", "sid": "c3d4"}.GetTokenID())
+	assert.Equal(t, "c3d4", CustomClaims{"jti": "a1b2", "sid": "c3d4"}.GetSessionID())
+	assert.True(t, claims.HasScope("email"))
+	assert.False(t, claims.HasScope("admin"))
+	assert.True(t, CustomClaims{"permissions": []interface{}{"read:users", "admin"}}.HasScope("admin"))
+	assert.False(t, CustomClaims{"scope": "administrator"}.HasScope("admin"))
+	assert.Nil(t, claims.GetAuthMethods())
+	assert.True(t, claims.GetAuthTime().IsZero())
+	mfa := CustomClaims{"amr": []interface{}{"pwd", "otp", "mfa"}, "auth_time": float64(1651239912)}
+	assert.Equal(t, []string{"pwd", "otp", "mfa"}, mfa.GetAuthMethods())
+	assert.True(t, mfa.HasAuthMethod(AuthMethodMFA))
+	assert.False(t, claims.HasAuthMethod(AuthMethodMFA))
+	assert.Equal(t, time.Unix(1651239912, 0), mfa.GetAuthTime())
+	assert.Equal(t, time.Unix(1651239912, 0), CustomClaims{"auth_time": json.Number("1651239912")}.GetAuthTime())
 
 	// no user ID
-	err := CustomClaims{}.Validate(context.Background())
+	err = CustomClaims{}.Validate(context.Background())
 	assert.Error(t, err)
 	assert.Equal(
 		t,
@@ -39,8 +64,8 @@ func TestClaims(t *testing.T) {
 
 	// user ID and email are present, but they are not strings
 	err = CustomClaims{
-		"sub":                          true,
-		"https://icondevhvo.com/email": false,
+		"sub":   true,
+		"email": false,
 	}.Validate(context.Background())
 	assert.Error(t, err)
 	assert.Equal(
@@ -50,3 +75,94 @@ func TestClaims(t *testing.T) {
 			"email 'false' from claims has unexpected type: expected 'string', got 'bool'",
 		err.Error())
 }
+
+func TestClaims_Map(t *testing.T) {
+	claimsJSON := `{
+    "sub": "auth0|1a2b3c4d5e6f7g8h9i0a1b2c",
+    "email": "jane@old-domain.com",
+    "name": "Jane Doe",
+    "https://replaceme.com/email": "jane.doe@replaceme.com",
+    "https://replaceme.com/app_metadata": {"tenant": "acme", "roles": ["admin", "editor"]},
+    "realm_access": {"roles": "offline_access admin"},
+    "org": {"id": 42}
+  }`
+
+	tests := []struct {
+		name    string
+		mapping ClaimMapping
+		email   string
+		tenant  string
+		roles   []string
+		err     string
+	}{
+		{
+			name:  "Default",
+			email: "jane@old-domain.com",
+		},
+		{
+			name:    "Namespaced",
+			mapping: ClaimMapping{Email: "https://replaceme.com/email", Roles: "https://replaceme.com/app_metadata.roles", Tenant: "https://replaceme.com/app_metadata.tenant"},
+			email:   "jane.doe@replaceme.com",
+			tenant:  "acme",
+			roles:   []string{"admin", "editor"},
+		},
+		{
+			name:    "Nested",
+			mapping: ClaimMapping{Roles: "realm_access.roles"},
+			email:   "jane@old-domain.com",
+			roles:   []string{"offline_access", "admin"},
+		},
+		{
+			name:    "Tenant of another type",
+			mapping: ClaimMapping{Tenant: "org.id"},
+			err:     "failed to validate token claims: tenant '42' from claims has unexpected type: expected 'string', got 'float64'",
+		},
+		{
+			name:    "Roles of another type",
+			mapping: ClaimMapping{Roles: "org"},
+			err:     "failed to validate token claims: roles 'map[id:42]' from claims have unexpected type: expected a list or a 'string', got 'map[string]interface {}'",
+		},
+		{
+			name:    "Missing subject",
+			mapping: ClaimMapping{Subject: "preferred_username"},
+			err:     "failed to validate token claims: no user ID found in claims",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the mapping does not depend on the order of the claims
+			for i := 0; i < 10; i++ {
+				var claims CustomClaims
+				require.NoError(t, json.Unmarshal([]byte(claimsJSON), &claims))
+				err := claims.Map(tt.mapping)
+				if tt.err != "" {
+					assert.EqualError(t, err, tt.err)
+					return
+				}
+				require.NoError(t, err)
+
+				email, err := claims.GetUserEmail()
+				assert.NoError(t, err)
+				assert.Equal(t, tt.email, email)
+				name, err := claims.GetUserName()
+				assert.NoError(t, err)
+				assert.Equal(t, "Jane Doe", name)
+				tenant, err := claims.GetTenant()
+				if tt.tenant == "" {
+					assert.ErrorIs(t, err, ErrClaimNotFound)
+				}
+				assert.Equal(t, tt.tenant, tenant)
+				assert.Equal(t, tt.roles, claims.GetRoles())
+			}
+		})
+	}
+
+	t.Run("Unmapped claims", func(t *testing.T) {
+		claims := CustomClaims{"sub": "auth0|1a2b3c4d5e6f7g8h9i0a1b2c"}
+		_, err := claims.GetUserID()
+		assert.EqualError(t, err, "claim not found: user ID")
+		claims[claimsKeyEmail] = 1
+		_, err = claims.GetUserEmail()
+		assert.EqualError(t, err, "email '1' from claims has unexpected type: expected 'string', got 'int'")
+	})
+}
@@ -1,26 +1,39 @@
-// pachage auth provides functionality to enable authentication middleware for auth0
+// pachage auth provides functionality to enable authentication middleware for auth0 and other OpenID Connect issuers
 package auth
 
 import (
 	jwtmiddleware "github.com/auth0/go-jwt-middleware/v2"
+	"github.com/auth0/go-jwt-middleware/v2/validator"
+	"github.com/efimovalex/replaceme/internal/token"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
 
 // Auth is the Auth service struct
 type Auth struct {
-	Domain   string
-	Audience []string
+	// Providers are the trusted OpenID Connect issuers, each with its own audiences and keys
+	Providers []Provider
+
+	// Issuer issues the first-party tokens of the login endpoint, they are accepted along with the provider tokens
+	Issuer *token.Issuer
 
 	Middleware *jwtmiddleware.JWTMiddleware
 	logger     zerolog.Logger
 }
 
-// New creates a new Auth service
-func New(domain string, audience []string) *Auth {
+// New creates a new Auth service trusting the providers
+func New(providers ...Provider) *Auth {
 	return &Auth{
-		Domain:   domain,
-		Audience: audience,
-		logger:   log.With().Str("component", "auth").Logger(),
+		Providers: providers,
+		logger:    log.With().Str("component", "auth").Logger(),
+	}
+}
+
+// Auth0 returns the provider of an Auth0 tenant
+func Auth0(domain string, audience ...string) Provider {
+	return Provider{
+		Issuer:     "https://" + domain + "/",
+		Audience:   audience,
+		Algorithms: []string{string(validator.RS256)},
 	}
 }
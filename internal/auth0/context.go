@@ -13,6 +13,9 @@ type ctxKey string
 var (
 	ctxKeyUserID    = ctxKey("user-id")
 	ctxKeyUserEmail = ctxKey("user-email")
+	ctxKeyUserName  = ctxKey("user-name")
+	ctxKeyTenant    = ctxKey("tenant")
+	ctxKeyIssuer    = ctxKey("issuer")
 )
 
 // ClaimsValue returns the JWT claims from the specified context.
@@ -60,7 +63,7 @@ func UserIDValue(ctx context.Context) (string, error) {
 
 // WithUserEmail sets the user email in the context.
 func WithUserEmail(ctx context.Context, email string) context.Context {
-	return context.WithValue(ctx, ctxKeyUserEmail, ctxKeyUserEmail)
+	return context.WithValue(ctx, ctxKeyUserEmail, email)
 }
 
 // UserEmailValue retrieves the user email from the context.
@@ -71,3 +74,45 @@ func UserEmailValue(ctx context.Context) (string, error) {
 	}
 	return userEmail, nil
 }
+
+// WithUserName sets the user name in the context.
+func WithUserName(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, ctxKeyUserName, name)
+}
+
+// UserNameValue retrieves the user name from the context.
+func UserNameValue(ctx context.Context) (string, error) {
+	name, ok := ctx.Value(ctxKeyUserName).(string)
+	if !ok {
+		return "", fmt.Errorf("no user name found in context")
+	}
+	return name, nil
+}
+
+// WithTenant sets the tenant of the user in the context.
+func WithTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, ctxKeyTenant, tenant)
+}
+
+// TenantValue retrieves the tenant of the user from the context.
+func TenantValue(ctx context.Context) (string, error) {
+	tenant, ok := ctx.Value(ctxKeyTenant).(string)
+	if !ok {
+		return "", fmt.Errorf("no tenant found in context")
+	}
+	return tenant, nil
+}
+
+// WithIssuer sets the issuer of the validated token in the context.
+func WithIssuer(ctx context.Context, issuer string) context.Context {
+	return context.WithValue(ctx, ctxKeyIssuer, issuer)
+}
+
+// IssuerValue retrieves the issuer of the validated token from the context.
+func IssuerValue(ctx context.Context) (string, error) {
+	issuer, ok := ctx.Value(ctxKeyIssuer).(string)
+	if !ok {
+		return "", fmt.Errorf("no issuer found in context")
+	}
+	return issuer, nil
+}
@@ -66,3 +66,47 @@ func TestContextUserID(t *testing.T) {
 	require.Equal(t, userID, actualUserID)
 
 }
+
+func TestContextUserEmail(t *testing.T) {
+	// missing user email
+	ctx := context.Background()
+	_, err := UserEmailValue(ctx)
+	require.EqualError(t, err, "no user email found in context")
+
+	// happy path
+	email := "jane.doe@replaceme.com"
+	ctx = WithUserEmail(ctx, email)
+	actualEmail, err := UserEmailValue(ctx)
+	require.NoError(t, err)
+	require.Equal(t, email, actualEmail)
+}
+
+func TestContextIssuer(t *testing.T) {
+	// missing issuer
+	ctx := context.Background()
+	_, err := IssuerValue(ctx)
+	require.EqualError(t, err, "no issuer found in context")
+
+	// happy path
+	issuer := "https://replaceme.eu.auth0.com/"
+	ctx = WithIssuer(ctx, issuer)
+	actualIssuer, err := IssuerValue(ctx)
+	require.NoError(t, err)
+	require.Equal(t, issuer, actualIssuer)
+}
+
+func TestContextUserNameAndTenant(t *testing.T) {
+	ctx := context.Background()
+	_, err := UserNameValue(ctx)
+	require.EqualError(t, err, "no user name found in context")
+	_, err = TenantValue(ctx)
+	require.EqualError(t, err, "no tenant found in context")
+
+	ctx = WithTenant(WithUserName(ctx, "Jane Doe"), "acme")
+	name, err := UserNameValue(ctx)
+	require.NoError(t, err)
+	require.Equal(t, "Jane Doe", name)
+	tenant, err := TenantValue(ctx)
+	require.NoError(t, err)
+	require.Equal(t, "acme", tenant)
+}
@@ -0,0 +1,369 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/auth0/go-jwt-middleware/v2/validator"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// defaultIntrospectionCacheTTL is how long an active token is trusted without asking the issuer again
+	defaultIntrospectionCacheTTL = time.Minute
+	// defaultIntrospectionNegativeCacheTTL is how long an inactive token is rejected without asking the issuer again
+	defaultIntrospectionNegativeCacheTTL = 30 * time.Second
+	// defaultBreakerThreshold is the number of consecutive failures which open the circuit breaker
+	defaultBreakerThreshold = 5
+	// defaultBreakerCooldown is how long the circuit breaker stays open before a request probes the endpoint
+	defaultBreakerCooldown = 30 * time.Second
+	// introspectionTimeout bounds each request to the introspection endpoint
+	introspectionTimeout = 5 * time.Second
+)
+
+var (
+	// ErrTokenInactive is returned for tokens the issuer reports inactive, e.g. expired or revoked
+	ErrTokenInactive = errors.New("token is not active")
+	// ErrIntrospectionUnavailable is returned while the circuit breaker of the introspection endpoint is open
+	ErrIntrospectionUnavailable = errors.New("introspection endpoint unavailable")
+)
+
+// Introspection configures the validation of tokens at the RFC 7662 introspection endpoint of an issuer, for the
+// opaque tokens which cannot be verified with the keys of the issuer
+type Introspection struct {
+	// URL is the introspection endpoint
+	URL string
+	// ClientID and ClientSecret authenticate the service to the endpoint with HTTP basic authentication
+	ClientID     string
+	ClientSecret string
+	// Opaque marks the issuer of the opaque tokens, which tell no issuer. It is implied for
+	// the only provider with an introspection endpoint.
+	Opaque bool
+	// CacheTTL is how long an active token is cached, at most until it expires, 1 minute when zero
+	CacheTTL time.Duration
+	// NegativeCacheTTL is how long an inactive token is cached, 30 seconds when zero
+	NegativeCacheTTL time.Duration
+	// BreakerThreshold is the number of consecutive failures of the endpoint after which tokens are rejected
+	// without calling it, for BreakerCooldown. 5 and 30 seconds when zero.
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+}
+
+// IntrospectionCache stores the introspection results, shared between replicas, see adapters/redisdb
+type IntrospectionCache interface {
+	// GetIntrospection returns the result cached under key, nil if not found
+	GetIntrospection(ctx context.Context, key string) ([]byte, error)
+	SetIntrospection(ctx context.Context, key string, result []byte, ttl time.Duration) error
+}
+
+// introspectionResponse is the part of the RFC 7662 response used to validate the token, the whole response
+// becomes the claims of the token
+type introspectionResponse struct {
+	Active    bool     `json:"active"`
+	Issuer    string   `json:"iss"`
+	Subject   string   `json:"sub"`
+	Audience  audience `json:"aud"`
+	Expiry    int64    `json:"exp"`
+	NotBefore int64    `json:"nbf"`
+	IssuedAt  int64    `json:"iat"`
+	ID        string   `json:"jti"`
+}
+
+// audience is the aud member, a string or a list of strings
+type audience []string
+
+func (a *audience) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*a = audience{s}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(b, &list); err != nil {
+		return err
+	}
+	*a = list
+
+	return nil
+}
+
+// inactiveResult is the cached result of the inactive tokens
+var inactiveResult = []byte(`{"active":false}`)
+
+// Introspector validates the tokens of a Provider at its introspection endpoint, see Introspection
+type Introspector struct {
+	provider Provider
+	config   Introspection
+	issuer   string
+	cache    IntrospectionCache
+	breaker  *breaker
+	logger   zerolog.Logger
+}
+
+// NewIntrospector checks the introspection configuration of the provider, the results are cached in cache
+// unless it is nil
+func NewIntrospector(p Provider, cache IntrospectionCache) (*Introspector, error) {
+	if p.Introspection == nil {
+		return nil, fmt.Errorf("issuer %q has no introspection endpoint", p.Issuer)
+	}
+	issuerURL, err := url.Parse(p.Issuer)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the issuer url: %v", err)
+	}
+	if issuerURL.Scheme == "" || issuerURL.Host == "" {
+		return nil, fmt.Errorf("invalid issuer url %q", p.Issuer)
+	}
+	endpoint, err := url.Parse(p.Introspection.URL)
+	if err != nil || endpoint.Scheme == "" || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid introspection url %q", p.Introspection.URL)
+	}
+	if p.Client == nil {
+		p.Client = http.DefaultClient
+	}
+
+	cfg := *p.Introspection
+	if cfg.CacheTTL <= 0 {
+		cfg.CacheTTL = defaultIntrospectionCacheTTL
+	}
+	if cfg.NegativeCacheTTL <= 0 {
+		cfg.NegativeCacheTTL = defaultIntrospectionNegativeCacheTTL
+	}
+	if cfg.BreakerThreshold <= 0 {
+		cfg.BreakerThreshold = defaultBreakerThreshold
+	}
+	if cfg.BreakerCooldown <= 0 {
+		cfg.BreakerCooldown = defaultBreakerCooldown
+	}
+
+	return &Introspector{
+		provider: p,
+		config:   cfg,
+		issuer:   issuerURL.String(),
+		cache:    cache,
+		breaker:  &breaker{threshold: cfg.BreakerThreshold, cooldown: cfg.BreakerCooldown},
+		logger:   log.With().Str("component", "auth").Str("issuer", p.Issuer).Logger(),
+	}, nil
+}
+
+// Issuer returns the issuer of the tokens of the provider
+func (in *Introspector) Issuer() string {
+	return in.issuer
+}
+
+// ValidateToken asks the issuer whether the token is active, and checks the issuer, the audience and the time
+// members of the response. The members of the response are the claims of the token, mapped as the claims of a JWT,
+// see ClaimMapping. It returns *validator.ValidatedClaims with *CustomClaims, see jwtmiddleware.ValidateToken.
+func (in *Introspector) ValidateToken(ctx context.Context, token string) (interface{}, error) {
+	key := in.cacheKey(token)
+	result := in.cached(ctx, key)
+	fresh := result == nil
+	if fresh {
+		var err error
+		if result, err = in.introspect(ctx, token); err != nil {
+			return nil, err
+		}
+	}
+
+	var res introspectionResponse
+	if err := json.Unmarshal(result, &res); err != nil {
+		return nil, fmt.Errorf("invalid introspection response: %w", err)
+	}
+	now := time.Now()
+	if !res.Active || (res.Expiry != 0 && now.After(time.Unix(res.Expiry, 0).Add(clockSkew))) {
+		if fresh {
+			in.store(ctx, key, inactiveResult, in.config.NegativeCacheTTL)
+		}
+		return nil, ErrTokenInactive
+	}
+	if fresh {
+		ttl := in.config.CacheTTL
+		if res.Expiry != 0 && time.Until(time.Unix(res.Expiry, 0)) < ttl {
+			ttl = time.Until(time.Unix(res.Expiry, 0))
+		}
+		in.store(ctx, key, result, ttl)
+	}
+
+	if res.NotBefore != 0 && now.Add(clockSkew).Before(time.Unix(res.NotBefore, 0)) {
+		return nil, errors.New("invalid token claims: token not valid yet")
+	}
+	if res.Issuer != "" && res.Issuer != in.issuer {
+		return nil, fmt.Errorf("token of issuer %q introspected by issuer %q", res.Issuer, in.issuer)
+	}
+	if !in.hasAudience(res.Audience) {
+		return nil, ErrInvalidAudience
+	}
+
+	claims := CustomClaims{}
+	if err := json.Unmarshal(result, &claims); err != nil {
+		return nil, fmt.Errorf("invalid introspection response: %w", err)
+	}
+	delete(claims, "active")
+	if err := claims.Map(in.provider.Claims); err != nil {
+		return nil, err
+	}
+
+	return &validator.ValidatedClaims{
+		RegisteredClaims: validator.RegisteredClaims{
+			Issuer:    in.issuer,
+			Subject:   res.Subject,
+			Audience:  res.Audience,
+			Expiry:    res.Expiry,
+			NotBefore: res.NotBefore,
+			IssuedAt:  res.IssuedAt,
+			ID:        res.ID,
+		},
+		CustomClaims: &claims,
+	}, nil
+}
+
+func (in *Introspector) hasAudience(aud audience) bool {
+	for _, expected := range in.provider.Audience {
+		for _, a := range aud {
+			if expected != "" && a == expected {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// introspect posts the token to the endpoint through the circuit breaker
+func (in *Introspector) introspect(ctx context.Context, token string) ([]byte, error) {
+	if !in.breaker.allow() {
+		return nil, ErrIntrospectionUnavailable
+	}
+	result, err := in.post(ctx, token)
+	if err != nil && ctx.Err() != nil {
+		// the request was canceled, it tells nothing about the endpoint
+		in.breaker.release()
+	} else {
+		in.breaker.done(err)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not introspect the token: %w", err)
+	}
+
+	return result, nil
+}
+
+func (in *Introspector) post(ctx context.Context, token string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, introspectionTimeout)
+	defer cancel()
+
+	form := url.Values{"token": {token}, "token_type_hint": {"access_token"}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, in.config.URL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if in.config.ClientID != "" {
+		req.SetBasicAuth(url.QueryEscape(in.config.ClientID), url.QueryEscape(in.config.ClientSecret))
+	}
+
+	res, err := in.provider.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d from %s", res.StatusCode, in.config.URL)
+	}
+	result, err := io.ReadAll(io.LimitReader(res.Body, maxDocumentSize))
+	if err != nil {
+		return nil, err
+	}
+	if !json.Valid(result) {
+		return nil, errors.New("introspection response is not json")
+	}
+
+	return result, nil
+}
+
+// cacheKey identifies the token of the issuer without storing it
+func (in *Introspector) cacheKey(token string) string {
+	sum := sha256.Sum256([]byte(in.issuer + " " + token))
+	return hex.EncodeToString(sum[:])
+}
+
+// cached returns the cached result, a failing cache only costs a call to the endpoint
+func (in *Introspector) cached(ctx context.Context, key string) []byte {
+	if in.cache == nil {
+		return nil
+	}
+	result, err := in.cache.GetIntrospection(ctx, key)
+	if err != nil {
+		in.logger.Warn().Err(err).Msg("failed to load the cached introspection result")
+		return nil
+	}
+
+	return result
+}
+
+func (in *Introspector) store(ctx context.Context, key string, result []byte, ttl time.Duration) {
+	if in.cache == nil || ttl <= 0 {
+		return
+	}
+	if err := in.cache.SetIntrospection(ctx, key, result, ttl); err != nil {
+		in.logger.Warn().Err(err).Msg("failed to cache the introspection result")
+	}
+}
+
+// breaker is a circuit breaker. After threshold consecutive failures it opens, and requests fail without calling
+// the endpoint until cooldown passed. Then a single request probes the endpoint, and closes the breaker on success.
+type breaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+func (b *breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures < b.threshold {
+		return true
+	}
+	if b.probing || time.Since(b.openedAt) < b.cooldown {
+		return false
+	}
+	b.probing = true
+
+	return true
+}
+
+// release ends a probe without a result
+func (b *breaker) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+}
+
+func (b *breaker) done(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	if err == nil {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures >= b.threshold {
+		b.openedAt = time.Now()
+	}
+}
@@ -0,0 +1,294 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/auth0/go-jwt-middleware/v2/validator"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// stubIntrospection serves an RFC 7662 introspection endpoint knowing the tokens of responses
+type stubIntrospection struct {
+	*httptest.Server
+	responses map[string]map[string]interface{}
+	status    int
+	calls     int32
+}
+
+func newStubIntrospection(t *testing.T) *stubIntrospection {
+	s := &stubIntrospection{responses: map[string]map[string]interface{}{}, status: http.StatusOK}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&s.calls, 1)
+		if id, secret, ok := r.BasicAuth(); !ok || id != "replaceme" || secret != "s3cr3t" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if s.status != http.StatusOK {
+			w.WriteHeader(s.status)
+			return
+		}
+		res, ok := s.responses[r.PostFormValue("token")]
+		if !ok {
+			res = map[string]interface{}{"active": false}
+		}
+		_ = json.NewEncoder(w).Encode(res)
+	}))
+	t.Cleanup(s.Close)
+
+	return s
+}
+
+func (s *stubIntrospection) provider() Provider {
+	return Provider{
+		Issuer:   "https://idp.replaceme.com/",
+		Audience: []string{"https://replaceme.com"},
+		Introspection: &Introspection{
+			URL:              s.URL,
+			ClientID:         "replaceme",
+			ClientSecret:     "s3cr3t",
+			BreakerThreshold: 2,
+		},
+	}
+}
+
+func (s *stubIntrospection) active(token string, members map[string]interface{}) {
+	res := map[string]interface{}{
+		"active": true,
+		"iss":    "https://idp.replaceme.com/",
+		"sub":    "user-1",
+		"aud":    "https://replaceme.com",
+		"exp":    time.Now().Add(time.Hour).Unix(),
+		"scope":  "openid admin",
+	}
+	for k, v := range members {
+		if v == nil {
+			delete(res, k)
+			continue
+		}
+		res[k] = v
+	}
+	s.responses[token] = res
+}
+
+// memoryCache is an IntrospectionCache recording the ttl of the results
+type memoryCache struct {
+	mu      sync.Mutex
+	results map[string][]byte
+	ttls    map[string]time.Duration
+	err     error
+}
+
+func newMemoryCache() *memoryCache {
+	return &memoryCache{results: map[string][]byte{}, ttls: map[string]time.Duration{}}
+}
+
+func (c *memoryCache) GetIntrospection(_ context.Context, key string) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.results[key], c.err
+}
+
+func (c *memoryCache) SetIntrospection(_ context.Context, key string, result []byte, ttl time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return c.err
+	}
+	c.results[key] = result
+	c.ttls[key] = ttl
+	return nil
+}
+
+func TestNewIntrospector(t *testing.T) {
+	tests := []struct {
+		name     string
+		provider Provider
+		err      string
+	}{
+		{"Valid", Provider{Issuer: "https://idp.replaceme.com/", Introspection: &Introspection{URL: "https://idp.replaceme.com/introspect"}}, ""},
+		{"No endpoint", Provider{Issuer: "https://idp.replaceme.com/"}, `issuer "https://idp.replaceme.com/" has no introspection endpoint`},
+		{"Relative endpoint", Provider{Issuer: "https://idp.replaceme.com/", Introspection: &Introspection{URL: "/introspect"}}, `invalid introspection url "/introspect"`},
+		{"Relative issuer", Provider{Issuer: "idp.replaceme.com", Introspection: &Introspection{URL: "https://idp.replaceme.com/introspect"}}, `invalid issuer url "idp.replaceme.com"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in, err := NewIntrospector(tt.provider, nil)
+			if tt.err != "" {
+				assert.EqualError(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.provider.Issuer, in.Issuer())
+			assert.Equal(t, defaultIntrospectionCacheTTL, in.config.CacheTTL)
+		})
+	}
+}
+
+func TestIntrospector_ValidateToken(t *testing.T) {
+	s := newStubIntrospection(t)
+	s.active("opaque-1", map[string]interface{}{"email": "jane.doe@replaceme.com", "jti": "a1b2"})
+	s.active("expiring", map[string]interface{}{"exp": time.Now().Add(20 * time.Second).Unix()})
+	s.active("expired", map[string]interface{}{"exp": time.Now().Add(-time.Hour).Unix()})
+	s.active("other-audience", map[string]interface{}{"aud": []string{"https://other.com"}})
+	s.active("audiences", map[string]interface{}{"aud": []string{"https://other.com", "https://replaceme.com"}})
+	s.active("other-issuer", map[string]interface{}{"iss": "https://other.com/"})
+	s.active("no-subject", map[string]interface{}{"sub": nil, "username": "jane"})
+
+	t.Run("Active", func(t *testing.T) {
+		cache := newMemoryCache()
+		in, err := NewIntrospector(s.provider(), cache)
+		require.NoError(t, err)
+		calls := atomic.LoadInt32(&s.calls)
+
+		got, err := in.ValidateToken(context.Background(), "opaque-1")
+		require.NoError(t, err)
+		validated := got.(*validator.ValidatedClaims)
+		assert.Equal(t, "https://idp.replaceme.com/", validated.RegisteredClaims.Issuer)
+		assert.Equal(t, "a1b2", validated.RegisteredClaims.ID)
+		claims := validated.CustomClaims.(*CustomClaims)
+		userID, err := claims.GetUserID()
+		assert.NoError(t, err)
+		assert.Equal(t, "user-1", userID)
+		email, err := claims.GetUserEmail()
+		assert.NoError(t, err)
+		assert.Equal(t, "jane.doe@replaceme.com", email)
+		assert.True(t, claims.HasScope("admin"))
+		assert.NotContains(t, *claims, "active")
+
+		// the result is cached, and the token itself is not stored
+		_, err = in.ValidateToken(context.Background(), "opaque-1")
+		assert.NoError(t, err)
+		assert.Equal(t, calls+1, atomic.LoadInt32(&s.calls))
+		require.Len(t, cache.ttls, 1)
+		for key, ttl := range cache.ttls {
+			assert.NotContains(t, key, "opaque-1")
+			assert.Equal(t, defaultIntrospectionCacheTTL, ttl)
+		}
+	})
+
+	t.Run("Cache bounded by the expiry", func(t *testing.T) {
+		cache := newMemoryCache()
+		in, err := NewIntrospector(s.provider(), cache)
+		require.NoError(t, err)
+
+		_, err = in.ValidateToken(context.Background(), "expiring")
+		require.NoError(t, err)
+		ttl := cache.ttls[in.cacheKey("expiring")]
+		assert.True(t, ttl > 15*time.Second && ttl <= 20*time.Second, ttl)
+	})
+
+	t.Run("Inactive", func(t *testing.T) {
+		cache := newMemoryCache()
+		in, err := NewIntrospector(s.provider(), cache)
+		require.NoError(t, err)
+		calls := atomic.LoadInt32(&s.calls)
+
+		for i := 0; i < 2; i++ {
+			_, err = in.ValidateToken(context.Background(), "revoked")
+			assert.ErrorIs(t, err, ErrTokenInactive)
+		}
+		assert.Equal(t, calls+1, atomic.LoadInt32(&s.calls), "inactive tokens are cached too")
+		assert.Equal(t, defaultIntrospectionNegativeCacheTTL, cache.ttls[in.cacheKey("revoked")])
+
+		_, err = in.ValidateToken(context.Background(), "expired")
+		assert.ErrorIs(t, err, ErrTokenInactive)
+	})
+
+	t.Run("Invalid tokens", func(t *testing.T) {
+		in, err := NewIntrospector(s.provider(), nil)
+		require.NoError(t, err)
+		ctx := context.Background()
+
+		_, err = in.ValidateToken(ctx, "other-audience")
+		assert.ErrorIs(t, err, ErrInvalidAudience)
+		_, err = in.ValidateToken(ctx, "audiences")
+		assert.NoError(t, err)
+		_, err = in.ValidateToken(ctx, "other-issuer")
+		assert.EqualError(t, err, `token of issuer "https://other.com/" introspected by issuer "https://idp.replaceme.com/"`)
+		_, err = in.ValidateToken(ctx, "no-subject")
+		assert.EqualError(t, err, "failed to validate token claims: no user ID found in claims")
+
+		p := s.provider()
+		p.Claims = ClaimMapping{Subject: "username"}
+		in, err = NewIntrospector(p, nil)
+		require.NoError(t, err)
+		got, err := in.ValidateToken(ctx, "no-subject")
+		require.NoError(t, err)
+		userID, err := got.(*validator.ValidatedClaims).CustomClaims.(*CustomClaims).GetUserID()
+		assert.NoError(t, err)
+		assert.Equal(t, "jane", userID)
+	})
+
+	t.Run("Failing cache", func(t *testing.T) {
+		cache := newMemoryCache()
+		cache.err = errors.New("connection refused")
+		in, err := NewIntrospector(s.provider(), cache)
+		require.NoError(t, err)
+
+		_, err = in.ValidateToken(context.Background(), "opaque-1")
+		assert.NoError(t, err)
+	})
+
+	t.Run("Client authentication", func(t *testing.T) {
+		p := s.provider()
+		p.Introspection.ClientSecret = "guessed"
+		in, err := NewIntrospector(p, nil)
+		require.NoError(t, err)
+
+		_, err = in.ValidateToken(context.Background(), "opaque-1")
+		assert.EqualError(t, err, "could not introspect the token: unexpected status 401 from "+s.URL)
+	})
+}
+
+func TestIntrospector_CircuitBreaker(t *testing.T) {
+	s := newStubIntrospection(t)
+	s.active("opaque-1", nil)
+	in, err := NewIntrospector(s.provider(), nil)
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	s.status = http.StatusServiceUnavailable
+	for i := 0; i < 2; i++ {
+		_, err = in.ValidateToken(ctx, "opaque-1")
+		assert.ErrorContains(t, err, "unexpected status 503")
+	}
+	// the breaker is open, the endpoint is not called
+	calls := atomic.LoadInt32(&s.calls)
+	_, err = in.ValidateToken(ctx, "opaque-1")
+	assert.ErrorIs(t, err, ErrIntrospectionUnavailable)
+	assert.Equal(t, calls, atomic.LoadInt32(&s.calls))
+
+	// after the cooldown a failed probe opens it again
+	in.breaker.openedAt = in.breaker.openedAt.Add(-defaultBreakerCooldown)
+	_, err = in.ValidateToken(ctx, "opaque-1")
+	assert.ErrorContains(t, err, "unexpected status 503")
+	_, err = in.ValidateToken(ctx, "opaque-1")
+	assert.ErrorIs(t, err, ErrIntrospectionUnavailable)
+
+	// and a successful probe closes it
+	s.status = http.StatusOK
+	in.breaker.openedAt = in.breaker.openedAt.Add(-defaultBreakerCooldown)
+	_, err = in.ValidateToken(ctx, "opaque-1")
+	assert.NoError(t, err)
+	_, err = in.ValidateToken(ctx, "opaque-1")
+	assert.NoError(t, err)
+
+	// canceled requests do not count as failures
+	s.status = http.StatusServiceUnavailable
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	for i := 0; i < 3; i++ {
+		_, err = in.ValidateToken(canceled, "opaque-1")
+		assert.ErrorIs(t, err, context.Canceled)
+	}
+	assert.Zero(t, in.breaker.failures)
+}
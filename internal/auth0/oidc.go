@@ -0,0 +1,395 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/auth0/go-jwt-middleware/v2/validator"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// DiscoveryPath is the path of the OpenID Connect discovery document, relative to the issuer
+const DiscoveryPath = "/.well-known/openid-configuration"
+
+const (
+	// defaultKeysTTL is how long the fetched keys are used before they are fetched again
+	defaultKeysTTL = 5 * time.Minute
+	// minKeysRefresh limits the fetches caused by tokens signed with unknown keys
+	minKeysRefresh = 30 * time.Second
+	// clockSkew is the leeway of the time claims
+	clockSkew = time.Minute
+	// maxDocumentSize is the size limit of the discovery document and of the JWKS
+	maxDocumentSize = 1 << 20
+	// fetchTimeout bounds the fetches of the default client
+	fetchTimeout = 10 * time.Second
+)
+
+var (
+	// ErrUnsupportedAlgorithm is returned for tokens signed with an algorithm the provider does not accept
+	ErrUnsupportedAlgorithm = errors.New("unsupported signature algorithm")
+	// ErrKeyNotFound is returned for tokens signed with a key which is not in the JWKS of the provider
+	ErrKeyNotFound = errors.New("signing key not found")
+	// ErrInvalidAudience is returned for tokens issued for none of the audiences of the provider
+	ErrInvalidAudience = errors.New("token has none of the expected audiences")
+)
+
+// asymmetricAlgorithms are the algorithms a provider can accept, the keys of a JWKS are public
+var asymmetricAlgorithms = map[string]bool{
+	string(jose.RS256): true, string(jose.RS384): true, string(jose.RS512): true,
+	string(jose.PS256): true, string(jose.PS384): true, string(jose.PS512): true,
+	string(jose.ES256): true, string(jose.ES384): true, string(jose.ES512): true,
+	string(jose.EdDSA): true,
+}
+
+// Provider configures the verification of the tokens of an OpenID Connect issuer, e.g. Auth0, Keycloak, Dex or Okta
+type Provider struct {
+	// Issuer is the issuer URL, the iss claim of the tokens
+	Issuer   string
+	Audience []string
+	// JWKSURL is where the keys are fetched from, the jwks_uri of the discovery document when empty
+	JWKSURL string
+	// Algorithms the tokens can be signed with, the id_token_signing_alg_values_supported
+	// of the discovery document when empty
+	Algorithms []string
+	Claims     ClaimMapping
+	// KeysTTL is how long the fetched keys are used, 5 minutes when zero
+	KeysTTL time.Duration
+	// Client fetches the discovery document and the keys, a client with a 10 seconds timeout when nil
+	Client *http.Client
+	// Introspection validates the tokens at the introspection endpoint of the issuer instead of with its keys,
+	// e.g. for opaque tokens, see NewIntrospector
+	Introspection *Introspection
+}
+
+// Discovery is the part of the OpenID Connect discovery document used to verify tokens
+type Discovery struct {
+	Issuer                           string   `json:"issuer"`
+	JWKSURI                          string   `json:"jwks_uri"`
+	IDTokenSigningAlgValuesSupported []string `json:"id_token_signing_alg_values_supported"`
+}
+
+// Verifier validates the tokens of a Provider, with its keys fetched from the JWKS of the issuer
+type Verifier struct {
+	provider Provider
+	issuer   string
+
+	mu         sync.Mutex
+	algorithms map[string]bool
+	jwksURL    string
+	keys       jose.JSONWebKeySet
+	fetchedAt  time.Time
+	// refreshing is the running fetch, nil when none
+	refreshing *refresh
+}
+
+// refresh is a fetch of the keys shared by the callers arriving while it runs
+type refresh struct {
+	done chan struct{}
+	err  error
+}
+
+// NewVerifier checks the configuration of the provider, nothing is fetched until the first token is validated
+func NewVerifier(p Provider) (*Verifier, error) {
+	issuerURL, err := url.Parse(p.Issuer)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the issuer url: %v", err)
+	}
+	if issuerURL.Scheme == "" || issuerURL.Host == "" {
+		return nil, fmt.Errorf("invalid issuer url %q", p.Issuer)
+	}
+	if p.JWKSURL != "" {
+		if _, err := url.Parse(p.JWKSURL); err != nil {
+			return nil, fmt.Errorf("failed to parse the jwks url: %v", err)
+		}
+	}
+	if p.KeysTTL <= 0 {
+		p.KeysTTL = defaultKeysTTL
+	}
+	if p.Client == nil {
+		p.Client = &http.Client{Timeout: fetchTimeout}
+	}
+
+	v := &Verifier{provider: p, issuer: issuerURL.String(), jwksURL: p.JWKSURL}
+	if len(p.Algorithms) > 0 {
+		if v.algorithms, err = algorithmSet(p.Algorithms); err != nil {
+			return nil, err
+		}
+	}
+
+	return v, nil
+}
+
+// Issuer returns the iss claim of the tokens of the provider
+func (v *Verifier) Issuer() string {
+	return v.issuer
+}
+
+// ValidateToken verifies the signature, the issuer, the audience and the time claims of a token, and maps its claims,
+// see ClaimMapping. It returns *validator.ValidatedClaims with *CustomClaims, see jwtmiddleware.ValidateToken.
+func (v *Verifier) ValidateToken(ctx context.Context, token string) (interface{}, error) {
+	parsed, err := jwt.ParseSigned(token)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse the token: %w", err)
+	}
+	header := parsed.Headers[0]
+
+	algorithms, err := v.allowedAlgorithms(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !algorithms[header.Algorithm] {
+		return nil, fmt.Errorf("%w %q", ErrUnsupportedAlgorithm, header.Algorithm)
+	}
+	key, err := v.key(ctx, header.KeyID)
+	if err != nil {
+		return nil, err
+	}
+
+	var registered jwt.Claims
+	claims := CustomClaims{}
+	if err := parsed.Claims(key.Key, &registered, &claims); err != nil {
+		return nil, fmt.Errorf("could not verify the token: %w", err)
+	}
+	if err := registered.ValidateWithLeeway(jwt.Expected{Issuer: v.issuer, Time: time.Now()}, clockSkew); err != nil {
+		return nil, fmt.Errorf("invalid token claims: %w", err)
+	}
+	if !v.hasAudience(registered.Audience) {
+		return nil, ErrInvalidAudience
+	}
+	if err := claims.Map(v.provider.Claims); err != nil {
+		return nil, err
+	}
+
+	return &validator.ValidatedClaims{
+		RegisteredClaims: validator.RegisteredClaims{
+			Issuer:    registered.Issuer,
+			Subject:   registered.Subject,
+			Audience:  registered.Audience,
+			Expiry:    numericDate(registered.Expiry),
+			NotBefore: numericDate(registered.NotBefore),
+			IssuedAt:  numericDate(registered.IssuedAt),
+			ID:        registered.ID,
+		},
+		CustomClaims: &claims,
+	}, nil
+}
+
+func (v *Verifier) hasAudience(audience jwt.Audience) bool {
+	for _, aud := range v.provider.Audience {
+		if aud != "" && audience.Contains(aud) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// allowedAlgorithms returns the configured algorithms, or the ones of the discovery document
+func (v *Verifier) allowedAlgorithms(ctx context.Context) (map[string]bool, error) {
+	v.mu.Lock()
+	algorithms := v.algorithms
+	v.mu.Unlock()
+	if algorithms != nil {
+		return algorithms, nil
+	}
+
+	if err := v.refresh(ctx); err != nil {
+		return nil, err
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	return v.algorithms, nil
+}
+
+// key returns the signing key with the id. The keys are fetched again once they expire, or when the key is
+// unknown, e.g. after the issuer rotated its keys. While they are fetched again, the other tokens signed with a
+// known key are verified with the old keys.
+func (v *Verifier) key(ctx context.Context, id string) (*jose.JSONWebKey, error) {
+	v.mu.Lock()
+	key := findKey(v.keys, id)
+	expired := time.Since(v.fetchedAt) > v.provider.KeysTTL
+	refreshing := v.refreshing != nil
+	v.mu.Unlock()
+	if key != nil && (!expired || refreshing) {
+		return key, nil
+	}
+
+	refreshed := false
+	if expired {
+		if err := v.refresh(ctx); err != nil {
+			return nil, err
+		}
+		refreshed = true
+		v.mu.Lock()
+		key = findKey(v.keys, id)
+		v.mu.Unlock()
+	}
+	v.mu.Lock()
+	stale := time.Since(v.fetchedAt) > minKeysRefresh
+	v.mu.Unlock()
+	if key == nil && !refreshed && stale {
+		if err := v.refresh(ctx); err != nil {
+			return nil, err
+		}
+		v.mu.Lock()
+		key = findKey(v.keys, id)
+		v.mu.Unlock()
+	}
+	if key == nil {
+		return nil, fmt.Errorf("%w: %q", ErrKeyNotFound, id)
+	}
+
+	return key, nil
+}
+
+// refresh fetches the keys, and the discovery document first when the JWKS URL or the algorithms are missing. One
+// fetch runs at a time, without the lock held: the callers arriving while it runs wait for its result. The fetch is
+// not canceled with the request which started it, it is bounded by the timeout of the client.
+func (v *Verifier) refresh(ctx context.Context) error {
+	v.mu.Lock()
+	r := v.refreshing
+	if r == nil {
+		r = &refresh{done: make(chan struct{})}
+		v.refreshing = r
+		go func() {
+			r.err = v.fetchKeys(context.Background())
+			v.mu.Lock()
+			v.refreshing = nil
+			v.mu.Unlock()
+			close(r.done)
+		}()
+	}
+	v.mu.Unlock()
+
+	select {
+	case <-r.done:
+		return r.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// fetchKeys fetches the JWKS of the provider, and stores the keys with the results of the discovery under the lock
+func (v *Verifier) fetchKeys(ctx context.Context) error {
+	v.mu.Lock()
+	jwksURL, algorithms := v.jwksURL, v.algorithms
+	v.mu.Unlock()
+	if jwksURL == "" || algorithms == nil {
+		var err error
+		if jwksURL, algorithms, err = v.discover(ctx, jwksURL, algorithms); err != nil {
+			return err
+		}
+	}
+
+	var keys jose.JSONWebKeySet
+	if err := v.get(ctx, jwksURL, &keys); err != nil {
+		return fmt.Errorf("could not fetch the jwks: %w", err)
+	}
+	v.mu.Lock()
+	v.jwksURL, v.algorithms = jwksURL, algorithms
+	v.keys = keys
+	v.fetchedAt = time.Now()
+	v.mu.Unlock()
+
+	return nil
+}
+
+// discover fetches the discovery document, for the JWKS URL and the algorithms missing from the configuration
+func (v *Verifier) discover(ctx context.Context, jwksURL string, algorithms map[string]bool) (string, map[string]bool, error) {
+	var doc Discovery
+	if err := v.get(ctx, strings.TrimSuffix(v.issuer, "/")+DiscoveryPath, &doc); err != nil {
+		return "", nil, fmt.Errorf("could not fetch the discovery document: %w", err)
+	}
+	// see OpenID Connect Discovery section 4.3
+	if doc.Issuer != v.issuer {
+		return "", nil, fmt.Errorf("discovery document of issuer %q is for issuer %q", v.issuer, doc.Issuer)
+	}
+
+	if jwksURL == "" {
+		if doc.JWKSURI == "" {
+			return "", nil, errors.New("discovery document has no jwks_uri")
+		}
+		jwksURL = doc.JWKSURI
+	}
+	if algorithms == nil {
+		// a list without asymmetric algorithms leaves the provider unusable, it is not kept
+		algorithms = map[string]bool{}
+		for _, alg := range doc.IDTokenSigningAlgValuesSupported {
+			if asymmetricAlgorithms[alg] {
+				algorithms[alg] = true
+			}
+		}
+		if len(algorithms) == 0 {
+			return "", nil, fmt.Errorf("discovery document of issuer %q has no supported signature algorithm", v.issuer)
+		}
+	}
+
+	return jwksURL, algorithms, nil
+}
+
+func (v *Verifier) get(ctx context.Context, url string, dst interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	res, err := v.provider.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d from %s", res.StatusCode, url)
+	}
+
+	return json.NewDecoder(io.LimitReader(res.Body, maxDocumentSize)).Decode(dst)
+}
+
+// findKey returns the signature key with the id, or the only signature key when the token does not name one
+func findKey(keys jose.JSONWebKeySet, id string) *jose.JSONWebKey {
+	var found []jose.JSONWebKey
+	for _, k := range keys.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		if id == "" || k.KeyID == id {
+			found = append(found, k)
+		}
+	}
+	if len(found) != 1 {
+		return nil
+	}
+
+	return &found[0]
+}
+
+func algorithmSet(algorithms []string) (map[string]bool, error) {
+	set := map[string]bool{}
+	for _, alg := range algorithms {
+		if !asymmetricAlgorithms[alg] {
+			return nil, fmt.Errorf("%w %q", ErrUnsupportedAlgorithm, alg)
+		}
+		set[alg] = true
+	}
+
+	return set, nil
+}
+
+func numericDate(d *jwt.NumericDate) int64 {
+	if d == nil {
+		return 0
+	}
+
+	return int64(*d)
+}
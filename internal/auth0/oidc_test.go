@@ -0,0 +1,274 @@
+package auth
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/auth0/go-jwt-middleware/v2/validator"
+	"github.com/efimovalex/replaceme/internal/auth0/authtest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+func newTestIssuer(t *testing.T) *authtest.Issuer {
+	s := authtest.NewIssuer(t, authtest.NewRSAKey(t, "rsa"), authtest.NewECKey(t, "ec"))
+	s.Algorithms = []string{"RS256", "ES256", "HS256"}
+
+	return s
+}
+
+func testProvider(s *authtest.Issuer) Provider {
+	return Provider{Issuer: s.Issuer(), Audience: []string{authtest.Audience}, Algorithms: []string{"RS256"}}
+}
+
+func TestNewVerifier(t *testing.T) {
+	tests := []struct {
+		name     string
+		provider Provider
+		err      string
+	}{
+		{"Valid", Provider{Issuer: "https://replaceme.eu.auth0.com/", Algorithms: []string{"RS256", "ES256"}}, ""},
+		{"Discovered algorithms", Provider{Issuer: "https://keycloak.replaceme.com/realms/replaceme"}, ""},
+		{"Invalid issuer", Provider{Issuer: "https://\\/"}, "failed to parse the issuer url"},
+		{"Relative issuer", Provider{Issuer: "replaceme.eu.auth0.com"}, `invalid issuer url "replaceme.eu.auth0.com"`},
+		{"Symmetric algorithm", Provider{Issuer: "https://dex.replaceme.com", Algorithms: []string{"HS256"}}, `unsupported signature algorithm "HS256"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, err := NewVerifier(tt.provider)
+			if tt.err != "" {
+				assert.ErrorContains(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.provider.Issuer, v.Issuer())
+		})
+	}
+}
+
+func TestVerifier_ValidateToken(t *testing.T) {
+	s := newTestIssuer(t)
+
+	t.Run("Valid", func(t *testing.T) {
+		v, err := NewVerifier(testProvider(s))
+		require.NoError(t, err)
+
+		got, err := v.ValidateToken(context.Background(), s.Sign(t, "rsa", map[string]interface{}{"email": "jane.doe@replaceme.com", "jti": "a1b2"}))
+		require.NoError(t, err)
+		validated := got.(*validator.ValidatedClaims)
+		assert.Equal(t, s.Issuer(), validated.RegisteredClaims.Issuer)
+		assert.Equal(t, "a1b2", validated.RegisteredClaims.ID)
+		claims := validated.CustomClaims.(*CustomClaims)
+		userID, err := claims.GetUserID()
+		assert.NoError(t, err)
+		assert.Equal(t, "user-1", userID)
+		email, err := claims.GetUserEmail()
+		assert.NoError(t, err)
+		assert.Equal(t, "jane.doe@replaceme.com", email)
+		assert.Nil(t, claims.GetRoles())
+
+		_, err = v.ValidateToken(context.Background(), s.Sign(t, "rsa", nil))
+		assert.NoError(t, err)
+		assert.Equal(t, 1, s.JWKSFetches(), "the keys are cached")
+	})
+
+	t.Run("Algorithms", func(t *testing.T) {
+		v, err := NewVerifier(testProvider(s))
+		require.NoError(t, err)
+		_, err = v.ValidateToken(context.Background(), s.Sign(t, "ec", nil))
+		assert.ErrorIs(t, err, ErrUnsupportedAlgorithm)
+
+		p := testProvider(s)
+		p.Algorithms = []string{"RS256", "ES256"}
+		v, err = NewVerifier(p)
+		require.NoError(t, err)
+		_, err = v.ValidateToken(context.Background(), s.Sign(t, "ec", nil))
+		assert.NoError(t, err)
+
+		// the discovered symmetric algorithms are ignored
+		p.Algorithms = nil
+		v, err = NewVerifier(p)
+		require.NoError(t, err)
+		_, err = v.ValidateToken(context.Background(), s.Sign(t, "ec", nil))
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]bool{"RS256": true, "ES256": true}, v.algorithms)
+	})
+
+	t.Run("Invalid tokens", func(t *testing.T) {
+		v, err := NewVerifier(testProvider(s))
+		require.NoError(t, err)
+		ctx := context.Background()
+
+		_, err = v.ValidateToken(ctx, "not-a-token")
+		assert.ErrorContains(t, err, "could not parse the token")
+		_, err = v.ValidateToken(ctx, s.Sign(t, "rsa", map[string]interface{}{"aud": "https://other.com"}))
+		assert.ErrorIs(t, err, ErrInvalidAudience)
+		_, err = v.ValidateToken(ctx, s.Sign(t, "rsa", map[string]interface{}{"iss": "https://other.com/"}))
+		assert.ErrorIs(t, err, jwt.ErrInvalidIssuer)
+		_, err = v.ValidateToken(ctx, s.Sign(t, "rsa", map[string]interface{}{"exp": time.Now().Add(-time.Hour).Unix()}))
+		assert.ErrorIs(t, err, jwt.ErrExpired)
+		_, err = v.ValidateToken(ctx, s.Sign(t, "rsa", map[string]interface{}{"sub": 1}))
+		assert.ErrorContains(t, err, "could not verify the token")
+
+		s.AddKey(authtest.NewRSAKey(t, "other"))
+		s.Publish("rsa", "ec")
+		_, err = v.ValidateToken(ctx, s.Sign(t, "other", nil))
+		assert.ErrorIs(t, err, ErrKeyNotFound)
+	})
+
+	t.Run("Key rotation", func(t *testing.T) {
+		v, err := NewVerifier(testProvider(s))
+		require.NoError(t, err)
+		_, err = v.ValidateToken(context.Background(), s.Sign(t, "rsa", nil))
+		require.NoError(t, err)
+
+		s.AddKey(authtest.NewRSAKey(t, "rotated"))
+		defer s.Publish("rsa", "ec")
+		token := s.Sign(t, "rotated", nil)
+
+		// unknown keys are fetched again at most every minKeysRefresh
+		_, err = v.ValidateToken(context.Background(), token)
+		assert.ErrorIs(t, err, ErrKeyNotFound)
+		v.fetchedAt = v.fetchedAt.Add(-minKeysRefresh)
+		_, err = v.ValidateToken(context.Background(), token)
+		assert.NoError(t, err)
+	})
+
+	t.Run("Concurrent fetches", func(t *testing.T) {
+		s := newTestIssuer(t)
+		v, err := NewVerifier(testProvider(s))
+		require.NoError(t, err)
+		token := s.Sign(t, "rsa", nil)
+
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, err := v.ValidateToken(context.Background(), token)
+				assert.NoError(t, err)
+			}()
+		}
+		wg.Wait()
+		assert.Equal(t, 1, s.JWKSFetches(), "the callers share the fetch")
+	})
+
+	t.Run("JWKS URL", func(t *testing.T) {
+		p := testProvider(s)
+		p.JWKSURL = s.JWKSURL()
+		p.Issuer = "https://dex.replaceme.com/"
+		v, err := NewVerifier(p)
+		require.NoError(t, err)
+
+		_, err = v.ValidateToken(context.Background(), s.Sign(t, "rsa", map[string]interface{}{"iss": p.Issuer}))
+		assert.NoError(t, err, "the discovery document is not needed")
+	})
+
+	t.Run("Discovery of another issuer", func(t *testing.T) {
+		p := testProvider(s)
+		p.Issuer = s.URL + "/realms/replaceme"
+		v, err := NewVerifier(p)
+		require.NoError(t, err)
+
+		_, err = v.ValidateToken(context.Background(), s.Sign(t, "rsa", map[string]interface{}{"iss": p.Issuer}))
+		assert.ErrorContains(t, err, "is for issuer")
+	})
+}
+
+func TestVerifier_ClaimMapping(t *testing.T) {
+	s := newTestIssuer(t)
+	tests := []struct {
+		name    string
+		mapping ClaimMapping
+		claims  map[string]interface{}
+		userID  string
+		email   string
+		roles   []string
+	}{
+		{
+			name:    "Auth0",
+			mapping: ClaimMapping{Email: "https://replaceme.com/email", Roles: "https://replaceme.com/roles"},
+			claims: map[string]interface{}{
+				"https://replaceme.com/email": "jane.doe@replaceme.com",
+				"https://replaceme.com/roles": []string{"admin", "editor"},
+			},
+			userID: "user-1",
+			email:  "jane.doe@replaceme.com",
+			roles:  []string{"admin", "editor"},
+		},
+		{
+			name:    "Keycloak",
+			mapping: ClaimMapping{Subject: "preferred_username", Email: "email", Roles: "realm_access.roles"},
+			claims: map[string]interface{}{
+				"preferred_username": "jane",
+				"email":              "jane.doe@replaceme.com",
+				"email_verified":     true,
+				"realm_access":       map[string]interface{}{"roles": []string{"offline_access", "admin"}},
+			},
+			userID: "jane",
+			email:  "jane.doe@replaceme.com",
+			roles:  []string{"offline_access", "admin"},
+		},
+		{
+			name:    "Okta",
+			mapping: ClaimMapping{Email: "email", Roles: "groups"},
+			claims:  map[string]interface{}{"email": "jane.doe@replaceme.com", "groups": []string{"Everyone"}},
+			userID:  "user-1",
+			email:   "jane.doe@replaceme.com",
+			roles:   []string{"Everyone"},
+		},
+		{
+			name:    "Space separated roles",
+			mapping: ClaimMapping{Roles: "roles"},
+			claims:  map[string]interface{}{"roles": "admin editor"},
+			userID:  "user-1",
+			roles:   []string{"admin", "editor"},
+		},
+		{
+			name:    "Missing claims",
+			mapping: ClaimMapping{Email: "email", Roles: "groups"},
+			userID:  "user-1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := testProvider(s)
+			p.Claims = tt.mapping
+			v, err := NewVerifier(p)
+			require.NoError(t, err)
+
+			got, err := v.ValidateToken(context.Background(), s.Sign(t, "rsa", tt.claims))
+			require.NoError(t, err)
+			claims := got.(*validator.ValidatedClaims).CustomClaims.(*CustomClaims)
+			userID, err := claims.GetUserID()
+			assert.NoError(t, err)
+			assert.Equal(t, tt.userID, userID)
+			email, _ := claims.GetUserEmail()
+			assert.Equal(t, tt.email, email)
+			assert.Equal(t, tt.roles, claims.GetRoles())
+		})
+	}
+
+	t.Run("Missing subject", func(t *testing.T) {
+		p := testProvider(s)
+		p.Claims = ClaimMapping{Subject: "preferred_username"}
+		v, err := NewVerifier(p)
+		require.NoError(t, err)
+
+		_, err = v.ValidateToken(context.Background(), s.Sign(t, "rsa", nil))
+		assert.EqualError(t, err, "failed to validate token claims: no user ID found in claims")
+	})
+
+	t.Run("Email of another type", func(t *testing.T) {
+		p := testProvider(s)
+		p.Claims = ClaimMapping{Email: "mail"}
+		v, err := NewVerifier(p)
+		require.NoError(t, err)
+
+		_, err = v.ValidateToken(context.Background(), s.Sign(t, "rsa", map[string]interface{}{"mail": []string{"jane"}}))
+		assert.ErrorContains(t, err, "email '[jane]' from claims has unexpected type")
+	})
+}
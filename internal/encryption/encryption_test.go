@@ -0,0 +1,57 @@
+package encryption
+
+import (
+	"encoding/base64"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCipher(t *testing.T) {
+	key, err := GenerateKey()
+	require.NoError(t, err)
+	c, err := New(key)
+	require.NoError(t, err)
+
+	ciphertext, err := c.Encrypt([]byte("JBSWY3DPEHPK3PXP"))
+	require.NoError(t, err)
+	again, err := c.Encrypt([]byte("JBSWY3DPEHPK3PXP"))
+	require.NoError(t, err)
+	assert.NotEqual(t, ciphertext, again, "nonces are random")
+
+	plaintext, err := c.Decrypt(ciphertext)
+	require.NoError(t, err)
+	assert.Equal(t, "JBSWY3DPEHPK3PXP", string(plaintext))
+
+	other, err := GenerateKey()
+	require.NoError(t, err)
+	oc, err := New(other)
+	require.NoError(t, err)
+	_, err = oc.Decrypt(ciphertext)
+	assert.ErrorIs(t, err, ErrDecrypt)
+
+	b, _ := base64.StdEncoding.DecodeString(ciphertext)
+	b[len(b)-1] ^= 1
+	_, err = c.Decrypt(base64.StdEncoding.EncodeToString(b))
+	assert.ErrorIs(t, err, ErrDecrypt)
+
+	_, err = c.Decrypt("bm9uY2U=")
+	assert.ErrorIs(t, err, ErrDecrypt)
+}
+
+func TestParseKey(t *testing.T) {
+	key, err := GenerateKey()
+	require.NoError(t, err)
+
+	parsed, err := ParseKey(base64.StdEncoding.EncodeToString(key))
+	require.NoError(t, err)
+	assert.Equal(t, key, parsed)
+
+	_, err = ParseKey(base64.StdEncoding.EncodeToString(key[:16]))
+	assert.Error(t, err)
+	_, err = ParseKey("not base64!")
+	assert.Error(t, err)
+	_, err = New(key[:16])
+	assert.Error(t, err)
+}
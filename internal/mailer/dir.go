@@ -0,0 +1,55 @@
+package mailer
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// Dir is a Mailer writing the emails as .eml files to a directory instead of sending them, for development.
+// The files open in any mail client.
+type Dir struct {
+	from *mail.Address
+	dir  string
+
+	logger zerolog.Logger
+}
+
+// NewDir creates a Dir mailer, the directory is created if missing
+func NewDir(from *mail.Address, dir string) (*Dir, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	d := &Dir{from: from, dir: dir, logger: log.With().Str("component", "mailer").Logger()}
+	d.logger.Warn().Str("dir", dir).Msg("emails are written to a directory and not sent")
+
+	return d, nil
+}
+
+// Send writes the email to a new file named after the time it was sent
+func (d *Dir) Send(ctx context.Context, m Message) error {
+	now := time.Now()
+	msg, err := encode(d.from, m, now)
+	if err != nil {
+		return err
+	}
+
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return err
+	}
+	name := filepath.Join(d.dir, now.UTC().Format("20060102T150405.000000000")+"-"+hex.EncodeToString(suffix)+".eml")
+	if err := os.WriteFile(name, msg, 0o600); err != nil {
+		return err
+	}
+	d.logger.Info().Str("to", m.To).Str("subject", m.Subject).Str("file", name).Msg("email written")
+
+	return nil
+}
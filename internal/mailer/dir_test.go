@@ -0,0 +1,31 @@
+package mailer
+
+import (
+	"context"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDir_Send(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "mail")
+	d, err := NewDir(&mail.Address{Address: "no-reply@replaceme.com"}, dir)
+	require.NoError(t, err)
+
+	require.NoError(t, d.Send(context.Background(), Message{To: "jane.doe@replaceme.com", Subject: "Hello", Text: "Hello Jane"}))
+	require.NoError(t, d.Send(context.Background(), Message{To: "john.doe@replaceme.com", Subject: "Hello", Text: "Hello John"}))
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.eml"))
+	require.NoError(t, err)
+	require.Len(t, files, 2)
+	f, err := os.Open(files[0])
+	require.NoError(t, err)
+	defer f.Close()
+	m, err := mail.ReadMessage(f)
+	require.NoError(t, err)
+	assert.Equal(t, "Hello", m.Header.Get("Subject"))
+}
@@ -0,0 +1,101 @@
+// Package mailer sends the emails of the service through a pluggable Mailer: SMTP, a directory of .eml files
+// for development, the log, or a redis queue sending them in the background.
+package mailer
+
+import (
+	"context"
+	"fmt"
+	"net/mail"
+	"sync"
+
+	"github.com/efimovalex/replaceme/config"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// Drivers of the emails
+const (
+	DriverSMTP = "smtp"
+	DriverDir  = "dir"
+	DriverLog  = "log"
+)
+
+// Message is an email to a single recipient, HTML is optional
+type Message struct {
+	To      string `json:"to"`
+	Subject string `json:"subject"`
+	Text    string `json:"text"`
+	HTML    string `json:"html,omitempty"`
+}
+
+// Mailer sends emails
+type Mailer interface {
+	Send(ctx context.Context, m Message) error
+}
+
+// New creates the Mailer of the configured driver
+func New(cfg config.Mailer) (Mailer, error) {
+	from, err := mail.ParseAddress(cfg.From)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sender address %q: %w", cfg.From, err)
+	}
+
+	switch cfg.Driver {
+	case DriverSMTP:
+		return NewSMTP(from, cfg.SMTP)
+	case DriverDir:
+		return NewDir(from, cfg.Dir)
+	case DriverLog:
+		return NewLog(), nil
+	default:
+		return nil, fmt.Errorf("unknown mailer driver %q", cfg.Driver)
+	}
+}
+
+// Log is a Mailer writing the emails to the log instead of sending them, for development
+type Log struct {
+	logger zerolog.Logger
+}
+
+// NewLog creates a Log mailer
+func NewLog() *Log {
+	l := &Log{logger: log.With().Str("component", "mailer").Logger()}
+	l.logger.Warn().Msg("no mailer configured, emails are written to the log")
+
+	return l
+}
+
+// Send logs the email
+func (l *Log) Send(ctx context.Context, m Message) error {
+	l.logger.Info().Str("to", m.To).Str("subject", m.Subject).Msg(m.Text)
+
+	return nil
+}
+
+// Fake is an in-memory Mailer for tests, it records the emails and fails with Err when set
+type Fake struct {
+	Err error
+
+	mu       sync.Mutex
+	messages []Message
+}
+
+// Send records the email
+func (f *Fake) Send(ctx context.Context, m Message) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.Err != nil {
+		return f.Err
+	}
+	f.messages = append(f.messages, m)
+
+	return nil
+}
+
+// Messages returns the recorded emails, oldest first
+func (f *Fake) Messages() []Message {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return append([]Message(nil), f.messages...)
+}
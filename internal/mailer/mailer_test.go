@@ -0,0 +1,19 @@
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLog_Send(t *testing.T) {
+	var buf bytes.Buffer
+	l := &Log{logger: zerolog.New(&buf)}
+
+	err := l.Send(context.Background(), Message{To: "jane.doe@replaceme.com", Subject: "Hello", Text: "Hello Jane"})
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"level":"info","to":"jane.doe@replaceme.com","subject":"Hello","message":"Hello Jane"}`, buf.String())
+}
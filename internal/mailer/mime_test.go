@@ -0,0 +1,75 @@
+package mailer
+
+import (
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncode(t *testing.T) {
+	from := &mail.Address{Name: "Replaceme", Address: "no-reply@replaceme.com"}
+	date := time.Date(2022, 8, 1, 10, 0, 0, 0, time.UTC)
+
+	t.Run("text only", func(t *testing.T) {
+		b, err := encode(from, Message{To: "jane.doe@replaceme.com", Subject: "Hello", Text: "Hello Jane,\nbye"}, date)
+		require.NoError(t, err)
+
+		m, err := mail.ReadMessage(strings.NewReader(string(b)))
+		require.NoError(t, err)
+		assert.Equal(t, "Hello", m.Header.Get("Subject"))
+		assert.Equal(t, "Mon, 01 Aug 2022 10:00:00 +0000", m.Header.Get("Date"))
+		assert.Regexp(t, `^<[0-9a-f]{32}@replaceme\.com>$`, m.Header.Get("Message-ID"))
+		assert.Equal(t, "text/plain; charset=utf-8", m.Header.Get("Content-Type"))
+		body, err := io.ReadAll(quotedprintable.NewReader(m.Body))
+		require.NoError(t, err)
+		assert.Equal(t, "Hello Jane,\r\nbye", string(body))
+	})
+
+	t.Run("text and html", func(t *testing.T) {
+		b, err := encode(from, Message{To: "jane.doe@replaceme.com", Subject: "Hello", Text: "Hello Jane", HTML: "<p>Hello Jane</p>"}, date)
+		require.NoError(t, err)
+
+		m, err := mail.ReadMessage(strings.NewReader(string(b)))
+		require.NoError(t, err)
+		mediaType, params, err := mime.ParseMediaType(m.Header.Get("Content-Type"))
+		require.NoError(t, err)
+		assert.Equal(t, "multipart/alternative", mediaType)
+		r := multipart.NewReader(m.Body, params["boundary"])
+		for _, expected := range []struct{ contentType, body string }{
+			{"text/plain; charset=utf-8", "Hello Jane"},
+			{"text/html; charset=utf-8", "<p>Hello Jane</p>"},
+		} {
+			p, err := r.NextPart()
+			require.NoError(t, err)
+			assert.Equal(t, expected.contentType, p.Header.Get("Content-Type"))
+			// multipart.Reader decodes quoted-printable parts
+			body, err := io.ReadAll(p)
+			require.NoError(t, err)
+			assert.Equal(t, expected.body, string(body))
+		}
+		_, err = r.NextPart()
+		assert.Equal(t, io.EOF, err)
+	})
+
+	t.Run("header injection", func(t *testing.T) {
+		b, err := encode(from, Message{To: "jane.doe@replaceme.com", Subject: "Hello\r\nBcc: john.doe@replaceme.com", Text: "Hello"}, date)
+		require.NoError(t, err)
+
+		m, err := mail.ReadMessage(strings.NewReader(string(b)))
+		require.NoError(t, err)
+		assert.Empty(t, m.Header.Get("Bcc"))
+	})
+
+	t.Run("invalid recipient", func(t *testing.T) {
+		_, err := encode(from, Message{To: "jane.doe", Subject: "Hello", Text: "Hello"}, date)
+		assert.Error(t, err)
+	})
+}
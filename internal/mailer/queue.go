@@ -0,0 +1,240 @@
+package mailer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/efimovalex/replaceme/adapters/redisdb"
+	"github.com/efimovalex/replaceme/config"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// queueName is the name of the queue of the emails to send
+const queueName = "mail"
+
+const (
+	// pollTimeout bounds how long a worker waits for an email, and so how long it takes to stop
+	pollTimeout = time.Second
+	// consumerLease is how long a consumer is deemed alive after it last polled the queue, it must exceed the time to
+	// send an email. The emails of the consumers whose lease expired are reclaimed by the other workers.
+	consumerLease = 5 * time.Minute
+)
+
+// JobQueue is the interface for the queue the emails wait in to be sent
+type JobQueue interface {
+	EnqueueJob(ctx context.Context, queue string, payload []byte) error
+	DequeueJob(ctx context.Context, queue, consumer string, timeout time.Duration) (*redisdb.Job, error)
+	AckJob(ctx context.Context, queue, consumer string, job *redisdb.Job) error
+	RetryJob(ctx context.Context, queue, consumer string, job *redisdb.Job, delay time.Duration) error
+	BuryJob(ctx context.Context, queue, consumer string, job *redisdb.Job, ttl time.Duration) error
+	RequeueJobs(ctx context.Context, queue, consumer string) (int, error)
+	TouchJobConsumer(ctx context.Context, queue, consumer string, ttl time.Duration) error
+	ReclaimJobs(ctx context.Context, queue string) (int, error)
+}
+
+// Queue is a Mailer enqueueing the emails, a Worker sends them in the background
+type Queue struct {
+	jobs JobQueue
+}
+
+// NewQueue creates a Queue mailer
+func NewQueue(jobs JobQueue) *Queue {
+	return &Queue{jobs: jobs}
+}
+
+// Send enqueues the email
+func (q *Queue) Send(ctx context.Context, m Message) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	return q.jobs.EnqueueJob(ctx, queueName, b)
+}
+
+// Worker sends the queued emails through a transport, e.g. SMTP. Failed emails are retried with an exponential
+// backoff, and moved to the dead emails of the queue after the configured attempts. The emails left in processing by
+// a worker which is gone are sent by the others.
+type Worker struct {
+	jobs      JobQueue
+	transport Mailer
+	cfg       config.MailQueue
+	// consumer prefixes the names of the processing lists, it must be stable across restarts
+	consumer string
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+
+	logger zerolog.Logger
+}
+
+// NewWorker creates a Worker, its consumer is the configured one or the hostname
+func NewWorker(jobs JobQueue, transport Mailer, cfg config.MailQueue) *Worker {
+	consumer := cfg.Consumer
+	if consumer == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			hostname = "mailer"
+		}
+		consumer = hostname
+	}
+
+	return &Worker{
+		jobs:      jobs,
+		transport: transport,
+		cfg:       cfg,
+		consumer:  consumer,
+		stop:      make(chan struct{}),
+		logger:    log.With().Str("component", "mailer-worker").Logger(),
+	}
+}
+
+// Start sends the queued emails until the context is done or the worker is stopped.
+// The emails a previous run left in processing are queued again first.
+func (w *Worker) Start(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-w.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	workers := w.cfg.Workers
+	if workers < 1 {
+		workers = 1
+	}
+
+	for i := 0; i < workers; i++ {
+		consumer := fmt.Sprintf("%s-%d", w.consumer, i)
+		n, err := w.jobs.RequeueJobs(ctx, queueName, consumer)
+		if err != nil {
+			return fmt.Errorf("failed to requeue the emails left in processing: %w", err)
+		}
+		if n > 0 {
+			w.logger.Warn().Int("count", n).Str("consumer", consumer).Msg("requeued emails left in processing")
+		}
+
+		w.wg.Add(1)
+		go func() {
+			defer w.wg.Done()
+			w.run(ctx, consumer)
+		}()
+	}
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		w.reclaim(ctx)
+	}()
+	w.logger.Info().Int("workers", workers).Str("consumer", w.consumer).Msg("mailer worker started")
+	w.wg.Wait()
+
+	return nil
+}
+
+// Stop stops the worker once the emails being sent are processed
+func (w *Worker) Stop(ctx context.Context) {
+	w.stopOnce.Do(func() { close(w.stop) })
+	w.wg.Wait()
+	w.logger.Info().Msg("mailer worker stopped")
+}
+
+// reclaim queues again the emails left in processing by the consumers which are gone, until the context is done
+func (w *Worker) reclaim(ctx context.Context) {
+	ticker := time.NewTicker(consumerLease)
+	defer ticker.Stop()
+	for {
+		n, err := w.jobs.ReclaimJobs(ctx, queueName)
+		if err != nil && ctx.Err() == nil {
+			w.logger.Error().Err(err).Msg("failed to reclaim the emails of gone consumers")
+		}
+		if n > 0 {
+			w.logger.Warn().Int("count", n).Msg("requeued emails left in processing by gone consumers")
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// run processes the emails of the queue one at a time
+func (w *Worker) run(ctx context.Context, consumer string) {
+	for ctx.Err() == nil {
+		if err := w.jobs.TouchJobConsumer(ctx, queueName, consumer, consumerLease); err != nil && ctx.Err() == nil {
+			w.logger.Error().Err(err).Msg("failed to renew the lease of the consumer")
+		}
+		job, err := w.jobs.DequeueJob(ctx, queueName, consumer, pollTimeout)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			if job == nil {
+				w.logger.Error().Err(err).Msg("failed to dequeue an email")
+				// the queue is likely unavailable, do not spin
+				select {
+				case <-ctx.Done():
+				case <-time.After(pollTimeout):
+				}
+
+				continue
+			}
+		}
+		if job == nil {
+			continue
+		}
+		// the email is sent even if the worker is stopping, it is not left in processing
+		w.process(context.Background(), consumer, job, err)
+	}
+}
+
+// process sends an email, decodeErr is the error decoding the job if any
+func (w *Worker) process(ctx context.Context, consumer string, job *redisdb.Job, decodeErr error) {
+	logger := w.logger.With().Str("job_id", job.ID).Int("attempts", job.Attempts).Logger()
+
+	var m Message
+	if decodeErr == nil {
+		decodeErr = json.Unmarshal(job.Payload, &m)
+	}
+	if decodeErr != nil {
+		logger.Error().Err(decodeErr).Msg("invalid email, it is moved to the dead emails")
+		if err := w.jobs.BuryJob(ctx, queueName, consumer, job, w.cfg.DeadTTL); err != nil {
+			logger.Error().Err(err).Msg("failed to bury an email")
+		}
+
+		return
+	}
+	logger = logger.With().Str("to", m.To).Str("subject", m.Subject).Logger()
+
+	sendErr := w.transport.Send(ctx, m)
+	if sendErr == nil {
+		if err := w.jobs.AckJob(ctx, queueName, consumer, job); err != nil {
+			logger.Error().Err(err).Msg("failed to acknowledge a sent email")
+		}
+
+		return
+	}
+
+	if job.Attempts+1 >= w.cfg.MaxAttempts {
+		logger.Error().Err(sendErr).Msg("failed to send an email, giving up")
+		if err := w.jobs.BuryJob(ctx, queueName, consumer, job, w.cfg.DeadTTL); err != nil {
+			logger.Error().Err(err).Msg("failed to bury an email")
+		}
+
+		return
+	}
+	delay := w.cfg.Backoff << job.Attempts
+	logger.Warn().Err(sendErr).Dur("retry_in", delay).Msg("failed to send an email, retrying")
+	if err := w.jobs.RetryJob(ctx, queueName, consumer, job, delay); err != nil {
+		logger.Error().Err(err).Msg("failed to retry an email")
+	}
+}
@@ -0,0 +1,162 @@
+package mailer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/efimovalex/replaceme/adapters/redisdb"
+	"github.com/efimovalex/replaceme/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// jobQueueMock is an in-memory JobQueue, retries are due immediately
+type jobQueueMock struct {
+	mu      sync.Mutex
+	ready   []*redisdb.Job
+	acked   []*redisdb.Job
+	buried  []*redisdb.Job
+	delays  []time.Duration
+	deadTTL time.Duration
+	touched map[string]bool
+	counter int
+}
+
+func (q *jobQueueMock) EnqueueJob(ctx context.Context, queue string, payload []byte) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.counter++
+	q.ready = append(q.ready, &redisdb.Job{ID: string(rune('0' + q.counter)), Payload: payload})
+
+	return nil
+}
+
+func (q *jobQueueMock) DequeueJob(ctx context.Context, queue, consumer string, timeout time.Duration) (*redisdb.Job, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.ready) == 0 {
+		q.mu.Unlock()
+		select {
+		case <-ctx.Done():
+		case <-time.After(10 * time.Millisecond):
+		}
+		q.mu.Lock()
+
+		return nil, nil
+	}
+	job := q.ready[0]
+	q.ready = q.ready[1:]
+
+	return job, nil
+}
+
+func (q *jobQueueMock) AckJob(ctx context.Context, queue, consumer string, job *redisdb.Job) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.acked = append(q.acked, job)
+
+	return nil
+}
+
+func (q *jobQueueMock) RetryJob(ctx context.Context, queue, consumer string, job *redisdb.Job, delay time.Duration) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	retried := *job
+	retried.Attempts++
+	q.ready = append(q.ready, &retried)
+	q.delays = append(q.delays, delay)
+
+	return nil
+}
+
+func (q *jobQueueMock) BuryJob(ctx context.Context, queue, consumer string, job *redisdb.Job, ttl time.Duration) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.buried = append(q.buried, job)
+	q.deadTTL = ttl
+
+	return nil
+}
+
+func (q *jobQueueMock) RequeueJobs(ctx context.Context, queue, consumer string) (int, error) {
+	return 0, nil
+}
+
+func (q *jobQueueMock) TouchJobConsumer(ctx context.Context, queue, consumer string, ttl time.Duration) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.touched == nil {
+		q.touched = map[string]bool{}
+	}
+	q.touched[consumer] = true
+
+	return nil
+}
+
+func (q *jobQueueMock) ReclaimJobs(ctx context.Context, queue string) (int, error) {
+	return 0, nil
+}
+
+func (q *jobQueueMock) done() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return len(q.acked) + len(q.buried)
+}
+
+// flakyMailer fails the first sends to the recipients of failures
+type flakyMailer struct {
+	Fake
+
+	mu       sync.Mutex
+	failures map[string]int
+}
+
+func (f *flakyMailer) Send(ctx context.Context, m Message) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.failures[m.To] > 0 {
+		f.failures[m.To]--
+		return errors.New("connection refused")
+	}
+
+	return f.Fake.Send(ctx, m)
+}
+
+func TestWorker(t *testing.T) {
+	jobs := &jobQueueMock{}
+	transport := &flakyMailer{failures: map[string]int{"jane.doe@replaceme.com": 1, "john.doe@replaceme.com": 2}}
+	q := NewQueue(jobs)
+	w := NewWorker(jobs, transport, config.MailQueue{Workers: 1, MaxAttempts: 2, Backoff: time.Second, DeadTTL: time.Hour, Consumer: "mailer-a"})
+
+	ctx := context.Background()
+	// sent after a retry
+	require.NoError(t, q.Send(ctx, Message{To: "jane.doe@replaceme.com", Subject: "Hello", Text: "Hello Jane"}))
+	// buried after its 2 attempts
+	require.NoError(t, q.Send(ctx, Message{To: "john.doe@replaceme.com", Subject: "Hello", Text: "Hello John"}))
+	// not an email
+	require.NoError(t, jobs.EnqueueJob(ctx, queueName, []byte(`"hello"`)))
+
+	started := make(chan error)
+	go func() { started <- w.Start(ctx) }()
+	require.Eventually(t, func() bool { return jobs.done() == 3 }, 5*time.Second, 10*time.Millisecond)
+	w.Stop(ctx)
+	require.NoError(t, <-started)
+
+	sent := transport.Messages()
+	require.Len(t, sent, 1)
+	assert.Equal(t, "jane.doe@replaceme.com", sent[0].To)
+	assert.Len(t, jobs.acked, 1)
+	require.Len(t, jobs.buried, 2)
+	assert.JSONEq(t, `"hello"`, string(jobs.buried[0].Payload))
+	var buried Message
+	require.NoError(t, json.Unmarshal(jobs.buried[1].Payload, &buried))
+	assert.Equal(t, "john.doe@replaceme.com", buried.To)
+	assert.Equal(t, []time.Duration{time.Second, time.Second}, jobs.delays, "first retry of each email")
+	assert.Equal(t, time.Hour, jobs.deadTTL)
+	assert.Equal(t, map[string]bool{"mailer-a-0": true}, jobs.touched, "the configured consumer is used")
+}
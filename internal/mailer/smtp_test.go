@@ -0,0 +1,165 @@
+package mailer
+
+import (
+	"bufio"
+	"context"
+	"mime"
+	"net"
+	"net/mail"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/efimovalex/replaceme/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// smtpServer is a local SMTP stand-in recording the commands and the data it receives
+type smtpServer struct {
+	ln net.Listener
+	// extensions are announced in the EHLO response
+	extensions []string
+
+	mu       sync.Mutex
+	commands []string
+	data     string
+}
+
+func newSMTPServer(t *testing.T, extensions ...string) *smtpServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := &smtpServer{ln: ln, extensions: extensions}
+	t.Cleanup(func() { ln.Close() })
+	go s.serve()
+
+	return s
+}
+
+func (s *smtpServer) serve() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *smtpServer) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(lines ...string) {
+		for _, l := range lines {
+			conn.Write([]byte(l + "\r\n"))
+		}
+	}
+	reply("220 localhost ESMTP")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd := strings.TrimRight(line, "\r\n")
+		s.mu.Lock()
+		s.commands = append(s.commands, cmd)
+		s.mu.Unlock()
+
+		switch verb := strings.ToUpper(strings.SplitN(cmd, " ", 2)[0]); verb {
+		case "EHLO":
+			lines := []string{"250-localhost"}
+			for _, e := range s.extensions {
+				lines = append(lines, "250-"+e)
+			}
+			reply(append(lines, "250 8BITMIME")...)
+		case "AUTH":
+			reply("235 authenticated")
+		case "MAIL", "RCPT":
+			reply("250 ok")
+		case "DATA":
+			reply("354 go ahead")
+			var data strings.Builder
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil || l == ".\r\n" {
+					break
+				}
+				data.WriteString(l)
+			}
+			s.mu.Lock()
+			s.data = data.String()
+			s.mu.Unlock()
+			reply("250 queued")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("502 not implemented")
+		}
+	}
+}
+
+func (s *smtpServer) received() ([]string, string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]string(nil), s.commands...), s.data
+}
+
+func (s *smtpServer) config(tlsMode, username string) config.SMTP {
+	host, port, _ := net.SplitHostPort(s.ln.Addr().String())
+
+	return config.SMTP{Host: host, Port: port, Username: username, Password: "secret", TLS: tlsMode, Timeout: 5 * time.Second}
+}
+
+func TestSMTP_Send(t *testing.T) {
+	from := &mail.Address{Name: "Replaceme", Address: "no-reply@replaceme.com"}
+	msg := Message{To: "jane.doe@replaceme.com", Subject: "Héllo", Text: "Hello Jane", HTML: "<p>Hello Jane</p>"}
+
+	t.Run("sends the email", func(t *testing.T) {
+		server := newSMTPServer(t, "AUTH PLAIN")
+		s, err := NewSMTP(from, server.config(SMTPNoTLS, "replaceme"))
+		require.NoError(t, err)
+
+		require.NoError(t, s.Send(context.Background(), msg))
+		commands, data := server.received()
+		require.Len(t, commands, 6)
+		assert.True(t, strings.HasPrefix(commands[0], "EHLO "))
+		assert.True(t, strings.HasPrefix(commands[1], "AUTH PLAIN "))
+		assert.Equal(t, []string{"MAIL FROM:<no-reply@replaceme.com> BODY=8BITMIME", "RCPT TO:<jane.doe@replaceme.com>", "DATA", "QUIT"}, commands[2:])
+
+		parsed, err := mail.ReadMessage(strings.NewReader(data))
+		require.NoError(t, err)
+		assert.Equal(t, `"Replaceme" <no-reply@replaceme.com>`, parsed.Header.Get("From"))
+		assert.Equal(t, "<jane.doe@replaceme.com>", parsed.Header.Get("To"))
+		subject, err := new(mime.WordDecoder).DecodeHeader(parsed.Header.Get("Subject"))
+		require.NoError(t, err)
+		assert.Equal(t, "Héllo", subject)
+		assert.Contains(t, parsed.Header.Get("Content-Type"), "multipart/alternative")
+	})
+
+	t.Run("requires STARTTLS", func(t *testing.T) {
+		server := newSMTPServer(t)
+		s, err := NewSMTP(from, server.config(SMTPStartTLS, ""))
+		require.NoError(t, err)
+
+		err = s.Send(context.Background(), msg)
+		assert.EqualError(t, err, "SMTP server does not support STARTTLS")
+	})
+
+	t.Run("unreachable server", func(t *testing.T) {
+		server := newSMTPServer(t)
+		cfg := server.config(SMTPNoTLS, "")
+		server.ln.Close()
+		s, err := NewSMTP(from, cfg)
+		require.NoError(t, err)
+
+		assert.Error(t, s.Send(context.Background(), msg))
+	})
+
+	t.Run("invalid TLS mode", func(t *testing.T) {
+		_, err := NewSMTP(from, config.SMTP{Host: "localhost", TLS: "ssl"})
+		assert.EqualError(t, err, `invalid SMTP TLS mode "ssl", expected starttls, tls or none`)
+	})
+}
@@ -0,0 +1,203 @@
+package mailer
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	htmltemplate "html/template"
+	"io/fs"
+	"path"
+	"strconv"
+	"strings"
+	texttemplate "text/template"
+	"time"
+
+	"golang.org/x/text/language"
+)
+
+// Names of the email templates
+const (
+	TemplatePasswordReset     = "password_reset"
+	TemplateEmailVerification = "email_verification"
+	TemplateMagicLink         = "magic_link"
+)
+
+// DefaultLanguage is the language of the emails when the recipient's is not available
+var DefaultLanguage = language.English
+
+//go:embed templates
+var templatesFS embed.FS
+
+var defaultTemplates = mustParseTemplates(templatesFS, "templates")
+
+// LinkData is the data of the templates of the emails carrying a link, e.g. a password reset
+type LinkData struct {
+	Name     string
+	Link     string
+	ValidFor time.Duration
+}
+
+// Templates renders emails from templates in several languages.
+// A template is a <name>.<lang>.txt text template defining the "subject" template, the rest is the text body,
+// with an optional <name>.<lang>.html HTML body.
+type Templates struct {
+	text map[string]*texttemplate.Template
+	html map[string]*htmltemplate.Template
+
+	languages []language.Tag
+	matcher   language.Matcher
+}
+
+// ParseTemplates parses the templates of the dir of fsys
+func ParseTemplates(fsys fs.FS, dir string) (*Templates, error) {
+	t := &Templates{
+		text: map[string]*texttemplate.Template{},
+		html: map[string]*htmltemplate.Template{},
+		// the default language comes first, it is the matcher fallback
+		languages: []language.Tag{DefaultLanguage},
+	}
+
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		parts := strings.Split(e.Name(), ".")
+		if e.IsDir() || len(parts) != 3 {
+			continue
+		}
+		name, ext := parts[0], parts[2]
+		lang, err := language.Parse(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("template %s: %w", e.Name(), err)
+		}
+		b, err := fs.ReadFile(fsys, path.Join(dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		funcs := map[string]interface{}{"duration": durationFunc(lang)}
+		key := templateKey(name, lang)
+		switch ext {
+		case "txt":
+			tmpl, err := texttemplate.New(e.Name()).Funcs(funcs).Parse(string(b))
+			if err != nil {
+				return nil, err
+			}
+			if tmpl.Lookup("subject") == nil {
+				return nil, fmt.Errorf("template %s does not define a subject", e.Name())
+			}
+			t.text[key] = tmpl
+		case "html":
+			tmpl, err := htmltemplate.New(e.Name()).Funcs(funcs).Parse(string(b))
+			if err != nil {
+				return nil, err
+			}
+			t.html[key] = tmpl
+		default:
+			continue
+		}
+		if !t.hasLanguage(lang) {
+			t.languages = append(t.languages, lang)
+		}
+	}
+	t.matcher = language.NewMatcher(t.languages)
+
+	return t, nil
+}
+
+// Render renders the email template name in the language best matching accept, an Accept-Language header
+// value, and falls back to DefaultLanguage. The recipient of the returned message is left to the caller.
+func (t *Templates) Render(name, accept string, data interface{}) (Message, error) {
+	lang := DefaultLanguage
+	if tags, _, err := language.ParseAcceptLanguage(accept); err == nil && len(tags) > 0 {
+		_, i, _ := t.matcher.Match(tags...)
+		lang = t.languages[i]
+	}
+	text, ok := t.text[templateKey(name, lang)]
+	if !ok {
+		lang = DefaultLanguage
+		if text, ok = t.text[templateKey(name, lang)]; !ok {
+			return Message{}, fmt.Errorf("unknown email template %q", name)
+		}
+	}
+
+	var m Message
+	var buf bytes.Buffer
+	if err := text.ExecuteTemplate(&buf, "subject", data); err != nil {
+		return Message{}, err
+	}
+	m.Subject = strings.TrimSpace(buf.String())
+	buf.Reset()
+	if err := text.Execute(&buf, data); err != nil {
+		return Message{}, err
+	}
+	m.Text = buf.String()
+	if html, ok := t.html[templateKey(name, lang)]; ok {
+		buf.Reset()
+		if err := html.Execute(&buf, data); err != nil {
+			return Message{}, err
+		}
+		m.HTML = buf.String()
+	}
+
+	return m, nil
+}
+
+// Render renders an embedded email template, see Templates.Render
+func Render(name, accept string, data interface{}) (Message, error) {
+	return defaultTemplates.Render(name, accept, data)
+}
+
+func (t *Templates) hasLanguage(lang language.Tag) bool {
+	for _, l := range t.languages {
+		if l == lang {
+			return true
+		}
+	}
+
+	return false
+}
+
+func templateKey(name string, lang language.Tag) string {
+	return name + "." + lang.String()
+}
+
+func mustParseTemplates(fsys fs.FS, dir string) *Templates {
+	t, err := ParseTemplates(fsys, dir)
+	if err != nil {
+		panic(err)
+	}
+
+	return t
+}
+
+// durationUnits are the singular and plural names of days, hours and minutes per language
+var durationUnits = map[language.Tag][3][2]string{
+	language.English: {{"day", "days"}, {"hour", "hours"}, {"minute", "minutes"}},
+	language.German:  {{"Tag", "Tage"}, {"Stunde", "Stunden"}, {"Minute", "Minuten"}},
+}
+
+// durationFunc formats durations in the largest unit they are a whole number of, e.g. 2 days or 90 minutes
+func durationFunc(lang language.Tag) func(d time.Duration) string {
+	units, ok := durationUnits[lang]
+	if !ok {
+		units = durationUnits[language.English]
+	}
+
+	return func(d time.Duration) string {
+		i, unit := 2, time.Minute
+		if d >= 24*time.Hour && d%(24*time.Hour) == 0 {
+			i, unit = 0, 24*time.Hour
+		} else if d >= time.Hour && d%time.Hour == 0 {
+			i, unit = 1, time.Hour
+		}
+		n := int64(d / unit)
+		name := units[i][1]
+		if n == 1 {
+			name = units[i][0]
+		}
+
+		return strconv.FormatInt(n, 10) + " " + name
+	}
+}
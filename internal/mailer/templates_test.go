@@ -0,0 +1,80 @@
+package mailer
+
+import (
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/text/language"
+)
+
+func TestRender(t *testing.T) {
+	data := LinkData{Name: "Jane", Link: "https://replaceme.com/reset-password?token=abc", ValidFor: time.Hour}
+
+	tests := []struct {
+		name    string
+		accept  string
+		subject string
+		text    string
+	}{
+		{"default language", "", "Reset your password", "within 1 hour"},
+		{"english", "en-US,en;q=0.9", "Reset your password", "within 1 hour"},
+		{"german", "de-AT,de;q=0.9,en;q=0.5", "Passwort zurücksetzen", "innerhalb von 1 Stunde"},
+		{"unsupported language", "fr-FR", "Reset your password", "within 1 hour"},
+		{"invalid header", "\x00", "Reset your password", "within 1 hour"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := Render(TemplatePasswordReset, tt.accept, data)
+			require.NoError(t, err)
+			assert.Equal(t, tt.subject, m.Subject)
+			assert.Contains(t, m.Text, tt.text)
+			assert.Contains(t, m.Text, data.Link)
+			assert.Contains(t, m.HTML, `<a href="https://replaceme.com/reset-password?token=abc">`)
+		})
+	}
+
+	m, err := Render(TemplateMagicLink, "de", data)
+	require.NoError(t, err)
+	assert.Equal(t, "Ihr Anmeldelink", m.Subject)
+	assert.Contains(t, m.Text, "innerhalb von 1 Stunde")
+
+	_, err = Render("unknown", "", data)
+	assert.EqualError(t, err, `unknown email template "unknown"`)
+}
+
+func TestTemplates_Render(t *testing.T) {
+	templates, err := ParseTemplates(fstest.MapFS{
+		"t/greeting.en.txt":  {Data: []byte(`{{define "subject"}}Hi{{end -}}Hello {{.}}`)},
+		"t/greeting.de.txt":  {Data: []byte(`{{define "subject"}}Hallo{{end -}}Hallo {{.}}`)},
+		"t/greeting.en.html": {Data: []byte(`<p>Hello {{.}}</p>`)},
+		"t/farewell.en.txt":  {Data: []byte(`{{define "subject"}}Bye{{end -}}Bye {{.}}`)},
+	}, "t")
+	require.NoError(t, err)
+
+	m, err := templates.Render("greeting", "de", "<Jane>")
+	require.NoError(t, err)
+	assert.Equal(t, Message{Subject: "Hallo", Text: "Hallo <Jane>"}, m, "the html body is not in german")
+
+	m, err = templates.Render("greeting", "en", "<Jane>")
+	require.NoError(t, err)
+	assert.Equal(t, Message{Subject: "Hi", Text: "Hello <Jane>", HTML: "<p>Hello &lt;Jane&gt;</p>"}, m)
+
+	m, err = templates.Render("farewell", "de", "Jane")
+	require.NoError(t, err)
+	assert.Equal(t, Message{Subject: "Bye", Text: "Bye Jane"}, m, "falls back to the default language")
+
+	_, err = ParseTemplates(fstest.MapFS{"t/greeting.en.txt": {Data: []byte(`Hello`)}}, "t")
+	assert.EqualError(t, err, "template greeting.en.txt does not define a subject")
+}
+
+func TestDurationFunc(t *testing.T) {
+	en, de := durationFunc(DefaultLanguage), durationFunc(language.German)
+	assert.Equal(t, "1 hour", en(time.Hour))
+	assert.Equal(t, "2 days", en(48*time.Hour))
+	assert.Equal(t, "90 minutes", en(90*time.Minute))
+	assert.Equal(t, "1 Tag", de(24*time.Hour))
+	assert.Equal(t, "30 Minuten", de(30*time.Minute))
+}
@@ -0,0 +1,141 @@
+// Package requestid carries the request id and the W3C trace context of a request through context.Context
+package requestid
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+
+	"github.com/rs/zerolog"
+)
+
+const (
+	// HeaderTraceParent is the W3C trace context header
+	HeaderTraceParent = "traceparent"
+
+	// maxIDLength is the maximum length accepted for a client provided request id
+	maxIDLength = 128
+)
+
+type ctxKey string
+
+var (
+	ctxKeyID          = ctxKey("request-id")
+	ctxKeyTraceParent = ctxKey("trace-parent")
+
+	idRegexp          = regexp.MustCompile(`^[A-Za-z0-9\-_.:]+$`)
+	traceParentRegexp = regexp.MustCompile(`^([0-9a-f]{2})-([0-9a-f]{32})-([0-9a-f]{16})-([0-9a-f]{2})$`)
+)
+
+// TraceParent is a W3C trace context traceparent, see https://www.w3.org/TR/trace-context/#traceparent-header
+type TraceParent struct {
+	Version  string
+	TraceID  string
+	ParentID string
+	Flags    string
+}
+
+// String returns the traceparent header value
+func (tp TraceParent) String() string {
+	return fmt.Sprintf("%s-%s-%s-%s", tp.Version, tp.TraceID, tp.ParentID, tp.Flags)
+}
+
+// Child returns a traceparent of the same trace with a new parent id, used for the spans started by this service
+func (tp TraceParent) Child() TraceParent {
+	tp.ParentID = randomHex(8)
+
+	return tp
+}
+
+// NewTraceParent starts a new sampled trace
+func NewTraceParent() TraceParent {
+	return TraceParent{
+		Version:  "00",
+		TraceID:  randomHex(16),
+		ParentID: randomHex(8),
+		Flags:    "01",
+	}
+}
+
+// ParseTraceParent parses a traceparent header value
+func ParseTraceParent(s string) (TraceParent, error) {
+	m := traceParentRegexp.FindStringSubmatch(s)
+	if m == nil {
+		return TraceParent{}, fmt.Errorf("invalid traceparent %q", s)
+	}
+
+	tp := TraceParent{Version: m[1], TraceID: m[2], ParentID: m[3], Flags: m[4]}
+	if tp.Version == "ff" || tp.TraceID == "00000000000000000000000000000000" || tp.ParentID == "0000000000000000" {
+		return TraceParent{}, fmt.Errorf("invalid traceparent %q", s)
+	}
+
+	return tp, nil
+}
+
+// New generates a new request id
+func New() string {
+	return randomHex(16)
+}
+
+// Valid reports whether a client provided request id can be trusted to be logged and echoed back
+func Valid(id string) bool {
+	return len(id) <= maxIDLength && idRegexp.MatchString(id)
+}
+
+// WithID sets the request id in the context.
+func WithID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, ctxKeyID, id)
+}
+
+// IDValue retrieves the request id from the context.
+func IDValue(ctx context.Context) (string, error) {
+	id, ok := ctx.Value(ctxKeyID).(string)
+	if !ok {
+		return "", fmt.Errorf("no request ID found in context")
+	}
+	return id, nil
+}
+
+// WithTraceParent sets the traceparent in the context.
+func WithTraceParent(ctx context.Context, tp TraceParent) context.Context {
+	return context.WithValue(ctx, ctxKeyTraceParent, tp)
+}
+
+// TraceParentValue retrieves the traceparent from the context.
+func TraceParentValue(ctx context.Context) (TraceParent, error) {
+	tp, ok := ctx.Value(ctxKeyTraceParent).(TraceParent)
+	if !ok {
+		return TraceParent{}, fmt.Errorf("no traceparent found in context")
+	}
+	return tp, nil
+}
+
+// Logger returns l enriched with the request id and trace id found in the context.
+func Logger(ctx context.Context, l zerolog.Logger) *zerolog.Logger {
+	if ctx == nil {
+		return &l
+	}
+
+	lc := l.With()
+	if id, err := IDValue(ctx); err == nil {
+		lc = lc.Str("request_id", id)
+	}
+	if tp, err := TraceParentValue(ctx); err == nil {
+		lc = lc.Str("trace_id", tp.TraceID).Str("span_id", tp.ParentID)
+	}
+	l = lc.Logger()
+
+	return &l
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	// crypto/rand only fails if the OS random source is unavailable
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,111 @@
+package requestid
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTraceParent(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    TraceParent
+		wantErr bool
+	}{
+		{
+			name:  "valid",
+			value: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+			want:  TraceParent{Version: "00", TraceID: "4bf92f3577b34da6a3ce929d0e0e4736", ParentID: "00f067aa0ba902b7", Flags: "01"},
+		},
+		{
+			name:    "empty",
+			value:   "",
+			wantErr: true,
+		},
+		{
+			name:    "upper case",
+			value:   "00-4BF92F3577B34DA6A3CE929D0E0E4736-00F067AA0BA902B7-01",
+			wantErr: true,
+		},
+		{
+			name:    "zero trace id",
+			value:   "00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+			wantErr: true,
+		},
+		{
+			name:    "forbidden version",
+			value:   "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseTraceParent(tt.value)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+			assert.Equal(t, tt.value, got.String())
+		})
+	}
+}
+
+func TestTraceParent_Child(t *testing.T) {
+	tp := NewTraceParent()
+	_, err := ParseTraceParent(tp.String())
+	require.NoError(t, err)
+
+	child := tp.Child()
+	assert.Equal(t, tp.TraceID, child.TraceID)
+	assert.NotEqual(t, tp.ParentID, child.ParentID)
+}
+
+func TestValid(t *testing.T) {
+	assert.True(t, Valid(New()))
+	assert.True(t, Valid("b7f1c2d0-5a5e-4c6b-9d2e-0a1b2c3d4e5f"))
+	assert.False(t, Valid(""))
+	assert.False(t, Valid("id with spaces"))
+	assert.False(t, Valid("id\nnewline"))
+	assert.False(t, Valid(strings.Repeat("a", maxIDLength+1)))
+}
+
+func TestContext(t *testing.T) {
+	ctx := context.Background()
+	_, err := IDValue(ctx)
+	require.EqualError(t, err, "no request ID found in context")
+	_, err = TraceParentValue(ctx)
+	require.EqualError(t, err, "no traceparent found in context")
+
+	tp := NewTraceParent()
+	ctx = WithTraceParent(WithID(ctx, "some-request-id"), tp)
+
+	id, err := IDValue(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "some-request-id", id)
+
+	got, err := TraceParentValue(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, tp, got)
+}
+
+func TestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	base := zerolog.New(&buf)
+
+	Logger(context.Background(), base).Info().Msg("no ids")
+	assert.Equal(t, `{"level":"info","message":"no ids"}`+"\n", buf.String())
+
+	buf.Reset()
+	tp := TraceParent{Version: "00", TraceID: "4bf92f3577b34da6a3ce929d0e0e4736", ParentID: "00f067aa0ba902b7", Flags: "01"}
+	ctx := WithTraceParent(WithID(context.Background(), "some-request-id"), tp)
+	Logger(ctx, base).Info().Msg("with ids")
+	assert.Equal(t, `{"level":"info","request_id":"some-request-id","trace_id":"4bf92f3577b34da6a3ce929d0e0e4736","span_id":"00f067aa0ba902b7","message":"with ids"}`+"\n", buf.String())
+}
@@ -0,0 +1,260 @@
+// Package tlsconfig builds the TLS configuration of the HTTP listeners.
+// Certificates and client CA bundles are reloaded when their files change on disk,
+// and the identity of verified client certificates is carried through context.Context.
+package tlsconfig
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/efimovalex/replaceme/config"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// New returns the TLS configuration of a listener, or nil when TLS is not configured.
+// The files are loaded right away so that a bad configuration fails at startup.
+func New(cfg config.TLS) (*tls.Config, error) {
+	if cfg.CertFile == "" && cfg.KeyFile == "" {
+		if cfg.ClientCAFile != "" {
+			return nil, errors.New("client certificates cannot be verified without a server certificate")
+		}
+
+		return nil, nil
+	}
+	if cfg.CertFile == "" || cfg.KeyFile == "" {
+		return nil, errors.New("both the certificate and the key file are required")
+	}
+
+	minVersion, err := parseVersion(cfg.MinVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &reloader{
+		cfg:        cfg,
+		minVersion: minVersion,
+		clientAuth: tls.NoClientCert,
+		modTimes:   map[string]time.Time{},
+		logger:     log.With().Str("component", "tls").Logger(),
+	}
+	if cfg.ClientCAFile != "" {
+		r.clientAuth = tls.RequireAndVerifyClientCert
+		if cfg.ClientCertOptional {
+			r.clientAuth = tls.VerifyClientCertIfGiven
+		}
+	}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+
+	return r.config(), nil
+}
+
+// parseVersion parses a TLS version, e.g. 1.2
+func parseVersion(version string) (uint16, error) {
+	switch version {
+	case "", "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	default:
+		return 0, fmt.Errorf("unsupported TLS version %q", version)
+	}
+}
+
+// reloader holds the certificate and the client CAs of a listener, and reloads them
+// on handshakes once the reload interval has passed and a file has changed
+type reloader struct {
+	cfg        config.TLS
+	minVersion uint16
+	clientAuth tls.ClientAuthType
+	logger     zerolog.Logger
+
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	modTimes  map[string]time.Time
+	checkedAt time.Time
+}
+
+// config returns the configuration of the listener, every handshake gets the current certificate and client CAs
+func (r *reloader) config() *tls.Config {
+	return &tls.Config{
+		MinVersion: r.minVersion,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return r.current(), nil
+		},
+		// only used by ServeTLS, which requires a certificate, handshakes use GetConfigForClient
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return r.current().GetCertificate(hello)
+		},
+	}
+}
+
+// current returns the configuration of a handshake, reloading the files when they changed
+func (r *reloader) current() *tls.Config {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if time.Since(r.checkedAt) >= r.cfg.ReloadInterval {
+		r.checkedAt = time.Now()
+		if r.changed() {
+			// the previous certificate keeps being served until the files are valid again, e.g. during a rotation
+			if err := r.loadLocked(); err != nil {
+				r.logger.Error().Err(err).Msg("error reloading TLS certificates")
+			} else {
+				r.logger.Info().Str("cert_file", r.cfg.CertFile).Msg("TLS certificates reloaded")
+			}
+		}
+	}
+
+	return r.handshakeConfig()
+}
+
+// handshakeConfig returns the configuration of the loaded files, r.mu must be held
+func (r *reloader) handshakeConfig() *tls.Config {
+	cert := r.cert
+
+	return &tls.Config{
+		MinVersion: r.minVersion,
+		// ServeTLS only adds the protocols to the base configuration
+		NextProtos: []string{"h2", "http/1.1"},
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return cert, nil
+		},
+		ClientAuth: r.clientAuth,
+		ClientCAs:  r.clientCAs,
+	}
+}
+
+// files returns the files of the listener
+func (r *reloader) files() []string {
+	files := []string{r.cfg.CertFile, r.cfg.KeyFile}
+	if r.cfg.ClientCAFile != "" {
+		files = append(files, r.cfg.ClientCAFile)
+	}
+
+	return files
+}
+
+// changed reports whether a file was modified since it was loaded, r.mu must be held
+func (r *reloader) changed() bool {
+	for _, file := range r.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			r.logger.Error().Err(err).Msg("error checking TLS file")
+
+			continue
+		}
+		if !info.ModTime().Equal(r.modTimes[file]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// load loads the certificate and the client CAs
+func (r *reloader) load() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.checkedAt = time.Now()
+
+	return r.loadLocked()
+}
+
+// loadLocked loads the certificate and the client CAs, r.mu must be held
+func (r *reloader) loadLocked() error {
+	modTimes := map[string]time.Time{}
+	for _, file := range r.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			return err
+		}
+		modTimes[file] = info.ModTime()
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.cfg.CertFile, r.cfg.KeyFile)
+	if err != nil {
+		return fmt.Errorf("error loading certificate: %w", err)
+	}
+
+	var clientCAs *x509.CertPool
+	if r.cfg.ClientCAFile != "" {
+		pem, err := os.ReadFile(r.cfg.ClientCAFile)
+		if err != nil {
+			return fmt.Errorf("error loading client CAs: %w", err)
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificate found in client CA file %s", r.cfg.ClientCAFile)
+		}
+	}
+
+	r.cert = &cert
+	r.clientCAs = clientCAs
+	r.modTimes = modTimes
+
+	return nil
+}
+
+// ClientIdentity is the identity of a verified client certificate
+type ClientIdentity struct {
+	// Subject is the distinguished name of the certificate, e.g. CN=billing,O=replaceme
+	Subject        string
+	CommonName     string
+	SerialNumber   string
+	DNSNames       []string
+	EmailAddresses []string
+	IPAddresses    []string
+	URIs           []string
+}
+
+// ClientIdentityFromState returns the identity of the client certificate of a connection.
+// Only certificates verified against the client CAs have an identity.
+func ClientIdentityFromState(state *tls.ConnectionState) (ClientIdentity, bool) {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return ClientIdentity{}, false
+	}
+
+	cert := state.VerifiedChains[0][0]
+	id := ClientIdentity{
+		Subject:        cert.Subject.String(),
+		CommonName:     cert.Subject.CommonName,
+		SerialNumber:   cert.SerialNumber.String(),
+		DNSNames:       cert.DNSNames,
+		EmailAddresses: cert.EmailAddresses,
+	}
+	for _, ip := range cert.IPAddresses {
+		id.IPAddresses = append(id.IPAddresses, ip.String())
+	}
+	for _, uri := range cert.URIs {
+		id.URIs = append(id.URIs, uri.String())
+	}
+
+	return id, true
+}
+
+type ctxKey string
+
+var ctxKeyClientIdentity = ctxKey("client-identity")
+
+// WithClientIdentity sets the client certificate identity in the context
+func WithClientIdentity(ctx context.Context, id ClientIdentity) context.Context {
+	return context.WithValue(ctx, ctxKeyClientIdentity, id)
+}
+
+// ClientIdentityValue returns the client certificate identity from the context
+func ClientIdentityValue(ctx context.Context) (ClientIdentity, bool) {
+	id, ok := ctx.Value(ctxKeyClientIdentity).(ClientIdentity)
+
+	return id, ok
+}
@@ -0,0 +1,270 @@
+package tlsconfig
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/efimovalex/replaceme/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testCA is a certificate authority issuing the certificates of the tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "replaceme test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns the PEM certificate and key of a leaf certificate
+func (ca *testCA) issue(t *testing.T, serial int64, commonName string, usage x509.ExtKeyUsage) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	spiffe, _ := url.Parse("spiffe://replaceme.com/" + commonName)
+	tmpl := &x509.Certificate{
+		SerialNumber:   big.NewInt(serial),
+		Subject:        pkix.Name{CommonName: commonName, Organization: []string{"replaceme"}},
+		NotBefore:      time.Now().Add(-time.Hour),
+		NotAfter:       time.Now().Add(time.Hour),
+		KeyUsage:       x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:    []x509.ExtKeyUsage{usage},
+		DNSNames:       []string{commonName},
+		IPAddresses:    []net.IP{net.ParseIP("127.0.0.1")},
+		EmailAddresses: []string{commonName + "@replaceme.com"},
+		URIs:           []*url.URL{spiffe},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+// writeFile writes a file with a modification time in the future, so that it is seen as changed
+func writeFile(t *testing.T, path string, b []byte, modTime time.Time) {
+	require.NoError(t, os.WriteFile(path, b, 0o600))
+	require.NoError(t, os.Chtimes(path, modTime, modTime))
+}
+
+// serve starts an HTTPS server answering the common name of the client identity
+func serve(t *testing.T, tlsConfig *tls.Config) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	srv := &http.Server{
+		TLSConfig: tlsConfig,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id, _ := ClientIdentityFromState(r.TLS)
+			fmt.Fprint(w, id.CommonName)
+		}),
+	}
+	go func() { _ = srv.ServeTLS(ln, "", "") }()
+	t.Cleanup(func() { _ = srv.Close() })
+
+	return "https://" + ln.Addr().String()
+}
+
+// get requests url with a client trusting ca and presenting the client certificate, if any
+func get(url string, ca *testCA, clientCert *tls.Certificate) (*http.Response, error) {
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	cfg := &tls.Config{RootCAs: roots, ServerName: "server"}
+	if clientCert != nil {
+		cfg.Certificates = []tls.Certificate{*clientCert}
+	}
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: cfg, DisableKeepAlives: true, ForceAttemptHTTP2: true}}
+
+	return client.Get(url)
+}
+
+func TestNew_Invalid(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	certPEM, keyPEM := ca.issue(t, 2, "server", x509.ExtKeyUsageServerAuth)
+	writeFile(t, filepath.Join(dir, "cert.pem"), certPEM, time.Now())
+	writeFile(t, filepath.Join(dir, "key.pem"), keyPEM, time.Now())
+	writeFile(t, filepath.Join(dir, "empty.pem"), []byte("\n"), time.Now())
+
+	tests := []struct {
+		name string
+		cfg  config.TLS
+		err  string
+	}{
+		{name: "Missing key", cfg: config.TLS{CertFile: filepath.Join(dir, "cert.pem")}, err: "both the certificate and the key file are required"},
+		{name: "Client CAs without certificate", cfg: config.TLS{ClientCAFile: filepath.Join(dir, "cert.pem")}, err: "client certificates cannot be verified without a server certificate"},
+		{name: "Missing file", cfg: config.TLS{CertFile: filepath.Join(dir, "missing.pem"), KeyFile: filepath.Join(dir, "key.pem")}, err: "no such file or directory"},
+		{name: "Key mismatch", cfg: config.TLS{CertFile: filepath.Join(dir, "key.pem"), KeyFile: filepath.Join(dir, "key.pem")}, err: "error loading certificate"},
+		{name: "Empty client CA file", cfg: config.TLS{CertFile: filepath.Join(dir, "cert.pem"), KeyFile: filepath.Join(dir, "key.pem"), ClientCAFile: filepath.Join(dir, "empty.pem")}, err: "no certificate found in client CA file"},
+		{name: "Version", cfg: config.TLS{CertFile: filepath.Join(dir, "cert.pem"), KeyFile: filepath.Join(dir, "key.pem"), MinVersion: "1.0"}, err: `unsupported TLS version "1.0"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := New(tt.cfg)
+			assert.ErrorContains(t, err, tt.err)
+		})
+	}
+
+	t.Run("Disabled", func(t *testing.T) {
+		cfg, err := New(config.TLS{})
+		assert.NoError(t, err)
+		assert.Nil(t, cfg)
+	})
+}
+
+func TestNew_MutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	certPEM, keyPEM := ca.issue(t, 2, "server", x509.ExtKeyUsageServerAuth)
+	writeFile(t, filepath.Join(dir, "cert.pem"), certPEM, time.Now())
+	writeFile(t, filepath.Join(dir, "key.pem"), keyPEM, time.Now())
+	writeFile(t, filepath.Join(dir, "ca.pem"), ca.pem, time.Now())
+
+	clientCertPEM, clientKeyPEM := ca.issue(t, 3, "billing", x509.ExtKeyUsageClientAuth)
+	clientCert, err := tls.X509KeyPair(clientCertPEM, clientKeyPEM)
+	require.NoError(t, err)
+	otherCertPEM, otherKeyPEM := newTestCA(t).issue(t, 4, "billing", x509.ExtKeyUsageClientAuth)
+	otherCert, err := tls.X509KeyPair(otherCertPEM, otherKeyPEM)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name       string
+		optional   bool
+		clientCert *tls.Certificate
+		want       string
+		wantErr    bool
+	}{
+		{name: "Verified client", clientCert: &clientCert, want: "billing"},
+		{name: "No client certificate", wantErr: true},
+		{name: "Unknown CA", clientCert: &otherCert, wantErr: true},
+		{name: "Optional, no client certificate", optional: true, want: ""},
+		{name: "Optional, verified client", optional: true, clientCert: &clientCert, want: "billing"},
+		{name: "Optional, unknown CA", optional: true, clientCert: &otherCert, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tlsConfig, err := New(config.TLS{
+				CertFile:           filepath.Join(dir, "cert.pem"),
+				KeyFile:            filepath.Join(dir, "key.pem"),
+				ClientCAFile:       filepath.Join(dir, "ca.pem"),
+				ClientCertOptional: tt.optional,
+			})
+			require.NoError(t, err)
+
+			res, err := get(serve(t, tlsConfig), ca, tt.clientCert)
+			if tt.wantErr {
+				if err == nil {
+					// TLS 1.3 clients learn about the refusal on their first read
+					res.Body.Close()
+				}
+				assert.True(t, err != nil || res.StatusCode != http.StatusOK)
+
+				return
+			}
+			require.NoError(t, err)
+			defer res.Body.Close()
+			assert.Equal(t, "HTTP/2.0", res.Proto)
+
+			body, err := io.ReadAll(res.Body)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, string(body))
+		})
+	}
+}
+
+func TestNew_Reload(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	certPEM, keyPEM := ca.issue(t, 2, "server", x509.ExtKeyUsageServerAuth)
+	writeFile(t, filepath.Join(dir, "cert.pem"), certPEM, time.Now())
+	writeFile(t, filepath.Join(dir, "key.pem"), keyPEM, time.Now())
+
+	tlsConfig, err := New(config.TLS{CertFile: filepath.Join(dir, "cert.pem"), KeyFile: filepath.Join(dir, "key.pem")})
+	require.NoError(t, err)
+	url := serve(t, tlsConfig)
+
+	serial := func() int64 {
+		res, err := get(url, ca, nil)
+		require.NoError(t, err)
+		defer res.Body.Close()
+
+		return res.TLS.PeerCertificates[0].SerialNumber.Int64()
+	}
+	assert.Equal(t, int64(2), serial())
+
+	// a half written rotation keeps the previous certificate
+	rotated, rotatedKey := ca.issue(t, 5, "server", x509.ExtKeyUsageServerAuth)
+	writeFile(t, filepath.Join(dir, "cert.pem"), rotated, time.Now().Add(time.Minute))
+	assert.Equal(t, int64(2), serial())
+
+	writeFile(t, filepath.Join(dir, "key.pem"), rotatedKey, time.Now().Add(2*time.Minute))
+	assert.Equal(t, int64(5), serial())
+}
+
+func TestClientIdentity(t *testing.T) {
+	ca := newTestCA(t)
+	certPEM, _ := ca.issue(t, 3, "billing", x509.ExtKeyUsageClientAuth)
+	block, _ := pem.Decode(certPEM)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	require.NoError(t, err)
+
+	_, ok := ClientIdentityFromState(nil)
+	assert.False(t, ok)
+	_, ok = ClientIdentityFromState(&tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}})
+	assert.False(t, ok, "unverified certificates have no identity")
+
+	id, ok := ClientIdentityFromState(&tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert, ca.cert}}})
+	require.True(t, ok)
+	assert.Equal(t, ClientIdentity{
+		Subject:        "CN=billing,O=replaceme",
+		CommonName:     "billing",
+		SerialNumber:   "3",
+		DNSNames:       []string{"billing"},
+		EmailAddresses: []string{"billing@replaceme.com"},
+		IPAddresses:    []string{"127.0.0.1"},
+		URIs:           []string{"spiffe://replaceme.com/billing"},
+	}, id)
+
+	ctx := WithClientIdentity(context.Background(), id)
+	got, ok := ClientIdentityValue(ctx)
+	assert.True(t, ok)
+	assert.Equal(t, id, got)
+
+	_, ok = ClientIdentityValue(context.Background())
+	assert.False(t, ok)
+}
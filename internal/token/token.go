@@ -0,0 +1,228 @@
+// Package token issues the first-party JWTs of the service, signed by keys the service manages,
+// and publishes the public keys as a JSON Web Key Set so that the tokens can be verified by anyone.
+package token
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/efimovalex/replaceme/config"
+	"github.com/rs/zerolog/log"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// Signature algorithms of the issued tokens
+const (
+	RS256 = string(jose.RS256)
+	EdDSA = string(jose.EdDSA)
+)
+
+// rsaKeyBits is the size of the RSA keys generated at startup
+const rsaKeyBits = 2048
+
+// Issuer signs access tokens with the first of its keys
+type Issuer struct {
+	issuer     string
+	audience   []string
+	algorithm  string
+	ttl        time.Duration
+	refreshTTL time.Duration
+
+	signer jose.Signer
+	keys   jose.JSONWebKeySet
+}
+
+// New creates an Issuer with the keys of the configuration, or with a key generated at startup when the
+// configuration allows an ephemeral key
+func New(cfg config.LocalAuth) (*Issuer, error) {
+	if cfg.Issuer == "" {
+		return nil, errors.New("token issuer is required")
+	}
+	if cfg.Algorithm != RS256 && cfg.Algorithm != EdDSA {
+		return nil, fmt.Errorf("unsupported token signature algorithm %q", cfg.Algorithm)
+	}
+
+	var keys []crypto.Signer
+	for _, file := range cfg.KeyFiles {
+		key, err := loadKey(file, cfg.Algorithm)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		if !cfg.EphemeralKey {
+			return nil, errors.New("token signing keys are required, set AUTH_LOCAL_KEY_FILES or AUTH_LOCAL_EPHEMERAL_KEY for development")
+		}
+		log.Warn().Str("component", "token").Msg("no token signing key configured, tokens are invalidated by restarts")
+		key, err := generateKey(cfg.Algorithm)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	i := &Issuer{
+		issuer:     cfg.Issuer,
+		audience:   []string{cfg.Audience},
+		algorithm:  cfg.Algorithm,
+		ttl:        cfg.AccessTokenTTL,
+		refreshTTL: cfg.RefreshTokenTTL,
+	}
+	for _, key := range keys {
+		jwk := jose.JSONWebKey{Key: key.Public(), Algorithm: cfg.Algorithm, Use: "sig"}
+		thumbprint, err := jwk.Thumbprint(crypto.SHA256)
+		if err != nil {
+			return nil, err
+		}
+		jwk.KeyID = base64.RawURLEncoding.EncodeToString(thumbprint)
+		i.keys.Keys = append(i.keys.Keys, jwk)
+	}
+
+	signer, err := jose.NewSigner(
+		jose.SigningKey{Algorithm: jose.SignatureAlgorithm(cfg.Algorithm), Key: keys[0]},
+		(&jose.SignerOptions{}).WithType("JWT").WithHeader("kid", i.keys.Keys[0].KeyID),
+	)
+	if err != nil {
+		return nil, err
+	}
+	i.signer = signer
+
+	return i, nil
+}
+
+// Issuer returns the iss claim of the tokens
+func (i *Issuer) Issuer() string {
+	return i.issuer
+}
+
+// Audience returns the aud claim of the tokens
+func (i *Issuer) Audience() []string {
+	return i.audience
+}
+
+// Algorithm returns the signature algorithm of the tokens
+func (i *Issuer) Algorithm() string {
+	return i.algorithm
+}
+
+// TTL returns the lifetime of the access tokens
+func (i *Issuer) TTL() time.Duration {
+	return i.ttl
+}
+
+// RefreshTTL returns the idle lifetime of the sessions kept alive by refresh tokens
+func (i *Issuer) RefreshTTL() time.Duration {
+	return i.refreshTTL
+}
+
+// JWKS returns the public keys verifying the tokens
+func (i *Issuer) JWKS() jose.JSONWebKeySet {
+	return i.keys
+}
+
+// KeyFunc returns the public keys verifying the tokens, see validator.New
+func (i *Issuer) KeyFunc(context.Context) (interface{}, error) {
+	return &i.keys, nil
+}
+
+// Token is a signed access token
+type Token struct {
+	// Raw is the compact serialization of the token
+	Raw string
+	// ID is the jti claim of the token
+	ID     string
+	Expiry time.Time
+}
+
+// Issue signs an access token for the subject, the claims are added to the registered ones
+func (i *Issuer) Issue(subject string, claims map[string]interface{}) (Token, error) {
+	now := time.Now()
+	expiry := now.Add(i.ttl)
+
+	registered := jwt.Claims{
+		Issuer:    i.issuer,
+		Subject:   subject,
+		Audience:  i.audience,
+		IssuedAt:  jwt.NewNumericDate(now),
+		NotBefore: jwt.NewNumericDate(now),
+		Expiry:    jwt.NewNumericDate(expiry),
+		ID:        newID(),
+	}
+
+	raw, err := jwt.Signed(i.signer).Claims(registered).Claims(claims).CompactSerialize()
+	if err != nil {
+		return Token{}, err
+	}
+
+	return Token{Raw: raw, ID: registered.ID, Expiry: expiry}, nil
+}
+
+// loadKey loads a PEM encoded PKCS #8 private key, or a PKCS #1 RSA private key
+func loadKey(file string, algorithm string) (crypto.Signer, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("error loading token signing key: %w", err)
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM encoded key found in %s", file)
+	}
+
+	var key interface{}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error parsing token signing key %s: %w", file, err)
+	}
+
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		if algorithm == RS256 {
+			return key, nil
+		}
+	case ed25519.PrivateKey:
+		if algorithm == EdDSA {
+			return key, nil
+		}
+	}
+
+	return nil, fmt.Errorf("key %s cannot sign %s tokens", file, algorithm)
+}
+
+// generateKey generates a key for the algorithm
+func generateKey(algorithm string) (crypto.Signer, error) {
+	if algorithm == RS256 {
+		return rsa.GenerateKey(rand.Reader, rsaKeyBits)
+	}
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+
+	return key, err
+}
+
+// newID generates the jti claim of a token
+func newID() string {
+	b := make([]byte, 16)
+	// crypto/rand only fails when the OS has no entropy source
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+
+	return hex.EncodeToString(b)
+}
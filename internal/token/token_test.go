@@ -0,0 +1,129 @@
+package token
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/efimovalex/replaceme/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// writeKey writes a PEM encoded private key
+func writeKey(t *testing.T, dir, name string, key interface{}) string {
+	var block *pem.Block
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		block = &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}
+	default:
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		require.NoError(t, err)
+		block = &pem.Block{Type: "PRIVATE KEY", Bytes: der}
+	}
+	path := filepath.Join(dir, name)
+	require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(block), 0o600))
+
+	return path
+}
+
+func TestNew_Invalid(t *testing.T) {
+	dir := t.TempDir()
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	edFile := writeKey(t, dir, "ed25519.pem", edKey)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "garbage.pem"), []byte("not a key"), 0o600))
+
+	tests := []struct {
+		name string
+		cfg  config.LocalAuth
+		err  string
+	}{
+		{name: "Issuer", cfg: config.LocalAuth{Algorithm: EdDSA}, err: "token issuer is required"},
+		{name: "Algorithm", cfg: config.LocalAuth{Issuer: "https://replaceme.com/", Algorithm: "HS256"}, err: `unsupported token signature algorithm "HS256"`},
+		{name: "Missing key file", cfg: config.LocalAuth{Issuer: "https://replaceme.com/", Algorithm: EdDSA, KeyFiles: []string{filepath.Join(dir, "missing.pem")}}, err: "no such file or directory"},
+		{name: "Not a PEM file", cfg: config.LocalAuth{Issuer: "https://replaceme.com/", Algorithm: EdDSA, KeyFiles: []string{filepath.Join(dir, "garbage.pem")}}, err: "no PEM encoded key found"},
+		{name: "Key of another algorithm", cfg: config.LocalAuth{Issuer: "https://replaceme.com/", Algorithm: RS256, KeyFiles: []string{edFile}}, err: "cannot sign RS256 tokens"},
+		{name: "No key", cfg: config.LocalAuth{Issuer: "https://replaceme.com/", Algorithm: EdDSA}, err: "token signing keys are required"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := New(tt.cfg)
+			assert.ErrorContains(t, err, tt.err)
+		})
+	}
+}
+
+func TestIssuer_Issue(t *testing.T) {
+	dir := t.TempDir()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	oldRSAKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name      string
+		algorithm string
+		keyFiles  []string
+		keys      int
+	}{
+		{name: "Generated EdDSA key", algorithm: EdDSA, keys: 1},
+		{name: "Generated RS256 key", algorithm: RS256, keys: 1},
+		{name: "PKCS #8 EdDSA key", algorithm: EdDSA, keyFiles: []string{writeKey(t, dir, "ed25519.pem", edKey)}, keys: 1},
+		{name: "Rotated PKCS #1 RS256 keys", algorithm: RS256, keyFiles: []string{writeKey(t, dir, "rsa.pem", rsaKey), writeKey(t, dir, "rsa-old.pem", oldRSAKey)}, keys: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			issuer, err := New(config.LocalAuth{
+				Issuer:         "https://replaceme.com/",
+				Audience:       "https://api.replaceme.com",
+				Algorithm:      tt.algorithm,
+				KeyFiles:       tt.keyFiles,
+				EphemeralKey:   true,
+				AccessTokenTTL: 15 * time.Minute,
+			})
+			require.NoError(t, err)
+
+			jwks := issuer.JWKS()
+			require.Len(t, jwks.Keys, tt.keys)
+			for _, key := range jwks.Keys {
+				assert.True(t, key.IsPublic())
+				assert.Equal(t, tt.algorithm, key.Algorithm)
+				assert.Equal(t, "sig", key.Use)
+				assert.NotEmpty(t, key.KeyID)
+			}
+
+			token, err := issuer.Issue("42", map[string]interface{}{"email": "jane.doe@replaceme.com"})
+			require.NoError(t, err)
+			assert.WithinDuration(t, time.Now().Add(15*time.Minute), token.Expiry, time.Second)
+
+			parsed, err := jwt.ParseSigned(token.Raw)
+			require.NoError(t, err)
+			require.Len(t, parsed.Headers, 1)
+			assert.Equal(t, tt.algorithm, parsed.Headers[0].Algorithm)
+			assert.Equal(t, jwks.Keys[0].KeyID, parsed.Headers[0].KeyID, "the first key signs")
+
+			var (
+				claims jwt.Claims
+				custom struct {
+					Email string `json:"email"`
+				}
+			)
+			require.NoError(t, parsed.Claims(&jwks, &claims, &custom))
+			assert.NoError(t, claims.Validate(jwt.Expected{Issuer: "https://replaceme.com/", Audience: jwt.Audience{"https://api.replaceme.com"}, Time: time.Now()}))
+			assert.Equal(t, "42", claims.Subject)
+			assert.Len(t, claims.ID, 32)
+			assert.Equal(t, token.ID, claims.ID)
+			assert.Equal(t, "jane.doe@replaceme.com", custom.Email)
+		})
+	}
+}
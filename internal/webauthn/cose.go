@@ -0,0 +1,150 @@
+package webauthn
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// COSE algorithms of the supported credentials, see https://www.iana.org/assignments/cose/cose.xhtml
+const (
+	AlgES256 = -7
+	AlgEdDSA = -8
+	AlgRS256 = -257
+)
+
+// COSE key parameters
+const (
+	coseKeyType   = 1
+	coseAlgorithm = 3
+	coseCurve     = -1
+	coseX         = -2
+	coseY         = -3
+	coseRSAN      = -1
+	coseRSAE      = -2
+
+	coseKeyTypeOKP = 1
+	coseKeyTypeEC2 = 2
+	coseKeyTypeRSA = 3
+
+	coseCurveP256    = 1
+	coseCurveEd25519 = 6
+)
+
+// ErrUnsupportedAlgorithm is returned for credentials of algorithms other than ES256, EdDSA and RS256
+var ErrUnsupportedAlgorithm = errors.New("unsupported credential algorithm")
+
+// PublicKey is the public key of a credential
+type PublicKey struct {
+	Algorithm int
+	Key       crypto.PublicKey
+}
+
+// ParsePublicKey decodes a COSE encoded public key, see RFC 8152 section 7
+func ParsePublicKey(cose []byte) (*PublicKey, error) {
+	var m map[int]interface{}
+	if err := cbor.Unmarshal(cose, &m); err != nil {
+		return nil, fmt.Errorf("invalid COSE key: %w", err)
+	}
+	alg, ok := coseInt(m[coseAlgorithm])
+	if !ok {
+		return nil, errors.New("COSE key has no algorithm")
+	}
+	kty, _ := coseInt(m[coseKeyType])
+
+	switch {
+	case alg == AlgES256 && kty == coseKeyTypeEC2:
+		crv, _ := coseInt(m[coseCurve])
+		x, _ := m[coseX].([]byte)
+		y, _ := m[coseY].([]byte)
+		if crv != coseCurveP256 || len(x) != 32 || len(y) != 32 {
+			return nil, errors.New("invalid ES256 key")
+		}
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return nil, errors.New("invalid ES256 key")
+		}
+
+		return &PublicKey{Algorithm: alg, Key: key}, nil
+	case alg == AlgEdDSA && kty == coseKeyTypeOKP:
+		crv, _ := coseInt(m[coseCurve])
+		x, _ := m[coseX].([]byte)
+		if crv != coseCurveEd25519 || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid EdDSA key")
+		}
+
+		return &PublicKey{Algorithm: alg, Key: ed25519.PublicKey(x)}, nil
+	case alg == AlgRS256 && kty == coseKeyTypeRSA:
+		n, _ := m[coseRSAN].([]byte)
+		e, _ := m[coseRSAE].([]byte)
+		if len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			return nil, errors.New("invalid RS256 key")
+		}
+
+		return &PublicKey{Algorithm: alg, Key: &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}}, nil
+	}
+
+	return nil, ErrUnsupportedAlgorithm
+}
+
+// Verify checks the signature of data by the key
+func (k *PublicKey) Verify(data, sig []byte) bool {
+	switch key := k.Key.(type) {
+	case *ecdsa.PublicKey:
+		sum := sha256.Sum256(data)
+
+		return ecdsa.VerifyASN1(key, sum[:], sig)
+	case ed25519.PublicKey:
+		return ed25519.Verify(key, data, sig)
+	case *rsa.PublicKey:
+		sum := sha256.Sum256(data)
+
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, sum[:], sig) == nil
+	}
+
+	return false
+}
+
+// EncodePublicKey encodes a public key as a COSE key, for the software authenticators of the tests
+func EncodePublicKey(key crypto.PublicKey) ([]byte, error) {
+	switch key := key.(type) {
+	case *ecdsa.PublicKey:
+		x, y := make([]byte, 32), make([]byte, 32)
+		key.X.FillBytes(x)
+		key.Y.FillBytes(y)
+
+		return cbor.Marshal(map[int]interface{}{
+			coseKeyType: coseKeyTypeEC2, coseAlgorithm: AlgES256, coseCurve: coseCurveP256, coseX: x, coseY: y,
+		})
+	case ed25519.PublicKey:
+		return cbor.Marshal(map[int]interface{}{
+			coseKeyType: coseKeyTypeOKP, coseAlgorithm: AlgEdDSA, coseCurve: coseCurveEd25519, coseX: []byte(key),
+		})
+	case *rsa.PublicKey:
+		return cbor.Marshal(map[int]interface{}{
+			coseKeyType: coseKeyTypeRSA, coseAlgorithm: AlgRS256, coseRSAN: key.N.Bytes(), coseRSAE: big.NewInt(int64(key.E)).Bytes(),
+		})
+	}
+
+	return nil, ErrUnsupportedAlgorithm
+}
+
+// coseInt converts a decoded CBOR integer
+func coseInt(v interface{}) (int, bool) {
+	switch i := v.(type) {
+	case int64:
+		return int(i), true
+	case uint64:
+		return int(i), true
+	}
+
+	return 0, false
+}
@@ -0,0 +1,153 @@
+package webauthn
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// Flags of the authenticator data
+const (
+	FlagUserPresent      byte = 0x01
+	FlagUserVerified     byte = 0x04
+	FlagBackupEligible   byte = 0x08
+	FlagBackedUp         byte = 0x10
+	FlagAttestedCredData byte = 0x40
+	FlagExtensionData    byte = 0x80
+)
+
+// Types of the client data of the ceremonies
+const (
+	ClientDataTypeCreate = "webauthn.create"
+	ClientDataTypeGet    = "webauthn.get"
+)
+
+// Base64URL is binary data encoded as unpadded base64url in JSON, as in the WebAuthn JSON serialization
+type Base64URL []byte
+
+// MarshalJSON encodes the data as an unpadded base64url string
+func (b Base64URL) MarshalJSON() ([]byte, error) {
+	return json.Marshal(base64.RawURLEncoding.EncodeToString(b))
+}
+
+// UnmarshalJSON decodes a base64url string, padded or not
+func (b *Base64URL) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	decoded, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil {
+		return fmt.Errorf("invalid base64url data: %w", err)
+	}
+	*b = decoded
+
+	return nil
+}
+
+// String returns the unpadded base64url encoding of the data
+func (b Base64URL) String() string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// CollectedClientData is the client data signed by the authenticators, see WebAuthn section 5.8.1
+type CollectedClientData struct {
+	Type        string `json:"type"`
+	Challenge   string `json:"challenge"`
+	Origin      string `json:"origin"`
+	CrossOrigin bool   `json:"crossOrigin,omitempty"`
+}
+
+// ParseClientData decodes a clientDataJSON
+func ParseClientData(clientDataJSON []byte) (*CollectedClientData, error) {
+	var c CollectedClientData
+	if err := json.Unmarshal(clientDataJSON, &c); err != nil {
+		return nil, fmt.Errorf("invalid client data: %w", err)
+	}
+
+	return &c, nil
+}
+
+// ChallengeBytes decodes the challenge of the client data
+func (c *CollectedClientData) ChallengeBytes() ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(c.Challenge, "="))
+}
+
+// AuthenticatorData is the data returned by the authenticators, see WebAuthn section 6.1
+type AuthenticatorData struct {
+	RPIDHash  []byte
+	Flags     byte
+	SignCount uint32
+	// AAGUID, CredentialID and PublicKey are set when the flags have FlagAttestedCredData, at registration
+	AAGUID       []byte
+	CredentialID []byte
+	// PublicKey is the COSE encoded public key of the credential
+	PublicKey []byte
+}
+
+// Has reports whether the authenticator data has the flag
+func (a *AuthenticatorData) Has(flag byte) bool {
+	return a.Flags&flag == flag
+}
+
+// ParseAuthenticatorData decodes authenticator data
+func ParseAuthenticatorData(data []byte) (*AuthenticatorData, error) {
+	if len(data) < 37 {
+		return nil, errors.New("authenticator data is too short")
+	}
+	a := &AuthenticatorData{
+		RPIDHash:  data[:32],
+		Flags:     data[32],
+		SignCount: binary.BigEndian.Uint32(data[33:37]),
+	}
+	rest := data[37:]
+
+	if a.Has(FlagAttestedCredData) {
+		if len(rest) < 18 {
+			return nil, errors.New("attested credential data is too short")
+		}
+		a.AAGUID = rest[:16]
+		n := int(binary.BigEndian.Uint16(rest[16:18]))
+		rest = rest[18:]
+		if len(rest) < n {
+			return nil, errors.New("credential id is truncated")
+		}
+		a.CredentialID = rest[:n]
+		rest = rest[n:]
+
+		// the public key is followed by the extensions, its length is only known by decoding it
+		dec := cbor.NewDecoder(bytes.NewReader(rest))
+		var key cbor.RawMessage
+		if err := dec.Decode(&key); err != nil {
+			return nil, fmt.Errorf("invalid credential public key: %w", err)
+		}
+		a.PublicKey = rest[:dec.NumBytesRead()]
+		rest = rest[dec.NumBytesRead():]
+	}
+	if a.Has(FlagExtensionData) {
+		var ext cbor.RawMessage
+		dec := cbor.NewDecoder(bytes.NewReader(rest))
+		if err := dec.Decode(&ext); err != nil {
+			return nil, fmt.Errorf("invalid extensions: %w", err)
+		}
+		rest = rest[dec.NumBytesRead():]
+	}
+	if len(rest) > 0 {
+		return nil, errors.New("authenticator data has trailing bytes")
+	}
+
+	return a, nil
+}
+
+// attestationObject is the CBOR encoded attestation of a new credential, see WebAuthn section 6.5
+type attestationObject struct {
+	Format    string                 `cbor:"fmt"`
+	Statement map[string]interface{} `cbor:"attStmt"`
+	AuthData  []byte                 `cbor:"authData"`
+}
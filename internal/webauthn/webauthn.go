@@ -0,0 +1,359 @@
+// Package webauthn implements the relying party side of the WebAuthn registration and authentication ceremonies,
+// see https://www.w3.org/TR/webauthn-2/
+package webauthn
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// ChallengeSize is the size in bytes of the challenges of the ceremonies
+const ChallengeSize = 32
+
+// User verification requirements
+const (
+	UserVerificationRequired    = "required"
+	UserVerificationPreferred   = "preferred"
+	UserVerificationDiscouraged = "discouraged"
+)
+
+var (
+	// ErrInvalidResponse is returned when the response of an authenticator does not verify
+	ErrInvalidResponse = errors.New("invalid webauthn response")
+	// ErrCounterRegression is returned when the signature counter of a credential did not increase, which means the
+	// authenticator may have been cloned
+	ErrCounterRegression = errors.New("signature counter did not increase")
+)
+
+// RelyingParty is the identity of the service for the authenticators
+type RelyingParty struct {
+	// ID is the domain of the service, credentials are scoped to it
+	ID   string
+	Name string
+	// Origins are the allowed origins of the pages running the ceremonies, e.g. https://app.replaceme.com
+	Origins          []string
+	Timeout          time.Duration
+	UserVerification string
+}
+
+// Credential is a credential registered by a user
+type Credential struct {
+	ID []byte
+	// PublicKey is the COSE encoded public key of the credential
+	PublicKey  []byte
+	SignCount  uint32
+	AAGUID     []byte
+	Transports []string
+}
+
+// User is the user of a registration ceremony
+type User struct {
+	ID          Base64URL `json:"id" swaggertype:"string"`
+	Name        string    `json:"name"`
+	DisplayName string    `json:"displayName"`
+}
+
+// RelyingPartyEntity is the relying party of a registration ceremony
+type RelyingPartyEntity struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// CredentialParameter is a credential type accepted by the relying party
+type CredentialParameter struct {
+	Type      string `json:"type"`
+	Algorithm int    `json:"alg"`
+}
+
+// CredentialDescriptor identifies a credential
+type CredentialDescriptor struct {
+	Type       string    `json:"type"`
+	ID         Base64URL `json:"id" swaggertype:"string"`
+	Transports []string  `json:"transports,omitempty"`
+}
+
+// AuthenticatorSelection are the requirements for the authenticators of a registration ceremony
+type AuthenticatorSelection struct {
+	ResidentKey      string `json:"residentKey"`
+	UserVerification string `json:"userVerification"`
+}
+
+// CreationOptions are the options for navigator.credentials.create
+type CreationOptions struct {
+	RP                     RelyingPartyEntity     `json:"rp"`
+	User                   User                   `json:"user"`
+	Challenge              Base64URL              `json:"challenge" swaggertype:"string"`
+	PubKeyCredParams       []CredentialParameter  `json:"pubKeyCredParams"`
+	Timeout                int64                  `json:"timeout"`
+	ExcludeCredentials     []CredentialDescriptor `json:"excludeCredentials"`
+	AuthenticatorSelection AuthenticatorSelection `json:"authenticatorSelection"`
+	Attestation            string                 `json:"attestation"`
+}
+
+// RequestOptions are the options for navigator.credentials.get
+type RequestOptions struct {
+	Challenge        Base64URL              `json:"challenge" swaggertype:"string"`
+	Timeout          int64                  `json:"timeout"`
+	RPID             string                 `json:"rpId"`
+	AllowCredentials []CredentialDescriptor `json:"allowCredentials"`
+	UserVerification string                 `json:"userVerification"`
+}
+
+// AttestationResponse is the response of an authenticator to a registration ceremony
+type AttestationResponse struct {
+	ClientDataJSON    Base64URL `json:"clientDataJSON" swaggertype:"string" validate:"required"`
+	AttestationObject Base64URL `json:"attestationObject" swaggertype:"string" validate:"required"`
+	Transports        []string  `json:"transports,omitempty"`
+}
+
+// RegistrationResponse is the credential created by navigator.credentials.create, in its JSON serialization
+type RegistrationResponse struct {
+	ID       string              `json:"id" validate:"required"`
+	RawID    Base64URL           `json:"rawId" swaggertype:"string" validate:"required"`
+	Type     string              `json:"type" validate:"required,eq=public-key"`
+	Response AttestationResponse `json:"response"`
+}
+
+// AssertionAuthenticatorResponse is the response of an authenticator to an authentication ceremony
+type AssertionAuthenticatorResponse struct {
+	ClientDataJSON    Base64URL `json:"clientDataJSON" swaggertype:"string" validate:"required"`
+	AuthenticatorData Base64URL `json:"authenticatorData" swaggertype:"string" validate:"required"`
+	Signature         Base64URL `json:"signature" swaggertype:"string" validate:"required"`
+	UserHandle        Base64URL `json:"userHandle,omitempty" swaggertype:"string"`
+}
+
+// AssertionResponse is the credential returned by navigator.credentials.get, in its JSON serialization
+type AssertionResponse struct {
+	ID       string                         `json:"id" validate:"required"`
+	RawID    Base64URL                      `json:"rawId" swaggertype:"string" validate:"required"`
+	Type     string                         `json:"type" validate:"required,eq=public-key"`
+	Response AssertionAuthenticatorResponse `json:"response"`
+}
+
+// NewChallenge generates the random challenge of a ceremony
+func NewChallenge() ([]byte, error) {
+	challenge := make([]byte, ChallengeSize)
+	if _, err := rand.Read(challenge); err != nil {
+		return nil, err
+	}
+
+	return challenge, nil
+}
+
+// CreationOptions returns the options of a registration ceremony, excluding the credentials the user already has
+func (rp *RelyingParty) CreationOptions(user User, challenge []byte, exclude []Credential) CreationOptions {
+	return CreationOptions{
+		RP:        RelyingPartyEntity{ID: rp.ID, Name: rp.Name},
+		User:      user,
+		Challenge: challenge,
+		PubKeyCredParams: []CredentialParameter{
+			{Type: "public-key", Algorithm: AlgES256},
+			{Type: "public-key", Algorithm: AlgEdDSA},
+			{Type: "public-key", Algorithm: AlgRS256},
+		},
+		Timeout:            rp.Timeout.Milliseconds(),
+		ExcludeCredentials: descriptors(exclude),
+		AuthenticatorSelection: AuthenticatorSelection{
+			ResidentKey:      "preferred",
+			UserVerification: rp.userVerification(),
+		},
+		Attestation: "none",
+	}
+}
+
+// RequestOptions returns the options of an authentication ceremony. Without credentials, the authenticators offer
+// the discoverable credentials of the relying party.
+func (rp *RelyingParty) RequestOptions(challenge []byte, allow []Credential) RequestOptions {
+	return RequestOptions{
+		Challenge:        challenge,
+		Timeout:          rp.Timeout.Milliseconds(),
+		RPID:             rp.ID,
+		AllowCredentials: descriptors(allow),
+		UserVerification: rp.userVerification(),
+	}
+}
+
+// VerifyRegistration verifies the response to a registration ceremony, see WebAuthn section 7.1, and returns the new
+// credential. Attestations are accepted in the none and packed formats, the attestation certificates are not checked
+// against trusted roots.
+func (rp *RelyingParty) VerifyRegistration(resp *RegistrationResponse, challenge []byte) (*Credential, error) {
+	if err := rp.verifyClientData(resp.Response.ClientDataJSON, ClientDataTypeCreate, challenge); err != nil {
+		return nil, err
+	}
+
+	var att attestationObject
+	if err := cbor.Unmarshal(resp.Response.AttestationObject, &att); err != nil {
+		return nil, fmt.Errorf("%w: invalid attestation object: %s", ErrInvalidResponse, err)
+	}
+	authData, err := ParseAuthenticatorData(att.AuthData)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidResponse, err)
+	}
+	if err := rp.verifyAuthenticatorData(authData); err != nil {
+		return nil, err
+	}
+	if !authData.Has(FlagAttestedCredData) {
+		return nil, fmt.Errorf("%w: no attested credential", ErrInvalidResponse)
+	}
+	if !bytes.Equal(authData.CredentialID, resp.RawID) {
+		return nil, fmt.Errorf("%w: credential id mismatch", ErrInvalidResponse)
+	}
+	key, err := ParsePublicKey(authData.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidResponse, err)
+	}
+
+	clientDataHash := sha256.Sum256(resp.Response.ClientDataJSON)
+	if err := verifyAttestation(&att, key, append(att.AuthData, clientDataHash[:]...)); err != nil {
+		return nil, err
+	}
+
+	return &Credential{
+		ID:         authData.CredentialID,
+		PublicKey:  authData.PublicKey,
+		SignCount:  authData.SignCount,
+		AAGUID:     authData.AAGUID,
+		Transports: resp.Response.Transports,
+	}, nil
+}
+
+// VerifyAssertion verifies the response to an authentication ceremony by the credential, see WebAuthn section 7.2.
+// It returns the new signature counter of the credential and whether the authenticator verified the user.
+// ErrCounterRegression is returned when the authenticator may be a clone of the one of the credential.
+func (rp *RelyingParty) VerifyAssertion(resp *AssertionResponse, challenge []byte, cred *Credential) (uint32, bool, error) {
+	if !bytes.Equal(resp.RawID, cred.ID) {
+		return 0, false, fmt.Errorf("%w: credential id mismatch", ErrInvalidResponse)
+	}
+	if err := rp.verifyClientData(resp.Response.ClientDataJSON, ClientDataTypeGet, challenge); err != nil {
+		return 0, false, err
+	}
+	authData, err := ParseAuthenticatorData(resp.Response.AuthenticatorData)
+	if err != nil {
+		return 0, false, fmt.Errorf("%w: %s", ErrInvalidResponse, err)
+	}
+	if err := rp.verifyAuthenticatorData(authData); err != nil {
+		return 0, false, err
+	}
+
+	key, err := ParsePublicKey(cred.PublicKey)
+	if err != nil {
+		return 0, false, err
+	}
+	clientDataHash := sha256.Sum256(resp.Response.ClientDataJSON)
+	signed := append(append([]byte{}, resp.Response.AuthenticatorData...), clientDataHash[:]...)
+	if !key.Verify(signed, resp.Response.Signature) {
+		return 0, false, fmt.Errorf("%w: invalid signature", ErrInvalidResponse)
+	}
+
+	// authenticators without a counter always send 0, any other value must increase with each assertion
+	if (authData.SignCount != 0 || cred.SignCount != 0) && authData.SignCount <= cred.SignCount {
+		return authData.SignCount, false, ErrCounterRegression
+	}
+
+	return authData.SignCount, authData.Has(FlagUserVerified), nil
+}
+
+// verifyClientData checks the client data of a ceremony
+func (rp *RelyingParty) verifyClientData(clientDataJSON []byte, typ string, challenge []byte) error {
+	c, err := ParseClientData(clientDataJSON)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidResponse, err)
+	}
+	if c.Type != typ {
+		return fmt.Errorf("%w: unexpected client data type %q", ErrInvalidResponse, c.Type)
+	}
+	got, err := c.ChallengeBytes()
+	if err != nil || subtle.ConstantTimeCompare(got, challenge) != 1 {
+		return fmt.Errorf("%w: challenge mismatch", ErrInvalidResponse)
+	}
+	for _, origin := range rp.Origins {
+		if strings.EqualFold(c.Origin, origin) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%w: origin %q is not allowed", ErrInvalidResponse, c.Origin)
+}
+
+// verifyAuthenticatorData checks the relying party and the flags of authenticator data
+func (rp *RelyingParty) verifyAuthenticatorData(authData *AuthenticatorData) error {
+	rpIDHash := sha256.Sum256([]byte(rp.ID))
+	if !bytes.Equal(authData.RPIDHash, rpIDHash[:]) {
+		return fmt.Errorf("%w: relying party id mismatch", ErrInvalidResponse)
+	}
+	if !authData.Has(FlagUserPresent) {
+		return fmt.Errorf("%w: user not present", ErrInvalidResponse)
+	}
+	if rp.userVerification() == UserVerificationRequired && !authData.Has(FlagUserVerified) {
+		return fmt.Errorf("%w: user not verified", ErrInvalidResponse)
+	}
+
+	return nil
+}
+
+func (rp *RelyingParty) userVerification() string {
+	if rp.UserVerification == "" {
+		return UserVerificationPreferred
+	}
+
+	return rp.UserVerification
+}
+
+// verifyAttestation checks the attestation statement of a new credential, see WebAuthn section 8
+func verifyAttestation(att *attestationObject, key *PublicKey, signed []byte) error {
+	switch att.Format {
+	case "none":
+		if len(att.Statement) != 0 {
+			return fmt.Errorf("%w: unexpected attestation statement", ErrInvalidResponse)
+		}
+
+		return nil
+	case "packed":
+		alg, ok := coseInt(att.Statement["alg"])
+		sig, _ := att.Statement["sig"].([]byte)
+		if !ok || len(sig) == 0 {
+			return fmt.Errorf("%w: invalid packed attestation", ErrInvalidResponse)
+		}
+
+		x5c, _ := att.Statement["x5c"].([]interface{})
+		if len(x5c) == 0 {
+			// self attestation, signed by the credential itself
+			if alg != key.Algorithm || !key.Verify(signed, sig) {
+				return fmt.Errorf("%w: invalid self attestation", ErrInvalidResponse)
+			}
+
+			return nil
+		}
+		der, _ := x5c[0].([]byte)
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return fmt.Errorf("%w: invalid attestation certificate: %s", ErrInvalidResponse, err)
+		}
+		attKey := &PublicKey{Algorithm: alg, Key: cert.PublicKey}
+		if !attKey.Verify(signed, sig) {
+			return fmt.Errorf("%w: invalid attestation signature", ErrInvalidResponse)
+		}
+
+		return nil
+	}
+
+	return fmt.Errorf("%w: unsupported attestation format %q", ErrInvalidResponse, att.Format)
+}
+
+func descriptors(creds []Credential) []CredentialDescriptor {
+	d := make([]CredentialDescriptor, 0, len(creds))
+	for _, c := range creds {
+		d = append(d, CredentialDescriptor{Type: "public-key", ID: c.ID, Transports: c.Transports})
+	}
+
+	return d
+}
@@ -0,0 +1,240 @@
+package webauthn_test
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"testing"
+	"time"
+
+	"github.com/efimovalex/replaceme/internal/webauthn"
+	"github.com/efimovalex/replaceme/internal/webauthn/webauthntest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testOrigin = "https://app.replaceme.com"
+
+func testRelyingParty() *webauthn.RelyingParty {
+	return &webauthn.RelyingParty{
+		ID:      "replaceme.com",
+		Name:    "Replaceme",
+		Origins: []string{testOrigin},
+		Timeout: time.Minute,
+	}
+}
+
+func register(t *testing.T, rp *webauthn.RelyingParty, a *webauthntest.Authenticator) *webauthn.Credential {
+	challenge, err := webauthn.NewChallenge()
+	require.NoError(t, err)
+	opts := rp.CreationOptions(webauthn.User{ID: []byte("1"), Name: "user@replaceme.com"}, challenge, nil)
+	resp, err := a.Register(opts)
+	require.NoError(t, err)
+	cred, err := rp.VerifyRegistration(resp, challenge)
+	require.NoError(t, err)
+
+	return cred
+}
+
+func TestRelyingParty_Ceremonies(t *testing.T) {
+	rp := testRelyingParty()
+	a, err := webauthntest.New(testOrigin)
+	require.NoError(t, err)
+
+	cred := register(t, rp, a)
+	assert.Equal(t, a.CredentialID, cred.ID)
+	assert.Equal(t, uint32(0), cred.SignCount)
+	assert.Equal(t, []string{"internal"}, cred.Transports)
+
+	for i := 1; i <= 2; i++ {
+		challenge, err := webauthn.NewChallenge()
+		require.NoError(t, err)
+		resp, err := a.Assert(rp.RequestOptions(challenge, []webauthn.Credential{*cred}))
+		require.NoError(t, err)
+		count, verified, err := rp.VerifyAssertion(resp, challenge, cred)
+		require.NoError(t, err)
+		assert.Equal(t, uint32(i), count)
+		assert.False(t, verified)
+		cred.SignCount = count
+	}
+
+	t.Run("user verified", func(t *testing.T) {
+		a.UserVerified = true
+		defer func() { a.UserVerified = false }()
+		challenge, _ := webauthn.NewChallenge()
+		resp, err := a.Assert(rp.RequestOptions(challenge, nil))
+		require.NoError(t, err)
+		_, verified, err := rp.VerifyAssertion(resp, challenge, cred)
+		require.NoError(t, err)
+		assert.True(t, verified)
+	})
+}
+
+func TestRelyingParty_VerifyAssertion_Clone(t *testing.T) {
+	rp := testRelyingParty()
+	a, err := webauthntest.New(testOrigin)
+	require.NoError(t, err)
+	cred := register(t, rp, a)
+	clone := a.Clone()
+
+	challenge, _ := webauthn.NewChallenge()
+	resp, err := a.Assert(rp.RequestOptions(challenge, nil))
+	require.NoError(t, err)
+	cred.SignCount, _, err = rp.VerifyAssertion(resp, challenge, cred)
+	require.NoError(t, err)
+
+	// the clone signs with the counter the original had when it was copied
+	challenge, _ = webauthn.NewChallenge()
+	resp, err = clone.Assert(rp.RequestOptions(challenge, nil))
+	require.NoError(t, err)
+	_, _, err = rp.VerifyAssertion(resp, challenge, cred)
+	assert.ErrorIs(t, err, webauthn.ErrCounterRegression)
+
+	t.Run("no counter", func(t *testing.T) {
+		a, err := webauthntest.New(testOrigin)
+		require.NoError(t, err)
+		a.NoCounter = true
+		cred := register(t, rp, a)
+		for i := 0; i < 2; i++ {
+			challenge, _ := webauthn.NewChallenge()
+			resp, err := a.Assert(rp.RequestOptions(challenge, nil))
+			require.NoError(t, err)
+			count, _, err := rp.VerifyAssertion(resp, challenge, cred)
+			require.NoError(t, err)
+			assert.Equal(t, uint32(0), count)
+		}
+	})
+}
+
+func TestRelyingParty_Errors(t *testing.T) {
+	rp := testRelyingParty()
+	a, err := webauthntest.New(testOrigin)
+	require.NoError(t, err)
+	challenge, _ := webauthn.NewChallenge()
+	reg, err := a.Register(rp.CreationOptions(webauthn.User{ID: []byte("1")}, challenge, nil))
+	require.NoError(t, err)
+	cred, err := rp.VerifyRegistration(reg, challenge)
+	require.NoError(t, err)
+
+	t.Run("registration challenge mismatch", func(t *testing.T) {
+		other, _ := webauthn.NewChallenge()
+		_, err := rp.VerifyRegistration(reg, other)
+		assert.ErrorIs(t, err, webauthn.ErrInvalidResponse)
+	})
+
+	t.Run("origin not allowed", func(t *testing.T) {
+		evil, err := webauthntest.New("https://evil.com")
+		require.NoError(t, err)
+		challenge, _ := webauthn.NewChallenge()
+		resp, err := evil.Register(rp.CreationOptions(webauthn.User{ID: []byte("1")}, challenge, nil))
+		require.NoError(t, err)
+		_, err = rp.VerifyRegistration(resp, challenge)
+		assert.ErrorIs(t, err, webauthn.ErrInvalidResponse)
+	})
+
+	t.Run("relying party mismatch", func(t *testing.T) {
+		challenge, _ := webauthn.NewChallenge()
+		opts := rp.RequestOptions(challenge, nil)
+		opts.RPID = "evil.com"
+		resp, err := a.Assert(opts)
+		require.NoError(t, err)
+		_, _, err = rp.VerifyAssertion(resp, challenge, cred)
+		assert.ErrorIs(t, err, webauthn.ErrInvalidResponse)
+	})
+
+	t.Run("user verification required", func(t *testing.T) {
+		rp := testRelyingParty()
+		rp.UserVerification = webauthn.UserVerificationRequired
+		challenge, _ := webauthn.NewChallenge()
+		resp, err := a.Assert(rp.RequestOptions(challenge, nil))
+		require.NoError(t, err)
+		_, _, err = rp.VerifyAssertion(resp, challenge, cred)
+		assert.ErrorIs(t, err, webauthn.ErrInvalidResponse)
+	})
+
+	t.Run("assertion used as registration", func(t *testing.T) {
+		challenge, _ := webauthn.NewChallenge()
+		resp, err := a.Assert(rp.RequestOptions(challenge, nil))
+		require.NoError(t, err)
+		reg := &webauthn.RegistrationResponse{RawID: resp.RawID}
+		reg.Response.ClientDataJSON = resp.Response.ClientDataJSON
+		_, err = rp.VerifyRegistration(reg, challenge)
+		assert.ErrorIs(t, err, webauthn.ErrInvalidResponse)
+	})
+
+	t.Run("tampered signature", func(t *testing.T) {
+		challenge, _ := webauthn.NewChallenge()
+		resp, err := a.Assert(rp.RequestOptions(challenge, nil))
+		require.NoError(t, err)
+		resp.Response.AuthenticatorData[36]++
+		_, _, err = rp.VerifyAssertion(resp, challenge, cred)
+		assert.ErrorIs(t, err, webauthn.ErrInvalidResponse)
+	})
+
+	t.Run("other credential", func(t *testing.T) {
+		other, err := webauthntest.New(testOrigin)
+		require.NoError(t, err)
+		challenge, _ := webauthn.NewChallenge()
+		resp, err := other.Assert(rp.RequestOptions(challenge, nil))
+		require.NoError(t, err)
+		_, _, err = rp.VerifyAssertion(resp, challenge, cred)
+		assert.ErrorIs(t, err, webauthn.ErrInvalidResponse)
+	})
+}
+
+func TestPublicKey(t *testing.T) {
+	data := []byte("signed data")
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name string
+		key  interface{ Public() crypto.PublicKey }
+		alg  int
+	}{
+		{"ES256", ecKey, webauthn.AlgES256},
+		{"EdDSA", edKey, webauthn.AlgEdDSA},
+		{"RS256", rsaKey, webauthn.AlgRS256},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cose, err := webauthn.EncodePublicKey(tt.key.Public())
+			require.NoError(t, err)
+			key, err := webauthn.ParsePublicKey(cose)
+			require.NoError(t, err)
+			assert.Equal(t, tt.alg, key.Algorithm)
+
+			sig := sign(t, tt.key, data)
+			assert.True(t, key.Verify(data, sig))
+			assert.False(t, key.Verify([]byte("other data"), sig))
+		})
+	}
+}
+
+func sign(t *testing.T, key interface{}, data []byte) []byte {
+	var (
+		sig []byte
+		err error
+	)
+	sum := sha256.Sum256(data)
+	switch key := key.(type) {
+	case *ecdsa.PrivateKey:
+		sig, err = ecdsa.SignASN1(rand.Reader, key, sum[:])
+	case ed25519.PrivateKey:
+		sig = ed25519.Sign(key, data)
+	case *rsa.PrivateKey:
+		sig, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+	}
+	require.NoError(t, err)
+
+	return sig
+}
@@ -0,0 +1,142 @@
+// Package webauthntest provides a software authenticator to run the WebAuthn ceremonies in tests
+package webauthntest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+
+	"github.com/efimovalex/replaceme/internal/webauthn"
+	"github.com/fxamacker/cbor/v2"
+)
+
+// Authenticator is a software authenticator holding a single ES256 credential
+type Authenticator struct {
+	Origin       string
+	CredentialID []byte
+	UserHandle   []byte
+	SignCount    uint32
+	// UserVerified sets the user verified flag of the responses
+	UserVerified bool
+	// NoCounter makes the authenticator always send a signature counter of 0, as some passkey providers do
+	NoCounter bool
+
+	key *ecdsa.PrivateKey
+}
+
+// New creates an authenticator for the pages of origin
+func New(origin string) (*Authenticator, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+
+	return &Authenticator{Origin: origin, CredentialID: id, key: key}, nil
+}
+
+// Clone returns an authenticator with the same credential and counter, as an attacker copying the key would have
+func (a *Authenticator) Clone() *Authenticator {
+	c := *a
+
+	return &c
+}
+
+// Register creates the credential for the options of a registration ceremony, with a none attestation
+func (a *Authenticator) Register(opts webauthn.CreationOptions) (*webauthn.RegistrationResponse, error) {
+	a.UserHandle = opts.User.ID
+	clientDataJSON, err := a.clientData(webauthn.ClientDataTypeCreate, opts.Challenge)
+	if err != nil {
+		return nil, err
+	}
+	publicKey, err := webauthn.EncodePublicKey(&a.key.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	authData := a.authData(opts.RP.ID, webauthn.FlagAttestedCredData)
+	authData = append(authData, make([]byte, 16)...) // AAGUID
+	authData = append(authData, byte(len(a.CredentialID)>>8), byte(len(a.CredentialID)))
+	authData = append(authData, a.CredentialID...)
+	authData = append(authData, publicKey...)
+
+	attestationObject, err := cbor.Marshal(map[string]interface{}{
+		"fmt":      "none",
+		"attStmt":  map[string]interface{}{},
+		"authData": authData,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &webauthn.RegistrationResponse{
+		ID:    base64.RawURLEncoding.EncodeToString(a.CredentialID),
+		RawID: a.CredentialID,
+		Type:  "public-key",
+		Response: webauthn.AttestationResponse{
+			ClientDataJSON:    clientDataJSON,
+			AttestationObject: attestationObject,
+			Transports:        []string{"internal"},
+		},
+	}, nil
+}
+
+// Assert signs the challenge of the options of an authentication ceremony, incrementing the signature counter
+func (a *Authenticator) Assert(opts webauthn.RequestOptions) (*webauthn.AssertionResponse, error) {
+	if !a.NoCounter {
+		a.SignCount++
+	}
+	clientDataJSON, err := a.clientData(webauthn.ClientDataTypeGet, opts.Challenge)
+	if err != nil {
+		return nil, err
+	}
+	authData := a.authData(opts.RPID, 0)
+
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	sum := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+	sig, err := ecdsa.SignASN1(rand.Reader, a.key, sum[:])
+	if err != nil {
+		return nil, err
+	}
+
+	return &webauthn.AssertionResponse{
+		ID:    base64.RawURLEncoding.EncodeToString(a.CredentialID),
+		RawID: a.CredentialID,
+		Type:  "public-key",
+		Response: webauthn.AssertionAuthenticatorResponse{
+			ClientDataJSON:    clientDataJSON,
+			AuthenticatorData: authData,
+			Signature:         sig,
+			UserHandle:        a.UserHandle,
+		},
+	}, nil
+}
+
+func (a *Authenticator) clientData(typ string, challenge []byte) ([]byte, error) {
+	return json.Marshal(webauthn.CollectedClientData{
+		Type:      typ,
+		Challenge: base64.RawURLEncoding.EncodeToString(challenge),
+		Origin:    a.Origin,
+	})
+}
+
+func (a *Authenticator) authData(rpID string, flags byte) []byte {
+	rpIDHash := sha256.Sum256([]byte(rpID))
+	flags |= webauthn.FlagUserPresent
+	if a.UserVerified {
+		flags |= webauthn.FlagUserVerified
+	}
+	authData := make([]byte, 37)
+	copy(authData, rpIDHash[:])
+	authData[32] = flags
+	binary.BigEndian.PutUint32(authData[33:], a.SignCount)
+
+	return authData
+}
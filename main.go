@@ -17,9 +17,6 @@ const (
 	exitFail = 1
 )
 
-// @title replaceme API
-// @version 1.0
-// @basePath /
 // main entry point for the service
 func main() {
 	err := run(os.Args, os.Stdout)
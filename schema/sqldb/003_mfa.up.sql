@@ -0,0 +1,17 @@
+CREATE TABLE user_totp (
+    user_id INTEGER PRIMARY KEY REFERENCES users (id) ON DELETE CASCADE,
+    -- secret is the base32 TOTP secret encrypted with the MFA encryption key
+    secret TEXT NOT NULL,
+    confirmed_at TIMESTAMP NULL,
+    -- last_used_step is the time step of the last accepted code, a code is only accepted once
+    last_used_step BIGINT NOT NULL DEFAULT 0,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE user_recovery_codes (
+    id serial PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    code_hash VARCHAR ( 64 ) NOT NULL,
+    used_at TIMESTAMP NULL,
+    UNIQUE (user_id, code_hash)
+);
@@ -0,0 +1,16 @@
+CREATE TABLE webauthn_credentials (
+    -- id is the base64url encoded credential id chosen by the authenticator
+    id TEXT PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    -- public_key is the COSE encoded public key of the credential
+    public_key BYTEA NOT NULL,
+    -- sign_count is the last signature counter sent by the authenticator, it must increase to detect clones
+    sign_count BIGINT NOT NULL DEFAULT 0,
+    transports TEXT NOT NULL DEFAULT '',
+    aaguid BYTEA NULL,
+    name VARCHAR ( 100 ) NOT NULL DEFAULT '',
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    last_used_at TIMESTAMP NULL
+);
+
+CREATE INDEX webauthn_credentials_user_id_idx ON webauthn_credentials (user_id);
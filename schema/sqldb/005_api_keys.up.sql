@@ -0,0 +1,15 @@
+CREATE TABLE api_keys (
+    id SERIAL PRIMARY KEY,
+    -- prefix is the visible start of the key, it finds the key and tells keys apart in lists and logs
+    prefix VARCHAR ( 32 ) UNIQUE NOT NULL,
+    -- secret_hash is the SHA-256 hash of the secret part of the key, the key is only shown when created
+    secret_hash VARCHAR ( 64 ) NOT NULL,
+    name VARCHAR ( 100 ) NOT NULL,
+    -- scopes are the space separated scopes granted to the key
+    scopes TEXT NOT NULL DEFAULT '',
+    -- created_by is the user id of the admin who created the key
+    created_by VARCHAR ( 255 ) NOT NULL DEFAULT '',
+    expires_at TIMESTAMP NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    last_used_at TIMESTAMP NULL
+);
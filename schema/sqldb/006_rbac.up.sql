@@ -0,0 +1,25 @@
+CREATE TABLE roles (
+    id SERIAL PRIMARY KEY,
+    name VARCHAR ( 100 ) UNIQUE NOT NULL,
+    description VARCHAR ( 255 ) NOT NULL DEFAULT '',
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+-- permissions are the permissions granted by each role, e.g. users:read
+CREATE TABLE permissions (
+    role_id INTEGER NOT NULL REFERENCES roles (id) ON DELETE CASCADE,
+    permission VARCHAR ( 100 ) NOT NULL,
+    PRIMARY KEY (role_id, permission)
+);
+
+CREATE TABLE user_roles (
+    -- issuer and user_id are the issuer and the subject of the tokens of the user, as the subjects of two issuers can
+    -- be equal. They are not bound to the users table so that the users of every trusted issuer can get roles.
+    issuer VARCHAR ( 255 ) NOT NULL,
+    user_id VARCHAR ( 255 ) NOT NULL,
+    role_id INTEGER NOT NULL REFERENCES roles (id) ON DELETE CASCADE,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (issuer, user_id, role_id)
+);
+
+CREATE INDEX user_roles_role_id_idx ON user_roles (role_id);
@@ -3,6 +3,7 @@ package healthcheck
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"net"
 	"net/http"
@@ -34,13 +35,13 @@ type HealthCheckResponse struct {
 	Errors  []string `json:"errors,omitempty"`
 }
 
-// New creates a new healthcheck service
-func New(DB Ping, Mongo Ping, Redis Ping, port string) *Health {
+// New creates a new healthcheck service, served over TLS when tlsConfig is not nil
+func New(DB Ping, Mongo Ping, Redis Ping, port string, tlsConfig *tls.Config) *Health {
 	h := &Health{
 		DB:    DB,
 		Mongo: Mongo,
 		Redis: Redis,
-		srv:   &http.Server{Addr: ":" + port},
+		srv:   &http.Server{Addr: ":" + port, TLSConfig: tlsConfig},
 
 		logger: log.With().Str("component", "healthcheck").Logger(),
 	}
@@ -58,7 +59,13 @@ func (h *Health) Start(ctx context.Context) error {
 	if err != nil {
 		return err
 	}
-	if err := h.srv.Serve(ln); err != http.ErrServerClosed {
+	if h.srv.TLSConfig != nil {
+		// the certificates are provided by the TLS config
+		err = h.srv.ServeTLS(ln, "", "")
+	} else {
+		err = h.srv.Serve(ln)
+	}
+	if err != http.ErrServerClosed {
 		// Error starting or closing listener:
 		h.logger.Fatal().Msgf("healthcheck server error: %v", err)
 		return err
@@ -34,7 +34,7 @@ func TestHealth_Check(t *testing.T) {
 		mongoClientMock := mongodb.ClientMock{}
 		mongoClientMock.On("Ping").Return(nil)
 
-		h := New(&postgres.Client{DB: sqlxMock}, &mongoClientMock, &redisdb.Client{DB: redisClientMock}, "")
+		h := New(&postgres.Client{DB: sqlxMock}, &mongoClientMock, &redisdb.Client{DB: redisClientMock}, "", nil)
 
 		req, err := http.NewRequest("GET", "/healthcheck", nil)
 		assert.NoError(t, err)
@@ -60,7 +60,7 @@ func TestHealth_Check(t *testing.T) {
 		mongoClientMock := mongodb.ClientMock{}
 		mongoClientMock.On("Ping").Return(errors.New("mongo error"))
 
-		h := New(&postgres.Client{DB: sqlxMock}, &mongoClientMock, &redisdb.Client{DB: redisClientMock}, "")
+		h := New(&postgres.Client{DB: sqlxMock}, &mongoClientMock, &redisdb.Client{DB: redisClientMock}, "", nil)
 
 		req, err := http.NewRequest("GET", "/healthcheck", nil)
 		assert.NoError(t, err)
@@ -88,7 +88,7 @@ func TestHealth_StopGrecefully(t *testing.T) {
 	mongoClientMock := mongodb.ClientMock{}
 	mongoClientMock.On("Ping").Return(nil)
 
-	h := New(&postgres.Client{DB: sqlxMock}, &mongoClientMock, &redisdb.Client{DB: redisClientMock}, "")
+	h := New(&postgres.Client{DB: sqlxMock}, &mongoClientMock, &redisdb.Client{DB: redisClientMock}, "", nil)
 
 	testServer := httptest.NewServer(http.HandlerFunc(h.Check))
 	defer testServer.Close()
@@ -125,7 +125,7 @@ func TestHealth_StopDeadline(t *testing.T) {
 	mongoClientMock := mongodb.ClientMock{}
 	mongoClientMock.On("Ping").Return(nil)
 
-	h := New(&postgres.Client{DB: sqlxMock}, &mongoClientMock, &redisdb.Client{DB: redisClientMock}, "")
+	h := New(&postgres.Client{DB: sqlxMock}, &mongoClientMock, &redisdb.Client{DB: redisClientMock}, "", nil)
 
 	testServer := httptest.NewServer(http.HandlerFunc(h.Check))
 	defer testServer.Close()
@@ -162,7 +162,7 @@ func TestHealth_JSON(t *testing.T) {
 	mongoClientMock := mongodb.ClientMock{}
 	mongoClientMock.On("Ping").Return(nil)
 
-	h := New(&postgres.Client{DB: sqlxMock}, &mongoClientMock, &redisdb.Client{DB: redisClientMock}, "")
+	h := New(&postgres.Client{DB: sqlxMock}, &mongoClientMock, &redisdb.Client{DB: redisClientMock}, "", nil)
 
 	type args struct {
 		w      http.ResponseWriter
@@ -227,7 +227,7 @@ func TestHealth_Start(t *testing.T) {
 		w.WriteHeader(http.StatusOK)
 	}))
 	t.Log(testServer.URL)
-	h := New(&postgres.Client{DB: sqlxMock}, &mongoClientMock, &redisdb.Client{DB: redisClientMock}, "not:a:port")
+	h := New(&postgres.Client{DB: sqlxMock}, &mongoClientMock, &redisdb.Client{DB: redisClientMock}, "not:a:port", nil)
 
 	err = h.Start(context.Background())
 
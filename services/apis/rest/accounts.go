@@ -0,0 +1,295 @@
+package rest
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/efimovalex/replaceme/adapters/postgres"
+	"github.com/efimovalex/replaceme/internal/apperr"
+	"github.com/efimovalex/replaceme/internal/mailer"
+	"github.com/efimovalex/replaceme/internal/requestid"
+	"github.com/labstack/echo/v4"
+)
+
+// Purposes of the emailed single-use tokens
+const (
+	tokenPurposePasswordReset     = "password-reset"
+	tokenPurposeEmailVerification = "email-verification"
+	tokenPurposeMagicLink         = "magic-link"
+)
+
+// UserTokenStore is the interface for the store of the single-use tokens sent to users
+type UserTokenStore interface {
+	CreateUserToken(ctx context.Context, purpose, userID, tokenHash string, ttl time.Duration) error
+	ConsumeUserToken(ctx context.Context, purpose, tokenHash string) (string, error)
+	RestoreUserToken(ctx context.Context, purpose, userID, tokenHash string) error
+}
+
+// EmailRequest is the request body of the endpoints emailing a link to a user
+type EmailRequest struct {
+	XMLName xml.Name `json:"-" xml:"email_request"`
+	Email   string   `json:"email" xml:"email" validate:"required,email,max=255" format:"email" example:"jane.doe@replaceme.com"`
+}
+
+// ResetPasswordRequest is the request body of the password reset endpoint
+type ResetPasswordRequest struct {
+	XMLName  xml.Name `json:"-" xml:"password_reset"`
+	Token    string   `json:"token" xml:"token" validate:"required,max=255"`
+	Password string   `json:"password" xml:"password" validate:"required,min=8,max=72" example:"n3w-s3cr3t-p4ss"`
+}
+
+// VerifyEmailRequest is the request body of the email verification endpoint
+type VerifyEmailRequest struct {
+	XMLName xml.Name `json:"-" xml:"email_verification"`
+	Token   string   `json:"token" xml:"token" validate:"required,max=255"`
+}
+
+// RequestPasswordReset emails a password reset link to a user
+// @Summary [post] /auth/password/forgot
+// @Description Emails a single-use password reset link if an active user has the email. The response is the same
+// @Description whether or not the email is known.
+// @Tags auth
+// @Accept  json,application/msgpack,application/cbor,xml
+// @Produce json,application/msgpack,application/cbor,xml
+// @Param email body EmailRequest true "email"
+// @Success 202 "Accepted"
+// @Failure 400 {object} Problem "Invalid request JSON"
+// @Failure 422 {object} Problem "Params validation error"
+// @Failure 500 {object} Problem "Internal server error"
+// @Failure 503 {object} Problem "Token store unavailable"
+// @Router /auth/password/forgot [post]
+func (rest *R) RequestPasswordReset(c echo.Context) error {
+	var req EmailRequest
+	if err := rest.Bind(c, &req); err != nil {
+		return err
+	}
+	if rest.UserTokens == nil {
+		return apperr.Unavailable(apperr.CodeUnavailable, "token store unavailable")
+	}
+
+	ctx := c.Request().Context()
+	active := true
+	u, err := rest.DB.FindOneUserByEmail(ctx, req.Email, &active)
+	if err != nil {
+		return err
+	}
+	if u != nil {
+		rest.sendUserToken(c, u, tokenPurposePasswordReset, "")
+	}
+
+	return c.NoContent(http.StatusAccepted)
+}
+
+// ResetPassword sets a new password with the token of a password reset link
+// @Summary [post] /auth/password/reset
+// @Description Sets a new password with the token of a password reset link, and logs the user out of every session.
+// @Description The token can only be used once.
+// @Tags auth
+// @Accept  json,application/msgpack,application/cbor,xml
+// @Produce json,application/msgpack,application/cbor,xml
+// @Param reset body ResetPasswordRequest true "token and new password"
+// @Success 204 "Password changed"
+// @Failure 400 {object} Problem "Invalid request JSON"
+// @Failure 422 {object} Problem "Invalid or expired token, or params validation error"
+// @Failure 500 {object} Problem "Internal server error"
+// @Failure 503 {object} Problem "Token store unavailable"
+// @Router /auth/password/reset [post]
+func (rest *R) ResetPassword(c echo.Context) error {
+	var req ResetPasswordRequest
+	if err := rest.Bind(c, &req); err != nil {
+		return err
+	}
+
+	ctx := c.Request().Context()
+	u, err := rest.useUserToken(ctx, tokenPurposePasswordReset, req.Token, func(u *postgres.User) error {
+		return rest.DB.UpdateUserPassword(ctx, u.ID, req.Password)
+	})
+	if err != nil {
+		return err
+	}
+	rest.InvalidateCache(ctx, usersCacheTag, userCacheTag(strconv.Itoa(u.ID)))
+	// sessions opened with the old password may be the reason of the reset
+	if rest.Sessions != nil {
+		if err := rest.Sessions.RevokeUserSessions(ctx, strconv.Itoa(u.ID), rest.Tokens.TTL()); err != nil {
+			requestid.Logger(ctx, rest.logger).Error().Err(err).Int("user_id", u.ID).Msg("failed to revoke sessions after password reset")
+		}
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// RequestEmailVerification emails an email verification link to a user
+// @Summary [post] /auth/email/verification
+// @Description Emails a single-use verification link if an active user with an unverified email has the email.
+// @Description The response is the same whether or not the email is known.
+// @Tags auth
+// @Accept  json,application/msgpack,application/cbor,xml
+// @Produce json,application/msgpack,application/cbor,xml
+// @Param email body EmailRequest true "email"
+// @Success 202 "Accepted"
+// @Failure 400 {object} Problem "Invalid request JSON"
+// @Failure 422 {object} Problem "Params validation error"
+// @Failure 500 {object} Problem "Internal server error"
+// @Failure 503 {object} Problem "Token store unavailable"
+// @Router /auth/email/verification [post]
+func (rest *R) RequestEmailVerification(c echo.Context) error {
+	var req EmailRequest
+	if err := rest.Bind(c, &req); err != nil {
+		return err
+	}
+	if rest.UserTokens == nil {
+		return apperr.Unavailable(apperr.CodeUnavailable, "token store unavailable")
+	}
+
+	ctx := c.Request().Context()
+	active := true
+	u, err := rest.DB.FindOneUserByEmail(ctx, req.Email, &active)
+	if err != nil {
+		return err
+	}
+	if u != nil && u.EmailVerifiedAt == nil {
+		rest.sendUserToken(c, u, tokenPurposeEmailVerification, "")
+	}
+
+	return c.NoContent(http.StatusAccepted)
+}
+
+// VerifyEmail verifies the email of a user with the token of a verification link
+// @Summary [post] /auth/email/verify
+// @Description Verifies the email of a user with the token of a verification link, the token can only be used once
+// @Tags auth
+// @Accept  json,application/msgpack,application/cbor,xml
+// @Produce json,application/msgpack,application/cbor,xml
+// @Param verification body VerifyEmailRequest true "token"
+// @Success 204 "Email verified"
+// @Failure 400 {object} Problem "Invalid request JSON"
+// @Failure 422 {object} Problem "Invalid or expired token, or params validation error"
+// @Failure 500 {object} Problem "Internal server error"
+// @Failure 503 {object} Problem "Token store unavailable"
+// @Router /auth/email/verify [post]
+func (rest *R) VerifyEmail(c echo.Context) error {
+	var req VerifyEmailRequest
+	if err := rest.Bind(c, &req); err != nil {
+		return err
+	}
+
+	ctx := c.Request().Context()
+	u, err := rest.useUserToken(ctx, tokenPurposeEmailVerification, req.Token, func(u *postgres.User) error {
+		return rest.DB.MarkUserEmailVerified(ctx, u.ID)
+	})
+	if err != nil {
+		return err
+	}
+	rest.InvalidateCache(ctx, usersCacheTag, userCacheTag(strconv.Itoa(u.ID)))
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// useUserToken consumes a single-use token for purpose, calls use with its active user and returns the user.
+// The token is consumed first so that concurrent requests cannot both use it, and it is restored when the user cannot
+// be loaded or use fails, e.g. on a database error, so that the link keeps working.
+func (rest *R) useUserToken(ctx context.Context, purpose, token string, use func(u *postgres.User) error) (*postgres.User, error) {
+	if rest.UserTokens == nil {
+		return nil, apperr.Unavailable(apperr.CodeUnavailable, "token store unavailable")
+	}
+
+	tokenHash := hashToken(token)
+	userID, err := rest.UserTokens.ConsumeUserToken(ctx, purpose, tokenHash)
+	if err != nil {
+		return nil, apperr.Unavailable(apperr.CodeUnavailable, "token store unavailable").Wrap(err)
+	}
+	if userID == "" {
+		return nil, apperr.Validation(apperr.CodeInvalidToken, "invalid or expired token")
+	}
+	id, err := strconv.Atoi(userID)
+	if err != nil {
+		return nil, apperr.Internal(err)
+	}
+	u, err := rest.DB.FindOneUserByID(ctx, id)
+	if err == nil && (u == nil || !u.Active) {
+		return nil, apperr.Validation(apperr.CodeInvalidToken, "invalid or expired token")
+	}
+	if err == nil {
+		err = use(u)
+	}
+	if err != nil {
+		// the token must be restored even if the request was cancelled
+		if restoreErr := rest.UserTokens.RestoreUserToken(context.Background(), purpose, userID, tokenHash); restoreErr != nil {
+			requestid.Logger(ctx, rest.logger).Error().Err(restoreErr).Str("user_id", userID).Msg("failed to restore the user token")
+		}
+
+		return nil, err
+	}
+
+	return u, nil
+}
+
+// sendUserToken emails a link carrying a new single-use token of the user for purpose, in the language of the
+// request's Accept-Language. A token bound to a nonce only works together with it, see bindToken.
+// Failures are only logged, they must not tell whether the email belongs to a user.
+func (rest *R) sendUserToken(c echo.Context, u *postgres.User, purpose, nonce string) {
+	ctx := c.Request().Context()
+	logger := requestid.Logger(ctx, rest.logger).With().Str("purpose", purpose).Int("user_id", u.ID).Logger()
+	if rest.UserTokens == nil || rest.Mailer == nil {
+		logger.Warn().Msg("no token store or mailer, the email is not sent")
+		return
+	}
+
+	template, base, ttl := mailer.TemplatePasswordReset, rest.cfg.Accounts.PasswordResetURL, rest.cfg.Accounts.PasswordResetTTL
+	switch purpose {
+	case tokenPurposeEmailVerification:
+		template, base, ttl = mailer.TemplateEmailVerification, rest.cfg.Accounts.EmailVerificationURL, rest.cfg.Accounts.EmailVerificationTTL
+	case tokenPurposeMagicLink:
+		template, base, ttl = mailer.TemplateMagicLink, rest.cfg.MagicLink.URL, rest.cfg.MagicLink.TTL
+	}
+	token := newOpaqueToken()
+	if err := rest.UserTokens.CreateUserToken(ctx, purpose, strconv.Itoa(u.ID), hashToken(bindToken(token, nonce)), ttl); err != nil {
+		logger.Error().Err(err).Msg("failed to store the emailed token")
+		return
+	}
+	link, err := tokenLink(base, token)
+	if err != nil {
+		logger.Error().Err(err).Msg("failed to build the emailed link")
+		return
+	}
+	msg, err := mailer.Render(template, c.Request().Header.Get("Accept-Language"), mailer.LinkData{Name: u.FirstName, Link: link, ValidFor: ttl})
+	if err != nil {
+		logger.Error().Err(err).Msg("failed to render the email")
+		return
+	}
+	msg.To = u.Email
+	if err := rest.Mailer.Send(ctx, msg); err != nil {
+		logger.Error().Err(err).Msg("failed to send the email")
+	}
+}
+
+// bindToken binds an emailed token to a nonce kept by the browser which asked for it, only the hash of both is
+// stored so a leaked link does not work without the nonce
+func bindToken(token, nonce string) string {
+	if nonce == "" {
+		return token
+	}
+
+	return token + "." + nonce
+}
+
+// tokenLink adds the token to the query of the link
+func tokenLink(base, token string) (string, error) {
+	u, err := url.Parse(base)
+	if err != nil {
+		return "", err
+	}
+	if !u.IsAbs() {
+		return "", errors.New("link is not an absolute URL")
+	}
+	q := u.Query()
+	q.Set("token", token)
+	u.RawQuery = q.Encode()
+
+	return u.String(), nil
+}
@@ -0,0 +1,421 @@
+package rest
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/efimovalex/replaceme/adapters/redisdb"
+	"github.com/efimovalex/replaceme/config"
+	"github.com/efimovalex/replaceme/internal/mailer"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	accountUserColumns       = append(append([]string{}, userColumns...), "email_verified_at")
+	updateUserPasswordQuery  = regexp.QuoteMeta(`UPDATE users SET password = $1, email_verified_at = COALESCE(email_verified_at, CURRENT_TIMESTAMP), updated_at = CURRENT_TIMESTAMP WHERE id = $2`)
+	markUserEmailVerifiedSQL = regexp.QuoteMeta(`UPDATE users SET email_verified_at = COALESCE(email_verified_at, CURRENT_TIMESTAMP), updated_at = CURRENT_TIMESTAMP WHERE id = $1`)
+	testAccountsConfig       = config.Accounts{
+		RequireVerifiedEmail: true,
+		PasswordResetURL:     "https://app.replaceme.test/reset-password?lang=en",
+		PasswordResetTTL:     time.Hour,
+		EmailVerificationURL: "https://app.replaceme.test/verify-email",
+		EmailVerificationTTL: 48 * time.Hour,
+	}
+)
+
+// userTokenStoreMock is an in-memory UserTokenStore
+type userTokenStoreMock struct {
+	mu     sync.Mutex
+	tokens map[string]string
+	err    error
+}
+
+func newUserTokenStoreMock() *userTokenStoreMock {
+	return &userTokenStoreMock{tokens: map[string]string{}}
+}
+
+func (m *userTokenStoreMock) CreateUserToken(ctx context.Context, purpose, userID, tokenHash string, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return m.err
+	}
+	m.tokens[purpose+":"+tokenHash] = userID
+
+	return nil
+}
+
+func (m *userTokenStoreMock) ConsumeUserToken(ctx context.Context, purpose, tokenHash string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return "", m.err
+	}
+	userID := m.tokens[purpose+":"+tokenHash]
+	delete(m.tokens, purpose+":"+tokenHash)
+
+	return userID, nil
+}
+
+func (m *userTokenStoreMock) RestoreUserToken(ctx context.Context, purpose, userID, tokenHash string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return m.err
+	}
+	m.tokens[purpose+":"+tokenHash] = userID
+
+	return nil
+}
+
+// newTestAccountsREST creates a REST instance with in-memory token store and mailer
+func newTestAccountsREST(t *testing.T) (*R, sqlmock.Sqlmock, *userTokenStoreMock, *mailer.Fake) {
+	r, mock := NewTestRESTWithMock(t)
+	r.cfg.Accounts = testAccountsConfig
+	tokens := newUserTokenStoreMock()
+	m := &mailer.Fake{}
+	r.UserTokens = tokens
+	r.Mailer = m
+
+	return r, mock, tokens, m
+}
+
+// newCachedUserMock returns a response cache holding the response of the user 1
+func newCachedUserMock(t *testing.T) *responseCacheMock {
+	cache := newResponseCacheMock()
+	require.NoError(t, cache.SetCachedResponse(context.Background(), "/v1/users/1", &redisdb.CachedResponse{}, time.Minute, usersCacheTag, userCacheTag("1")))
+
+	return cache
+}
+
+// emailedToken returns the token of the link of an email
+func emailedToken(t *testing.T, msg mailer.Message, linkPrefix string) string {
+	i := strings.Index(msg.Text, linkPrefix)
+	require.GreaterOrEqual(t, i, 0, msg.Text)
+	link := strings.Fields(msg.Text[i:])[0]
+	u, err := url.Parse(link)
+	require.NoError(t, err)
+
+	return u.Query().Get("token")
+}
+
+func postJSON(r *R, path, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	w := httptest.NewRecorder()
+	r.Router.ServeHTTP(w, req)
+
+	return w
+}
+
+func TestREST_RequestPasswordReset(t *testing.T) {
+	createdAt := time.Date(2022, 7, 1, 10, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name               string
+		body               string
+		mock               func(mock sqlmock.Sqlmock)
+		storeErr           error
+		expectedStatusCode int
+		expectedEmails     int
+	}{
+		{
+			name: "Active user",
+			body: `{"email":"jane.doe@replaceme.com"}`,
+			mock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(findActiveUserQuery).WithArgs("jane.doe@replaceme.com", true).WillReturnRows(sqlmock.NewRows(accountUserColumns).
+					AddRow(1, "jane.doe@replaceme.com", "hash", "", "Jane", "Doe", true, createdAt, createdAt, nil))
+			},
+			expectedStatusCode: http.StatusAccepted,
+			expectedEmails:     1,
+		},
+		{
+			name: "Unknown or inactive user",
+			body: `{"email":"john.doe@replaceme.com"}`,
+			mock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(findActiveUserQuery).WithArgs("john.doe@replaceme.com", true).WillReturnRows(sqlmock.NewRows(accountUserColumns))
+			},
+			expectedStatusCode: http.StatusAccepted,
+		},
+		{
+			name: "Token store failure",
+			body: `{"email":"jane.doe@replaceme.com"}`,
+			mock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(findActiveUserQuery).WithArgs("jane.doe@replaceme.com", true).WillReturnRows(sqlmock.NewRows(accountUserColumns).
+					AddRow(1, "jane.doe@replaceme.com", "hash", "", "Jane", "Doe", true, createdAt, createdAt, nil))
+			},
+			storeErr:           errors.New("connection refused"),
+			expectedStatusCode: http.StatusAccepted,
+		},
+		{
+			name:               "Invalid email",
+			body:               `{"email":"not-an-email"}`,
+			mock:               func(mock sqlmock.Sqlmock) {},
+			expectedStatusCode: http.StatusUnprocessableEntity,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, mock, tokens, m := newTestAccountsREST(t)
+			tt.mock(mock)
+			tokens.err = tt.storeErr
+
+			w := postJSON(r, "/v1/auth/password/forgot", tt.body)
+
+			assert.Equal(t, tt.expectedStatusCode, w.Code)
+			checkResponseWithTestDataFile(t, w.Body.Bytes(), []string{"correlation_id"})
+			require.Len(t, m.Messages(), tt.expectedEmails)
+			if tt.expectedEmails == 0 {
+				return
+			}
+
+			msg := m.Messages()[0]
+			assert.Equal(t, "jane.doe@replaceme.com", msg.To)
+			assert.Equal(t, "Reset your password", msg.Subject)
+			assert.Contains(t, msg.Text, "https://app.replaceme.test/reset-password?lang=en&token=")
+			token := emailedToken(t, msg, "https://app.replaceme.test/reset-password")
+			assert.Equal(t, "1", tokens.tokens[tokenPurposePasswordReset+":"+hashToken(token)], "the token is stored hashed")
+		})
+	}
+}
+
+func TestREST_RequestPasswordResetLanguage(t *testing.T) {
+	createdAt := time.Date(2022, 7, 1, 10, 0, 0, 0, time.UTC)
+	r, mock, _, m := newTestAccountsREST(t)
+	mock.ExpectQuery(findActiveUserQuery).WithArgs("jane.doe@replaceme.com", true).WillReturnRows(sqlmock.NewRows(accountUserColumns).
+		AddRow(1, "jane.doe@replaceme.com", "hash", "", "Jane", "Doe", true, createdAt, createdAt, nil))
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/auth/password/forgot", strings.NewReader(`{"email":"jane.doe@replaceme.com"}`))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	req.Header.Set("Accept-Language", "de-DE,de;q=0.9,en;q=0.8")
+	w := httptest.NewRecorder()
+	r.Router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	require.Len(t, m.Messages(), 1)
+	msg := m.Messages()[0]
+	assert.Equal(t, "Passwort zurücksetzen", msg.Subject)
+	assert.Contains(t, msg.Text, "Hallo Jane")
+	assert.Contains(t, msg.HTML, "https://app.replaceme.test/reset-password?lang=en&amp;token=")
+}
+
+func TestREST_ResetPassword(t *testing.T) {
+	createdAt := time.Date(2022, 7, 1, 10, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name               string
+		body               string
+		mock               func(mock sqlmock.Sqlmock)
+		expectedStatusCode int
+		revoked            bool
+		consumed           bool
+	}{
+		{
+			name: "Success",
+			body: `{"token":"reset-token","password":"n3w-s3cr3t-p4ss"}`,
+			mock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(findUserByID).WithArgs(1).WillReturnRows(sqlmock.NewRows(accountUserColumns).
+					AddRow(1, "jane.doe@replaceme.com", "hash", "", "Jane", "Doe", true, createdAt, createdAt, nil))
+				mock.ExpectExec(updateUserPasswordQuery).WithArgs(sqlmock.AnyArg(), 1).WillReturnResult(sqlmock.NewResult(0, 1))
+			},
+			expectedStatusCode: http.StatusNoContent,
+			revoked:            true,
+			consumed:           true,
+		},
+		{
+			name: "Database error",
+			body: `{"token":"reset-token","password":"n3w-s3cr3t-p4ss"}`,
+			mock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(findUserByID).WithArgs(1).WillReturnRows(sqlmock.NewRows(accountUserColumns).
+					AddRow(1, "jane.doe@replaceme.com", "hash", "", "Jane", "Doe", true, createdAt, createdAt, nil))
+				mock.ExpectExec(updateUserPasswordQuery).WithArgs(sqlmock.AnyArg(), 1).WillReturnError(errors.New("connection reset"))
+			},
+			expectedStatusCode: http.StatusInternalServerError,
+		},
+		{
+			name:               "Unknown token",
+			body:               `{"token":"unknown","password":"n3w-s3cr3t-p4ss"}`,
+			mock:               func(mock sqlmock.Sqlmock) {},
+			expectedStatusCode: http.StatusUnprocessableEntity,
+		},
+		{
+			name: "Inactive user",
+			body: `{"token":"reset-token","password":"n3w-s3cr3t-p4ss"}`,
+			mock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(findUserByID).WithArgs(1).WillReturnRows(sqlmock.NewRows(accountUserColumns).
+					AddRow(1, "jane.doe@replaceme.com", "hash", "", "Jane", "Doe", false, createdAt, createdAt, nil))
+			},
+			expectedStatusCode: http.StatusUnprocessableEntity,
+			consumed:           true,
+		},
+		{
+			name:               "Password too short",
+			body:               `{"token":"reset-token","password":"short"}`,
+			mock:               func(mock sqlmock.Sqlmock) {},
+			expectedStatusCode: http.StatusUnprocessableEntity,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, mock, tokens, _ := newTestAccountsREST(t)
+			tt.mock(mock)
+			require.NoError(t, tokens.CreateUserToken(context.Background(), tokenPurposePasswordReset, "1", hashToken("reset-token"), time.Hour))
+			sessions := newSessionStoreMock()
+			r.Sessions = sessions
+			_, accessToken := newTestSession(t, r, sessions, "1", "refresh-1")
+			cache := newCachedUserMock(t)
+			r.Cache = cache
+
+			w := postJSON(r, "/v1/auth/password/reset", tt.body)
+
+			assert.Equal(t, tt.expectedStatusCode, w.Code)
+			checkResponseWithTestDataFile(t, w.Body.Bytes(), []string{"correlation_id"})
+			revoked, err := sessions.IsTokenRevoked(context.Background(), "1", jwtID(t, accessToken))
+			require.NoError(t, err)
+			assert.Equal(t, tt.revoked, revoked, "a password reset logs out everywhere")
+			_, kept := tokens.tokens[tokenPurposePasswordReset+":"+hashToken("reset-token")]
+			assert.Equal(t, tt.consumed, !kept, "a failed reset keeps the token usable")
+			assert.Equal(t, w.Code == http.StatusNoContent, cache.responses["/v1/users/1"] == nil, "the cached user is invalidated")
+			if w.Code != http.StatusNoContent {
+				return
+			}
+
+			// the token is single-use
+			w = postJSON(r, "/v1/auth/password/reset", tt.body)
+			assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+		})
+	}
+}
+
+func TestREST_RequestEmailVerification(t *testing.T) {
+	createdAt := time.Date(2022, 7, 1, 10, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name           string
+		verifiedAt     *time.Time
+		expectedEmails int
+	}{
+		{name: "Unverified email", expectedEmails: 1},
+		{name: "Verified email", verifiedAt: &createdAt},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, mock, tokens, m := newTestAccountsREST(t)
+			mock.ExpectQuery(findActiveUserQuery).WithArgs("jane.doe@replaceme.com", true).WillReturnRows(sqlmock.NewRows(accountUserColumns).
+				AddRow(1, "jane.doe@replaceme.com", "hash", "", "Jane", "Doe", true, createdAt, createdAt, tt.verifiedAt))
+
+			w := postJSON(r, "/v1/auth/email/verification", `{"email":"jane.doe@replaceme.com"}`)
+
+			assert.Equal(t, http.StatusAccepted, w.Code)
+			assert.Empty(t, w.Body.String())
+			require.Len(t, m.Messages(), tt.expectedEmails)
+			if tt.expectedEmails == 0 {
+				return
+			}
+			assert.Equal(t, "Verify your email", m.Messages()[0].Subject)
+			token := emailedToken(t, m.Messages()[0], "https://app.replaceme.test/verify-email")
+			assert.Equal(t, "1", tokens.tokens[tokenPurposeEmailVerification+":"+hashToken(token)])
+		})
+	}
+}
+
+func TestREST_VerifyEmail(t *testing.T) {
+	createdAt := time.Date(2022, 7, 1, 10, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name               string
+		body               string
+		mock               func(mock sqlmock.Sqlmock)
+		expectedStatusCode int
+	}{
+		{
+			name: "Success",
+			body: `{"token":"verification-token"}`,
+			mock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(findUserByID).WithArgs(1).WillReturnRows(sqlmock.NewRows(accountUserColumns).
+					AddRow(1, "jane.doe@replaceme.com", "hash", "", "Jane", "Doe", true, createdAt, createdAt, nil))
+				mock.ExpectExec(markUserEmailVerifiedSQL).WithArgs(1).WillReturnResult(sqlmock.NewResult(0, 1))
+			},
+			expectedStatusCode: http.StatusNoContent,
+		},
+		{
+			name: "Database error",
+			body: `{"token":"verification-token"}`,
+			mock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(findUserByID).WithArgs(1).WillReturnRows(sqlmock.NewRows(accountUserColumns).
+					AddRow(1, "jane.doe@replaceme.com", "hash", "", "Jane", "Doe", true, createdAt, createdAt, nil))
+				mock.ExpectExec(markUserEmailVerifiedSQL).WithArgs(1).WillReturnError(errors.New("connection reset"))
+			},
+			expectedStatusCode: http.StatusInternalServerError,
+		},
+		{
+			name:               "Token of another purpose",
+			body:               `{"token":"reset-token"}`,
+			mock:               func(mock sqlmock.Sqlmock) {},
+			expectedStatusCode: http.StatusUnprocessableEntity,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, mock, tokens, _ := newTestAccountsREST(t)
+			tt.mock(mock)
+			require.NoError(t, tokens.CreateUserToken(context.Background(), tokenPurposeEmailVerification, "1", hashToken("verification-token"), time.Hour))
+			require.NoError(t, tokens.CreateUserToken(context.Background(), tokenPurposePasswordReset, "1", hashToken("reset-token"), time.Hour))
+			cache := newCachedUserMock(t)
+			r.Cache = cache
+
+			w := postJSON(r, "/v1/auth/email/verify", tt.body)
+
+			assert.Equal(t, tt.expectedStatusCode, w.Code)
+			checkResponseWithTestDataFile(t, w.Body.Bytes(), []string{"correlation_id"})
+			_, kept := tokens.tokens[tokenPurposeEmailVerification+":"+hashToken("verification-token")]
+			assert.Equal(t, w.Code == http.StatusNoContent, !kept, "the token is consumed only on success")
+			assert.Equal(t, w.Code == http.StatusNoContent, cache.responses["/v1/users/1"] == nil, "the cached user is invalidated")
+		})
+	}
+}
+
+func TestREST_Login_UnverifiedEmail(t *testing.T) {
+	createdAt := time.Date(2022, 7, 1, 10, 0, 0, 0, time.UTC)
+	hash, err := bcrypt.GenerateFromPassword([]byte("s3cr3t-p4ss"), bcrypt.MinCost)
+	require.NoError(t, err)
+
+	r, mock, _, _ := newTestAccountsREST(t)
+	mock.ExpectQuery(findActiveUserQuery).WithArgs("jane.doe@replaceme.com", true).WillReturnRows(sqlmock.NewRows(accountUserColumns).
+		AddRow(1, "jane.doe@replaceme.com", string(hash), "", "Jane", "Doe", true, createdAt, createdAt, nil))
+
+	w := postJSON(r, "/v1/auth/login", `{"email":"jane.doe@replaceme.com","password":"s3cr3t-p4ss"}`)
+
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	checkResponseWithTestDataFile(t, w.Body.Bytes(), []string{"correlation_id"})
+}
+
+func TestREST_CreateUser_SendsVerification(t *testing.T) {
+	createdAt := time.Date(2022, 7, 1, 10, 0, 0, 0, time.UTC)
+
+	r, mock, tokens, m := newTestAccountsREST(t)
+	mock.ExpectQuery(findUserQuery).WithArgs("jane.doe@replaceme.com").WillReturnRows(sqlmock.NewRows(userColumns))
+	mock.ExpectQuery(findUserQuery).WithArgs("jane.doe@replaceme.com").WillReturnRows(sqlmock.NewRows(userColumns))
+	mock.ExpectQuery(insertUserQuery).WillReturnRows(sqlmock.NewRows(accountUserColumns).
+		AddRow(1, "jane.doe@replaceme.com", "hash", "", "Jane", "Doe", true, createdAt, createdAt, nil))
+
+	w := postJSON(r, "/v1/users", `{"email":"jane.doe@replaceme.com","password":"s3cr3t-p4ss","first_name":"Jane","last_name":"Doe"}`)
+
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	require.Len(t, m.Messages(), 1)
+	assert.Equal(t, "jane.doe@replaceme.com", m.Messages()[0].To)
+	token := emailedToken(t, m.Messages()[0], "https://app.replaceme.test/verify-email")
+	assert.Equal(t, "1", tokens.tokens[tokenPurposeEmailVerification+":"+hashToken(token)])
+}
@@ -0,0 +1,17 @@
+package rest
+
+import "github.com/labstack/echo/v4"
+
+// @title replaceme API
+// @version 1.0
+// @description Version 1 of the replaceme API. Requests to unversioned paths are served by the version
+// @description of the API-Version header, or by the default version.
+// @basePath /v1
+// @securityDefinitions.apikey BearerAuth
+// @in header
+// @name Authorization
+
+// routesV1 registers the routes of the v1 API, the routes shared by all versions
+func (rest *R) routesV1(g *echo.Group) {
+	rest.routes(g)
+}
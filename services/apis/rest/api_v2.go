@@ -0,0 +1,18 @@
+package rest
+
+import "github.com/labstack/echo/v4"
+
+// @title replaceme API
+// @version 2.0
+// @description Version 2 of the replaceme API, breaking changes to the v1 response shapes land here.
+// @description Requests to unversioned paths are served by the version of the API-Version header, or by the default version.
+// @basePath /v2
+// @securityDefinitions.apikey BearerAuth
+// @in header
+// @name Authorization
+
+// routesV2 registers the routes of the v2 API. It starts from the shared routes, a route of v2 which diverges from
+// v1 is registered again after them with its v2 handler, echo keeps the last handler of a method and path.
+func (rest *R) routesV2(g *echo.Group) {
+	rest.routes(g)
+}
@@ -0,0 +1,382 @@
+package rest
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/xml"
+	"net/http"
+	"strings"
+	"time"
+
+	jwtmiddleware "github.com/auth0/go-jwt-middleware/v2"
+	"github.com/auth0/go-jwt-middleware/v2/validator"
+	"github.com/efimovalex/replaceme/adapters/postgres"
+	"github.com/efimovalex/replaceme/internal/apperr"
+	"github.com/efimovalex/replaceme/internal/audit"
+	auth "github.com/efimovalex/replaceme/internal/auth0"
+	"github.com/efimovalex/replaceme/internal/requestid"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// AuthSchemeAPIKey is the Authorization scheme of the API keys, e.g. Authorization: ApiKey rk_1a2b3c4d_...
+	AuthSchemeAPIKey = "ApiKey"
+	// APIKeyIssuer is the issuer of the requests authenticated by an API key, see auth.IssuerValue
+	APIKeyIssuer = "api-key"
+	// apiKeyTag starts the keys, so that secret scanners can find leaked keys
+	apiKeyTag = "rk"
+	// apiKeySubjectPrefix starts the user id of the requests authenticated by an API key
+	apiKeySubjectPrefix = "apikey|"
+)
+
+// APIKeyRequest is the request body of the create API key endpoint
+type APIKeyRequest struct {
+	XMLName xml.Name `json:"-" xml:"api_key"`
+	Name    string   `json:"name" xml:"name" validate:"required,max=100" example:"Nightly export"`
+	// Scopes are granted to the requests authenticated by the key, as the scopes of a token
+	Scopes    []string   `json:"scopes" xml:"scopes>scope" validate:"max=50,dive,required,max=100,excludesall= " example:"users:read"`
+	ExpiresAt *time.Time `json:"expires_at" xml:"expires_at,omitempty"`
+}
+
+// UpdateAPIKeyRequest are the path params and the request body of the update API key endpoint
+type UpdateAPIKeyRequest struct {
+	ID int `json:"-" xml:"-" param:"id" validate:"min=1"`
+	APIKeyRequest
+}
+
+// APIKeyPathRequest are the path params of the API key endpoints
+type APIKeyPathRequest struct {
+	ID int `param:"id" validate:"min=1"`
+}
+
+// APIKey is the public representation of an API key, without its secret
+type APIKey struct {
+	XMLName xml.Name `json:"-" xml:"api_key"`
+	ID      int      `json:"id" xml:"id"`
+	// Prefix is the visible start of the key
+	Prefix     string     `json:"prefix" xml:"prefix" example:"rk_1a2b3c4d"`
+	Name       string     `json:"name" xml:"name"`
+	Scopes     []string   `json:"scopes" xml:"scopes>scope"`
+	CreatedBy  string     `json:"created_by" xml:"created_by"`
+	ExpiresAt  *time.Time `json:"expires_at" xml:"expires_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at" xml:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at" xml:"last_used_at,omitempty"`
+}
+
+// CreatedAPIKey is a new API key with its secret, which is only returned once
+type CreatedAPIKey struct {
+	APIKey
+	// Key is sent in the Authorization header as ApiKey <key>
+	Key string `json:"key" xml:"key"`
+}
+
+// ListAPIKeys returns the API keys
+// @Summary [get] /admin/api-keys
+// @Description Returns the API keys, oldest first, without their secrets. Requires the admin scope.
+// @Tags admin
+// @Accept  json
+// @Produce json,application/msgpack,application/cbor,xml
+// @Security BearerAuth
+// @Success 200 {array} APIKey "API keys"
+// @Failure 401 {object} Problem "Invalid or revoked access token"
+// @Failure 403 {object} Problem "Missing admin scope"
+// @Failure 500 {object} Problem "Internal server error"
+// @Router /admin/api-keys [get]
+func (rest *R) ListAPIKeys(c echo.Context) error {
+	keys, err := rest.DB.FindAPIKeys(c.Request().Context())
+	if err != nil {
+		return err
+	}
+	res := make([]APIKey, 0, len(keys))
+	for i := range keys {
+		res = append(res, newAPIKey(&keys[i]))
+	}
+
+	return rest.Render(c, http.StatusOK, res)
+}
+
+// CreateAPIKey creates an API key
+// @Summary [post] /admin/api-keys
+// @Description Creates an API key for a service or a partner. The key is only returned in this response, only its
+// @Description hash is stored. Requests send it in the Authorization header as ApiKey <key>, and get the scopes of the
+// @Description key. Requires the admin scope.
+// @Tags admin
+// @Accept  json,application/msgpack,application/cbor,xml
+// @Produce json,application/msgpack,application/cbor,xml
+// @Security BearerAuth
+// @Param api_key body APIKeyRequest true "API key"
+// @Param Idempotency-Key header string false "Key making retries of the request safe"
+// @Success 201 {object} CreatedAPIKey "API key with its secret"
+// @Failure 400 {object} Problem "Invalid request JSON"
+// @Failure 401 {object} Problem "Invalid or revoked access token"
+// @Failure 403 {object} Problem "Missing admin scope"
+// @Failure 422 {object} Problem "Params validation error"
+// @Failure 500 {object} Problem "Internal server error"
+// @Router /admin/api-keys [post]
+func (rest *R) CreateAPIKey(c echo.Context) error {
+	var req APIKeyRequest
+	if err := rest.Bind(c, &req); err != nil {
+		return err
+	}
+	if err := validateAPIKeyExpiry(req.ExpiresAt); err != nil {
+		return err
+	}
+
+	ctx := c.Request().Context()
+	actor, _ := auth.UserIDValue(ctx)
+	prefix, secret := newAPIKeySecret()
+	k := postgres.APIKey{
+		Prefix:     prefix,
+		SecretHash: hashToken(secret),
+		Name:       req.Name,
+		Scopes:     strings.Join(req.Scopes, " "),
+		CreatedBy:  actor,
+		ExpiresAt:  utcTime(req.ExpiresAt),
+	}
+	if err := rest.DB.InsertAPIKey(ctx, &k); err != nil {
+		return err
+	}
+	rest.Audit.Record(ctx, audit.Event{Type: audit.EventAPIKeyCreated, Actor: actor, Subject: k.Prefix, IP: c.RealIP()})
+
+	return rest.Render(c, http.StatusCreated, CreatedAPIKey{APIKey: newAPIKey(&k), Key: prefix + "_" + secret})
+}
+
+// GetAPIKey returns an API key
+// @Summary [get] /admin/api-keys/{id}
+// @Description Returns an API key, without its secret. Requires the admin scope.
+// @Tags admin
+// @Accept  json
+// @Produce json,application/msgpack,application/cbor,xml
+// @Security BearerAuth
+// @Param id path int true "API key ID"
+// @Success 200 {object} APIKey "API key"
+// @Failure 401 {object} Problem "Invalid or revoked access token"
+// @Failure 403 {object} Problem "Missing admin scope"
+// @Failure 404 {object} Problem "API key not found"
+// @Failure 422 {object} Problem "Params validation error"
+// @Failure 500 {object} Problem "Internal server error"
+// @Router /admin/api-keys/{id} [get]
+func (rest *R) GetAPIKey(c echo.Context) error {
+	var req APIKeyPathRequest
+	if err := rest.Bind(c, &req); err != nil {
+		return err
+	}
+
+	k, err := rest.DB.FindAPIKey(c.Request().Context(), req.ID)
+	if err != nil {
+		return err
+	}
+	if k == nil {
+		return apperr.NotFound(apperr.CodeAPIKeyNotFound, "api key not found")
+	}
+
+	return rest.Render(c, http.StatusOK, newAPIKey(k))
+}
+
+// UpdateAPIKey changes the name, the scopes and the expiry of an API key
+// @Summary [put] /admin/api-keys/{id}
+// @Description Replaces the name, the scopes and the expiry of an API key, its secret does not change. The requests
+// @Description authenticated by the key get the new scopes right away. Requires the admin scope.
+// @Tags admin
+// @Accept  json,application/msgpack,application/cbor,xml
+// @Produce json,application/msgpack,application/cbor,xml
+// @Security BearerAuth
+// @Param id path int true "API key ID"
+// @Param api_key body APIKeyRequest true "API key"
+// @Success 200 {object} APIKey "API key"
+// @Failure 400 {object} Problem "Invalid request JSON"
+// @Failure 401 {object} Problem "Invalid or revoked access token"
+// @Failure 403 {object} Problem "Missing admin scope"
+// @Failure 404 {object} Problem "API key not found"
+// @Failure 422 {object} Problem "Params validation error"
+// @Failure 500 {object} Problem "Internal server error"
+// @Router /admin/api-keys/{id} [put]
+func (rest *R) UpdateAPIKey(c echo.Context) error {
+	var req UpdateAPIKeyRequest
+	if err := rest.Bind(c, &req); err != nil {
+		return err
+	}
+	if err := validateAPIKeyExpiry(req.ExpiresAt); err != nil {
+		return err
+	}
+
+	ctx := c.Request().Context()
+	k, err := rest.DB.FindAPIKey(ctx, req.ID)
+	if err != nil {
+		return err
+	}
+	if k == nil {
+		return apperr.NotFound(apperr.CodeAPIKeyNotFound, "api key not found")
+	}
+	k.Name = req.Name
+	k.Scopes = strings.Join(req.Scopes, " ")
+	k.ExpiresAt = utcTime(req.ExpiresAt)
+	if err := rest.DB.UpdateAPIKey(ctx, k); err != nil {
+		return err
+	}
+	actor, _ := auth.UserIDValue(ctx)
+	rest.Audit.Record(ctx, audit.Event{Type: audit.EventAPIKeyUpdated, Actor: actor, Subject: k.Prefix, IP: c.RealIP()})
+
+	return rest.Render(c, http.StatusOK, newAPIKey(k))
+}
+
+// DeleteAPIKey revokes an API key
+// @Summary [delete] /admin/api-keys/{id}
+// @Description Deletes an API key, the requests authenticated by it are rejected right away. Requires the admin scope.
+// @Tags admin
+// @Accept  json
+// @Produce json,application/msgpack,application/cbor,xml
+// @Security BearerAuth
+// @Param id path int true "API key ID"
+// @Success 204 "API key deleted"
+// @Failure 401 {object} Problem "Invalid or revoked access token"
+// @Failure 403 {object} Problem "Missing admin scope"
+// @Failure 404 {object} Problem "API key not found"
+// @Failure 422 {object} Problem "Params validation error"
+// @Failure 500 {object} Problem "Internal server error"
+// @Router /admin/api-keys/{id} [delete]
+func (rest *R) DeleteAPIKey(c echo.Context) error {
+	var req APIKeyPathRequest
+	if err := rest.Bind(c, &req); err != nil {
+		return err
+	}
+
+	ctx := c.Request().Context()
+	k, err := rest.DB.FindAPIKey(ctx, req.ID)
+	if err != nil {
+		return err
+	}
+	if k == nil {
+		return apperr.NotFound(apperr.CodeAPIKeyNotFound, "api key not found")
+	}
+	if err := rest.DB.DeleteAPIKey(ctx, k.ID); err != nil {
+		return err
+	}
+	actor, _ := auth.UserIDValue(ctx)
+	rest.Audit.Record(ctx, audit.Event{Type: audit.EventAPIKeyDeleted, Actor: actor, Subject: k.Prefix, IP: c.RealIP()})
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// APIKeyMiddleware authenticates the requests with an ApiKey Authorization header. The key is set in the request
+// context as validated token claims, its scopes as the scope claim, so that the key works wherever a token does.
+func (rest *R) APIKeyMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		req := c.Request()
+		ctx := req.Context()
+		k, err := rest.findAPIKey(ctx, req.Header.Get(echo.HeaderAuthorization))
+		if err != nil {
+			return err
+		}
+		if err := rest.DB.UpdateAPIKeyUse(ctx, k.ID); err != nil {
+			// the request is authenticated, only the last use is missed
+			requestid.Logger(ctx, rest.logger).Warn().Err(err).Str("api_key", k.Prefix).Msg("failed to record the use of the api key")
+		}
+
+		subject := apiKeySubjectPrefix + k.Prefix
+		claims := auth.CustomClaims{"sub": subject, auth.ClaimScope: k.Scopes}
+		if err := claims.Validate(ctx); err != nil {
+			return apperr.Internal(err)
+		}
+		validated := &validator.ValidatedClaims{
+			RegisteredClaims: validator.RegisteredClaims{Issuer: APIKeyIssuer, Subject: subject},
+			CustomClaims:     &claims,
+		}
+		if k.ExpiresAt != nil {
+			validated.RegisteredClaims.Expiry = k.ExpiresAt.Unix()
+		}
+		c.SetRequest(req.WithContext(context.WithValue(ctx, jwtmiddleware.ContextKey{}, validated)))
+
+		return next(c)
+	}
+}
+
+// findAPIKey returns the unexpired key of the Authorization header
+func (rest *R) findAPIKey(ctx context.Context, header string) (*postgres.APIKey, error) {
+	invalid := apperr.Unauthorized(apperr.CodeUnauthorized, "api key invalid")
+
+	_, key, _ := strings.Cut(header, " ")
+	prefix, secret, ok := parseAPIKey(strings.TrimSpace(key))
+	if !ok {
+		return nil, invalid
+	}
+	k, err := rest.DB.FindAPIKeyByPrefix(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	if k == nil || subtle.ConstantTimeCompare([]byte(hashToken(secret)), []byte(k.SecretHash)) != 1 {
+		return nil, invalid
+	}
+	if k.ExpiresAt != nil && !k.ExpiresAt.After(time.Now()) {
+		return nil, apperr.Unauthorized(apperr.CodeUnauthorized, "api key expired")
+	}
+
+	return k, nil
+}
+
+// isAPIKeyRequest reports whether the request is authenticated by an API key rather than a bearer token
+func isAPIKeyRequest(req *http.Request) bool {
+	scheme, _, _ := strings.Cut(req.Header.Get(echo.HeaderAuthorization), " ")
+
+	return strings.EqualFold(scheme, AuthSchemeAPIKey)
+}
+
+// newAPIKeySecret generates the visible prefix and the secret of a key, the key is <prefix>_<secret>
+func newAPIKeySecret() (string, string) {
+	b := make([]byte, 4)
+	// crypto/rand only fails when the OS has no entropy source
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+
+	return apiKeyTag + "_" + hex.EncodeToString(b), newOpaqueToken()
+}
+
+// parseAPIKey splits a key into its prefix and its secret
+func parseAPIKey(key string) (string, string, bool) {
+	parts := strings.SplitN(key, "_", 3)
+	if len(parts) != 3 || parts[0] != apiKeyTag || parts[1] == "" || parts[2] == "" {
+		return "", "", false
+	}
+
+	return parts[0] + "_" + parts[1], parts[2], true
+}
+
+// validateAPIKeyExpiry refuses expiries in the past, the key would never work
+func validateAPIKeyExpiry(expiresAt *time.Time) error {
+	if expiresAt == nil || expiresAt.After(time.Now()) {
+		return nil
+	}
+
+	return apperr.Validation(apperr.CodeValidation, "request validation failed").WithFields(apperr.FieldError{
+		Pointer: "/expires_at",
+		Rule:    "future",
+		Detail:  "must be in the future",
+	})
+}
+
+// newAPIKey creates the public representation of a database API key
+func newAPIKey(k *postgres.APIKey) APIKey {
+	return APIKey{
+		ID:         k.ID,
+		Prefix:     k.Prefix,
+		Name:       k.Name,
+		Scopes:     append([]string{}, strings.Fields(k.Scopes)...),
+		CreatedBy:  k.CreatedBy,
+		ExpiresAt:  utcTime(k.ExpiresAt),
+		CreatedAt:  k.CreatedAt.UTC(),
+		LastUsedAt: utcTime(k.LastUsedAt),
+	}
+}
+
+// utcTime returns t in UTC, nil if t is nil
+func utcTime(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+	u := t.UTC()
+
+	return &u
+}
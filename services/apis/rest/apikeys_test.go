@@ -0,0 +1,266 @@
+package rest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/efimovalex/replaceme/internal/audit"
+	auth "github.com/efimovalex/replaceme/internal/auth0"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	apiKeyColumns         = []string{"id", "prefix", "secret_hash", "name", "scopes", "created_by", "expires_at", "created_at", "last_used_at"}
+	insertAPIKeyQuery     = regexp.QuoteMeta(`INSERT INTO api_keys (prefix,secret_hash,name,scopes,created_by,expires_at) VALUES ($1,$2,$3,$4,$5,$6) RETURNING id, created_at`)
+	findAPIKeysQuery      = regexp.QuoteMeta(`SELECT * FROM api_keys ORDER BY id`)
+	findAPIKeyQuery       = regexp.QuoteMeta(`SELECT * FROM api_keys WHERE id = $1 LIMIT 1`)
+	findAPIKeyPrefixQuery = regexp.QuoteMeta(`SELECT * FROM api_keys WHERE prefix = $1 LIMIT 1`)
+	updateAPIKeyQuery     = regexp.QuoteMeta(`UPDATE api_keys SET name = $1, scopes = $2, expires_at = $3 WHERE id = $4`)
+	updateAPIKeyUseQuery  = regexp.QuoteMeta(`UPDATE api_keys SET last_used_at = CURRENT_TIMESTAMP WHERE (id = $1 AND (last_used_at IS NULL OR last_used_at < CURRENT_TIMESTAMP - INTERVAL '1 minute'))`)
+	deleteAPIKeyQuery     = regexp.QuoteMeta(`DELETE FROM api_keys WHERE id = $1`)
+)
+
+// testAPIKey is the key rk_1a2b3c4d_s3cr3t
+var testAPIKey = struct {
+	key, prefix, hash string
+}{"rk_1a2b3c4d_s3cr3t", "rk_1a2b3c4d", hashToken("s3cr3t")}
+
+func apiKeyRows(scopes string, expiresAt interface{}) *sqlmock.Rows {
+	createdAt := time.Date(2022, 7, 1, 10, 0, 0, 0, time.UTC)
+	return sqlmock.NewRows(apiKeyColumns).
+		AddRow(1, testAPIKey.prefix, testAPIKey.hash, "Nightly export", scopes, "2", expiresAt, createdAt, nil)
+}
+
+func adminRequest(t *testing.T, r *R, method, path, body string) *httptest.ResponseRecorder {
+	accessToken, err := r.Tokens.Issue("2", map[string]interface{}{"email": "admin@replaceme.com", "scope": "admin"})
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	req.Header.Set(echo.HeaderAuthorization, "Bearer "+accessToken.Raw)
+	w := httptest.NewRecorder()
+	r.Router.ServeHTTP(w, req)
+
+	return w
+}
+
+func TestREST_CreateAPIKey(t *testing.T) {
+	t.Run("Created", func(t *testing.T) {
+		r, mock := NewTestRESTWithMock(t)
+		events := &audit.Fake{}
+		r.Audit = events
+		mock.ExpectQuery(insertAPIKeyQuery).
+			WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), "Nightly export", "users:read users:write", "2", nil).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(1, time.Date(2022, 7, 1, 10, 0, 0, 0, time.UTC)))
+
+		w := adminRequest(t, r, http.MethodPost, "/v1/admin/api-keys", `{"name":"Nightly export","scopes":["users:read","users:write"]}`)
+		require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+		checkResponseWithTestDataFile(t, w.Body.Bytes(), []string{"prefix", "key"})
+
+		var res CreatedAPIKey
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+		prefix, secret, ok := parseAPIKey(res.Key)
+		require.True(t, ok, res.Key)
+		assert.Equal(t, res.Prefix, prefix)
+		assert.Regexp(t, `^rk_[0-9a-f]{8}$`, prefix)
+		assert.Len(t, secret, 43)
+		require.Len(t, events.Events(), 1)
+		assert.Equal(t, audit.Event{Type: audit.EventAPIKeyCreated, Actor: "2", Subject: prefix, IP: "192.0.2.1"}, events.Events()[0])
+	})
+
+	t.Run("Invalid scope", func(t *testing.T) {
+		r, _ := NewTestRESTWithMock(t)
+
+		w := adminRequest(t, r, http.MethodPost, "/v1/admin/api-keys", `{"name":"Nightly export","scopes":["users:read users:write"]}`)
+		assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+		checkResponseWithTestDataFile(t, w.Body.Bytes(), []string{"correlation_id"})
+	})
+
+	t.Run("Expired", func(t *testing.T) {
+		r, _ := NewTestRESTWithMock(t)
+
+		w := adminRequest(t, r, http.MethodPost, "/v1/admin/api-keys", `{"name":"Nightly export","expires_at":"2022-07-01T10:00:00Z"}`)
+		assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+		checkResponseWithTestDataFile(t, w.Body.Bytes(), []string{"correlation_id"})
+	})
+
+	t.Run("Missing admin scope", func(t *testing.T) {
+		r, _ := NewTestRESTWithMock(t)
+		accessToken, err := r.Tokens.Issue("1", map[string]interface{}{"scope": "openid"})
+		require.NoError(t, err)
+
+		req := httptest.NewRequest(http.MethodPost, "/v1/admin/api-keys", strings.NewReader(`{"name":"Nightly export"}`))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		req.Header.Set(echo.HeaderAuthorization, "Bearer "+accessToken.Raw)
+		w := httptest.NewRecorder()
+		r.Router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusForbidden, w.Code)
+	})
+}
+
+func TestREST_APIKeys(t *testing.T) {
+	expiresAt := time.Now().Add(24 * time.Hour).UTC().Truncate(time.Second)
+
+	t.Run("List", func(t *testing.T) {
+		r, mock := NewTestRESTWithMock(t)
+		mock.ExpectQuery(findAPIKeysQuery).WillReturnRows(apiKeyRows("users:read", nil))
+
+		w := adminRequest(t, r, http.MethodGet, "/v1/admin/api-keys", "")
+		assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		checkResponseWithTestDataFile(t, w.Body.Bytes(), []string{})
+	})
+
+	t.Run("Get", func(t *testing.T) {
+		r, mock := NewTestRESTWithMock(t)
+		mock.ExpectQuery(findAPIKeyQuery).WithArgs(1).WillReturnRows(apiKeyRows("users:read", nil))
+
+		w := adminRequest(t, r, http.MethodGet, "/v1/admin/api-keys/1", "")
+		assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		checkResponseWithTestDataFile(t, w.Body.Bytes(), []string{})
+	})
+
+	t.Run("Get unknown", func(t *testing.T) {
+		r, mock := NewTestRESTWithMock(t)
+		mock.ExpectQuery(findAPIKeyQuery).WithArgs(2).WillReturnRows(sqlmock.NewRows(apiKeyColumns))
+
+		w := adminRequest(t, r, http.MethodGet, "/v1/admin/api-keys/2", "")
+		assert.Equal(t, http.StatusNotFound, w.Code)
+		checkResponseWithTestDataFile(t, w.Body.Bytes(), []string{"correlation_id"})
+	})
+
+	t.Run("Update", func(t *testing.T) {
+		r, mock := NewTestRESTWithMock(t)
+		events := &audit.Fake{}
+		r.Audit = events
+		mock.ExpectQuery(findAPIKeyQuery).WithArgs(1).WillReturnRows(apiKeyRows("users:read", nil))
+		mock.ExpectExec(updateAPIKeyQuery).WithArgs("Hourly export", "users:read users:write", expiresAt, 1).WillReturnResult(sqlmock.NewResult(0, 1))
+
+		w := adminRequest(t, r, http.MethodPut, "/v1/admin/api-keys/1",
+			`{"name":"Hourly export","scopes":["users:read","users:write"],"expires_at":"`+expiresAt.Format(time.RFC3339)+`"}`)
+		assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		checkResponseWithTestDataFile(t, w.Body.Bytes(), []string{"expires_at"})
+		require.Len(t, events.Events(), 1)
+		assert.Equal(t, audit.Event{Type: audit.EventAPIKeyUpdated, Actor: "2", Subject: testAPIKey.prefix, IP: "192.0.2.1"}, events.Events()[0])
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		r, mock := NewTestRESTWithMock(t)
+		events := &audit.Fake{}
+		r.Audit = events
+		mock.ExpectQuery(findAPIKeyQuery).WithArgs(1).WillReturnRows(apiKeyRows("users:read", nil))
+		mock.ExpectExec(deleteAPIKeyQuery).WithArgs(1).WillReturnResult(sqlmock.NewResult(0, 1))
+
+		w := adminRequest(t, r, http.MethodDelete, "/v1/admin/api-keys/1", "")
+		assert.Equal(t, http.StatusNoContent, w.Code, w.Body.String())
+		require.Len(t, events.Events(), 1)
+		assert.Equal(t, audit.Event{Type: audit.EventAPIKeyDeleted, Actor: "2", Subject: testAPIKey.prefix, IP: "192.0.2.1"}, events.Events()[0])
+	})
+
+	t.Run("Delete unknown", func(t *testing.T) {
+		r, mock := NewTestRESTWithMock(t)
+		mock.ExpectQuery(findAPIKeyQuery).WithArgs(2).WillReturnRows(sqlmock.NewRows(apiKeyColumns))
+
+		w := adminRequest(t, r, http.MethodDelete, "/v1/admin/api-keys/2", "")
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+}
+
+func TestREST_APIKeyMiddleware(t *testing.T) {
+	handler := func(c echo.Context) error {
+		ctx := c.Request().Context()
+		userID, err := auth.UserIDValue(ctx)
+		if err != nil {
+			return err
+		}
+		issuer, err := auth.IssuerValue(ctx)
+		if err != nil {
+			return err
+		}
+		return c.String(http.StatusOK, userID+" "+issuer)
+	}
+
+	tests := []struct {
+		name               string
+		authorization      string
+		rows               *sqlmock.Rows
+		expectedStatusCode int
+		expectedBody       string
+	}{
+		{
+			name:               "Valid",
+			authorization:      "ApiKey " + testAPIKey.key,
+			rows:               apiKeyRows("users:read", time.Now().Add(time.Hour)),
+			expectedStatusCode: http.StatusOK,
+			expectedBody:       "apikey|rk_1a2b3c4d api-key",
+		},
+		{
+			name:               "Scheme is case insensitive",
+			authorization:      "apikey " + testAPIKey.key,
+			rows:               apiKeyRows("users:read", nil),
+			expectedStatusCode: http.StatusOK,
+			expectedBody:       "apikey|rk_1a2b3c4d api-key",
+		},
+		{
+			name:               "Missing scope",
+			authorization:      "ApiKey " + testAPIKey.key,
+			rows:               apiKeyRows("users:write", nil),
+			expectedStatusCode: http.StatusForbidden,
+		},
+		{
+			name:               "Wrong secret",
+			authorization:      "ApiKey rk_1a2b3c4d_guessed",
+			rows:               apiKeyRows("users:read", nil),
+			expectedStatusCode: http.StatusUnauthorized,
+		},
+		{
+			name:               "Unknown key",
+			authorization:      "ApiKey " + testAPIKey.key,
+			rows:               sqlmock.NewRows(apiKeyColumns),
+			expectedStatusCode: http.StatusUnauthorized,
+		},
+		{
+			name:               "Malformed key",
+			authorization:      "ApiKey s3cr3t",
+			expectedStatusCode: http.StatusUnauthorized,
+		},
+		{
+			name:               "Expired",
+			authorization:      "ApiKey " + testAPIKey.key,
+			rows:               apiKeyRows("users:read", time.Now().Add(-time.Hour)),
+			expectedStatusCode: http.StatusUnauthorized,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, mock := NewTestRESTWithMock(t)
+			if tt.rows != nil {
+				mock.ExpectQuery(findAPIKeyPrefixQuery).WithArgs(testAPIKey.prefix).WillReturnRows(tt.rows)
+			}
+			mock.ExpectExec(updateAPIKeyUseQuery).WithArgs(1).WillReturnResult(sqlmock.NewResult(0, 1))
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set(echo.HeaderAuthorization, tt.authorization)
+			w := httptest.NewRecorder()
+			c := r.Router.NewContext(req, w)
+			err := r.Authenticate(RequireScope("users:read")(handler))(c)
+			if err != nil {
+				r.HTTPErrorHandler(err, c)
+			}
+
+			assert.Equal(t, tt.expectedStatusCode, w.Code, w.Body.String())
+			if tt.expectedStatusCode == http.StatusOK {
+				assert.Equal(t, tt.expectedBody, w.Body.String())
+				return
+			}
+			checkResponseWithTestDataFile(t, w.Body.Bytes(), []string{"correlation_id"})
+		})
+	}
+}
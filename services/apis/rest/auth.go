@@ -0,0 +1,155 @@
+package rest
+
+import (
+	"encoding/xml"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/efimovalex/replaceme/adapters/postgres"
+	"github.com/efimovalex/replaceme/internal/apperr"
+	auth "github.com/efimovalex/replaceme/internal/auth0"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// TokenTypeBearer is the type of the issued access tokens, see RFC 6750
+	TokenTypeBearer = "Bearer"
+	// HeaderPragma is sent with token responses for HTTP/1.0 caches, see RFC 6749 section 5.1
+	HeaderPragma = "Pragma"
+)
+
+// LoginRequest is the request body of the login endpoint
+type LoginRequest struct {
+	XMLName  xml.Name `json:"-" xml:"login"`
+	Email    string   `json:"email" xml:"email" validate:"required,email,max=255" format:"email" example:"jane.doe@replaceme.com"`
+	Password string   `json:"password" xml:"password" validate:"required,max=72" example:"s3cr3t-p4ss"`
+}
+
+// TokenResponse is the body of successful token responses, see RFC 6749 section 5.1
+type TokenResponse struct {
+	XMLName     xml.Name `json:"-" xml:"token"`
+	AccessToken string   `json:"access_token" xml:"access_token"`
+	TokenType   string   `json:"token_type" xml:"token_type" example:"Bearer"`
+	// ExpiresIn is the lifetime of the access token in seconds
+	ExpiresIn int `json:"expires_in" xml:"expires_in" example:"900"`
+	// RefreshToken is issued when sessions are enabled, it is rotated on every use
+	RefreshToken string `json:"refresh_token,omitempty" xml:"refresh_token,omitempty"`
+}
+
+// Login verifies the credentials of a user and issues an access token
+// @Summary [post] /auth/login
+// @Description Verifies an email and password and issues a first-party access token, and a refresh token
+// @Description when sessions are enabled. Unknown emails, inactive users and wrong passwords get the same response.
+// @Description Repeated failures delay the next attempts and lock the account or IP out for a while.
+// @Description Users with a second factor get an MFA challenge instead of the tokens.
+// @Tags auth
+// @Accept  json,application/msgpack,application/cbor,xml
+// @Produce json,application/msgpack,application/cbor,xml
+// @Param credentials body LoginRequest true "credentials"
+// @Success 200 {object} TokenResponse "Access token"
+// @Success 202 {object} MFAChallengeResponse "Second factor required, see /auth/mfa/verify"
+// @Failure 400 {object} Problem "Invalid request JSON"
+// @Failure 401 {object} Problem "Invalid email or password"
+// @Failure 403 {object} Problem "Email not verified"
+// @Failure 422 {object} Problem "Params validation error"
+// @Failure 429 {object} Problem "Too many failed logins, see the Retry-After header"
+// @Failure 500 {object} Problem "Internal server error"
+// @Failure 503 {object} Problem "Session or lockout store unavailable"
+// @Router /auth/login [post]
+func (rest *R) Login(c echo.Context) error {
+	var req LoginRequest
+	if err := rest.Bind(c, &req); err != nil {
+		return err
+	}
+
+	attempt, err := rest.reserveLoginAttempt(c, req.Email)
+	if err != nil {
+		return err
+	}
+
+	active := true
+	u, err := rest.DB.FindOneUserByEmail(c.Request().Context(), req.Email, &active)
+	if err != nil {
+		return err
+	}
+	// unknown emails are checked against a dummy hash, they take as long as wrong passwords,
+	// and their failures are counted the same
+	if !postgres.CheckPassword(u, req.Password) {
+		rest.loginFailed(c, attempt)
+
+		return apperr.Unauthorized(apperr.CodeInvalidCredentials, "invalid email or password")
+	}
+	if err := rest.refundLoginAttempt(c, attempt); err != nil {
+		return err
+	}
+	mfa, err := rest.hasMFA(c.Request().Context(), u.ID)
+	if err != nil {
+		return err
+	}
+	// the failures are only forgotten once the second factor is verified too
+	if !mfa {
+		if err := rest.resetLoginFailures(c, req.Email); err != nil {
+			return err
+		}
+	}
+	if rest.cfg.Accounts.RequireVerifiedEmail && u.EmailVerifiedAt == nil {
+		return apperr.Forbidden(apperr.CodeEmailNotVerified, "email is not verified")
+	}
+	if mfa {
+		return rest.startMFAChallenge(c, u, []string{auth.AuthMethodPassword})
+	}
+
+	authn := authentication{methods: []string{auth.AuthMethodPassword}, time: time.Now()}
+	sessionID, refreshToken, err := rest.startSession(c, strconv.Itoa(u.ID), authn)
+	if err != nil {
+		return err
+	}
+
+	return rest.issueTokens(c, u, authn, sessionID, refreshToken)
+}
+
+// authentication is how and when a user authenticated, the access tokens carry it in their amr and auth_time claims
+type authentication struct {
+	methods []string
+	time    time.Time
+}
+
+// issueTokens responds with the tokens of an authenticated user.
+// The access token is bound to the session, if any, and revoked with it.
+func (rest *R) issueTokens(c echo.Context, u *postgres.User, authn authentication, sessionID, refreshToken string) error {
+	claims := map[string]interface{}{"email": u.Email}
+	if len(authn.methods) > 0 {
+		claims[auth.ClaimAuthMethods] = authn.methods
+		claims[auth.ClaimAuthTime] = authn.time.Unix()
+	}
+	if sessionID != "" {
+		claims[auth.ClaimSessionID] = sessionID
+	}
+	accessToken, err := rest.Tokens.Issue(strconv.Itoa(u.ID), claims)
+	if err != nil {
+		return apperr.Internal(err)
+	}
+	if sessionID != "" {
+		if err := rest.Sessions.AddSessionAccessToken(c.Request().Context(), strconv.Itoa(u.ID), sessionID, accessToken.ID, rest.Tokens.TTL()); err != nil {
+			return apperr.Unavailable(apperr.CodeUnavailable, "session store unavailable").Wrap(err)
+		}
+	}
+
+	h := c.Response().Header()
+	h.Set(echo.HeaderCacheControl, CacheNoStore)
+	h.Set(HeaderPragma, "no-cache")
+
+	return rest.Render(c, http.StatusOK, TokenResponse{
+		AccessToken:  accessToken.Raw,
+		TokenType:    TokenTypeBearer,
+		ExpiresIn:    int(rest.Tokens.TTL().Seconds()),
+		RefreshToken: refreshToken,
+	})
+}
+
+// GetJWKS returns the public keys verifying the first-party access tokens, see RFC 7517.
+// It is served at /.well-known/jwks.json, outside of the API versions.
+func (rest *R) GetJWKS(c echo.Context) error {
+	return rest.JSON(c, http.StatusOK, rest.Tokens.JWKS())
+}
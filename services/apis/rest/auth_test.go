@@ -0,0 +1,195 @@
+package rest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	auth "github.com/efimovalex/replaceme/internal/auth0"
+	"github.com/efimovalex/replaceme/internal/token"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var findActiveUserQuery = regexp.QuoteMeta(`SELECT * FROM users WHERE email = $1 AND active = $2 LIMIT 1`)
+
+func TestREST_Login(t *testing.T) {
+	createdAt := time.Date(2022, 7, 1, 10, 0, 0, 0, time.UTC)
+	hash, err := bcrypt.GenerateFromPassword([]byte("s3cr3t-p4ss"), bcrypt.MinCost)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name               string
+		body               string
+		mock               func(mock sqlmock.Sqlmock)
+		expectedStatusCode int
+	}{
+		{
+			name: "Success",
+			body: `{"email":"jane.doe@replaceme.com","password":"s3cr3t-p4ss"}`,
+			mock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(findActiveUserQuery).WithArgs("jane.doe@replaceme.com", true).WillReturnRows(sqlmock.NewRows(userColumns).
+					AddRow(1, "jane.doe@replaceme.com", string(hash), "", "Jane", "Doe", true, createdAt, createdAt))
+			},
+			expectedStatusCode: http.StatusOK,
+		},
+		{
+			name: "Wrong password",
+			body: `{"email":"jane.doe@replaceme.com","password":"wrong-p4ss"}`,
+			mock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(findActiveUserQuery).WithArgs("jane.doe@replaceme.com", true).WillReturnRows(sqlmock.NewRows(userColumns).
+					AddRow(1, "jane.doe@replaceme.com", string(hash), "", "Jane", "Doe", true, createdAt, createdAt))
+			},
+			expectedStatusCode: http.StatusUnauthorized,
+		},
+		{
+			name: "Unknown or inactive user",
+			body: `{"email":"john.doe@replaceme.com","password":"s3cr3t-p4ss"}`,
+			mock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(findActiveUserQuery).WithArgs("john.doe@replaceme.com", true).WillReturnRows(sqlmock.NewRows(userColumns))
+			},
+			expectedStatusCode: http.StatusUnauthorized,
+		},
+		{
+			name:               "Invalid credentials format",
+			body:               `{"email":"not-an-email"}`,
+			mock:               func(mock sqlmock.Sqlmock) {},
+			expectedStatusCode: http.StatusUnprocessableEntity,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, mock := NewTestRESTWithMock(t)
+			tt.mock(mock)
+
+			req := httptest.NewRequest(http.MethodPost, "/v1/auth/login", strings.NewReader(tt.body))
+			req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+			w := httptest.NewRecorder()
+			r.Router.ServeHTTP(w, req)
+
+			assert.Equal(t, tt.expectedStatusCode, w.Code)
+			assert.Equal(t, CacheNoStore, w.Header().Get(echo.HeaderCacheControl))
+			checkResponseWithTestDataFile(t, w.Body.Bytes(), []string{"access_token", "correlation_id"})
+		})
+	}
+}
+
+func TestR_Authenticate(t *testing.T) {
+	r := NewTestREST(t)
+	e := echo.New()
+	e.HTTPErrorHandler = r.HTTPErrorHandler
+	e.GET("/me", func(c echo.Context) error {
+		id, err := auth.UserIDValue(c.Request().Context())
+		if err != nil {
+			return err
+		}
+		email, err := auth.UserEmailValue(c.Request().Context())
+		if err != nil {
+			return err
+		}
+
+		return c.String(http.StatusOK, id+" "+email)
+	}, r.Authenticate)
+
+	issue := func(t *testing.T, issuer func(*token.Issuer) *token.Issuer) string {
+		accessToken, err := issuer(r.Tokens).Issue("42", map[string]interface{}{"email": "jane.doe@replaceme.com"})
+		require.NoError(t, err)
+
+		return accessToken.Raw
+	}
+	otherIssuer := func(iss string, ttl time.Duration) func(*token.Issuer) *token.Issuer {
+		return func(*token.Issuer) *token.Issuer {
+			cfg := testTokenConfig
+			cfg.Issuer = iss
+			cfg.KeyFiles = nil
+			cfg.EphemeralKey = true
+			cfg.AccessTokenTTL = ttl
+			tokens, err := token.New(cfg)
+			require.NoError(t, err)
+
+			return tokens
+		}
+	}
+	sameIssuer := func(tokens *token.Issuer) *token.Issuer { return tokens }
+
+	tests := []struct {
+		name               string
+		authorization      string
+		expectedStatusCode int
+		expectedBody       string
+	}{
+		{
+			name:               "First-party token",
+			authorization:      "Bearer " + issue(t, sameIssuer),
+			expectedStatusCode: http.StatusOK,
+			expectedBody:       "42 jane.doe@replaceme.com",
+		},
+		{
+			name:               "Token signed by another key",
+			authorization:      "Bearer " + issue(t, otherIssuer(testTokenConfig.Issuer, time.Minute)),
+			expectedStatusCode: http.StatusUnauthorized,
+		},
+		{
+			name:               "Expired token",
+			authorization:      "Bearer " + issue(t, otherIssuer(testTokenConfig.Issuer, -2*time.Minute)),
+			expectedStatusCode: http.StatusUnauthorized,
+		},
+		{
+			name:               "Unknown issuer",
+			authorization:      "Bearer " + issue(t, otherIssuer("https://evil.com/", time.Minute)),
+			expectedStatusCode: http.StatusUnauthorized,
+		},
+		{
+			name:               "Missing token",
+			expectedStatusCode: http.StatusUnauthorized,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/me", nil)
+			if tt.authorization != "" {
+				req.Header.Set(echo.HeaderAuthorization, tt.authorization)
+			}
+			w := httptest.NewRecorder()
+			e.ServeHTTP(w, req)
+
+			assert.Equal(t, tt.expectedStatusCode, w.Code, w.Body.String())
+			if tt.expectedBody != "" {
+				assert.Equal(t, tt.expectedBody, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestUserContextMiddleware(t *testing.T) {
+	r := NewTestREST(t)
+	e := echo.New()
+	e.HTTPErrorHandler = r.HTTPErrorHandler
+	e.GET("/", func(c echo.Context) error { return c.NoContent(http.StatusNoContent) }, UserContextMiddleware)
+
+	w := httptest.NewRecorder()
+	e.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	checkResponseWithTestDataFile(t, w.Body.Bytes(), []string{})
+}
+
+func TestREST_GetJWKS(t *testing.T) {
+	r := NewTestREST(t)
+
+	req := httptest.NewRequest(http.MethodGet, "/.well-known/jwks.json", nil)
+	req.Header.Set(HeaderAPIVersion, "2")
+	w := httptest.NewRecorder()
+	r.Router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, CachePublic, w.Header().Get(echo.HeaderCacheControl))
+	assert.Empty(t, w.Header().Get(HeaderAPIVersion), "well-known URIs are not versioned")
+	checkResponseWithTestDataFile(t, w.Body.Bytes(), []string{})
+}
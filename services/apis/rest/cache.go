@@ -0,0 +1,165 @@
+package rest
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/efimovalex/replaceme/adapters/redisdb"
+	"github.com/efimovalex/replaceme/config"
+	"github.com/efimovalex/replaceme/internal/requestid"
+	"github.com/labstack/echo/v4"
+)
+
+// HTTP caching headers
+const (
+	HeaderETag        = "ETag"
+	HeaderIfNoneMatch = "If-None-Match"
+	// HeaderXCache tells whether the response was served from the shared cache
+	HeaderXCache = "X-Cache"
+
+	// ctxKeyBody is the echo context key of the compact body written by R.Render
+	ctxKeyBody = "rest.body"
+)
+
+// Cache-Control policies
+const (
+	CachePublic  = "public, max-age=60"
+	CachePrivate = "private, no-cache"
+	CacheNoStore = "no-store"
+)
+
+// ResponseCache is the interface for the shared response cache
+type ResponseCache interface {
+	GetCachedResponse(ctx context.Context, key string) (*redisdb.CachedResponse, error)
+	SetCachedResponse(ctx context.Context, key string, res *redisdb.CachedResponse, ttl time.Duration, tags ...string) error
+	InvalidateCacheTags(ctx context.Context, tags ...string) error
+}
+
+// CacheTagsFunc returns the invalidation tags of a response
+type CacheTagsFunc func(c echo.Context) []string
+
+// CacheControl sets the Cache-Control policy of a route.
+// Error responses always get no-store, see JSONError.
+func CacheControl(policy string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			c.Response().Header().Set(echo.HeaderCacheControl, policy)
+
+			return next(c)
+		}
+	}
+}
+
+// CacheMiddleware serves GET responses from the shared cache.
+// Successful responses rendered by R.Render are stored, per negotiated media type, with the tags returned by tags,
+// and removed when one of the tags is invalidated, see InvalidateCache.
+// Requests with "Cache-Control: no-cache" skip the cached response.
+func (rest *R) CacheMiddleware(cfg config.Cache, tags CacheTagsFunc) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		if !cfg.Enable || rest.Cache == nil {
+			return next
+		}
+
+		return func(c echo.Context) error {
+			req := c.Request()
+			if req.Method != http.MethodGet {
+				return next(c)
+			}
+
+			codec, ok := c.Get(ctxKeyCodec).(Codec)
+			if !ok {
+				// not negotiated, the handler answers with a 406
+				return next(c)
+			}
+
+			ctx := req.Context()
+			logger := requestid.Logger(ctx, rest.logger)
+			key := codec.ContentType() + " " + cacheKey(c)
+
+			if !strings.Contains(req.Header.Get(echo.HeaderCacheControl), "no-cache") {
+				cached, err := rest.Cache.GetCachedResponse(ctx, key)
+				if err != nil {
+					logger.Error().Err(err).Msg("failed to load cached response")
+				}
+				if cached != nil {
+					c.Response().Header().Set(HeaderXCache, "HIT")
+
+					return rest.write(c, cached.Status, codec, cached.Body)
+				}
+			}
+
+			c.Response().Header().Set(HeaderXCache, "MISS")
+			if err := next(c); err != nil {
+				return err
+			}
+
+			body, ok := c.Get(ctxKeyBody).([]byte)
+			if !ok || c.Response().Status != http.StatusOK && c.Response().Status != http.StatusNotModified {
+				return nil
+			}
+
+			res := &redisdb.CachedResponse{Status: http.StatusOK, Body: body}
+			if err := rest.Cache.SetCachedResponse(ctx, key, res, cfg.TTL, tags(c)...); err != nil {
+				logger.Error().Err(err).Msg("failed to store cached response")
+			}
+
+			return nil
+		}
+	}
+}
+
+// InvalidateCache removes the cached responses tagged with one of the tags.
+// Failures are logged, cached responses expire on their own.
+func (rest *R) InvalidateCache(ctx context.Context, tags ...string) {
+	if rest.Cache == nil {
+		return
+	}
+
+	if err := rest.Cache.InvalidateCacheTags(ctx, tags...); err != nil {
+		requestid.Logger(ctx, rest.logger).Error().Err(err).Strs("tags", tags).Msg("failed to invalidate cache")
+	}
+}
+
+// cacheKey identifies a cached response by its path and query, presentation params excluded
+func cacheKey(c echo.Context) string {
+	q := c.Request().URL.Query()
+	q.Del("pretty")
+	if len(q) == 0 {
+		return c.Request().URL.Path
+	}
+
+	// Encode sorts the params by key
+	return c.Request().URL.Path + "?" + q.Encode()
+}
+
+// strongETag returns a strong ETag of the body
+func strongETag(b []byte) string {
+	sum := sha256.Sum256(b)
+
+	return `"` + base64.RawURLEncoding.EncodeToString(sum[:16]) + `"`
+}
+
+// etagMatch reports whether the If-None-Match header matches the etag, using the weak comparison of RFC 7232
+func etagMatch(ifNoneMatch, etag string) bool {
+	if ifNoneMatch == "" {
+		return false
+	}
+
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isCacheable reports whether a response with the given status to a request with the given method can be cached
+func isCacheable(method string, status int) bool {
+	return (method == http.MethodGet || method == http.MethodHead) && status == http.StatusOK
+}
@@ -0,0 +1,189 @@
+package rest
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/efimovalex/replaceme/adapters/redisdb"
+	"github.com/efimovalex/replaceme/config"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+// responseCacheMock is an in-memory ResponseCache
+type responseCacheMock struct {
+	mu        sync.Mutex
+	responses map[string]*redisdb.CachedResponse
+	tags      map[string][]string
+}
+
+func newResponseCacheMock() *responseCacheMock {
+	return &responseCacheMock{responses: map[string]*redisdb.CachedResponse{}, tags: map[string][]string{}}
+}
+
+func (m *responseCacheMock) GetCachedResponse(ctx context.Context, key string) (*redisdb.CachedResponse, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.responses[key], nil
+}
+
+func (m *responseCacheMock) SetCachedResponse(ctx context.Context, key string, res *redisdb.CachedResponse, ttl time.Duration, tags ...string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.responses[key] = res
+	for _, tag := range tags {
+		m.tags[tag] = append(m.tags[tag], key)
+	}
+
+	return nil
+}
+
+func (m *responseCacheMock) InvalidateCacheTags(ctx context.Context, tags ...string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, tag := range tags {
+		for _, key := range m.tags[tag] {
+			delete(m.responses, key)
+		}
+		delete(m.tags, tag)
+	}
+
+	return nil
+}
+
+func TestR_JSON_ETag(t *testing.T) {
+	do := func(r *R, ifNoneMatch string) *httptest.ResponseRecorder {
+		e := echo.New()
+		e.GET("/", func(c echo.Context) error {
+			return r.JSON(c, http.StatusOK, Message{Message: "Hello, World!"})
+		})
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if ifNoneMatch != "" {
+			req.Header.Set(HeaderIfNoneMatch, ifNoneMatch)
+		}
+		w := httptest.NewRecorder()
+		e.ServeHTTP(w, req)
+
+		return w
+	}
+
+	compact := do(&R{}, "")
+	assert.Equal(t, http.StatusOK, compact.Code)
+	assert.Equal(t, `{"message":"Hello, World!"}`+"\n", compact.Body.String())
+	etag := compact.Header().Get(HeaderETag)
+	assert.NotEmpty(t, etag)
+
+	pretty := do(&R{prettyResponse: true}, "")
+	assert.Equal(t, "{\n\t\"message\": \"Hello, World!\"\n}\n", pretty.Body.String())
+	assert.Equal(t, etag, pretty.Header().Get(HeaderETag), "pretty printing must not change the ETag")
+
+	tests := []struct {
+		name        string
+		ifNoneMatch string
+		want        int
+	}{
+		{name: "Matching ETag", ifNoneMatch: etag, want: http.StatusNotModified},
+		{name: "Weak matching ETag", ifNoneMatch: "W/" + etag, want: http.StatusNotModified},
+		{name: "ETag list", ifNoneMatch: `"other", ` + etag, want: http.StatusNotModified},
+		{name: "Any", ifNoneMatch: "*", want: http.StatusNotModified},
+		{name: "Stale ETag", ifNoneMatch: `"other"`, want: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := do(&R{}, tt.ifNoneMatch)
+			assert.Equal(t, tt.want, w.Code)
+			assert.Equal(t, etag, w.Header().Get(HeaderETag))
+			if tt.want == http.StatusNotModified {
+				assert.Empty(t, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestR_CacheMiddleware(t *testing.T) {
+	cfg := config.Cache{Enable: true, TTL: time.Minute}
+
+	var calls int32
+	r := NewTestREST(t)
+	r.Cache = newResponseCacheMock()
+	e := echo.New()
+	e.HTTPErrorHandler = r.HTTPErrorHandler
+	e.GET("/things/:id", func(c echo.Context) error {
+		n := atomic.AddInt32(&calls, 1)
+		if c.Param("id") == "missing" {
+			return echo.ErrNotFound
+		}
+
+		return r.Render(c, http.StatusOK, map[string]interface{}{"id": c.Param("id"), "version": n})
+	}, r.NegotiateMiddleware, CacheControl(CachePrivate), r.CacheMiddleware(cfg, func(c echo.Context) []string {
+		return []string{"thing:" + c.Param("id")}
+	}))
+
+	do := func(path string, header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		w := httptest.NewRecorder()
+		e.ServeHTTP(w, req)
+
+		return w
+	}
+
+	miss := do("/things/1", nil)
+	assert.Equal(t, http.StatusOK, miss.Code)
+	assert.Equal(t, "MISS", miss.Header().Get(HeaderXCache))
+
+	// pretty printing is a presentation param, the response is shared
+	hit := do("/things/1?pretty=true", nil)
+	assert.Equal(t, http.StatusOK, hit.Code)
+	assert.Equal(t, "HIT", hit.Header().Get(HeaderXCache))
+	assert.Equal(t, CachePrivate, hit.Header().Get(echo.HeaderCacheControl))
+	assert.Equal(t, miss.Header().Get(HeaderETag), hit.Header().Get(HeaderETag))
+	assert.JSONEq(t, miss.Body.String(), hit.Body.String())
+	assert.Equal(t, int32(1), calls)
+
+	// conditional requests are answered from the cache too
+	notModified := do("/things/1", http.Header{HeaderIfNoneMatch: []string{miss.Header().Get(HeaderETag)}})
+	assert.Equal(t, http.StatusNotModified, notModified.Code)
+	assert.Equal(t, int32(1), calls)
+
+	// clients can bypass the cache
+	bypass := do("/things/1", http.Header{echo.HeaderCacheControl: []string{"no-cache"}})
+	assert.Equal(t, "MISS", bypass.Header().Get(HeaderXCache))
+	assert.Equal(t, int32(2), calls)
+
+	// every media type is cached on its own
+	msgpack := do("/things/1", http.Header{echo.HeaderAccept: []string{MIMEApplicationMsgpack}})
+	assert.Equal(t, "MISS", msgpack.Header().Get(HeaderXCache))
+	assert.Equal(t, MIMEApplicationMsgpack, msgpack.Header().Get(echo.HeaderContentType))
+	assert.NotEqual(t, miss.Header().Get(HeaderETag), msgpack.Header().Get(HeaderETag))
+	assert.Equal(t, "HIT", do("/things/1", http.Header{echo.HeaderAccept: []string{MIMEApplicationMsgpack}}).Header().Get(HeaderXCache))
+	assert.Equal(t, int32(3), calls)
+
+	// errors are not cached
+	assert.Equal(t, http.StatusNotFound, do("/things/missing", nil).Code)
+	assert.Equal(t, http.StatusNotFound, do("/things/missing", nil).Code)
+	assert.Equal(t, int32(5), calls)
+
+	// invalidation drops the tagged responses only
+	do("/things/2", nil)
+	r.InvalidateCache(context.Background(), "thing:1")
+	assert.Equal(t, "MISS", do("/things/1", nil).Header().Get(HeaderXCache))
+	assert.Equal(t, "HIT", do("/things/2", nil).Header().Get(HeaderXCache))
+}
+
+func TestEtagMatch(t *testing.T) {
+	assert.False(t, etagMatch("", `"a"`))
+	assert.True(t, etagMatch(`"a"`, `"a"`))
+	assert.True(t, etagMatch(`W/"a"`, `"a"`))
+	assert.True(t, etagMatch(`"b" , "a"`, `"a"`))
+	assert.True(t, etagMatch(`*`, `"a"`))
+	assert.False(t, etagMatch(`"b"`, `"a"`))
+}
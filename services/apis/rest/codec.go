@@ -0,0 +1,410 @@
+package rest
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/labstack/echo/v4"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Media types supported by the REST service
+const (
+	MIMEApplicationMsgpack = "application/msgpack"
+	MIMEApplicationCBOR    = "application/cbor"
+	MIMETextCSV            = "text/csv"
+)
+
+var (
+	// ErrNotRepresentable is returned by codecs that cannot encode a value, e.g. CSV for a single object
+	ErrNotRepresentable = errors.New("value cannot be represented in the media type")
+	// ErrNotDecodable is returned by codecs that are only used for responses
+	ErrNotDecodable = errors.New("media type cannot be decoded")
+)
+
+// Codec encodes response bodies and decodes request bodies of a media type
+type Codec interface {
+	// ContentType is the Content-Type header of encoded responses
+	ContentType() string
+	// Marshal returns the compact encoding of v
+	Marshal(v interface{}) ([]byte, error)
+	// Decode decodes the request body r into v
+	Decode(r io.Reader, v interface{}) error
+}
+
+// Indenter is implemented by codecs of text formats that can be pretty printed
+type Indenter interface {
+	Indent(b []byte) ([]byte, error)
+}
+
+// Lister is implemented by codecs which only represent lists, e.g. CSV. They are only negotiated for the routes
+// responding with lists.
+type Lister interface {
+	ListOnly()
+}
+
+// Codecs is a registry of codecs by media type, the order of registration is the order of preference
+type Codecs struct {
+	byMediaType map[string]Codec
+	mediaTypes  []string
+}
+
+// NewCodecs creates an empty codec registry
+func NewCodecs() *Codecs {
+	return &Codecs{byMediaType: map[string]Codec{}}
+}
+
+// DefaultCodecs creates the registry of the codecs supported by the REST service, JSON being the default
+func DefaultCodecs() *Codecs {
+	codecs := NewCodecs()
+	codecs.Register(jsonCodec{}, echo.MIMEApplicationJSON)
+	codecs.Register(msgpackCodec{}, MIMEApplicationMsgpack, "application/x-msgpack", "application/vnd.msgpack")
+	codecs.Register(newCBORCodec(), MIMEApplicationCBOR)
+	codecs.Register(xmlCodec{}, echo.MIMEApplicationXML, echo.MIMETextXML)
+	codecs.Register(csvCodec{}, MIMETextCSV)
+
+	return codecs
+}
+
+// Register adds a codec for the media types, replacing any codec previously registered for them
+func (cs *Codecs) Register(codec Codec, mediaTypes ...string) {
+	for _, mt := range mediaTypes {
+		mt = strings.ToLower(mt)
+		if _, ok := cs.byMediaType[mt]; !ok {
+			cs.mediaTypes = append(cs.mediaTypes, mt)
+		}
+		cs.byMediaType[mt] = codec
+	}
+}
+
+// Default returns the codec used when the client accepts any media type
+func (cs *Codecs) Default() Codec {
+	return cs.byMediaType[cs.mediaTypes[0]]
+}
+
+// Lookup returns the codec of a Content-Type header value, parameters are ignored
+func (cs *Codecs) Lookup(contentType string) (Codec, bool) {
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, false
+	}
+	codec, ok := cs.byMediaType[mt]
+
+	return codec, ok
+}
+
+// Negotiate returns the preferred codec for an Accept header value as defined by RFC 7231.
+// Media ranges are ordered by quality, then by specificity, ties are broken by registration order.
+// The codecs which only represent lists are skipped unless lists is set, see Lister.
+func (cs *Codecs) Negotiate(accept string, lists bool) (Codec, bool) {
+	if strings.TrimSpace(accept) == "" {
+		return cs.Default(), true
+	}
+
+	ranges := parseAccept(accept)
+	for _, r := range ranges {
+		if r.q <= 0 {
+			break
+		}
+		for _, mt := range cs.mediaTypes {
+			codec := cs.byMediaType[mt]
+			if _, listOnly := codec.(Lister); listOnly && !lists {
+				continue
+			}
+			if r.matches(mt) && cs.acceptable(ranges, mt) {
+				return codec, true
+			}
+		}
+	}
+
+	return nil, false
+}
+
+// acceptable reports whether the most specific range matching mt does not refuse it with q=0
+func (cs *Codecs) acceptable(ranges []mediaRange, mt string) bool {
+	best := -1
+	for i, r := range ranges {
+		if r.matches(mt) && (best < 0 || r.specificity() > ranges[best].specificity()) {
+			best = i
+		}
+	}
+
+	return best >= 0 && ranges[best].q > 0
+}
+
+// mediaRange is a media range of an Accept header, e.g. application/* or text/csv;q=0.5
+type mediaRange struct {
+	typ, subtype string
+	q            float64
+}
+
+func (r mediaRange) matches(mediaType string) bool {
+	typ, subtype, _ := strings.Cut(mediaType, "/")
+
+	return (r.typ == "*" || r.typ == typ) && (r.subtype == "*" || r.subtype == subtype)
+}
+
+func (r mediaRange) specificity() int {
+	switch {
+	case r.typ == "*":
+		return 0
+	case r.subtype == "*":
+		return 1
+	default:
+		return 2
+	}
+}
+
+// parseAccept parses an Accept header, invalid ranges are skipped
+func parseAccept(accept string) []mediaRange {
+	var ranges []mediaRange
+	for _, part := range strings.Split(accept, ",") {
+		mt, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		typ, subtype, ok := strings.Cut(mt, "/")
+		if !ok {
+			continue
+		}
+
+		r := mediaRange{typ: typ, subtype: subtype, q: 1}
+		if q, ok := params["q"]; ok {
+			if r.q, err = strconv.ParseFloat(q, 64); err != nil {
+				continue
+			}
+		}
+		ranges = append(ranges, r)
+	}
+
+	sort.SliceStable(ranges, func(i, j int) bool {
+		if ranges[i].q != ranges[j].q {
+			return ranges[i].q > ranges[j].q
+		}
+
+		return ranges[i].specificity() > ranges[j].specificity()
+	})
+
+	return ranges
+}
+
+// jsonCodec is the application/json codec
+type jsonCodec struct{}
+
+func (jsonCodec) ContentType() string { return echo.MIMEApplicationJSONCharsetUTF8 }
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) { return json.Marshal(v) }
+
+func (jsonCodec) Decode(r io.Reader, v interface{}) error { return json.NewDecoder(r).Decode(v) }
+
+func (jsonCodec) Indent(b []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, b, "", "\t"); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// msgpackCodec is the application/msgpack codec, it uses the json struct tags
+type msgpackCodec struct{}
+
+func (msgpackCodec) ContentType() string { return MIMEApplicationMsgpack }
+
+func (msgpackCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetCustomStructTag("json")
+	enc.UseCompactInts(true)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (msgpackCodec) Decode(r io.Reader, v interface{}) error {
+	dec := msgpack.NewDecoder(r)
+	dec.SetCustomStructTag("json")
+
+	return dec.Decode(v)
+}
+
+// cborCodec is the application/cbor codec, it falls back to the json struct tags
+type cborCodec struct {
+	enc cbor.EncMode
+}
+
+func newCBORCodec() cborCodec {
+	// the options are static, an error is a programming error
+	enc, err := cbor.EncOptions{Time: cbor.TimeRFC3339Nano}.EncMode()
+	if err != nil {
+		panic(err)
+	}
+
+	return cborCodec{enc: enc}
+}
+
+func (cborCodec) ContentType() string { return MIMEApplicationCBOR }
+
+func (c cborCodec) Marshal(v interface{}) ([]byte, error) { return c.enc.Marshal(v) }
+
+func (cborCodec) Decode(r io.Reader, v interface{}) error { return cbor.NewDecoder(r).Decode(v) }
+
+// xmlCodec is the application/xml codec
+type xmlCodec struct{}
+
+func (xmlCodec) ContentType() string { return echo.MIMEApplicationXMLCharsetUTF8 }
+
+func (xmlCodec) Marshal(v interface{}) ([]byte, error) {
+	b, err := xml.Marshal(v)
+	if err != nil {
+		var ute *xml.UnsupportedTypeError
+		if errors.As(err, &ute) {
+			return nil, fmt.Errorf("%w: %s", ErrNotRepresentable, err)
+		}
+
+		return nil, err
+	}
+
+	return append([]byte(xml.Header), b...), nil
+}
+
+func (xmlCodec) Decode(r io.Reader, v interface{}) error { return xml.NewDecoder(r).Decode(v) }
+
+func (xmlCodec) Indent(b []byte) ([]byte, error) {
+	// the encoder does not break the line after the header
+	buf := bytes.NewBufferString(xml.Header)
+	dec := xml.NewDecoder(bytes.NewReader(bytes.TrimPrefix(b, []byte(xml.Header))))
+	enc := xml.NewEncoder(buf)
+	enc.Indent("", "\t")
+	for {
+		token, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		// whitespace between elements is replaced by the indentation
+		if cd, ok := token.(xml.CharData); ok && len(bytes.TrimSpace(cd)) == 0 {
+			continue
+		}
+		if err := enc.EncodeToken(token); err != nil {
+			return nil, err
+		}
+	}
+	if err := enc.Flush(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// csvCodec is the text/csv codec of list responses, slices of structs are encoded
+// with a header row made of the json field names
+type csvCodec struct{}
+
+func (csvCodec) ContentType() string { return "text/csv; charset=UTF-8" }
+
+func (csvCodec) Marshal(v interface{}) ([]byte, error) {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+		return nil, ErrNotRepresentable
+	}
+	elem := rv.Type().Elem()
+	if elem.Kind() == reflect.Ptr {
+		elem = elem.Elem()
+	}
+	if elem.Kind() != reflect.Struct {
+		return nil, ErrNotRepresentable
+	}
+
+	fields, header := csvFields(elem)
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	if err := w.Write(header); err != nil {
+		return nil, err
+	}
+	for i := 0; i < rv.Len(); i++ {
+		item := reflect.Indirect(rv.Index(i))
+		record := make([]string, len(fields))
+		if item.IsValid() {
+			for j, f := range fields {
+				s, err := csvValue(item.Field(f))
+				if err != nil {
+					return nil, err
+				}
+				record[j] = s
+			}
+		}
+		if err := w.Write(record); err != nil {
+			return nil, err
+		}
+	}
+	w.Flush()
+
+	return buf.Bytes(), w.Error()
+}
+
+func (csvCodec) Decode(r io.Reader, v interface{}) error { return ErrNotDecodable }
+
+func (csvCodec) ListOnly() {}
+
+// csvFields returns the indexes and the column names of the exported fields of t
+func csvFields(t reflect.Type) ([]int, []string) {
+	var (
+		fields []int
+		header []string
+	)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fields = append(fields, i)
+		header = append(header, name)
+	}
+
+	return fields, header
+}
+
+// csvValue formats a field value, composite values are JSON encoded
+func csvValue(v reflect.Value) (string, error) {
+	if t, ok := v.Interface().(time.Time); ok {
+		return t.Format(time.RFC3339Nano), nil
+	}
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return "", nil
+		}
+
+		return csvValue(v.Elem())
+	case reflect.Struct, reflect.Map, reflect.Slice, reflect.Array:
+		b, err := json.Marshal(v.Interface())
+
+		return string(b), err
+	default:
+		return fmt.Sprint(v.Interface()), nil
+	}
+}
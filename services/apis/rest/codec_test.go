@@ -0,0 +1,105 @@
+package rest
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCodecs_Negotiate(t *testing.T) {
+	codecs := DefaultCodecs()
+
+	tests := []struct {
+		name   string
+		accept string
+		lists  bool
+		want   string
+		wantOK bool
+	}{
+		{name: "No header", accept: "", want: echo.MIMEApplicationJSONCharsetUTF8, wantOK: true},
+		{name: "Any", accept: "*/*", want: echo.MIMEApplicationJSONCharsetUTF8, wantOK: true},
+		{name: "Exact", accept: "application/cbor", want: MIMEApplicationCBOR, wantOK: true},
+		{name: "Alias", accept: "application/x-msgpack", want: MIMEApplicationMsgpack, wantOK: true},
+		{name: "Parameters are ignored", accept: "application/xml; charset=utf-8", want: echo.MIMEApplicationXMLCharsetUTF8, wantOK: true},
+		{name: "Quality", accept: "application/json;q=0.5, text/csv", lists: true, want: "text/csv; charset=UTF-8", wantOK: true},
+		{name: "Lists only", accept: "application/json;q=0.5, text/csv", want: echo.MIMEApplicationJSONCharsetUTF8, wantOK: true},
+		{name: "Lists only refused", accept: "text/csv", wantOK: false},
+		{name: "Specific range wins ties", accept: "*/*, application/msgpack", want: MIMEApplicationMsgpack, wantOK: true},
+		{name: "Subtype range", accept: "text/*", want: echo.MIMEApplicationXMLCharsetUTF8, wantOK: true},
+		{name: "Unsupported types are skipped", accept: "image/png, application/xml;q=0.1", want: echo.MIMEApplicationXMLCharsetUTF8, wantOK: true},
+		{name: "Refused type", accept: "*/*, application/json;q=0", want: MIMEApplicationMsgpack, wantOK: true},
+		{name: "Unsupported", accept: "image/png", wantOK: false},
+		{name: "Everything refused", accept: "*/*;q=0", wantOK: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			codec, ok := codecs.Negotiate(tt.accept, tt.lists)
+			assert.Equal(t, tt.wantOK, ok)
+			if tt.wantOK {
+				assert.Equal(t, tt.want, codec.ContentType())
+			}
+		})
+	}
+}
+
+func TestCodecs_RoundTrip(t *testing.T) {
+	type item struct {
+		ID        int       `json:"id" xml:"id"`
+		Name      string    `json:"name" xml:"name"`
+		CreatedAt time.Time `json:"created_at" xml:"created_at"`
+	}
+	in := item{ID: 1, Name: "thing", CreatedAt: time.Date(2022, 7, 1, 10, 0, 0, 0, time.UTC)}
+
+	for _, mt := range []string{echo.MIMEApplicationJSON, MIMEApplicationMsgpack, MIMEApplicationCBOR, echo.MIMEApplicationXML} {
+		t.Run(mt, func(t *testing.T) {
+			codec, ok := DefaultCodecs().Lookup(mt)
+			require.True(t, ok)
+
+			b, err := codec.Marshal(in)
+			require.NoError(t, err)
+
+			var out item
+			require.NoError(t, codec.Decode(bytes.NewReader(b), &out))
+			assert.Equal(t, in.ID, out.ID)
+			assert.Equal(t, in.Name, out.Name)
+			assert.True(t, in.CreatedAt.Equal(out.CreatedAt))
+		})
+	}
+}
+
+func TestXMLCodec_Indent(t *testing.T) {
+	b, err := xmlCodec{}.Marshal(Message{Message: "Hello, World!"})
+	require.NoError(t, err)
+	assert.Equal(t, `<?xml version="1.0" encoding="UTF-8"?>`+"\n"+`<message><text>Hello, World!</text></message>`, string(b))
+
+	indented, err := xmlCodec{}.Indent(b)
+	require.NoError(t, err)
+	assert.Equal(t, `<?xml version="1.0" encoding="UTF-8"?>`+"\n<message>\n\t<text>Hello, World!</text>\n</message>", string(indented))
+
+	_, err = xmlCodec{}.Marshal(map[string]string{"message": "Hello"})
+	assert.ErrorIs(t, err, ErrNotRepresentable)
+}
+
+func TestCSVCodec_Marshal(t *testing.T) {
+	createdAt := time.Date(2022, 7, 1, 10, 0, 0, 0, time.UTC)
+	users := []*User{
+		{ID: 1, Email: "jane.doe@replaceme.com", FirstName: "Jane", LastName: "Doe", Description: "Loves go, and commas", Active: true, CreatedAt: createdAt, UpdatedAt: createdAt},
+		{ID: 2, Email: "john.doe@replaceme.com", FirstName: "John", LastName: "Doe", CreatedAt: createdAt, UpdatedAt: createdAt},
+	}
+
+	b, err := csvCodec{}.Marshal(users)
+	require.NoError(t, err)
+	assert.Equal(t, "id,email,first_name,last_name,description,active,created_at,updated_at\n"+
+		"1,jane.doe@replaceme.com,Jane,Doe,\"Loves go, and commas\",true,2022-07-01T10:00:00Z,2022-07-01T10:00:00Z\n"+
+		"2,john.doe@replaceme.com,John,Doe,,false,2022-07-01T10:00:00Z,2022-07-01T10:00:00Z\n", string(b))
+
+	_, err = csvCodec{}.Marshal(users[0])
+	assert.ErrorIs(t, err, ErrNotRepresentable)
+	_, err = csvCodec{}.Marshal([]string{"a"})
+	assert.ErrorIs(t, err, ErrNotRepresentable)
+	assert.ErrorIs(t, csvCodec{}.Decode(bytes.NewReader(b), &users), ErrNotDecodable)
+}
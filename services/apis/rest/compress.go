@@ -0,0 +1,211 @@
+package rest
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/efimovalex/replaceme/config"
+	"github.com/labstack/echo/v4"
+)
+
+// Content codings supported by CompressMiddleware, in order of preference
+const (
+	encodingBrotli = "br"
+	encodingGzip   = "gzip"
+)
+
+// CompressMiddleware compresses response bodies with brotli or gzip, as accepted by the client.
+// Bodies shorter than the configured minimum length are sent as is. The strong ETags of the responses to these
+// clients are made weak, an encoded body is not byte for byte the one the ETag was computed from.
+func CompressMiddleware(cfg config.Compression) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		if !cfg.Enable {
+			return next
+		}
+
+		return func(c echo.Context) error {
+			res := c.Response()
+			res.Header().Add(echo.HeaderVary, echo.HeaderAcceptEncoding)
+
+			encoding := acceptedEncoding(c.Request().Header.Get(echo.HeaderAcceptEncoding))
+			if encoding == "" || c.Request().Method == http.MethodHead {
+				return next(c)
+			}
+
+			cw := &compressWriter{ResponseWriter: res.Writer, encoding: encoding, cfg: cfg, status: http.StatusOK}
+			res.Writer = cw
+			defer func() {
+				// errors of the last write cannot be reported, the status was already sent
+				_ = cw.Close()
+				res.Writer = cw.ResponseWriter
+			}()
+
+			if err := next(c); err != nil {
+				// render the error now so that it is compressed too
+				c.Error(err)
+			}
+
+			return nil
+		}
+	}
+}
+
+// acceptedEncoding returns the preferred content coding accepted by an Accept-Encoding header, or an empty string
+func acceptedEncoding(acceptEncoding string) string {
+	accepted := map[string]bool{}
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if params = strings.TrimSpace(params); strings.HasPrefix(params, "q=") {
+			q, _ = strconv.ParseFloat(strings.TrimPrefix(params, "q="), 64)
+		}
+		accepted[strings.ToLower(strings.TrimSpace(coding))] = q > 0
+	}
+
+	for _, encoding := range []string{encodingBrotli, encodingGzip} {
+		if accepted[encoding] {
+			return encoding
+		}
+	}
+
+	return ""
+}
+
+// compressWriter buffers the response body until it reaches the minimum length,
+// then compresses it. The status is deferred until the body is compressed or complete
+// so that the Content-Encoding header can still be set.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	cfg      config.Compression
+
+	status      int
+	wroteHeader bool
+	buf         bytes.Buffer
+	compressor  io.WriteCloser
+	passthrough bool
+}
+
+// WriteHeader records the status, it is sent with the first compressed bytes or when the response is complete
+func (w *compressWriter) WriteHeader(status int) {
+	w.status = status
+}
+
+// Write compresses b once the body is longer than the minimum length
+func (w *compressWriter) Write(b []byte) (int, error) {
+	switch {
+	case w.passthrough:
+		return w.ResponseWriter.Write(b)
+	case w.compressor != nil:
+		return w.compressor.Write(b)
+	}
+
+	w.buf.Write(b)
+	if w.buf.Len() < w.cfg.MinLength {
+		return len(b), nil
+	}
+	if err := w.start(); err != nil {
+		return 0, err
+	}
+
+	return len(b), nil
+}
+
+// Flush starts compressing whatever was buffered, streamed responses are not held back by the minimum length
+func (w *compressWriter) Flush() {
+	if w.compressor == nil && !w.passthrough {
+		if err := w.start(); err != nil {
+			return
+		}
+	}
+	if f, ok := w.compressor.(interface{ Flush() error }); ok {
+		_ = f.Flush()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack lets websocket handlers take over the connection
+func (w *compressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer does not support hijacking")
+	}
+
+	return hj.Hijack()
+}
+
+// Close completes the compressed stream, or sends the buffered body uncompressed if it is too short
+func (w *compressWriter) Close() error {
+	if w.compressor != nil {
+		return w.compressor.Close()
+	}
+	if w.passthrough {
+		return nil
+	}
+
+	w.passthrough = true
+	w.writeHeader()
+	if w.buf.Len() == 0 {
+		return nil
+	}
+	_, err := w.ResponseWriter.Write(w.buf.Bytes())
+
+	return err
+}
+
+// start sends the status and the buffered body through the compressor.
+// Responses already encoded by the handler are passed through.
+func (w *compressWriter) start() error {
+	h := w.ResponseWriter.Header()
+	if h.Get(echo.HeaderContentEncoding) != "" || w.status == http.StatusNoContent || w.status == http.StatusNotModified {
+		w.passthrough = true
+		w.writeHeader()
+		_, err := w.ResponseWriter.Write(w.buf.Bytes())
+		w.buf.Reset()
+
+		return err
+	}
+
+	h.Del(echo.HeaderContentLength)
+	h.Set(echo.HeaderContentEncoding, w.encoding)
+	w.writeHeader()
+
+	switch w.encoding {
+	case encodingBrotli:
+		w.compressor = brotli.NewWriterLevel(w.ResponseWriter, w.cfg.BrotliLevel)
+	default:
+		gw, err := gzip.NewWriterLevel(w.ResponseWriter, w.cfg.GzipLevel)
+		if err != nil {
+			return err
+		}
+		w.compressor = gw
+	}
+
+	_, err := w.compressor.Write(w.buf.Bytes())
+	w.buf.Reset()
+
+	return err
+}
+
+// writeHeader sends the status once, with a weak ETag: a response with a strong ETag would be sent with it whether
+// its body is encoded or not, a 304 too as it answers for the encoded variant
+func (w *compressWriter) writeHeader() {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		h := w.ResponseWriter.Header()
+		if etag := h.Get(HeaderETag); strings.HasPrefix(etag, `"`) {
+			h.Set(HeaderETag, "W/"+etag)
+		}
+		w.ResponseWriter.WriteHeader(w.status)
+	}
+}
@@ -0,0 +1,92 @@
+package rest
+
+import (
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/efimovalex/replaceme/config"
+	"github.com/efimovalex/replaceme/internal/apperr"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompressMiddleware(t *testing.T) {
+	cfg := config.Compression{Enable: true, MinLength: 64, GzipLevel: gzip.DefaultCompression, BrotliLevel: 4}
+	long := strings.Repeat("compressible ", 20)
+
+	r := NewTestREST(t)
+	e := echo.New()
+	e.HTTPErrorHandler = r.HTTPErrorHandler
+	e.Use(CompressMiddleware(cfg))
+	e.GET("/short", func(c echo.Context) error { return c.String(http.StatusOK, "short") })
+	e.GET("/long", func(c echo.Context) error { return c.String(http.StatusCreated, long) })
+	e.GET("/error", func(c echo.Context) error {
+		return apperr.Validation(apperr.CodeValidation, long)
+	})
+	e.GET("/not-modified", func(c echo.Context) error { return c.NoContent(http.StatusNotModified) })
+	e.GET("/etag", func(c echo.Context) error {
+		c.Response().Header().Set(HeaderETag, strongETag([]byte(long)))
+		return c.String(http.StatusOK, long)
+	})
+
+	tests := []struct {
+		name             string
+		path             string
+		acceptEncoding   string
+		expectedStatus   int
+		expectedEncoding string
+		expectedBody     string
+		expectedETag     string
+	}{
+		{name: "Short body", path: "/short", acceptEncoding: "gzip", expectedStatus: http.StatusOK, expectedBody: "short"},
+		{name: "Gzip", path: "/long", acceptEncoding: "gzip", expectedStatus: http.StatusCreated, expectedEncoding: "gzip", expectedBody: long},
+		{name: "Brotli is preferred", path: "/long", acceptEncoding: "gzip, deflate, br", expectedStatus: http.StatusCreated, expectedEncoding: "br", expectedBody: long},
+		{name: "Refused coding", path: "/long", acceptEncoding: "br;q=0, gzip;q=0.5", expectedStatus: http.StatusCreated, expectedEncoding: "gzip", expectedBody: long},
+		{name: "Unsupported coding", path: "/long", acceptEncoding: "deflate", expectedStatus: http.StatusCreated, expectedBody: long},
+		{name: "No coding", path: "/long", expectedStatus: http.StatusCreated, expectedBody: long},
+		{name: "Errors", path: "/error", acceptEncoding: "gzip", expectedStatus: http.StatusUnprocessableEntity, expectedEncoding: "gzip"},
+		{name: "No body", path: "/not-modified", acceptEncoding: "gzip", expectedStatus: http.StatusNotModified},
+		{name: "Weak ETag of an encoded body", path: "/etag", acceptEncoding: "gzip", expectedStatus: http.StatusOK, expectedEncoding: "gzip", expectedBody: long, expectedETag: "W/" + strongETag([]byte(long))},
+		{name: "Strong ETag of an identity body", path: "/etag", expectedStatus: http.StatusOK, expectedBody: long, expectedETag: strongETag([]byte(long))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.acceptEncoding != "" {
+				req.Header.Set(echo.HeaderAcceptEncoding, tt.acceptEncoding)
+			}
+			w := httptest.NewRecorder()
+			e.ServeHTTP(w, req)
+
+			assert.Equal(t, tt.expectedStatus, w.Code)
+			assert.Equal(t, tt.expectedEncoding, w.Header().Get(echo.HeaderContentEncoding))
+			assert.Contains(t, w.Header().Values(echo.HeaderVary), echo.HeaderAcceptEncoding)
+			assert.Equal(t, tt.expectedETag, w.Header().Get(HeaderETag))
+
+			var body io.Reader = w.Body
+			switch tt.expectedEncoding {
+			case "gzip":
+				gr, err := gzip.NewReader(w.Body)
+				require.NoError(t, err)
+				body = gr
+			case "br":
+				body = brotli.NewReader(w.Body)
+			}
+			b, err := ioutil.ReadAll(body)
+			require.NoError(t, err)
+			if tt.expectedBody != "" {
+				assert.Equal(t, tt.expectedBody, string(b))
+			}
+			if tt.name == "Errors" {
+				assert.Contains(t, string(b), `"code": "validation_failed"`)
+			}
+		})
+	}
+}
@@ -0,0 +1,108 @@
+package rest
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/efimovalex/replaceme/internal/apperr"
+	"github.com/efimovalex/replaceme/internal/requestid"
+	"github.com/labstack/echo/v4"
+)
+
+// MIMEApplicationProblemJSON is the RFC 7807 problem details media type
+const MIMEApplicationProblemJSON = "application/problem+json"
+
+// Problem is the RFC 7807 problem details body returned for every error response
+type Problem struct {
+	Type          string `json:"type"`
+	Title         string `json:"title"`
+	Status        int    `json:"status"`
+	Detail        string `json:"detail,omitempty"`
+	Instance      string `json:"instance,omitempty"`
+	Code          string `json:"code"`
+	CorrelationID string `json:"correlation_id,omitempty"`
+
+	Errors []apperr.FieldError `json:"errors,omitempty"`
+}
+
+// HTTPErrorHandler is the central echo error handler, it renders every error as problem+json.
+func (rest *R) HTTPErrorHandler(err error, c echo.Context) {
+	if c.Response().Committed {
+		return
+	}
+
+	_ = rest.JSONError(c, err)
+}
+
+// JSONError returns an HTTP response as a problem+json message with the status code
+// based on the app err Kind and the detail from the app err Message.
+// Errors that are not app errors are never exposed, they are logged as 5xx with a correlation id.
+func (rest *R) JSONError(c echo.Context, err error) error {
+	p := rest.problem(c, err)
+	if p.Status >= http.StatusInternalServerError {
+		requestid.Logger(c.Request().Context(), rest.logger).Error().Err(err).
+			Str("correlation_id", p.CorrelationID).
+			Str("code", p.Code).
+			Msgf("%s %s failed", c.Request().Method, c.Request().URL.Path)
+	}
+
+	c.Response().Header().Set(echo.HeaderContentType, MIMEApplicationProblemJSON)
+	// errors must not be stored by caches, whatever the route policy is
+	c.Response().Header().Set(echo.HeaderCacheControl, CacheNoStore)
+
+	return rest.JSON(c, p.Status, p)
+}
+
+// problem converts err into problem details
+func (rest *R) problem(c echo.Context, err error) Problem {
+	p := Problem{
+		Type:          "about:blank",
+		Instance:      c.Request().URL.Path,
+		CorrelationID: correlationID(c),
+	}
+
+	var he *echo.HTTPError
+	if errors.As(err, &he) {
+		p.Status = he.Code
+		p.Code = statusCode(he.Code)
+		if msg := fmt.Sprint(he.Message); he.Code < http.StatusInternalServerError && msg != http.StatusText(he.Code) {
+			p.Detail = msg
+		}
+	} else {
+		ae := apperr.As(err)
+		p.Status = ae.Kind.HTTPStatus()
+		p.Code = ae.Code
+		if ae.Kind != apperr.KindInternal {
+			p.Detail = ae.Message
+			p.Errors = ae.Fields
+		}
+	}
+
+	if p.Code == "" {
+		p.Code = statusCode(p.Status)
+	}
+	p.Title = http.StatusText(p.Status)
+
+	return p
+}
+
+// correlationID returns the request id assigned to the request
+func correlationID(c echo.Context) string {
+	if id, err := requestid.IDValue(c.Request().Context()); err == nil {
+		return id
+	}
+
+	return c.Request().Header.Get(echo.HeaderXRequestID)
+}
+
+// statusCode returns a stable code for the given HTTP status, e.g. 404 -> not_found
+func statusCode(status int) string {
+	text := http.StatusText(status)
+	if text == "" || status == http.StatusInternalServerError {
+		return apperr.CodeInternal
+	}
+
+	return strings.ReplaceAll(strings.ToLower(text), " ", "_")
+}
@@ -0,0 +1,79 @@
+package rest
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/efimovalex/replaceme/internal/apperr"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestR_HTTPErrorHandler(t *testing.T) {
+	tests := []struct {
+		name               string
+		err                error
+		expectedStatusCode int
+	}{
+		{
+			name:               "Conflict app error",
+			err:                apperr.Conflict(apperr.CodeUserEmailTaken, "user with email test@test.com does already exist"),
+			expectedStatusCode: http.StatusConflict,
+		},
+		{
+			name:               "Internal error is not leaked",
+			err:                errors.New(`pq: password authentication failed for user "replaceme"`),
+			expectedStatusCode: http.StatusInternalServerError,
+		},
+		{
+			name:               "Echo HTTP error",
+			err:                echo.ErrNotFound,
+			expectedStatusCode: http.StatusNotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewTestREST(t)
+
+			req := httptest.NewRequest(http.MethodGet, "/users", nil)
+			req.Header.Set(echo.HeaderXRequestID, "some-request-id")
+			w := httptest.NewRecorder()
+			c := r.Router.NewContext(req, w)
+
+			r.HTTPErrorHandler(tt.err, c)
+
+			assert.Equal(t, tt.expectedStatusCode, w.Code)
+			assert.Equal(t, MIMEApplicationProblemJSON, w.Header().Get(echo.HeaderContentType))
+			checkResponseWithTestDataFile(t, w.Body.Bytes(), []string{})
+		})
+	}
+
+	t.Run("Committed response is left untouched", func(t *testing.T) {
+		r := NewTestREST(t)
+
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		w := httptest.NewRecorder()
+		c := r.Router.NewContext(req, w)
+		assert.NoError(t, c.NoContent(http.StatusNoContent))
+
+		r.HTTPErrorHandler(errors.New("late error"), c)
+
+		assert.Equal(t, http.StatusNoContent, w.Code)
+		assert.Empty(t, w.Body.String())
+	})
+}
+
+func TestR_Router_NotFound(t *testing.T) {
+	r := NewTestREST(t)
+
+	req := httptest.NewRequest(http.MethodGet, "/not-a-route", nil)
+	w := httptest.NewRecorder()
+	r.Router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Equal(t, MIMEApplicationProblemJSON, w.Header().Get(echo.HeaderContentType))
+	assert.NotEmpty(t, w.Header().Get(echo.HeaderXRequestID))
+	checkResponseWithTestDataFile(t, w.Body.Bytes(), []string{"correlation_id"})
+}
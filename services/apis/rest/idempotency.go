@@ -0,0 +1,209 @@
+package rest
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/efimovalex/replaceme/adapters/redisdb"
+	"github.com/efimovalex/replaceme/config"
+	"github.com/efimovalex/replaceme/internal/apperr"
+	auth "github.com/efimovalex/replaceme/internal/auth0"
+	"github.com/efimovalex/replaceme/internal/requestid"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// HeaderIdempotencyKey is the client provided key of an idempotent request
+	HeaderIdempotencyKey = "Idempotency-Key"
+	// HeaderIdempotentReplayed is set on responses replayed from the idempotency store
+	HeaderIdempotentReplayed = "Idempotent-Replayed"
+
+	maxIdempotencyKeyLength = 255
+	idempotencyPollInterval = 50 * time.Millisecond
+)
+
+// idempotentHeaders are the response headers stored and replayed with an idempotent response
+var idempotentHeaders = []string{echo.HeaderContentType, echo.HeaderLocation, "Content-Language"}
+
+// IdempotencyStore is the interface for the distributed idempotency store
+type IdempotencyStore interface {
+	AcquireIdempotencyLock(ctx context.Context, key string, ttl time.Duration) (string, error)
+	ReleaseIdempotencyLock(ctx context.Context, key, token string) error
+	GetIdempotentResponse(ctx context.Context, key string) (*redisdb.IdempotentResponse, error)
+	SetIdempotentResponse(ctx context.Context, key string, res *redisdb.IdempotentResponse, ttl time.Duration) error
+}
+
+// IdempotencyMiddleware makes unsafe requests carrying an Idempotency-Key header safe to retry.
+// The first response for a key, scoped per user and route, is stored and replayed on retries.
+// Retries with a different request body are rejected with a 422, and concurrent retries wait
+// for the first request to complete instead of executing again.
+// The keys of anonymous requests are scoped by client IP and request body too, so that a response
+// is only replayed to a client which sent the very same request.
+func (rest *R) IdempotencyMiddleware(cfg config.Idempotency) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		if !cfg.Enable || rest.Idempotency == nil {
+			return next
+		}
+
+		return func(c echo.Context) error {
+			req := c.Request()
+			idempotencyKey := req.Header.Get(HeaderIdempotencyKey)
+			if idempotencyKey == "" || isSafeMethod(req.Method) {
+				return next(c)
+			}
+			if len(idempotencyKey) > maxIdempotencyKeyLength {
+				return apperr.Validation(apperr.CodeValidation, "request validation failed").WithFields(apperr.FieldError{
+					Pointer: "/headers/" + HeaderIdempotencyKey,
+					Rule:    "max",
+					Detail:  "must be at most 255 characters long",
+				})
+			}
+
+			body, err := io.ReadAll(req.Body)
+			if err != nil {
+				return apperr.Internal(err)
+			}
+			req.Body = io.NopCloser(bytes.NewReader(body))
+
+			ctx := req.Context()
+			fingerprint := requestFingerprint(req.Method, c.Path(), body)
+			key := idempotencyPrincipal(c, fingerprint) + ":" + req.Method + " " + c.Path() + ":" + idempotencyKey
+
+			deadline := time.Now().Add(cfg.LockWait)
+			for {
+				stored, err := rest.Idempotency.GetIdempotentResponse(ctx, key)
+				if err != nil {
+					return apperr.Unavailable(apperr.CodeUnavailable, "idempotency store unavailable").Wrap(err)
+				}
+				if stored != nil {
+					return replayIdempotentResponse(c, stored, fingerprint)
+				}
+
+				token, err := rest.Idempotency.AcquireIdempotencyLock(ctx, key, cfg.LockTTL)
+				if err != nil {
+					return apperr.Unavailable(apperr.CodeUnavailable, "idempotency store unavailable").Wrap(err)
+				}
+				if token != "" {
+					return rest.executeIdempotent(c, next, cfg, key, token, fingerprint)
+				}
+
+				// another request with the same key is in flight, wait for its response
+				if time.Now().After(deadline) {
+					return apperr.Conflict(apperr.CodeIdempotencyInProgress, "a request with the same idempotency key is in progress")
+				}
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case <-time.After(idempotencyPollInterval):
+				}
+			}
+		}
+	}
+}
+
+// executeIdempotent runs the handler while holding the idempotency lock and stores its response.
+// Server errors are not stored so that retries can execute again.
+func (rest *R) executeIdempotent(c echo.Context, next echo.HandlerFunc, cfg config.Idempotency, key, token, fingerprint string) error {
+	ctx := c.Request().Context()
+	logger := requestid.Logger(ctx, rest.logger)
+	defer func() {
+		// the lock must be released even if the request was cancelled
+		if err := rest.Idempotency.ReleaseIdempotencyLock(context.Background(), key, token); err != nil {
+			logger.Error().Err(err).Msg("failed to release idempotency lock")
+		}
+	}()
+
+	res := c.Response()
+	recorder := &bodyRecorder{ResponseWriter: res.Writer}
+	res.Writer = recorder
+
+	if err := next(c); err != nil {
+		// render the error now so that it is recorded
+		c.Error(err)
+	}
+	res.Writer = recorder.ResponseWriter
+
+	if res.Status >= http.StatusInternalServerError {
+		return nil
+	}
+
+	stored := &redisdb.IdempotentResponse{
+		Fingerprint: fingerprint,
+		Status:      res.Status,
+		Header:      http.Header{},
+		Body:        recorder.body.Bytes(),
+	}
+	for _, h := range idempotentHeaders {
+		if v := res.Header().Values(h); len(v) > 0 {
+			stored.Header[h] = v
+		}
+	}
+	if err := rest.Idempotency.SetIdempotentResponse(ctx, key, stored, cfg.TTL); err != nil {
+		logger.Error().Err(err).Msg("failed to store idempotent response")
+	}
+
+	return nil
+}
+
+// replayIdempotentResponse writes the stored response if it was produced for the same request
+func replayIdempotentResponse(c echo.Context, stored *redisdb.IdempotentResponse, fingerprint string) error {
+	if stored.Fingerprint != fingerprint {
+		return apperr.Validation(apperr.CodeIdempotencyKeyReused, "idempotency key was already used for a different request")
+	}
+
+	for k, v := range stored.Header {
+		c.Response().Header()[k] = v
+	}
+	c.Response().Header().Set(HeaderIdempotentReplayed, "true")
+	c.Response().WriteHeader(stored.Status)
+	_, err := c.Response().Write(stored.Body)
+
+	return err
+}
+
+// idempotencyPrincipal identifies the user of an authenticated request by the issuer and the subject of its token.
+// An anonymous request is identified by its client IP and its fingerprint.
+func idempotencyPrincipal(c echo.Context, fingerprint string) string {
+	ctx := c.Request().Context()
+	userID, err := auth.UserIDValue(ctx)
+	if err != nil {
+		return "anonymous " + c.RealIP() + " " + fingerprint
+	}
+	issuer, err := auth.IssuerValue(ctx)
+	if err != nil {
+		return "anonymous " + c.RealIP() + " " + fingerprint
+	}
+
+	return issuer + " " + userID
+}
+
+// requestFingerprint identifies a request by its method, route and body
+func requestFingerprint(method, path string, body []byte) string {
+	h := sha256.New()
+	_, _ = io.WriteString(h, method+" "+path+"\n")
+	_, _ = h.Write(body)
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func isSafeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+// bodyRecorder copies the response body written to the underlying http.ResponseWriter
+type bodyRecorder struct {
+	http.ResponseWriter
+	body bytes.Buffer
+}
+
+// Write writes b to the response and records it
+func (r *bodyRecorder) Write(b []byte) (int, error) {
+	r.body.Write(b)
+
+	return r.ResponseWriter.Write(b)
+}
@@ -0,0 +1,225 @@
+package rest
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/efimovalex/replaceme/adapters/redisdb"
+	"github.com/efimovalex/replaceme/config"
+	"github.com/efimovalex/replaceme/internal/apperr"
+	auth "github.com/efimovalex/replaceme/internal/auth0"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+// idempotencyStoreMock is an in-memory IdempotencyStore
+type idempotencyStoreMock struct {
+	mu        sync.Mutex
+	locks     map[string]string
+	responses map[string]*redisdb.IdempotentResponse
+}
+
+func newIdempotencyStoreMock() *idempotencyStoreMock {
+	return &idempotencyStoreMock{locks: map[string]string{}, responses: map[string]*redisdb.IdempotentResponse{}}
+}
+
+func (m *idempotencyStoreMock) AcquireIdempotencyLock(ctx context.Context, key string, ttl time.Duration) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.locks[key]; ok {
+		return "", nil
+	}
+	m.locks[key] = "token"
+
+	return "token", nil
+}
+
+func (m *idempotencyStoreMock) ReleaseIdempotencyLock(ctx context.Context, key, token string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.locks[key] == token {
+		delete(m.locks, key)
+	}
+
+	return nil
+}
+
+func (m *idempotencyStoreMock) GetIdempotentResponse(ctx context.Context, key string) (*redisdb.IdempotentResponse, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.responses[key], nil
+}
+
+func (m *idempotencyStoreMock) SetIdempotentResponse(ctx context.Context, key string, res *redisdb.IdempotentResponse, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.responses[key] = res
+
+	return nil
+}
+
+func TestR_IdempotencyMiddleware(t *testing.T) {
+	cfg := config.Idempotency{Enable: true, TTL: time.Hour, LockTTL: time.Minute, LockWait: time.Second}
+
+	setup := func(t *testing.T, handler echo.HandlerFunc) (*R, *echo.Echo) {
+		r := NewTestREST(t)
+		r.Idempotency = newIdempotencyStoreMock()
+		e := echo.New()
+		e.HTTPErrorHandler = r.HTTPErrorHandler
+		e.POST("/things", handler, r.IdempotencyMiddleware(cfg))
+
+		return r, e
+	}
+	// doFrom sends a request of the user of this service from the client IP, anonymous when userID is empty
+	doFrom := func(e *echo.Echo, ip, userID, key, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/things", strings.NewReader(body))
+		req.RemoteAddr = ip + ":1234"
+		if userID != "" {
+			req = req.WithContext(auth.WithIssuer(auth.WithUserID(req.Context(), userID), testTokenConfig.Issuer))
+		}
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		if key != "" {
+			req.Header.Set(HeaderIdempotencyKey, key)
+		}
+		w := httptest.NewRecorder()
+		e.ServeHTTP(w, req)
+
+		return w
+	}
+	do := func(e *echo.Echo, userID, key, body string) *httptest.ResponseRecorder {
+		return doFrom(e, "192.0.2.1", userID, key, body)
+	}
+
+	t.Run("Retries replay the first response", func(t *testing.T) {
+		var calls int32
+		_, e := setup(t, func(c echo.Context) error {
+			n := atomic.AddInt32(&calls, 1)
+			c.Response().Header().Set(echo.HeaderLocation, "/things/1")
+
+			return c.JSON(http.StatusCreated, map[string]int32{"call": n})
+		})
+
+		first := do(e, "1", "some-key", `{"name":"thing"}`)
+		assert.Equal(t, http.StatusCreated, first.Code)
+		assert.Empty(t, first.Header().Get(HeaderIdempotentReplayed))
+
+		retry := do(e, "1", "some-key", `{"name":"thing"}`)
+		assert.Equal(t, http.StatusCreated, retry.Code)
+		assert.Equal(t, "true", retry.Header().Get(HeaderIdempotentReplayed))
+		assert.Equal(t, "/things/1", retry.Header().Get(echo.HeaderLocation))
+		assert.Equal(t, echo.MIMEApplicationJSONCharsetUTF8, retry.Header().Get(echo.HeaderContentType))
+		assert.Equal(t, first.Body.String(), retry.Body.String())
+		assert.Equal(t, int32(1), calls)
+
+		other := do(e, "1", "other-key", `{"name":"thing"}`)
+		assert.Equal(t, `{"call":2}`+"\n", other.Body.String())
+
+		without := do(e, "1", "", `{"name":"thing"}`)
+		assert.Equal(t, `{"call":3}`+"\n", without.Body.String())
+	})
+
+	t.Run("Keys are scoped per user", func(t *testing.T) {
+		var calls int32
+		_, e := setup(t, func(c echo.Context) error {
+			return c.JSON(http.StatusCreated, map[string]int32{"call": atomic.AddInt32(&calls, 1)})
+		})
+
+		assert.Equal(t, `{"call":1}`+"\n", do(e, "1", "some-key", `{"name":"thing"}`).Body.String())
+		other := do(e, "2", "some-key", `{"name":"thing"}`)
+		assert.Empty(t, other.Header().Get(HeaderIdempotentReplayed))
+		assert.Equal(t, `{"call":2}`+"\n", other.Body.String())
+
+		// anonymous responses are replayed to the same client for the same request only
+		assert.Equal(t, `{"call":3}`+"\n", do(e, "", "some-key", `{"name":"thing"}`).Body.String())
+		anonymous := do(e, "", "some-key", `{"name":"thing"}`)
+		assert.Equal(t, "true", anonymous.Header().Get(HeaderIdempotentReplayed))
+		assert.Equal(t, `{"call":3}`+"\n", anonymous.Body.String())
+		otherIP := doFrom(e, "198.51.100.7", "", "some-key", `{"name":"thing"}`)
+		assert.Empty(t, otherIP.Header().Get(HeaderIdempotentReplayed))
+		assert.Equal(t, `{"call":4}`+"\n", otherIP.Body.String())
+		otherBody := do(e, "", "some-key", `{"name":"other thing"}`)
+		assert.Empty(t, otherBody.Header().Get(HeaderIdempotentReplayed))
+		assert.Equal(t, `{"call":5}`+"\n", otherBody.Body.String())
+	})
+
+	t.Run("Errors are replayed, server errors are not", func(t *testing.T) {
+		var calls int32
+		_, e := setup(t, func(c echo.Context) error {
+			if atomic.AddInt32(&calls, 1) == 1 {
+				return apperr.Internal(assert.AnError)
+			}
+
+			return apperr.Conflict(apperr.CodeUserEmailTaken, "user with email does already exist")
+		})
+
+		assert.Equal(t, http.StatusInternalServerError, do(e, "1", "some-key", `{}`).Code)
+		assert.Equal(t, http.StatusConflict, do(e, "1", "some-key", `{}`).Code)
+
+		replayed := do(e, "1", "some-key", `{}`)
+		assert.Equal(t, http.StatusConflict, replayed.Code)
+		assert.Equal(t, "true", replayed.Header().Get(HeaderIdempotentReplayed))
+		assert.Equal(t, int32(2), calls)
+	})
+
+	t.Run("Mismatched body is rejected", func(t *testing.T) {
+		_, e := setup(t, func(c echo.Context) error {
+			return c.NoContent(http.StatusCreated)
+		})
+
+		assert.Equal(t, http.StatusCreated, do(e, "1", "some-key", `{"name":"thing"}`).Code)
+
+		w := do(e, "1", "some-key", `{"name":"other thing"}`)
+		assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+		checkResponseWithTestDataFile(t, w.Body.Bytes(), []string{"correlation_id"})
+	})
+
+	t.Run("Concurrent retries wait for the in-flight request", func(t *testing.T) {
+		var calls int32
+		release := make(chan struct{})
+		_, e := setup(t, func(c echo.Context) error {
+			atomic.AddInt32(&calls, 1)
+			<-release
+
+			return c.JSON(http.StatusCreated, map[string]string{"name": "thing"})
+		})
+
+		var wg sync.WaitGroup
+		results := make([]*httptest.ResponseRecorder, 3)
+		for i := range results {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				results[i] = do(e, "1", "some-key", `{"name":"thing"}`)
+			}(i)
+		}
+		time.Sleep(100 * time.Millisecond)
+		close(release)
+		wg.Wait()
+
+		assert.Equal(t, int32(1), calls)
+		for _, w := range results {
+			assert.Equal(t, http.StatusCreated, w.Code)
+			assert.Equal(t, `{"name":"thing"}`+"\n", w.Body.String())
+		}
+	})
+
+	t.Run("Waiting retries give up after the lock wait", func(t *testing.T) {
+		r, e := setup(t, func(c echo.Context) error {
+			return c.NoContent(http.StatusCreated)
+		})
+		store := r.Idempotency.(*idempotencyStoreMock)
+		store.locks[testTokenConfig.Issuer+" 1:POST /things:some-key"] = "held-by-another-request"
+
+		start := time.Now()
+		w := do(e, "1", "some-key", `{}`)
+		assert.Equal(t, http.StatusConflict, w.Code)
+		assert.GreaterOrEqual(t, time.Since(start), cfg.LockWait)
+	})
+}
@@ -0,0 +1,244 @@
+package rest
+
+import (
+	"context"
+	"encoding/xml"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/efimovalex/replaceme/adapters/redisdb"
+	"github.com/efimovalex/replaceme/internal/apperr"
+	"github.com/efimovalex/replaceme/internal/audit"
+	auth "github.com/efimovalex/replaceme/internal/auth0"
+	"github.com/efimovalex/replaceme/internal/requestid"
+	"github.com/labstack/echo/v4"
+)
+
+// Types of the subjects whose failed logins are counted
+const (
+	LockoutTypeAccount = "account"
+	LockoutTypeIP      = "ip"
+)
+
+// LoginThrottler is the interface for the store of the failed logins
+type LoginThrottler interface {
+	ReserveLoginAttempt(ctx context.Context, subject string, t redisdb.LoginThrottle, now time.Time) (*redisdb.LoginAttempts, error)
+	RefundLoginAttempt(ctx context.Context, a *redisdb.LoginAttempts, t redisdb.LoginThrottle) error
+	ResetLoginFailures(ctx context.Context, subject string) error
+	ListLockouts(ctx context.Context, now time.Time) ([]*redisdb.LoginAttempts, error)
+	ClearLockout(ctx context.Context, subject string) (bool, error)
+}
+
+// Lockout is a login subject locked out after too many failed logins
+type Lockout struct {
+	XMLName xml.Name `json:"-" xml:"lockout"`
+	// Type is account or ip
+	Type        string    `json:"type" xml:"type" enums:"account,ip" example:"account"`
+	Subject     string    `json:"subject" xml:"subject" example:"jane.doe@replaceme.com"`
+	LockedUntil time.Time `json:"locked_until" xml:"locked_until"`
+}
+
+// DeleteLockoutRequest are the path params of the delete lockout endpoint
+type DeleteLockoutRequest struct {
+	Type    string `param:"type" validate:"required,oneof=account ip"`
+	Subject string `param:"subject" validate:"required,max=255"`
+}
+
+// ListLockouts returns the accounts and IPs locked out of the password login
+// @Summary [get] /admin/lockouts
+// @Description Returns the accounts and IPs currently locked out of the password login, the lockouts ending first
+// @Description come first. Requires the admin scope.
+// @Tags admin
+// @Accept  json
+// @Produce json,application/msgpack,application/cbor,xml
+// @Security BearerAuth
+// @Success 200 {array} Lockout "Lockouts"
+// @Failure 401 {object} Problem "Invalid or revoked access token"
+// @Failure 403 {object} Problem "Missing admin scope"
+// @Failure 500 {object} Problem "Internal server error"
+// @Failure 503 {object} Problem "Lockout store unavailable"
+// @Router /admin/lockouts [get]
+func (rest *R) ListLockouts(c echo.Context) error {
+	if rest.Logins == nil {
+		return apperr.Unavailable(apperr.CodeUnavailable, "lockout store unavailable")
+	}
+
+	attempts, err := rest.Logins.ListLockouts(c.Request().Context(), time.Now())
+	if err != nil {
+		return apperr.Unavailable(apperr.CodeUnavailable, "lockout store unavailable").Wrap(err)
+	}
+	res := make([]Lockout, 0, len(attempts))
+	for _, a := range attempts {
+		typ, subject, _ := strings.Cut(a.Subject, ":")
+		res = append(res, Lockout{Type: typ, Subject: subject, LockedUntil: a.LockedUntil.UTC()})
+	}
+
+	return rest.Render(c, http.StatusOK, res)
+}
+
+// DeleteLockout lifts the lockout of an account or IP
+// @Summary [delete] /admin/lockouts/{type}/{subject}
+// @Description Lifts the lockout of an account or IP and forgets its failed logins. Requires the admin scope.
+// @Tags admin
+// @Accept  json
+// @Produce json,application/msgpack,application/cbor,xml
+// @Security BearerAuth
+// @Param type path string true "account or ip" Enums(account, ip)
+// @Param subject path string true "email of the account or IP"
+// @Success 204 "Lockout lifted"
+// @Failure 401 {object} Problem "Invalid or revoked access token"
+// @Failure 403 {object} Problem "Missing admin scope"
+// @Failure 404 {object} Problem "Lockout not found"
+// @Failure 422 {object} Problem "Params validation error"
+// @Failure 500 {object} Problem "Internal server error"
+// @Failure 503 {object} Problem "Lockout store unavailable"
+// @Router /admin/lockouts/{type}/{subject} [delete]
+func (rest *R) DeleteLockout(c echo.Context) error {
+	var req DeleteLockoutRequest
+	if err := rest.Bind(c, &req); err != nil {
+		return err
+	}
+	if rest.Logins == nil {
+		return apperr.Unavailable(apperr.CodeUnavailable, "lockout store unavailable")
+	}
+
+	ctx := c.Request().Context()
+	subject := lockoutSubject(req.Type, req.Subject)
+	ok, err := rest.Logins.ClearLockout(ctx, subject)
+	if err != nil {
+		return apperr.Unavailable(apperr.CodeUnavailable, "lockout store unavailable").Wrap(err)
+	}
+	if !ok {
+		return apperr.NotFound(apperr.CodeLockoutNotFound, "lockout not found")
+	}
+	actor, _ := auth.UserIDValue(ctx)
+	rest.Audit.Record(ctx, audit.Event{Type: audit.EventLockoutCleared, Actor: actor, Subject: subject, IP: c.RealIP()})
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// loginSubjects are the subjects whose failed logins are counted for a login attempt. The IP is the one of the
+// IPExtractor of the router, the forwarded headers are only trusted from REST_SERVER_TRUSTED_PROXIES.
+func loginSubjects(c echo.Context, email string) []string {
+	return []string{lockoutSubject(LockoutTypeAccount, email), lockoutSubject(LockoutTypeIP, c.RealIP())}
+}
+
+// lockoutSubject is the key of the failed logins of an account or IP
+func lockoutSubject(typ, subject string) string {
+	if typ == LockoutTypeAccount {
+		subject = strings.ToLower(subject)
+	}
+
+	return typ + ":" + subject
+}
+
+// loginThrottle is the failed logins policy of the subject
+func (rest *R) loginThrottle(subject string) redisdb.LoginThrottle {
+	cfg := rest.cfg.Lockout
+	t := redisdb.LoginThrottle{
+		Threshold:       cfg.AccountThreshold,
+		Window:          cfg.Window,
+		LockoutDuration: cfg.Duration,
+		DelayAfter:      cfg.DelayAfter,
+		BaseDelay:       cfg.BaseDelay,
+		MaxDelay:        cfg.MaxDelay,
+	}
+	// many users can share an IP, it is only locked out
+	if strings.HasPrefix(subject, LockoutTypeIP+":") {
+		t.Threshold = cfg.IPThreshold
+		t.BaseDelay = 0
+	}
+
+	return t
+}
+
+// reserveLoginAttempt counts the login attempt as a failure of the account and IP before the credentials are
+// checked, so that concurrent attempts cannot get past the limits, and refuses the attempts of locked out or delayed
+// accounts and IPs with a 429. The attempt is then settled with loginFailed or refundLoginAttempt.
+func (rest *R) reserveLoginAttempt(c echo.Context, email string) ([]*redisdb.LoginAttempts, error) {
+	if !rest.cfg.Lockout.Enable || rest.Logins == nil {
+		return nil, nil
+	}
+
+	ctx := c.Request().Context()
+	now := time.Now()
+	var reserved []*redisdb.LoginAttempts
+	for _, subject := range loginSubjects(c, email) {
+		a, err := rest.Logins.ReserveLoginAttempt(ctx, subject, rest.loginThrottle(subject), now)
+		if err != nil {
+			return reserved, rest.lockoutStoreError(ctx, err)
+		}
+		if !a.Refused {
+			reserved = append(reserved, a)
+			continue
+		}
+
+		// the subjects reserved before are not charged for a refused attempt
+		if err := rest.refundLoginAttempt(c, reserved); err != nil {
+			return nil, err
+		}
+		_, until := a.Blocked(now)
+		c.Response().Header().Set(HeaderRetryAfter, seconds(until.Sub(now)))
+		if a.LockedUntil.After(now) {
+			return nil, apperr.RateLimited(apperr.CodeLoginLocked, "too many failed logins, try again later")
+		}
+
+		return nil, apperr.RateLimited(apperr.CodeLoginThrottled, "too many failed logins, wait before trying again")
+	}
+
+	return reserved, nil
+}
+
+// loginFailed settles a failed login attempt, its failures are already counted and the lockouts it caused are audited
+func (rest *R) loginFailed(c echo.Context, reserved []*redisdb.LoginAttempts) {
+	ctx := c.Request().Context()
+	for _, a := range reserved {
+		if a.Locked {
+			rest.Audit.Record(ctx, audit.Event{
+				Type:    audit.EventLoginLocked,
+				Subject: a.Subject,
+				IP:      c.RealIP(),
+				Details: map[string]interface{}{"locked_until": a.LockedUntil.UTC()},
+			})
+		}
+	}
+}
+
+// refundLoginAttempt gives back a login attempt whose credentials were right, it is not a failure of the account
+// and IP
+func (rest *R) refundLoginAttempt(c echo.Context, reserved []*redisdb.LoginAttempts) error {
+	ctx := c.Request().Context()
+	for _, a := range reserved {
+		if err := rest.Logins.RefundLoginAttempt(ctx, a, rest.loginThrottle(a.Subject)); err != nil {
+			return rest.lockoutStoreError(ctx, err)
+		}
+	}
+
+	return nil
+}
+
+// resetLoginFailures forgets the failed logins of an account after it logged in. The failures of the IP are
+// kept, an attacker owning one account must not reset them.
+func (rest *R) resetLoginFailures(c echo.Context, email string) error {
+	if !rest.cfg.Lockout.Enable || rest.Logins == nil {
+		return nil
+	}
+
+	ctx := c.Request().Context()
+	if err := rest.Logins.ResetLoginFailures(ctx, lockoutSubject(LockoutTypeAccount, email)); err != nil {
+		return rest.lockoutStoreError(ctx, err)
+	}
+
+	return nil
+}
+
+// lockoutStoreError logs a failure of the lockout store, the login goes on if the protection fails open
+func (rest *R) lockoutStoreError(ctx context.Context, err error) error {
+	requestid.Logger(ctx, rest.logger).Error().Err(err).Msg("lockout store unavailable")
+	if rest.cfg.Lockout.FailOpen {
+		return nil
+	}
+
+	return apperr.Unavailable(apperr.CodeUnavailable, "lockout store unavailable").Wrap(err)
+}
@@ -0,0 +1,378 @@
+package rest
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/efimovalex/replaceme/adapters/redisdb"
+	"github.com/efimovalex/replaceme/config"
+	"github.com/efimovalex/replaceme/internal/audit"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// loginThrottlerMock is an in-memory LoginThrottler following the policies of redisdb
+type loginThrottlerMock struct {
+	mu       sync.Mutex
+	attempts map[string]*redisdb.LoginAttempts
+	err      error
+}
+
+func newLoginThrottlerMock() *loginThrottlerMock {
+	return &loginThrottlerMock{attempts: map[string]*redisdb.LoginAttempts{}}
+}
+
+func (m *loginThrottlerMock) ReserveLoginAttempt(ctx context.Context, subject string, t redisdb.LoginThrottle, now time.Time) (*redisdb.LoginAttempts, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return nil, m.err
+	}
+	a, ok := m.attempts[subject]
+	if !ok {
+		a = &redisdb.LoginAttempts{Subject: subject}
+		m.attempts[subject] = a
+	}
+	if blocked, _ := a.Blocked(now); blocked {
+		copied := *a
+		copied.Refused = true
+		return &copied, nil
+	}
+	a.Failures++
+	a.Locked = false
+	a.RetryAt = time.Time{}
+	if a.Failures >= t.Threshold {
+		a.Failures = 0
+		a.Locked = true
+		a.LockedUntil = now.Add(t.LockoutDuration)
+	} else if a.Failures >= t.DelayAfter && t.BaseDelay > 0 {
+		a.RetryAt = now.Add(t.BaseDelay << (a.Failures - t.DelayAfter))
+	}
+	copied := *a
+
+	return &copied, nil
+}
+
+func (m *loginThrottlerMock) RefundLoginAttempt(ctx context.Context, reserved *redisdb.LoginAttempts, t redisdb.LoginThrottle) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return m.err
+	}
+	a, ok := m.attempts[reserved.Subject]
+	if !ok {
+		return nil
+	}
+	if reserved.Locked {
+		if a.LockedUntil.Equal(reserved.LockedUntil) {
+			a.Failures = t.Threshold - 1
+			a.RetryAt = time.Time{}
+			a.LockedUntil = time.Time{}
+		}
+		return nil
+	}
+	if a.Failures > 0 {
+		a.Failures--
+	}
+	if !reserved.RetryAt.IsZero() && a.RetryAt.Equal(reserved.RetryAt) {
+		a.RetryAt = time.Time{}
+	}
+
+	return nil
+}
+
+func (m *loginThrottlerMock) ResetLoginFailures(ctx context.Context, subject string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return m.err
+	}
+	if a, ok := m.attempts[subject]; ok {
+		a.Failures = 0
+		a.RetryAt = time.Time{}
+	}
+
+	return nil
+}
+
+func (m *loginThrottlerMock) ListLockouts(ctx context.Context, now time.Time) ([]*redisdb.LoginAttempts, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return nil, m.err
+	}
+	var lockouts []*redisdb.LoginAttempts
+	for _, a := range m.attempts {
+		if a.LockedUntil.After(now) {
+			lockouts = append(lockouts, a)
+		}
+	}
+
+	return lockouts, nil
+}
+
+func (m *loginThrottlerMock) ClearLockout(ctx context.Context, subject string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return false, m.err
+	}
+	a, ok := m.attempts[subject]
+	delete(m.attempts, subject)
+
+	return ok && !a.LockedUntil.IsZero(), nil
+}
+
+var testLockoutConfig = config.Lockout{
+	Enable:           true,
+	AccountThreshold: 3,
+	IPThreshold:      100,
+	Window:           15 * time.Minute,
+	Duration:         15 * time.Minute,
+	DelayAfter:       10,
+	BaseDelay:        time.Second,
+	MaxDelay:         time.Minute,
+}
+
+// newTestLockoutREST creates a REST instance with in-memory login throttler and audit log
+func newTestLockoutREST(t *testing.T, cfg config.Lockout) (*R, sqlmock.Sqlmock, *loginThrottlerMock, *audit.Fake) {
+	r, mock := NewTestRESTWithMock(t)
+	r.cfg.Lockout = cfg
+	logins := newLoginThrottlerMock()
+	events := &audit.Fake{}
+	r.Logins = logins
+	r.Audit = events
+
+	return r, mock, logins, events
+}
+
+func login(r *R, password, ip string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/v1/auth/login", strings.NewReader(`{"email":"Jane.Doe@replaceme.com","password":"`+password+`"}`))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	req.RemoteAddr = ip + ":1234"
+	w := httptest.NewRecorder()
+	r.Router.ServeHTTP(w, req)
+
+	return w
+}
+
+func TestREST_Login_Lockout(t *testing.T) {
+	createdAt := time.Date(2022, 7, 1, 10, 0, 0, 0, time.UTC)
+	hash, err := bcrypt.GenerateFromPassword([]byte("s3cr3t-p4ss"), bcrypt.MinCost)
+	require.NoError(t, err)
+	expectUser := func(mock sqlmock.Sqlmock) {
+		mock.ExpectQuery(findActiveUserQuery).WithArgs("Jane.Doe@replaceme.com", true).WillReturnRows(sqlmock.NewRows(userColumns).
+			AddRow(1, "jane.doe@replaceme.com", string(hash), "", "Jane", "Doe", true, createdAt, createdAt))
+	}
+
+	t.Run("Locked out after the threshold", func(t *testing.T) {
+		r, mock, logins, events := newTestLockoutREST(t, testLockoutConfig)
+		for i := 0; i < 3; i++ {
+			expectUser(mock)
+			w := login(r, "wrong-p4ss", "192.0.2.1")
+			require.Equal(t, http.StatusUnauthorized, w.Code)
+		}
+		require.Len(t, events.Events(), 1)
+		assert.Equal(t, audit.EventLoginLocked, events.Events()[0].Type)
+		assert.Equal(t, "account:jane.doe@replaceme.com", events.Events()[0].Subject)
+		assert.Equal(t, "192.0.2.1", events.Events()[0].IP)
+
+		// even with the right password, from another IP
+		w := login(r, "s3cr3t-p4ss", "198.51.100.1")
+		assert.Equal(t, http.StatusTooManyRequests, w.Code)
+		assert.Equal(t, "900", w.Header().Get(HeaderRetryAfter))
+		checkResponseWithTestDataFile(t, w.Body.Bytes(), []string{"correlation_id"})
+
+		assert.Equal(t, 3, logins.attempts["ip:192.0.2.1"].Failures, "the IP is not locked out yet")
+	})
+
+	t.Run("Delayed attempts", func(t *testing.T) {
+		cfg := testLockoutConfig
+		cfg.DelayAfter = 1
+		r, mock, _, _ := newTestLockoutREST(t, cfg)
+		expectUser(mock)
+		require.Equal(t, http.StatusUnauthorized, login(r, "wrong-p4ss", "192.0.2.1").Code)
+
+		w := login(r, "s3cr3t-p4ss", "192.0.2.1")
+		assert.Equal(t, http.StatusTooManyRequests, w.Code)
+		assert.Equal(t, "1", w.Header().Get(HeaderRetryAfter))
+		checkResponseWithTestDataFile(t, w.Body.Bytes(), []string{"correlation_id"})
+	})
+
+	t.Run("IP locked out", func(t *testing.T) {
+		cfg := testLockoutConfig
+		cfg.IPThreshold = 1
+		r, mock, logins, events := newTestLockoutREST(t, cfg)
+		expectUser(mock)
+		require.Equal(t, http.StatusUnauthorized, login(r, "wrong-p4ss", "192.0.2.1").Code)
+		require.Len(t, events.Events(), 1)
+		assert.Equal(t, "ip:192.0.2.1", events.Events()[0].Subject)
+
+		assert.Equal(t, http.StatusTooManyRequests, login(r, "s3cr3t-p4ss", "192.0.2.1").Code)
+		expectUser(mock)
+		assert.Equal(t, http.StatusOK, login(r, "s3cr3t-p4ss", "198.51.100.1").Code)
+		assert.Zero(t, logins.attempts["ip:198.51.100.1"].LockedUntil, "the lockout of a successful attempt is lifted")
+		assert.Len(t, events.Events(), 1)
+	})
+
+	t.Run("Attempts counted before the check", func(t *testing.T) {
+		r, _, _, _ := newTestLockoutREST(t, testLockoutConfig)
+
+		// concurrent attempts cannot get past the threshold while their passwords are checked
+		for i := 0; i < 3; i++ {
+			c := r.Router.NewContext(httptest.NewRequest(http.MethodPost, "/v1/auth/login", nil), httptest.NewRecorder())
+			_, err := r.reserveLoginAttempt(c, "jane.doe@replaceme.com")
+			require.NoError(t, err)
+		}
+		w := login(r, "s3cr3t-p4ss", "192.0.2.1")
+		assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	})
+
+	t.Run("IP locked out despite forwarded headers", func(t *testing.T) {
+		cfg := testLockoutConfig
+		cfg.IPThreshold = 1
+		r, mock, _, events := newTestLockoutREST(t, cfg)
+		expectUser(mock)
+		require.Equal(t, http.StatusUnauthorized, login(r, "wrong-p4ss", "192.0.2.1").Code)
+
+		// without trusted proxies, the clients cannot pick the IP of their attempts
+		req := httptest.NewRequest(http.MethodPost, "/v1/auth/login", strings.NewReader(`{"email":"Jane.Doe@replaceme.com","password":"s3cr3t-p4ss"}`))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		req.Header.Set(echo.HeaderXForwardedFor, "198.51.100.1")
+		req.Header.Set(echo.HeaderXRealIP, "198.51.100.1")
+		req.RemoteAddr = "192.0.2.1:1234"
+		w := httptest.NewRecorder()
+		r.Router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusTooManyRequests, w.Code)
+		require.Len(t, events.Events(), 1)
+		assert.Equal(t, "192.0.2.1", events.Events()[0].IP)
+	})
+
+	t.Run("Success resets the account failures", func(t *testing.T) {
+		r, mock, logins, _ := newTestLockoutREST(t, testLockoutConfig)
+		expectUser(mock)
+		require.Equal(t, http.StatusUnauthorized, login(r, "wrong-p4ss", "192.0.2.1").Code)
+		expectUser(mock)
+		require.Equal(t, http.StatusOK, login(r, "s3cr3t-p4ss", "192.0.2.1").Code)
+
+		assert.Zero(t, logins.attempts["account:jane.doe@replaceme.com"].Failures)
+		assert.Equal(t, 1, logins.attempts["ip:192.0.2.1"].Failures)
+	})
+
+	t.Run("Store unavailable", func(t *testing.T) {
+		r, _, logins, _ := newTestLockoutREST(t, testLockoutConfig)
+		logins.err = errors.New("connection refused")
+
+		w := login(r, "s3cr3t-p4ss", "192.0.2.1")
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	})
+
+	t.Run("Store unavailable, failing open", func(t *testing.T) {
+		cfg := testLockoutConfig
+		cfg.FailOpen = true
+		r, mock, logins, _ := newTestLockoutREST(t, cfg)
+		logins.err = errors.New("connection refused")
+		expectUser(mock)
+
+		w := login(r, "s3cr3t-p4ss", "192.0.2.1")
+		assert.Equal(t, http.StatusOK, w.Code)
+	})
+}
+
+func TestREST_Lockouts(t *testing.T) {
+	lockedUntil := time.Now().Add(time.Hour).Truncate(time.Hour)
+
+	tests := []struct {
+		name               string
+		method             string
+		path               string
+		scope              string
+		storeErr           error
+		expectedStatusCode int
+		expectedLockouts   int
+	}{
+		{
+			name:               "List",
+			method:             http.MethodGet,
+			path:               "/v1/admin/lockouts",
+			scope:              "openid admin",
+			expectedStatusCode: http.StatusOK,
+			expectedLockouts:   1,
+		},
+		{
+			name:               "Missing admin scope",
+			method:             http.MethodGet,
+			path:               "/v1/admin/lockouts",
+			scope:              "openid",
+			expectedStatusCode: http.StatusForbidden,
+			expectedLockouts:   1,
+		},
+		{
+			name:               "Delete",
+			method:             http.MethodDelete,
+			path:               "/v1/admin/lockouts/account/jane.doe@replaceme.com",
+			scope:              "admin",
+			expectedStatusCode: http.StatusNoContent,
+		},
+		{
+			name:               "Delete unknown lockout",
+			method:             http.MethodDelete,
+			path:               "/v1/admin/lockouts/ip/192.0.2.1",
+			scope:              "admin",
+			expectedStatusCode: http.StatusNotFound,
+			expectedLockouts:   1,
+		},
+		{
+			name:               "Delete invalid type",
+			method:             http.MethodDelete,
+			path:               "/v1/admin/lockouts/user/1",
+			scope:              "admin",
+			expectedStatusCode: http.StatusUnprocessableEntity,
+			expectedLockouts:   1,
+		},
+		{
+			name:               "Store unavailable",
+			method:             http.MethodGet,
+			path:               "/v1/admin/lockouts",
+			scope:              "admin",
+			storeErr:           errors.New("connection refused"),
+			expectedStatusCode: http.StatusServiceUnavailable,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, _, logins, events := newTestLockoutREST(t, testLockoutConfig)
+			logins.attempts["account:jane.doe@replaceme.com"] = &redisdb.LoginAttempts{Subject: "account:jane.doe@replaceme.com", LockedUntil: lockedUntil}
+			logins.err = tt.storeErr
+			accessToken, err := r.Tokens.Issue("2", map[string]interface{}{"email": "admin@replaceme.com", "scope": tt.scope})
+			require.NoError(t, err)
+
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			req.Header.Set(echo.HeaderAuthorization, "Bearer "+accessToken.Raw)
+			w := httptest.NewRecorder()
+			r.Router.ServeHTTP(w, req)
+
+			assert.Equal(t, tt.expectedStatusCode, w.Code, w.Body.String())
+			checkResponseWithTestDataFile(t, w.Body.Bytes(), []string{"correlation_id", "locked_until"})
+			if tt.storeErr != nil {
+				return
+			}
+			lockouts, err := logins.ListLockouts(context.Background(), time.Now())
+			require.NoError(t, err)
+			assert.Len(t, lockouts, tt.expectedLockouts)
+			if tt.expectedStatusCode == http.StatusNoContent {
+				require.Len(t, events.Events(), 1)
+				assert.Equal(t, audit.Event{Type: audit.EventLockoutCleared, Actor: "2", Subject: "account:jane.doe@replaceme.com", IP: "192.0.2.1"}, events.Events()[0])
+			}
+		})
+	}
+}
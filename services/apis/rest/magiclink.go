@@ -0,0 +1,142 @@
+package rest
+
+import (
+	"encoding/xml"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/efimovalex/replaceme/adapters/postgres"
+	"github.com/efimovalex/replaceme/internal/apperr"
+	auth "github.com/efimovalex/replaceme/internal/auth0"
+	"github.com/labstack/echo/v4"
+)
+
+// MagicLinkLoginRequest is the request body of the magic link login endpoint
+type MagicLinkLoginRequest struct {
+	XMLName xml.Name `json:"-" xml:"magic_link_login"`
+	Token   string   `json:"token" xml:"token" validate:"required,max=255"`
+}
+
+// RequestMagicLink emails a login link to a user
+// @Summary [post] /auth/magic-link
+// @Description Emails a single-use login link if an active user has the email. The response sets a cookie binding
+// @Description the link to the browser, the link only works with it. Only the last emailed link works. The response
+// @Description is the same whether or not the email is known.
+// @Tags auth
+// @Accept  json,application/msgpack,application/cbor,xml
+// @Produce json,application/msgpack,application/cbor,xml
+// @Param email body EmailRequest true "email"
+// @Success 202 "Accepted"
+// @Failure 400 {object} Problem "Invalid request JSON"
+// @Failure 404 {object} Problem "Magic links are disabled"
+// @Failure 422 {object} Problem "Params validation error"
+// @Failure 500 {object} Problem "Internal server error"
+// @Failure 503 {object} Problem "Token store unavailable"
+// @Router /auth/magic-link [post]
+func (rest *R) RequestMagicLink(c echo.Context) error {
+	var req EmailRequest
+	if err := rest.Bind(c, &req); err != nil {
+		return err
+	}
+	if !rest.cfg.MagicLink.Enable {
+		return apperr.NotFound(apperr.CodeNotFound, "magic links are disabled")
+	}
+	if rest.UserTokens == nil {
+		return apperr.Unavailable(apperr.CodeUnavailable, "token store unavailable")
+	}
+
+	ctx := c.Request().Context()
+	active := true
+	u, err := rest.DB.FindOneUserByEmail(ctx, req.Email, &active)
+	if err != nil {
+		return err
+	}
+	// the cookie is set for unknown emails too, so the response does not tell them apart
+	nonce := newOpaqueToken()
+	if u != nil {
+		rest.sendUserToken(c, u, tokenPurposeMagicLink, nonce)
+	}
+	c.SetCookie(rest.magicLinkCookie(nonce, int(rest.cfg.MagicLink.TTL.Seconds())))
+
+	return c.NoContent(http.StatusAccepted)
+}
+
+// MagicLinkLogin logs a user in with the token of a login link
+// @Summary [post] /auth/magic-link/login
+// @Description Issues the same tokens as a password login for the token of a login link, from the browser which
+// @Description asked for the link. The token can only be used once. Opening the link verifies the email of the user.
+// @Description Users with a second factor get an MFA challenge instead of the tokens.
+// @Tags auth
+// @Accept  json,application/msgpack,application/cbor,xml
+// @Produce json,application/msgpack,application/cbor,xml
+// @Param login body MagicLinkLoginRequest true "token"
+// @Success 200 {object} TokenResponse "Access token"
+// @Success 202 {object} MFAChallengeResponse "Second factor required, see /auth/mfa/verify"
+// @Failure 400 {object} Problem "Invalid request JSON"
+// @Failure 404 {object} Problem "Magic links are disabled"
+// @Failure 422 {object} Problem "Invalid or expired token, link of another browser, or params validation error"
+// @Failure 500 {object} Problem "Internal server error"
+// @Failure 503 {object} Problem "Token or session store unavailable"
+// @Router /auth/magic-link/login [post]
+func (rest *R) MagicLinkLogin(c echo.Context) error {
+	var req MagicLinkLoginRequest
+	if err := rest.Bind(c, &req); err != nil {
+		return err
+	}
+	if !rest.cfg.MagicLink.Enable {
+		return apperr.NotFound(apperr.CodeNotFound, "magic links are disabled")
+	}
+	cookie, err := c.Cookie(rest.cfg.MagicLink.CookieName)
+	if err != nil || cookie.Value == "" {
+		return apperr.Validation(apperr.CodeInvalidToken, "the link must be opened in the browser it was requested from")
+	}
+
+	ctx := c.Request().Context()
+	verified := false
+	u, err := rest.useUserToken(ctx, tokenPurposeMagicLink, bindToken(req.Token, cookie.Value), func(u *postgres.User) error {
+		// the link was received at the email of the user
+		if u.EmailVerifiedAt != nil {
+			return nil
+		}
+		verified = true
+
+		return rest.DB.MarkUserEmailVerified(ctx, u.ID)
+	})
+	if err != nil {
+		return err
+	}
+	if verified {
+		rest.InvalidateCache(ctx, usersCacheTag, userCacheTag(strconv.Itoa(u.ID)))
+	}
+	c.SetCookie(rest.magicLinkCookie("", -1))
+
+	mfa, err := rest.hasMFA(ctx, u.ID)
+	if err != nil {
+		return err
+	}
+	if mfa {
+		return rest.startMFAChallenge(c, u, []string{auth.AuthMethodEmail})
+	}
+
+	authn := authentication{methods: []string{auth.AuthMethodEmail}, time: time.Now()}
+	sessionID, refreshToken, err := rest.startSession(c, strconv.Itoa(u.ID), authn)
+	if err != nil {
+		return err
+	}
+
+	return rest.issueTokens(c, u, authn, sessionID, refreshToken)
+}
+
+// magicLinkCookie is the cookie holding the nonce of the login links of a browser, a negative maxAge deletes it
+func (rest *R) magicLinkCookie(nonce string, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name:     rest.cfg.MagicLink.CookieName,
+		Value:    nonce,
+		Path:     "/",
+		MaxAge:   maxAge,
+		Secure:   rest.cfg.MagicLink.CookieSecure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
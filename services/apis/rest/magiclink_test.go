@@ -0,0 +1,197 @@
+package rest
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/efimovalex/replaceme/config"
+	"github.com/efimovalex/replaceme/internal/mailer"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testMagicLinkConfig = config.MagicLink{
+	Enable:       true,
+	URL:          "https://app.replaceme.test/magic-link",
+	TTL:          15 * time.Minute,
+	CookieName:   "magic_link_nonce",
+	CookieSecure: true,
+}
+
+// newTestMagicLinkREST creates a REST instance with magic links enabled, in-memory token store, mailer and sessions
+func newTestMagicLinkREST(t *testing.T) (*R, sqlmock.Sqlmock, *userTokenStoreMock, *mailer.Fake) {
+	r, mock, tokens, m := newTestAccountsREST(t)
+	r.cfg.MagicLink = testMagicLinkConfig
+	r.Sessions = newSessionStoreMock()
+
+	return r, mock, tokens, m
+}
+
+// requestMagicLink asks for the link of the user 1 and returns its token and the cookie of the browser
+func requestMagicLink(t *testing.T, r *R, mock sqlmock.Sqlmock, m *mailer.Fake) (string, *http.Cookie) {
+	createdAt := time.Date(2022, 7, 1, 10, 0, 0, 0, time.UTC)
+	mock.ExpectQuery(findActiveUserQuery).WithArgs("jane.doe@replaceme.com", true).WillReturnRows(sqlmock.NewRows(accountUserColumns).
+		AddRow(1, "jane.doe@replaceme.com", "hash", "", "Jane", "Doe", true, createdAt, createdAt, nil))
+
+	w := postJSON(r, "/v1/auth/magic-link", `{"email":"jane.doe@replaceme.com"}`)
+	require.Equal(t, http.StatusAccepted, w.Code, w.Body.String())
+	cookies := w.Result().Cookies()
+	require.Len(t, cookies, 1)
+	require.Len(t, m.Messages(), 1)
+
+	return emailedToken(t, m.Messages()[0], "https://app.replaceme.test/magic-link"), cookies[0]
+}
+
+func magicLinkLogin(r *R, token string, cookie *http.Cookie) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/v1/auth/magic-link/login", strings.NewReader(`{"token":"`+token+`"}`))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	r.Router.ServeHTTP(w, req)
+
+	return w
+}
+
+func TestREST_RequestMagicLink(t *testing.T) {
+	t.Run("Active user", func(t *testing.T) {
+		r, mock, tokens, m := newTestMagicLinkREST(t)
+		token, cookie := requestMagicLink(t, r, mock, m)
+
+		assert.Equal(t, "magic_link_nonce", cookie.Name)
+		assert.True(t, cookie.HttpOnly)
+		assert.True(t, cookie.Secure)
+		assert.Equal(t, http.SameSiteLaxMode, cookie.SameSite)
+		assert.Equal(t, 900, cookie.MaxAge)
+		msg := m.Messages()[0]
+		assert.Equal(t, "Your login link", msg.Subject)
+		assert.Contains(t, msg.Text, "within 15 minutes")
+		assert.Empty(t, tokens.tokens[tokenPurposeMagicLink+":"+hashToken(token)], "the token only works with the nonce")
+		assert.Equal(t, "1", tokens.tokens[tokenPurposeMagicLink+":"+hashToken(bindToken(token, cookie.Value))])
+	})
+
+	t.Run("Unknown user", func(t *testing.T) {
+		r, mock, _, m := newTestMagicLinkREST(t)
+		mock.ExpectQuery(findActiveUserQuery).WithArgs("john.doe@replaceme.com", true).WillReturnRows(sqlmock.NewRows(accountUserColumns))
+
+		w := postJSON(r, "/v1/auth/magic-link", `{"email":"john.doe@replaceme.com"}`)
+		assert.Equal(t, http.StatusAccepted, w.Code)
+		assert.Len(t, w.Result().Cookies(), 1, "unknown emails get the same response")
+		assert.Empty(t, m.Messages())
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		r, _, _, _ := newTestMagicLinkREST(t)
+		r.cfg.MagicLink.Enable = false
+
+		w := postJSON(r, "/v1/auth/magic-link", `{"email":"jane.doe@replaceme.com"}`)
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+
+	t.Run("Token store unavailable", func(t *testing.T) {
+		r, _, _, _ := newTestMagicLinkREST(t)
+		r.UserTokens = nil
+
+		w := postJSON(r, "/v1/auth/magic-link", `{"email":"jane.doe@replaceme.com"}`)
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+		checkResponseWithTestDataFile(t, w.Body.Bytes(), []string{"correlation_id"})
+	})
+}
+
+func TestREST_MagicLinkLogin(t *testing.T) {
+	createdAt := time.Date(2022, 7, 1, 10, 0, 0, 0, time.UTC)
+	expectUser := func(mock sqlmock.Sqlmock, verifiedAt interface{}) {
+		mock.ExpectQuery(findUserByID).WithArgs(1).WillReturnRows(sqlmock.NewRows(accountUserColumns).
+			AddRow(1, "jane.doe@replaceme.com", "hash", "", "Jane", "Doe", true, createdAt, createdAt, verifiedAt))
+	}
+
+	t.Run("Login", func(t *testing.T) {
+		r, mock, tokens, m := newTestMagicLinkREST(t)
+		token, cookie := requestMagicLink(t, r, mock, m)
+
+		expectUser(mock, createdAt)
+		w := magicLinkLogin(r, token, cookie)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		assert.Empty(t, tokens.tokens, "the token is used once")
+		cookies := w.Result().Cookies()
+		if assert.Len(t, cookies, 1) {
+			assert.Equal(t, "magic_link_nonce", cookies[0].Name)
+			assert.Equal(t, -1, cookies[0].MaxAge, "the nonce is deleted")
+		}
+
+		var res TokenResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+		assert.NotEmpty(t, res.RefreshToken)
+		claims := accessTokenClaims(t, res.AccessToken)
+		assert.Equal(t, "1", claims["sub"])
+		assert.Equal(t, []interface{}{"email"}, claims["amr"])
+
+		w = magicLinkLogin(r, token, cookie)
+		assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+		checkResponseWithTestDataFile(t, w.Body.Bytes(), []string{"correlation_id"})
+	})
+
+	t.Run("Unverified email", func(t *testing.T) {
+		r, mock, _, m := newTestMagicLinkREST(t)
+		cache := newCachedUserMock(t)
+		r.Cache = cache
+		token, cookie := requestMagicLink(t, r, mock, m)
+
+		expectUser(mock, nil)
+		mock.ExpectExec(markUserEmailVerifiedSQL).WithArgs(1).WillReturnResult(sqlmock.NewResult(0, 1))
+		w := magicLinkLogin(r, token, cookie)
+		assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		assert.Nil(t, cache.responses["/v1/users/1"], "the cached user is invalidated")
+	})
+
+	t.Run("Database error", func(t *testing.T) {
+		r, mock, tokens, m := newTestMagicLinkREST(t)
+		token, cookie := requestMagicLink(t, r, mock, m)
+
+		expectUser(mock, nil)
+		mock.ExpectExec(markUserEmailVerifiedSQL).WithArgs(1).WillReturnError(errors.New("connection reset"))
+		w := magicLinkLogin(r, token, cookie)
+		assert.Equal(t, http.StatusInternalServerError, w.Code)
+		assert.Len(t, tokens.tokens, 1, "the link still works")
+	})
+
+	t.Run("Other browser", func(t *testing.T) {
+		r, mock, tokens, m := newTestMagicLinkREST(t)
+		token, _ := requestMagicLink(t, r, mock, m)
+
+		w := magicLinkLogin(r, token, nil)
+		assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+		checkResponseWithTestDataFile(t, w.Body.Bytes(), []string{"correlation_id"})
+
+		// the nonce of another request does not work either
+		w = magicLinkLogin(r, token, &http.Cookie{Name: "magic_link_nonce", Value: newOpaqueToken()})
+		assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+		assert.Len(t, tokens.tokens, 1, "the link still works in its browser")
+	})
+
+	t.Run("Second factor", func(t *testing.T) {
+		r, mock, _, m := newTestMagicLinkREST(t)
+		r.cfg.MFA = testMFAConfig
+		challenges := newMFAChallengeStoreMock()
+		r.MFAChallenges = challenges
+		token, cookie := requestMagicLink(t, r, mock, m)
+
+		expectUser(mock, createdAt)
+		expectTestTOTP(mock, testTOTP{encrypted: "secret"}, true)
+		w := magicLinkLogin(r, token, cookie)
+		assert.Equal(t, http.StatusAccepted, w.Code, w.Body.String())
+		var res MFAChallengeResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+		assert.NotEmpty(t, res.MFAToken)
+		require.Contains(t, challenges.challenges, hashToken(res.MFAToken))
+		assert.Equal(t, []string{"email"}, challenges.challenges[hashToken(res.MFAToken)].AuthMethods, "the second factor follows the link")
+	})
+}
@@ -0,0 +1,626 @@
+package rest
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/xml"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/efimovalex/replaceme/adapters/postgres"
+	"github.com/efimovalex/replaceme/adapters/redisdb"
+	"github.com/efimovalex/replaceme/config"
+	"github.com/efimovalex/replaceme/internal/apperr"
+	"github.com/efimovalex/replaceme/internal/audit"
+	auth "github.com/efimovalex/replaceme/internal/auth0"
+	"github.com/efimovalex/replaceme/internal/encryption"
+	"github.com/efimovalex/replaceme/internal/totp"
+	"github.com/labstack/echo/v4"
+)
+
+// Second factors of an MFA challenge
+const (
+	MFAMethodTOTP         = "totp"
+	MFAMethodRecoveryCode = "recovery_code"
+)
+
+// totpSkew is the number of periods the codes of clocks ahead or behind are accepted for
+const totpSkew = 1
+
+// recoveryCodeEncoding is the encoding of the recovery codes, lowercase to be easy to type
+var recoveryCodeEncoding = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+// MFAChallengeStore is the interface for the store of the logins waiting for their second factor
+type MFAChallengeStore interface {
+	CreateMFAChallenge(ctx context.Context, tokenHash, userID string, authMethods []string, ttl time.Duration) error
+	AttemptMFAChallenge(ctx context.Context, tokenHash string, maxAttempts int) (*redisdb.MFAChallenge, error)
+	DeleteMFAChallenge(ctx context.Context, tokenHash string) error
+}
+
+// MFAChallengeResponse is the response of a login waiting for its second factor
+type MFAChallengeResponse struct {
+	XMLName xml.Name `json:"-" xml:"mfa_challenge"`
+	// MFAToken identifies the login at the verify endpoint
+	MFAToken string `json:"mfa_token" xml:"mfa_token"`
+	// Methods are the accepted second factors
+	Methods []string `json:"methods" xml:"method" enums:"totp,recovery_code"`
+	// ExpiresIn is the lifetime of the challenge in seconds
+	ExpiresIn int `json:"expires_in" xml:"expires_in" example:"300"`
+}
+
+// VerifyMFARequest is the request body of the MFA verify endpoint, with either a code or a recovery code
+type VerifyMFARequest struct {
+	XMLName      xml.Name `json:"-" xml:"mfa_verify"`
+	MFAToken     string   `json:"mfa_token" xml:"mfa_token" validate:"required,max=255"`
+	Code         string   `json:"code,omitempty" xml:"code,omitempty" validate:"required_without=RecoveryCode,omitempty,numeric,len=6" example:"123456"`
+	RecoveryCode string   `json:"recovery_code,omitempty" xml:"recovery_code,omitempty" validate:"omitempty,max=64" example:"abcd-efgh-ijkl-mnop"`
+}
+
+// StepUpRequest is the request body of the step-up endpoint, with either a code or a recovery code
+type StepUpRequest struct {
+	XMLName      xml.Name `json:"-" xml:"step_up"`
+	Code         string   `json:"code,omitempty" xml:"code,omitempty" validate:"required_without=RecoveryCode,omitempty,numeric,len=6" example:"123456"`
+	RecoveryCode string   `json:"recovery_code,omitempty" xml:"recovery_code,omitempty" validate:"omitempty,max=64" example:"abcd-efgh-ijkl-mnop"`
+}
+
+// ConfirmTOTPRequest is the request body of the TOTP confirm endpoint
+type ConfirmTOTPRequest struct {
+	XMLName xml.Name `json:"-" xml:"totp_confirm"`
+	Code    string   `json:"code" xml:"code" validate:"required,numeric,len=6" example:"123456"`
+}
+
+// TOTPEnrollment is the secret of a TOTP enrollment, to be added to an authenticator app
+type TOTPEnrollment struct {
+	XMLName xml.Name `json:"-" xml:"totp_enrollment"`
+	// Secret is the base32 encoded secret, for manual entry
+	Secret string `json:"secret" xml:"secret" example:"JBSWY3DPEHPK3PXPJBSWY3DPEHPK3PXP"`
+	// URI is the otpauth URI of the secret, to be shown as a QR code
+	URI string `json:"uri" xml:"uri" example:"otpauth://totp/Replaceme:jane.doe@replaceme.com?secret=JBSWY3DPEHPK3PXPJBSWY3DPEHPK3PXP&issuer=Replaceme"`
+}
+
+// RecoveryCodes are the single-use codes replacing the second factor when the authenticator is lost.
+// They are only shown once.
+type RecoveryCodes struct {
+	XMLName xml.Name `json:"-" xml:"recovery_codes"`
+	Codes   []string `json:"codes" xml:"code"`
+}
+
+// VerifyMFA completes a login with its second factor and issues the tokens
+// @Summary [post] /auth/mfa/verify
+// @Description Verifies the second factor of a login which got an MFA challenge, a TOTP code or a recovery code,
+// @Description and issues the tokens. A challenge accepts a few attempts, failures count as failed logins.
+// @Tags auth
+// @Accept  json,application/msgpack,application/cbor,xml
+// @Produce json,application/msgpack,application/cbor,xml
+// @Param verification body VerifyMFARequest true "MFA token and code"
+// @Success 200 {object} TokenResponse "Access token"
+// @Failure 400 {object} Problem "Invalid request JSON"
+// @Failure 401 {object} Problem "Invalid or expired MFA token, or invalid code"
+// @Failure 422 {object} Problem "Params validation error"
+// @Failure 429 {object} Problem "Too many failed logins, see the Retry-After header"
+// @Failure 500 {object} Problem "Internal server error"
+// @Failure 503 {object} Problem "Challenge, session or lockout store unavailable"
+// @Router /auth/mfa/verify [post]
+func (rest *R) VerifyMFA(c echo.Context) error {
+	var req VerifyMFARequest
+	if err := rest.Bind(c, &req); err != nil {
+		return err
+	}
+	if rest.MFAChallenges == nil {
+		return apperr.Unavailable(apperr.CodeUnavailable, "MFA challenge store unavailable")
+	}
+
+	ctx := c.Request().Context()
+	tokenHash := hashToken(req.MFAToken)
+	challenge, err := rest.MFAChallenges.AttemptMFAChallenge(ctx, tokenHash, rest.cfg.MFA.ChallengeAttempts)
+	if err != nil {
+		return apperr.Unavailable(apperr.CodeUnavailable, "MFA challenge store unavailable").Wrap(err)
+	}
+	if challenge == nil {
+		return apperr.Unauthorized(apperr.CodeInvalidMFAToken, "invalid or expired MFA token")
+	}
+	userID := challenge.UserID
+	u, err := rest.findActiveUser(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if u == nil {
+		return apperr.Unauthorized(apperr.CodeInvalidMFAToken, "invalid or expired MFA token")
+	}
+
+	attempt, err := rest.reserveLoginAttempt(c, u.Email)
+	if err != nil {
+		return err
+	}
+	if err := rest.verifySecondFactor(c, u.ID, req.Code, req.RecoveryCode); err != nil {
+		rest.loginFailed(c, attempt)
+
+		return err
+	}
+	if err := rest.refundLoginAttempt(c, attempt); err != nil {
+		return err
+	}
+	if err := rest.MFAChallenges.DeleteMFAChallenge(ctx, tokenHash); err != nil {
+		return apperr.Unavailable(apperr.CodeUnavailable, "MFA challenge store unavailable").Wrap(err)
+	}
+	if err := rest.resetLoginFailures(c, u.Email); err != nil {
+		return err
+	}
+
+	authn := mfaAuthentication(challenge.AuthMethods, time.Now())
+	sessionID, refreshToken, err := rest.startSession(c, userID, authn)
+	if err != nil {
+		return err
+	}
+
+	return rest.issueTokens(c, u, authn, sessionID, refreshToken)
+}
+
+// EnrollTOTP starts the TOTP enrollment of the authenticated user
+// @Summary [post] /mfa/totp
+// @Description Generates a TOTP secret for the authenticated user, to be added to an authenticator app by scanning
+// @Description the QR code of its URI. The factor is enabled once confirmed with a code, enrolling again before
+// @Description replaces the secret.
+// @Tags mfa
+// @Accept  json
+// @Produce json,application/msgpack,application/cbor,xml
+// @Security BearerAuth
+// @Success 201 {object} TOTPEnrollment "TOTP secret"
+// @Failure 401 {object} Problem "Invalid or revoked access token"
+// @Failure 404 {object} Problem "MFA is disabled"
+// @Failure 409 {object} Problem "TOTP is already enabled"
+// @Failure 500 {object} Problem "Internal server error"
+// @Router /mfa/totp [post]
+func (rest *R) EnrollTOTP(c echo.Context) error {
+	u, err := rest.mfaUser(c)
+	if err != nil {
+		return err
+	}
+	ctx := c.Request().Context()
+	factor, err := rest.DB.FindUserTOTP(ctx, u.ID)
+	if err != nil {
+		return err
+	}
+	if factor.Confirmed() {
+		return apperr.Conflict(apperr.CodeTOTPAlreadyEnabled, "TOTP is already enabled")
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		return apperr.Internal(err)
+	}
+	encrypted, err := rest.MFACipher.Encrypt([]byte(secret))
+	if err != nil {
+		return apperr.Internal(err)
+	}
+	if err := rest.DB.SaveUserTOTP(ctx, u.ID, encrypted); err != nil {
+		return err
+	}
+
+	return rest.Render(c, http.StatusCreated, TOTPEnrollment{
+		Secret: secret,
+		URI:    totp.ProvisioningURI(rest.cfg.MFA.Issuer, u.Email, secret),
+	})
+}
+
+// ConfirmTOTP enables the TOTP factor of the authenticated user
+// @Summary [post] /mfa/totp/confirm
+// @Description Enables the TOTP factor being enrolled with a code of the authenticator app and returns the recovery
+// @Description codes, they are not shown again.
+// @Tags mfa
+// @Accept  json,application/msgpack,application/cbor,xml
+// @Produce json,application/msgpack,application/cbor,xml
+// @Security BearerAuth
+// @Param code body ConfirmTOTPRequest true "TOTP code"
+// @Success 200 {object} RecoveryCodes "Recovery codes"
+// @Failure 400 {object} Problem "Invalid request JSON"
+// @Failure 401 {object} Problem "Invalid or revoked access token"
+// @Failure 404 {object} Problem "No TOTP enrollment"
+// @Failure 409 {object} Problem "TOTP is already enabled"
+// @Failure 422 {object} Problem "Params validation error or invalid code"
+// @Failure 500 {object} Problem "Internal server error"
+// @Router /mfa/totp/confirm [post]
+func (rest *R) ConfirmTOTP(c echo.Context) error {
+	var req ConfirmTOTPRequest
+	if err := rest.Bind(c, &req); err != nil {
+		return err
+	}
+	u, err := rest.mfaUser(c)
+	if err != nil {
+		return err
+	}
+	ctx := c.Request().Context()
+	factor, err := rest.DB.FindUserTOTP(ctx, u.ID)
+	if err != nil {
+		return err
+	}
+	if factor == nil {
+		return apperr.NotFound(apperr.CodeTOTPNotEnrolled, "TOTP enrollment not found")
+	}
+	if factor.Confirmed() {
+		return apperr.Conflict(apperr.CodeTOTPAlreadyEnabled, "TOTP is already enabled")
+	}
+
+	step, ok, err := rest.validateTOTP(factor.Secret, req.Code)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return apperr.Validation(apperr.CodeInvalidMFACode, "invalid code")
+	}
+	codes, hashes, err := rest.newRecoveryCodes()
+	if err != nil {
+		return err
+	}
+	if err := rest.DB.ConfirmUserTOTP(ctx, u.ID, step, hashes); err != nil {
+		return err
+	}
+	rest.Audit.Record(ctx, audit.Event{Type: audit.EventMFAEnabled, Actor: strconv.Itoa(u.ID), Subject: strconv.Itoa(u.ID), IP: c.RealIP()})
+
+	return rest.Render(c, http.StatusOK, RecoveryCodes{Codes: codes})
+}
+
+// DeleteTOTP disables the TOTP factor of the authenticated user
+// @Summary [delete] /mfa/totp
+// @Description Disables the TOTP factor of the authenticated user and deletes its recovery codes.
+// @Description Requires a recent second factor, see /mfa/step-up.
+// @Tags mfa
+// @Accept  json
+// @Produce json,application/msgpack,application/cbor,xml
+// @Security BearerAuth
+// @Success 204 "TOTP disabled"
+// @Failure 401 {object} Problem "Invalid or revoked access token"
+// @Failure 403 {object} Problem "Recent second factor required"
+// @Failure 404 {object} Problem "MFA is disabled"
+// @Failure 500 {object} Problem "Internal server error"
+// @Router /mfa/totp [delete]
+func (rest *R) DeleteTOTP(c echo.Context) error {
+	u, err := rest.mfaUser(c)
+	if err != nil {
+		return err
+	}
+	ctx := c.Request().Context()
+	if err := rest.DB.DeleteUserTOTP(ctx, u.ID); err != nil {
+		return err
+	}
+	rest.Audit.Record(ctx, audit.Event{Type: audit.EventMFADisabled, Actor: strconv.Itoa(u.ID), Subject: strconv.Itoa(u.ID), IP: c.RealIP()})
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// RegenerateRecoveryCodes replaces the recovery codes of the authenticated user
+// @Summary [post] /mfa/recovery-codes
+// @Description Replaces the recovery codes of the authenticated user, the previous ones stop working.
+// @Description Requires a recent second factor, see /mfa/step-up.
+// @Tags mfa
+// @Accept  json
+// @Produce json,application/msgpack,application/cbor,xml
+// @Security BearerAuth
+// @Success 200 {object} RecoveryCodes "Recovery codes"
+// @Failure 401 {object} Problem "Invalid or revoked access token"
+// @Failure 403 {object} Problem "Recent second factor required"
+// @Failure 404 {object} Problem "TOTP is not enabled"
+// @Failure 500 {object} Problem "Internal server error"
+// @Router /mfa/recovery-codes [post]
+func (rest *R) RegenerateRecoveryCodes(c echo.Context) error {
+	u, err := rest.mfaUser(c)
+	if err != nil {
+		return err
+	}
+	ctx := c.Request().Context()
+	factor, err := rest.DB.FindUserTOTP(ctx, u.ID)
+	if err != nil {
+		return err
+	}
+	if !factor.Confirmed() {
+		return apperr.NotFound(apperr.CodeTOTPNotEnrolled, "TOTP is not enabled")
+	}
+
+	codes, hashes, err := rest.newRecoveryCodes()
+	if err != nil {
+		return err
+	}
+	if err := rest.DB.ReplaceRecoveryCodes(ctx, u.ID, hashes); err != nil {
+		return err
+	}
+	rest.Audit.Record(ctx, audit.Event{Type: audit.EventRecoveryCodesRegenerated, Actor: strconv.Itoa(u.ID), Subject: strconv.Itoa(u.ID), IP: c.RealIP()})
+
+	return rest.Render(c, http.StatusOK, RecoveryCodes{Codes: codes})
+}
+
+// StepUp verifies the second factor of the authenticated user and issues an access token proving it
+// @Summary [post] /mfa/step-up
+// @Description Verifies a TOTP code or a recovery code of the authenticated user and issues an access token of
+// @Description the same session allowed on the routes requiring a recent second factor. Failures count as
+// @Description failed logins.
+// @Tags mfa
+// @Accept  json,application/msgpack,application/cbor,xml
+// @Produce json,application/msgpack,application/cbor,xml
+// @Security BearerAuth
+// @Param code body StepUpRequest true "TOTP code or recovery code"
+// @Success 200 {object} TokenResponse "Access token"
+// @Failure 400 {object} Problem "Invalid request JSON"
+// @Failure 401 {object} Problem "Invalid or revoked access token, or invalid code"
+// @Failure 404 {object} Problem "TOTP is not enabled"
+// @Failure 422 {object} Problem "Params validation error"
+// @Failure 429 {object} Problem "Too many failed logins, see the Retry-After header"
+// @Failure 500 {object} Problem "Internal server error"
+// @Failure 503 {object} Problem "Session or lockout store unavailable"
+// @Router /mfa/step-up [post]
+func (rest *R) StepUp(c echo.Context) error {
+	var req StepUpRequest
+	if err := rest.Bind(c, &req); err != nil {
+		return err
+	}
+	u, err := rest.mfaUser(c)
+	if err != nil {
+		return err
+	}
+	ctx := c.Request().Context()
+	factor, err := rest.DB.FindUserTOTP(ctx, u.ID)
+	if err != nil {
+		return err
+	}
+	if !factor.Confirmed() {
+		return apperr.NotFound(apperr.CodeTOTPNotEnrolled, "TOTP is not enabled")
+	}
+
+	attempt, err := rest.reserveLoginAttempt(c, u.Email)
+	if err != nil {
+		return err
+	}
+	if err := rest.verifySecondFactor(c, u.ID, req.Code, req.RecoveryCode); err != nil {
+		rest.loginFailed(c, attempt)
+
+		return err
+	}
+	if err := rest.refundLoginAttempt(c, attempt); err != nil {
+		return err
+	}
+	if err := rest.resetLoginFailures(c, u.Email); err != nil {
+		return err
+	}
+
+	// the token proves the first factor
+	var sessionID string
+	var methods []string
+	if claims, err := auth.ClaimsValue(ctx); err == nil {
+		sessionID = claims.GetSessionID()
+		methods = claims.GetAuthMethods()
+	}
+
+	return rest.issueTokens(c, u, mfaAuthentication(methods, time.Now()), sessionID, "")
+}
+
+// RequireMFA rejects the tokens which do not prove a second factor verified within maxAge with a 403,
+// it runs after Authenticate. The second factor is proven again at the step-up endpoint.
+func RequireMFA(maxAge time.Duration) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			claims, err := auth.ClaimsValue(c.Request().Context())
+			if err != nil {
+				return apperr.Unauthorized(apperr.CodeUnauthorized, "jwt missing").Wrap(err)
+			}
+			authTime := claims.GetAuthTime()
+			if !claims.HasAuthMethod(auth.AuthMethodMFA) || authTime.IsZero() || time.Since(authTime) > maxAge {
+				return apperr.Forbidden(apperr.CodeMFARequired, "a recent second factor is required, see /mfa/step-up")
+			}
+
+			return next(c)
+		}
+	}
+}
+
+// adminMiddlewares are the middlewares of the admin routes
+func (rest *R) adminMiddlewares() []echo.MiddlewareFunc {
+	m := []echo.MiddlewareFunc{rest.Authenticate, RequireScope(ScopeAdmin)}
+	if rest.cfg.MFA.Enable && rest.cfg.MFA.RequireForAdmin {
+		m = append(m, RequireMFA(rest.cfg.MFA.StepUpMaxAge))
+	}
+
+	return append(m, CacheControl(CacheNoStore))
+}
+
+// newMFACipher creates the cipher of the TOTP secrets. The key must be configured, a key generated at startup would
+// invalidate the enrolled factors on restarts and differ between the instances.
+func newMFACipher(cfg config.MFA) (*encryption.Cipher, error) {
+	if cfg.EncryptionKey == "" {
+		return nil, errors.New("REST_MFA_ENCRYPTION_KEY is required when MFA is enabled")
+	}
+	key, err := encryption.ParseKey(cfg.EncryptionKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return encryption.New(key)
+}
+
+// hasMFA reports whether the user has a confirmed second factor to verify at login
+func (rest *R) hasMFA(ctx context.Context, userID int) (bool, error) {
+	if !rest.cfg.MFA.Enable {
+		return false, nil
+	}
+	factor, err := rest.DB.FindUserTOTP(ctx, userID)
+	if err != nil {
+		return false, err
+	}
+
+	return factor.Confirmed(), nil
+}
+
+// startMFAChallenge responds to a login waiting for its second factor with an MFA challenge, the methods of the
+// first factor are kept with the challenge, see mfaAuthentication
+func (rest *R) startMFAChallenge(c echo.Context, u *postgres.User, methods []string) error {
+	if rest.MFAChallenges == nil {
+		return apperr.Unavailable(apperr.CodeUnavailable, "MFA challenge store unavailable")
+	}
+
+	mfaToken := newOpaqueToken()
+	ttl := rest.cfg.MFA.ChallengeTTL
+	if err := rest.MFAChallenges.CreateMFAChallenge(c.Request().Context(), hashToken(mfaToken), strconv.Itoa(u.ID), methods, ttl); err != nil {
+		return apperr.Unavailable(apperr.CodeUnavailable, "MFA challenge store unavailable").Wrap(err)
+	}
+
+	h := c.Response().Header()
+	h.Set(echo.HeaderCacheControl, CacheNoStore)
+	h.Set(HeaderPragma, "no-cache")
+
+	return rest.Render(c, http.StatusAccepted, MFAChallengeResponse{
+		MFAToken:  mfaToken,
+		Methods:   []string{MFAMethodTOTP, MFAMethodRecoveryCode},
+		ExpiresIn: int(ttl.Seconds()),
+	})
+}
+
+// verifySecondFactor checks a TOTP code or a recovery code of the user, each is accepted only once
+func (rest *R) verifySecondFactor(c echo.Context, userID int, code, recoveryCode string) error {
+	ctx := c.Request().Context()
+	invalid := apperr.Unauthorized(apperr.CodeInvalidMFACode, "invalid code")
+	if recoveryCode != "" {
+		ok, err := rest.DB.UseRecoveryCode(ctx, userID, hashRecoveryCode(recoveryCode))
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return invalid
+		}
+		rest.Audit.Record(ctx, audit.Event{Type: audit.EventRecoveryCodeUsed, Actor: strconv.Itoa(userID), Subject: strconv.Itoa(userID), IP: c.RealIP()})
+
+		return nil
+	}
+
+	factor, err := rest.DB.FindUserTOTP(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if !factor.Confirmed() {
+		return invalid
+	}
+	step, ok, err := rest.validateTOTP(factor.Secret, code)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return invalid
+	}
+	// a code seen by an attacker must not be replayed while it is valid
+	if ok, err = rest.DB.UseTOTPStep(ctx, userID, step); err != nil {
+		return err
+	}
+	if !ok {
+		return invalid
+	}
+
+	return nil
+}
+
+// validateTOTP checks a code against an encrypted secret, it returns the time step of the code
+func (rest *R) validateTOTP(encryptedSecret, code string) (int64, bool, error) {
+	secret, err := rest.MFACipher.Decrypt(encryptedSecret)
+	if err != nil {
+		return 0, false, apperr.Internal(err)
+	}
+	step, ok, err := totp.Validate(string(secret), code, time.Now(), totpSkew)
+	if err != nil {
+		return 0, false, apperr.Internal(err)
+	}
+
+	return step, ok, nil
+}
+
+// mfaUser loads the authenticated user managing its second factor
+func (rest *R) mfaUser(c echo.Context) (*postgres.User, error) {
+	if !rest.cfg.MFA.Enable {
+		return nil, apperr.NotFound(apperr.CodeNotFound, "MFA is disabled")
+	}
+	userID, err := rest.localUserID(c.Request().Context())
+	if err != nil {
+		return nil, err
+	}
+	u, err := rest.findActiveUser(c.Request().Context(), userID)
+	if err != nil {
+		return nil, err
+	}
+	if u == nil {
+		return nil, apperr.Unauthorized(apperr.CodeUnauthorized, "user not found")
+	}
+
+	return u, nil
+}
+
+// newRecoveryCodes generates the recovery codes of a user and their hashes, only the hashes are stored
+func (rest *R) newRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, rest.cfg.MFA.RecoveryCodes)
+	hashes := make([]string, len(codes))
+	for i := range codes {
+		b := make([]byte, 10)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, apperr.Internal(err)
+		}
+		s := recoveryCodeEncoding.EncodeToString(b)
+		codes[i] = s[0:4] + "-" + s[4:8] + "-" + s[8:12] + "-" + s[12:16]
+		hashes[i] = hashRecoveryCode(codes[i])
+	}
+
+	return codes, hashes, nil
+}
+
+// hashRecoveryCode hashes a recovery code as typed by the user, ignoring case, dashes and spaces
+func hashRecoveryCode(code string) string {
+	code = strings.NewReplacer("-", "", " ", "").Replace(strings.ToLower(code))
+
+	return hashToken(code)
+}
+
+// mfaAuthentication is the authentication of a user who verified a second factor at t, after a first factor of
+// the methods, e.g. pwd or email
+func mfaAuthentication(methods []string, t time.Time) authentication {
+	merged := make([]string, 0, len(methods)+2)
+	seen := map[string]bool{}
+	for _, m := range append(append([]string{}, methods...), auth.AuthMethodOTP, auth.AuthMethodMFA) {
+		if !seen[m] {
+			seen[m] = true
+			merged = append(merged, m)
+		}
+	}
+
+	return authentication{methods: merged, time: t}
+}
+
+// localUserID returns the user id of the request, which must be authenticated by a token of this service. The
+// subjects of the other trusted issuers are not local users even when they look like ids, they must not act on the
+// account of the local user with the same id.
+func (rest *R) localUserID(ctx context.Context) (string, error) {
+	userID, err := auth.UserIDValue(ctx)
+	if err != nil {
+		return "", apperr.Unauthorized(apperr.CodeUnauthorized, "jwt missing").Wrap(err)
+	}
+	issuer, err := auth.IssuerValue(ctx)
+	if err != nil || rest.Tokens == nil || issuer != rest.Tokens.Issuer() {
+		return "", apperr.Forbidden(apperr.CodeForbidden, "token not issued by this service")
+	}
+
+	return userID, nil
+}
+
+// findActiveUser loads the user of the id of a local token or a challenge, nil if unknown or inactive
+func (rest *R) findActiveUser(ctx context.Context, userID string) (*postgres.User, error) {
+	// the subjects of third-party tokens are not local users
+	id, err := strconv.Atoi(userID)
+	if err != nil {
+		return nil, nil
+	}
+	u, err := rest.DB.FindOneUserByID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if u == nil || !u.Active {
+		return nil, nil
+	}
+
+	return u, nil
+}
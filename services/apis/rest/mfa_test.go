@@ -0,0 +1,532 @@
+package rest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/efimovalex/replaceme/adapters/redisdb"
+	"github.com/efimovalex/replaceme/config"
+	"github.com/efimovalex/replaceme/internal/audit"
+	"github.com/efimovalex/replaceme/internal/auth0/authtest"
+	"github.com/efimovalex/replaceme/internal/encryption"
+	"github.com/efimovalex/replaceme/internal/totp"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+var (
+	totpColumns          = []string{"user_id", "secret", "confirmed_at", "last_used_step", "created_at"}
+	findUserTOTPQuery    = regexp.QuoteMeta(`SELECT * FROM user_totp WHERE user_id = $1 LIMIT 1`)
+	saveUserTOTPQuery    = regexp.QuoteMeta(`INSERT INTO user_totp (user_id,secret) VALUES ($1,$2) ON CONFLICT (user_id)`)
+	confirmUserTOTPQuery = regexp.QuoteMeta(`UPDATE user_totp SET confirmed_at = CURRENT_TIMESTAMP, last_used_step = $1 WHERE confirmed_at IS NULL AND user_id = $2`)
+	useTOTPStepQuery     = regexp.QuoteMeta(`UPDATE user_totp SET last_used_step = $1 WHERE user_id = $2 AND last_used_step < $3`)
+	deleteUserTOTPQuery  = regexp.QuoteMeta(`DELETE FROM user_totp WHERE user_id = $1`)
+	deleteRecoveryQuery  = regexp.QuoteMeta(`DELETE FROM user_recovery_codes WHERE user_id = $1`)
+	insertRecoveryQuery  = regexp.QuoteMeta(`INSERT INTO user_recovery_codes (user_id,code_hash) VALUES`)
+	useRecoveryCodeQuery = regexp.QuoteMeta(`UPDATE user_recovery_codes SET used_at = CURRENT_TIMESTAMP WHERE code_hash = $1 AND used_at IS NULL AND user_id = $2`)
+	testMFAConfig        = config.MFA{
+		Enable:            true,
+		Issuer:            "Replaceme",
+		ChallengeTTL:      5 * time.Minute,
+		ChallengeAttempts: 3,
+		StepUpMaxAge:      15 * time.Minute,
+		RequireForAdmin:   true,
+		RecoveryCodes:     4,
+	}
+)
+
+// mfaChallengeStoreMock is an in-memory MFAChallengeStore
+type mfaChallengeStoreMock struct {
+	mu         sync.Mutex
+	challenges map[string]*redisdb.MFAChallenge
+	attempts   map[string]int
+	err        error
+}
+
+func newMFAChallengeStoreMock() *mfaChallengeStoreMock {
+	return &mfaChallengeStoreMock{challenges: map[string]*redisdb.MFAChallenge{}, attempts: map[string]int{}}
+}
+
+func (m *mfaChallengeStoreMock) CreateMFAChallenge(ctx context.Context, tokenHash, userID string, authMethods []string, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return m.err
+	}
+	m.challenges[tokenHash] = &redisdb.MFAChallenge{UserID: userID, AuthMethods: authMethods}
+
+	return nil
+}
+
+func (m *mfaChallengeStoreMock) AttemptMFAChallenge(ctx context.Context, tokenHash string, maxAttempts int) (*redisdb.MFAChallenge, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return nil, m.err
+	}
+	challenge, ok := m.challenges[tokenHash]
+	if !ok {
+		return nil, nil
+	}
+	m.attempts[tokenHash]++
+	if m.attempts[tokenHash] >= maxAttempts {
+		delete(m.challenges, tokenHash)
+	}
+
+	return challenge, nil
+}
+
+func (m *mfaChallengeStoreMock) DeleteMFAChallenge(ctx context.Context, tokenHash string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return m.err
+	}
+	delete(m.challenges, tokenHash)
+
+	return nil
+}
+
+// testTOTP is a TOTP factor of the tests, with its secret encrypted by the cipher of the REST instance
+type testTOTP struct {
+	secret    string
+	encrypted string
+}
+
+func (f testTOTP) code(t *testing.T) string {
+	code, err := totp.Code(f.secret, time.Now())
+	require.NoError(t, err)
+
+	return code
+}
+
+// newTestMFAREST creates a REST instance with MFA enabled, an in-memory challenge store, login throttler and audit log
+func newTestMFAREST(t *testing.T) (*R, sqlmock.Sqlmock, *mfaChallengeStoreMock, *loginThrottlerMock, *audit.Fake, testTOTP) {
+	r, mock := NewTestRESTWithMock(t)
+	r.cfg.MFA = testMFAConfig
+	r.cfg.Lockout = testLockoutConfig
+	key, err := encryption.GenerateKey()
+	require.NoError(t, err)
+	r.MFACipher, err = encryption.New(key)
+	require.NoError(t, err)
+	challenges := newMFAChallengeStoreMock()
+	logins := newLoginThrottlerMock()
+	events := &audit.Fake{}
+	r.MFAChallenges = challenges
+	r.Logins = logins
+	r.Audit = events
+	// the MFA requirements of the routes depend on the configuration
+	r.SetupRouter()
+
+	secret, err := totp.GenerateSecret()
+	require.NoError(t, err)
+	encrypted, err := r.MFACipher.Encrypt([]byte(secret))
+	require.NoError(t, err)
+
+	return r, mock, challenges, logins, events, testTOTP{secret: secret, encrypted: encrypted}
+}
+
+func expectTestUserByID(mock sqlmock.Sqlmock) {
+	createdAt := time.Date(2022, 7, 1, 10, 0, 0, 0, time.UTC)
+	mock.ExpectQuery(findUserByID).WithArgs(1).WillReturnRows(sqlmock.NewRows(userColumns).
+		AddRow(1, "jane.doe@replaceme.com", "", "", "Jane", "Doe", true, createdAt, createdAt))
+}
+
+func expectTestTOTP(mock sqlmock.Sqlmock, f testTOTP, confirmed bool) {
+	createdAt := time.Date(2022, 7, 1, 10, 0, 0, 0, time.UTC)
+	var confirmedAt interface{}
+	if confirmed {
+		confirmedAt = createdAt
+	}
+	mock.ExpectQuery(findUserTOTPQuery).WithArgs(1).WillReturnRows(sqlmock.NewRows(totpColumns).
+		AddRow(1, f.encrypted, confirmedAt, 0, createdAt))
+}
+
+// mfaRequest serves a request of the user 1 with an access token carrying claims
+func mfaRequest(t *testing.T, r *R, method, path, body string, claims map[string]interface{}) *httptest.ResponseRecorder {
+	all := map[string]interface{}{"email": "jane.doe@replaceme.com"}
+	for k, v := range claims {
+		all[k] = v
+	}
+	accessToken, err := r.Tokens.Issue("1", all)
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	req.Header.Set(echo.HeaderAuthorization, "Bearer "+accessToken.Raw)
+	w := httptest.NewRecorder()
+	r.Router.ServeHTTP(w, req)
+
+	return w
+}
+
+func accessTokenClaims(t *testing.T, raw string) map[string]interface{} {
+	parsed, err := jwt.ParseSigned(raw)
+	require.NoError(t, err)
+	claims := map[string]interface{}{}
+	require.NoError(t, parsed.UnsafeClaimsWithoutVerification(&claims))
+
+	return claims
+}
+
+func TestREST_Login_MFA(t *testing.T) {
+	createdAt := time.Date(2022, 7, 1, 10, 0, 0, 0, time.UTC)
+	hash, err := bcrypt.GenerateFromPassword([]byte("s3cr3t-p4ss"), bcrypt.MinCost)
+	require.NoError(t, err)
+	startLogin := func(t *testing.T, r *R, mock sqlmock.Sqlmock, f testTOTP) (string, []byte) {
+		mock.ExpectQuery(findActiveUserQuery).WithArgs("Jane.Doe@replaceme.com", true).WillReturnRows(sqlmock.NewRows(userColumns).
+			AddRow(1, "jane.doe@replaceme.com", string(hash), "", "Jane", "Doe", true, createdAt, createdAt))
+		expectTestTOTP(mock, f, true)
+
+		w := login(r, "s3cr3t-p4ss", "192.0.2.1")
+		require.Equal(t, http.StatusAccepted, w.Code, w.Body.String())
+		assert.Equal(t, CacheNoStore, w.Header().Get(echo.HeaderCacheControl))
+		var res MFAChallengeResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+		require.NotEmpty(t, res.MFAToken)
+
+		return res.MFAToken, w.Body.Bytes()
+	}
+	verify := func(r *R, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/v1/auth/mfa/verify", strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		w := httptest.NewRecorder()
+		r.Router.ServeHTTP(w, req)
+
+		return w
+	}
+
+	t.Run("TOTP code", func(t *testing.T) {
+		r, mock, challenges, _, _, f := newTestMFAREST(t)
+		sessions := newSessionStoreMock()
+		r.Sessions = sessions
+		mfaToken, challenge := startLogin(t, r, mock, f)
+		checkResponseWithTestDataFile(t, challenge, []string{"mfa_token"})
+
+		expectTestUserByID(mock)
+		expectTestTOTP(mock, f, true)
+		mock.ExpectExec(useTOTPStepQuery).WillReturnResult(sqlmock.NewResult(0, 1))
+		w := verify(r, `{"mfa_token":"`+mfaToken+`","code":"`+f.code(t)+`"}`)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		assert.Empty(t, challenges.challenges, "the challenge is used once")
+
+		var res TokenResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+		claims := accessTokenClaims(t, res.AccessToken)
+		assert.Equal(t, []interface{}{"pwd", "otp", "mfa"}, claims["amr"])
+		assert.InDelta(t, time.Now().Unix(), claims["auth_time"], 5)
+		s := sessions.sessions[sessions.refreshTokens[hashToken(res.RefreshToken)]]
+		require.NotNil(t, s)
+		assert.Equal(t, []string{"pwd", "otp", "mfa"}, s.AuthMethods, "refreshed tokens keep the second factor")
+	})
+
+	t.Run("Recovery code", func(t *testing.T) {
+		r, mock, _, _, events, f := newTestMFAREST(t)
+		mfaToken, _ := startLogin(t, r, mock, f)
+
+		expectTestUserByID(mock)
+		mock.ExpectExec(useRecoveryCodeQuery).WithArgs(hashRecoveryCode("abcdefghijklmnop"), 1).WillReturnResult(sqlmock.NewResult(0, 1))
+		w := verify(r, `{"mfa_token":"`+mfaToken+`","recovery_code":"ABCD-EFGH-IJKL-MNOP"}`)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		require.Len(t, events.Events(), 1)
+		assert.Equal(t, audit.EventRecoveryCodeUsed, events.Events()[0].Type)
+	})
+
+	t.Run("Invalid code", func(t *testing.T) {
+		r, mock, challenges, logins, _, f := newTestMFAREST(t)
+		mfaToken, _ := startLogin(t, r, mock, f)
+
+		expectTestUserByID(mock)
+		expectTestTOTP(mock, f, true)
+		w := verify(r, `{"mfa_token":"`+mfaToken+`","code":"000000"}`)
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		checkResponseWithTestDataFile(t, w.Body.Bytes(), []string{"correlation_id"})
+		assert.Equal(t, 1, logins.attempts["account:jane.doe@replaceme.com"].Failures, "wrong codes are failed logins")
+		assert.Len(t, challenges.challenges, 1, "the challenge can be tried again")
+	})
+
+	t.Run("Replayed code", func(t *testing.T) {
+		r, mock, _, _, _, f := newTestMFAREST(t)
+		mfaToken, _ := startLogin(t, r, mock, f)
+
+		expectTestUserByID(mock)
+		expectTestTOTP(mock, f, true)
+		mock.ExpectExec(useTOTPStepQuery).WillReturnResult(sqlmock.NewResult(0, 0))
+		w := verify(r, `{"mfa_token":"`+mfaToken+`","code":"`+f.code(t)+`"}`)
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+	})
+
+	t.Run("Invalid MFA token", func(t *testing.T) {
+		r, _, _, _, _, _ := newTestMFAREST(t)
+
+		w := verify(r, `{"mfa_token":"unknown","code":"123456"}`)
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		checkResponseWithTestDataFile(t, w.Body.Bytes(), []string{"correlation_id"})
+	})
+
+	t.Run("Missing code", func(t *testing.T) {
+		r, _, _, _, _, _ := newTestMFAREST(t)
+
+		w := verify(r, `{"mfa_token":"unknown"}`)
+		assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	})
+
+	t.Run("Challenge store unavailable", func(t *testing.T) {
+		r, mock, challenges, _, _, f := newTestMFAREST(t)
+		challenges.err = errors.New("connection refused")
+		mock.ExpectQuery(findActiveUserQuery).WithArgs("Jane.Doe@replaceme.com", true).WillReturnRows(sqlmock.NewRows(userColumns).
+			AddRow(1, "jane.doe@replaceme.com", string(hash), "", "Jane", "Doe", true, createdAt, createdAt))
+		expectTestTOTP(mock, f, true)
+
+		w := login(r, "s3cr3t-p4ss", "192.0.2.1")
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	})
+
+	t.Run("Unconfirmed factor", func(t *testing.T) {
+		r, mock, _, _, _, f := newTestMFAREST(t)
+		mock.ExpectQuery(findActiveUserQuery).WithArgs("Jane.Doe@replaceme.com", true).WillReturnRows(sqlmock.NewRows(userColumns).
+			AddRow(1, "jane.doe@replaceme.com", string(hash), "", "Jane", "Doe", true, createdAt, createdAt))
+		expectTestTOTP(mock, f, false)
+
+		w := login(r, "s3cr3t-p4ss", "192.0.2.1")
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var res TokenResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+		assert.Equal(t, []interface{}{"pwd"}, accessTokenClaims(t, res.AccessToken)["amr"])
+	})
+}
+
+func TestREST_EnrollTOTP(t *testing.T) {
+	t.Run("Enroll and confirm", func(t *testing.T) {
+		r, mock, _, _, events, _ := newTestMFAREST(t)
+		expectTestUserByID(mock)
+		mock.ExpectQuery(findUserTOTPQuery).WithArgs(1).WillReturnRows(sqlmock.NewRows(totpColumns))
+		mock.ExpectExec(saveUserTOTPQuery).WithArgs(1, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+
+		w := mfaRequest(t, r, http.MethodPost, "/v1/mfa/totp", "", nil)
+		require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+		assert.Equal(t, CacheNoStore, w.Header().Get(echo.HeaderCacheControl))
+		var enrollment TOTPEnrollment
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &enrollment))
+		assert.Len(t, enrollment.Secret, 32)
+		assert.True(t, strings.HasPrefix(enrollment.URI, "otpauth://totp/Replaceme:jane.doe@replaceme.com?"), enrollment.URI)
+		assert.Contains(t, enrollment.URI, "secret="+enrollment.Secret)
+
+		encrypted, err := r.MFACipher.Encrypt([]byte(enrollment.Secret))
+		require.NoError(t, err)
+		f := testTOTP{secret: enrollment.Secret, encrypted: encrypted}
+		expectTestUserByID(mock)
+		expectTestTOTP(mock, f, false)
+		mock.ExpectBegin()
+		mock.ExpectExec(confirmUserTOTPQuery).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec(deleteRecoveryQuery).WithArgs(1).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec(insertRecoveryQuery).WillReturnResult(sqlmock.NewResult(0, 4))
+		mock.ExpectCommit()
+
+		w = mfaRequest(t, r, http.MethodPost, "/v1/mfa/totp/confirm", `{"code":"`+f.code(t)+`"}`, nil)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var codes RecoveryCodes
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &codes))
+		require.Len(t, codes.Codes, 4)
+		assert.Regexp(t, `^[a-z2-7]{4}-[a-z2-7]{4}-[a-z2-7]{4}-[a-z2-7]{4}$`, codes.Codes[0])
+		require.Len(t, events.Events(), 1)
+		assert.Equal(t, audit.Event{Type: audit.EventMFAEnabled, Actor: "1", Subject: "1", IP: "192.0.2.1"}, events.Events()[0])
+	})
+
+	t.Run("Already enabled", func(t *testing.T) {
+		r, mock, _, _, _, f := newTestMFAREST(t)
+		expectTestUserByID(mock)
+		expectTestTOTP(mock, f, true)
+
+		w := mfaRequest(t, r, http.MethodPost, "/v1/mfa/totp", "", nil)
+		assert.Equal(t, http.StatusConflict, w.Code)
+		checkResponseWithTestDataFile(t, w.Body.Bytes(), []string{"correlation_id"})
+	})
+
+	t.Run("Invalid confirmation code", func(t *testing.T) {
+		r, mock, _, _, _, f := newTestMFAREST(t)
+		expectTestUserByID(mock)
+		expectTestTOTP(mock, f, false)
+
+		w := mfaRequest(t, r, http.MethodPost, "/v1/mfa/totp/confirm", `{"code":"000000"}`, nil)
+		assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+		checkResponseWithTestDataFile(t, w.Body.Bytes(), []string{"correlation_id"})
+	})
+
+	t.Run("Confirm without enrollment", func(t *testing.T) {
+		r, mock, _, _, _, _ := newTestMFAREST(t)
+		expectTestUserByID(mock)
+		mock.ExpectQuery(findUserTOTPQuery).WithArgs(1).WillReturnRows(sqlmock.NewRows(totpColumns))
+
+		w := mfaRequest(t, r, http.MethodPost, "/v1/mfa/totp/confirm", `{"code":"123456"}`, nil)
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+
+	t.Run("MFA disabled", func(t *testing.T) {
+		r := NewTestREST(t)
+
+		w := mfaRequest(t, r, http.MethodPost, "/v1/mfa/totp", "", nil)
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+}
+
+func TestREST_StepUp(t *testing.T) {
+	admin := map[string]interface{}{"scope": "admin", "amr": []string{"pwd"}, "auth_time": time.Now().Unix()}
+
+	t.Run("Admin routes require a recent second factor", func(t *testing.T) {
+		r, mock, _, _, _, f := newTestMFAREST(t)
+		w := mfaRequest(t, r, http.MethodGet, "/v1/admin/lockouts", "", admin)
+		assert.Equal(t, http.StatusForbidden, w.Code)
+		checkResponseWithTestDataFile(t, w.Body.Bytes(), []string{"correlation_id"})
+
+		stale := map[string]interface{}{"scope": "admin", "amr": []string{"pwd", "otp", "mfa"}, "auth_time": time.Now().Add(-time.Hour).Unix()}
+		w = mfaRequest(t, r, http.MethodGet, "/v1/admin/lockouts", "", stale)
+		assert.Equal(t, http.StatusForbidden, w.Code)
+
+		expectTestUserByID(mock)
+		expectTestTOTP(mock, f, true)
+		expectTestTOTP(mock, f, true)
+		mock.ExpectExec(useTOTPStepQuery).WillReturnResult(sqlmock.NewResult(0, 1))
+		w = mfaRequest(t, r, http.MethodPost, "/v1/mfa/step-up", `{"code":"`+f.code(t)+`"}`, admin)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var res TokenResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+		assert.Empty(t, res.RefreshToken)
+		claims := accessTokenClaims(t, res.AccessToken)
+		assert.Equal(t, []interface{}{"pwd", "otp", "mfa"}, claims["amr"])
+
+		recent := map[string]interface{}{"scope": "admin", "amr": claims["amr"], "auth_time": claims["auth_time"]}
+		w = mfaRequest(t, r, http.MethodGet, "/v1/admin/lockouts", "", recent)
+		assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	})
+
+	t.Run("Invalid code", func(t *testing.T) {
+		r, mock, _, logins, _, f := newTestMFAREST(t)
+		expectTestUserByID(mock)
+		expectTestTOTP(mock, f, true)
+		expectTestTOTP(mock, f, true)
+
+		w := mfaRequest(t, r, http.MethodPost, "/v1/mfa/step-up", `{"code":"000000"}`, nil)
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		assert.Equal(t, 1, logins.attempts["account:jane.doe@replaceme.com"].Failures)
+	})
+
+	t.Run("Not enrolled", func(t *testing.T) {
+		r, mock, _, _, _, _ := newTestMFAREST(t)
+		expectTestUserByID(mock)
+		mock.ExpectQuery(findUserTOTPQuery).WithArgs(1).WillReturnRows(sqlmock.NewRows(totpColumns))
+
+		w := mfaRequest(t, r, http.MethodPost, "/v1/mfa/step-up", `{"code":"123456"}`, nil)
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+
+	t.Run("Admin routes without the requirement", func(t *testing.T) {
+		r, _, _, _, _, _ := newTestMFAREST(t)
+		r.cfg.MFA.RequireForAdmin = false
+		r.SetupRouter()
+
+		w := mfaRequest(t, r, http.MethodGet, "/v1/admin/lockouts", "", admin)
+		assert.Equal(t, http.StatusOK, w.Code)
+	})
+}
+
+func TestREST_ManageTOTP(t *testing.T) {
+	mfa := map[string]interface{}{"amr": []string{"pwd", "otp", "mfa"}, "auth_time": time.Now().Unix()}
+
+	t.Run("Delete", func(t *testing.T) {
+		r, mock, _, _, events, _ := newTestMFAREST(t)
+		expectTestUserByID(mock)
+		mock.ExpectBegin()
+		mock.ExpectExec(deleteRecoveryQuery).WithArgs(1).WillReturnResult(sqlmock.NewResult(0, 4))
+		mock.ExpectExec(deleteUserTOTPQuery).WithArgs(1).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+
+		w := mfaRequest(t, r, http.MethodDelete, "/v1/mfa/totp", "", mfa)
+		assert.Equal(t, http.StatusNoContent, w.Code, w.Body.String())
+		require.Len(t, events.Events(), 1)
+		assert.Equal(t, audit.EventMFADisabled, events.Events()[0].Type)
+	})
+
+	t.Run("Delete requires a second factor", func(t *testing.T) {
+		r, _, _, _, _, _ := newTestMFAREST(t)
+
+		w := mfaRequest(t, r, http.MethodDelete, "/v1/mfa/totp", "", nil)
+		assert.Equal(t, http.StatusForbidden, w.Code)
+	})
+
+	t.Run("Regenerate recovery codes", func(t *testing.T) {
+		r, mock, _, _, events, f := newTestMFAREST(t)
+		expectTestUserByID(mock)
+		expectTestTOTP(mock, f, true)
+		mock.ExpectBegin()
+		mock.ExpectExec(deleteRecoveryQuery).WithArgs(1).WillReturnResult(sqlmock.NewResult(0, 4))
+		mock.ExpectExec(insertRecoveryQuery).WillReturnResult(sqlmock.NewResult(0, 4))
+		mock.ExpectCommit()
+
+		w := mfaRequest(t, r, http.MethodPost, "/v1/mfa/recovery-codes", "", mfa)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var codes RecoveryCodes
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &codes))
+		assert.Len(t, codes.Codes, 4)
+		require.Len(t, events.Events(), 1)
+		assert.Equal(t, audit.EventRecoveryCodesRegenerated, events.Events()[0].Type)
+	})
+}
+
+func TestREST_LocalAccountRoutes_OtherIssuer(t *testing.T) {
+	issuer := authtest.NewIssuer(t)
+	r, _ := NewTestRESTWithIssuer(t, issuer)
+	r.cfg.MFA = testMFAConfig
+	r.cfg.WebAuthn = testWebAuthnConfig
+	r.SetupRouter()
+	// the subject of the other issuer looks like the id of the local user 1
+	accessToken := issuer.Token(t, authtest.Claims{"sub": "1"})
+
+	for _, path := range []string{"/v1/mfa/totp", "/v1/mfa/step-up", "/v1/webauthn/registration/options"} {
+		t.Run(path, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(`{"code":"123456"}`))
+			req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+			req.Header.Set(echo.HeaderAuthorization, "Bearer "+accessToken)
+			w := httptest.NewRecorder()
+			r.Router.ServeHTTP(w, req)
+			assert.Equal(t, http.StatusForbidden, w.Code, w.Body.String())
+		})
+	}
+}
+
+func TestHashRecoveryCode(t *testing.T) {
+	assert.Equal(t, hashRecoveryCode("abcd-efgh-ijkl-mnop"), hashRecoveryCode("ABCD EFGH IJKL MNOP"))
+	assert.NotEqual(t, hashRecoveryCode("abcd-efgh-ijkl-mnop"), hashRecoveryCode("abcd-efgh-ijkl-mnoq"))
+}
+
+func TestMFAAuthentication(t *testing.T) {
+	now := time.Now()
+	for _, tt := range []struct {
+		name    string
+		methods []string
+		want    []string
+	}{
+		{"Password", []string{"pwd"}, []string{"pwd", "otp", "mfa"}},
+		{"Magic link", []string{"email"}, []string{"email", "otp", "mfa"}},
+		{"Second factor again", []string{"pwd", "otp", "mfa"}, []string{"pwd", "otp", "mfa"}},
+		{"Unknown first factor", nil, []string{"otp", "mfa"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			authn := mfaAuthentication(tt.methods, now)
+			assert.Equal(t, tt.want, authn.methods)
+			assert.Equal(t, now, authn.time)
+		})
+	}
+}
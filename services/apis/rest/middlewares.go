@@ -1,52 +1,330 @@
 package rest
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net/http"
-	"net/url"
+	"runtime/debug"
 	"time"
 
 	jwtmiddleware "github.com/auth0/go-jwt-middleware/v2"
-	"github.com/auth0/go-jwt-middleware/v2/jwks"
 	"github.com/auth0/go-jwt-middleware/v2/validator"
+	"github.com/efimovalex/replaceme/config"
+	"github.com/efimovalex/replaceme/internal/apperr"
 	auth "github.com/efimovalex/replaceme/internal/auth0"
+	"github.com/efimovalex/replaceme/internal/requestid"
+	"github.com/efimovalex/replaceme/internal/tlsconfig"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"gopkg.in/square/go-jose.v2/jwt"
 )
 
 type CtxKey string
 
+// AuthMiddlewareSetup creates the JWT middleware accepting the tokens of the OpenID Connect providers of the Auth,
+// and the first-party tokens of the login endpoint when the Auth has an Issuer. Each token is validated by the
+// validator of its issuer, and the opaque tokens by the introspection endpoint of the opaque token issuer.
 func (rest *R) AuthMiddlewareSetup(a *auth.Auth) (*jwtmiddleware.JWTMiddleware, error) {
-	issuerURL, err := url.Parse("https://" + a.Domain + "/")
-	if err != nil {
-		return nil, fmt.Errorf("failed to parse the issuer url: %v", err)
-	}
-
-	provider := jwks.NewCachingProvider(issuerURL, 5*time.Minute)
-	jwtValidator, err := validator.New(
-		provider.KeyFunc,
-		validator.RS256,
-		issuerURL.String(),
-		a.Audience,
-		validator.WithCustomClaims(
-			func() validator.CustomClaims {
-				return &auth.CustomClaims{}
-			},
-		),
-		validator.WithAllowedClockSkew(time.Minute),
-	)
-	if err != nil {
-		return nil, fmt.Errorf("failed to set up the jwt validator: %v", err)
+	validators := map[string]jwtmiddleware.ValidateToken{}
+	var opaque, introspector jwtmiddleware.ValidateToken
+	var opaqueIssuer string
+	introspectors := 0
+	for _, p := range a.Providers {
+		issuer, validate, err := rest.providerValidator(p)
+		if err != nil {
+			return nil, err
+		}
+		if validators[issuer] != nil {
+			return nil, fmt.Errorf("issuer %q is trusted twice", issuer)
+		}
+		validators[issuer] = validate
+		if p.Introspection != nil {
+			introspectors++
+			introspector = validate
+			if p.Introspection.Opaque {
+				if opaque != nil {
+					return nil, fmt.Errorf("issuers %q and %q both introspect the opaque tokens", opaqueIssuer, issuer)
+				}
+				opaque, opaqueIssuer = validate, issuer
+			}
+		}
+	}
+	// an opaque token tells no issuer, it is sent only to the endpoint of the issuer configured for them
+	if opaque == nil && introspectors == 1 {
+		opaque = introspector
+	}
+	if a.Issuer != nil {
+		localValidator, err := validator.New(
+			a.Issuer.KeyFunc,
+			validator.SignatureAlgorithm(a.Issuer.Algorithm()),
+			a.Issuer.Issuer(),
+			a.Issuer.Audience(),
+			validator.WithCustomClaims(
+				func() validator.CustomClaims {
+					return &auth.CustomClaims{}
+				},
+			),
+			validator.WithAllowedClockSkew(time.Minute),
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to set up the local jwt validator: %v", err)
+		}
+		if validators[a.Issuer.Issuer()] != nil {
+			return nil, fmt.Errorf("issuer %q is trusted twice", a.Issuer.Issuer())
+		}
+		validators[a.Issuer.Issuer()] = localValidator.ValidateToken
 	}
 
 	errorHandler := func(w http.ResponseWriter, rq *http.Request, err error) {
-		rest.logger.Error().Err(err).Msg("failed to validate the jwt")
+		requestid.Logger(rq.Context(), rest.logger).Error().Err(err).Msg("failed to validate the jwt")
 		c := rest.Router.NewContext(rq, w)
-		_ = rest.JSONError(c, http.StatusUnauthorized, err)
+		msg := "jwt invalid"
+		if errors.Is(err, jwtmiddleware.ErrJWTMissing) {
+			msg = "jwt missing"
+		}
+		_ = rest.JSONError(c, apperr.Unauthorized(apperr.CodeUnauthorized, msg).Wrap(err))
 	}
 
 	middleware := jwtmiddleware.New(
-		jwtValidator.ValidateToken,
+		validateByIssuer(validators, opaque),
 		jwtmiddleware.WithErrorHandler(errorHandler),
 	)
 
 	return middleware, nil
 }
+
+// providerValidator returns the validator of the tokens of the provider, the introspection endpoint of the issuer
+// when it has one, see auth.Introspector, or its keys, see auth.Verifier
+func (rest *R) providerValidator(p auth.Provider) (string, jwtmiddleware.ValidateToken, error) {
+	if p.Introspection != nil {
+		introspector, err := auth.NewIntrospector(p, rest.IntrospectionCache)
+		if err != nil {
+			return "", nil, err
+		}
+		return introspector.Issuer(), introspector.ValidateToken, nil
+	}
+
+	verifier, err := auth.NewVerifier(p)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return verifier.Issuer(), verifier.ValidateToken, nil
+}
+
+// errUntrustedIssuer rejects the tokens whose iss claim is none of the trusted issuers
+var errUntrustedIssuer = errors.New("token issuer is not trusted")
+
+// validateByIssuer validates tokens with the validator of their iss claim, each issuer has its own keys and audiences.
+// Opaque tokens tell no issuer, they are validated by opaque, the introspection of the issuer of the opaque tokens,
+// and rejected when it is nil: a token is never sent to an issuer which may not have issued it.
+func validateByIssuer(validators map[string]jwtmiddleware.ValidateToken, opaque jwtmiddleware.ValidateToken) jwtmiddleware.ValidateToken {
+	return func(ctx context.Context, token string) (interface{}, error) {
+		parsed, err := jwt.ParseSigned(token)
+		if err != nil {
+			if opaque == nil {
+				return nil, fmt.Errorf("could not parse the token: %w", err)
+			}
+			return opaque(ctx, token)
+		}
+		// the claims are verified by the selected validator
+		var claims jwt.Claims
+		if err := parsed.UnsafeClaimsWithoutVerification(&claims); err != nil {
+			return nil, fmt.Errorf("could not parse the token claims: %w", err)
+		}
+		validate := validators[claims.Issuer]
+		if validate == nil {
+			return nil, fmt.Errorf("%w: %q", errUntrustedIssuer, claims.Issuer)
+		}
+
+		return validate(ctx, token)
+	}
+}
+
+// Authenticate requires a valid bearer token, see AuthMiddlewareSetup, which has not been revoked,
+// see RevocationMiddleware, or an API key, see APIKeyMiddleware. It sets the user of the token or the key
+// in the request context, see UserContextMiddleware.
+func (rest *R) Authenticate(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		authenticated := UserContextMiddleware(rest.RevocationMiddleware(next))
+		if isAPIKeyRequest(c.Request()) {
+			return rest.APIKeyMiddleware(authenticated)(c)
+		}
+
+		return echo.WrapMiddleware(rest.AuthMiddleware.CheckJWT)(authenticated)(c)
+	}
+}
+
+// UserContextMiddleware sets the user id, the email, the name, the tenant and the issuer of the validated token claims
+// in the request context, see auth.UserIDValue, auth.UserEmailValue, auth.UserNameValue, auth.TenantValue and
+// auth.IssuerValue
+func UserContextMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		req := c.Request()
+		claims, err := auth.ClaimsValue(req.Context())
+		if err != nil {
+			return apperr.Unauthorized(apperr.CodeUnauthorized, "jwt missing").Wrap(err)
+		}
+
+		userID, err := claims.GetUserID()
+		if err != nil {
+			return apperr.Unauthorized(apperr.CodeUnauthorized, "jwt invalid").Wrap(err)
+		}
+		// tokens without an email get an empty one, the name and the tenant are only set when the token has them
+		email, err := claims.GetUserEmail()
+		if err != nil && !errors.Is(err, auth.ErrClaimNotFound) {
+			return apperr.Unauthorized(apperr.CodeUnauthorized, "jwt invalid").Wrap(err)
+		}
+		ctx := auth.WithUserEmail(auth.WithUserID(req.Context(), userID), email)
+		if name, err := claims.GetUserName(); err == nil {
+			ctx = auth.WithUserName(ctx, name)
+		}
+		if tenant, err := claims.GetTenant(); err == nil {
+			ctx = auth.WithTenant(ctx, tenant)
+		}
+		if validated, ok := req.Context().Value(jwtmiddleware.ContextKey{}).(*validator.ValidatedClaims); ok {
+			ctx = auth.WithIssuer(ctx, validated.RegisteredClaims.Issuer)
+		}
+		c.SetRequest(req.WithContext(ctx))
+
+		return next(c)
+	}
+}
+
+// ScopeAdmin is the scope of the tokens of administrators
+const ScopeAdmin = "admin"
+
+// RequireScope rejects the tokens which do not grant scope with a 403, it runs after Authenticate
+func RequireScope(scope string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			claims, err := auth.ClaimsValue(c.Request().Context())
+			if err != nil {
+				return apperr.Unauthorized(apperr.CodeUnauthorized, "jwt missing").Wrap(err)
+			}
+			if !claims.HasScope(scope) {
+				return apperr.Forbidden(apperr.CodeInsufficientScope, "token does not grant the "+scope+" scope")
+			}
+
+			return next(c)
+		}
+	}
+}
+
+// RequestIDMiddleware accepts the X-Request-ID and traceparent headers of the request or generates new ones,
+// stores them in the request context and returns them in the response headers.
+func RequestIDMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		req := c.Request()
+
+		id := req.Header.Get(echo.HeaderXRequestID)
+		if !requestid.Valid(id) {
+			id = requestid.New()
+			req.Header.Set(echo.HeaderXRequestID, id)
+		}
+
+		tp, err := requestid.ParseTraceParent(req.Header.Get(requestid.HeaderTraceParent))
+		if err != nil {
+			tp = requestid.NewTraceParent()
+		} else {
+			tp = tp.Child()
+		}
+
+		ctx := requestid.WithTraceParent(requestid.WithID(req.Context(), id), tp)
+		c.SetRequest(req.WithContext(ctx))
+		c.Response().Header().Set(echo.HeaderXRequestID, id)
+		c.Response().Header().Set(requestid.HeaderTraceParent, tp.String())
+
+		return next(c)
+	}
+}
+
+// ClientIdentityMiddleware sets the identity of the verified client certificate of mutual TLS connections
+// in the request context, see tlsconfig.ClientIdentityValue
+func ClientIdentityMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		req := c.Request()
+		if id, ok := tlsconfig.ClientIdentityFromState(req.TLS); ok {
+			c.SetRequest(req.WithContext(tlsconfig.WithClientIdentity(req.Context(), id)))
+		}
+
+		return next(c)
+	}
+}
+
+// RecoverMiddleware turns panics into 500 problem responses. The stack trace is logged with an error id,
+// the correlation id of the response, so that a reported error can be traced back to its stack.
+func (rest *R) RecoverMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) (err error) {
+		defer func() {
+			r := recover()
+			if r == nil {
+				return
+			}
+			// the handler gave up on the response on purpose
+			if r == http.ErrAbortHandler {
+				panic(r)
+			}
+
+			perr, ok := r.(error)
+			if !ok {
+				perr = fmt.Errorf("%v", r)
+			}
+			requestid.Logger(c.Request().Context(), rest.logger).Error().Err(perr).
+				Str("error_id", correlationID(c)).
+				Str("stack", string(debug.Stack())).
+				Msg("recovered from panic")
+
+			err = apperr.Internal(fmt.Errorf("panic: %w", perr))
+		}()
+
+		return next(c)
+	}
+}
+
+// SecurityHeadersMiddleware sets the HSTS, CSP, frame, referrer and content sniffing headers
+func SecurityHeadersMiddleware(cfg config.Security) echo.MiddlewareFunc {
+	return middleware.SecureWithConfig(middleware.SecureConfig{
+		// the X-XSS-Protection auditor is gone from browsers and could be abused, CSP replaces it
+		XSSProtection:         "0",
+		ContentTypeNosniff:    "nosniff",
+		XFrameOptions:         cfg.FrameOptions,
+		HSTSMaxAge:            cfg.HSTSMaxAge,
+		HSTSExcludeSubdomains: !cfg.HSTSIncludeSubdomains,
+		HSTSPreloadEnabled:    cfg.HSTSPreload,
+		ContentSecurityPolicy: cfg.ContentSecurityPolicy,
+		ReferrerPolicy:        cfg.ReferrerPolicy,
+	})
+}
+
+// CORSMiddleware allows the cross-origin requests of the configured origins, others are refused by browsers.
+// Without allowed origins it does nothing, so only same-origin requests are possible.
+func CORSMiddleware(cfg config.CORS) echo.MiddlewareFunc {
+	if len(cfg.AllowOrigins) == 0 {
+		return func(next echo.HandlerFunc) echo.HandlerFunc {
+			return next
+		}
+	}
+
+	return middleware.CORSWithConfig(middleware.CORSConfig{
+		AllowOrigins:     cfg.AllowOrigins,
+		AllowMethods:     cfg.AllowMethods,
+		AllowHeaders:     cfg.AllowHeaders,
+		ExposeHeaders:    cfg.ExposeHeaders,
+		AllowCredentials: cfg.AllowCredentials,
+		MaxAge:           int(cfg.MaxAge.Seconds()),
+	})
+}
+
+// BodyLimitMiddleware rejects request bodies larger than maxBodySize, e.g. 4M, with a 413.
+// An empty size disables the limit.
+func BodyLimitMiddleware(maxBodySize string) echo.MiddlewareFunc {
+	if maxBodySize == "" {
+		return func(next echo.HandlerFunc) echo.HandlerFunc {
+			return next
+		}
+	}
+
+	return middleware.BodyLimit(maxBodySize)
+}
@@ -2,59 +2,567 @@ package rest
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/DATA-DOG/go-sqlmock"
 	jwtmiddleware "github.com/auth0/go-jwt-middleware/v2"
 	"github.com/auth0/go-jwt-middleware/v2/validator"
+	"github.com/efimovalex/replaceme/config"
 	auth "github.com/efimovalex/replaceme/internal/auth0"
+	"github.com/efimovalex/replaceme/internal/auth0/authtest"
+	"github.com/efimovalex/replaceme/internal/requestid"
+	"github.com/efimovalex/replaceme/internal/tlsconfig"
+	"github.com/labstack/echo/v4"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestR_AuthMiddlewareSetup(t *testing.T) {
+	issuer := authtest.NewIssuer(t)
+	r, _ := NewTestRESTWithIssuer(t, issuer)
+	handler := r.Authenticate(func(c echo.Context) error {
+		ctx := c.Request().Context()
+		userID, err := auth.UserIDValue(ctx)
+		if err != nil {
+			return err
+		}
+		email, err := auth.UserEmailValue(ctx)
+		if err != nil {
+			return err
+		}
+		return c.String(http.StatusOK, userID+" "+email)
+	})
+
+	tests := []struct {
+		name          string
+		authorization string
+		code          int
+	}{
+		{"Valid token", "Bearer " + issuer.Token(t, authtest.Claims{"email": "jane.doe@replaceme.com"}), http.StatusOK},
+		{"Missing token", "", http.StatusUnauthorized},
+		{"Expired token", "Bearer " + issuer.Token(t, authtest.Claims{"exp": time.Now().Add(-time.Hour).Unix()}), http.StatusUnauthorized},
+		{"Other audience", "Bearer " + issuer.Token(t, authtest.Claims{"aud": "https://other.com"}), http.StatusUnauthorized},
+		{"Tampered token", "Bearer " + issuer.Token(t, nil) + "x", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.authorization != "" {
+				req.Header.Set(echo.HeaderAuthorization, tt.authorization)
+			}
+			w := httptest.NewRecorder()
+			c := r.Router.NewContext(req, w)
+			if err := handler(c); err != nil {
+				r.HTTPErrorHandler(err, c)
+			}
+
+			assert.Equal(t, tt.code, w.Code, "body:\n%s", w.Body.String())
+			if tt.code == http.StatusOK {
+				assert.Equal(t, authtest.Subject+" jane.doe@replaceme.com", w.Body.String())
+			}
+		})
+	}
+
+	t.Run("Unpublished key", func(t *testing.T) {
+		issuer.AddKey(authtest.NewECKey(t, "unpublished"))
+		issuer.Publish("rsa")
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set(echo.HeaderAuthorization, "Bearer "+issuer.Sign(t, "unpublished", nil))
+		w := httptest.NewRecorder()
+		assert.NoError(t, handler(r.Router.NewContext(req, w)))
+
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		checkResponseWithTestDataFile(t, w.Body.Bytes(), []string{})
+	})
+
+	t.Run("Admin route", func(t *testing.T) {
+		r, mock := NewTestRESTWithIssuer(t, issuer)
+		mock.ExpectQuery(findAPIKeysQuery).WillReturnRows(sqlmock.NewRows(apiKeyColumns))
+
+		for scope, code := range map[string]int{"admin": http.StatusOK, "openid": http.StatusForbidden} {
+			req := httptest.NewRequest(http.MethodGet, "/v1/admin/api-keys", nil)
+			req.Header.Set(echo.HeaderAuthorization, "Bearer "+issuer.Token(t, authtest.Claims{"scope": scope}))
+			w := httptest.NewRecorder()
+			r.Router.ServeHTTP(w, req)
+			assert.Equal(t, code, w.Code, "scope %s, body:\n%s", scope, w.Body.String())
+		}
+	})
+}
+
+func TestUserContextMiddleware_Claims(t *testing.T) {
+	r := NewTestREST(t)
+	handler := UserContextMiddleware(func(c echo.Context) error {
+		ctx := c.Request().Context()
+		userID, _ := auth.UserIDValue(ctx)
+		email, _ := auth.UserEmailValue(ctx)
+		name, _ := auth.UserNameValue(ctx)
+		tenant, _ := auth.TenantValue(ctx)
+		return c.String(http.StatusOK, strings.Join([]string{userID, email, name, tenant}, ","))
+	})
+
 	tests := []struct {
 		name    string
-		want    *jwtmiddleware.JWTMiddleware
-		wantErr bool
+		claims  auth.CustomClaims
+		mapping auth.ClaimMapping
+		code    int
+		body    string
 	}{
 		{
-			name: "success",
+			name:   "Default mapping",
+			claims: auth.CustomClaims{"sub": "user-1", "email": "jane.doe@replaceme.com", "name": "Jane Doe"},
+			code:   http.StatusOK,
+			body:   "user-1,jane.doe@replaceme.com,Jane Doe,",
+		},
+		{
+			name:    "Tenant",
+			claims:  auth.CustomClaims{"sub": "user-1", "https://replaceme.com/app_metadata": map[string]interface{}{"tenant": "acme"}},
+			mapping: auth.ClaimMapping{Tenant: "https://replaceme.com/app_metadata.tenant"},
+			code:    http.StatusOK,
+			body:    "user-1,,,acme",
+		},
+		{
+			name:   "Unmapped claims",
+			claims: auth.CustomClaims{"sub": "user-1"},
+			code:   http.StatusUnauthorized,
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			r := NewTestREST(t)
-			got, err := r.AuthMiddlewareSetup(auth.New("http://some-domain", []string{"some-audience"}))
-			if (err != nil) != tt.wantErr {
-				t.Errorf("R.AuthMiddlewareSetup() error = %v, wantErr %v", err, tt.wantErr)
-				return
+			if tt.code == http.StatusOK {
+				require.NoError(t, tt.claims.Map(tt.mapping))
+			}
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req = req.WithContext(context.WithValue(req.Context(), jwtmiddleware.ContextKey{}, &validator.ValidatedClaims{CustomClaims: &tt.claims}))
+			w := httptest.NewRecorder()
+			c := r.Router.NewContext(req, w)
+			if err := handler(c); err != nil {
+				r.HTTPErrorHandler(err, c)
+			}
+
+			assert.Equal(t, tt.code, w.Code, w.Body.String())
+			if tt.code == http.StatusOK {
+				assert.Equal(t, tt.body, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestR_AuthMiddlewareSetup_Issuers(t *testing.T) {
+	// two Auth0 tenants, each with its own keys and audience
+	tenantA := authtest.NewIssuer(t, authtest.NewECKey(t, "a"))
+	tenantB := authtest.NewIssuer(t, authtest.NewRSAKey(t, "b"))
+	untrusted := authtest.NewIssuer(t)
+
+	r := NewTestREST(t)
+	a := auth.New(
+		auth.Provider{Issuer: tenantA.Issuer(), Audience: []string{authtest.Audience}},
+		auth.Provider{Issuer: tenantB.Issuer(), Audience: []string{"https://api.replaceme.com"}, JWKSURL: tenantB.JWKSURL(), Algorithms: []string{"RS256"}},
+	)
+	a.Issuer = r.Tokens
+	mw, err := r.AuthMiddlewareSetup(a)
+	require.NoError(t, err)
+	handler := echo.WrapMiddleware(mw.CheckJWT)(UserContextMiddleware(func(c echo.Context) error {
+		issuer, err := auth.IssuerValue(c.Request().Context())
+		if err != nil {
+			return err
+		}
+		return c.String(http.StatusOK, issuer)
+	}))
+	firstParty, err := r.Tokens.Issue("user-1", nil)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name   string
+		token  string
+		issuer string
+		code   int
+	}{
+		{"Tenant A", tenantA.Token(t, nil), tenantA.Issuer(), http.StatusOK},
+		{"Tenant B", tenantB.Token(t, authtest.Claims{"aud": "https://api.replaceme.com"}), tenantB.Issuer(), http.StatusOK},
+		{"Audience of another tenant", tenantB.Token(t, nil), "", http.StatusUnauthorized},
+		{"First-party", firstParty.Raw, r.Tokens.Issuer(), http.StatusOK},
+		{"Untrusted", untrusted.Token(t, nil), "", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set(echo.HeaderAuthorization, "Bearer "+tt.token)
+			w := httptest.NewRecorder()
+
+			assert.NoError(t, handler(r.Router.NewContext(req, w)))
+			assert.Equal(t, tt.code, w.Code, w.Body.String())
+			if tt.code == http.StatusOK {
+				assert.Equal(t, tt.issuer, w.Body.String())
+			}
+		})
+	}
+
+	t.Run("Issuer trusted twice", func(t *testing.T) {
+		a := auth.New(auth.Auth0("tenant-a.eu.auth0.com", "https://replaceme.com"), auth.Auth0("tenant-a.eu.auth0.com", "https://api.replaceme.com"))
+		_, err := r.AuthMiddlewareSetup(a)
+		assert.EqualError(t, err, `issuer "https://tenant-a.eu.auth0.com/" is trusted twice`)
+	})
+}
+
+func TestR_AuthMiddlewareSetup_Introspection(t *testing.T) {
+	// an issuer of opaque tokens, only opaque-1 is active
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		res := map[string]interface{}{"active": false}
+		if r.PostFormValue("token") == "opaque-1" {
+			res = map[string]interface{}{"active": true, "sub": "user-1", "aud": "https://replaceme.com", "exp": time.Now().Add(time.Hour).Unix()}
+		}
+		_ = json.NewEncoder(w).Encode(res)
+	}))
+	defer endpoint.Close()
+	jwtIssuer := authtest.NewIssuer(t)
+
+	r := NewTestREST(t)
+	a := auth.New(
+		auth.Provider{Issuer: "https://idp.replaceme.com/", Audience: []string{"https://replaceme.com"}, Introspection: &auth.Introspection{URL: endpoint.URL}},
+		auth.Provider{Issuer: jwtIssuer.Issuer(), Audience: []string{authtest.Audience}},
+	)
+	a.Issuer = r.Tokens
+	mw, err := r.AuthMiddlewareSetup(a)
+	require.NoError(t, err)
+	r.AuthMiddleware = mw
+	handler := r.Authenticate(func(c echo.Context) error {
+		ctx := c.Request().Context()
+		userID, _ := auth.UserIDValue(ctx)
+		issuer, _ := auth.IssuerValue(ctx)
+		return c.String(http.StatusOK, userID+" "+issuer)
+	})
+
+	tests := []struct {
+		name  string
+		token string
+		code  int
+		body  string
+	}{
+		{"Active opaque token", "opaque-1", http.StatusOK, "user-1 https://idp.replaceme.com/"},
+		{"Inactive opaque token", "opaque-2", http.StatusUnauthorized, ""},
+		{"JWT of another issuer", jwtIssuer.Token(t, nil), http.StatusOK, authtest.Subject + " " + jwtIssuer.Issuer()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set(echo.HeaderAuthorization, "Bearer "+tt.token)
+			w := httptest.NewRecorder()
+			assert.NoError(t, handler(r.Router.NewContext(req, w)))
+
+			assert.Equal(t, tt.code, w.Code, w.Body.String())
+			if tt.code == http.StatusOK {
+				assert.Equal(t, tt.body, w.Body.String())
 			}
-			assert.NotNil(t, got)
+		})
+	}
+}
+
+func TestR_AuthMiddlewareSetup_OpaqueIssuer(t *testing.T) {
+	// two issuers with an introspection endpoint, each records the tokens it was sent
+	var calls []string
+	introspection := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls = append(calls, name+" "+r.PostFormValue("token"))
+			res := map[string]interface{}{"active": true, "sub": "user-1", "aud": "https://replaceme.com", "exp": time.Now().Add(time.Hour).Unix()}
+			_ = json.NewEncoder(w).Encode(res)
+		}))
+	}
+	a := introspection("a")
+	defer a.Close()
+	b := introspection("b")
+	defer b.Close()
+	providers := func(opaqueA, opaqueB bool) *auth.Auth {
+		return auth.New(
+			auth.Provider{Issuer: "https://a.replaceme.com/", Audience: []string{"https://replaceme.com"}, Introspection: &auth.Introspection{URL: a.URL, Opaque: opaqueA}},
+			auth.Provider{Issuer: "https://b.replaceme.com/", Audience: []string{"https://replaceme.com"}, Introspection: &auth.Introspection{URL: b.URL, Opaque: opaqueB}},
+		)
+	}
+
+	tests := []struct {
+		name      string
+		opaqueA   bool
+		opaqueB   bool
+		code      int
+		wantCalls []string
+	}{
+		{"No opaque token issuer", false, false, http.StatusUnauthorized, nil},
+		{"Opaque token issuer", false, true, http.StatusOK, []string{"b opaque-1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls = nil
+			r := NewTestREST(t)
+			mw, err := r.AuthMiddlewareSetup(providers(tt.opaqueA, tt.opaqueB))
+			require.NoError(t, err)
+			r.AuthMiddleware = mw
+			handler := r.Authenticate(func(c echo.Context) error {
+				issuer, _ := auth.IssuerValue(c.Request().Context())
+				return c.String(http.StatusOK, issuer)
+			})
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set(echo.HeaderAuthorization, "Bearer opaque-1")
+			w := httptest.NewRecorder()
+			assert.NoError(t, handler(r.Router.NewContext(req, w)))
+
+			assert.Equal(t, tt.code, w.Code, w.Body.String())
+			assert.Equal(t, tt.wantCalls, calls)
+		})
+	}
+
+	t.Run("Two opaque token issuers", func(t *testing.T) {
+		_, err := NewTestREST(t).AuthMiddlewareSetup(providers(true, true))
+		assert.EqualError(t, err, `issuers "https://a.replaceme.com/" and "https://b.replaceme.com/" both introspect the opaque tokens`)
+	})
+}
+
+func TestRequestIDMiddleware(t *testing.T) {
+	const traceParent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+	tests := []struct {
+		name          string
+		requestID     string
+		traceParent   string
+		wantRequestID string
+		wantTraceID   string
+	}{
+		{
+			name:          "accepts client ids",
+			requestID:     "some-request-id",
+			traceParent:   traceParent,
+			wantRequestID: "some-request-id",
+			wantTraceID:   "4bf92f3577b34da6a3ce929d0e0e4736",
+		},
+		{
+			name: "generates missing ids",
+		},
+		{
+			name:        "replaces invalid ids",
+			requestID:   "not a valid id",
+			traceParent: "not-a-traceparent",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var ctxID string
+			var ctxTP requestid.TraceParent
+			handler := RequestIDMiddleware(func(c echo.Context) error {
+				var err error
+				ctxID, err = requestid.IDValue(c.Request().Context())
+				require.NoError(t, err)
+				ctxTP, err = requestid.TraceParentValue(c.Request().Context())
+				require.NoError(t, err)
 
-			handlerFunc := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-				w.WriteHeader(http.StatusOK)
+				return c.NoContent(http.StatusNoContent)
 			})
 
-			// happy path: set claims in request context
-			claimsWithWriteAll := &validator.ValidatedClaims{
-				CustomClaims: &auth.CustomClaims{
-					"sub":                       "auth0|1a2b3c4d5e6f7g8h9i0a1b2c",
-					"https://some-domain/email": "some-email@some-domain.com",
-				},
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.requestID != "" {
+				req.Header.Set(echo.HeaderXRequestID, tt.requestID)
+			}
+			if tt.traceParent != "" {
+				req.Header.Set(requestid.HeaderTraceParent, tt.traceParent)
+			}
+			w := httptest.NewRecorder()
+			require.NoError(t, handler(echo.New().NewContext(req, w)))
+
+			assert.True(t, requestid.Valid(ctxID))
+			assert.Equal(t, ctxID, w.Header().Get(echo.HeaderXRequestID))
+			assert.Equal(t, ctxTP.String(), w.Header().Get(requestid.HeaderTraceParent))
+			if tt.wantRequestID != "" {
+				assert.Equal(t, tt.wantRequestID, ctxID)
+			}
+			if tt.wantTraceID != "" {
+				assert.Equal(t, tt.wantTraceID, ctxTP.TraceID)
+				assert.NotEqual(t, traceParent, ctxTP.String(), "a new span id is expected")
 			}
-			assert.NoError(t, claimsWithWriteAll.CustomClaims.Validate(context.Background()))
+		})
+	}
+}
+
+func TestClientIdentityMiddleware(t *testing.T) {
+	e := echo.New()
+	e.Use(ClientIdentityMiddleware)
+	e.GET("/", func(c echo.Context) error {
+		id, ok := tlsconfig.ClientIdentityValue(c.Request().Context())
+		if !ok {
+			return c.String(http.StatusOK, "anonymous")
+		}
+
+		return c.String(http.StatusOK, id.Subject)
+	})
+
+	cert := &x509.Certificate{
+		Subject:      pkix.Name{CommonName: "billing", Organization: []string{"replaceme"}},
+		SerialNumber: big.NewInt(3),
+		DNSNames:     []string{"billing.replaceme.com"},
+	}
+	tests := []struct {
+		name     string
+		state    *tls.ConnectionState
+		expected string
+	}{
+		{name: "Plain HTTP", expected: "anonymous"},
+		{name: "No client certificate", state: &tls.ConnectionState{}, expected: "anonymous"},
+		{name: "Unverified client certificate", state: &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}, expected: "anonymous"},
+		{name: "Verified client certificate", state: &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}, VerifiedChains: [][]*x509.Certificate{{cert}}}, expected: "CN=billing,O=replaceme"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.TLS = tt.state
+			w := httptest.NewRecorder()
+			e.ServeHTTP(w, req)
+
+			assert.Equal(t, tt.expected, w.Body.String())
+		})
+	}
+}
+
+func TestR_RecoverMiddleware(t *testing.T) {
+	r := NewTestREST(t)
+	e := echo.New()
+	e.HTTPErrorHandler = r.HTTPErrorHandler
+	e.Use(RequestIDMiddleware, r.RecoverMiddleware)
+	e.GET("/panic", func(c echo.Context) error {
+		var m map[string]int
+		m["boom"]++
+
+		return nil
+	})
+	e.GET("/abort", func(c echo.Context) error {
+		panic(http.ErrAbortHandler)
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/panic", nil)
+	req.Header.Set(echo.HeaderXRequestID, "some-request-id")
+	w := httptest.NewRecorder()
+	e.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	checkResponseWithTestDataFile(t, w.Body.Bytes(), []string{})
+
+	assert.PanicsWithValue(t, http.ErrAbortHandler, func() {
+		e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/abort", nil))
+	})
+}
+
+func TestSecurityHeadersMiddleware(t *testing.T) {
+	cfg := config.Security{
+		HSTSMaxAge:            31536000,
+		HSTSIncludeSubdomains: true,
+		ContentSecurityPolicy: "default-src 'none'; frame-ancestors 'none'",
+		FrameOptions:          "DENY",
+		ReferrerPolicy:        "no-referrer",
+	}
+	e := echo.New()
+	e.Use(SecurityHeadersMiddleware(cfg))
+	e.GET("/", func(c echo.Context) error { return c.NoContent(http.StatusNoContent) })
+
+	t.Run("Plain HTTP", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		e.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+
+		assert.Equal(t, "default-src 'none'; frame-ancestors 'none'", w.Header().Get(echo.HeaderContentSecurityPolicy))
+		assert.Equal(t, "DENY", w.Header().Get(echo.HeaderXFrameOptions))
+		assert.Equal(t, "nosniff", w.Header().Get(echo.HeaderXContentTypeOptions))
+		assert.Equal(t, "no-referrer", w.Header().Get(echo.HeaderReferrerPolicy))
+		assert.Empty(t, w.Header().Get(echo.HeaderStrictTransportSecurity), "HSTS is only sent over TLS")
+	})
+	t.Run("Behind a TLS proxy", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set(echo.HeaderXForwardedProto, "https")
+		w := httptest.NewRecorder()
+		e.ServeHTTP(w, req)
 
-			req := httptest.NewRequest("GET", "http://some-test-url", nil)
-			ctx := context.WithValue(req.Context(), jwtmiddleware.ContextKey{}, claimsWithWriteAll)
-			req = req.WithContext(ctx)
+		assert.Equal(t, "max-age=31536000; includeSubdomains", w.Header().Get(echo.HeaderStrictTransportSecurity))
+	})
+}
+
+func TestCORSMiddleware(t *testing.T) {
+	cfg := config.CORS{
+		AllowOrigins:     []string{"https://app.replaceme.com", "https://*.admin.replaceme.com"},
+		AllowMethods:     []string{http.MethodGet, http.MethodPost},
+		AllowHeaders:     []string{echo.HeaderAuthorization, echo.HeaderContentType},
+		ExposeHeaders:    []string{HeaderAPIVersion},
+		AllowCredentials: true,
+		MaxAge:           10 * time.Minute,
+	}
+
+	tests := []struct {
+		name          string
+		cfg           config.CORS
+		method        string
+		origin        string
+		expectedAllow string
+	}{
+		{name: "Allowed origin", cfg: cfg, method: http.MethodGet, origin: "https://app.replaceme.com", expectedAllow: "https://app.replaceme.com"},
+		{name: "Allowed origin pattern", cfg: cfg, method: http.MethodGet, origin: "https://eu.admin.replaceme.com", expectedAllow: "https://eu.admin.replaceme.com"},
+		{name: "Preflight", cfg: cfg, method: http.MethodOptions, origin: "https://app.replaceme.com", expectedAllow: "https://app.replaceme.com"},
+		{name: "Other origin", cfg: cfg, method: http.MethodGet, origin: "https://evil.com"},
+		{name: "No allowed origins", cfg: config.CORS{}, method: http.MethodGet, origin: "https://app.replaceme.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := echo.New()
+			e.Use(CORSMiddleware(tt.cfg))
+			e.GET("/", func(c echo.Context) error { return c.NoContent(http.StatusNoContent) })
+
+			req := httptest.NewRequest(tt.method, "/", nil)
+			req.Header.Set(echo.HeaderOrigin, tt.origin)
+			req.Header.Set(echo.HeaderAccessControlRequestMethod, http.MethodGet)
 			w := httptest.NewRecorder()
+			e.ServeHTTP(w, req)
 
-			got.CheckJWT(handlerFunc).ServeHTTP(w, req)
-			assert.Equal(t, http.StatusUnauthorized, w.Code, "body:\n%s", w.Body.String())
+			assert.Equal(t, tt.expectedAllow, w.Header().Get(echo.HeaderAccessControlAllowOrigin))
+			if tt.expectedAllow == "" {
+				assert.Empty(t, w.Header().Get(echo.HeaderAccessControlAllowCredentials))
 
-			checkResponseWithTestDataFile(t, w.Body.Bytes(), []string{})
+				return
+			}
+			assert.Equal(t, "true", w.Header().Get(echo.HeaderAccessControlAllowCredentials))
+			if tt.method == http.MethodOptions {
+				assert.Equal(t, "GET,POST", w.Header().Get(echo.HeaderAccessControlAllowMethods))
+				assert.Equal(t, "Authorization,Content-Type", w.Header().Get(echo.HeaderAccessControlAllowHeaders))
+				assert.Equal(t, "600", w.Header().Get(echo.HeaderAccessControlMaxAge))
+			} else {
+				assert.Equal(t, HeaderAPIVersion, w.Header().Get(echo.HeaderAccessControlExposeHeaders))
+			}
 		})
 	}
 }
+
+func TestBodyLimitMiddleware(t *testing.T) {
+	r := NewTestREST(t)
+	e := echo.New()
+	e.HTTPErrorHandler = r.HTTPErrorHandler
+	e.Use(BodyLimitMiddleware("16B"))
+	e.POST("/", func(c echo.Context) error {
+		_, err := ioutil.ReadAll(c.Request().Body)
+		if err != nil {
+			return err
+		}
+
+		return c.NoContent(http.StatusNoContent)
+	})
+
+	w := httptest.NewRecorder()
+	e.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"small":true}`)))
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	w = httptest.NewRecorder()
+	e.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"too":"large","for":"the limit"}`)))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+	checkResponseWithTestDataFile(t, w.Body.Bytes(), []string{"correlation_id"})
+}
@@ -0,0 +1,93 @@
+package rest
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// ctxKeyCodec is the echo context key of the codec negotiated for the response
+const ctxKeyCodec = "rest.codec"
+
+// NegotiateMiddleware selects the response codec from the Accept header before the handler runs,
+// so that requests the service cannot answer are rejected with a 406 without side effects.
+// The media types of lists only, e.g. CSV, are only negotiated for the routes marked by listRoute.
+func (rest *R) NegotiateMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		lists := rest.listRoutes[c.Request().Method+" "+c.Path()]
+		codec, ok := rest.codecs.Negotiate(c.Request().Header.Get(echo.HeaderAccept), lists)
+		if !ok {
+			return errNotAcceptable(c)
+		}
+		c.Set(ctxKeyCodec, codec)
+
+		return next(c)
+	}
+}
+
+// listRoute marks a route as responding with a list, see NegotiateMiddleware
+func (rest *R) listRoute(route *echo.Route) {
+	rest.listRoutes[route.Method+" "+route.Path] = true
+}
+
+// errNotAcceptable is the error of requests accepting none of the supported media types
+func errNotAcceptable(c echo.Context) error {
+	return echo.NewHTTPError(http.StatusNotAcceptable, "no supported media type in "+c.Request().Header.Get(echo.HeaderAccept))
+}
+
+// Binder binds path and query params like the echo DefaultBinder, and decodes request bodies
+// with the codec registered for their Content-Type.
+type Binder struct {
+	echo.DefaultBinder
+	codecs *Codecs
+}
+
+// NewBinder creates a Binder decoding request bodies with codecs
+func NewBinder(codecs *Codecs) *Binder {
+	return &Binder{codecs: codecs}
+}
+
+// Bind binds the path params, the query params of GET, HEAD and DELETE requests, then the body into i
+func (b *Binder) Bind(i interface{}, c echo.Context) error {
+	if err := b.BindPathParams(c, i); err != nil {
+		return err
+	}
+
+	method := c.Request().Method
+	if method == http.MethodGet || method == http.MethodHead || method == http.MethodDelete {
+		if err := b.BindQueryParams(c, i); err != nil {
+			return err
+		}
+	}
+
+	return b.BindBody(c, i)
+}
+
+// BindBody decodes the request body into i, forms are bound by the echo DefaultBinder
+func (b *Binder) BindBody(c echo.Context, i interface{}) error {
+	req := c.Request()
+	if req.ContentLength == 0 {
+		return nil
+	}
+
+	ctype := req.Header.Get(echo.HeaderContentType)
+	if strings.HasPrefix(ctype, echo.MIMEApplicationForm) || strings.HasPrefix(ctype, echo.MIMEMultipartForm) {
+		return b.DefaultBinder.BindBody(c, i)
+	}
+
+	codec, ok := b.codecs.Lookup(ctype)
+	if !ok {
+		return echo.ErrUnsupportedMediaType
+	}
+	if err := codec.Decode(req.Body, i); err != nil {
+		if errors.Is(err, ErrNotDecodable) {
+			return echo.ErrUnsupportedMediaType
+		}
+
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error()).SetInternal(err)
+	}
+
+	return nil
+}
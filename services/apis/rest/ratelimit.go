@@ -0,0 +1,92 @@
+package rest
+
+import (
+	"context"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/efimovalex/replaceme/adapters/redisdb"
+	"github.com/efimovalex/replaceme/config"
+	"github.com/efimovalex/replaceme/internal/apperr"
+	auth "github.com/efimovalex/replaceme/internal/auth0"
+	"github.com/efimovalex/replaceme/internal/requestid"
+	"github.com/labstack/echo/v4"
+)
+
+// Rate limit response headers, see https://datatracker.ietf.org/doc/draft-ietf-httpapi-ratelimit-headers/
+const (
+	HeaderRateLimitLimit     = "RateLimit-Limit"
+	HeaderRateLimitRemaining = "RateLimit-Remaining"
+	HeaderRateLimitReset     = "RateLimit-Reset"
+	HeaderRetryAfter         = "Retry-After"
+)
+
+// RateLimiter is the interface for the distributed rate limit store
+type RateLimiter interface {
+	Allow(ctx context.Context, key string, l redisdb.RateLimit) (*redisdb.RateLimitResult, error)
+}
+
+// RateLimitMiddleware limits the requests of a route group per client.
+// Clients are identified by RateLimitKey. When the limiter fails, requests are let through
+// if the policy fails open, rejected with a 503 otherwise.
+func (rest *R) RateLimitMiddleware(group string, cfg config.RateLimit) echo.MiddlewareFunc {
+	limit := redisdb.RateLimit{
+		Algorithm: cfg.Algorithm,
+		Limit:     cfg.Limit,
+		Period:    cfg.Period,
+		Burst:     cfg.Burst,
+	}
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		if !cfg.Enable || rest.RateLimiter == nil {
+			return next
+		}
+
+		return func(c echo.Context) error {
+			ctx := c.Request().Context()
+			res, err := rest.RateLimiter.Allow(ctx, group+":"+RateLimitKey(c), limit)
+			if err != nil {
+				requestid.Logger(ctx, rest.logger).Error().Err(err).Str("group", group).Msg("rate limiter unavailable")
+				if cfg.FailOpen {
+					return next(c)
+				}
+
+				return apperr.Unavailable(apperr.CodeUnavailable, "rate limiter unavailable").Wrap(err)
+			}
+
+			h := c.Response().Header()
+			h.Set(HeaderRateLimitLimit, strconv.Itoa(res.Limit))
+			h.Set(HeaderRateLimitRemaining, strconv.Itoa(res.Remaining))
+			h.Set(HeaderRateLimitReset, seconds(res.ResetAfter))
+			if !res.Allowed {
+				h.Set(HeaderRetryAfter, seconds(res.RetryAfter))
+
+				return apperr.RateLimited(apperr.CodeRateLimited, "too many requests")
+			}
+
+			return next(c)
+		}
+	}
+}
+
+// RateLimitKey identifies the client of the request: the API key or the user ID validated by Authenticate, else the
+// client IP. Unvalidated credentials are not keys, any client could send them to get fresh limits.
+func RateLimitKey(c echo.Context) string {
+	ctx := c.Request().Context()
+	if userID, err := auth.UserIDValue(ctx); err == nil {
+		if issuer, _ := auth.IssuerValue(ctx); issuer == APIKeyIssuer {
+			return "apikey:" + strings.TrimPrefix(userID, apiKeySubjectPrefix)
+		}
+
+		return "user:" + userID
+	}
+
+	return "ip:" + c.RealIP()
+}
+
+// seconds formats d as whole seconds, rounded up
+func seconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
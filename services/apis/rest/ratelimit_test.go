@@ -0,0 +1,165 @@
+package rest
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/efimovalex/replaceme/adapters/redisdb"
+	"github.com/efimovalex/replaceme/config"
+	auth "github.com/efimovalex/replaceme/internal/auth0"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+type rateLimiterMock struct {
+	keys   []string
+	result *redisdb.RateLimitResult
+	err    error
+}
+
+func (m *rateLimiterMock) Allow(ctx context.Context, key string, l redisdb.RateLimit) (*redisdb.RateLimitResult, error) {
+	m.keys = append(m.keys, key)
+
+	return m.result, m.err
+}
+
+func TestR_RateLimitMiddleware(t *testing.T) {
+	cfg := config.RateLimit{Enable: true, Algorithm: redisdb.SlidingWindow, Limit: 10, Period: time.Minute, FailOpen: true}
+
+	tests := []struct {
+		name               string
+		cfg                config.RateLimit
+		limiter            *rateLimiterMock
+		expectedStatusCode int
+		expectedHeaders    map[string]string
+	}{
+		{
+			name:               "Allowed",
+			cfg:                cfg,
+			limiter:            &rateLimiterMock{result: &redisdb.RateLimitResult{Allowed: true, Limit: 10, Remaining: 9, ResetAfter: 59500 * time.Millisecond}},
+			expectedStatusCode: http.StatusOK,
+			expectedHeaders:    map[string]string{HeaderRateLimitLimit: "10", HeaderRateLimitRemaining: "9", HeaderRateLimitReset: "60", HeaderRetryAfter: ""},
+		},
+		{
+			name:               "Rate limited",
+			cfg:                cfg,
+			limiter:            &rateLimiterMock{result: &redisdb.RateLimitResult{Limit: 10, RetryAfter: 1500 * time.Millisecond, ResetAfter: time.Minute}},
+			expectedStatusCode: http.StatusTooManyRequests,
+			expectedHeaders:    map[string]string{HeaderRateLimitLimit: "10", HeaderRateLimitRemaining: "0", HeaderRateLimitReset: "60", HeaderRetryAfter: "2"},
+		},
+		{
+			name:               "Redis down fails open",
+			cfg:                cfg,
+			limiter:            &rateLimiterMock{err: errors.New("dial tcp: connection refused")},
+			expectedStatusCode: http.StatusOK,
+			expectedHeaders:    map[string]string{HeaderRateLimitLimit: ""},
+		},
+		{
+			name: "Redis down fails closed",
+			cfg: func() config.RateLimit {
+				cfg := cfg
+				cfg.FailOpen = false
+
+				return cfg
+			}(),
+			limiter:            &rateLimiterMock{err: errors.New("dial tcp: connection refused")},
+			expectedStatusCode: http.StatusServiceUnavailable,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewTestREST(t)
+			r.RateLimiter = tt.limiter
+			r.cfg.RateLimit = tt.cfg
+			r.SetupRouter()
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			w := httptest.NewRecorder()
+			r.Router.ServeHTTP(w, req)
+
+			assert.Equal(t, tt.expectedStatusCode, w.Code, "body:\n%s", w.Body.String())
+			for k, v := range tt.expectedHeaders {
+				assert.Equal(t, v, w.Header().Get(k), k)
+			}
+			assert.Equal(t, []string{"default:ip:192.0.2.1"}, tt.limiter.keys)
+			checkResponseWithTestDataFile(t, w.Body.Bytes(), []string{"correlation_id"})
+		})
+	}
+
+	t.Run("Disabled", func(t *testing.T) {
+		r := NewTestREST(t)
+		limiter := &rateLimiterMock{}
+		r.RateLimiter = limiter
+		r.SetupRouter()
+
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		w := httptest.NewRecorder()
+		r.Router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Empty(t, limiter.keys)
+	})
+}
+
+func TestR_RateLimitMiddleware_APIKey(t *testing.T) {
+	r, mock := NewTestRESTWithMock(t)
+	limiter := &rateLimiterMock{result: &redisdb.RateLimitResult{Allowed: true, Limit: 10, Remaining: 9}}
+	r.RateLimiter = limiter
+	r.cfg.UsersRateLimit = config.RateLimit{Enable: true, Algorithm: redisdb.SlidingWindow, Limit: 10, Period: time.Minute}
+	r.PermissionCache = newPermissionCacheMock()
+	r.SetupRouter()
+	mock.ExpectQuery(findAPIKeyPrefixQuery).WithArgs(testAPIKey.prefix).WillReturnRows(apiKeyRows("users:read", nil))
+	mock.ExpectExec(updateAPIKeyUseQuery).WithArgs(1).WillReturnResult(sqlmock.NewResult(0, 1))
+
+	req := httptest.NewRequest(http.MethodGet, "/v1/users/1", nil)
+	req.Header.Set(echo.HeaderAuthorization, "ApiKey "+testAPIKey.key)
+	w := httptest.NewRecorder()
+	r.Router.ServeHTTP(w, req)
+
+	assert.Equal(t, "10", w.Header().Get(HeaderRateLimitLimit), w.Body.String())
+	assert.Equal(t, []string{"users:apikey:" + testAPIKey.prefix}, limiter.keys, "the validated key is limited, not its IP")
+}
+
+func TestRateLimitKey(t *testing.T) {
+	e := echo.New()
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	assert.Equal(t, "ip:192.0.2.1", RateLimitKey(e.NewContext(req, nil)))
+
+	req.Header.Set(echo.HeaderAuthorization, "ApiKey rk_1a2b3c4d_secret")
+	assert.Equal(t, "ip:192.0.2.1", RateLimitKey(e.NewContext(req, nil)), "unvalidated credentials are not keys")
+
+	req = req.WithContext(auth.WithUserID(req.Context(), "auth0|1a2b3c4d5e6f7g8h9i0a1b2c"))
+	assert.Equal(t, "user:auth0|1a2b3c4d5e6f7g8h9i0a1b2c", RateLimitKey(e.NewContext(req, nil)))
+
+	req = req.WithContext(auth.WithIssuer(auth.WithUserID(req.Context(), "apikey|rk_1a2b3c4d"), APIKeyIssuer))
+	assert.Equal(t, "apikey:rk_1a2b3c4d", RateLimitKey(e.NewContext(req, nil)))
+}
+
+func TestIPExtractor(t *testing.T) {
+	tests := []struct {
+		name       string
+		proxies    []string
+		remoteAddr string
+		expectedIP string
+	}{
+		{name: "No proxy", remoteAddr: "198.51.100.1:1234", expectedIP: "198.51.100.1"},
+		{name: "Trusted proxy", proxies: []string{"10.0.0.0/8"}, remoteAddr: "10.0.0.1:1234", expectedIP: "203.0.113.7"},
+		{name: "Untrusted proxy", proxies: []string{"10.0.0.0/8"}, remoteAddr: "198.51.100.1:1234", expectedIP: "198.51.100.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			req.Header.Set(echo.HeaderXForwardedFor, "203.0.113.7")
+			req.Header.Set(echo.HeaderXRealIP, "203.0.113.8")
+
+			assert.Equal(t, tt.expectedIP, ipExtractor(tt.proxies)(req))
+		})
+	}
+}
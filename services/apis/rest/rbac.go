@@ -0,0 +1,504 @@
+package rest
+
+import (
+	"context"
+	"encoding/xml"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/efimovalex/replaceme/adapters/postgres"
+	"github.com/efimovalex/replaceme/adapters/redisdb"
+	"github.com/efimovalex/replaceme/internal/apperr"
+	"github.com/efimovalex/replaceme/internal/audit"
+	auth "github.com/efimovalex/replaceme/internal/auth0"
+	"github.com/efimovalex/replaceme/internal/requestid"
+	"github.com/labstack/echo/v4"
+)
+
+// PermissionCache caches the effective permissions of the users, see adapters/redisdb
+type PermissionCache interface {
+	// GetPermissions returns the cached permissions of the user of the issuer, nil if not found
+	GetPermissions(ctx context.Context, issuer, userID string) ([]string, error)
+	// LeasePermissions is called before the permissions are loaded, they are cached under the lease unless they
+	// were invalidated meanwhile. It returns nil if they are already being loaded.
+	LeasePermissions(ctx context.Context, issuer, userID string) (*redisdb.PermissionsLease, error)
+	SetPermissions(ctx context.Context, issuer, userID string, permissions []string, roleIDs []int, lease *redisdb.PermissionsLease, ttl time.Duration) error
+	InvalidateUserPermissions(ctx context.Context, issuer string, userIDs ...string) error
+	InvalidateRolePermissions(ctx context.Context, roleIDs ...int) error
+}
+
+// RoleRequest is the request body of the create role endpoint
+type RoleRequest struct {
+	XMLName     xml.Name `json:"-" xml:"role"`
+	Name        string   `json:"name" xml:"name" validate:"required,max=100" example:"editor"`
+	Description string   `json:"description" xml:"description" validate:"max=255" example:"Edits the users"`
+	// Permissions are granted to the users holding the role
+	Permissions []string `json:"permissions" xml:"permissions>permission" validate:"max=100,dive,required,max=100,excludesall= " example:"users:write"`
+}
+
+// UpdateRoleRequest are the path params and the request body of the update role endpoint
+type UpdateRoleRequest struct {
+	ID int `json:"-" xml:"-" param:"id" validate:"min=1"`
+	RoleRequest
+}
+
+// RolePathRequest are the path params of the role endpoints
+type RolePathRequest struct {
+	ID int `param:"id" validate:"min=1"`
+}
+
+// UserRolesPathRequest are the path and query params of the list user roles endpoint
+type UserRolesPathRequest struct {
+	// UserID is the subject of the tokens of the user
+	UserID string `param:"user_id" validate:"required,max=255"`
+	// Issuer is the issuer of the tokens of the user, this service by default. The subjects of two issuers can be
+	// equal, they are different users.
+	Issuer string `query:"issuer" validate:"max=255"`
+}
+
+// UserRolePathRequest are the path and query params of the assign and unassign role endpoints
+type UserRolePathRequest struct {
+	UserID string `param:"user_id" validate:"required,max=255"`
+	RoleID int    `param:"role_id" validate:"min=1"`
+	Issuer string `query:"issuer" validate:"max=255"`
+}
+
+// Role is the public representation of a role
+type Role struct {
+	XMLName     xml.Name  `json:"-" xml:"role"`
+	ID          int       `json:"id" xml:"id"`
+	Name        string    `json:"name" xml:"name" example:"editor"`
+	Description string    `json:"description" xml:"description"`
+	Permissions []string  `json:"permissions" xml:"permissions>permission" example:"users:write"`
+	CreatedAt   time.Time `json:"created_at" xml:"created_at"`
+}
+
+// ListRoles returns the roles
+// @Summary [get] /admin/roles
+// @Description Returns the roles with their permissions, oldest first. Requires the admin scope.
+// @Tags admin
+// @Accept  json
+// @Produce json,application/msgpack,application/cbor,xml
+// @Security BearerAuth
+// @Success 200 {array} Role "Roles"
+// @Failure 401 {object} Problem "Invalid or revoked access token"
+// @Failure 403 {object} Problem "Missing admin scope"
+// @Failure 500 {object} Problem "Internal server error"
+// @Router /admin/roles [get]
+func (rest *R) ListRoles(c echo.Context) error {
+	roles, err := rest.DB.FindRoles(c.Request().Context())
+	if err != nil {
+		return err
+	}
+
+	return rest.Render(c, http.StatusOK, newRoles(roles))
+}
+
+// CreateRole creates a role
+// @Summary [post] /admin/roles
+// @Description Creates a role granting the permissions to the users it is assigned to. Requires the admin scope.
+// @Tags admin
+// @Accept  json,application/msgpack,application/cbor,xml
+// @Produce json,application/msgpack,application/cbor,xml
+// @Security BearerAuth
+// @Param role body RoleRequest true "Role"
+// @Param Idempotency-Key header string false "Key making retries of the request safe"
+// @Success 201 {object} Role "Role"
+// @Failure 400 {object} Problem "Invalid request JSON"
+// @Failure 401 {object} Problem "Invalid or revoked access token"
+// @Failure 403 {object} Problem "Missing admin scope"
+// @Failure 409 {object} Problem "Role name already taken"
+// @Failure 422 {object} Problem "Params validation error"
+// @Failure 500 {object} Problem "Internal server error"
+// @Router /admin/roles [post]
+func (rest *R) CreateRole(c echo.Context) error {
+	var req RoleRequest
+	if err := rest.Bind(c, &req); err != nil {
+		return err
+	}
+
+	ctx := c.Request().Context()
+	r := postgres.Role{Name: req.Name, Description: req.Description, Permissions: req.Permissions}
+	if err := rest.DB.InsertRole(ctx, &r); err != nil {
+		return err
+	}
+	actor, _ := auth.UserIDValue(ctx)
+	rest.Audit.Record(ctx, audit.Event{Type: audit.EventRoleCreated, Actor: actor, Subject: r.Name, IP: c.RealIP()})
+
+	return rest.Render(c, http.StatusCreated, newRole(&r))
+}
+
+// GetRole returns a role
+// @Summary [get] /admin/roles/{id}
+// @Description Returns a role with its permissions. Requires the admin scope.
+// @Tags admin
+// @Accept  json
+// @Produce json,application/msgpack,application/cbor,xml
+// @Security BearerAuth
+// @Param id path int true "Role ID"
+// @Success 200 {object} Role "Role"
+// @Failure 401 {object} Problem "Invalid or revoked access token"
+// @Failure 403 {object} Problem "Missing admin scope"
+// @Failure 404 {object} Problem "Role not found"
+// @Failure 422 {object} Problem "Params validation error"
+// @Failure 500 {object} Problem "Internal server error"
+// @Router /admin/roles/{id} [get]
+func (rest *R) GetRole(c echo.Context) error {
+	var req RolePathRequest
+	if err := rest.Bind(c, &req); err != nil {
+		return err
+	}
+
+	r, err := rest.DB.FindRole(c.Request().Context(), req.ID)
+	if err != nil {
+		return err
+	}
+	if r == nil {
+		return apperr.NotFound(apperr.CodeRoleNotFound, "role not found")
+	}
+
+	return rest.Render(c, http.StatusOK, newRole(r))
+}
+
+// UpdateRole changes the name, the description and the permissions of a role
+// @Summary [put] /admin/roles/{id}
+// @Description Replaces the name, the description and the permissions of a role. The users holding the role get the
+// @Description new permissions right away. Requires the admin scope.
+// @Tags admin
+// @Accept  json,application/msgpack,application/cbor,xml
+// @Produce json,application/msgpack,application/cbor,xml
+// @Security BearerAuth
+// @Param id path int true "Role ID"
+// @Param role body RoleRequest true "Role"
+// @Success 200 {object} Role "Role"
+// @Failure 400 {object} Problem "Invalid request JSON"
+// @Failure 401 {object} Problem "Invalid or revoked access token"
+// @Failure 403 {object} Problem "Missing admin scope"
+// @Failure 404 {object} Problem "Role not found"
+// @Failure 409 {object} Problem "Role name already taken"
+// @Failure 422 {object} Problem "Params validation error"
+// @Failure 500 {object} Problem "Internal server error"
+// @Router /admin/roles/{id} [put]
+func (rest *R) UpdateRole(c echo.Context) error {
+	var req UpdateRoleRequest
+	if err := rest.Bind(c, &req); err != nil {
+		return err
+	}
+
+	ctx := c.Request().Context()
+	r := postgres.Role{ID: req.ID, Name: req.Name, Description: req.Description, Permissions: req.Permissions}
+	if err := rest.DB.UpdateRole(ctx, &r); err != nil {
+		return err
+	}
+	rest.invalidateRolePermissions(ctx, r.ID)
+	actor, _ := auth.UserIDValue(ctx)
+	rest.Audit.Record(ctx, audit.Event{Type: audit.EventRoleUpdated, Actor: actor, Subject: r.Name, IP: c.RealIP()})
+
+	return rest.Render(c, http.StatusOK, newRole(&r))
+}
+
+// DeleteRole deletes a role
+// @Summary [delete] /admin/roles/{id}
+// @Description Deletes a role, the users holding it lose its permissions right away. Requires the admin scope.
+// @Tags admin
+// @Accept  json
+// @Produce json,application/msgpack,application/cbor,xml
+// @Security BearerAuth
+// @Param id path int true "Role ID"
+// @Success 204 "Role deleted"
+// @Failure 401 {object} Problem "Invalid or revoked access token"
+// @Failure 403 {object} Problem "Missing admin scope"
+// @Failure 404 {object} Problem "Role not found"
+// @Failure 422 {object} Problem "Params validation error"
+// @Failure 500 {object} Problem "Internal server error"
+// @Router /admin/roles/{id} [delete]
+func (rest *R) DeleteRole(c echo.Context) error {
+	var req RolePathRequest
+	if err := rest.Bind(c, &req); err != nil {
+		return err
+	}
+
+	ctx := c.Request().Context()
+	r, err := rest.DB.FindRole(ctx, req.ID)
+	if err != nil {
+		return err
+	}
+	if r == nil {
+		return apperr.NotFound(apperr.CodeRoleNotFound, "role not found")
+	}
+	if err := rest.DB.DeleteRole(ctx, r.ID); err != nil {
+		return err
+	}
+	rest.invalidateRolePermissions(ctx, r.ID)
+	actor, _ := auth.UserIDValue(ctx)
+	rest.Audit.Record(ctx, audit.Event{Type: audit.EventRoleDeleted, Actor: actor, Subject: r.Name, IP: c.RealIP()})
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// ListUserRoles returns the roles of a user
+// @Summary [get] /admin/users/{user_id}/roles
+// @Description Returns the roles assigned to a user, oldest first. Requires the admin scope.
+// @Tags admin
+// @Accept  json
+// @Produce json,application/msgpack,application/cbor,xml
+// @Security BearerAuth
+// @Param user_id path string true "User ID, the subject of the tokens of the user"
+// @Param issuer query string false "Issuer of the tokens of the user, this service by default"
+// @Success 200 {array} Role "Roles"
+// @Failure 401 {object} Problem "Invalid or revoked access token"
+// @Failure 403 {object} Problem "Missing admin scope"
+// @Failure 422 {object} Problem "Params validation error"
+// @Failure 500 {object} Problem "Internal server error"
+// @Router /admin/users/{user_id}/roles [get]
+func (rest *R) ListUserRoles(c echo.Context) error {
+	var req UserRolesPathRequest
+	if err := rest.Bind(c, &req); err != nil {
+		return err
+	}
+
+	roles, err := rest.DB.FindUserRoles(c.Request().Context(), rest.userRoleIssuer(req.Issuer), req.UserID)
+	if err != nil {
+		return err
+	}
+
+	return rest.Render(c, http.StatusOK, newRoles(roles))
+}
+
+// AssignRole assigns a role to a user
+// @Summary [put] /admin/users/{user_id}/roles/{role_id}
+// @Description Assigns a role to a user, assigning it again does nothing. The user gets the permissions of the role
+// @Description right away. Requires the admin scope.
+// @Tags admin
+// @Accept  json
+// @Produce json,application/msgpack,application/cbor,xml
+// @Security BearerAuth
+// @Param user_id path string true "User ID, the subject of the tokens of the user"
+// @Param role_id path int true "Role ID"
+// @Param issuer query string false "Issuer of the tokens of the user, this service by default"
+// @Success 204 "Role assigned"
+// @Failure 401 {object} Problem "Invalid or revoked access token"
+// @Failure 403 {object} Problem "Missing admin scope"
+// @Failure 404 {object} Problem "Role not found"
+// @Failure 422 {object} Problem "Params validation error"
+// @Failure 500 {object} Problem "Internal server error"
+// @Router /admin/users/{user_id}/roles/{role_id} [put]
+func (rest *R) AssignRole(c echo.Context) error {
+	var req UserRolePathRequest
+	// the binder only binds the query params of the requests without a body
+	if err := new(echo.DefaultBinder).BindQueryParams(c, &req); err != nil {
+		return err
+	}
+	if err := rest.Bind(c, &req); err != nil {
+		return err
+	}
+
+	ctx := c.Request().Context()
+	issuer := rest.userRoleIssuer(req.Issuer)
+	if err := rest.DB.AssignRole(ctx, issuer, req.UserID, req.RoleID); err != nil {
+		return err
+	}
+	rest.invalidateUserPermissions(ctx, issuer, req.UserID)
+	actor, _ := auth.UserIDValue(ctx)
+	rest.Audit.Record(ctx, audit.Event{
+		Type:    audit.EventRoleAssigned,
+		Actor:   actor,
+		Subject: req.UserID,
+		IP:      c.RealIP(),
+		Details: map[string]interface{}{"role_id": req.RoleID, "issuer": issuer},
+	})
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// UnassignRole removes a role from a user
+// @Summary [delete] /admin/users/{user_id}/roles/{role_id}
+// @Description Removes a role from a user, the user loses the permissions of the role right away. Requires the admin
+// @Description scope.
+// @Tags admin
+// @Accept  json
+// @Produce json,application/msgpack,application/cbor,xml
+// @Security BearerAuth
+// @Param user_id path string true "User ID, the subject of the tokens of the user"
+// @Param role_id path int true "Role ID"
+// @Param issuer query string false "Issuer of the tokens of the user, this service by default"
+// @Success 204 "Role removed"
+// @Failure 401 {object} Problem "Invalid or revoked access token"
+// @Failure 403 {object} Problem "Missing admin scope"
+// @Failure 404 {object} Problem "Role not assigned to the user"
+// @Failure 422 {object} Problem "Params validation error"
+// @Failure 500 {object} Problem "Internal server error"
+// @Router /admin/users/{user_id}/roles/{role_id} [delete]
+func (rest *R) UnassignRole(c echo.Context) error {
+	var req UserRolePathRequest
+	if err := rest.Bind(c, &req); err != nil {
+		return err
+	}
+
+	ctx := c.Request().Context()
+	issuer := rest.userRoleIssuer(req.Issuer)
+	if err := rest.DB.UnassignRole(ctx, issuer, req.UserID, req.RoleID); err != nil {
+		return err
+	}
+	rest.invalidateUserPermissions(ctx, issuer, req.UserID)
+	actor, _ := auth.UserIDValue(ctx)
+	rest.Audit.Record(ctx, audit.Event{
+		Type:    audit.EventRoleUnassigned,
+		Actor:   actor,
+		Subject: req.UserID,
+		IP:      c.RealIP(),
+		Details: map[string]interface{}{"role_id": req.RoleID, "issuer": issuer},
+	})
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// UserPermissions returns the effective permissions of the user of the issuer, the permissions of all the roles
+// assigned to them, sorted. They are cached for REST_RBAC_CACHE_TTL, role changes invalidate them, a zero TTL
+// disables the cache. A failing cache only costs a query.
+func (rest *R) UserPermissions(ctx context.Context, issuer, userID string) ([]string, error) {
+	logger := requestid.Logger(ctx, rest.logger)
+	var lease *redisdb.PermissionsLease
+	if rest.PermissionCache != nil {
+		permissions, err := rest.PermissionCache.GetPermissions(ctx, issuer, userID)
+		if err != nil {
+			logger.Warn().Err(err).Msg("failed to load the cached permissions")
+		} else if permissions != nil {
+			return permissions, nil
+		}
+		// the lease is taken before the roles are read, an assignment racing with the read is not cached
+		if err == nil && rest.cfg.RBAC.CacheTTL > 0 {
+			if lease, err = rest.PermissionCache.LeasePermissions(ctx, issuer, userID); err != nil {
+				logger.Warn().Err(err).Msg("failed to lease the cached permissions")
+			}
+		}
+	}
+
+	roles, err := rest.DB.FindUserRoles(ctx, issuer, userID)
+	if err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{}
+	permissions := []string{}
+	roleIDs := make([]int, 0, len(roles))
+	for _, r := range roles {
+		roleIDs = append(roleIDs, r.ID)
+		for _, p := range r.Permissions {
+			if !seen[p] {
+				seen[p] = true
+				permissions = append(permissions, p)
+			}
+		}
+	}
+	sort.Strings(permissions)
+
+	if lease != nil {
+		if err := rest.PermissionCache.SetPermissions(ctx, issuer, userID, permissions, roleIDs, lease, rest.cfg.RBAC.CacheTTL); err != nil {
+			logger.Warn().Err(err).Msg("failed to cache the permissions")
+		}
+	}
+
+	return permissions, nil
+}
+
+// HasPermission reports whether the user of the request context has the permission, see UserPermissions
+func (rest *R) HasPermission(ctx context.Context, permission string) (bool, error) {
+	userID, err := auth.UserIDValue(ctx)
+	if err != nil {
+		return false, apperr.Unauthorized(apperr.CodeUnauthorized, "jwt missing").Wrap(err)
+	}
+	issuer, err := auth.IssuerValue(ctx)
+	if err != nil {
+		return false, apperr.Unauthorized(apperr.CodeUnauthorized, "jwt missing").Wrap(err)
+	}
+	permissions, err := rest.UserPermissions(ctx, issuer, userID)
+	if err != nil {
+		return false, err
+	}
+	i := sort.SearchStrings(permissions, permission)
+
+	return i < len(permissions) && permissions[i] == permission, nil
+}
+
+// CheckPermission fails with a forbidden error unless the user of the request context has the permission. It is the
+// policy check of the handlers, e.g. when the permission depends on the resource:
+//
+//	if err := rest.CheckPermission(ctx, "users:write"); err != nil {
+//		return err
+//	}
+func (rest *R) CheckPermission(ctx context.Context, permission string) error {
+	ok, err := rest.HasPermission(ctx, permission)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return apperr.Forbidden(apperr.CodeMissingPermission, "missing the "+permission+" permission")
+	}
+
+	return nil
+}
+
+// RequirePermission rejects the users without the permission with a 403, it runs after Authenticate
+func (rest *R) RequirePermission(permission string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if err := rest.CheckPermission(c.Request().Context(), permission); err != nil {
+				return err
+			}
+
+			return next(c)
+		}
+	}
+}
+
+// invalidateRolePermissions drops the cached permissions of the users holding the role,
+// until the cache recovers they are stale for at most REST_RBAC_CACHE_TTL
+func (rest *R) invalidateRolePermissions(ctx context.Context, roleID int) {
+	if rest.PermissionCache == nil {
+		return
+	}
+	if err := rest.PermissionCache.InvalidateRolePermissions(ctx, roleID); err != nil {
+		requestid.Logger(ctx, rest.logger).Error().Err(err).Str("role_id", strconv.Itoa(roleID)).Msg("failed to invalidate the cached permissions")
+	}
+}
+
+// invalidateUserPermissions drops the cached permissions of the user of the issuer, see invalidateRolePermissions
+func (rest *R) invalidateUserPermissions(ctx context.Context, issuer, userID string) {
+	if rest.PermissionCache == nil {
+		return
+	}
+	if err := rest.PermissionCache.InvalidateUserPermissions(ctx, issuer, userID); err != nil {
+		requestid.Logger(ctx, rest.logger).Error().Err(err).Str("issuer", issuer).Str("user_id", userID).Msg("failed to invalidate the cached permissions")
+	}
+}
+
+// userRoleIssuer is the issuer of the user of the user role endpoints, the users of this service by default
+func (rest *R) userRoleIssuer(issuer string) string {
+	if issuer == "" && rest.Tokens != nil {
+		return rest.Tokens.Issuer()
+	}
+
+	return issuer
+}
+
+// newRole creates the public representation of a database role
+func newRole(r *postgres.Role) Role {
+	return Role{
+		ID:          r.ID,
+		Name:        r.Name,
+		Description: r.Description,
+		Permissions: append([]string{}, r.Permissions...),
+		CreatedAt:   r.CreatedAt.UTC(),
+	}
+}
+
+func newRoles(roles []postgres.Role) []Role {
+	res := make([]Role, 0, len(roles))
+	for i := range roles {
+		res = append(res, newRole(&roles[i]))
+	}
+
+	return res
+}
@@ -0,0 +1,416 @@
+package rest
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/efimovalex/replaceme/adapters/redisdb"
+	"github.com/efimovalex/replaceme/internal/audit"
+	auth "github.com/efimovalex/replaceme/internal/auth0"
+	"github.com/labstack/echo/v4"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	roleColumns            = []string{"id", "name", "description", "created_at"}
+	insertRoleQuery        = regexp.QuoteMeta(`INSERT INTO roles (name,description) VALUES ($1,$2) RETURNING id, created_at`)
+	findRolesQuery         = regexp.QuoteMeta(`SELECT id, name, description, created_at FROM roles ORDER BY id`)
+	findRoleQuery          = regexp.QuoteMeta(`SELECT id, name, description, created_at FROM roles WHERE id = $1 ORDER BY id`)
+	findUserRolesQuery     = regexp.QuoteMeta(`SELECT roles.id, roles.name, roles.description, roles.created_at FROM roles JOIN user_roles ON user_roles.role_id = roles.id WHERE user_roles.issuer = $1 AND user_roles.user_id = $2 ORDER BY id`)
+	updateRoleQuery        = regexp.QuoteMeta(`UPDATE roles SET name = $1, description = $2 WHERE id = $3 RETURNING created_at`)
+	deleteRoleQuery        = regexp.QuoteMeta(`DELETE FROM roles WHERE id = $1`)
+	findPermissionsQuery   = regexp.QuoteMeta(`SELECT role_id, permission FROM permissions WHERE role_id IN (`)
+	deletePermissionsQuery = regexp.QuoteMeta(`DELETE FROM permissions WHERE role_id = $1`)
+	insertPermissionsQuery = regexp.QuoteMeta(`INSERT INTO permissions (role_id,permission) VALUES ($1,$2),($3,$4)`)
+	assignRoleQuery        = regexp.QuoteMeta(`INSERT INTO user_roles (issuer,user_id,role_id) VALUES ($1,$2,$3) ON CONFLICT DO NOTHING`)
+	unassignRoleQuery      = regexp.QuoteMeta(`DELETE FROM user_roles WHERE issuer = $1 AND role_id = $2 AND user_id = $3`)
+)
+
+var roleCreatedAt = time.Date(2022, 7, 1, 10, 0, 0, 0, time.UTC)
+
+func roleRows() *sqlmock.Rows {
+	return sqlmock.NewRows(roleColumns).
+		AddRow(1, "editor", "Edits the users", roleCreatedAt).
+		AddRow(2, "viewer", "", roleCreatedAt)
+}
+
+func permissionRows() *sqlmock.Rows {
+	return sqlmock.NewRows([]string{"role_id", "permission"}).
+		AddRow(1, "users:read").
+		AddRow(2, "users:read").
+		AddRow(1, "users:write")
+}
+
+// permissionCacheMock is an in-memory PermissionCache, the users are keyed by "<issuer> <user id>"
+type permissionCacheMock struct {
+	mu          sync.Mutex
+	permissions map[string][]string
+	roles       map[int][]string
+	leases      map[string]*redisdb.PermissionsLease
+	err         error
+}
+
+func newPermissionCacheMock() *permissionCacheMock {
+	return &permissionCacheMock{permissions: map[string][]string{}, roles: map[int][]string{}, leases: map[string]*redisdb.PermissionsLease{}}
+}
+
+func (m *permissionCacheMock) LeasePermissions(ctx context.Context, issuer, userID string) (*redisdb.PermissionsLease, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return nil, m.err
+	}
+	if m.leases[issuer+" "+userID] != nil {
+		return nil, nil
+	}
+	lease := &redisdb.PermissionsLease{}
+	m.leases[issuer+" "+userID] = lease
+
+	return lease, nil
+}
+
+func (m *permissionCacheMock) GetPermissions(ctx context.Context, issuer, userID string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.permissions[issuer+" "+userID], m.err
+}
+
+func (m *permissionCacheMock) SetPermissions(ctx context.Context, issuer, userID string, permissions []string, roleIDs []int, lease *redisdb.PermissionsLease, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return m.err
+	}
+	if m.leases[issuer+" "+userID] != lease {
+		return nil
+	}
+	delete(m.leases, issuer+" "+userID)
+	m.permissions[issuer+" "+userID] = permissions
+	for _, id := range roleIDs {
+		m.roles[id] = append(m.roles[id], issuer+" "+userID)
+	}
+
+	return nil
+}
+
+func (m *permissionCacheMock) InvalidateUserPermissions(ctx context.Context, issuer string, userIDs ...string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, id := range userIDs {
+		delete(m.permissions, issuer+" "+id)
+		delete(m.leases, issuer+" "+id)
+	}
+
+	return m.err
+}
+
+func (m *permissionCacheMock) InvalidateRolePermissions(ctx context.Context, roleIDs ...int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, id := range roleIDs {
+		for _, userID := range m.roles[id] {
+			delete(m.permissions, userID)
+		}
+		delete(m.roles, id)
+	}
+	// the permissions being loaded may come from the roles
+	m.leases = map[string]*redisdb.PermissionsLease{}
+
+	return m.err
+}
+
+func TestREST_CreateRole(t *testing.T) {
+	t.Run("Created", func(t *testing.T) {
+		r, mock := NewTestRESTWithMock(t)
+		events := &audit.Fake{}
+		r.Audit = events
+		mock.ExpectBegin()
+		mock.ExpectQuery(insertRoleQuery).WithArgs("editor", "Edits the users").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(1, roleCreatedAt))
+		mock.ExpectExec(deletePermissionsQuery).WithArgs(1).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec(insertPermissionsQuery).WithArgs(1, "users:read", 1, "users:write").WillReturnResult(sqlmock.NewResult(0, 2))
+		mock.ExpectCommit()
+
+		w := adminRequest(t, r, http.MethodPost, "/v1/admin/roles",
+			`{"name":"editor","description":"Edits the users","permissions":["users:write","users:read","users:write"]}`)
+		require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+		checkResponseWithTestDataFile(t, w.Body.Bytes(), []string{})
+		require.Len(t, events.Events(), 1)
+		assert.Equal(t, audit.Event{Type: audit.EventRoleCreated, Actor: "2", Subject: "editor", IP: "192.0.2.1"}, events.Events()[0])
+	})
+
+	t.Run("Name taken", func(t *testing.T) {
+		r, mock := NewTestRESTWithMock(t)
+		mock.ExpectBegin()
+		mock.ExpectQuery(insertRoleQuery).WithArgs("editor", "").
+			WillReturnError(&pq.Error{Code: "23505", Message: "duplicate key value violates unique constraint"})
+		mock.ExpectRollback()
+
+		w := adminRequest(t, r, http.MethodPost, "/v1/admin/roles", `{"name":"editor"}`)
+		assert.Equal(t, http.StatusConflict, w.Code)
+		checkResponseWithTestDataFile(t, w.Body.Bytes(), []string{"correlation_id"})
+	})
+
+	t.Run("Invalid permission", func(t *testing.T) {
+		r, _ := NewTestRESTWithMock(t)
+
+		w := adminRequest(t, r, http.MethodPost, "/v1/admin/roles", `{"name":"editor","permissions":["users:read users:write"]}`)
+		assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+		checkResponseWithTestDataFile(t, w.Body.Bytes(), []string{"correlation_id"})
+	})
+}
+
+func TestREST_Roles(t *testing.T) {
+	t.Run("List", func(t *testing.T) {
+		r, mock := NewTestRESTWithMock(t)
+		mock.ExpectQuery(findRolesQuery).WillReturnRows(roleRows())
+		mock.ExpectQuery(findPermissionsQuery).WithArgs(1, 2).WillReturnRows(permissionRows())
+
+		w := adminRequest(t, r, http.MethodGet, "/v1/admin/roles", "")
+		assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		checkResponseWithTestDataFile(t, w.Body.Bytes(), []string{})
+	})
+
+	t.Run("Get unknown", func(t *testing.T) {
+		r, mock := NewTestRESTWithMock(t)
+		mock.ExpectQuery(findRoleQuery).WithArgs(3).WillReturnRows(sqlmock.NewRows(roleColumns))
+
+		w := adminRequest(t, r, http.MethodGet, "/v1/admin/roles/3", "")
+		assert.Equal(t, http.StatusNotFound, w.Code)
+		checkResponseWithTestDataFile(t, w.Body.Bytes(), []string{"correlation_id"})
+	})
+
+	t.Run("Update", func(t *testing.T) {
+		r, mock := NewTestRESTWithMock(t)
+		events := &audit.Fake{}
+		r.Audit = events
+		cache := newPermissionCacheMock()
+		r.PermissionCache = cache
+		cache.permissions["1"] = []string{"users:read"}
+		cache.roles[1] = []string{"1"}
+		mock.ExpectBegin()
+		mock.ExpectQuery(updateRoleQuery).WithArgs("admin", "", 1).WillReturnRows(sqlmock.NewRows([]string{"created_at"}).AddRow(roleCreatedAt))
+		mock.ExpectExec(deletePermissionsQuery).WithArgs(1).WillReturnResult(sqlmock.NewResult(0, 2))
+		mock.ExpectExec(insertPermissionsQuery).WithArgs(1, "users:delete", 1, "users:read").WillReturnResult(sqlmock.NewResult(0, 2))
+		mock.ExpectCommit()
+
+		w := adminRequest(t, r, http.MethodPut, "/v1/admin/roles/1", `{"name":"admin","permissions":["users:read","users:delete"]}`)
+		assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		checkResponseWithTestDataFile(t, w.Body.Bytes(), []string{})
+		assert.NotContains(t, cache.permissions, "1", "the permissions of the users holding the role are invalidated")
+		require.Len(t, events.Events(), 1)
+		assert.Equal(t, audit.Event{Type: audit.EventRoleUpdated, Actor: "2", Subject: "admin", IP: "192.0.2.1"}, events.Events()[0])
+	})
+
+	t.Run("Update unknown", func(t *testing.T) {
+		r, mock := NewTestRESTWithMock(t)
+		mock.ExpectBegin()
+		mock.ExpectQuery(updateRoleQuery).WithArgs("admin", "", 3).WillReturnError(sql.ErrNoRows)
+		mock.ExpectRollback()
+
+		w := adminRequest(t, r, http.MethodPut, "/v1/admin/roles/3", `{"name":"admin"}`)
+		assert.Equal(t, http.StatusNotFound, w.Code, w.Body.String())
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		r, mock := NewTestRESTWithMock(t)
+		events := &audit.Fake{}
+		r.Audit = events
+		cache := newPermissionCacheMock()
+		r.PermissionCache = cache
+		cache.permissions["1"] = []string{"users:read"}
+		cache.roles[1] = []string{"1"}
+		mock.ExpectQuery(findRoleQuery).WithArgs(1).WillReturnRows(sqlmock.NewRows(roleColumns).AddRow(1, "editor", "", roleCreatedAt))
+		mock.ExpectQuery(findPermissionsQuery).WithArgs(1).WillReturnRows(sqlmock.NewRows([]string{"role_id", "permission"}))
+		mock.ExpectExec(deleteRoleQuery).WithArgs(1).WillReturnResult(sqlmock.NewResult(0, 1))
+
+		w := adminRequest(t, r, http.MethodDelete, "/v1/admin/roles/1", "")
+		assert.Equal(t, http.StatusNoContent, w.Code, w.Body.String())
+		assert.Empty(t, cache.permissions)
+		require.Len(t, events.Events(), 1)
+		assert.Equal(t, audit.Event{Type: audit.EventRoleDeleted, Actor: "2", Subject: "editor", IP: "192.0.2.1"}, events.Events()[0])
+	})
+}
+
+func TestREST_UserRoles(t *testing.T) {
+	t.Run("List", func(t *testing.T) {
+		r, mock := NewTestRESTWithMock(t)
+		mock.ExpectQuery(findUserRolesQuery).WithArgs("https://some-domain/", "auth0|1").WillReturnRows(roleRows())
+		mock.ExpectQuery(findPermissionsQuery).WithArgs(1, 2).WillReturnRows(permissionRows())
+
+		w := adminRequest(t, r, http.MethodGet, "/v1/admin/users/auth0|1/roles?issuer=https://some-domain/", "")
+		assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		checkResponseWithTestDataFile(t, w.Body.Bytes(), []string{})
+	})
+
+	t.Run("Assign", func(t *testing.T) {
+		r, mock := NewTestRESTWithMock(t)
+		events := &audit.Fake{}
+		r.Audit = events
+		cache := newPermissionCacheMock()
+		r.PermissionCache = cache
+		cache.permissions[testTokenConfig.Issuer+" 1"] = []string{}
+		cache.permissions["https://some-domain/ 1"] = []string{}
+		mock.ExpectExec(assignRoleQuery).WithArgs(testTokenConfig.Issuer, "1", 2).WillReturnResult(sqlmock.NewResult(0, 1))
+
+		w := adminRequest(t, r, http.MethodPut, "/v1/admin/users/1/roles/2", "")
+		assert.Equal(t, http.StatusNoContent, w.Code, w.Body.String())
+		assert.Equal(t, map[string][]string{"https://some-domain/ 1": {}}, cache.permissions,
+			"the user 1 of another issuer keeps its permissions")
+		require.Len(t, events.Events(), 1)
+		assert.Equal(t, audit.Event{
+			Type:    audit.EventRoleAssigned,
+			Actor:   "2",
+			Subject: "1",
+			IP:      "192.0.2.1",
+			Details: map[string]interface{}{"role_id": 2, "issuer": testTokenConfig.Issuer},
+		}, events.Events()[0])
+	})
+
+	t.Run("Assign user of another issuer", func(t *testing.T) {
+		r, mock := NewTestRESTWithMock(t)
+		r.Audit = &audit.Fake{}
+		mock.ExpectExec(assignRoleQuery).WithArgs("https://some-domain/", "auth0|1", 2).WillReturnResult(sqlmock.NewResult(0, 1))
+
+		w := adminRequest(t, r, http.MethodPut, "/v1/admin/users/auth0|1/roles/2?issuer=https://some-domain/", "")
+		assert.Equal(t, http.StatusNoContent, w.Code, w.Body.String())
+	})
+
+	t.Run("Assign unknown role", func(t *testing.T) {
+		r, mock := NewTestRESTWithMock(t)
+		mock.ExpectExec(assignRoleQuery).WithArgs(testTokenConfig.Issuer, "1", 3).
+			WillReturnError(&pq.Error{Code: "23503", Message: "insert or update on table \"user_roles\" violates foreign key constraint"})
+
+		w := adminRequest(t, r, http.MethodPut, "/v1/admin/users/1/roles/3", "")
+		assert.Equal(t, http.StatusNotFound, w.Code)
+		checkResponseWithTestDataFile(t, w.Body.Bytes(), []string{"correlation_id"})
+	})
+
+	t.Run("Unassign", func(t *testing.T) {
+		r, mock := NewTestRESTWithMock(t)
+		events := &audit.Fake{}
+		r.Audit = events
+		cache := newPermissionCacheMock()
+		r.PermissionCache = cache
+		cache.permissions[testTokenConfig.Issuer+" 1"] = []string{"users:read"}
+		mock.ExpectExec(unassignRoleQuery).WithArgs(testTokenConfig.Issuer, 2, "1").WillReturnResult(sqlmock.NewResult(0, 1))
+
+		w := adminRequest(t, r, http.MethodDelete, "/v1/admin/users/1/roles/2", "")
+		assert.Equal(t, http.StatusNoContent, w.Code, w.Body.String())
+		assert.Empty(t, cache.permissions)
+		require.Len(t, events.Events(), 1)
+		assert.Equal(t, audit.EventRoleUnassigned, events.Events()[0].Type)
+	})
+
+	t.Run("Unassign not assigned", func(t *testing.T) {
+		r, mock := NewTestRESTWithMock(t)
+		mock.ExpectExec(unassignRoleQuery).WithArgs(testTokenConfig.Issuer, 2, "1").WillReturnResult(sqlmock.NewResult(0, 0))
+
+		w := adminRequest(t, r, http.MethodDelete, "/v1/admin/users/1/roles/2", "")
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+}
+
+func TestR_UserPermissions(t *testing.T) {
+	ctx := context.Background()
+	issuer := testTokenConfig.Issuer
+
+	t.Run("Cached", func(t *testing.T) {
+		r, mock := NewTestRESTWithMock(t)
+		r.cfg.RBAC.CacheTTL = time.Minute
+		cache := newPermissionCacheMock()
+		r.PermissionCache = cache
+		mock.ExpectQuery(findUserRolesQuery).WithArgs(issuer, "1").WillReturnRows(roleRows())
+		mock.ExpectQuery(findPermissionsQuery).WithArgs(1, 2).WillReturnRows(permissionRows())
+
+		permissions, err := r.UserPermissions(ctx, issuer, "1")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"users:read", "users:write"}, permissions)
+		assert.Equal(t, map[int][]string{1: {issuer + " 1"}, 2: {issuer + " 1"}}, cache.roles)
+
+		// the second call is served by the cache, the mock has no more rows
+		permissions, err = r.UserPermissions(ctx, issuer, "1")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"users:read", "users:write"}, permissions)
+	})
+
+	t.Run("No roles", func(t *testing.T) {
+		r, mock := NewTestRESTWithMock(t)
+		r.cfg.RBAC.CacheTTL = time.Minute
+		cache := newPermissionCacheMock()
+		r.PermissionCache = cache
+		mock.ExpectQuery(findUserRolesQuery).WithArgs(issuer, "1").WillReturnRows(sqlmock.NewRows(roleColumns))
+
+		permissions, err := r.UserPermissions(ctx, issuer, "1")
+		require.NoError(t, err)
+		assert.Empty(t, permissions)
+		assert.Equal(t, []string{}, cache.permissions[issuer+" 1"], "users without roles are cached too")
+	})
+
+	t.Run("Failing cache", func(t *testing.T) {
+		r, mock := NewTestRESTWithMock(t)
+		r.cfg.RBAC.CacheTTL = time.Minute
+		cache := newPermissionCacheMock()
+		cache.err = errors.New("connection refused")
+		r.PermissionCache = cache
+		mock.ExpectQuery(findUserRolesQuery).WithArgs(issuer, "1").WillReturnRows(roleRows())
+		mock.ExpectQuery(findPermissionsQuery).WithArgs(1, 2).WillReturnRows(permissionRows())
+
+		permissions, err := r.UserPermissions(ctx, issuer, "1")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"users:read", "users:write"}, permissions)
+	})
+}
+
+func TestR_RequirePermission(t *testing.T) {
+	r, mock := NewTestRESTWithMock(t)
+	cache := newPermissionCacheMock()
+	r.PermissionCache = cache
+	cache.permissions[testTokenConfig.Issuer+" 1"] = []string{"users:read", "users:write"}
+	cache.permissions[testTokenConfig.Issuer+" 2"] = []string{"users:read"}
+	mock.ExpectQuery(findUserRolesQuery).WithArgs("https://some-domain/", "1").WillReturnRows(sqlmock.NewRows(roleColumns))
+	handler := r.RequirePermission("users:write")(func(c echo.Context) error {
+		return c.NoContent(http.StatusNoContent)
+	})
+
+	tests := []struct {
+		name               string
+		issuer             string
+		userID             string
+		expectedStatusCode int
+	}{
+		{"Granted", testTokenConfig.Issuer, "1", http.StatusNoContent},
+		{"Missing permission", testTokenConfig.Issuer, "2", http.StatusForbidden},
+		{"Same subject of another issuer", "https://some-domain/", "1", http.StatusForbidden},
+		{"Anonymous", "", "", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/v1/users", nil)
+			if tt.userID != "" {
+				req = req.WithContext(auth.WithIssuer(auth.WithUserID(req.Context(), tt.userID), tt.issuer))
+			}
+			w := httptest.NewRecorder()
+			c := r.Router.NewContext(req, w)
+
+			if err := handler(c); err != nil {
+				r.HTTPErrorHandler(err, c)
+			}
+			assert.Equal(t, tt.expectedStatusCode, w.Code)
+			if tt.name == "Missing permission" {
+				checkResponseWithTestDataFile(t, w.Body.Bytes(), []string{"correlation_id"})
+			}
+		})
+	}
+}
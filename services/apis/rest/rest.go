@@ -2,16 +2,33 @@
 package rest
 
 import (
+	"compress/gzip"
 	"context"
+	"errors"
+	"fmt"
+	"io"
 	"net"
 	"net/http"
+	"net/url"
+	"strconv"
 	"time"
 
+	"github.com/andybalholm/brotli"
 	jwtmiddleware "github.com/auth0/go-jwt-middleware/v2"
 	"github.com/efimovalex/replaceme/adapters/mongodb"
+	"github.com/efimovalex/replaceme/adapters/postgres"
 	"github.com/efimovalex/replaceme/adapters/redisdb"
+	"github.com/efimovalex/replaceme/config"
+	"github.com/efimovalex/replaceme/internal/audit"
 	auth "github.com/efimovalex/replaceme/internal/auth0"
+	"github.com/efimovalex/replaceme/internal/encryption"
+	"github.com/efimovalex/replaceme/internal/mailer"
+	"github.com/efimovalex/replaceme/internal/requestid"
+	"github.com/efimovalex/replaceme/internal/tlsconfig"
+	"github.com/efimovalex/replaceme/internal/token"
+	"github.com/efimovalex/replaceme/internal/webauthn"
 	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/bytes"
 
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
@@ -20,6 +37,38 @@ import (
 // DB is the interface for the database service
 type DB interface {
 	Ping() error
+	FindOneUserByEmail(ctx context.Context, email string, active *bool) (*postgres.User, error)
+	FindOneUserByID(ctx context.Context, id int) (*postgres.User, error)
+	InsertUser(ctx context.Context, u *postgres.User) error
+	UpdateUserPassword(ctx context.Context, id int, password string) error
+	MarkUserEmailVerified(ctx context.Context, id int) error
+	FindUserTOTP(ctx context.Context, userID int) (*postgres.UserTOTP, error)
+	SaveUserTOTP(ctx context.Context, userID int, secret string) error
+	ConfirmUserTOTP(ctx context.Context, userID int, step int64, recoveryHashes []string) error
+	UseTOTPStep(ctx context.Context, userID int, step int64) (bool, error)
+	DeleteUserTOTP(ctx context.Context, userID int) error
+	ReplaceRecoveryCodes(ctx context.Context, userID int, hashes []string) error
+	UseRecoveryCode(ctx context.Context, userID int, hash string) (bool, error)
+	InsertWebAuthnCredential(ctx context.Context, c *postgres.WebAuthnCredential) error
+	FindWebAuthnCredentials(ctx context.Context, userID int) ([]postgres.WebAuthnCredential, error)
+	FindWebAuthnCredential(ctx context.Context, id string) (*postgres.WebAuthnCredential, error)
+	UpdateWebAuthnCredentialUse(ctx context.Context, id string, prevCount, signCount int64) (bool, error)
+	DeleteWebAuthnCredential(ctx context.Context, userID int, id string) error
+	InsertAPIKey(ctx context.Context, k *postgres.APIKey) error
+	FindAPIKeys(ctx context.Context) ([]postgres.APIKey, error)
+	FindAPIKey(ctx context.Context, id int) (*postgres.APIKey, error)
+	FindAPIKeyByPrefix(ctx context.Context, prefix string) (*postgres.APIKey, error)
+	UpdateAPIKey(ctx context.Context, k *postgres.APIKey) error
+	UpdateAPIKeyUse(ctx context.Context, id int) error
+	DeleteAPIKey(ctx context.Context, id int) error
+	InsertRole(ctx context.Context, r *postgres.Role) error
+	FindRoles(ctx context.Context) ([]postgres.Role, error)
+	FindRole(ctx context.Context, id int) (*postgres.Role, error)
+	FindUserRoles(ctx context.Context, issuer, userID string) ([]postgres.Role, error)
+	UpdateRole(ctx context.Context, r *postgres.Role) error
+	DeleteRole(ctx context.Context, id int) error
+	AssignRole(ctx context.Context, issuer, userID string, roleID int) error
+	UnassignRole(ctx context.Context, issuer, userID string, roleID int) error
 }
 
 // Router is the router interface for the REST service
@@ -32,27 +81,76 @@ type Router interface {
 type R struct {
 	Router Router
 	srv    *http.Server
+	cfg    config.REST
 
 	DB    DB
 	Mongo *mongodb.Client
 	Redis *redisdb.Client
 
 	AuthMiddleware *jwtmiddleware.JWTMiddleware
+	Tokens         *token.Issuer
+	RateLimiter    RateLimiter
+	Idempotency    IdempotencyStore
+	Cache          ResponseCache
+	Sessions       SessionStore
+	UserTokens     UserTokenStore
+	Logins         LoginThrottler
+	MFAChallenges  MFAChallengeStore
+	MFACipher      *encryption.Cipher
+	WebAuthn       *webauthn.RelyingParty
+	// WebAuthnChallenges stores the challenges of the passkey ceremonies
+	WebAuthnChallenges WebAuthnChallengeStore
+	// IntrospectionCache caches the results of the token introspection of the issuers which use it
+	IntrospectionCache auth.IntrospectionCache
+	// PermissionCache caches the effective permissions of the users, see UserPermissions
+	PermissionCache PermissionCache
+	Mailer          mailer.Mailer
+	Audit           audit.Logger
 
+	validator *Validator
+	codecs    *Codecs
+	// listRoutes are the routes responding with lists by method and path, see listRoute
+	listRoutes     map[string]bool
 	logger         zerolog.Logger
 	prettyResponse bool
 }
 
 // New creates a new REST service
-func New(DB DB, Mongo *mongodb.Client, redis *redisdb.Client, a *auth.Auth, prettyResponse bool, port string) (*R, error) {
+func New(cfg config.REST, DB DB, Mongo *mongodb.Client, redis *redisdb.Client, a *auth.Auth, m mailer.Mailer) (*R, error) {
+	if err := validateConfig(cfg); err != nil {
+		return nil, err
+	}
+
 	rest := &R{
+		cfg:            cfg,
 		DB:             DB,
 		Mongo:          Mongo,
 		Redis:          redis,
+		Mailer:         m,
+		Audit:          audit.NewLog(),
 		logger:         log.With().Str("component", "rest").Logger(),
-		prettyResponse: prettyResponse,
+		prettyResponse: cfg.Pretty,
+	}
+	if redis != nil {
+		rest.RateLimiter = redis
+		rest.Idempotency = redis
+		rest.Cache = redis
+		rest.Sessions = redis
+		rest.UserTokens = redis
+		rest.Logins = redis
+		rest.MFAChallenges = redis
+		rest.WebAuthnChallenges = redis
+		rest.IntrospectionCache = redis
+		rest.PermissionCache = redis
 	}
+	rest.Tokens = a.Issuer
 	var err error
+	if cfg.MFA.Enable {
+		if rest.MFACipher, err = newMFACipher(cfg.MFA); err != nil {
+			return nil, fmt.Errorf("invalid MFA configuration: %w", err)
+		}
+	}
+	rest.WebAuthn = newRelyingParty(cfg.WebAuthn)
 	rest.AuthMiddleware, err = rest.AuthMiddlewareSetup(a)
 	if err != nil {
 		return nil, err
@@ -60,11 +158,62 @@ func New(DB DB, Mongo *mongodb.Client, redis *redisdb.Client, a *auth.Auth, pret
 
 	rest.SetupRouter()
 
-	rest.srv = &http.Server{Addr: "0.0.0.0:" + port, Handler: rest.Router}
+	tlsConfig, err := tlsconfig.New(cfg.TLS)
+	if err != nil {
+		return nil, fmt.Errorf("invalid TLS configuration: %w", err)
+	}
+
+	rest.srv = &http.Server{
+		Addr:              "0.0.0.0:" + cfg.Port,
+		Handler:           rest.Router,
+		ReadHeaderTimeout: cfg.Server.ReadHeaderTimeout,
+		ReadTimeout:       cfg.Server.ReadTimeout,
+		WriteTimeout:      cfg.Server.WriteTimeout,
+		IdleTimeout:       cfg.Server.IdleTimeout,
+		MaxHeaderBytes:    cfg.Server.MaxHeaderBytes,
+		TLSConfig:         tlsConfig,
+	}
 
 	return rest, nil
 }
 
+// validateConfig checks the settings that would otherwise fail on the first request
+func validateConfig(cfg config.REST) error {
+	if cfg.Server.MaxBodySize != "" {
+		if _, err := bytes.Parse(cfg.Server.MaxBodySize); err != nil {
+			return fmt.Errorf("invalid max body size %q: %w", cfg.Server.MaxBodySize, err)
+		}
+	}
+	for _, proxy := range cfg.Server.TrustedProxies {
+		if _, _, err := net.ParseCIDR(proxy); err != nil {
+			return fmt.Errorf("invalid trusted proxy %q: %w", proxy, err)
+		}
+	}
+	if cfg.Compression.Enable {
+		if _, err := gzip.NewWriterLevel(io.Discard, cfg.Compression.GzipLevel); err != nil {
+			return fmt.Errorf("invalid gzip level: %w", err)
+		}
+		if cfg.Compression.BrotliLevel < brotli.BestSpeed || cfg.Compression.BrotliLevel > brotli.BestCompression {
+			return fmt.Errorf("invalid brotli level: %d", cfg.Compression.BrotliLevel)
+		}
+	}
+	for _, link := range []string{cfg.Accounts.PasswordResetURL, cfg.Accounts.EmailVerificationURL, cfg.MagicLink.URL} {
+		if link == "" {
+			continue
+		}
+		if u, err := url.Parse(link); err != nil || !u.IsAbs() {
+			return fmt.Errorf("invalid account link URL %q", link)
+		}
+	}
+	for _, origin := range cfg.CORS.AllowOrigins {
+		if origin == "*" && cfg.CORS.AllowCredentials {
+			return errors.New("cors credentials cannot be allowed for every origin")
+		}
+	}
+
+	return nil
+}
+
 // Start starts the REST service
 func (rest *R) Start(ctx context.Context) error {
 	rest.logger.Info().Msgf("Starting REST service %s", rest.srv.Addr)
@@ -73,7 +222,13 @@ func (rest *R) Start(ctx context.Context) error {
 	if err != nil {
 		return err
 	}
-	if err := rest.srv.Serve(ln); err != http.ErrServerClosed {
+	if rest.srv.TLSConfig != nil {
+		// the certificates are provided by the TLS config
+		err = rest.srv.ServeTLS(ln, "", "")
+	} else {
+		err = rest.srv.Serve(ln)
+	}
+	if err != http.ErrServerClosed {
 		// Error starting or closing listener:
 		rest.logger.Fatal().Msgf("healthcheck server error: %v", err)
 		return err
@@ -97,29 +252,80 @@ func (rest *R) Stop(ctx context.Context) {
 // JSON serializes the given struct as JSON into the response body.
 // It also sets the Content-Type as "application/json" and
 // X-Content-Type-Options as "nosniff".
-// Logs the status and v if l is not nil.
+// Successful GET responses get a strong ETag and conditional requests are answered with a 304, see write.
 func (rest *R) JSON(c echo.Context, status int, v interface{}) error {
-	var err error
-	if rest.prettyResponse {
-		err = c.JSONPretty(status, v, "\t")
-	} else {
-		err = c.JSON(status, v)
+	return rest.render(c, status, jsonCodec{}, v)
+}
+
+// Render serializes the given struct into the response body in the media type negotiated
+// from the Accept header, see NegotiateMiddleware. JSON is used when the client accepts anything.
+// A value the negotiated media type cannot represent, e.g. a single object as CSV, is a 406.
+func (rest *R) Render(c echo.Context, status int, v interface{}) error {
+	codec, ok := c.Get(ctxKeyCodec).(Codec)
+	if !ok {
+		if codec, ok = rest.codecs.Negotiate(c.Request().Header.Get(echo.HeaderAccept), false); !ok {
+			return errNotAcceptable(c)
+		}
 	}
+
+	err := rest.render(c, status, codec, v)
+	if errors.Is(err, ErrNotRepresentable) {
+		return echo.NewHTTPError(http.StatusNotAcceptable, "response cannot be represented as "+c.Request().Header.Get(echo.HeaderAccept)).SetInternal(err)
+	}
+
+	return err
+}
+
+// render encodes v with the codec and writes it
+func (rest *R) render(c echo.Context, status int, codec Codec, v interface{}) error {
+	b, err := codec.Marshal(v)
 	if err != nil {
-		rest.logger.Error().Err(err).Msg("error json encoding response")
+		if !errors.Is(err, ErrNotRepresentable) {
+			requestid.Logger(c.Request().Context(), rest.logger).Error().Err(err).Msg("error encoding response")
+		}
 
 		return err
 	}
-	return nil
+
+	return rest.write(c, status, codec, b)
 }
 
-type errorResponse struct {
-	Message string `json:"message"`
+// write writes the compact body b encoded by codec, indented if pretty responses are requested.
+// The ETag is computed from the compact body so pretty printing does not change the identity of a response.
+func (rest *R) write(c echo.Context, status int, codec Codec, b []byte) error {
+	h := c.Response().Header()
+	h.Set("X-Content-Type-Options", "nosniff")
+	h.Add(echo.HeaderVary, echo.HeaderAccept)
+
+	if isCacheable(c.Request().Method, status) {
+		etag := strongETag(b)
+		h.Set(HeaderETag, etag)
+		c.Set(ctxKeyBody, b)
+
+		if etagMatch(c.Request().Header.Get(HeaderIfNoneMatch), etag) {
+			return c.NoContent(http.StatusNotModified)
+		}
+	}
+
+	if indenter, ok := codec.(Indenter); ok && rest.pretty(c) {
+		indented, err := indenter.Indent(b)
+		if err != nil {
+			return err
+		}
+		b = indented
+	}
+	if _, ok := codec.(Indenter); ok {
+		b = append(b, '\n')
+	}
+
+	return c.Blob(status, codec.ContentType(), b)
 }
 
-// JSONError returns an HTTP response as JSON message with status code
-// base on app err Kind, Msg from app err HTTPMessage.
-// Logs the error if l is not nil.
-func (rest *R) JSONError(c echo.Context, status int, err error) error {
-	return rest.JSON(c, status, errorResponse{Message: err.Error()})
+// pretty reports whether the response is pretty printed, the pretty query param overrides the REST_PRETTY default
+func (rest *R) pretty(c echo.Context) bool {
+	if pretty, err := strconv.ParseBool(c.QueryParam("pretty")); err == nil {
+		return pretty
+	}
+
+	return rest.prettyResponse
 }
@@ -11,32 +11,71 @@ import (
 
 	"github.com/DATA-DOG/go-sqlmock"
 	"github.com/efimovalex/replaceme/adapters/postgres"
+	"github.com/efimovalex/replaceme/config"
 	auth "github.com/efimovalex/replaceme/internal/auth0"
+	"github.com/efimovalex/replaceme/internal/auth0/authtest"
+	"github.com/efimovalex/replaceme/internal/token"
 	"github.com/jmoiron/sqlx"
 	"github.com/rs/zerolog"
 	"github.com/stretchr/testify/assert"
 )
 
+// testTokenConfig is the configuration of the first-party tokens of the test REST instances
+var testTokenConfig = config.LocalAuth{
+	Issuer:         "https://replaceme.test/",
+	Audience:       "some-audience",
+	Algorithm:      token.EdDSA,
+	KeyFiles:       []string{"test_data/keys/token_ed25519.pem"},
+	AccessTokenTTL: 15 * time.Minute,
+}
+
 // NewTestREST - creates new REST instance for testing
 func NewTestREST(t *testing.T) *R {
+	r, _ := NewTestRESTWithMock(t)
+
+	return r
+}
+
+// NewTestRESTWithMock - creates new REST instance for testing and returns the sql mock backing its DB
+func NewTestRESTWithMock(t *testing.T) (*R, sqlmock.Sqlmock) {
 	mockDB, mock, err := sqlmock.New(sqlmock.MonitorPingsOption(true))
 	assert.NoError(t, err)
 	assert.NoError(t, err)
+	mock.MatchExpectationsInOrder(false)
 	mock.ExpectPing().WillReturnError(errors.New("ping error"))
 	sqlxMock := sqlx.NewDb(mockDB, "sqlmock")
 
+	tokens, err := token.New(testTokenConfig)
+	assert.NoError(t, err)
+
 	r := R{
 		logger:         zerolog.Nop(),
 		DB:             &postgres.Client{DB: sqlxMock},
+		Tokens:         tokens,
 		prettyResponse: true,
 	}
 
 	r.SetupRouter()
 
-	r.AuthMiddleware, err = r.AuthMiddlewareSetup(auth.New("https://some-domain/", []string{"some-audience"}))
+	a := auth.New(auth.Auth0("https://some-domain/", "some-audience"))
+	a.Issuer = tokens
+	r.AuthMiddleware, err = r.AuthMiddlewareSetup(a)
+	assert.NoError(t, err)
+
+	return &r, mock
+}
+
+// NewTestRESTWithIssuer - creates new REST instance for testing which trusts the tokens of the issuer, see authtest
+func NewTestRESTWithIssuer(t *testing.T, issuer *authtest.Issuer) (*R, sqlmock.Sqlmock) {
+	r, mock := NewTestRESTWithMock(t)
+
+	a := auth.New(auth.Provider{Issuer: issuer.Issuer(), Audience: []string{authtest.Audience}})
+	a.Issuer = r.Tokens
+	var err error
+	r.AuthMiddleware, err = r.AuthMiddlewareSetup(a)
 	assert.NoError(t, err)
 
-	return &r
+	return r, mock
 }
 
 func TestREST_New(t *testing.T) {
@@ -47,20 +86,75 @@ func TestREST_New(t *testing.T) {
 	sqlxMock := sqlx.NewDb(mockDB, "sqlmock")
 
 	t.Run("test success", func(t *testing.T) {
-		claims := auth.New("http://some-domain", []string{""})
-		h, err := New(&postgres.Client{DB: sqlxMock}, nil, nil, claims, true, "9000")
+		claims := auth.New(auth.Auth0("http://some-domain", ""))
+		h, err := New(config.REST{Pretty: true, Port: "9000"}, &postgres.Client{DB: sqlxMock}, nil, nil, claims, nil)
 		assert.NoError(t, err)
 		assert.NotNil(t, h)
 	})
 
 	t.Run("test auth init error", func(t *testing.T) {
-		claims := auth.New("\\", []string{""})
-		h, err := New(&postgres.Client{DB: sqlxMock}, nil, nil, claims, true, "9000")
+		claims := auth.New(auth.Auth0("\\", ""))
+		h, err := New(config.REST{Pretty: true, Port: "9000"}, &postgres.Client{DB: sqlxMock}, nil, nil, claims, nil)
 		assert.Error(t, err)
 		assert.Nil(t, h)
 	})
 }
 
+func TestREST_New_InvalidConfig(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  config.REST
+		err  string
+	}{
+		{
+			name: "Max body size",
+			cfg:  config.REST{Server: config.Server{MaxBodySize: "a lot"}},
+			err:  `invalid max body size "a lot"`,
+		},
+		{
+			name: "Gzip level",
+			cfg:  config.REST{Compression: config.Compression{Enable: true, GzipLevel: 12, BrotliLevel: 4}},
+			err:  "invalid gzip level",
+		},
+		{
+			name: "Brotli level",
+			cfg:  config.REST{Compression: config.Compression{Enable: true, GzipLevel: -1, BrotliLevel: 12}},
+			err:  "invalid brotli level",
+		},
+		{
+			name: "Credentials for every origin",
+			cfg:  config.REST{CORS: config.CORS{AllowOrigins: []string{"*"}, AllowCredentials: true}},
+			err:  "cors credentials cannot be allowed for every origin",
+		},
+		{
+			name: "Relative account link",
+			cfg:  config.REST{Accounts: config.Accounts{PasswordResetURL: "/reset-password"}},
+			err:  `invalid account link URL "/reset-password"`,
+		},
+		{
+			name: "Trusted proxy",
+			cfg:  config.REST{Server: config.Server{TrustedProxies: []string{"10.0.0.1"}}},
+			err:  `invalid trusted proxy "10.0.0.1"`,
+		},
+		{
+			name: "MFA without encryption key",
+			cfg:  config.REST{MFA: config.MFA{Enable: true}},
+			err:  "REST_MFA_ENCRYPTION_KEY is required when MFA is enabled",
+		},
+		{
+			name: "MFA encryption key size",
+			cfg:  config.REST{MFA: config.MFA{Enable: true, EncryptionKey: "c2hvcnQ="}},
+			err:  "encryption key must be 32 bytes",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := New(tt.cfg, nil, nil, nil, auth.New(auth.Auth0("http://some-domain", "")), nil)
+			assert.ErrorContains(t, err, tt.err)
+		})
+	}
+}
+
 func TestHealth_StopGrecefully(t *testing.T) {
 	t.Parallel()
 	r := NewTestREST(t)
@@ -1,6 +1,7 @@
 package rest
 
 import (
+	"encoding/xml"
 	"fmt"
 	"net/http"
 
@@ -9,7 +10,13 @@ import (
 
 // Message is a simple JSON response
 type Message struct {
-	Message string `json:"message"`
+	XMLName xml.Name `json:"-" xml:"message"`
+	Message string   `json:"message" xml:"text"`
+}
+
+// RootRequest are the query params of the root endpoint
+type RootRequest struct {
+	Name string `query:"name" validate:"max=64"`
 }
 
 // GetRoot root endpoint with a simple hello world/name message
@@ -17,18 +24,23 @@ type Message struct {
 // @Description Returns root endpoint
 // @Tags root
 // @Accept  json
-// @Produce json
-// @Param name query string false "name"
+// @Produce json,application/msgpack,application/cbor,xml
+// @Param name query string false "name" maxlength(64)
 // @Success 200 {object} string "No content"
-// @Failure 400 {object} Message "Invalid request JSON"
-// @Failure 422 {object} Message "Params validation error"
-// @Failure 500 {object} Message "Internal server error"
+// @Failure 400 {object} Problem "Invalid request JSON"
+// @Failure 422 {object} Problem "Params validation error"
+// @Failure 500 {object} Problem "Internal server error"
 // @Router / [get]
 func (rest *R) GetRoot(c echo.Context) error {
-	name := c.QueryParams().Get("name")
+	var req RootRequest
+	if err := rest.Bind(c, &req); err != nil {
+		return err
+	}
+
+	name := req.Name
 	if name == "" {
 		name = "World"
 	}
 
-	return rest.JSON(c, http.StatusOK, Message{fmt.Sprintf("Hello, %s!", name)})
+	return rest.Render(c, http.StatusOK, Message{Message: fmt.Sprintf("Hello, %s!", name)})
 }
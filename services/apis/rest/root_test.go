@@ -7,6 +7,7 @@ import (
 	"strings"
 	"testing"
 
+	"github.com/efimovalex/replaceme/internal/apperr"
 	"github.com/labstack/echo/v4"
 	"github.com/stretchr/testify/assert"
 )
@@ -76,4 +77,91 @@ func TestREST_GetRoot(t *testing.T) {
 		assert.Equal(t, http.StatusOK, w.Code)
 		checkResponseWithTestDataFile(t, w.Body.Bytes(), []string{})
 	})
+	t.Run("Name too long", func(t *testing.T) {
+		r := NewTestREST(t)
+
+		req := httptest.NewRequest("GET", "/?name="+strings.Repeat("a", 65), nil)
+		w := httptest.NewRecorder()
+		c := r.Router.NewContext(req, w)
+
+		err := r.GetRoot(c)
+		assert.True(t, apperr.Is(err, apperr.KindValidation))
+		assert.Equal(t, "/name", apperr.As(err).Fields[0].Pointer)
+	})
+	t.Run("Content negotiation", func(t *testing.T) {
+		tests := []struct {
+			name                string
+			target              string
+			accept              string
+			expectedStatusCode  int
+			expectedContentType string
+			expectedBody        string
+		}{
+			{
+				name:                "XML",
+				target:              "/?pretty=false",
+				accept:              "application/xml",
+				expectedStatusCode:  http.StatusOK,
+				expectedContentType: echo.MIMEApplicationXMLCharsetUTF8,
+				expectedBody:        `<?xml version="1.0" encoding="UTF-8"?>` + "\n<message><text>Hello, World!</text></message>\n",
+			},
+			{
+				name:                "Pretty XML",
+				target:              "/",
+				accept:              "text/xml",
+				expectedStatusCode:  http.StatusOK,
+				expectedContentType: echo.MIMEApplicationXMLCharsetUTF8,
+				expectedBody:        `<?xml version="1.0" encoding="UTF-8"?>` + "\n<message>\n\t<text>Hello, World!</text>\n</message>\n",
+			},
+			{
+				name:                "MessagePack",
+				target:              "/",
+				accept:              "application/msgpack",
+				expectedStatusCode:  http.StatusOK,
+				expectedContentType: MIMEApplicationMsgpack,
+				expectedBody:        "\x81\xa7message\xadHello, World!",
+			},
+			{
+				name:                "CBOR",
+				target:              "/",
+				accept:              "application/cbor",
+				expectedStatusCode:  http.StatusOK,
+				expectedContentType: MIMEApplicationCBOR,
+				expectedBody:        "\xa1gmessagemHello, World!",
+			},
+			{
+				name:                "CSV is for lists",
+				target:              "/",
+				accept:              "text/csv",
+				expectedStatusCode:  http.StatusNotAcceptable,
+				expectedContentType: MIMEApplicationProblemJSON,
+			},
+			{
+				name:                "Unsupported media type",
+				target:              "/",
+				accept:              "image/png",
+				expectedStatusCode:  http.StatusNotAcceptable,
+				expectedContentType: MIMEApplicationProblemJSON,
+			},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				r := NewTestREST(t)
+
+				req := httptest.NewRequest(http.MethodGet, tt.target, nil)
+				req.Header.Set(echo.HeaderAccept, tt.accept)
+				w := httptest.NewRecorder()
+				r.Router.ServeHTTP(w, req)
+
+				assert.Equal(t, tt.expectedStatusCode, w.Code)
+				assert.Equal(t, tt.expectedContentType, w.Header().Get(echo.HeaderContentType))
+				assert.Contains(t, w.Header().Values(echo.HeaderVary), echo.HeaderAccept)
+				if tt.expectedBody != "" {
+					assert.Equal(t, tt.expectedBody, w.Body.String())
+				} else {
+					checkResponseWithTestDataFile(t, w.Body.Bytes(), []string{"correlation_id"})
+				}
+			})
+		}
+	})
 }
@@ -1,8 +1,9 @@
 package rest
 
 import (
+	"net"
+
 	"github.com/labstack/echo/v4"
-	"github.com/labstack/echo/v4/middleware"
 	"github.com/ziflex/lecho/v3"
 )
 
@@ -11,14 +12,119 @@ func (rest *R) SetupRouter() {
 	r := echo.New()
 	logger := lecho.From(rest.logger)
 	r.Logger = logger
+	r.HTTPErrorHandler = rest.HTTPErrorHandler
+	r.IPExtractor = ipExtractor(rest.cfg.Server.TrustedProxies)
+
+	rest.validator = NewValidator()
+	// registering a custom rule only fails on programming errors, e.g. an empty tag
+	if err := rest.validator.RegisterValidationCtx(uniqueEmailTag, rest.uniqueEmail); err != nil {
+		panic(err)
+	}
+	r.Validator = rest.validator
+
+	rest.codecs = DefaultCodecs()
+	rest.listRoutes = map[string]bool{}
+	r.Binder = NewBinder(rest.codecs)
 
 	// Add middlewarers
+	r.Pre(rest.VersionMiddleware)
+	r.Use(RequestIDMiddleware)
+	r.Use(ClientIdentityMiddleware)
+	r.Use(CompressMiddleware(rest.cfg.Compression))
 	r.Use(lecho.Middleware(lecho.Config{
-		Logger: logger,
+		Logger:       logger,
+		RequestIDKey: "request_id",
 	}))
-	r.Use(middleware.CORS())
+	r.Use(rest.RecoverMiddleware)
+	r.Use(BodyLimitMiddleware(rest.cfg.Server.MaxBodySize))
+	r.Use(SecurityHeadersMiddleware(rest.cfg.Security))
+	r.Use(CORSMiddleware(rest.cfg.CORS))
+	r.Use(rest.NegotiateMiddleware)
+
+	// well-known URIs are not versioned, see RFC 8615
+	r.GET(wellKnownPath+"/jwks.json", rest.GetJWKS, CacheControl(CachePublic))
 
-	r.GET("/", rest.GetRoot)
+	versions := rest.apiVersions()
+	rest.routesV1(r.Group("/"+APIVersionV1, APIVersionMiddleware(APIVersionV1, versions[APIVersionV1])))
+	rest.routesV2(r.Group("/"+APIVersionV2, APIVersionMiddleware(APIVersionV2, versions[APIVersionV2])))
 
 	rest.Router = r
 }
+
+// ipExtractor returns the client IP of the requests, see echo.Context.RealIP. The forwarded headers are only trusted
+// from the proxies, any client can send them.
+func ipExtractor(proxies []string) echo.IPExtractor {
+	if len(proxies) == 0 {
+		return echo.ExtractIPDirect()
+	}
+
+	options := []echo.TrustOption{echo.TrustLoopback(false), echo.TrustLinkLocal(false), echo.TrustPrivateNet(false)}
+	for _, proxy := range proxies {
+		// the CIDRs are checked by New
+		if _, ipNet, err := net.ParseCIDR(proxy); err == nil {
+			options = append(options, echo.TrustIPRange(ipNet))
+		}
+	}
+
+	return echo.ExtractIPFromXFFHeader(options...)
+}
+
+// routes registers the routes shared by all the API versions, see routesV1 and routesV2
+func (rest *R) routes(g *echo.Group) {
+	g.GET("/", rest.GetRoot, rest.RateLimitMiddleware("default", rest.cfg.RateLimit), CacheControl(CachePublic))
+
+	// the authenticated routes are limited after Authenticate, per user or API key instead of per IP
+	users := g.Group("/users")
+	users.POST("", rest.CreateUser, rest.RateLimitMiddleware("users", rest.cfg.UsersRateLimit), rest.IdempotencyMiddleware(rest.cfg.Idempotency))
+	users.GET("/:id", rest.GetUser, rest.Authenticate, rest.RateLimitMiddleware("users", rest.cfg.UsersRateLimit),
+		rest.UserAccessMiddleware, CacheControl(CachePrivate), rest.CacheMiddleware(rest.cfg.Cache, userCacheTags))
+
+	authn := g.Group("/auth", rest.RateLimitMiddleware("auth", rest.cfg.AuthRateLimit))
+	authn.POST("/login", rest.Login)
+	authn.POST("/refresh", rest.Refresh)
+	authn.POST("/password/forgot", rest.RequestPasswordReset)
+	authn.POST("/password/reset", rest.ResetPassword)
+	authn.POST("/email/verification", rest.RequestEmailVerification)
+	authn.POST("/email/verify", rest.VerifyEmail)
+	authn.POST("/magic-link", rest.RequestMagicLink)
+	authn.POST("/magic-link/login", rest.MagicLinkLogin)
+	authn.POST("/mfa/verify", rest.VerifyMFA)
+	authn.POST("/webauthn/options", rest.PasskeyLoginOptions, CacheControl(CacheNoStore))
+	authn.POST("/webauthn/login", rest.PasskeyLogin)
+
+	sessions := g.Group("/sessions", rest.Authenticate, CacheControl(CacheNoStore))
+	rest.listRoute(sessions.GET("", rest.ListSessions))
+	sessions.DELETE("", rest.DeleteSessions)
+	sessions.DELETE("/:id", rest.DeleteSession)
+
+	mfa := g.Group("/mfa", rest.Authenticate, rest.RateLimitMiddleware("auth", rest.cfg.AuthRateLimit), CacheControl(CacheNoStore))
+	mfa.POST("/totp", rest.EnrollTOTP)
+	mfa.POST("/totp/confirm", rest.ConfirmTOTP)
+	mfa.DELETE("/totp", rest.DeleteTOTP, RequireMFA(rest.cfg.MFA.StepUpMaxAge))
+	mfa.POST("/recovery-codes", rest.RegenerateRecoveryCodes, RequireMFA(rest.cfg.MFA.StepUpMaxAge))
+	mfa.POST("/step-up", rest.StepUp)
+
+	passkeys := g.Group("/webauthn", rest.Authenticate, rest.RateLimitMiddleware("auth", rest.cfg.AuthRateLimit), CacheControl(CacheNoStore))
+	passkeys.POST("/registration/options", rest.PasskeyRegistrationOptions)
+	passkeys.POST("/registration", rest.RegisterPasskey)
+	rest.listRoute(passkeys.GET("/credentials", rest.ListPasskeys))
+	passkeys.DELETE("/credentials/:id", rest.DeletePasskey)
+
+	admin := g.Group("/admin", rest.adminMiddlewares()...)
+	admin.Use(rest.IdempotencyMiddleware(rest.cfg.Idempotency))
+	rest.listRoute(admin.GET("/lockouts", rest.ListLockouts))
+	admin.DELETE("/lockouts/:type/:subject", rest.DeleteLockout)
+	rest.listRoute(admin.GET("/api-keys", rest.ListAPIKeys))
+	admin.POST("/api-keys", rest.CreateAPIKey)
+	admin.GET("/api-keys/:id", rest.GetAPIKey)
+	admin.PUT("/api-keys/:id", rest.UpdateAPIKey)
+	admin.DELETE("/api-keys/:id", rest.DeleteAPIKey)
+	rest.listRoute(admin.GET("/roles", rest.ListRoles))
+	admin.POST("/roles", rest.CreateRole)
+	admin.GET("/roles/:id", rest.GetRole)
+	admin.PUT("/roles/:id", rest.UpdateRole)
+	admin.DELETE("/roles/:id", rest.DeleteRole)
+	rest.listRoute(admin.GET("/users/:user_id/roles", rest.ListUserRoles))
+	admin.PUT("/users/:user_id/roles/:role_id", rest.AssignRole)
+	admin.DELETE("/users/:user_id/roles/:role_id", rest.UnassignRole)
+}
@@ -0,0 +1,308 @@
+package rest
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/efimovalex/replaceme/adapters/redisdb"
+	"github.com/efimovalex/replaceme/internal/apperr"
+	auth "github.com/efimovalex/replaceme/internal/auth0"
+	"github.com/labstack/echo/v4"
+)
+
+// SessionStore is the interface for the store of the sessions kept alive by refresh tokens
+type SessionStore interface {
+	CreateSession(ctx context.Context, s *redisdb.Session, refreshHash string, ttl time.Duration) error
+	AddSessionAccessToken(ctx context.Context, userID, sessionID, tokenID string, ttl time.Duration) error
+	RotateRefreshToken(ctx context.Context, refreshHash, newRefreshHash string, usedAt time.Time, ttl, accessTTL time.Duration) (*redisdb.Session, error)
+	ListSessions(ctx context.Context, userID string) ([]*redisdb.Session, error)
+	RevokeSession(ctx context.Context, userID, sessionID string, accessTTL time.Duration) (bool, error)
+	RevokeUserSessions(ctx context.Context, userID string, accessTTL time.Duration) error
+	IsTokenRevoked(ctx context.Context, userID, tokenID string) (bool, error)
+}
+
+// RefreshRequest is the request body of the refresh endpoint
+type RefreshRequest struct {
+	XMLName      xml.Name `json:"-" xml:"refresh"`
+	RefreshToken string   `json:"refresh_token" xml:"refresh_token" validate:"required,max=255"`
+}
+
+// DeleteSessionRequest are the path params of the delete session endpoint
+type DeleteSessionRequest struct {
+	ID string `param:"id" validate:"required,max=64"`
+}
+
+// Session is the public representation of a session
+type Session struct {
+	XMLName    xml.Name  `json:"-" xml:"session"`
+	ID         string    `json:"id" xml:"id"`
+	CreatedAt  time.Time `json:"created_at" xml:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at" xml:"last_used_at"`
+	UserAgent  string    `json:"user_agent" xml:"user_agent"`
+	IP         string    `json:"ip" xml:"ip"`
+	// Current is set on the session of the access token of the request
+	Current bool `json:"current" xml:"current"`
+}
+
+// Refresh rotates a refresh token and issues a new access token
+// @Summary [post] /auth/refresh
+// @Description Exchanges a refresh token for a new access token and a new refresh token, the presented refresh token
+// @Description can not be used again. Presenting a refresh token which was already rotated revokes its session.
+// @Tags auth
+// @Accept  json,application/msgpack,application/cbor,xml
+// @Produce json,application/msgpack,application/cbor,xml
+// @Param token body RefreshRequest true "refresh token"
+// @Success 200 {object} TokenResponse "Access and refresh tokens"
+// @Failure 400 {object} Problem "Invalid request JSON"
+// @Failure 401 {object} Problem "Invalid, expired or reused refresh token"
+// @Failure 422 {object} Problem "Params validation error"
+// @Failure 500 {object} Problem "Internal server error"
+// @Failure 503 {object} Problem "Session store unavailable"
+// @Router /auth/refresh [post]
+func (rest *R) Refresh(c echo.Context) error {
+	var req RefreshRequest
+	if err := rest.Bind(c, &req); err != nil {
+		return err
+	}
+	if rest.Sessions == nil {
+		return apperr.Unavailable(apperr.CodeUnavailable, "session store unavailable")
+	}
+
+	ctx := c.Request().Context()
+	refreshToken := newOpaqueToken()
+	s, err := rest.Sessions.RotateRefreshToken(ctx, hashToken(req.RefreshToken), hashToken(refreshToken),
+		time.Now(), rest.Tokens.RefreshTTL(), rest.Tokens.TTL())
+	if err != nil {
+		if errors.Is(err, redisdb.ErrRefreshTokenReused) {
+			return apperr.Unauthorized(apperr.CodeRefreshTokenReused, "refresh token was already used, the session is revoked")
+		}
+
+		return apperr.Unavailable(apperr.CodeUnavailable, "session store unavailable").Wrap(err)
+	}
+	if s == nil {
+		return apperr.Unauthorized(apperr.CodeInvalidRefreshToken, "invalid or expired refresh token")
+	}
+
+	// the user may have been deactivated since the login
+	id, err := strconv.Atoi(s.UserID)
+	if err != nil {
+		return apperr.Internal(err)
+	}
+	u, err := rest.DB.FindOneUserByID(ctx, id)
+	if err != nil {
+		return err
+	}
+	if u == nil || !u.Active {
+		if _, err := rest.Sessions.RevokeSession(ctx, s.UserID, s.ID, rest.Tokens.TTL()); err != nil {
+			return apperr.Unavailable(apperr.CodeUnavailable, "session store unavailable").Wrap(err)
+		}
+
+		return apperr.Unauthorized(apperr.CodeInvalidRefreshToken, "invalid or expired refresh token")
+	}
+
+	return rest.issueTokens(c, u, authentication{methods: s.AuthMethods, time: s.AuthTime}, s.ID, refreshToken)
+}
+
+// ListSessions returns the sessions of the authenticated user
+// @Summary [get] /sessions
+// @Description Returns the sessions of the authenticated user, most recently used first
+// @Tags sessions
+// @Accept  json
+// @Produce json,application/msgpack,application/cbor,xml
+// @Security BearerAuth
+// @Success 200 {array} Session "Sessions"
+// @Failure 401 {object} Problem "Invalid or revoked access token"
+// @Failure 403 {object} Problem "Token not issued by this service"
+// @Failure 500 {object} Problem "Internal server error"
+// @Failure 503 {object} Problem "Session store unavailable"
+// @Router /sessions [get]
+func (rest *R) ListSessions(c echo.Context) error {
+	ctx := c.Request().Context()
+	// the sessions are the ones of local users, a subject of another issuer is not one of them
+	userID, err := rest.localUserID(ctx)
+	if err != nil {
+		return err
+	}
+	if rest.Sessions == nil {
+		return apperr.Unavailable(apperr.CodeUnavailable, "session store unavailable")
+	}
+
+	sessions, err := rest.Sessions.ListSessions(ctx, userID)
+	if err != nil {
+		return apperr.Unavailable(apperr.CodeUnavailable, "session store unavailable").Wrap(err)
+	}
+	var current string
+	if claims, err := auth.ClaimsValue(ctx); err == nil {
+		current = claims.GetSessionID()
+	}
+
+	res := make([]Session, 0, len(sessions))
+	for _, s := range sessions {
+		res = append(res, Session{
+			ID:         s.ID,
+			CreatedAt:  s.CreatedAt,
+			LastUsedAt: s.LastUsedAt,
+			UserAgent:  s.UserAgent,
+			IP:         s.IP,
+			Current:    s.ID == current,
+		})
+	}
+
+	return rest.Render(c, http.StatusOK, res)
+}
+
+// DeleteSession revokes a session of the authenticated user
+// @Summary [delete] /sessions/{id}
+// @Description Revokes a session of the authenticated user, its refresh token and access tokens stop working
+// @Tags sessions
+// @Accept  json
+// @Produce json,application/msgpack,application/cbor,xml
+// @Security BearerAuth
+// @Param id path string true "session id"
+// @Success 204 "Session revoked"
+// @Failure 401 {object} Problem "Invalid or revoked access token"
+// @Failure 403 {object} Problem "Token not issued by this service"
+// @Failure 404 {object} Problem "Session not found"
+// @Failure 422 {object} Problem "Params validation error"
+// @Failure 500 {object} Problem "Internal server error"
+// @Failure 503 {object} Problem "Session store unavailable"
+// @Router /sessions/{id} [delete]
+func (rest *R) DeleteSession(c echo.Context) error {
+	var req DeleteSessionRequest
+	if err := rest.Bind(c, &req); err != nil {
+		return err
+	}
+	ctx := c.Request().Context()
+	// the sessions are the ones of local users, a subject of another issuer is not one of them
+	userID, err := rest.localUserID(ctx)
+	if err != nil {
+		return err
+	}
+	if rest.Sessions == nil {
+		return apperr.Unavailable(apperr.CodeUnavailable, "session store unavailable")
+	}
+
+	ok, err := rest.Sessions.RevokeSession(ctx, userID, req.ID, rest.Tokens.TTL())
+	if err != nil {
+		return apperr.Unavailable(apperr.CodeUnavailable, "session store unavailable").Wrap(err)
+	}
+	if !ok {
+		return apperr.NotFound(apperr.CodeSessionNotFound, "session not found")
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// DeleteSessions revokes all the sessions of the authenticated user
+// @Summary [delete] /sessions
+// @Description Logs the authenticated user out everywhere, all the refresh tokens and access tokens of its sessions stop working
+// @Tags sessions
+// @Accept  json
+// @Produce json,application/msgpack,application/cbor,xml
+// @Security BearerAuth
+// @Success 204 "Sessions revoked"
+// @Failure 401 {object} Problem "Invalid or revoked access token"
+// @Failure 403 {object} Problem "Token not issued by this service"
+// @Failure 500 {object} Problem "Internal server error"
+// @Failure 503 {object} Problem "Session store unavailable"
+// @Router /sessions [delete]
+func (rest *R) DeleteSessions(c echo.Context) error {
+	ctx := c.Request().Context()
+	// the sessions are the ones of local users, a subject of another issuer is not one of them
+	userID, err := rest.localUserID(ctx)
+	if err != nil {
+		return err
+	}
+	if rest.Sessions == nil {
+		return apperr.Unavailable(apperr.CodeUnavailable, "session store unavailable")
+	}
+
+	if err := rest.Sessions.RevokeUserSessions(ctx, userID, rest.Tokens.TTL()); err != nil {
+		return apperr.Unavailable(apperr.CodeUnavailable, "session store unavailable").Wrap(err)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// RevocationMiddleware rejects access tokens whose jti has been revoked, e.g. by a logout.
+// It runs after UserContextMiddleware and fails closed when the session store is unavailable.
+func (rest *R) RevocationMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if rest.Sessions == nil {
+			return next(c)
+		}
+		ctx := c.Request().Context()
+		claims, err := auth.ClaimsValue(ctx)
+		if err != nil {
+			return apperr.Unauthorized(apperr.CodeUnauthorized, "jwt missing").Wrap(err)
+		}
+		if claims.GetTokenID() == "" {
+			return next(c)
+		}
+		userID, err := auth.UserIDValue(ctx)
+		if err != nil {
+			return apperr.Unauthorized(apperr.CodeUnauthorized, "jwt invalid").Wrap(err)
+		}
+
+		revoked, err := rest.Sessions.IsTokenRevoked(ctx, userID, claims.GetTokenID())
+		if err != nil {
+			return apperr.Unavailable(apperr.CodeUnavailable, "session store unavailable").Wrap(err)
+		}
+		if revoked {
+			return apperr.Unauthorized(apperr.CodeTokenRevoked, "token has been revoked")
+		}
+
+		return next(c)
+	}
+}
+
+// startSession creates a session for the user, it returns the session id and its first refresh token.
+// No session is created without a session store, only access tokens are issued then.
+func (rest *R) startSession(c echo.Context, userID string, authn authentication) (string, string, error) {
+	if rest.Sessions == nil {
+		return "", "", nil
+	}
+
+	now := time.Now()
+	s := &redisdb.Session{
+		UserID:      userID,
+		CreatedAt:   now,
+		LastUsedAt:  now,
+		UserAgent:   c.Request().UserAgent(),
+		IP:          c.RealIP(),
+		AuthMethods: authn.methods,
+		AuthTime:    authn.time,
+	}
+	refreshToken := newOpaqueToken()
+	if err := rest.Sessions.CreateSession(c.Request().Context(), s, hashToken(refreshToken), rest.Tokens.RefreshTTL()); err != nil {
+		return "", "", apperr.Unavailable(apperr.CodeUnavailable, "session store unavailable").Wrap(err)
+	}
+
+	return s.ID, refreshToken, nil
+}
+
+// newOpaqueToken generates an opaque token, e.g. a refresh token or an emailed link token
+func newOpaqueToken() string {
+	b := make([]byte, 32)
+	// crypto/rand only fails when the OS has no entropy source
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// hashToken hashes an opaque token, only the hashes are stored
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,519 @@
+package rest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	jwtmiddleware "github.com/auth0/go-jwt-middleware/v2"
+	"github.com/auth0/go-jwt-middleware/v2/validator"
+	"github.com/efimovalex/replaceme/adapters/redisdb"
+	auth "github.com/efimovalex/replaceme/internal/auth0"
+	"github.com/efimovalex/replaceme/internal/auth0/authtest"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// mockSession is a session of the sessionStoreMock with its refresh token family and access tokens
+type mockSession struct {
+	redisdb.Session
+	refreshHash string
+	hashes      []string
+	tokenIDs    []string
+}
+
+// sessionStoreMock is an in-memory SessionStore
+type sessionStoreMock struct {
+	mu            sync.Mutex
+	sessions      map[string]*mockSession
+	refreshTokens map[string]string
+	revoked       map[string]bool
+	created       int
+	err           error
+}
+
+func newSessionStoreMock() *sessionStoreMock {
+	return &sessionStoreMock{sessions: map[string]*mockSession{}, refreshTokens: map[string]string{}, revoked: map[string]bool{}}
+}
+
+func (m *sessionStoreMock) CreateSession(ctx context.Context, s *redisdb.Session, refreshHash string, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return m.err
+	}
+	if s.ID == "" {
+		m.created++
+		s.ID = "session-" + strconv.Itoa(m.created)
+	}
+	m.sessions[s.ID] = &mockSession{Session: *s, refreshHash: refreshHash, hashes: []string{refreshHash}}
+	m.refreshTokens[refreshHash] = s.ID
+
+	return nil
+}
+
+func (m *sessionStoreMock) AddSessionAccessToken(ctx context.Context, userID, sessionID, tokenID string, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return m.err
+	}
+	if s, ok := m.sessions[sessionID]; ok && s.UserID == userID {
+		s.tokenIDs = append(s.tokenIDs, tokenID)
+	}
+
+	return nil
+}
+
+func (m *sessionStoreMock) RotateRefreshToken(ctx context.Context, refreshHash, newRefreshHash string, usedAt time.Time, ttl, accessTTL time.Duration) (*redisdb.Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return nil, m.err
+	}
+	s, ok := m.sessions[m.refreshTokens[refreshHash]]
+	if !ok {
+		return nil, nil
+	}
+	if s.refreshHash != refreshHash {
+		m.revoke(s.ID)
+		return nil, redisdb.ErrRefreshTokenReused
+	}
+	s.refreshHash = newRefreshHash
+	s.hashes = append(s.hashes, newRefreshHash)
+	s.LastUsedAt = usedAt
+	m.refreshTokens[newRefreshHash] = s.ID
+	session := s.Session
+
+	return &session, nil
+}
+
+func (m *sessionStoreMock) ListSessions(ctx context.Context, userID string) ([]*redisdb.Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return nil, m.err
+	}
+	var sessions []*redisdb.Session
+	for _, s := range m.sessions {
+		if s.UserID == userID {
+			session := s.Session
+			sessions = append(sessions, &session)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].ID < sessions[j].ID })
+
+	return sessions, nil
+}
+
+func (m *sessionStoreMock) RevokeSession(ctx context.Context, userID, sessionID string, accessTTL time.Duration) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return false, m.err
+	}
+	if s, ok := m.sessions[sessionID]; !ok || s.UserID != userID {
+		return false, nil
+	}
+	m.revoke(sessionID)
+
+	return true, nil
+}
+
+func (m *sessionStoreMock) RevokeUserSessions(ctx context.Context, userID string, accessTTL time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return m.err
+	}
+	for id, s := range m.sessions {
+		if s.UserID == userID {
+			m.revoke(id)
+		}
+	}
+
+	return nil
+}
+
+func (m *sessionStoreMock) IsTokenRevoked(ctx context.Context, userID, tokenID string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return false, m.err
+	}
+
+	return m.revoked[userID+" "+tokenID], nil
+}
+
+// revoke deletes a session and revokes its access tokens, the lock must be held
+func (m *sessionStoreMock) revoke(sessionID string) {
+	s := m.sessions[sessionID]
+	for _, id := range s.tokenIDs {
+		m.revoked[s.UserID+" "+id] = true
+	}
+	for _, hash := range s.hashes {
+		delete(m.refreshTokens, hash)
+	}
+	delete(m.sessions, sessionID)
+}
+
+// newTestSession stores a session of the user with the refresh token and returns an access token bound to it
+func newTestSession(t *testing.T, r *R, sessions *sessionStoreMock, userID, refreshToken string) (string, string) {
+	lastUsedAt := time.Date(2022, 7, 1, 10, 0, 0, 0, time.UTC)
+	s := &redisdb.Session{UserID: userID, CreatedAt: lastUsedAt, LastUsedAt: lastUsedAt, UserAgent: "curl/7.79.1", IP: "192.0.2.1"}
+	require.NoError(t, sessions.CreateSession(context.Background(), s, hashToken(refreshToken), time.Hour))
+
+	accessToken, err := r.Tokens.Issue(userID, map[string]interface{}{"email": "jane.doe@replaceme.com", auth.ClaimSessionID: s.ID})
+	require.NoError(t, err)
+	require.NoError(t, sessions.AddSessionAccessToken(context.Background(), userID, s.ID, accessToken.ID, r.Tokens.TTL()))
+
+	return s.ID, accessToken.Raw
+}
+
+func TestREST_Login_Session(t *testing.T) {
+	createdAt := time.Date(2022, 7, 1, 10, 0, 0, 0, time.UTC)
+	hash, err := bcrypt.GenerateFromPassword([]byte("s3cr3t-p4ss"), bcrypt.MinCost)
+	require.NoError(t, err)
+
+	r, mock := NewTestRESTWithMock(t)
+	sessions := newSessionStoreMock()
+	r.Sessions = sessions
+	mock.ExpectQuery(findActiveUserQuery).WithArgs("jane.doe@replaceme.com", true).WillReturnRows(sqlmock.NewRows(userColumns).
+		AddRow(1, "jane.doe@replaceme.com", string(hash), "", "Jane", "Doe", true, createdAt, createdAt))
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/auth/login", strings.NewReader(`{"email":"jane.doe@replaceme.com","password":"s3cr3t-p4ss"}`))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	req.Header.Set("User-Agent", "curl/7.79.1")
+	// without trusted proxies, the forwarded headers of the clients are ignored
+	req.Header.Set(echo.HeaderXForwardedFor, "203.0.113.7")
+	w := httptest.NewRecorder()
+	r.Router.ServeHTTP(w, req)
+
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	checkResponseWithTestDataFile(t, w.Body.Bytes(), []string{"access_token", "refresh_token"})
+
+	var res TokenResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+	require.NotEmpty(t, res.RefreshToken)
+	s, ok := sessions.sessions[sessions.refreshTokens[hashToken(res.RefreshToken)]]
+	require.True(t, ok, "the refresh token is stored hashed")
+	assert.Equal(t, "1", s.UserID)
+	assert.Equal(t, "curl/7.79.1", s.UserAgent)
+	assert.Equal(t, "192.0.2.1", s.IP)
+
+	parsed, err := jwt.ParseSigned(res.AccessToken)
+	require.NoError(t, err)
+	var claims struct {
+		jwt.Claims
+		SessionID string `json:"sid"`
+	}
+	require.NoError(t, parsed.UnsafeClaimsWithoutVerification(&claims))
+	assert.Equal(t, s.ID, claims.SessionID)
+	assert.Equal(t, []string{claims.ID}, s.tokenIDs)
+}
+
+func TestREST_Refresh(t *testing.T) {
+	createdAt := time.Date(2022, 7, 1, 10, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name               string
+		body               string
+		mock               func(mock sqlmock.Sqlmock)
+		storeErr           error
+		noStore            bool
+		expectedStatusCode int
+		revoked            bool
+	}{
+		{
+			name: "Success",
+			body: `{"refresh_token":"refresh-2"}`,
+			mock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(findUserByID).WithArgs(1).WillReturnRows(sqlmock.NewRows(userColumns).
+					AddRow(1, "jane.doe@replaceme.com", "", "", "Jane", "Doe", true, createdAt, createdAt))
+			},
+			expectedStatusCode: http.StatusOK,
+		},
+		{
+			name:               "Reused refresh token",
+			body:               `{"refresh_token":"refresh-1"}`,
+			mock:               func(mock sqlmock.Sqlmock) {},
+			expectedStatusCode: http.StatusUnauthorized,
+			revoked:            true,
+		},
+		{
+			name:               "Unknown refresh token",
+			body:               `{"refresh_token":"unknown"}`,
+			mock:               func(mock sqlmock.Sqlmock) {},
+			expectedStatusCode: http.StatusUnauthorized,
+		},
+		{
+			name: "Inactive user",
+			body: `{"refresh_token":"refresh-2"}`,
+			mock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(findUserByID).WithArgs(1).WillReturnRows(sqlmock.NewRows(userColumns).
+					AddRow(1, "jane.doe@replaceme.com", "", "", "Jane", "Doe", false, createdAt, createdAt))
+			},
+			expectedStatusCode: http.StatusUnauthorized,
+			revoked:            true,
+		},
+		{
+			name:               "Missing refresh token",
+			body:               `{}`,
+			mock:               func(mock sqlmock.Sqlmock) {},
+			expectedStatusCode: http.StatusUnprocessableEntity,
+		},
+		{
+			name:               "Session store failure",
+			body:               `{"refresh_token":"refresh-2"}`,
+			mock:               func(mock sqlmock.Sqlmock) {},
+			storeErr:           errors.New("connection refused"),
+			expectedStatusCode: http.StatusServiceUnavailable,
+		},
+		{
+			name:               "No session store",
+			body:               `{"refresh_token":"refresh-2"}`,
+			mock:               func(mock sqlmock.Sqlmock) {},
+			noStore:            true,
+			expectedStatusCode: http.StatusServiceUnavailable,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, mock := NewTestRESTWithMock(t)
+			tt.mock(mock)
+			sessions := newSessionStoreMock()
+			sessionID, accessToken := newTestSession(t, r, sessions, "1", "refresh-1")
+			_, err := sessions.RotateRefreshToken(context.Background(), hashToken("refresh-1"), hashToken("refresh-2"), createdAt, time.Hour, time.Minute)
+			require.NoError(t, err)
+			sessions.err = tt.storeErr
+			if !tt.noStore {
+				r.Sessions = sessions
+			}
+
+			req := httptest.NewRequest(http.MethodPost, "/v1/auth/refresh", strings.NewReader(tt.body))
+			req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+			w := httptest.NewRecorder()
+			r.Router.ServeHTTP(w, req)
+
+			assert.Equal(t, tt.expectedStatusCode, w.Code)
+			checkResponseWithTestDataFile(t, w.Body.Bytes(), []string{"access_token", "refresh_token", "correlation_id"})
+
+			sessions.err = nil
+			revoked, err := sessions.IsTokenRevoked(context.Background(), "1", jwtID(t, accessToken))
+			require.NoError(t, err)
+			assert.Equal(t, tt.revoked, revoked)
+			if tt.revoked {
+				assert.NotContains(t, sessions.sessions, sessionID)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+
+			var res TokenResponse
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+			assert.NotEqual(t, "refresh-2", res.RefreshToken)
+			assert.Equal(t, sessionID, sessions.refreshTokens[hashToken(res.RefreshToken)])
+			assert.Contains(t, sessions.sessions[sessionID].tokenIDs, jwtID(t, res.AccessToken))
+		})
+	}
+}
+
+// jwtID returns the jti claim of a token
+func jwtID(t *testing.T, token string) string {
+	parsed, err := jwt.ParseSigned(token)
+	require.NoError(t, err)
+	var claims jwt.Claims
+	require.NoError(t, parsed.UnsafeClaimsWithoutVerification(&claims))
+
+	return claims.ID
+}
+
+func TestREST_Sessions(t *testing.T) {
+	tests := []struct {
+		name               string
+		method             string
+		path               string
+		revoked            bool
+		storeErr           error
+		expectedStatusCode int
+		expectedSessions   []string
+	}{
+		{
+			name:               "List",
+			method:             http.MethodGet,
+			path:               "/v1/sessions",
+			expectedStatusCode: http.StatusOK,
+			expectedSessions:   []string{"session-1", "session-2"},
+		},
+		{
+			name:               "Delete another session",
+			method:             http.MethodDelete,
+			path:               "/v1/sessions/session-2",
+			expectedStatusCode: http.StatusNoContent,
+			expectedSessions:   []string{"session-1"},
+		},
+		{
+			name:               "Delete a session of another user",
+			method:             http.MethodDelete,
+			path:               "/v1/sessions/session-3",
+			expectedStatusCode: http.StatusNotFound,
+			expectedSessions:   []string{"session-1", "session-2"},
+		},
+		{
+			name:               "Log out everywhere",
+			method:             http.MethodDelete,
+			path:               "/v1/sessions",
+			expectedStatusCode: http.StatusNoContent,
+		},
+		{
+			name:               "Revoked access token",
+			method:             http.MethodGet,
+			path:               "/v1/sessions",
+			revoked:            true,
+			expectedStatusCode: http.StatusUnauthorized,
+			expectedSessions:   []string{"session-2"},
+		},
+		{
+			name:               "Session store failure",
+			method:             http.MethodGet,
+			path:               "/v1/sessions",
+			storeErr:           errors.New("connection refused"),
+			expectedStatusCode: http.StatusServiceUnavailable,
+			expectedSessions:   []string{"session-1", "session-2"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewTestREST(t)
+			sessions := newSessionStoreMock()
+			r.Sessions = sessions
+			current, accessToken := newTestSession(t, r, sessions, "42", "refresh-1")
+			newTestSession(t, r, sessions, "42", "refresh-2")
+			newTestSession(t, r, sessions, "43", "refresh-3")
+			if tt.revoked {
+				ok, err := sessions.RevokeSession(context.Background(), "42", current, time.Minute)
+				require.NoError(t, err)
+				require.True(t, ok)
+			}
+			sessions.err = tt.storeErr
+
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			req.Header.Set(echo.HeaderAuthorization, "Bearer "+accessToken)
+			w := httptest.NewRecorder()
+			r.Router.ServeHTTP(w, req)
+
+			assert.Equal(t, tt.expectedStatusCode, w.Code)
+			checkResponseWithTestDataFile(t, w.Body.Bytes(), []string{"correlation_id"})
+			if w.Code == http.StatusOK {
+				assert.Equal(t, CacheNoStore, w.Header().Get(echo.HeaderCacheControl))
+			}
+
+			sessions.err = nil
+			got, err := sessions.ListSessions(context.Background(), "42")
+			require.NoError(t, err)
+			var ids []string
+			for _, s := range got {
+				ids = append(ids, s.ID)
+			}
+			assert.Equal(t, tt.expectedSessions, ids)
+		})
+	}
+}
+
+func TestREST_Sessions_CSV(t *testing.T) {
+	r := NewTestREST(t)
+	sessions := newSessionStoreMock()
+	r.Sessions = sessions
+	_, accessToken := newTestSession(t, r, sessions, "42", "refresh-1")
+
+	req := httptest.NewRequest(http.MethodGet, "/v1/sessions", nil)
+	req.Header.Set(echo.HeaderAuthorization, "Bearer "+accessToken)
+	req.Header.Set(echo.HeaderAccept, MIMETextCSV)
+	w := httptest.NewRecorder()
+	r.Router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, "text/csv; charset=UTF-8", w.Header().Get(echo.HeaderContentType))
+	assert.True(t, strings.HasPrefix(w.Body.String(), "id,"), w.Body.String())
+}
+
+func TestREST_Sessions_OtherIssuer(t *testing.T) {
+	issuer := authtest.NewIssuer(t)
+	r, _ := NewTestRESTWithIssuer(t, issuer)
+	sessions := newSessionStoreMock()
+	r.Sessions = sessions
+	r.SetupRouter()
+	newTestSession(t, r, sessions, "1", "refresh-1")
+	// the subject of the other issuer looks like the id of the local user 1
+	accessToken := issuer.Token(t, authtest.Claims{"sub": "1"})
+
+	for _, route := range []struct{ method, path string }{
+		{http.MethodGet, "/v1/sessions"},
+		{http.MethodDelete, "/v1/sessions/session-1"},
+		{http.MethodDelete, "/v1/sessions"},
+	} {
+		t.Run(route.method+" "+route.path, func(t *testing.T) {
+			req := httptest.NewRequest(route.method, route.path, nil)
+			req.Header.Set(echo.HeaderAuthorization, "Bearer "+accessToken)
+			w := httptest.NewRecorder()
+			r.Router.ServeHTTP(w, req)
+
+			assert.Equal(t, http.StatusForbidden, w.Code, w.Body.String())
+			assert.NotContains(t, w.Body.String(), "192.0.2.1")
+			assert.Contains(t, sessions.sessions, "session-1", "the sessions of the local user are kept")
+		})
+	}
+}
+
+func TestR_RevocationMiddleware(t *testing.T) {
+	r := NewTestREST(t)
+	sessions := newSessionStoreMock()
+	sessions.revoked["42 revoked"] = true
+	r.Sessions = sessions
+	e := echo.New()
+	e.HTTPErrorHandler = r.HTTPErrorHandler
+	e.GET("/", func(c echo.Context) error { return c.NoContent(http.StatusNoContent) }, r.RevocationMiddleware)
+
+	tests := []struct {
+		name               string
+		claims             auth.CustomClaims
+		expectedStatusCode int
+	}{
+		{name: "Token without jti", claims: auth.CustomClaims{"sub": "42"}, expectedStatusCode: http.StatusNoContent},
+		{name: "Valid token", claims: auth.CustomClaims{"sub": "42", "jti": "valid"}, expectedStatusCode: http.StatusNoContent},
+		{name: "Revoked token", claims: auth.CustomClaims{"sub": "42", "jti": "revoked"}, expectedStatusCode: http.StatusUnauthorized},
+		{name: "Same jti of another user", claims: auth.CustomClaims{"sub": "43", "jti": "revoked"}, expectedStatusCode: http.StatusNoContent},
+		{name: "Missing user", claims: auth.CustomClaims{"jti": "revoked"}, expectedStatusCode: http.StatusUnauthorized},
+		{name: "Missing claims", expectedStatusCode: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.claims != nil {
+				claims := &validator.ValidatedClaims{CustomClaims: &tt.claims}
+				ctx := context.WithValue(req.Context(), jwtmiddleware.ContextKey{}, claims)
+				// set by UserContextMiddleware
+				if sub, ok := tt.claims["sub"].(string); ok {
+					ctx = auth.WithUserID(ctx, sub)
+				}
+				req = req.WithContext(ctx)
+			}
+			w := httptest.NewRecorder()
+			e.ServeHTTP(w, req)
+
+			assert.Equal(t, tt.expectedStatusCode, w.Code, w.Body.String())
+		})
+	}
+}
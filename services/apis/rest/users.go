@@ -0,0 +1,179 @@
+package rest
+
+import (
+	"context"
+	"encoding/xml"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/efimovalex/replaceme/adapters/postgres"
+	"github.com/efimovalex/replaceme/internal/apperr"
+	"github.com/efimovalex/replaceme/internal/requestid"
+	"github.com/go-playground/validator/v10"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// uniqueEmailTag is the validation rule that checks the email is not used by another user
+	uniqueEmailTag = "unique_email"
+	// usersCacheTag tags every cached response listing or containing users
+	usersCacheTag = "users"
+	// permissionReadUsers lets the callers read the accounts of the other users
+	permissionReadUsers = "users:read"
+)
+
+// CreateUserRequest is the request body for creating a new user
+type CreateUserRequest struct {
+	XMLName     xml.Name `json:"-" xml:"user"`
+	Email       string   `json:"email" xml:"email" validate:"required,email,max=255,unique_email" format:"email" example:"jane.doe@replaceme.com"`
+	Password    string   `json:"password" xml:"password" validate:"required,min=8,max=72" example:"s3cr3t-p4ss"`
+	FirstName   string   `json:"first_name" xml:"first_name" validate:"required,max=255" example:"Jane"`
+	LastName    string   `json:"last_name" xml:"last_name" validate:"required,max=255" example:"Doe"`
+	Description string   `json:"description" xml:"description" validate:"max=255" example:"Loves go"`
+}
+
+// GetUserRequest are the path params of the get user endpoint
+type GetUserRequest struct {
+	ID int `param:"id" validate:"min=1"`
+}
+
+// User is the public representation of a user
+type User struct {
+	XMLName     xml.Name  `json:"-" xml:"user"`
+	ID          int       `json:"id" xml:"id"`
+	Email       string    `json:"email" xml:"email"`
+	FirstName   string    `json:"first_name" xml:"first_name"`
+	LastName    string    `json:"last_name" xml:"last_name"`
+	Description string    `json:"description" xml:"description"`
+	Active      bool      `json:"active" xml:"active"`
+	CreatedAt   time.Time `json:"created_at" xml:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at" xml:"updated_at"`
+}
+
+// newUser creates the public representation of a database user
+func newUser(u *postgres.User) User {
+	return User{
+		ID:          u.ID,
+		Email:       u.Email,
+		FirstName:   u.FirstName,
+		LastName:    u.LastName,
+		Description: u.Description,
+		Active:      u.Active,
+		CreatedAt:   u.CreatedAt,
+		UpdatedAt:   u.UpdatedAt,
+	}
+}
+
+// CreateUser creates a new user
+// @Summary [post] /users
+// @Description Creates a new active user and emails a link to verify the email
+// @Tags users
+// @Accept  json,application/msgpack,application/cbor,xml
+// @Produce json,application/msgpack,application/cbor,xml
+// @Param Idempotency-Key header string false "Key making retries of the request safe"
+// @Param user body CreateUserRequest true "user"
+// @Success 201 {object} User "Created user"
+// @Failure 400 {object} Problem "Invalid request JSON"
+// @Failure 409 {object} Problem "User with email already exists"
+// @Failure 422 {object} Problem "Params validation error"
+// @Failure 500 {object} Problem "Internal server error"
+// @Router /users [post]
+func (rest *R) CreateUser(c echo.Context) error {
+	var req CreateUserRequest
+	if err := rest.Bind(c, &req); err != nil {
+		return err
+	}
+
+	u := &postgres.User{
+		Email:       req.Email,
+		Password:    req.Password,
+		FirstName:   req.FirstName,
+		LastName:    req.LastName,
+		Description: req.Description,
+		Active:      true,
+	}
+	if err := rest.DB.InsertUser(c.Request().Context(), u); err != nil {
+		return err
+	}
+	rest.InvalidateCache(c.Request().Context(), usersCacheTag, userCacheTag(strconv.Itoa(u.ID)))
+	rest.sendUserToken(c, u, tokenPurposeEmailVerification, "")
+
+	return rest.Render(c, http.StatusCreated, newUser(u))
+}
+
+// GetUser returns a user by id
+// @Summary [get] /users/{id}
+// @Description Returns a user, responses carry an ETag and are revalidated with If-None-Match. Users read their own
+// @Description account with a token of this service, the other users need the users:read permission.
+// @Tags users
+// @Accept  json
+// @Produce json,application/msgpack,application/cbor,xml
+// @Security BearerAuth
+// @Param id path int true "user id" minimum(1)
+// @Param If-None-Match header string false "ETag of the cached representation"
+// @Success 200 {object} User "User"
+// @Success 304 "Not modified"
+// @Failure 400 {object} Problem "Invalid request params"
+// @Failure 401 {object} Problem "Invalid or revoked access token"
+// @Failure 403 {object} Problem "Missing the users:read permission"
+// @Failure 404 {object} Problem "User not found"
+// @Failure 422 {object} Problem "Params validation error"
+// @Failure 500 {object} Problem "Internal server error"
+// @Router /users/{id} [get]
+func (rest *R) GetUser(c echo.Context) error {
+	var req GetUserRequest
+	if err := rest.Bind(c, &req); err != nil {
+		return err
+	}
+
+	u, err := rest.DB.FindOneUserByID(c.Request().Context(), req.ID)
+	if err != nil {
+		return err
+	}
+	if u == nil {
+		return apperr.NotFound(apperr.CodeUserNotFound, "user not found")
+	}
+
+	return rest.Render(c, http.StatusOK, newUser(u))
+}
+
+// UserAccessMiddleware lets the users read their own account, the other callers need the users:read permission.
+// It runs after Authenticate and before CacheMiddleware, so that the cached responses are only served to the callers
+// allowed to read them.
+func (rest *R) UserAccessMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+		if userID, err := rest.localUserID(ctx); err == nil && userID == c.Param("id") {
+			return next(c)
+		}
+		if err := rest.CheckPermission(ctx, permissionReadUsers); err != nil {
+			return err
+		}
+
+		return next(c)
+	}
+}
+
+// userCacheTags tags a cached user response with the user id
+func userCacheTags(c echo.Context) []string {
+	return []string{userCacheTag(c.Param("id"))}
+}
+
+// userCacheTag is the cache tag of a single user
+func userCacheTag(id string) string {
+	return "user:" + id
+}
+
+// uniqueEmail validates that no user is registered with the field value.
+// Database failures are logged and let through, InsertUser enforces uniqueness anyway.
+func (rest *R) uniqueEmail(ctx context.Context, fl validator.FieldLevel) bool {
+	u, err := rest.DB.FindOneUserByEmail(ctx, fl.Field().String(), nil)
+	if err != nil {
+		requestid.Logger(ctx, rest.logger).Error().Err(err).Msg("failed to check email uniqueness")
+
+		return true
+	}
+
+	return u == nil
+}
@@ -0,0 +1,278 @@
+package rest
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/efimovalex/replaceme/config"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	findUserQuery   = regexp.QuoteMeta(`SELECT * FROM users WHERE email = $1 LIMIT 1`)
+	findUserByID    = regexp.QuoteMeta(`SELECT * FROM users WHERE id = $1 LIMIT 1`)
+	insertUserQuery = regexp.QuoteMeta(`INSERT INTO users (email,password,description,first_name,last_name,active)`)
+	userColumns     = []string{"id", "email", "password", "description", "first_name", "last_name", "active", "created_at", "updated_at"}
+)
+
+func TestREST_CreateUser(t *testing.T) {
+	createdAt := time.Date(2022, 7, 1, 10, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name               string
+		body               string
+		mock               func(mock sqlmock.Sqlmock)
+		expectedStatusCode int
+	}{
+		{
+			name: "Success",
+			body: `{"email":"jane.doe@replaceme.com","password":"s3cr3t-p4ss","first_name":"Jane","last_name":"Doe"}`,
+			mock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(findUserQuery).WithArgs("jane.doe@replaceme.com").WillReturnRows(sqlmock.NewRows(userColumns))
+				mock.ExpectQuery(findUserQuery).WithArgs("jane.doe@replaceme.com").WillReturnRows(sqlmock.NewRows(userColumns))
+				mock.ExpectQuery(insertUserQuery).WillReturnRows(sqlmock.NewRows(userColumns).
+					AddRow(1, "jane.doe@replaceme.com", "hash", "", "Jane", "Doe", true, createdAt, createdAt))
+			},
+			expectedStatusCode: http.StatusCreated,
+		},
+		{
+			name:               "Invalid JSON",
+			body:               `{"email":`,
+			mock:               func(mock sqlmock.Sqlmock) {},
+			expectedStatusCode: http.StatusBadRequest,
+		},
+		{
+			name:               "Every invalid field is listed",
+			body:               `{"email":"not-an-email","password":"short","last_name":"Doe"}`,
+			mock:               func(mock sqlmock.Sqlmock) {},
+			expectedStatusCode: http.StatusUnprocessableEntity,
+		},
+		{
+			name: "Email already taken",
+			body: `{"email":"jane.doe@replaceme.com","password":"s3cr3t-p4ss","first_name":"Jane","last_name":"Doe"}`,
+			mock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(findUserQuery).WithArgs("jane.doe@replaceme.com").WillReturnRows(sqlmock.NewRows(userColumns).
+					AddRow(1, "jane.doe@replaceme.com", "hash", "", "Jane", "Doe", true, createdAt, createdAt))
+			},
+			expectedStatusCode: http.StatusUnprocessableEntity,
+		},
+		{
+			name: "Email taken by a concurrent request",
+			body: `{"email":"jane.doe@replaceme.com","password":"s3cr3t-p4ss","first_name":"Jane","last_name":"Doe"}`,
+			mock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(findUserQuery).WithArgs("jane.doe@replaceme.com").WillReturnError(errors.New("connection reset"))
+				mock.ExpectQuery(findUserQuery).WithArgs("jane.doe@replaceme.com").WillReturnRows(sqlmock.NewRows(userColumns).
+					AddRow(1, "jane.doe@replaceme.com", "hash", "", "Jane", "Doe", true, createdAt, createdAt))
+			},
+			expectedStatusCode: http.StatusConflict,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, mock := NewTestRESTWithMock(t)
+			tt.mock(mock)
+
+			req := httptest.NewRequest(http.MethodPost, "/users", strings.NewReader(tt.body))
+			req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+			w := httptest.NewRecorder()
+			r.Router.ServeHTTP(w, req)
+
+			assert.Equal(t, tt.expectedStatusCode, w.Code, "body:\n%s", w.Body.String())
+			checkResponseWithTestDataFile(t, w.Body.Bytes(), []string{"correlation_id"})
+		})
+	}
+}
+
+func TestREST_CreateUser_Idempotency(t *testing.T) {
+	createdAt := time.Date(2022, 7, 1, 10, 0, 0, 0, time.UTC)
+	r, mock := NewTestRESTWithMock(t)
+	r.cfg.Idempotency = config.Idempotency{Enable: true, TTL: time.Hour, LockTTL: time.Minute, LockWait: time.Second}
+	r.Idempotency = newIdempotencyStoreMock()
+	r.SetupRouter()
+	// the user is created once
+	mock.ExpectQuery(findUserQuery).WithArgs("jane.doe@replaceme.com").WillReturnRows(sqlmock.NewRows(userColumns))
+	mock.ExpectQuery(findUserQuery).WithArgs("jane.doe@replaceme.com").WillReturnRows(sqlmock.NewRows(userColumns))
+	mock.ExpectQuery(insertUserQuery).WillReturnRows(sqlmock.NewRows(userColumns).
+		AddRow(1, "jane.doe@replaceme.com", "hash", "", "Jane", "Doe", true, createdAt, createdAt))
+
+	create := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/users", strings.NewReader(`{"email":"jane.doe@replaceme.com","password":"s3cr3t-p4ss","first_name":"Jane","last_name":"Doe"}`))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		req.Header.Set(HeaderIdempotencyKey, "signup-1")
+		w := httptest.NewRecorder()
+		r.Router.ServeHTTP(w, req)
+
+		return w
+	}
+
+	first := create()
+	assert.Equal(t, http.StatusCreated, first.Code, first.Body.String())
+	retry := create()
+	assert.Equal(t, http.StatusCreated, retry.Code, retry.Body.String())
+	assert.Equal(t, "true", retry.Header().Get(HeaderIdempotentReplayed))
+	assert.Equal(t, first.Body.String(), retry.Body.String())
+}
+
+func TestREST_CreateUser_ContentTypes(t *testing.T) {
+	createdAt := time.Date(2022, 7, 1, 10, 0, 0, 0, time.UTC)
+	req := CreateUserRequest{Email: "jane.doe@replaceme.com", Password: "s3cr3t-p4ss", FirstName: "Jane", LastName: "Doe"}
+
+	for _, contentType := range []string{MIMEApplicationMsgpack, MIMEApplicationCBOR, echo.MIMEApplicationXML} {
+		t.Run(contentType, func(t *testing.T) {
+			r, mock := NewTestRESTWithMock(t)
+			mock.ExpectQuery(findUserQuery).WithArgs("jane.doe@replaceme.com").WillReturnRows(sqlmock.NewRows(userColumns))
+			mock.ExpectQuery(findUserQuery).WithArgs("jane.doe@replaceme.com").WillReturnRows(sqlmock.NewRows(userColumns))
+			mock.ExpectQuery(insertUserQuery).WillReturnRows(sqlmock.NewRows(userColumns).
+				AddRow(1, "jane.doe@replaceme.com", "hash", "", "Jane", "Doe", true, createdAt, createdAt))
+
+			codec, _ := r.codecs.Lookup(contentType)
+			body, err := codec.Marshal(req)
+			assert.NoError(t, err)
+
+			httpReq := httptest.NewRequest(http.MethodPost, "/users", bytes.NewReader(body))
+			httpReq.Header.Set(echo.HeaderContentType, contentType)
+			httpReq.Header.Set(echo.HeaderAccept, contentType)
+			w := httptest.NewRecorder()
+			r.Router.ServeHTTP(w, httpReq)
+
+			assert.Equal(t, http.StatusCreated, w.Code, "body:\n%s", w.Body.String())
+			assert.Equal(t, codec.ContentType(), w.Header().Get(echo.HeaderContentType))
+
+			var created User
+			assert.NoError(t, codec.Decode(w.Body, &created))
+			assert.Equal(t, 1, created.ID)
+			assert.Equal(t, "jane.doe@replaceme.com", created.Email)
+		})
+	}
+
+	t.Run("Unsupported media type", func(t *testing.T) {
+		r := NewTestREST(t)
+
+		httpReq := httptest.NewRequest(http.MethodPost, "/users", strings.NewReader("email,password"))
+		httpReq.Header.Set(echo.HeaderContentType, MIMETextCSV)
+		w := httptest.NewRecorder()
+		r.Router.ServeHTTP(w, httpReq)
+
+		assert.Equal(t, http.StatusUnsupportedMediaType, w.Code)
+	})
+
+	t.Run("Media type of lists only", func(t *testing.T) {
+		// no query is expected, the user must not be created
+		r, _ := NewTestRESTWithMock(t)
+
+		httpReq := httptest.NewRequest(http.MethodPost, "/users", strings.NewReader(`{"email":"jane.doe@replaceme.com","password":"s3cr3t-p4ssw0rd"}`))
+		httpReq.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		httpReq.Header.Set(echo.HeaderAccept, MIMETextCSV)
+		w := httptest.NewRecorder()
+		r.Router.ServeHTTP(w, httpReq)
+
+		assert.Equal(t, http.StatusNotAcceptable, w.Code, "the request is rejected before the user is created")
+	})
+}
+
+func TestREST_GetUser(t *testing.T) {
+	createdAt := time.Date(2022, 7, 1, 10, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name string
+		path string
+		// userID is the subject of the access token of the request, user 9 has the users:read permission
+		userID             string
+		mock               func(mock sqlmock.Sqlmock)
+		expectedStatusCode int
+	}{
+		{
+			name:   "Success",
+			path:   "/users/1",
+			userID: "1",
+			mock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(findUserByID).WithArgs(1).WillReturnRows(sqlmock.NewRows(userColumns).
+					AddRow(1, "jane.doe@replaceme.com", "hash", "", "Jane", "Doe", true, createdAt, createdAt))
+			},
+			expectedStatusCode: http.StatusOK,
+		},
+		{
+			name:   "Success with permission",
+			path:   "/users/1",
+			userID: "9",
+			mock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(findUserByID).WithArgs(1).WillReturnRows(sqlmock.NewRows(userColumns).
+					AddRow(1, "jane.doe@replaceme.com", "hash", "", "Jane", "Doe", true, createdAt, createdAt))
+			},
+			expectedStatusCode: http.StatusOK,
+		},
+		{
+			name:   "Not found",
+			path:   "/users/2",
+			userID: "2",
+			mock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(findUserByID).WithArgs(2).WillReturnRows(sqlmock.NewRows(userColumns))
+			},
+			expectedStatusCode: http.StatusNotFound,
+		},
+		{
+			name:               "Invalid id",
+			path:               "/users/jane",
+			userID:             "9",
+			mock:               func(mock sqlmock.Sqlmock) {},
+			expectedStatusCode: http.StatusBadRequest,
+		},
+		{
+			name:               "Id out of range",
+			path:               "/users/0",
+			userID:             "9",
+			mock:               func(mock sqlmock.Sqlmock) {},
+			expectedStatusCode: http.StatusUnprocessableEntity,
+		},
+		{
+			name:               "Anonymous",
+			path:               "/users/1",
+			mock:               func(mock sqlmock.Sqlmock) {},
+			expectedStatusCode: http.StatusUnauthorized,
+		},
+		{
+			name:               "Another user",
+			path:               "/users/1",
+			userID:             "2",
+			mock:               func(mock sqlmock.Sqlmock) {},
+			expectedStatusCode: http.StatusForbidden,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, mock := NewTestRESTWithMock(t)
+			cache := newPermissionCacheMock()
+			cache.permissions[testTokenConfig.Issuer+" 2"] = []string{}
+			cache.permissions[testTokenConfig.Issuer+" 9"] = []string{permissionReadUsers}
+			r.PermissionCache = cache
+			tt.mock(mock)
+
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.userID != "" {
+				accessToken, err := r.Tokens.Issue(tt.userID, nil)
+				require.NoError(t, err)
+				req.Header.Set(echo.HeaderAuthorization, "Bearer "+accessToken.Raw)
+			}
+			w := httptest.NewRecorder()
+			r.Router.ServeHTTP(w, req)
+
+			assert.Equal(t, tt.expectedStatusCode, w.Code, "body:\n%s", w.Body.String())
+			checkResponseWithTestDataFile(t, w.Body.Bytes(), []string{"correlation_id"})
+			if w.Code == http.StatusOK {
+				assert.Equal(t, CachePrivate, w.Header().Get(echo.HeaderCacheControl))
+				assert.NotEmpty(t, w.Header().Get(HeaderETag))
+			} else {
+				assert.Equal(t, CacheNoStore, w.Header().Get(echo.HeaderCacheControl))
+			}
+		})
+	}
+}
@@ -0,0 +1,138 @@
+package rest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"github.com/efimovalex/replaceme/internal/apperr"
+	"github.com/go-playground/validator/v10"
+	"github.com/labstack/echo/v4"
+)
+
+// indexRegexp matches the slice and map indexes of a validator namespace, e.g. items[0]
+var indexRegexp = regexp.MustCompile(`\[([^\]]*)\]`)
+
+// Validator validates request structs using struct-tag rules.
+// It implements echo.Validator.
+type Validator struct {
+	validate *validator.Validate
+}
+
+// NewValidator creates a new Validator that reports fields by their json, query or param name
+func NewValidator() *Validator {
+	v := validator.New()
+	v.RegisterTagNameFunc(func(f reflect.StructField) string {
+		for _, tag := range []string{"json", "query", "param", "form"} {
+			name := strings.SplitN(f.Tag.Get(tag), ",", 2)[0]
+			if name == "-" {
+				return ""
+			}
+			if name != "" {
+				return name
+			}
+		}
+
+		return f.Name
+	})
+
+	return &Validator{validate: v}
+}
+
+// RegisterValidationCtx registers a custom validation rule for the given tag
+func (v *Validator) RegisterValidationCtx(tag string, fn validator.FuncCtx) error {
+	return v.validate.RegisterValidationCtx(tag, fn)
+}
+
+// Validate validates i, see ValidateCtx.
+func (v *Validator) Validate(i interface{}) error {
+	return v.ValidateCtx(context.Background(), i)
+}
+
+// ValidateCtx validates i and returns an apperr.KindValidation error listing every invalid field.
+func (v *Validator) ValidateCtx(ctx context.Context, i interface{}) error {
+	err := v.validate.StructCtx(ctx, i)
+	if err == nil {
+		return nil
+	}
+
+	var verrs validator.ValidationErrors
+	if !errors.As(err, &verrs) {
+		return apperr.Internal(err)
+	}
+
+	fields := make([]apperr.FieldError, 0, len(verrs))
+	for _, fe := range verrs {
+		fields = append(fields, apperr.FieldError{
+			Pointer: jsonPointer(fe.Namespace()),
+			Rule:    fe.Tag(),
+			Detail:  fieldErrorDetail(fe),
+		})
+	}
+
+	return apperr.Validation(apperr.CodeValidation, "request validation failed").WithFields(fields...)
+}
+
+// Bind binds the request path, query and body into v and validates the result.
+// Malformed requests result in a 400, invalid fields in a 422.
+func (rest *R) Bind(c echo.Context, v interface{}) error {
+	if err := c.Bind(v); err != nil {
+		return err
+	}
+
+	return rest.validator.ValidateCtx(c.Request().Context(), v)
+}
+
+// jsonPointer converts a validator namespace, e.g. Request.items[0].name, into a JSON pointer, e.g. /items/0/name
+func jsonPointer(namespace string) string {
+	// drop the top level struct name
+	if i := strings.Index(namespace, "."); i >= 0 {
+		namespace = namespace[i+1:]
+	}
+	namespace = indexRegexp.ReplaceAllString(namespace, ".$1")
+
+	var b strings.Builder
+	for _, token := range strings.Split(namespace, ".") {
+		// escape as defined by RFC 6901
+		token = strings.ReplaceAll(token, "~", "~0")
+		token = strings.ReplaceAll(token, "/", "~1")
+		b.WriteString("/" + token)
+	}
+
+	return b.String()
+}
+
+// fieldErrorDetail returns a human readable message for the failed rule
+func fieldErrorDetail(fe validator.FieldError) string {
+	isString := fe.Kind() == reflect.String
+	switch fe.Tag() {
+	case "required":
+		return "is required"
+	case "email":
+		return "must be a valid email address"
+	case "min", "gte":
+		if isString {
+			return fmt.Sprintf("must be at least %s characters long", fe.Param())
+		}
+		return fmt.Sprintf("must be at least %s", fe.Param())
+	case "max", "lte":
+		if isString {
+			return fmt.Sprintf("must be at most %s characters long", fe.Param())
+		}
+		return fmt.Sprintf("must be at most %s", fe.Param())
+	case "len":
+		if isString {
+			return fmt.Sprintf("must be exactly %s characters long", fe.Param())
+		}
+		return fmt.Sprintf("must contain exactly %s items", fe.Param())
+	case "oneof":
+		return fmt.Sprintf("must be one of: %s", strings.Join(strings.Fields(fe.Param()), ", "))
+	case uniqueEmailTag:
+		return "is already taken"
+	default:
+		return fmt.Sprintf("failed on the '%s' rule", fe.Tag())
+	}
+}
@@ -0,0 +1,55 @@
+package rest
+
+import (
+	"testing"
+
+	"github.com/efimovalex/replaceme/internal/apperr"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_jsonPointer(t *testing.T) {
+	tests := []struct {
+		namespace string
+		want      string
+	}{
+		{namespace: "CreateUserRequest.email", want: "/email"},
+		{namespace: "Request.address.street", want: "/address/street"},
+		{namespace: "Request.items[2].name", want: "/items/2/name"},
+		{namespace: "Request.labels[a/b~c]", want: "/labels/a~1b~0c"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.namespace, func(t *testing.T) {
+			assert.Equal(t, tt.want, jsonPointer(tt.namespace))
+		})
+	}
+}
+
+func TestValidator_Validate(t *testing.T) {
+	type item struct {
+		Name string `json:"name" validate:"required"`
+	}
+	type request struct {
+		Kind  string `json:"kind" validate:"oneof=admin user"`
+		Code  string `json:"code" validate:"len=4"`
+		Items []item `json:"items" validate:"min=1,dive"`
+		Skip  string `json:"-" validate:"required"`
+	}
+
+	v := NewValidator()
+
+	err := v.Validate(&request{
+		Kind:  "guest",
+		Code:  "123",
+		Items: []item{{Name: "a"}, {}},
+		Skip:  "set",
+	})
+	assert.True(t, apperr.Is(err, apperr.KindValidation))
+	assert.Equal(t, []apperr.FieldError{
+		{Pointer: "/kind", Rule: "oneof", Detail: "must be one of: admin, user"},
+		{Pointer: "/code", Rule: "len", Detail: "must be exactly 4 characters long"},
+		{Pointer: "/items/1/name", Rule: "required", Detail: "is required"},
+	}, apperr.As(err).Fields)
+
+	assert.NoError(t, v.Validate(&request{Kind: "admin", Code: "1234", Items: []item{{Name: "a"}}, Skip: "set"}))
+	assert.True(t, apperr.Is(v.Validate("not a struct"), apperr.KindInternal))
+}
@@ -0,0 +1,113 @@
+package rest
+
+import (
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/efimovalex/replaceme/config"
+	"github.com/labstack/echo/v4"
+)
+
+// API versioning headers
+const (
+	// HeaderAPIVersion selects the version of requests to unversioned paths, and tells the version of every response
+	HeaderAPIVersion = "API-Version"
+	// HeaderDeprecation announces the deprecation date of a version, a structured field date, see RFC 9745
+	HeaderDeprecation = "Deprecation"
+	// HeaderSunset announces the date a version stops answering, see RFC 8594
+	HeaderSunset = "Sunset"
+	// HeaderLink links the deprecation documentation
+	HeaderLink = "Link"
+)
+
+// API versions, in release order
+const (
+	APIVersionV1 = "v1"
+	APIVersionV2 = "v2"
+)
+
+// wellKnownPath is the prefix of the well-known URIs, they are served outside of the API versions
+const wellKnownPath = "/.well-known"
+
+// versionPathRegexp matches paths starting with a version segment
+var versionPathRegexp = regexp.MustCompile(`^/v[0-9]+(/|$)`)
+
+// apiVersions returns the lifecycle configuration of every API version
+func (rest *R) apiVersions() map[string]config.APIVersion {
+	return map[string]config.APIVersion{
+		APIVersionV1: rest.cfg.Versioning.V1,
+		APIVersionV2: rest.cfg.Versioning.V2,
+	}
+}
+
+// VersionMiddleware routes requests to unversioned paths to the version of the API-Version header,
+// or to the default version. It must run before routing, see echo.Pre.
+// Versioned paths win over the header, well-known URIs are left alone.
+func (rest *R) VersionMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		req := c.Request()
+		if versionPathRegexp.MatchString(req.URL.Path) || strings.HasPrefix(req.URL.Path, wellKnownPath+"/") {
+			return next(c)
+		}
+
+		version := normalizeVersion(req.Header.Get(HeaderAPIVersion))
+		if version == "" {
+			version = rest.cfg.Versioning.Default
+		}
+		if version == "" {
+			version = APIVersionV1
+		}
+		if _, ok := rest.apiVersions()[version]; !ok {
+			return echo.NewHTTPError(http.StatusBadRequest, "unsupported API version "+req.Header.Get(HeaderAPIVersion))
+		}
+
+		req.URL.Path = "/" + version + req.URL.Path
+		if req.URL.RawPath != "" {
+			req.URL.RawPath = "/" + version + req.URL.RawPath
+		}
+
+		return next(c)
+	}
+}
+
+// APIVersionMiddleware tells the version of the responses of a version route group,
+// and signals its deprecation and sunset. Sunset versions answer 410 Gone.
+func APIVersionMiddleware(version string, cfg config.APIVersion) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			h := c.Response().Header()
+			h.Set(HeaderAPIVersion, version)
+			if !cfg.DeprecatedAt.IsZero() {
+				h.Set(HeaderDeprecation, "@"+strconv.FormatInt(cfg.DeprecatedAt.Unix(), 10))
+				if cfg.Link != "" {
+					h.Add(HeaderLink, `<`+cfg.Link+`>; rel="deprecation"`)
+				}
+			}
+			if !cfg.SunsetAt.IsZero() {
+				h.Set(HeaderSunset, cfg.SunsetAt.UTC().Format(http.TimeFormat))
+				if cfg.Link != "" {
+					h.Add(HeaderLink, `<`+cfg.Link+`>; rel="sunset"`)
+				}
+
+				if !time.Now().Before(cfg.SunsetAt) {
+					return echo.NewHTTPError(http.StatusGone, "API "+version+" was sunset on "+cfg.SunsetAt.UTC().Format(time.RFC3339))
+				}
+			}
+
+			return next(c)
+		}
+	}
+}
+
+// normalizeVersion accepts versions with or without the v prefix, e.g. 2 and v2
+func normalizeVersion(version string) string {
+	version = strings.ToLower(strings.TrimSpace(version))
+	if version != "" && !strings.HasPrefix(version, "v") {
+		version = "v" + version
+	}
+
+	return version
+}
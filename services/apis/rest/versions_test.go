@@ -0,0 +1,109 @@
+package rest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/efimovalex/replaceme/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestR_VersionMiddleware(t *testing.T) {
+	tests := []struct {
+		name               string
+		path               string
+		apiVersion         string
+		expectedStatusCode int
+		expectedVersion    string
+	}{
+		{name: "Default version", path: "/", expectedStatusCode: http.StatusOK, expectedVersion: "v2"},
+		{name: "Header version", path: "/", apiVersion: "v1", expectedStatusCode: http.StatusOK, expectedVersion: "v1"},
+		{name: "Header version without prefix", path: "/", apiVersion: "1", expectedStatusCode: http.StatusOK, expectedVersion: "v1"},
+		{name: "Path version", path: "/v1/", expectedStatusCode: http.StatusOK, expectedVersion: "v1"},
+		{name: "Path version wins", path: "/v2/", apiVersion: "v1", expectedStatusCode: http.StatusOK, expectedVersion: "v2"},
+		{name: "Unsupported header version", path: "/", apiVersion: "v9", expectedStatusCode: http.StatusBadRequest},
+		{name: "Unsupported path version", path: "/v9/", expectedStatusCode: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewTestREST(t)
+			r.cfg.Versioning.Default = "v2"
+			r.SetupRouter()
+
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.apiVersion != "" {
+				req.Header.Set(HeaderAPIVersion, tt.apiVersion)
+			}
+			w := httptest.NewRecorder()
+			r.Router.ServeHTTP(w, req)
+
+			assert.Equal(t, tt.expectedStatusCode, w.Code, "body:\n%s", w.Body.String())
+			assert.Equal(t, tt.expectedVersion, w.Header().Get(HeaderAPIVersion))
+		})
+	}
+}
+
+func TestAPIVersionMiddleware(t *testing.T) {
+	deprecatedAt := time.Date(2022, 9, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name               string
+		cfg                config.APIVersion
+		expectedStatusCode int
+		expectedHeader     http.Header
+	}{
+		{
+			name:               "Current version",
+			cfg:                config.APIVersion{},
+			expectedStatusCode: http.StatusOK,
+			expectedHeader:     http.Header{HeaderAPIVersion: {"v1"}},
+		},
+		{
+			name:               "Deprecated version",
+			cfg:                config.APIVersion{DeprecatedAt: deprecatedAt, SunsetAt: time.Date(2100, 1, 1, 0, 0, 0, 0, time.UTC), Link: "https://replaceme.com/docs/v2-migration"},
+			expectedStatusCode: http.StatusOK,
+			expectedHeader: http.Header{
+				HeaderAPIVersion:  {"v1"},
+				HeaderDeprecation: {"@1661990400"},
+				HeaderSunset:      {"Fri, 01 Jan 2100 00:00:00 GMT"},
+				HeaderLink:        {`<https://replaceme.com/docs/v2-migration>; rel="deprecation"`, `<https://replaceme.com/docs/v2-migration>; rel="sunset"`},
+			},
+		},
+		{
+			name:               "Sunset version",
+			cfg:                config.APIVersion{DeprecatedAt: deprecatedAt, SunsetAt: deprecatedAt.AddDate(0, 1, 0)},
+			expectedStatusCode: http.StatusGone,
+			expectedHeader: http.Header{
+				HeaderAPIVersion:  {"v1"},
+				HeaderDeprecation: {"@1661990400"},
+				HeaderSunset:      {"Sat, 01 Oct 2022 00:00:00 GMT"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewTestREST(t)
+			r.cfg.Versioning.V1 = tt.cfg
+			r.SetupRouter()
+
+			req := httptest.NewRequest(http.MethodGet, "/v1/", nil)
+			w := httptest.NewRecorder()
+			r.Router.ServeHTTP(w, req)
+
+			assert.Equal(t, tt.expectedStatusCode, w.Code)
+			for k, v := range tt.expectedHeader {
+				assert.Equal(t, v, w.Header().Values(k), k)
+			}
+			for _, k := range []string{HeaderDeprecation, HeaderSunset, HeaderLink} {
+				if _, ok := tt.expectedHeader[k]; !ok {
+					assert.Empty(t, w.Header().Values(k), k)
+				}
+			}
+			if w.Code != http.StatusOK {
+				checkResponseWithTestDataFile(t, w.Body.Bytes(), []string{"correlation_id"})
+			}
+		})
+	}
+}
@@ -0,0 +1,451 @@
+package rest
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/efimovalex/replaceme/adapters/postgres"
+	"github.com/efimovalex/replaceme/adapters/redisdb"
+	"github.com/efimovalex/replaceme/config"
+	"github.com/efimovalex/replaceme/internal/apperr"
+	"github.com/efimovalex/replaceme/internal/audit"
+	auth "github.com/efimovalex/replaceme/internal/auth0"
+	"github.com/efimovalex/replaceme/internal/webauthn"
+	"github.com/labstack/echo/v4"
+)
+
+// Ceremonies of the WebAuthn challenges
+const (
+	CeremonyRegistration = "registration"
+	CeremonyLogin        = "login"
+)
+
+// WebAuthnChallengeStore is the interface for the store of the challenges of the pending WebAuthn ceremonies
+type WebAuthnChallengeStore interface {
+	CreateWebAuthnChallenge(ctx context.Context, challenge string, ch redisdb.WebAuthnChallenge, ttl time.Duration) error
+	ConsumeWebAuthnChallenge(ctx context.Context, challenge string) (*redisdb.WebAuthnChallenge, error)
+}
+
+// PasskeyRegistrationRequest is the request body of the passkey registration endpoint
+type PasskeyRegistrationRequest struct {
+	// Name tells the passkeys of a user apart, e.g. the device holding it
+	Name       string                        `json:"name" validate:"max=100" example:"YubiKey"`
+	Credential webauthn.RegistrationResponse `json:"credential"`
+}
+
+// PasskeyLoginRequest is the request body of the passkey login endpoint
+type PasskeyLoginRequest struct {
+	Credential webauthn.AssertionResponse `json:"credential"`
+}
+
+// DeletePasskeyRequest are the path params of the delete passkey endpoint
+type DeletePasskeyRequest struct {
+	ID string `param:"id" validate:"required,max=1400"`
+}
+
+// Passkey is the public representation of a passkey
+type Passkey struct {
+	XMLName    xml.Name   `json:"-" xml:"passkey"`
+	ID         string     `json:"id" xml:"id"`
+	Name       string     `json:"name" xml:"name"`
+	CreatedAt  time.Time  `json:"created_at" xml:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at" xml:"last_used_at,omitempty"`
+}
+
+// PasskeyRegistrationOptions starts the registration of a passkey of the authenticated user
+// @Summary [post] /webauthn/registration/options
+// @Description Starts the registration of a passkey of the authenticated user, the options are passed to
+// @Description navigator.credentials.create and the created credential is sent to /webauthn/registration.
+// @Tags webauthn
+// @Accept  json
+// @Produce json
+// @Security BearerAuth
+// @Success 200 {object} webauthn.CreationOptions "Credential creation options"
+// @Failure 401 {object} Problem "Invalid or revoked access token"
+// @Failure 404 {object} Problem "Passkeys are disabled"
+// @Failure 500 {object} Problem "Internal server error"
+// @Failure 503 {object} Problem "Challenge store unavailable"
+// @Router /webauthn/registration/options [post]
+func (rest *R) PasskeyRegistrationOptions(c echo.Context) error {
+	u, err := rest.passkeyUser(c)
+	if err != nil {
+		return err
+	}
+	ctx := c.Request().Context()
+	creds, err := rest.DB.FindWebAuthnCredentials(ctx, u.ID)
+	if err != nil {
+		return err
+	}
+	exclude := make([]webauthn.Credential, 0, len(creds))
+	for i := range creds {
+		cred, err := webAuthnCredential(&creds[i])
+		if err != nil {
+			return err
+		}
+		exclude = append(exclude, *cred)
+	}
+
+	challenge, err := rest.startCeremony(c, CeremonyRegistration, strconv.Itoa(u.ID))
+	if err != nil {
+		return err
+	}
+	user := webauthn.User{
+		ID:          []byte(strconv.Itoa(u.ID)),
+		Name:        u.Email,
+		DisplayName: strings.TrimSpace(u.FirstName + " " + u.LastName),
+	}
+
+	return rest.JSON(c, http.StatusOK, rest.WebAuthn.CreationOptions(user, challenge, exclude))
+}
+
+// RegisterPasskey stores the passkey created by an authenticator for the authenticated user
+// @Summary [post] /webauthn/registration
+// @Description Verifies the credential created by navigator.credentials.create with the options of
+// @Description /webauthn/registration/options and stores it as a passkey of the authenticated user.
+// @Tags webauthn
+// @Accept  json
+// @Produce json
+// @Security BearerAuth
+// @Param registration body PasskeyRegistrationRequest true "Name and created credential"
+// @Success 201 {object} Passkey "Passkey"
+// @Failure 400 {object} Problem "Invalid request JSON"
+// @Failure 401 {object} Problem "Invalid or revoked access token, or invalid or expired challenge"
+// @Failure 404 {object} Problem "Passkeys are disabled"
+// @Failure 409 {object} Problem "Credential already registered"
+// @Failure 422 {object} Problem "Params validation error or invalid credential"
+// @Failure 500 {object} Problem "Internal server error"
+// @Failure 503 {object} Problem "Challenge store unavailable"
+// @Router /webauthn/registration [post]
+func (rest *R) RegisterPasskey(c echo.Context) error {
+	var req PasskeyRegistrationRequest
+	if err := rest.Bind(c, &req); err != nil {
+		return err
+	}
+	u, err := rest.passkeyUser(c)
+	if err != nil {
+		return err
+	}
+	challenge, err := rest.finishCeremony(c, req.Credential.Response.ClientDataJSON, CeremonyRegistration, strconv.Itoa(u.ID))
+	if err != nil {
+		return err
+	}
+
+	cred, err := rest.WebAuthn.VerifyRegistration(&req.Credential, challenge)
+	if err != nil {
+		return apperr.Validation(apperr.CodeInvalidWebAuthn, "invalid credential").Wrap(err)
+	}
+	p := &postgres.WebAuthnCredential{
+		ID:         base64.RawURLEncoding.EncodeToString(cred.ID),
+		UserID:     u.ID,
+		PublicKey:  cred.PublicKey,
+		SignCount:  int64(cred.SignCount),
+		Transports: strings.Join(cred.Transports, " "),
+		AAGUID:     cred.AAGUID,
+		Name:       req.Name,
+	}
+	ctx := c.Request().Context()
+	if err := rest.DB.InsertWebAuthnCredential(ctx, p); err != nil {
+		return err
+	}
+	rest.Audit.Record(ctx, audit.Event{Type: audit.EventPasskeyRegistered, Actor: strconv.Itoa(u.ID), Subject: p.ID, IP: c.RealIP()})
+
+	return rest.JSON(c, http.StatusCreated, newPasskey(p))
+}
+
+// ListPasskeys returns the passkeys of the authenticated user
+// @Summary [get] /webauthn/credentials
+// @Description Returns the passkeys of the authenticated user, oldest first
+// @Tags webauthn
+// @Accept  json
+// @Produce json,application/msgpack,application/cbor,xml
+// @Security BearerAuth
+// @Success 200 {array} Passkey "Passkeys"
+// @Failure 401 {object} Problem "Invalid or revoked access token"
+// @Failure 404 {object} Problem "Passkeys are disabled"
+// @Failure 500 {object} Problem "Internal server error"
+// @Router /webauthn/credentials [get]
+func (rest *R) ListPasskeys(c echo.Context) error {
+	u, err := rest.passkeyUser(c)
+	if err != nil {
+		return err
+	}
+	creds, err := rest.DB.FindWebAuthnCredentials(c.Request().Context(), u.ID)
+	if err != nil {
+		return err
+	}
+
+	res := make([]Passkey, 0, len(creds))
+	for i := range creds {
+		res = append(res, newPasskey(&creds[i]))
+	}
+
+	return rest.Render(c, http.StatusOK, res)
+}
+
+// DeletePasskey deletes a passkey of the authenticated user
+// @Summary [delete] /webauthn/credentials/{id}
+// @Description Deletes a passkey of the authenticated user, it can no longer log in
+// @Tags webauthn
+// @Accept  json
+// @Produce json,application/msgpack,application/cbor,xml
+// @Security BearerAuth
+// @Param id path string true "Passkey ID"
+// @Success 204 "Passkey deleted"
+// @Failure 401 {object} Problem "Invalid or revoked access token"
+// @Failure 404 {object} Problem "Passkey not found"
+// @Failure 422 {object} Problem "Params validation error"
+// @Failure 500 {object} Problem "Internal server error"
+// @Router /webauthn/credentials/{id} [delete]
+func (rest *R) DeletePasskey(c echo.Context) error {
+	var req DeletePasskeyRequest
+	if err := rest.Bind(c, &req); err != nil {
+		return err
+	}
+	u, err := rest.passkeyUser(c)
+	if err != nil {
+		return err
+	}
+	ctx := c.Request().Context()
+	if err := rest.DB.DeleteWebAuthnCredential(ctx, u.ID, req.ID); err != nil {
+		return err
+	}
+	rest.Audit.Record(ctx, audit.Event{Type: audit.EventPasskeyDeleted, Actor: strconv.Itoa(u.ID), Subject: req.ID, IP: c.RealIP()})
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// PasskeyLoginOptions starts a passkey login
+// @Summary [post] /auth/webauthn/options
+// @Description Starts a passkey login, the options are passed to navigator.credentials.get and the returned
+// @Description credential is sent to /auth/webauthn/login. The authenticator offers the passkeys of the service,
+// @Description the user does not need to type an email.
+// @Tags auth
+// @Accept  json
+// @Produce json
+// @Success 200 {object} webauthn.RequestOptions "Credential request options"
+// @Failure 404 {object} Problem "Passkeys are disabled"
+// @Failure 500 {object} Problem "Internal server error"
+// @Failure 503 {object} Problem "Challenge store unavailable"
+// @Router /auth/webauthn/options [post]
+func (rest *R) PasskeyLoginOptions(c echo.Context) error {
+	if !rest.cfg.WebAuthn.Enable {
+		return apperr.NotFound(apperr.CodeNotFound, "passkeys are disabled")
+	}
+	challenge, err := rest.startCeremony(c, CeremonyLogin, "")
+	if err != nil {
+		return err
+	}
+
+	return rest.JSON(c, http.StatusOK, rest.WebAuthn.RequestOptions(challenge, nil))
+}
+
+// PasskeyLogin verifies the credential returned by an authenticator and issues the tokens of its user
+// @Summary [post] /auth/webauthn/login
+// @Description Verifies the credential returned by navigator.credentials.get with the options of
+// @Description /auth/webauthn/options and issues the tokens of the user of the passkey. A passkey whose signature
+// @Description counter did not increase may have been cloned, it is refused. Users with a second factor must use
+// @Description an authenticator verifying them, e.g. with a PIN or a fingerprint.
+// @Tags auth
+// @Accept  json
+// @Produce json,application/msgpack,application/cbor,xml
+// @Param login body PasskeyLoginRequest true "Returned credential"
+// @Success 200 {object} TokenResponse "Access token"
+// @Failure 400 {object} Problem "Invalid request JSON"
+// @Failure 401 {object} Problem "Invalid credential, unknown passkey or invalid or expired challenge"
+// @Failure 403 {object} Problem "Email not verified"
+// @Failure 404 {object} Problem "Passkeys are disabled"
+// @Failure 422 {object} Problem "Params validation error"
+// @Failure 500 {object} Problem "Internal server error"
+// @Failure 503 {object} Problem "Challenge or session store unavailable"
+// @Router /auth/webauthn/login [post]
+func (rest *R) PasskeyLogin(c echo.Context) error {
+	var req PasskeyLoginRequest
+	if err := rest.Bind(c, &req); err != nil {
+		return err
+	}
+	if !rest.cfg.WebAuthn.Enable {
+		return apperr.NotFound(apperr.CodeNotFound, "passkeys are disabled")
+	}
+	challenge, err := rest.finishCeremony(c, req.Credential.Response.ClientDataJSON, CeremonyLogin, "")
+	if err != nil {
+		return err
+	}
+
+	ctx := c.Request().Context()
+	id := base64.RawURLEncoding.EncodeToString(req.Credential.RawID)
+	p, err := rest.DB.FindWebAuthnCredential(ctx, id)
+	if err != nil {
+		return err
+	}
+	if p == nil {
+		return apperr.Unauthorized(apperr.CodeCredentialNotFound, "unknown passkey")
+	}
+	userID := strconv.Itoa(p.UserID)
+	if h := req.Credential.Response.UserHandle; len(h) > 0 && string(h) != userID {
+		return apperr.Unauthorized(apperr.CodeInvalidWebAuthn, "invalid credential")
+	}
+
+	cred, err := webAuthnCredential(p)
+	if err != nil {
+		return err
+	}
+	signCount, verified, err := rest.WebAuthn.VerifyAssertion(&req.Credential, challenge, cred)
+	if errors.Is(err, webauthn.ErrCounterRegression) {
+		return rest.passkeyCloned(c, p)
+	}
+	if err != nil {
+		return apperr.Unauthorized(apperr.CodeInvalidWebAuthn, "invalid credential").Wrap(err)
+	}
+	// a concurrent login with the same counter is a clone too
+	ok, err := rest.DB.UpdateWebAuthnCredentialUse(ctx, p.ID, p.SignCount, int64(signCount))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return rest.passkeyCloned(c, p)
+	}
+
+	u, err := rest.findActiveUser(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if u == nil {
+		return apperr.Unauthorized(apperr.CodeCredentialNotFound, "unknown passkey")
+	}
+	if rest.cfg.Accounts.RequireVerifiedEmail && u.EmailVerifiedAt == nil {
+		return apperr.Forbidden(apperr.CodeEmailNotVerified, "email is not verified")
+	}
+	// a passkey only proves the possession of the authenticator unless it verified the user,
+	// it must not weaken the login of the users who enabled a second factor
+	mfa, err := rest.hasMFA(ctx, u.ID)
+	if err != nil {
+		return err
+	}
+	if mfa && !verified {
+		return apperr.Unauthorized(apperr.CodeInvalidWebAuthn, "user verification is required for accounts with a second factor")
+	}
+
+	authn := authentication{methods: []string{auth.AuthMethodHardwareKey}, time: time.Now()}
+	if verified {
+		authn.methods = append(authn.methods, auth.AuthMethodMFA)
+	}
+	sessionID, refreshToken, err := rest.startSession(c, userID, authn)
+	if err != nil {
+		return err
+	}
+
+	return rest.issueTokens(c, u, authn, sessionID, refreshToken)
+}
+
+// newRelyingParty creates the relying party of the passkeys from the configuration
+func newRelyingParty(cfg config.WebAuthn) *webauthn.RelyingParty {
+	return &webauthn.RelyingParty{
+		ID:               cfg.RPID,
+		Name:             cfg.RPName,
+		Origins:          cfg.Origins,
+		Timeout:          cfg.ChallengeTTL,
+		UserVerification: cfg.UserVerification,
+	}
+}
+
+// startCeremony stores the challenge of a new ceremony, of the user registering a passkey or of a login
+func (rest *R) startCeremony(c echo.Context, ceremony, userID string) ([]byte, error) {
+	if rest.WebAuthnChallenges == nil {
+		return nil, apperr.Unavailable(apperr.CodeUnavailable, "WebAuthn challenge store unavailable")
+	}
+	challenge, err := webauthn.NewChallenge()
+	if err != nil {
+		return nil, apperr.Internal(err)
+	}
+	ch := redisdb.WebAuthnChallenge{Ceremony: ceremony, UserID: userID}
+	key := base64.RawURLEncoding.EncodeToString(challenge)
+	if err := rest.WebAuthnChallenges.CreateWebAuthnChallenge(c.Request().Context(), key, ch, rest.cfg.WebAuthn.ChallengeTTL); err != nil {
+		return nil, apperr.Unavailable(apperr.CodeUnavailable, "WebAuthn challenge store unavailable").Wrap(err)
+	}
+
+	return challenge, nil
+}
+
+// finishCeremony consumes the challenge signed in the client data of a response, it must be a challenge of the
+// ceremony started by the user
+func (rest *R) finishCeremony(c echo.Context, clientDataJSON []byte, ceremony, userID string) ([]byte, error) {
+	if rest.WebAuthnChallenges == nil {
+		return nil, apperr.Unavailable(apperr.CodeUnavailable, "WebAuthn challenge store unavailable")
+	}
+	invalid := apperr.Unauthorized(apperr.CodeInvalidChallenge, "invalid or expired challenge")
+	clientData, err := webauthn.ParseClientData(clientDataJSON)
+	if err != nil {
+		return nil, invalid.Wrap(err)
+	}
+	challenge, err := clientData.ChallengeBytes()
+	if err != nil || len(challenge) != webauthn.ChallengeSize {
+		return nil, invalid
+	}
+
+	key := base64.RawURLEncoding.EncodeToString(challenge)
+	ch, err := rest.WebAuthnChallenges.ConsumeWebAuthnChallenge(c.Request().Context(), key)
+	if err != nil {
+		return nil, apperr.Unavailable(apperr.CodeUnavailable, "WebAuthn challenge store unavailable").Wrap(err)
+	}
+	if ch == nil || ch.Ceremony != ceremony || ch.UserID != userID {
+		return nil, invalid
+	}
+
+	return challenge, nil
+}
+
+// passkeyCloned refuses the login of a passkey whose authenticator may have been cloned
+func (rest *R) passkeyCloned(c echo.Context, p *postgres.WebAuthnCredential) error {
+	rest.Audit.Record(c.Request().Context(), audit.Event{
+		Type:    audit.EventPasskeyCloneDetected,
+		Actor:   strconv.Itoa(p.UserID),
+		Subject: p.ID,
+		IP:      c.RealIP(),
+	})
+
+	return apperr.Unauthorized(apperr.CodeCredentialCloned, "the passkey may have been cloned")
+}
+
+// passkeyUser loads the authenticated user managing its passkeys
+func (rest *R) passkeyUser(c echo.Context) (*postgres.User, error) {
+	if !rest.cfg.WebAuthn.Enable {
+		return nil, apperr.NotFound(apperr.CodeNotFound, "passkeys are disabled")
+	}
+	userID, err := rest.localUserID(c.Request().Context())
+	if err != nil {
+		return nil, err
+	}
+	u, err := rest.findActiveUser(c.Request().Context(), userID)
+	if err != nil {
+		return nil, err
+	}
+	if u == nil {
+		return nil, apperr.Unauthorized(apperr.CodeUnauthorized, "user not found")
+	}
+
+	return u, nil
+}
+
+// webAuthnCredential converts a stored passkey for the verification of the ceremonies
+func webAuthnCredential(p *postgres.WebAuthnCredential) (*webauthn.Credential, error) {
+	id, err := base64.RawURLEncoding.DecodeString(p.ID)
+	if err != nil {
+		return nil, apperr.Internal(err)
+	}
+	cred := &webauthn.Credential{ID: id, PublicKey: p.PublicKey, SignCount: uint32(p.SignCount), AAGUID: p.AAGUID}
+	if p.Transports != "" {
+		cred.Transports = strings.Fields(p.Transports)
+	}
+
+	return cred, nil
+}
+
+func newPasskey(p *postgres.WebAuthnCredential) Passkey {
+	return Passkey{ID: p.ID, Name: p.Name, CreatedAt: p.CreatedAt, LastUsedAt: p.LastUsedAt}
+}
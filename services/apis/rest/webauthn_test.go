@@ -0,0 +1,398 @@
+package rest
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/efimovalex/replaceme/adapters/redisdb"
+	"github.com/efimovalex/replaceme/config"
+	"github.com/efimovalex/replaceme/internal/audit"
+	"github.com/efimovalex/replaceme/internal/webauthn"
+	"github.com/efimovalex/replaceme/internal/webauthn/webauthntest"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testWebAuthnOrigin = "http://localhost:8080"
+
+var (
+	passkeyColumns        = []string{"id", "user_id", "public_key", "sign_count", "transports", "aaguid", "name", "created_at", "last_used_at"}
+	findPasskeysQuery     = regexp.QuoteMeta(`SELECT * FROM webauthn_credentials WHERE user_id = $1 ORDER BY created_at, id`)
+	findPasskeyQuery      = regexp.QuoteMeta(`SELECT * FROM webauthn_credentials WHERE id = $1 LIMIT 1`)
+	insertPasskeyQuery    = regexp.QuoteMeta(`INSERT INTO webauthn_credentials (id,user_id,public_key,sign_count,transports,aaguid,name) VALUES ($1,$2,$3,$4,$5,$6,$7) ON CONFLICT (id) DO NOTHING RETURNING created_at`)
+	updatePasskeyUseQuery = regexp.QuoteMeta(`UPDATE webauthn_credentials SET sign_count = $1, last_used_at = CURRENT_TIMESTAMP WHERE id = $2 AND sign_count = $3`)
+	deletePasskeyQuery    = regexp.QuoteMeta(`DELETE FROM webauthn_credentials WHERE id = $1 AND user_id = $2`)
+	testWebAuthnConfig    = config.WebAuthn{
+		Enable:           true,
+		RPID:             "localhost",
+		RPName:           "Replaceme",
+		Origins:          []string{testWebAuthnOrigin},
+		ChallengeTTL:     5 * time.Minute,
+		UserVerification: webauthn.UserVerificationPreferred,
+	}
+)
+
+// webAuthnChallengeStoreMock is an in-memory WebAuthnChallengeStore
+type webAuthnChallengeStoreMock struct {
+	mu         sync.Mutex
+	challenges map[string]redisdb.WebAuthnChallenge
+	err        error
+}
+
+func newWebAuthnChallengeStoreMock() *webAuthnChallengeStoreMock {
+	return &webAuthnChallengeStoreMock{challenges: map[string]redisdb.WebAuthnChallenge{}}
+}
+
+func (m *webAuthnChallengeStoreMock) CreateWebAuthnChallenge(ctx context.Context, challenge string, ch redisdb.WebAuthnChallenge, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return m.err
+	}
+	m.challenges[challenge] = ch
+
+	return nil
+}
+
+func (m *webAuthnChallengeStoreMock) ConsumeWebAuthnChallenge(ctx context.Context, challenge string) (*redisdb.WebAuthnChallenge, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return nil, m.err
+	}
+	ch, ok := m.challenges[challenge]
+	if !ok {
+		return nil, nil
+	}
+	delete(m.challenges, challenge)
+
+	return &ch, nil
+}
+
+// capturedArg matches any argument of a query and keeps it
+type capturedArg struct {
+	value driver.Value
+}
+
+func (a *capturedArg) Match(v driver.Value) bool {
+	a.value = v
+
+	return true
+}
+
+// newTestWebAuthnREST creates a REST instance with passkeys enabled, an in-memory challenge store, session store
+// and audit log
+func newTestWebAuthnREST(t *testing.T) (*R, sqlmock.Sqlmock, *webAuthnChallengeStoreMock, *audit.Fake) {
+	r, mock := NewTestRESTWithMock(t)
+	r.cfg.WebAuthn = testWebAuthnConfig
+	r.WebAuthn = newRelyingParty(testWebAuthnConfig)
+	challenges := newWebAuthnChallengeStoreMock()
+	events := &audit.Fake{}
+	r.WebAuthnChallenges = challenges
+	r.Sessions = newSessionStoreMock()
+	r.Audit = events
+
+	return r, mock, challenges, events
+}
+
+// registerTestPasskey registers a passkey of the user 1 on the authenticator and returns its stored row
+func registerTestPasskey(t *testing.T, r *R, a *webauthntest.Authenticator, signCount int64) *sqlmock.Rows {
+	challenge, err := webauthn.NewChallenge()
+	require.NoError(t, err)
+	resp, err := a.Register(r.WebAuthn.CreationOptions(webauthn.User{ID: []byte("1")}, challenge, nil))
+	require.NoError(t, err)
+	cred, err := r.WebAuthn.VerifyRegistration(resp, challenge)
+	require.NoError(t, err)
+
+	createdAt := time.Date(2022, 7, 1, 10, 0, 0, 0, time.UTC)
+	return sqlmock.NewRows(passkeyColumns).
+		AddRow(resp.ID, 1, cred.PublicKey, signCount, "internal", cred.AAGUID, "Laptop", createdAt, nil)
+}
+
+func passkeyLogin(r *R, path string, body interface{}) *httptest.ResponseRecorder {
+	b, _ := json.Marshal(body)
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(string(b)))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	w := httptest.NewRecorder()
+	r.Router.ServeHTTP(w, req)
+
+	return w
+}
+
+func TestREST_RegisterPasskey(t *testing.T) {
+	t.Run("Register", func(t *testing.T) {
+		r, mock, challenges, events := newTestWebAuthnREST(t)
+		a, err := webauthntest.New(testWebAuthnOrigin)
+		require.NoError(t, err)
+
+		expectTestUserByID(mock)
+		mock.ExpectQuery(findPasskeysQuery).WithArgs(1).WillReturnRows(sqlmock.NewRows(passkeyColumns))
+		w := mfaRequest(t, r, http.MethodPost, "/v1/webauthn/registration/options", "", nil)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		assert.Equal(t, CacheNoStore, w.Header().Get(echo.HeaderCacheControl))
+		t.Run("Options", func(t *testing.T) {
+			checkResponseWithTestDataFile(t, w.Body.Bytes(), []string{"challenge"})
+		})
+		require.Len(t, challenges.challenges, 1)
+		var opts webauthn.CreationOptions
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &opts))
+
+		cred, err := a.Register(opts)
+		require.NoError(t, err)
+		body, err := json.Marshal(PasskeyRegistrationRequest{Name: "Laptop", Credential: *cred})
+		require.NoError(t, err)
+		publicKey := &capturedArg{}
+		createdAt := time.Date(2022, 7, 1, 10, 0, 0, 0, time.UTC)
+		expectTestUserByID(mock)
+		mock.ExpectQuery(insertPasskeyQuery).WithArgs(cred.ID, 1, publicKey, 0, "internal", sqlmock.AnyArg(), "Laptop").
+			WillReturnRows(sqlmock.NewRows([]string{"created_at"}).AddRow(createdAt))
+		w = mfaRequest(t, r, http.MethodPost, "/v1/webauthn/registration", string(body), nil)
+		require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+		assert.Empty(t, challenges.challenges, "the challenge is used once")
+		_, err = webauthn.ParsePublicKey(publicKey.value.([]byte))
+		assert.NoError(t, err)
+		require.Len(t, events.Events(), 1)
+		assert.Equal(t, audit.EventPasskeyRegistered, events.Events()[0].Type)
+
+		// the response cannot be replayed
+		expectTestUserByID(mock)
+		w = mfaRequest(t, r, http.MethodPost, "/v1/webauthn/registration", string(body), nil)
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		checkResponseWithTestDataFile(t, w.Body.Bytes(), []string{"correlation_id"})
+	})
+
+	t.Run("Challenge of a login", func(t *testing.T) {
+		r, mock, _, _ := newTestWebAuthnREST(t)
+		a, err := webauthntest.New(testWebAuthnOrigin)
+		require.NoError(t, err)
+
+		w := passkeyLogin(r, "/v1/auth/webauthn/options", nil)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var opts webauthn.RequestOptions
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &opts))
+		cred, err := a.Register(r.WebAuthn.CreationOptions(webauthn.User{ID: []byte("1")}, opts.Challenge, nil))
+		require.NoError(t, err)
+		body, err := json.Marshal(PasskeyRegistrationRequest{Credential: *cred})
+		require.NoError(t, err)
+
+		expectTestUserByID(mock)
+		w = mfaRequest(t, r, http.MethodPost, "/v1/webauthn/registration", string(body), nil)
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+	})
+
+	t.Run("Invalid origin", func(t *testing.T) {
+		r, mock, _, _ := newTestWebAuthnREST(t)
+		a, err := webauthntest.New("https://evil.com")
+		require.NoError(t, err)
+
+		expectTestUserByID(mock)
+		mock.ExpectQuery(findPasskeysQuery).WithArgs(1).WillReturnRows(sqlmock.NewRows(passkeyColumns))
+		w := mfaRequest(t, r, http.MethodPost, "/v1/webauthn/registration/options", "", nil)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var opts webauthn.CreationOptions
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &opts))
+		cred, err := a.Register(opts)
+		require.NoError(t, err)
+		body, err := json.Marshal(PasskeyRegistrationRequest{Credential: *cred})
+		require.NoError(t, err)
+
+		expectTestUserByID(mock)
+		w = mfaRequest(t, r, http.MethodPost, "/v1/webauthn/registration", string(body), nil)
+		assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+		checkResponseWithTestDataFile(t, w.Body.Bytes(), []string{"correlation_id"})
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		r, _, _, _ := newTestWebAuthnREST(t)
+		r.cfg.WebAuthn.Enable = false
+
+		w := mfaRequest(t, r, http.MethodPost, "/v1/webauthn/registration/options", "", nil)
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+}
+
+func TestREST_PasskeyLogin(t *testing.T) {
+	// startLogin runs the ceremony of a passkey login up to the response of the authenticator
+	startLogin := func(t *testing.T, r *R, a *webauthntest.Authenticator) *webauthn.AssertionResponse {
+		w := passkeyLogin(r, "/v1/auth/webauthn/options", nil)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		assert.Equal(t, CacheNoStore, w.Header().Get(echo.HeaderCacheControl))
+		var opts webauthn.RequestOptions
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &opts))
+		assert.Equal(t, "localhost", opts.RPID)
+		assert.Empty(t, opts.AllowCredentials, "the authenticator offers its discoverable passkeys")
+
+		resp, err := a.Assert(opts)
+		require.NoError(t, err)
+
+		return resp
+	}
+
+	t.Run("Login", func(t *testing.T) {
+		r, mock, challenges, _ := newTestWebAuthnREST(t)
+		a, err := webauthntest.New(testWebAuthnOrigin)
+		require.NoError(t, err)
+		rows := registerTestPasskey(t, r, a, 0)
+		resp := startLogin(t, r, a)
+
+		mock.ExpectQuery(findPasskeyQuery).WithArgs(resp.ID).WillReturnRows(rows)
+		mock.ExpectExec(updatePasskeyUseQuery).WithArgs(1, resp.ID, 0).WillReturnResult(sqlmock.NewResult(0, 1))
+		expectTestUserByID(mock)
+		w := passkeyLogin(r, "/v1/auth/webauthn/login", PasskeyLoginRequest{Credential: *resp})
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		assert.Empty(t, challenges.challenges, "the challenge is used once")
+
+		var res TokenResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+		assert.NotEmpty(t, res.RefreshToken)
+		claims := accessTokenClaims(t, res.AccessToken)
+		assert.Equal(t, "1", claims["sub"])
+		assert.Equal(t, []interface{}{"hwk"}, claims["amr"])
+
+		// the response cannot be replayed
+		w = passkeyLogin(r, "/v1/auth/webauthn/login", PasskeyLoginRequest{Credential: *resp})
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		checkResponseWithTestDataFile(t, w.Body.Bytes(), []string{"correlation_id"})
+	})
+
+	t.Run("User verified", func(t *testing.T) {
+		r, mock, _, _ := newTestWebAuthnREST(t)
+		a, err := webauthntest.New(testWebAuthnOrigin)
+		require.NoError(t, err)
+		a.UserVerified = true
+		rows := registerTestPasskey(t, r, a, 0)
+		resp := startLogin(t, r, a)
+
+		mock.ExpectQuery(findPasskeyQuery).WithArgs(resp.ID).WillReturnRows(rows)
+		mock.ExpectExec(updatePasskeyUseQuery).WithArgs(1, resp.ID, 0).WillReturnResult(sqlmock.NewResult(0, 1))
+		expectTestUserByID(mock)
+		w := passkeyLogin(r, "/v1/auth/webauthn/login", PasskeyLoginRequest{Credential: *resp})
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var res TokenResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+		assert.Equal(t, []interface{}{"hwk", "mfa"}, accessTokenClaims(t, res.AccessToken)["amr"])
+	})
+
+	t.Run("Cloned authenticator", func(t *testing.T) {
+		r, mock, _, events := newTestWebAuthnREST(t)
+		a, err := webauthntest.New(testWebAuthnOrigin)
+		require.NoError(t, err)
+		// the original authenticator already signed 5 logins, the clone was copied before
+		rows := registerTestPasskey(t, r, a, 5)
+		resp := startLogin(t, r, a.Clone())
+
+		mock.ExpectQuery(findPasskeyQuery).WithArgs(resp.ID).WillReturnRows(rows)
+		w := passkeyLogin(r, "/v1/auth/webauthn/login", PasskeyLoginRequest{Credential: *resp})
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		checkResponseWithTestDataFile(t, w.Body.Bytes(), []string{"correlation_id"})
+		require.Len(t, events.Events(), 1)
+		assert.Equal(t, audit.EventPasskeyCloneDetected, events.Events()[0].Type)
+		assert.Equal(t, resp.ID, events.Events()[0].Subject)
+	})
+
+	t.Run("Concurrent login", func(t *testing.T) {
+		r, mock, _, events := newTestWebAuthnREST(t)
+		a, err := webauthntest.New(testWebAuthnOrigin)
+		require.NoError(t, err)
+		rows := registerTestPasskey(t, r, a, 0)
+		resp := startLogin(t, r, a)
+
+		mock.ExpectQuery(findPasskeyQuery).WithArgs(resp.ID).WillReturnRows(rows)
+		mock.ExpectExec(updatePasskeyUseQuery).WithArgs(1, resp.ID, 0).WillReturnResult(sqlmock.NewResult(0, 0))
+		w := passkeyLogin(r, "/v1/auth/webauthn/login", PasskeyLoginRequest{Credential: *resp})
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		assert.Len(t, events.Events(), 1)
+	})
+
+	t.Run("Unknown passkey", func(t *testing.T) {
+		r, mock, _, _ := newTestWebAuthnREST(t)
+		a, err := webauthntest.New(testWebAuthnOrigin)
+		require.NoError(t, err)
+		resp := startLogin(t, r, a)
+
+		mock.ExpectQuery(findPasskeyQuery).WithArgs(resp.ID).WillReturnRows(sqlmock.NewRows(passkeyColumns))
+		w := passkeyLogin(r, "/v1/auth/webauthn/login", PasskeyLoginRequest{Credential: *resp})
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		checkResponseWithTestDataFile(t, w.Body.Bytes(), []string{"correlation_id"})
+	})
+
+	t.Run("User handle of another user", func(t *testing.T) {
+		r, mock, _, _ := newTestWebAuthnREST(t)
+		a, err := webauthntest.New(testWebAuthnOrigin)
+		require.NoError(t, err)
+		rows := registerTestPasskey(t, r, a, 0)
+		a.UserHandle = []byte("2")
+		resp := startLogin(t, r, a)
+
+		mock.ExpectQuery(findPasskeyQuery).WithArgs(resp.ID).WillReturnRows(rows)
+		w := passkeyLogin(r, "/v1/auth/webauthn/login", PasskeyLoginRequest{Credential: *resp})
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+	})
+
+	t.Run("Second factor without user verification", func(t *testing.T) {
+		r, mock, _, _ := newTestWebAuthnREST(t)
+		r.cfg.MFA = testMFAConfig
+		a, err := webauthntest.New(testWebAuthnOrigin)
+		require.NoError(t, err)
+		rows := registerTestPasskey(t, r, a, 0)
+		resp := startLogin(t, r, a)
+
+		mock.ExpectQuery(findPasskeyQuery).WithArgs(resp.ID).WillReturnRows(rows)
+		mock.ExpectExec(updatePasskeyUseQuery).WithArgs(1, resp.ID, 0).WillReturnResult(sqlmock.NewResult(0, 1))
+		expectTestUserByID(mock)
+		expectTestTOTP(mock, testTOTP{encrypted: "secret"}, true)
+		w := passkeyLogin(r, "/v1/auth/webauthn/login", PasskeyLoginRequest{Credential: *resp})
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		checkResponseWithTestDataFile(t, w.Body.Bytes(), []string{"correlation_id"})
+	})
+
+	t.Run("Challenge store unavailable", func(t *testing.T) {
+		r, _, challenges, _ := newTestWebAuthnREST(t)
+		challenges.err = errors.New("connection refused")
+
+		w := passkeyLogin(r, "/v1/auth/webauthn/options", nil)
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	})
+}
+
+func TestREST_ManagePasskeys(t *testing.T) {
+	r, mock, _, events := newTestWebAuthnREST(t)
+	createdAt := time.Date(2022, 7, 1, 10, 0, 0, 0, time.UTC)
+	usedAt := time.Date(2022, 7, 2, 10, 0, 0, 0, time.UTC)
+
+	expectTestUserByID(mock)
+	mock.ExpectQuery(findPasskeysQuery).WithArgs(1).WillReturnRows(sqlmock.NewRows(passkeyColumns).
+		AddRow("Y3JlZC0x", 1, []byte("key"), 3, "usb nfc", nil, "YubiKey", createdAt, usedAt).
+		AddRow("Y3JlZC0y", 1, []byte("key"), 0, "internal", nil, "Laptop", createdAt, nil))
+	w := mfaRequest(t, r, http.MethodGet, "/v1/webauthn/credentials", "", nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	t.Run("List", func(t *testing.T) {
+		checkResponseWithTestDataFile(t, w.Body.Bytes(), nil)
+	})
+
+	expectTestUserByID(mock)
+	mock.ExpectExec(deletePasskeyQuery).WithArgs("Y3JlZC0x", 1).WillReturnResult(sqlmock.NewResult(0, 1))
+	w = mfaRequest(t, r, http.MethodDelete, "/v1/webauthn/credentials/Y3JlZC0x", "", nil)
+	assert.Equal(t, http.StatusNoContent, w.Code, w.Body.String())
+	require.Len(t, events.Events(), 1)
+	assert.Equal(t, audit.EventPasskeyDeleted, events.Events()[0].Type)
+
+	expectTestUserByID(mock)
+	mock.ExpectExec(deletePasskeyQuery).WithArgs("unknown", 1).WillReturnResult(sqlmock.NewResult(0, 0))
+	w = mfaRequest(t, r, http.MethodDelete, "/v1/webauthn/credentials/unknown", "", nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	t.Run("Delete unknown", func(t *testing.T) {
+		checkResponseWithTestDataFile(t, w.Body.Bytes(), []string{"correlation_id"})
+	})
+}
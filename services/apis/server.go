@@ -2,6 +2,7 @@ package server
 
 import (
 	"context"
+	"fmt"
 	"os"
 	"os/signal"
 	"syscall"
@@ -11,6 +12,9 @@ import (
 	"github.com/efimovalex/replaceme/adapters/redisdb"
 	"github.com/efimovalex/replaceme/config"
 	auth "github.com/efimovalex/replaceme/internal/auth0"
+	"github.com/efimovalex/replaceme/internal/mailer"
+	"github.com/efimovalex/replaceme/internal/tlsconfig"
+	"github.com/efimovalex/replaceme/internal/token"
 	"github.com/efimovalex/replaceme/services/apis/healthcheck"
 	"github.com/efimovalex/replaceme/services/apis/rest"
 	"github.com/efimovalex/replaceme/services/apis/swagger"
@@ -34,6 +38,8 @@ type Server struct {
 	REST        Service
 	HealthCheck Service
 	Swagger     Service
+	// MailWorker sends the queued emails, nil when the emails are sent synchronously
+	MailWorker Service
 
 	SwaggerUI Service
 
@@ -58,19 +64,49 @@ func New(cfg *config.Config) (*Server, error) {
 	if err != nil {
 		return nil, err
 	}
-	claims := auth.New(cfg.Auth.Domain, []string{cfg.Auth.Audience})
+	claims := auth.New(authProviders(cfg.Auth)...)
+	claims.Issuer, err = token.New(cfg.Auth.Local)
+	if err != nil {
+		return nil, err
+	}
+
+	transport, err := mailer.New(cfg.Mailer)
+	if err != nil {
+		return nil, fmt.Errorf("invalid mailer configuration: %w", err)
+	}
+	// with the queue, requests do not wait for the emails to be sent and failed sends are retried
+	var mail mailer.Mailer = transport
+	var mailWorker Service
+	if cfg.Mailer.Queue.Enable {
+		mail = mailer.NewQueue(redis)
+		mailWorker = mailer.NewWorker(redis, transport, cfg.Mailer.Queue)
+	}
 
-	rest, err := rest.New(db, mongodb, redis, claims, cfg.REST.Pretty, cfg.REST.Port)
+	rest, err := rest.New(cfg.REST, db, mongodb, redis, claims, mail)
 	if err != nil {
 		return nil, err
 	}
 
+	healthCheckTLS, err := tlsconfig.New(cfg.HealthCheck.TLS)
+	if err != nil {
+		return nil, fmt.Errorf("invalid healthcheck TLS configuration: %w", err)
+	}
+	swaggerTLS, err := tlsconfig.New(cfg.Swagger.TLS)
+	if err != nil {
+		return nil, fmt.Errorf("invalid swagger TLS configuration: %w", err)
+	}
+	apiScheme := "http"
+	if cfg.REST.TLS.CertFile != "" {
+		apiScheme = "https"
+	}
+
 	return &Server{
 		cfg:         cfg,
 		DB:          db,
 		REST:        rest,
-		HealthCheck: healthcheck.New(db, mongodb, redis, cfg.HealthCheck.Port),
-		Swagger:     swagger.New(cfg.Swagger.Port, cfg.REST.Port),
+		HealthCheck: healthcheck.New(db, mongodb, redis, cfg.HealthCheck.Port, healthCheckTLS),
+		Swagger:     swagger.New(cfg.Swagger.Port, fmt.Sprintf("%s://localhost:%s/", apiScheme, cfg.REST.Port), swaggerTLS),
+		MailWorker:  mailWorker,
 		sigChan:     make(chan os.Signal, 1),
 		logger:      log.With().Str("component", "server").Logger(),
 	}, nil
@@ -95,6 +131,11 @@ func (s *Server) Start(ctx context.Context) error {
 	errWg.Go(func() error {
 		return s.REST.Start(errCtx)
 	})
+	if s.MailWorker != nil {
+		errWg.Go(func() error {
+			return s.MailWorker.Start(errCtx)
+		})
+	}
 
 	errWg.Go(func() error {
 		<-ctx.Done()
@@ -102,6 +143,9 @@ func (s *Server) Start(ctx context.Context) error {
 		stop()
 		s.REST.Stop(ctx)
 		s.HealthCheck.Stop(ctx)
+		if s.MailWorker != nil {
+			s.MailWorker.Stop(ctx)
+		}
 		if s.cfg.Swagger.Enable {
 			s.Swagger.Stop(ctx)
 		}
@@ -122,3 +166,52 @@ func (s *Server) Start(ctx context.Context) error {
 
 	return nil
 }
+
+// authProviders returns the trusted issuers of the configuration, the listed ones or the one of the domain
+func authProviders(cfg config.Auth) []auth.Provider {
+	issuers := cfg.Issuers
+	if len(issuers) == 0 {
+		issuer := cfg.Issuer
+		if issuer == "" {
+			issuer = auth.Auth0(cfg.Domain).Issuer
+		}
+		issuers = config.Issuers{{Issuer: issuer, Audiences: []string{cfg.Audience}, JWKSURL: cfg.JWKSURL}}
+		if cfg.Introspection.URL != "" {
+			issuers[0].Introspection = &cfg.Introspection
+		}
+	}
+
+	providers := make([]auth.Provider, 0, len(issuers))
+	for _, iss := range issuers {
+		p := auth.Provider{
+			Issuer:     iss.Issuer,
+			Audience:   iss.Audiences,
+			JWKSURL:    iss.JWKSURL,
+			Algorithms: iss.Algorithms,
+			Claims:     auth.ClaimMapping(cfg.Claims),
+			KeysTTL:    cfg.KeysTTL,
+		}
+		if len(p.Algorithms) == 0 {
+			p.Algorithms = cfg.Algorithms
+		}
+		if iss.Claims != nil {
+			p.Claims = auth.ClaimMapping(*iss.Claims)
+		}
+		if iss.Introspection != nil {
+			introspection := auth.Introspection{
+				URL:              iss.Introspection.URL,
+				ClientID:         iss.Introspection.ClientID,
+				ClientSecret:     iss.Introspection.ClientSecret,
+				Opaque:           iss.Introspection.Opaque,
+				CacheTTL:         cfg.Introspection.CacheTTL,
+				NegativeCacheTTL: cfg.Introspection.NegativeCacheTTL,
+				BreakerThreshold: cfg.Introspection.BreakerThreshold,
+				BreakerCooldown:  cfg.Introspection.BreakerCooldown,
+			}
+			p.Introspection = &introspection
+		}
+		providers = append(providers, p)
+	}
+
+	return providers
+}
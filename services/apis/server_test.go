@@ -17,6 +17,8 @@ import (
 func TestNew(t *testing.T) {
 	cfg, err := config.Load()
 	assert.NoError(t, err)
+	cfg.Auth.Local.EphemeralKey = true
+	cfg.REST.MFA.EncryptionKey = "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="
 
 	tests := []struct {
 		name    string
@@ -3,85 +3,94 @@ package swagger
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"net"
 	"net/http"
 	"net/url"
+	"strings"
 	"time"
 
-	_ "github.com/efimovalex/replaceme/docs/swagger"
+	docs "github.com/efimovalex/replaceme/docs/swagger"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	httpSwagger "github.com/swaggo/http-swagger"
+	"github.com/swaggo/swag"
 )
 
+// versions are the swagger documents of the API versions, in release order
+var versions = []struct {
+	name string
+	spec *swag.Spec
+}{
+	{name: "v1", spec: docs.SwaggerInfov1},
+	{name: "v2", spec: docs.SwaggerInfov2},
+}
+
 // S is a swagger service implementation
 type S struct {
 	logger zerolog.Logger
 	srv    *http.Server
 }
 
-// New creates a new swagger service
-func New(port string, apiPort string) *S {
+// New creates a new swagger service documenting the API served at apiURL, e.g. https://localhost:8080/.
+// The service is served over TLS when tlsConfig is not nil.
+func New(port string, apiURL string, tlsConfig *tls.Config) *S {
 	h := &S{
-		srv: &http.Server{Addr: "0.0.0.0:" + port},
+		srv: &http.Server{Addr: "0.0.0.0:" + port, TLSConfig: tlsConfig},
 
 		logger: log.With().Str("component", "Swagger").Logger(),
 	}
 
-	uri, _ := url.Parse(fmt.Sprintf("http://localhost:%s/", apiPort))
+	uri, _ := url.Parse(apiURL)
 
-	h.srv.Handler = httpSwagger.Handler(
-		httpSwagger.URL("0.0.0.0:"+port+"/swagger/doc.json"), //The url pointing to API definition
+	mux := http.NewServeMux()
+	urls := make([]string, 0, len(versions))
+	for i := len(versions) - 1; i >= 0; i-- {
+		v := versions[i]
+		// the specs are served with the host of the API instead of the host of the swagger service
+		v.spec.Host = uri.Host
+		v.spec.Schemes = []string{uri.Scheme}
+
+		mux.Handle("/swagger/"+v.name+"/", httpSwagger.Handler(httpSwagger.InstanceName(v.name)))
+		urls = append(urls, fmt.Sprintf(`{url: "/swagger/%s/doc.json", name: "%s"}`, v.name, v.name))
+	}
+
+	mux.Handle("/swagger/", httpSwagger.Handler(
 		httpSwagger.DeepLinking(true),
 		httpSwagger.DocExpansion("none"),
 		httpSwagger.PersistAuthorization(true),
-		httpSwagger.BeforeScript(`const UrlMutatorPlugin = (system) => ({
-			rootInjects: {
-			  setScheme: (scheme) => {
-				const jsonSpec = system.getState().toJSON().spec.json;
-				const schemes = Array.isArray(scheme) ? scheme : [scheme];
-				const newJsonSpec = Object.assign({}, jsonSpec, { schemes });
-		  
-				return system.specActions.updateJsonSpec(newJsonSpec);
-			  },
-			  setHost: (host) => {
-				const jsonSpec = system.getState().toJSON().spec.json;
-				const newJsonSpec = Object.assign({}, jsonSpec, { host });
-		  
-				return system.specActions.updateJsonSpec(newJsonSpec);
-			  },
-			  setBasePath: (basePath) => {
-				const jsonSpec = system.getState().toJSON().spec.json;
-				const newJsonSpec = Object.assign({}, jsonSpec, { basePath });
-		  
-				return system.specActions.updateJsonSpec(newJsonSpec);
-			  }
-			}
-		  });`),
-		httpSwagger.Plugins([]string{"UrlMutatorPlugin"}),
+		// the spec selector of the top bar switches between the versions, the latest is displayed first
 		httpSwagger.UIConfig(map[string]string{
-			"onComplete": fmt.Sprintf(`() => {
-			window.ui.setScheme('%s');
-			window.ui.setHost('%s');
-			window.ui.setBasePath('%s');
-		}`, uri.Scheme, uri.Host, uri.Path),
+			"urls":               "[" + strings.Join(urls, ", ") + "]",
+			`"urls.primaryName"`: fmt.Sprintf("%q", versions[len(versions)-1].name),
 		}),
-	)
+	))
+	h.srv.Handler = mux
 
 	return h
 }
 
 // Start starts the swagger service
 func (h *S) Start(ctx context.Context) error {
-	h.logger.Info().Msgf("Starting swagger service http://%s", h.srv.Addr)
-	h.logger.Info().Msgf("Documentation url:  http://%s/swagger/index.html", h.srv.Addr)
+	scheme := "http"
+	if h.srv.TLSConfig != nil {
+		scheme = "https"
+	}
+	h.logger.Info().Msgf("Starting swagger service %s://%s", scheme, h.srv.Addr)
+	h.logger.Info().Msgf("Documentation url:  %s://%s/swagger/index.html", scheme, h.srv.Addr)
 	lc := net.ListenConfig{}
 	ln, err := lc.Listen(ctx, "tcp", h.srv.Addr)
 	if err != nil {
 		return err
 	}
-	if err := h.srv.Serve(ln); err != http.ErrServerClosed {
+	if h.srv.TLSConfig != nil {
+		// the certificates are provided by the TLS config
+		err = h.srv.ServeTLS(ln, "", "")
+	} else {
+		err = h.srv.Serve(ln)
+	}
+	if err != http.ErrServerClosed {
 		// Error starting or closing listener:
 		h.logger.Fatal().Msgf("Swagger server error: %v", err)
 
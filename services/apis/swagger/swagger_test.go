@@ -2,19 +2,50 @@ package swagger
 
 import (
 	"context"
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
 	"time"
 
-	_ "github.com/efimovalex/replaceme/docs/swagger"
 	"github.com/stretchr/testify/assert"
 )
 
+func TestS_Versions(t *testing.T) {
+	h := New("8085", "http://localhost:3000/", nil)
+
+	for _, version := range []string{"v1", "v2"} {
+		t.Run(version, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			h.srv.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/swagger/"+version+"/doc.json", nil))
+
+			assert.Equal(t, http.StatusOK, w.Code)
+			var doc struct {
+				Host     string   `json:"host"`
+				BasePath string   `json:"basePath"`
+				Schemes  []string `json:"schemes"`
+			}
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &doc))
+			assert.Equal(t, "localhost:3000", doc.Host)
+			assert.Equal(t, "/"+version, doc.BasePath)
+			assert.Equal(t, []string{"http"}, doc.Schemes)
+		})
+	}
+
+	t.Run("Version switcher", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		h.srv.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/swagger/index.html", nil))
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), `urls: [{url: "/swagger/v2/doc.json", name: "v2"}, {url: "/swagger/v1/doc.json", name: "v1"}]`)
+		assert.Contains(t, w.Body.String(), `"urls.primaryName": "v2"`)
+	})
+}
+
 func TestS_StopGraceful(t *testing.T) {
 
-	h := New("8085", "3000")
+	h := New("8085", "http://localhost:3000/", nil)
 
 	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
@@ -39,7 +70,7 @@ func TestS_StopGraceful(t *testing.T) {
 }
 
 func TestS_StopError(t *testing.T) {
-	h := New("8085", "3000")
+	h := New("8085", "http://localhost:3000/", nil)
 
 	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
@@ -68,7 +99,7 @@ func TestS_Start(t *testing.T) {
 		w.WriteHeader(http.StatusOK)
 	}))
 	t.Log(testServer.URL)
-	h := New("not:a:port", "8080")
+	h := New("not:a:port", "http://localhost:8080/", nil)
 
 	err := h.Start(context.Background())
 